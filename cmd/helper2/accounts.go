@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+	"github.com/rfielding/helper2/internal/server"
+)
+
+// Every account is active, suspended or banned. Suspended users can still
+// sign in and talk to the assistant, to appeal, but they're left out of
+// matching and the directory and can't send messages or contact requests.
+// A suspension lasts until an admin reinstates the user, or for a set
+// number of days. Banned users are turned away everywhere but their data
+// export. Admins change a user's status with a reason code, and users are
+// suspended without one once enough reports against them are confirmed or,
+// if accounts.suspend_after_strikes is set, they collect enough moderation
+// strikes. Active users have no row in suspensions.
+
+const accountsSchema = `
+	CREATE TABLE IF NOT EXISTS suspensions (
+		email TEXT PRIMARY KEY,
+		reason TEXT,
+		report_id TEXT,
+		suspended_by TEXT,
+		created_at TIMESTAMP,
+		status TEXT,
+		note TEXT,
+		ends_at TIMESTAMP
+	)
+`
+
+// migrateSuspensions adds the columns for bans and timed suspensions to
+// suspensions tables created before them
+func migrateSuspensions(db *instrumentedDB) error {
+	for _, c := range [][2]string{
+		{"status", "TEXT DEFAULT 'suspended'"},
+		{"note", "TEXT DEFAULT ''"},
+		{"ends_at", "TIMESTAMP"},
+	} {
+		if err := addColumn(db, "suspensions", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Account statuses
+const (
+	AccountActive    = "active"
+	AccountSuspended = "suspended"
+	AccountBanned    = "banned"
+)
+
+// systemActor is who automatic status changes are recorded as
+const systemActor = "system"
+
+// accountReasons are the reason codes for a status change: what users can
+// report each other for, and what only the team or the system gives
+var accountReasons = append(append([]reportReason(nil), reportReasons...),
+	reportReason{"repeated_reports", "Several confirmed reports"},
+	reportReason{"strikes", "Repeated moderation strikes"},
+	reportReason{"fake_profile", "Fake or misleading profile"},
+	reportReason{"payment_fraud", "Payment fraud"},
+	reportReason{"terms", "Breaking the terms of service"},
+	reportReason{"appeal", "Appeal accepted"},
+)
+
+var errSuspended = errors.New("your account is suspended")
+
+const accountBannedMessage = "This account has been closed, so the assistant can't help with it any more."
+
+// Suspension is a user who isn't active: suspended, until EndsAt if set,
+// or banned
+type Suspension struct {
+	Email       string    `json:"email"`
+	Status      string    `json:"status"`
+	Reason      string    `json:"reason"`
+	Note        string    `json:"note,omitempty"`
+	ReportID    string    `json:"report_id,omitempty"`
+	SuspendedBy string    `json:"suspended_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	EndsAt      time.Time `json:"ends_at,omitempty"`
+}
+
+// current reports whether the suspension still applies
+func (s *Suspension) current() bool {
+	return s.Status == AccountBanned || s.EndsAt.IsZero() || time.Now().Before(s.EndsAt)
+}
+
+func validAccountReason(code string) bool {
+	for _, r := range accountReasons {
+		if r.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// querySuspensions returns the suspensions matching a condition that
+// still apply, the most recent first. The columns are selected in table
+// order, which chai returns them in when sorting.
+func (app *App) querySuspensions(where string, args ...interface{}) ([]Suspension, error) {
+	result, err := app.db.Query(`
+		SELECT email, reason, report_id, suspended_by, created_at, status, note, ends_at
+		FROM suspensions `+where+` ORDER BY created_at DESC
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query suspensions: %v", err)
+	}
+	defer result.Close()
+
+	suspensions := []Suspension{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var s Suspension
+		if err := r.Scan(&s.Email, &s.Reason, &s.ReportID, &s.SuspendedBy, &s.CreatedAt,
+			&s.Status, &s.Note, &s.EndsAt); err != nil {
+			return fmt.Errorf("failed to scan suspension: %v", err)
+		}
+		if s.Status == "" {
+			s.Status = AccountSuspended
+		}
+		if s.current() {
+			suspensions = append(suspensions, s)
+		}
+		return nil
+	})
+	return suspensions, err
+}
+
+// GetSuspension returns what keeps email from being active, or nil if
+// they are
+func (app *App) GetSuspension(email string) (*Suspension, error) {
+	suspensions, err := app.querySuspensions("WHERE email = ?", email)
+	if err != nil || len(suspensions) == 0 {
+		return nil, err
+	}
+	return &suspensions[0], nil
+}
+
+// AccountStatus returns whether email is active, suspended or banned
+func (app *App) AccountStatus(email string) string {
+	s, err := app.GetSuspension(email)
+	if err != nil {
+		log.Printf("Error checking account status of %s: %v", email, err)
+	}
+	if s == nil {
+		return AccountActive
+	}
+	return s.Status
+}
+
+// Suspended reports whether email is suspended or banned
+func (app *App) Suspended(email string) bool {
+	return app.AccountStatus(email) != AccountActive
+}
+
+// Banned reports whether email is banned
+func (app *App) Banned(email string) bool {
+	return app.AccountStatus(email) == AccountBanned
+}
+
+// Suspensions lists the users who aren't active, with one status or both
+// when status is empty
+func (app *App) Suspensions(status string) ([]Suspension, error) {
+	all, err := app.querySuspensions("")
+	if err != nil || status == "" {
+		return all, err
+	}
+	// Filtered here since rows from before bans have no status
+	kept := []Suspension{}
+	for _, s := range all {
+		if s.Status == status {
+			kept = append(kept, s)
+		}
+	}
+	return kept, nil
+}
+
+// restrictedAccounts returns everyone suspended or banned
+func (app *App) restrictedAccounts() (map[string]bool, error) {
+	suspensions, err := app.querySuspensions("")
+	if err != nil {
+		return nil, err
+	}
+	restricted := make(map[string]bool, len(suspensions))
+	for _, s := range suspensions {
+		restricted[s.Email] = true
+	}
+	return restricted, nil
+}
+
+// SetAccountStatus changes a user's status and tells them. Suspending for
+// days above zero lifts the suspension on its own afterwards; active
+// reinstates the user.
+func (app *App) SetAccountStatus(email, status, reason, note, reportID, by string, days int) error {
+	if email == "" {
+		return fmt.Errorf("no such user")
+	}
+	if !validAccountReason(reason) {
+		return fmt.Errorf("unknown reason %q", reason)
+	}
+	if days < 0 {
+		return fmt.Errorf("days can't be negative")
+	}
+
+	var message string
+	switch status {
+	case AccountActive:
+		if err := app.db.Exec("DELETE FROM suspensions WHERE email = ?", email); err != nil {
+			return fmt.Errorf("failed to remove suspension: %v", err)
+		}
+		message = "Your account has been reinstated. You can be matched and message other users again."
+
+	case AccountSuspended, AccountBanned:
+		var endsAt time.Time
+		message = "Your account has been suspended, so you can't be matched or send messages for now. Reply here if you think this is a mistake."
+		if status == AccountBanned {
+			message = "Your account has been closed for breaking our rules."
+		} else if days > 0 {
+			endsAt = time.Now().AddDate(0, 0, days)
+			message = fmt.Sprintf("Your account has been suspended until %s, so you can't be matched or send messages until then. Reply here if you think this is a mistake.",
+				endsAt.Format("Jan 2"))
+		}
+		err := app.db.Exec(`
+			INSERT INTO suspensions (email, status, reason, note, report_id, suspended_by, created_at, ends_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT DO REPLACE
+		`, email, status, reason, strings.TrimSpace(note), reportID, by, time.Now(), endsAt)
+		if err != nil {
+			return fmt.Errorf("failed to store suspension: %v", err)
+		}
+
+	default:
+		return fmt.Errorf("status must be %s, %s or %s", AccountActive, AccountSuspended, AccountBanned)
+	}
+
+	// Match cards rendered before now include or leave out this user
+	app.invalidateToolCaches()
+	return app.AddMessageWithRecipient(email, "assistant", message, adminThread)
+}
+
+// Suspend suspends email until reinstated, unless they're already
+// suspended or banned
+func (app *App) Suspend(email, reason, reportID, by string) error {
+	if app.Suspended(email) {
+		return nil
+	}
+	return app.SetAccountStatus(email, AccountSuspended, reason, "", reportID, by, 0)
+}
+
+// suspendRepeatOffender suspends a user once accounts.suspend_after_reports
+// reports against them have been confirmed
+func (app *App) suspendRepeatOffender(email, reportID string) error {
+	limit := config.Accounts.SuspendAfterReports
+	if limit <= 0 {
+		return nil
+	}
+	confirmed, err := app.ConfirmedReports(email)
+	if err != nil || confirmed < limit || app.Suspended(email) {
+		return err
+	}
+	if err := app.Suspend(email, "repeated_reports", reportID, systemActor); err != nil {
+		return err
+	}
+	app.Audit(nil, systemActor, "account.suspended", email, fmt.Sprintf("%d confirmed reports", confirmed))
+	return nil
+}
+
+// suspendForStrikes suspends a user once they have
+// accounts.suspend_after_strikes moderation strikes
+func (app *App) suspendForStrikes(email string) {
+	limit := config.Accounts.SuspendAfterStrikes
+	if limit <= 0 {
+		return
+	}
+	strikes, err := app.StrikeCount(email)
+	if err != nil {
+		log.Printf("Error counting strikes for %s: %v", email, err)
+		return
+	}
+	if strikes < limit || app.Suspended(email) {
+		return
+	}
+	if err := app.Suspend(email, "strikes", "", systemActor); err != nil {
+		log.Printf("Error suspending %s for strikes: %v", email, err)
+		return
+	}
+	app.Audit(nil, systemActor, "account.suspended", email, fmt.Sprintf("%d strikes", strikes))
+}
+
+// refuseBanned turns away requests made as a banned user, apart from
+// their data export and the pages anyone can see. Admins viewing as the
+// user get through.
+func refuseBanned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.IsWebhook(r.URL.Path) || strings.HasPrefix(r.URL.Path, "/static/") ||
+			strings.HasPrefix(r.URL.Path, "/export") || impersonationFrom(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			email = r.FormValue("email")
+		}
+		if email != "" && !isAdmin(email) && chatRoom.Banned(email) {
+			http.Error(w, "This account has been closed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// applyAccountStatus changes a user's status for an admin and audits it
+func applyAccountStatus(r *http.Request, actor, target, status, reason, note string, days int) error {
+	if err := chatRoom.SetAccountStatus(target, status, reason, note, "", actor, days); err != nil {
+		return err
+	}
+	detail := reason
+	if note != "" {
+		detail += ": " + note
+	}
+	chatRoom.Audit(r, actor, "account."+status, target, detail)
+	return nil
+}
+
+// handleSuspensionsAPI lists users who aren't active (GET, optionally
+// with status), changes a user's status from a JSON body {"target",
+// "status": "active"|"suspended"|"banned", "reason", "note", "days"}
+// (POST), and reinstates one (DELETE with target)
+func handleSuspensionsAPI(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		suspensions, err := chatRoom.Suspensions(r.FormValue("status"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, suspensions)
+
+	case "POST":
+		var req struct {
+			Target string `json:"target"`
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+			Note   string `json:"note"`
+			Days   int    `json:"days"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := applyAccountStatus(r, actor, req.Target, req.Status, req.Reason, req.Note, req.Days); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		target := r.FormValue("target")
+		reason := r.FormValue("reason")
+		if reason == "" {
+			reason = "other"
+		}
+		if err := applyAccountStatus(r, actor, target, AccountActive, reason, "", 0); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
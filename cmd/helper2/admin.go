@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// isAdmin reports whether email is listed in the ADMIN_EMAILS environment
+// variable (comma separated)
+func isAdmin(email string) bool {
+	if email == "" {
+		return false
+	}
+	for _, admin := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if strings.EqualFold(strings.TrimSpace(admin), email) {
+			return true
+		}
+	}
+	return false
+}
+
+// signedInAdmin returns the email of the admin a request's session was
+// signed in as, or "". The email a request names is only a claim, so
+// admin access comes from the session alone.
+func signedInAdmin(r *http.Request) string {
+	if email := signedInEmail(r); isAdmin(email) {
+		return email
+	}
+	return ""
+}
+
+// requireAdmin writes a 403 and returns "" unless the request was made in
+// an admin's session, whose email it returns
+func requireAdmin(w http.ResponseWriter, r *http.Request) string {
+	email := signedInAdmin(r)
+	if email == "" {
+		http.Error(w, "Admin access required; sign in at /login", http.StatusForbidden)
+		return ""
+	}
+	return email
+}
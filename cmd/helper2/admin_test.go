@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// signIn opens a session for email and returns its token
+func signIn(t *testing.T, app *App, email string) string {
+	t.Helper()
+	if err := app.SendSignInLink(email); err != nil {
+		t.Fatal(err)
+	}
+	s, err := app.RedeemSignInLink(signInLinkToken(t, app, email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Token
+}
+
+func TestAdminRoutesNeedAdminSession(t *testing.T) {
+	t.Setenv("ADMIN_EMAILS", "admin@example.com")
+	app := newTestApp(t)
+	handler := newRouter()
+
+	get := func(session string) int {
+		req := httptest.NewRequest("GET", "/api/v1/admin/audit?email=admin@example.com", nil)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: loginCookie, Value: session})
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get(""); code != http.StatusUnauthorized {
+		t.Errorf("naming an admin's email without a session: got %d, want 403", code)
+	}
+	if code := get(signIn(t, app, "user@example.com")); code != http.StatusForbidden {
+		t.Errorf("a non-admin's session: got %d, want 403", code)
+	}
+	if code := get(signIn(t, app, "admin@example.com")); code != http.StatusOK {
+		t.Errorf("an admin's session: got %d, want 200", code)
+	}
+}
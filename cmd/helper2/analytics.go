@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// analyticsWeeks is how many weeks of history the funnel report covers
+const analyticsWeeks = 12
+
+const analyticsSchema = `
+	CREATE TABLE IF NOT EXISTS analytics_snapshots (
+		computed_at TIMESTAMP PRIMARY KEY,
+		report TEXT
+	)
+`
+
+// WeeklyStats counts activity in the week starting WeekStart (a Monday)
+type WeeklyStats struct {
+	WeekStart  time.Time `json:"week_start"`
+	Caregivers int       `json:"caregivers"`
+	Patients   int       `json:"patients"`
+	Messages   int       `json:"messages"`
+}
+
+// FunnelReport summarises how users move from registering to an accepted match
+type FunnelReport struct {
+	ComputedAt              time.Time     `json:"computed_at"`
+	Weeks                   []WeeklyStats `json:"weeks"`
+	Patients                int           `json:"patients"`
+	PatientsMatched         int           `json:"patients_matched"`
+	MatchedRate             float64       `json:"matched_rate"`
+	MedianHoursToFirstMatch float64       `json:"median_hours_to_first_match"`
+	MeanHoursToFirstMatch   float64       `json:"mean_hours_to_first_match"`
+	Matches                 int           `json:"matches"`
+	MatchesAccepted         int           `json:"matches_accepted"`
+	AcceptanceRate          float64       `json:"acceptance_rate"`
+	// Waitlist counts patients waiting for a caregiver, by region
+	Waitlist []WaitlistRegion `json:"waitlist"`
+}
+
+// weekStart returns midnight UTC on the Monday of t's week
+func weekStart(t time.Time) time.Time {
+	t = t.UTC()
+	offset := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.UTC)
+}
+
+// scanTimes calls fn with every time returned by a single-column query
+func (app *App) scanTimes(query string, fn func(time.Time), args ...interface{}) error {
+	result, err := app.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to run %q: %v", query, err)
+	}
+	defer result.Close()
+	return result.Iterate(func(r *chai.Row) error {
+		var t time.Time
+		if err := r.Scan(&t); err != nil {
+			return err
+		}
+		fn(t)
+		return nil
+	})
+}
+
+// ComputeFunnelReport runs the funnel queries against the current data
+func (app *App) ComputeFunnelReport() (*FunnelReport, error) {
+	now := time.Now()
+	report := &FunnelReport{ComputedAt: now}
+
+	first := weekStart(now).AddDate(0, 0, -7*(analyticsWeeks-1))
+	weeks := make(map[time.Time]*WeeklyStats)
+	for i := 0; i < analyticsWeeks; i++ {
+		start := first.AddDate(0, 0, 7*i)
+		report.Weeks = append(report.Weeks, WeeklyStats{WeekStart: start})
+	}
+	for i := range report.Weeks {
+		weeks[report.Weeks[i].WeekStart] = &report.Weeks[i]
+	}
+	bucket := func(t time.Time) *WeeklyStats { return weeks[weekStart(t)] }
+
+	err := app.scanTimes("SELECT created_at FROM caregivers WHERE created_at >= ?", func(t time.Time) {
+		if w := bucket(t); w != nil {
+			w.Caregivers++
+		}
+	}, first)
+	if err != nil {
+		return nil, err
+	}
+	err = app.scanTimes("SELECT created_at FROM chat_history WHERE created_at >= ?", func(t time.Time) {
+		if w := bucket(t); w != nil {
+			w.Messages++
+		}
+	}, first)
+	if err != nil {
+		return nil, err
+	}
+
+	// Patients are needed in full for the match funnel, not just recent weeks
+	registered := make(map[string]time.Time)
+	result, err := app.db.Query("SELECT email, created_at FROM patients")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query patients: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		var createdAt time.Time
+		if err := r.Scan(&email, &createdAt); err != nil {
+			return err
+		}
+		registered[email] = createdAt
+		if w := bucket(createdAt); w != nil {
+			w.Patients++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate patients: %v", err)
+	}
+	report.Patients = len(registered)
+
+	firstMatch := make(map[string]time.Time)
+	result, err = app.db.Query("SELECT patient_email, created_at FROM matches")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query matches: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		var createdAt time.Time
+		if err := r.Scan(&email, &createdAt); err != nil {
+			return err
+		}
+		report.Matches++
+		if t, ok := firstMatch[email]; !ok || createdAt.Before(t) {
+			firstMatch[email] = createdAt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate matches: %v", err)
+	}
+
+	var hours []float64
+	for email, matchedAt := range firstMatch {
+		registeredAt, ok := registered[email]
+		if !ok {
+			continue
+		}
+		report.PatientsMatched++
+		if matchedAt.After(registeredAt) {
+			hours = append(hours, matchedAt.Sub(registeredAt).Hours())
+		} else {
+			hours = append(hours, 0)
+		}
+	}
+	if report.Patients > 0 {
+		report.MatchedRate = float64(report.PatientsMatched) / float64(report.Patients)
+	}
+	if len(hours) > 0 {
+		sort.Float64s(hours)
+		total := 0.0
+		for _, h := range hours {
+			total += h
+		}
+		report.MeanHoursToFirstMatch = total / float64(len(hours))
+		mid := len(hours) / 2
+		if len(hours)%2 == 0 {
+			report.MedianHoursToFirstMatch = (hours[mid-1] + hours[mid]) / 2
+		} else {
+			report.MedianHoursToFirstMatch = hours[mid]
+		}
+	}
+
+	accepted := make(map[[2]string]bool)
+	result, err = app.db.Query("SELECT caregiver_email, patient_email FROM match_events WHERE to_status = ?",
+		MatchAccepted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query accepted matches: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		var pair [2]string
+		if err := r.Scan(&pair[0], &pair[1]); err != nil {
+			return err
+		}
+		accepted[pair] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate accepted matches: %v", err)
+	}
+	report.MatchesAccepted = len(accepted)
+	if report.Matches > 0 {
+		report.AcceptanceRate = float64(report.MatchesAccepted) / float64(report.Matches)
+	}
+
+	if report.Waitlist, err = app.WaitlistByRegion(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// RefreshFunnelReport computes a new report and stores it as the latest snapshot
+func (app *App) RefreshFunnelReport() (*FunnelReport, error) {
+	report, err := app.ComputeFunnelReport()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %v", err)
+	}
+	err = app.db.Exec("INSERT INTO analytics_snapshots (computed_at, report) VALUES (?, ?)",
+		report.ComputedAt, string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to store report: %v", err)
+	}
+	return report, nil
+}
+
+// LatestFunnelReport returns the most recent snapshot, computing one if
+// none has been stored yet
+func (app *App) LatestFunnelReport() (*FunnelReport, error) {
+	result, err := app.db.Query("SELECT report FROM analytics_snapshots ORDER BY computed_at DESC LIMIT 1")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query analytics snapshots: %v", err)
+	}
+	defer result.Close()
+
+	var data string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&data)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan analytics snapshot: %v", err)
+	}
+	if data == "" {
+		return app.RefreshFunnelReport()
+	}
+
+	var report FunnelReport
+	if err := json.Unmarshal([]byte(data), &report); err != nil {
+		return nil, fmt.Errorf("failed to decode analytics snapshot: %v", err)
+	}
+	return &report, nil
+}
+
+// loadFunnelReport returns the latest report, or a fresh one when the
+// request asks for refresh=true
+func loadFunnelReport(r *http.Request) (*FunnelReport, error) {
+	if r.FormValue("refresh") == "true" {
+		return chatRoom.RefreshFunnelReport()
+	}
+	return chatRoom.LatestFunnelReport()
+}
+
+// handleAnalyticsAPI serves the funnel report as JSON
+func handleAnalyticsAPI(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+	report, err := loadFunnelReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+const adminAnalyticsTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Matching Funnel</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Matching Funnel</h1>
+            <div class="app-description">Computed {{.Report.ComputedAt.Format "Jan 2 2006 3:04 PM"}} ·
+                <a href="analytics?email={{.UserEmail}}&refresh=true">Recompute now</a></div>
+        </div>
+        <table class="query-results">
+            <tr><th>Patients registered</th><td>{{.Report.Patients}}</td></tr>
+            <tr><th>Patients with at least one match</th><td>{{.Report.PatientsMatched}} ({{printf "%.1f" (percent .Report.MatchedRate)}}%)</td></tr>
+            <tr><th>Time to first match (median)</th><td>{{printf "%.1f" .Report.MedianHoursToFirstMatch}} hours</td></tr>
+            <tr><th>Time to first match (mean)</th><td>{{printf "%.1f" .Report.MeanHoursToFirstMatch}} hours</td></tr>
+            <tr><th>Matches proposed</th><td>{{.Report.Matches}}</td></tr>
+            <tr><th>Matches accepted</th><td>{{.Report.MatchesAccepted}} ({{printf "%.1f" (percent .Report.AcceptanceRate)}}%)</td></tr>
+        </table>
+        <h3>Weekly activity</h3>
+        <table class="query-results">
+            <tr><th>Week of</th><th>Caregivers</th><th>Patients</th><th>Messages</th></tr>
+            {{range .Report.Weeks}}
+            <tr><td>{{.WeekStart.Format "Jan 2 2006"}}</td><td>{{.Caregivers}}</td><td>{{.Patients}}</td><td>{{.Messages}}</td></tr>
+            {{end}}
+        </table>
+        <h3>Waitlist</h3>
+        {{if .Report.Waitlist}}
+        <table class="query-results">
+            <tr><th>Region</th><th>Patients waiting</th><th>Waiting since</th></tr>
+            {{range .Report.Waitlist}}
+            <tr><td>{{.Region}}</td><td>{{.Waiting}}</td><td>{{.Since.Format "Jan 2 2006"}}</td></tr>
+            {{end}}
+        </table>
+        {{else}}
+        <p>No patients are waiting for a caregiver.</p>
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// handleAdminAnalytics renders the funnel report
+func handleAdminAnalytics(w http.ResponseWriter, r *http.Request) {
+	email := requireAdmin(w, r)
+	if email == "" {
+		return
+	}
+	report, err := loadFunnelReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "analytics", adminAnalyticsTemplate, struct {
+		UserEmail string
+		Report    *FunnelReport
+	}{email, report})
+}
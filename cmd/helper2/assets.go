@@ -0,0 +1,78 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// staticHandler serves the embedded static directory, so the binary runs
+// from any working directory
+func staticHandler() http.Handler {
+	sub, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		// The directory is embedded at build time, so this can't happen
+		panic(err)
+	}
+	return withStaticETags(sub, http.FileServer(http.FS(sub)))
+}
+
+// avatarColors are background colours for generated avatars; each user
+// always gets the same one
+var avatarColors = []string{
+	"#4CAF50", "#2196F3", "#9C27B0", "#FF9800", "#E91E63",
+	"#009688", "#3F51B5", "#795548", "#607D8B", "#F44336",
+}
+
+// avatarInitials picks up to two initials from a name, falling back to the
+// local part of an email address
+func avatarInitials(name string) string {
+	if at := strings.Index(name, "@"); at >= 0 {
+		name = strings.NewReplacer(".", " ", "_", " ", "-", " ").Replace(name[:at])
+	}
+	var initials []rune
+	for _, word := range strings.Fields(name) {
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				initials = append(initials, unicode.ToUpper(r))
+				break
+			}
+		}
+		if len(initials) == 2 {
+			break
+		}
+	}
+	if len(initials) == 0 {
+		return "?"
+	}
+	return string(initials)
+}
+
+// generateAvatarSVG renders a round avatar with the initials of name on a
+// colour picked from seed
+func generateAvatarSVG(name, seed string) []byte {
+	h := fnv.New32a()
+	h.Write([]byte(seed))
+	color := avatarColors[h.Sum32()%uint32(len(avatarColors))]
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="64" height="64" viewBox="0 0 64 64">
+<circle cx="32" cy="32" r="32" fill="%s"/>
+<text x="32" y="32" dy=".35em" text-anchor="middle" font-family="Arial, sans-serif" font-size="26" fill="#ffffff">%s</text>
+</svg>
+`, color, html.EscapeString(avatarInitials(name))))
+}
+
+// avatarImg is the markup for another user's avatar on a match card. It
+// links by avatar id, not email, since cards may hide the email.
+func avatarImg(email, name string) string {
+	return fmt.Sprintf("<img src='avatar?id=%s&name=%s' alt='Avatar' class='match-avatar'>",
+		userKey(email), html.EscapeString(url.QueryEscape(name)))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chaisql/chai"
+	"github.com/rfielding/helper2/internal/server"
+)
+
+// The audit log records what admins do to other people's accounts. It's
+// kept apart from the application log so it survives log rotation and can
+// be searched by user.
+
+const auditLogSchema = `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id TEXT PRIMARY KEY,
+		actor TEXT,
+		action TEXT,
+		subject TEXT,
+		detail TEXT,
+		request_id TEXT,
+		created_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_subject ON audit_log(subject);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_created ON audit_log(created_at)
+`
+
+// AuditEntry is one recorded admin action. Subject is the user it was
+// done to.
+type AuditEntry struct {
+	ID        string    `json:"id"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Subject   string    `json:"subject"`
+	Detail    string    `json:"detail,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// maxAuditEntries caps one audit API response
+const maxAuditEntries = 500
+
+// Audit records an action. A failure is logged rather than returned, so
+// it never undoes the action it describes. r is nil for actions the app
+// takes on its own.
+func (app *App) Audit(r *http.Request, actor, action, subject, detail string) {
+	var id string
+	if r != nil {
+		id = server.RequestID(r)
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	err := app.db.Exec(`
+		INSERT INTO audit_log (id, actor, action, subject, detail, request_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, hex.EncodeToString(b), actor, action, subject, detail, id, time.Now())
+	if err != nil {
+		log.Printf("Error writing audit entry %s by %s on %s: %v", action, actor, subject, err)
+	}
+}
+
+// AuditEntries returns the newest entries, up to limit, optionally only
+// those by actor or about subject
+func (app *App) AuditEntries(actor, subject string, limit int) ([]AuditEntry, error) {
+	query := "SELECT id, actor, action, subject, detail, request_id, created_at FROM audit_log"
+	var args []interface{}
+	switch {
+	case actor != "" && subject != "":
+		query += " WHERE actor = ? AND subject = ?"
+		args = append(args, actor, subject)
+	case actor != "":
+		query += " WHERE actor = ?"
+		args = append(args, actor)
+	case subject != "":
+		query += " WHERE subject = ?"
+		args = append(args, subject)
+	}
+	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT %d", limit)
+
+	result, err := app.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %v", err)
+	}
+	defer result.Close()
+
+	var entries []AuditEntry
+	err = result.Iterate(func(r *chai.Row) error {
+		var e AuditEntry
+		if err := r.Scan(&e.ID, &e.Actor, &e.Action, &e.Subject, &e.Detail, &e.RequestID, &e.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan audit entry: %v", err)
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// handleAuditAPI lists audit entries, newest first, filtered by actor
+// and/or subject, up to limit (default and maximum 500)
+func handleAuditAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := maxAuditEntries
+	if n, err := strconv.Atoi(r.FormValue("limit")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	entries, err := chatRoom.AuditEntries(r.FormValue("actor"), r.FormValue("subject"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// A caregiver can stop being matched without deleting their profile:
+// paused until they resume, or away until a date, after which they're
+// matched again without doing anything.
+
+const caregiverAvailabilitySchema = `
+	CREATE TABLE IF NOT EXISTS caregiver_availability (
+		email TEXT PRIMARY KEY,
+		active BOOLEAN,
+		unavailable_until TIMESTAMP,
+		updated_at TIMESTAMP
+	)
+`
+
+// CaregiverAvailability is whether a caregiver is taking new matches
+type CaregiverAvailability struct {
+	Active           bool      `json:"active"`
+	UnavailableUntil time.Time `json:"unavailable_until"` // Zero unless away
+}
+
+// Paused reports whether the caregiver shouldn't be matched at t
+func (a CaregiverAvailability) Paused(t time.Time) bool {
+	return !a.Active || t.Before(a.UnavailableUntil)
+}
+
+// Available reports whether the caregiver can be matched now
+func (a CaregiverAvailability) Available() bool {
+	return !a.Paused(time.Now())
+}
+
+// Describe tells the caregiver where they stand
+func (a CaregiverAvailability) Describe() string {
+	switch {
+	case !a.Active:
+		return "Matching is paused: families won't see you until you resume."
+	case a.Paused(time.Now()):
+		return fmt.Sprintf("You're away until %s: families will see you again from then.", a.UnavailableUntil.Format("Jan 2, 2006"))
+	}
+	return "You're available: families can be matched with you."
+}
+
+var setAvailabilityFunction = map[string]interface{}{
+	"name":        "set_availability",
+	"description": "Pause or resume the current caregiver being matched with families, or mark them away until a date (vacation mode)",
+	"parameters": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"active": map[string]interface{}{
+				"type":        "boolean",
+				"description": "false to pause matching until the caregiver resumes, true to resume",
+			},
+			"unavailable_until": map[string]interface{}{
+				"type":        "string",
+				"description": "Date (YYYY-MM-DD) the caregiver is away until; empty to clear",
+			},
+		},
+	},
+}
+
+// parseAvailableDate parses the date a caregiver is away until, which must
+// be in the future
+func parseAvailableDate(s string) (time.Time, error) {
+	date, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(s), time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("dates look like 2006-01-02")
+	}
+	if !date.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("the date must be in the future")
+	}
+	return date, nil
+}
+
+// GetAvailability returns a caregiver's availability; caregivers who never
+// set it are available
+func (app *App) GetAvailability(email string) (CaregiverAvailability, error) {
+	a := CaregiverAvailability{Active: true}
+	result, err := app.db.Query("SELECT active, unavailable_until FROM caregiver_availability WHERE email = ?", email)
+	if err != nil {
+		return a, fmt.Errorf("failed to query availability: %v", err)
+	}
+	defer result.Close()
+
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&a.Active, &a.UnavailableUntil)
+	})
+	if err != nil {
+		return a, fmt.Errorf("failed to scan availability: %v", err)
+	}
+	return a, nil
+}
+
+// SetAvailability stores a caregiver's availability
+func (app *App) SetAvailability(email string, a CaregiverAvailability) error {
+	if !app.IsCaregiver(email) {
+		return fmt.Errorf("only caregivers can set their availability")
+	}
+	err := app.db.Exec(`
+		INSERT INTO caregiver_availability (email, active, unavailable_until, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, a.Active, a.UnavailableUntil, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store availability: %v", err)
+	}
+	log.Printf("Availability for %s: %s", email, a.Describe())
+	app.invalidateToolCaches()
+	app.refreshCalendars(email)
+	go func() {
+		if err := app.checkFavorites(email); err != nil {
+			log.Printf("Error checking shortlists for %s: %v", email, err)
+		}
+	}()
+	return nil
+}
+
+// pausedCaregivers returns the caregivers who shouldn't be matched right
+// now: paused, away, or busy on their connected calendar
+func (app *App) pausedCaregivers() (map[string]bool, error) {
+	result, err := app.db.Query(`
+		SELECT email FROM caregiver_availability
+		WHERE active = false OR unavailable_until > ?
+	`, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query paused caregivers: %v", err)
+	}
+	defer result.Close()
+
+	paused := map[string]bool{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		if err := r.Scan(&email); err != nil {
+			return fmt.Errorf("failed to scan paused caregiver: %v", err)
+		}
+		paused[email] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	busy, err := app.busyCaregivers(time.Now())
+	for email := range busy {
+		paused[email] = true
+	}
+	return paused, err
+}
+
+// withoutPausedCaregivers drops caregivers who aren't taking matches
+func (app *App) withoutPausedCaregivers(caregivers []Caregiver) ([]Caregiver, error) {
+	paused, err := app.pausedCaregivers()
+	if err != nil || len(paused) == 0 {
+		return caregivers, err
+	}
+	kept := caregivers[:0]
+	for _, c := range caregivers {
+		if !paused[c.Email] {
+			kept = append(kept, c)
+		}
+	}
+	return kept, nil
+}
+
+// availabilityFromArgs applies a set_availability call to a caregiver's
+// current availability
+func availabilityFromArgs(current CaregiverAvailability, args map[string]interface{}) (CaregiverAvailability, error) {
+	a := current
+	if v, ok := args["active"].(bool); ok {
+		a.Active = v
+		if v {
+			a.UnavailableUntil = time.Time{}
+		}
+	}
+	if v, ok := args["unavailable_until"].(string); ok {
+		if strings.TrimSpace(v) == "" {
+			a.UnavailableUntil = time.Time{}
+		} else {
+			until, err := parseAvailableDate(v)
+			if err != nil {
+				return current, err
+			}
+			a.Active = true
+			a.UnavailableUntil = until
+		}
+	}
+	return a, nil
+}
+
+// updateAvailability applies a set_availability call and returns what to
+// tell the caregiver
+func (app *App) updateAvailability(email string, args map[string]interface{}) string {
+	current, err := app.GetAvailability(email)
+	if err != nil {
+		return fmt.Sprintf("Error updating availability: %v", err)
+	}
+	a, err := availabilityFromArgs(current, args)
+	if err != nil {
+		return fmt.Sprintf("Error updating availability: %v", err)
+	}
+	if err := app.SetAvailability(email, a); err != nil {
+		return fmt.Sprintf("Error updating availability: %v", err)
+	}
+	return a.Describe()
+}
+
+// handleAvailability pauses (action=pause), resumes (action=resume) or
+// sets away until a date (action=away with until) from the chat page
+func handleAvailability(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	var args map[string]interface{}
+	switch r.FormValue("action") {
+	case "pause":
+		args = map[string]interface{}{"active": false}
+	case "resume":
+		args = map[string]interface{}{"active": true}
+	case "away":
+		args = map[string]interface{}{"unavailable_until": r.FormValue("until")}
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	current, err := chatRoom.GetAvailability(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a, err := availabilityFromArgs(current, args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := chatRoom.SetAvailability(email, a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "../?email="+url.QueryEscape(email), http.StatusSeeOther)
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Caregivers can be background checked through an outside provider. A
+// check is requested for a caregiver, who gets an invitation link from the
+// provider to give consent and their details; the provider then reports
+// progress to a webhook. A caregiver whose latest check came back clear is
+// shown as background checked, and with background_checks.required on,
+// patients only see a caregiver's contact details once they are.
+//
+// Checkr is the provider today, configured from CHECKR_API_KEY. Admins
+// can also record the outcome of a check run outside the app.
+
+const backgroundChecksSchema = `
+	CREATE TABLE IF NOT EXISTS background_checks (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		provider TEXT,
+		status TEXT,
+		invitation_url TEXT,
+		requested_by TEXT,
+		requested_at TIMESTAMP,
+		updated_at TIMESTAMP,
+		completed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_background_checks_email ON background_checks(email)
+`
+
+// Background check statuses
+const (
+	CheckInvited  = "invited"  // Waiting for the caregiver to consent
+	CheckPending  = "pending"  // The provider is running the check
+	CheckClear    = "clear"    // Nothing found
+	CheckConsider = "consider" // Something found that needs review
+	CheckCanceled = "canceled" // Stopped, expired or suspended
+)
+
+// BackgroundCheck is one check of a caregiver. ID is the provider's id for
+// it.
+type BackgroundCheck struct {
+	ID            string    `json:"id"`
+	Email         string    `json:"email"`
+	Provider      string    `json:"provider"`
+	Status        string    `json:"status"`
+	InvitationURL string    `json:"invitation_url,omitempty"`
+	RequestedBy   string    `json:"requested_by"`
+	RequestedAt   time.Time `json:"requested_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	CompletedAt   time.Time `json:"completed_at,omitempty"`
+}
+
+// BackgroundCheckStatus is what a caregiver's chat page shows about their
+// background check
+type BackgroundCheckStatus struct {
+	Checked    bool
+	Latest     *BackgroundCheck // Nil before the first check
+	CanRequest bool             // A new check can be started from the page
+}
+
+// BackgroundCheckStatus returns a caregiver's background check status, or
+// nil when there's nothing to show
+func (app *App) BackgroundCheckStatus(email string) (*BackgroundCheckStatus, error) {
+	latest, err := app.LatestBackgroundCheck(email)
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil && app.checks == nil {
+		return nil, nil
+	}
+	status := &BackgroundCheckStatus{Checked: app.BackgroundChecked(email), Latest: latest}
+	status.CanRequest = app.checks != nil && !status.Checked &&
+		(latest == nil || (latest.Status != CheckInvited && latest.Status != CheckPending))
+	return status, nil
+}
+
+// checkUpdate is a status change a provider reported
+type checkUpdate struct {
+	ID     string
+	Status string
+}
+
+// backgroundChecker is a background check provider
+type backgroundChecker interface {
+	Name() string
+	// Request starts a check and returns its id and the link the
+	// caregiver follows to consent
+	Request(c *Caregiver) (id, invitationURL string, err error)
+	// ParseWebhook verifies and reads a webhook call. Events that don't
+	// change a check's status give no updates.
+	ParseWebhook(r *http.Request) ([]checkUpdate, error)
+}
+
+// newBackgroundChecker returns nil if no provider is configured
+func newBackgroundChecker() backgroundChecker {
+	apiKey := os.Getenv("CHECKR_API_KEY")
+	if apiKey == "" {
+		return nil
+	}
+	return &checkrChecker{
+		apiKey:  apiKey,
+		pkg:     config.BackgroundChecks.Package,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		baseURL: "https://api.checkr.com/v1",
+	}
+}
+
+// checkrChecker runs checks through Checkr's invitation flow. The check's
+// id is the Checkr candidate, which every webhook event carries.
+type checkrChecker struct {
+	apiKey  string
+	pkg     string
+	client  *http.Client
+	baseURL string
+}
+
+func (c *checkrChecker) Name() string { return "checkr" }
+
+// post sends a form to the Checkr API and decodes the reply into out
+func (c *checkrChecker) post(path string, form url.Values, out interface{}) error {
+	request, err := http.NewRequest("POST", c.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	request.SetBasicAuth(c.apiKey, "")
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to call Checkr: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read Checkr response: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Checkr %s failed with status %d: %s", path, resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode Checkr response: %v", err)
+	}
+	return nil
+}
+
+func (c *checkrChecker) Request(cg *Caregiver) (string, string, error) {
+	first, last := cg.Name, ""
+	if i := strings.LastIndex(cg.Name, " "); i > 0 {
+		first, last = cg.Name[:i], cg.Name[i+1:]
+	}
+	var candidate struct {
+		ID string `json:"id"`
+	}
+	err := c.post("/candidates", url.Values{
+		"first_name": {first},
+		"last_name":  {last},
+		"email":      {cg.Email},
+	}, &candidate)
+	if err != nil {
+		return "", "", err
+	}
+
+	var invitation struct {
+		InvitationURL string `json:"invitation_url"`
+	}
+	err = c.post("/invitations", url.Values{
+		"candidate_id": {candidate.ID},
+		"package":      {c.pkg},
+	}, &invitation)
+	if err != nil {
+		return "", "", err
+	}
+	return candidate.ID, invitation.InvitationURL, nil
+}
+
+func (c *checkrChecker) ParseWebhook(r *http.Request) ([]checkUpdate, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(c.apiKey))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Checkr-Signature"))) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	var event struct {
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				CandidateID string `json:"candidate_id"`
+				Result      string `json:"result"`
+				Status      string `json:"status"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook: %v", err)
+	}
+	obj := event.Data.Object
+	var status string
+	switch event.Type {
+	case "invitation.completed", "report.created", "report.resumed":
+		status = CheckPending
+	case "report.completed":
+		status = CheckConsider
+		if obj.Result == "clear" || (obj.Result == "" && obj.Status == "clear") {
+			status = CheckClear
+		}
+	case "invitation.expired", "invitation.deleted", "report.canceled", "report.suspended":
+		status = CheckCanceled
+	default:
+		return nil, nil
+	}
+	return []checkUpdate{{ID: obj.CandidateID, Status: status}}, nil
+}
+
+// scanBackgroundChecks reads query results into checks
+func scanBackgroundChecks(result *chai.Result) ([]BackgroundCheck, error) {
+	defer result.Close()
+	var checks []BackgroundCheck
+	err := result.Iterate(func(r *chai.Row) error {
+		var c BackgroundCheck
+		if err := r.Scan(&c.ID, &c.Email, &c.Provider, &c.Status, &c.InvitationURL, &c.RequestedBy,
+			&c.RequestedAt, &c.UpdatedAt, &c.CompletedAt); err != nil {
+			return fmt.Errorf("failed to scan background check: %v", err)
+		}
+		checks = append(checks, c)
+		return nil
+	})
+	return checks, err
+}
+
+const backgroundCheckColumns = `id, email, provider, status, invitation_url, requested_by,
+	requested_at, updated_at, completed_at`
+
+// LatestBackgroundCheck returns a caregiver's most recent check, or nil
+func (app *App) LatestBackgroundCheck(email string) (*BackgroundCheck, error) {
+	result, err := app.db.Query("SELECT "+backgroundCheckColumns+
+		" FROM background_checks WHERE email = ? ORDER BY requested_at DESC LIMIT 1", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query background checks: %v", err)
+	}
+	checks, err := scanBackgroundChecks(result)
+	if err != nil || len(checks) == 0 {
+		return nil, err
+	}
+	return &checks[0], nil
+}
+
+// BackgroundChecked reports whether a caregiver's latest check came back
+// clear within the configured validity period
+func (app *App) BackgroundChecked(email string) bool {
+	check, err := app.LatestBackgroundCheck(email)
+	if err != nil {
+		log.Printf("Error loading background check for %s: %v", email, err)
+		return false
+	}
+	if check == nil || check.Status != CheckClear {
+		return false
+	}
+	if days := config.BackgroundChecks.ValidDays; days > 0 {
+		return check.CompletedAt.After(time.Now().AddDate(0, 0, -days))
+	}
+	return true
+}
+
+// contactCleared reports whether background checks allow a and b to share
+// contact details: with checks required, a caregiver has to be background
+// checked before a patient sees their details
+func (app *App) contactCleared(a, b string) bool {
+	if !config.BackgroundChecks.Required {
+		return true
+	}
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		if app.IsCaregiver(pair[0]) && app.userRole(pair[1]) == "patient" && !app.BackgroundChecked(pair[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestBackgroundCheck starts a check of a caregiver. It does nothing if
+// one is already under way or has come back clear.
+func (app *App) RequestBackgroundCheck(email, requestedBy string) (*BackgroundCheck, error) {
+	if app.checks == nil {
+		return nil, fmt.Errorf("background checks are not configured")
+	}
+	latest, err := app.LatestBackgroundCheck(email)
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil && (latest.Status == CheckInvited || latest.Status == CheckPending || app.BackgroundChecked(email)) {
+		return latest, nil
+	}
+	caregiver, err := app.GetCaregiver(email)
+	if err != nil {
+		return nil, err
+	}
+	if caregiver == nil {
+		return nil, fmt.Errorf("only registered caregivers can be background checked")
+	}
+
+	id, invitationURL, err := app.checks.Request(caregiver)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	check := &BackgroundCheck{
+		ID:            id,
+		Email:         email,
+		Provider:      app.checks.Name(),
+		Status:        CheckInvited,
+		InvitationURL: invitationURL,
+		RequestedBy:   requestedBy,
+		RequestedAt:   now,
+		UpdatedAt:     now,
+	}
+	err = app.db.Exec(`
+		INSERT INTO background_checks (`+backgroundCheckColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, check.ID, check.Email, check.Provider, check.Status, check.InvitationURL, check.RequestedBy,
+		check.RequestedAt, check.UpdatedAt, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store background check: %v", err)
+	}
+	return check, nil
+}
+
+// RecordBackgroundCheck stores the outcome of a check run outside the app
+func (app *App) RecordBackgroundCheck(email, status, actor string) error {
+	if status != CheckClear && status != CheckConsider {
+		return fmt.Errorf("status must be %q or %q", CheckClear, CheckConsider)
+	}
+	if !app.IsCaregiver(email) {
+		return fmt.Errorf("only registered caregivers can be background checked")
+	}
+	now := time.Now()
+	err := app.db.Exec(`
+		INSERT INTO background_checks (`+backgroundCheckColumns+`)
+		VALUES (?, ?, 'manual', ?, '', ?, ?, ?, ?)
+	`, "manual-"+newAttachmentID(), email, status, actor, now, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to store background check: %v", err)
+	}
+	app.invalidateToolCaches()
+	return nil
+}
+
+// UpdateBackgroundCheck applies a status the provider reported, and tells
+// the caregiver when their check completes
+func (app *App) UpdateBackgroundCheck(u checkUpdate) error {
+	result, err := app.db.Query("SELECT "+backgroundCheckColumns+" FROM background_checks WHERE id = ?", u.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query background check: %v", err)
+	}
+	checks, err := scanBackgroundChecks(result)
+	if err != nil {
+		return err
+	}
+	if len(checks) == 0 {
+		return fmt.Errorf("unknown background check %s", u.ID)
+	}
+	check := checks[0]
+	if check.Status == u.Status {
+		return nil
+	}
+
+	now := time.Now()
+	completedAt := check.CompletedAt
+	if u.Status == CheckClear || u.Status == CheckConsider {
+		completedAt = now
+	}
+	err = app.db.Exec("UPDATE background_checks SET status = ?, updated_at = ?, completed_at = ? WHERE id = ?",
+		u.Status, now, completedAt, u.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update background check: %v", err)
+	}
+	// Match cards show contact details depending on the outcome
+	app.invalidateToolCaches()
+
+	var msg string
+	switch u.Status {
+	case CheckClear:
+		msg = "Your background check is complete and came back clear. Families now see you as background checked."
+	case CheckConsider:
+		msg = "Your background check is complete. Our team will review the results and be in touch."
+	case CheckCanceled:
+		msg = "Your background check was stopped before it finished. You can start a new one from the chat page."
+	default:
+		return nil
+	}
+	return app.AddMessageWithRecipient(check.Email, "assistant", msg, adminThread)
+}
+
+// backgroundCheckBadge marks background checked caregivers on match cards
+func backgroundCheckBadge(email string) string {
+	if !chatRoom.BackgroundChecked(email) {
+		return ""
+	}
+	return "<span class='verified'>✅ Background checked</span><br>"
+}
+
+// handleBackgroundCheck starts a check of the caregiver posting it
+func handleBackgroundCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	if _, err := chatRoom.RequestBackgroundCheck(email, email); err != nil {
+		log.Printf("Error requesting background check for %s: %v", email, err)
+		http.Error(w, "Failed to start background check", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("../?email=%s", url.QueryEscape(email)), http.StatusSeeOther)
+}
+
+// handleBackgroundCheckWebhook takes status updates from the provider
+func handleBackgroundCheckWebhook(w http.ResponseWriter, r *http.Request) {
+	checker := chatRoom.checks
+	if checker == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	updates, err := checker.ParseWebhook(r)
+	if err != nil {
+		log.Printf("Rejected %s webhook: %v", checker.Name(), err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	for _, u := range updates {
+		if err := chatRoom.UpdateBackgroundCheck(u); err != nil {
+			log.Printf("Error updating background check %s: %v", u.ID, err)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleBackgroundChecksAPI shows a caregiver's latest check (GET with
+// target), and on POST either requests a check through the provider or,
+// with a status, records the outcome of one run outside the app. The body
+// is {"email": ..., "status": "clear"|"consider"}, status optional.
+func handleBackgroundChecksAPI(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		check, err := chatRoom.LatestBackgroundCheck(r.FormValue("target"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if check == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, check)
+
+	case "POST":
+		var req struct {
+			Email  string `json:"email"`
+			Status string `json:"status"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.Status != "" {
+			if err := chatRoom.RecordBackgroundCheck(req.Email, req.Status, actor); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			chatRoom.Audit(r, actor, "background_check.record", req.Email, req.Status)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		check, err := chatRoom.RequestBackgroundCheck(req.Email, actor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chatRoom.Audit(r, actor, "background_check.request", req.Email, check.ID)
+		writeJSON(w, check)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
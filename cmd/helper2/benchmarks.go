@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// benchmarkOutlier is how far from the local median a rate or budget has to
+// be before the assistant points it out
+const benchmarkOutlier = 0.25
+
+// RateBenchmark summarises caregiver rates and patient budgets in one
+// location
+type RateBenchmark struct {
+	Location     string  `json:"location"`
+	Caregivers   int     `json:"caregivers"`
+	AvgRate      float64 `json:"avg_rate"`
+	MedianRate   float64 `json:"median_rate"`
+	Patients     int     `json:"patients"`
+	AvgBudget    float64 `json:"avg_budget"`
+	MedianBudget float64 `json:"median_budget"`
+}
+
+// locationKey groups free-text locations that differ only in case or spacing
+func locationKey(location string) string {
+	return strings.ToLower(strings.Join(strings.Fields(location), " "))
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// collectAmounts gathers positive amounts from profile_locations rows by
+// location key, remembering the first spelling of each location seen
+func (app *App) collectAmounts(query string, args []interface{}, amounts map[string][]float64, names map[string]string) error {
+	result, err := app.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query rates: %v", err)
+	}
+	defer result.Close()
+
+	return result.Iterate(func(r *chai.Row) error {
+		var location, key string
+		var amount float64
+		if err := r.Scan(&location, &key, &amount); err != nil {
+			return fmt.Errorf("failed to scan rate: %v", err)
+		}
+		if key == "" || amount <= 0 {
+			return nil
+		}
+		if _, ok := names[key]; !ok {
+			names[key] = strings.TrimSpace(location)
+		}
+		amounts[key] = append(amounts[key], amount)
+		return nil
+	})
+}
+
+// RateBenchmarks returns rate and budget statistics per location, busiest
+// first. A non-empty location limits the result to that location.
+func (app *App) RateBenchmarks(location string) ([]RateBenchmark, error) {
+	rates := make(map[string][]float64)
+	budgets := make(map[string][]float64)
+	names := make(map[string]string)
+	// One location is an index lookup on its key; every location reads
+	// the whole table
+	query := "SELECT location, location_key, amount FROM profile_locations WHERE role = ?"
+	var filter []interface{}
+	if want := locationKey(location); want != "" {
+		query += " AND location_key = ?"
+		filter = append(filter, want)
+	}
+	if err := app.collectAmounts(query, append([]interface{}{"caregiver"}, filter...), rates, names); err != nil {
+		return nil, err
+	}
+	if err := app.collectAmounts(query, append([]interface{}{"patient"}, filter...), budgets, names); err != nil {
+		return nil, err
+	}
+
+	var benchmarks []RateBenchmark
+	for key, name := range names {
+		benchmarks = append(benchmarks, RateBenchmark{
+			Location:     name,
+			Caregivers:   len(rates[key]),
+			AvgRate:      mean(rates[key]),
+			MedianRate:   median(rates[key]),
+			Patients:     len(budgets[key]),
+			AvgBudget:    mean(budgets[key]),
+			MedianBudget: median(budgets[key]),
+		})
+	}
+	sort.Slice(benchmarks, func(i, j int) bool {
+		bi, bj := benchmarks[i], benchmarks[j]
+		if bi.Caregivers+bi.Patients != bj.Caregivers+bj.Patients {
+			return bi.Caregivers+bi.Patients > bj.Caregivers+bj.Patients
+		}
+		return bi.Location < bj.Location
+	})
+	return benchmarks, nil
+}
+
+// benchmarkAdvice compares the user's own rate or budget to the local
+// median, so the assistant can tell them when they're well off the market
+func (app *App) benchmarkAdvice(email string, b RateBenchmark) string {
+	off := func(mine, market float64) float64 {
+		if mine <= 0 || market <= 0 {
+			return 0
+		}
+		return (mine - market) / market
+	}
+
+	if c, err := app.GetCaregiver(email); err == nil && c != nil && locationKey(c.Location) == locationKey(b.Location) {
+		// More than one caregiver, so the median isn't just their own rate
+		if d := off(c.RateExpectations, b.MedianRate); math.Abs(d) > benchmarkOutlier && b.Caregivers > 1 {
+			return fmt.Sprintf("Your rate of $%.2f/hour is %.0f%% %s the median caregiver rate here.",
+				c.RateExpectations, math.Abs(d)*100, aboveBelow(d))
+		}
+	}
+	if p, err := app.GetPatient(email); err == nil && p != nil && locationKey(p.Location) == locationKey(b.Location) {
+		if d := off(p.Budget, b.MedianRate); math.Abs(d) > benchmarkOutlier && b.Caregivers > 0 {
+			return fmt.Sprintf("Your budget of $%.2f/hour is %.0f%% %s the median caregiver rate here.",
+				p.Budget, math.Abs(d)*100, aboveBelow(d))
+		}
+	}
+	return ""
+}
+
+func aboveBelow(d float64) string {
+	if d > 0 {
+		return "above"
+	}
+	return "below"
+}
+
+// formatRateBenchmarks renders benchmarks for the assistant's reply
+func (app *App) formatRateBenchmarks(email string, benchmarks []RateBenchmark) string {
+	if len(benchmarks) == 0 {
+		return "<p>Not enough data for rate benchmarks yet.</p>"
+	}
+	var sb strings.Builder
+	sb.WriteString("<table class='query-results'><tr><th>Location</th><th>Caregivers</th><th>Median rate</th>" +
+		"<th>Average rate</th><th>Patients</th><th>Median budget</th><th>Average budget</th></tr>")
+	for _, b := range benchmarks {
+		sb.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%d</td><td>$%.2f</td><td>$%.2f</td><td>%d</td><td>$%.2f</td><td>$%.2f</td></tr>",
+			html.EscapeString(b.Location), b.Caregivers, b.MedianRate, b.AvgRate, b.Patients, b.MedianBudget, b.AvgBudget))
+	}
+	sb.WriteString("</table>")
+	for _, b := range benchmarks {
+		if advice := app.benchmarkAdvice(email, b); advice != "" {
+			sb.WriteString("<p>" + advice + "</p>")
+		}
+	}
+	return sb.String()
+}
+
+var rateBenchmarksFunction = map[string]interface{}{
+	"name":        "get_rate_benchmarks",
+	"description": "Get median and average caregiver hourly rates and patient budgets by location, and whether the current user's own rate or budget is far from the local market",
+	"parameters": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"location": map[string]interface{}{
+				"type":        "string",
+				"description": "Location to report on; omit for every location",
+			},
+		},
+	},
+}
+
+// handleRateBenchmarks serves rate benchmarks as JSON, optionally for one location
+func handleRateBenchmarks(w http.ResponseWriter, r *http.Request) {
+	benchmarks, err := chatRoom.RateBenchmarks(r.FormValue("location"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONCached(w, r, benchmarks, time.Time{})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+	"github.com/rfielding/helper2/internal/server"
+)
+
+// Every chat message costs OpenAI tokens, so a new user's first message is
+// screened before it reaches the model. A filled-in honeypot, a failed
+// challenge or too many new users from one address turn it away; softer
+// signs that it's scripted flag the user for an admin, and the assistant
+// stays quiet for them until an admin clears the flag.
+
+const signupFlagsSchema = `
+	CREATE TABLE IF NOT EXISTS signup_flags (
+		email TEXT PRIMARY KEY,
+		ip TEXT,
+		reasons TEXT,
+		status TEXT,
+		created_at TIMESTAMP,
+		reviewed_by TEXT,
+		reviewed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_signup_flags_status ON signup_flags(status)
+`
+
+// Signup flag statuses
+const (
+	SignupFlagPending = "pending"
+	SignupFlagCleared = "cleared"
+	SignupFlagBlocked = "blocked"
+)
+
+// honeypotField is a form input hidden from people; anything in it came
+// from a bot filling in every field
+const honeypotField = "website"
+
+// minFormSeconds is the least time a person takes between the chat page
+// loading and sending a first message
+const minFormSeconds = 2
+
+const signupReviewMessage = "Thanks for reaching out! We review new conversations to keep out spam, and the assistant will reply once yours has been checked."
+
+// SignupFlag is a new user held for review
+type SignupFlag struct {
+	Email      string    `json:"email"`
+	IP         string    `json:"ip"`
+	Reasons    []string  `json:"reasons"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReviewedBy string    `json:"reviewed_by,omitempty"`
+	ReviewedAt time.Time `json:"reviewed_at,omitempty"`
+}
+
+// errRejected is returned for first contacts turned away outright; the
+// detail goes to the log, not the sender
+type errRejected struct {
+	status int
+	reason string
+}
+
+func (e *errRejected) Error() string {
+	return e.reason
+}
+
+// signupLimiter counts new users per client address
+var signupLimiter = server.NewRateLimiter()
+
+var turnstileClient = &http.Client{Timeout: 10 * time.Second}
+
+// scriptedAgents are User-Agent substrings of HTTP libraries and tools
+var scriptedAgents = []string{"curl/", "wget/", "python-requests", "python-urllib", "go-http-client",
+	"okhttp", "scrapy", "headlesschrome", "phantomjs", "httpclient"}
+
+// disposableDomains are throwaway email providers
+var disposableDomains = map[string]bool{
+	"mailinator.com": true, "guerrillamail.com": true, "10minutemail.com": true, "tempmail.com": true,
+	"yopmail.com": true, "trashmail.com": true, "sharklasers.com": true, "getnada.com": true,
+	"dispostable.com": true, "maildrop.cc": true,
+}
+
+var (
+	linkPattern      = regexp.MustCompile(`(?i)https?://|www\.`)
+	digitRunPattern  = regexp.MustCompile(`[0-9]{5,}`)
+	vowellessPattern = regexp.MustCompile(`(?i)^[^aeiouy@._+-]{8,}$`)
+)
+
+// isFirstContact reports whether email has never chatted or registered
+func (app *App) isFirstContact(email string) bool {
+	if app.userRole(email) != "unknown" {
+		return false
+	}
+	exists, err := rowExists(app.db, "SELECT email FROM chat_history WHERE email = ? LIMIT 1", email)
+	if err != nil {
+		log.Printf("Error checking chat history for %s: %v", email, err)
+		return false
+	}
+	return !exists
+}
+
+// screenFirstContact decides what happens to a new user's first message.
+// It returns an *errRejected for one to turn away; otherwise the user may
+// have been flagged for review.
+func (app *App) screenFirstContact(r *http.Request, email string) error {
+	if !config.Bots.ScreenSignups {
+		return nil
+	}
+	ip := server.ClientAddr(r)
+	if r.FormValue(honeypotField) != "" {
+		return &errRejected{http.StatusBadRequest, "honeypot field filled in"}
+	}
+	if err := verifyTurnstile(r.FormValue("cf-turnstile-response"), ip); err != nil {
+		return &errRejected{http.StatusForbidden, err.Error()}
+	}
+	if perHour := config.Bots.SignupsPerHourPerIP; perHour > 0 {
+		if !signupLimiter.Allow(ip, float64(perHour)/60, perHour, time.Now()) {
+			return &errRejected{http.StatusTooManyRequests, "too many new users from " + ip}
+		}
+	}
+
+	reasons := scriptedSignupReasons(r, email)
+	if len(reasons) < 2 {
+		return nil
+	}
+	log.Printf("Flagging signup %s from %s for review: %s", email, ip, strings.Join(reasons, "; "))
+	err := app.db.Exec(`
+		INSERT INTO signup_flags (email, ip, reasons, status, created_at, reviewed_by, reviewed_at)
+		VALUES (?, ?, ?, ?, ?, '', ?)
+		ON CONFLICT DO NOTHING
+	`, email, ip, strings.Join(reasons, "\n"), SignupFlagPending, time.Now(), time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to flag signup: %v", err)
+	}
+	return nil
+}
+
+// scriptedSignupReasons lists the signs that a first message was sent by a
+// script. Each is weak alone, so it takes two to flag someone.
+func scriptedSignupReasons(r *http.Request, email string) []string {
+	var reasons []string
+	agent := strings.ToLower(r.UserAgent())
+	if agent == "" {
+		reasons = append(reasons, "no User-Agent")
+	}
+	for _, s := range scriptedAgents {
+		if strings.Contains(agent, s) {
+			reasons = append(reasons, "User-Agent is "+r.UserAgent())
+			break
+		}
+	}
+
+	if rendered, err := strconv.ParseInt(r.FormValue("form_time"), 10, 64); err != nil {
+		reasons = append(reasons, "not sent from the chat page")
+	} else if time.Since(time.Unix(rendered, 0)) < minFormSeconds*time.Second {
+		reasons = append(reasons, fmt.Sprintf("sent within %d seconds of the page loading", minFormSeconds))
+	}
+
+	if linkPattern.MatchString(r.FormValue("message")) {
+		reasons = append(reasons, "first message contains a link")
+	}
+
+	local, domain, _ := strings.Cut(strings.ToLower(email), "@")
+	if disposableDomains[domain] {
+		reasons = append(reasons, "disposable email domain "+domain)
+	}
+	if digitRunPattern.MatchString(local) || vowellessPattern.MatchString(local) {
+		reasons = append(reasons, "email address looks generated")
+	}
+	return reasons
+}
+
+// verifyTurnstile checks a Cloudflare Turnstile token when both keys are
+// configured
+func verifyTurnstile(token, ip string) error {
+	secret := os.Getenv("TURNSTILE_SECRET_KEY")
+	if secret == "" || config.Bots.TurnstileSiteKey == "" {
+		return nil
+	}
+	if token == "" {
+		return fmt.Errorf("challenge not completed")
+	}
+	resp, err := turnstileClient.PostForm("https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		url.Values{"secret": {secret}, "response": {token}, "remoteip": {ip}})
+	if err != nil {
+		// Don't lock new users out while Cloudflare can't be reached
+		log.Printf("Error verifying challenge, letting it through: %v", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Printf("Error decoding challenge verification, letting it through: %v", err)
+		return nil
+	}
+	if !result.Success {
+		return fmt.Errorf("challenge failed: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// HeldForReview reports whether a user's messages should wait for an admin
+// rather than go to the model
+func (app *App) HeldForReview(email string) bool {
+	exists, err := rowExists(app.db,
+		"SELECT email FROM signup_flags WHERE email = ? AND status != ?", email, SignupFlagCleared)
+	if err != nil {
+		log.Printf("Error checking signup flag for %s: %v", email, err)
+		return false
+	}
+	return exists
+}
+
+// SignupFlags lists flagged signups with the given status, newest first
+func (app *App) SignupFlags(status string) ([]SignupFlag, error) {
+	result, err := app.db.Query(`
+		SELECT email, ip, reasons, status, created_at, reviewed_by, reviewed_at
+		FROM signup_flags WHERE status = ?
+		ORDER BY created_at DESC
+	`, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query signup flags: %v", err)
+	}
+	defer result.Close()
+
+	var flags []SignupFlag
+	err = result.Iterate(func(r *chai.Row) error {
+		var f SignupFlag
+		var reasons string
+		if err := r.Scan(&f.Email, &f.IP, &reasons, &f.Status, &f.CreatedAt, &f.ReviewedBy, &f.ReviewedAt); err != nil {
+			return fmt.Errorf("failed to scan signup flag: %v", err)
+		}
+		f.Reasons = strings.Split(reasons, "\n")
+		flags = append(flags, f)
+		return nil
+	})
+	return flags, err
+}
+
+// ReviewSignup clears or blocks a flagged signup
+func (app *App) ReviewSignup(email, status, admin string) error {
+	if status != SignupFlagCleared && status != SignupFlagBlocked {
+		return fmt.Errorf("status must be %q or %q", SignupFlagCleared, SignupFlagBlocked)
+	}
+	exists, err := rowExists(app.db, "SELECT email FROM signup_flags WHERE email = ?", email)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%s has not been flagged", email)
+	}
+	err = app.db.Exec(`
+		UPDATE signup_flags SET status = ?, reviewed_by = ?, reviewed_at = ?
+		WHERE email = ?
+	`, status, admin, time.Now(), email)
+	if err != nil {
+		return fmt.Errorf("failed to review signup: %v", err)
+	}
+	return nil
+}
+
+// handleSignupFlagsAPI lists flagged signups (GET, with an optional status,
+// pending by default) and records a review from a JSON body
+// {"email", "status"} (POST)
+func handleSignupFlagsAPI(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		status := r.FormValue("status")
+		if status == "" {
+			status = SignupFlagPending
+		}
+		flags, err := chatRoom.SignupFlags(status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, flags)
+
+	case "POST":
+		var req struct {
+			Email  string `json:"email"`
+			Status string `json:"status"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.ReviewSignup(req.Email, req.Status, admin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
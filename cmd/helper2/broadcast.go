@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Admins can send an announcement to every user or to a segment of them,
+// such as all caregivers in Chicago. It's added to each recipient's
+// conversation with the assistant and, if asked, emailed too. Each
+// recipient has a delivery row recording when it reached their chat, how
+// the email went, and, from their read marker, whether they've seen it.
+
+const broadcastsSchema = `
+	CREATE TABLE IF NOT EXISTS broadcasts (
+		id TEXT PRIMARY KEY,
+		subject TEXT,
+		body TEXT,
+		segment TEXT,
+		send_email BOOLEAN,
+		recipients INTEGER,
+		created_by TEXT,
+		created_at TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS broadcast_deliveries (
+		broadcast_id TEXT,
+		email TEXT,
+		delivered_at TIMESTAMP,
+		email_status TEXT,
+		error TEXT,
+		PRIMARY KEY (broadcast_id, email)
+	)
+`
+
+// Broadcast email statuses; empty when the broadcast isn't emailed or the
+// email hasn't gone yet
+const (
+	BroadcastEmailSent       = "sent"
+	BroadcastEmailFailed     = "failed"
+	BroadcastEmailQuietHours = "quiet_hours" // Skipped, not retried
+)
+
+// maxBroadcastBody caps the length of an announcement
+const maxBroadcastBody = 4000
+
+const defaultBroadcastSubject = "Announcement"
+
+// BroadcastSegment picks the users a broadcast goes to. Empty fields
+// don't filter, so the zero segment is everyone with a profile.
+type BroadcastSegment struct {
+	Role     string `json:"role,omitempty"`     // caregiver or patient
+	Location string `json:"location,omitempty"` // Matches profile locations containing it
+	Tag      string `json:"tag,omitempty"`
+}
+
+// Describe says who a segment is, for people to read
+func (s BroadcastSegment) Describe() string {
+	who := "all users"
+	if s.Role != "" {
+		who = "all " + s.Role + "s"
+	}
+	if s.Location != "" {
+		who += " in " + s.Location
+	}
+	if s.Tag != "" {
+		who += " tagged " + s.Tag
+	}
+	return who
+}
+
+// Broadcast is an announcement and, when listed, how its delivery is going
+type Broadcast struct {
+	ID         string           `json:"id"`
+	Subject    string           `json:"subject"`
+	Body       string           `json:"body"`
+	Segment    BroadcastSegment `json:"segment"`
+	SendEmail  bool             `json:"send_email"`
+	Recipients int              `json:"recipients"`
+	CreatedBy  string           `json:"created_by"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Stats      *BroadcastStats  `json:"stats,omitempty"`
+}
+
+// BroadcastStats counts a broadcast's deliveries
+type BroadcastStats struct {
+	Delivered   int `json:"delivered"`
+	Pending     int `json:"pending"`
+	Read        int `json:"read"`
+	Emailed     int `json:"emailed"`
+	EmailFailed int `json:"email_failed"`
+}
+
+// BroadcastDelivery is one recipient's copy of a broadcast
+type BroadcastDelivery struct {
+	Email       string     `json:"email"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	ReadAt      *time.Time `json:"read_at,omitempty"`
+	EmailStatus string     `json:"email_status,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// SegmentEmails returns the users in a segment
+func (app *App) SegmentEmails(s BroadcastSegment) ([]string, error) {
+	if s.Role != "" && s.Role != "caregiver" && s.Role != "patient" {
+		return nil, fmt.Errorf("role must be caregiver or patient")
+	}
+	location := locationKey(s.Location)
+	inLocation := func(l string) bool {
+		return location == "" || strings.Contains(locationKey(l), location)
+	}
+
+	selected := map[string]bool{}
+	if s.Role != "patient" {
+		err := app.IterateCaregivers(func(c Caregiver) error {
+			if inLocation(c.Location) {
+				selected[c.Email] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.Role != "caregiver" {
+		err := app.IteratePatients(func(p Patient) error {
+			if inLocation(p.Location) {
+				selected[p.Email] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Tag != "" {
+		tagged, err := app.EmailsWithTag(s.Tag)
+		if err != nil {
+			return nil, err
+		}
+		withTag := make(map[string]bool, len(tagged))
+		for _, email := range tagged {
+			withTag[email] = true
+		}
+		for email := range selected {
+			if !withTag[email] {
+				delete(selected, email)
+			}
+		}
+	}
+
+	emails := make([]string, 0, len(selected))
+	for email := range selected {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	return emails, nil
+}
+
+// SendBroadcast records a broadcast to a segment and delivers it in the
+// background. It fails if nobody is in the segment.
+func (app *App) SendBroadcast(subject, body string, segment BroadcastSegment, sendEmail bool, admin string) (*Broadcast, error) {
+	subject, body = strings.TrimSpace(subject), strings.TrimSpace(body)
+	if body == "" {
+		return nil, fmt.Errorf("body is required")
+	}
+	if len(body) > maxBroadcastBody {
+		return nil, fmt.Errorf("body can be at most %d characters", maxBroadcastBody)
+	}
+	if subject == "" {
+		subject = defaultBroadcastSubject
+	}
+	emails, err := app.SegmentEmails(segment)
+	if err != nil {
+		return nil, err
+	}
+	if len(emails) == 0 {
+		return nil, fmt.Errorf("no users are in %s", segment.Describe())
+	}
+	encoded, err := json.Marshal(segment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode segment: %v", err)
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	b := &Broadcast{
+		ID:         hex.EncodeToString(id),
+		Subject:    subject,
+		Body:       body,
+		Segment:    segment,
+		SendEmail:  sendEmail,
+		Recipients: len(emails),
+		CreatedBy:  admin,
+		CreatedAt:  time.Now(),
+	}
+	err = app.withTx(func(tx *chai.Tx) error {
+		err := tx.Exec(`
+			INSERT INTO broadcasts (id, subject, body, segment, send_email, recipients, created_by, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, b.ID, b.Subject, b.Body, string(encoded), b.SendEmail, b.Recipients, b.CreatedBy, b.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to store broadcast: %v", err)
+		}
+		for _, email := range emails {
+			err := tx.Exec(`
+				INSERT INTO broadcast_deliveries (broadcast_id, email, delivered_at, email_status, error)
+				VALUES (?, ?, ?, '', '')
+			`, b.ID, email, time.Time{})
+			if err != nil {
+				return fmt.Errorf("failed to store broadcast delivery: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go app.deliverBroadcast(b, emails)
+	return b, nil
+}
+
+// formatBroadcast renders a broadcast as a chat message
+func formatBroadcast(b *Broadcast) string {
+	body := strings.ReplaceAll(template.HTMLEscapeString(b.Body), "\n", "<br>")
+	return fmt.Sprintf("<strong>📢 %s</strong><br>%s", template.HTMLEscapeString(b.Subject), body)
+}
+
+// deliverBroadcast adds a broadcast to each recipient's chat, emails it if
+// asked, and records how each went
+func (app *App) deliverBroadcast(b *Broadcast, emails []string) {
+	message := formatBroadcast(b)
+	for _, email := range emails {
+		var deliveredAt time.Time
+		var failed []string
+		if err := app.AddMessageWithRecipient(email, "assistant", message, adminThread); err != nil {
+			failed = append(failed, err.Error())
+		} else {
+			deliveredAt = time.Now()
+		}
+
+		status := ""
+		if b.SendEmail {
+			err := app.Notify(Notification{
+				Email: email,
+				Kind:  NotifyAnnouncement,
+				Data:  map[string]interface{}{"Subject": b.Subject, "Body": b.Body},
+			})
+			switch {
+			case err == errQuietHours:
+				status = BroadcastEmailQuietHours
+			case err != nil:
+				status = BroadcastEmailFailed
+				failed = append(failed, err.Error())
+			default:
+				status = BroadcastEmailSent
+			}
+		}
+
+		err := app.db.Exec(`
+			UPDATE broadcast_deliveries SET delivered_at = ?, email_status = ?, error = ?
+			WHERE broadcast_id = ? AND email = ?
+		`, deliveredAt, status, strings.Join(failed, "; "), b.ID, email)
+		if err != nil {
+			log.Printf("Error recording broadcast %s delivery to %s: %v", b.ID, email, err)
+		}
+	}
+	log.Printf("Delivered broadcast %s to %d users", b.ID, len(emails))
+}
+
+// BroadcastDeliveries returns who a broadcast went to and how far it got
+// with each of them
+func (app *App) BroadcastDeliveries(id string) ([]BroadcastDelivery, error) {
+	readAt, err := app.assistantReadMarkers()
+	if err != nil {
+		return nil, err
+	}
+	result, err := app.db.Query(`
+		SELECT email, delivered_at, email_status, error
+		FROM broadcast_deliveries WHERE broadcast_id = ?
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query broadcast deliveries: %v", err)
+	}
+	defer result.Close()
+
+	var deliveries []BroadcastDelivery
+	err = result.Iterate(func(r *chai.Row) error {
+		var d BroadcastDelivery
+		var deliveredAt time.Time
+		if err := r.Scan(&d.Email, &deliveredAt, &d.EmailStatus, &d.Error); err != nil {
+			return fmt.Errorf("failed to scan broadcast delivery: %v", err)
+		}
+		if !deliveredAt.IsZero() {
+			d.DeliveredAt = &deliveredAt
+			if read, ok := readAt[d.Email]; ok && !read.Before(deliveredAt) {
+				d.ReadAt = &read
+			}
+		}
+		deliveries = append(deliveries, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].Email < deliveries[j].Email })
+	return deliveries, nil
+}
+
+// assistantReadMarkers returns when each user last read their
+// conversation with the assistant
+func (app *App) assistantReadMarkers() (map[string]time.Time, error) {
+	result, err := app.db.Query("SELECT email, read_at FROM read_markers WHERE thread = ?", adminThread)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query read markers: %v", err)
+	}
+	defer result.Close()
+
+	markers := map[string]time.Time{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		var readAt time.Time
+		if err := r.Scan(&email, &readAt); err != nil {
+			return fmt.Errorf("failed to scan read marker: %v", err)
+		}
+		markers[email] = readAt
+		return nil
+	})
+	return markers, err
+}
+
+// Broadcasts lists every broadcast, newest first, with delivery counts
+func (app *App) Broadcasts() ([]Broadcast, error) {
+	result, err := app.db.Query(`
+		SELECT id, subject, body, segment, send_email, recipients, created_by, created_at
+		FROM broadcasts
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query broadcasts: %v", err)
+	}
+	defer result.Close()
+
+	var broadcasts []Broadcast
+	err = result.Iterate(func(r *chai.Row) error {
+		var b Broadcast
+		var segment string
+		if err := r.Scan(&b.ID, &b.Subject, &b.Body, &segment, &b.SendEmail, &b.Recipients, &b.CreatedBy, &b.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan broadcast: %v", err)
+		}
+		if err := json.Unmarshal([]byte(segment), &b.Segment); err != nil {
+			return fmt.Errorf("failed to decode broadcast segment: %v", err)
+		}
+		broadcasts = append(broadcasts, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range broadcasts {
+		deliveries, err := app.BroadcastDeliveries(broadcasts[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		stats := &BroadcastStats{}
+		for _, d := range deliveries {
+			if d.DeliveredAt != nil {
+				stats.Delivered++
+			} else if d.Error == "" {
+				stats.Pending++
+			}
+			if d.ReadAt != nil {
+				stats.Read++
+			}
+			switch d.EmailStatus {
+			case BroadcastEmailSent:
+				stats.Emailed++
+			case BroadcastEmailFailed:
+				stats.EmailFailed++
+			}
+		}
+		broadcasts[i].Stats = stats
+	}
+	return broadcasts, nil
+}
+
+// handleBroadcastsAPI lists broadcasts, or one broadcast's deliveries with
+// ?id=, on GET. POST sends one:
+// {"subject", "body", "segment": {"role", "location", "tag"}, "email": true}.
+// With "dry_run" it only returns who would receive it.
+func handleBroadcastsAPI(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if id := r.URL.Query().Get("id"); id != "" {
+			deliveries, err := chatRoom.BroadcastDeliveries(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, deliveries)
+			return
+		}
+		broadcasts, err := chatRoom.Broadcasts()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, broadcasts)
+
+	case "POST":
+		var req struct {
+			Subject string           `json:"subject"`
+			Body    string           `json:"body"`
+			Segment BroadcastSegment `json:"segment"`
+			Email   bool             `json:"email"`
+			DryRun  bool             `json:"dry_run"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.DryRun {
+			emails, err := chatRoom.SegmentEmails(req.Segment)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, map[string]interface{}{
+				"segment":    req.Segment.Describe(),
+				"recipients": emails,
+			})
+			return
+		}
+		b, err := chatRoom.SendBroadcast(req.Subject, req.Body, req.Segment, req.Email, admin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chatRoom.Audit(r, admin, "broadcast.send", b.ID, fmt.Sprintf("%d recipients, %s", b.Recipients, b.Segment.Describe()))
+		writeJSON(w, b)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// completionCacheTTL is short: an identical conversation state is
+	// usually a retry or a replayed test script
+	completionCacheTTL = 10 * time.Minute
+	// toolCacheTTL bounds staleness for data not covered by invalidation,
+	// like other users' skills
+	toolCacheTTL    = 5 * time.Minute
+	maxCacheEntries = 5000
+)
+
+// cacheableTools are the read-only tools whose results can be reused until a
+// profile changes. The find_matching tools depend on who is asking, so their
+// keys include the user's email.
+var cacheableTools = map[string]bool{
+	"list_patients":            true,
+	"list_caregivers":          true,
+	"find_matching_caregivers": true,
+	"find_matching_patients":   true,
+	"execute_dynamic_query":    true,
+	"get_rate_benchmarks":      true,
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// ttlCache is a small in-memory cache with per-entry expiry
+type ttlCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newTTLCache() *ttlCache {
+	return &ttlCache{entries: make(map[string]cacheEntry)}
+}
+
+func (c *ttlCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *ttlCache) Set(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		c.pruneLocked()
+	}
+	c.entries[key] = cacheEntry{value: value, expires: time.Now().Add(ttl)}
+}
+
+// InvalidatePrefix drops every entry whose key starts with prefix
+func (c *ttlCache) InvalidatePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// pruneLocked drops expired entries, or everything if none have expired;
+// c.mu must be held
+func (c *ttlCache) pruneLocked() {
+	now := time.Now()
+	for key, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) >= maxCacheEntries {
+		c.entries = make(map[string]cacheEntry)
+	}
+}
+
+func hashKey(prefix string, parts ...interface{}) string {
+	data, _ := json.Marshal(parts)
+	sum := sha256.Sum256(data)
+	return prefix + hex.EncodeToString(sum[:])
+}
+
+// completionCacheKey hashes the model and the full prompt
+func completionCacheKey(req ChatRequest) string {
+	return hashKey("chat:", req.Model, req.Messages)
+}
+
+// toolCacheKey hashes a tool call; email is included since tools act as the user
+func toolCacheKey(name string, args map[string]interface{}, email string) string {
+	return hashKey("tool:", name, args, email)
+}
+
+// completeChat calls OpenAI unless the same prompt was answered recently.
+// cached reports whether the response came from the cache, so callers don't
+// bill for it twice.
+func (app *App) completeChat(req ChatRequest) (resp *ChatResponse, cached bool, err error) {
+	key := completionCacheKey(req)
+	if v, ok := app.cache.Get(key); ok {
+		return v.(*ChatResponse), true, nil
+	}
+
+	resp, err = callOpenAI(req)
+	if err != nil {
+		return nil, false, err
+	}
+	// A response that writes data must run again for real next time
+	if len(resp.Choices) > 0 {
+		if fc := resp.Choices[0].Message.FunctionCall; fc == nil || cacheableTools[fc.Name] {
+			app.cache.Set(key, resp, completionCacheTTL)
+		}
+	}
+	return resp, false, nil
+}
+
+// invalidateToolCaches forgets tool results after a profile or match write.
+// Completions are keyed on the prompt, which embeds the profile summary, so
+// they go stale on their own.
+func (app *App) invalidateToolCaches() {
+	app.cache.InvalidatePrefix("tool:")
+}
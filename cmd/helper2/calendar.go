@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Users can subscribe to their bookings from Google, Apple or any other
+// calendar app. Each user has an iCal feed at a secret URL, which is the
+// only thing that authorizes reading it, so it can be reset if it leaks.
+// The feed has the user's confirmed bookings and, for caregivers, the days
+// they're away. It's stored when it's built and rebuilt whenever a booking
+// or the caregiver's availability changes, so calendar apps polling it get
+// the same document, and its ETag, until something changed.
+
+const calendarFeedsSchema = `
+	CREATE TABLE IF NOT EXISTS calendar_feeds (
+		email TEXT PRIMARY KEY,
+		token TEXT,
+		ics TEXT,
+		built_at TIMESTAMP,
+		created_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_calendar_feeds_token ON calendar_feeds(token)
+`
+
+// calendarFeedHistory is how far back a feed lists bookings
+const calendarFeedHistory = 90 * 24 * time.Hour
+
+// calendarFeedMaxAge is how long a stored feed is served before it's
+// rebuilt anyway, so old bookings leave it and names stay current
+const calendarFeedMaxAge = 24 * time.Hour
+
+// calendarFeedURL is where calendar apps fetch a feed
+func calendarFeedURL(token string) string {
+	return fmt.Sprintf("%s/calendar/%s.ics", config.Email.BaseURL, token)
+}
+
+// CalendarFeedToken returns the token in a user's feed URL, creating the
+// feed the first time
+func (app *App) CalendarFeedToken(email string) (string, error) {
+	var token string
+	result, err := app.db.Query("SELECT token FROM calendar_feeds WHERE email = ?", email)
+	if err != nil {
+		return "", fmt.Errorf("failed to query calendar feed: %v", err)
+	}
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&token)
+	})
+	result.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to read calendar feed: %v", err)
+	}
+	if token != "" {
+		return token, nil
+	}
+	return app.ResetCalendarFeed(email)
+}
+
+// ResetCalendarFeed gives a user's feed a new secret URL; the old one stops
+// working
+func (app *App) ResetCalendarFeed(email string) (string, error) {
+	ics, err := app.buildCalendar(email)
+	if err != nil {
+		return "", err
+	}
+	token := newUnsubscribeToken()
+	exists, err := rowExists(app.db, "SELECT 1 FROM calendar_feeds WHERE email = ?", email)
+	if err != nil {
+		return "", err
+	}
+	// An update, since replacing the row leaves the old token in its index
+	if exists {
+		err = app.db.Exec("UPDATE calendar_feeds SET token = ?, ics = ?, built_at = ? WHERE email = ?",
+			token, ics, time.Now(), email)
+	} else {
+		err = app.db.Exec(`
+			INSERT INTO calendar_feeds (email, token, ics, built_at, created_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, email, token, ics, time.Now(), time.Now())
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to store calendar feed: %v", err)
+	}
+	return token, nil
+}
+
+// refreshCalendars rebuilds the feeds of those users who have one, after
+// their bookings or availability changed
+func (app *App) refreshCalendars(emails ...string) {
+	for _, email := range emails {
+		exists, err := rowExists(app.db, "SELECT 1 FROM calendar_feeds WHERE email = ?", email)
+		if err != nil || !exists {
+			continue
+		}
+		ics, err := app.buildCalendar(email)
+		if err == nil {
+			err = app.db.Exec("UPDATE calendar_feeds SET ics = ?, built_at = ? WHERE email = ?", ics, time.Now(), email)
+		}
+		if err != nil {
+			log.Printf("Error refreshing calendar feed for %s: %v", email, err)
+		}
+	}
+}
+
+// calendarFeed returns the feed a token opens and when it was built, or ""
+// for an unknown token. Feeds older than calendarFeedMaxAge are rebuilt.
+func (app *App) calendarFeed(token string) (string, time.Time, error) {
+	var email, ics string
+	var builtAt time.Time
+	if token == "" {
+		return "", builtAt, nil
+	}
+	result, err := app.db.Query("SELECT email, ics, built_at FROM calendar_feeds WHERE token = ?", token)
+	if err != nil {
+		return "", builtAt, fmt.Errorf("failed to query calendar feed: %v", err)
+	}
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&email, &ics, &builtAt)
+	})
+	result.Close()
+	if err != nil || email == "" {
+		return "", builtAt, err
+	}
+	if time.Since(builtAt) > calendarFeedMaxAge {
+		app.refreshCalendars(email)
+		return app.calendarFeed(token)
+	}
+	return ics, builtAt, nil
+}
+
+// buildCalendar writes a user's iCal feed: their scheduled and completed
+// bookings from the last few months on, and for caregivers the time
+// they've marked themselves away
+func (app *App) buildCalendar(email string) (string, error) {
+	var bookings []Assignment
+	var err error
+	from, to := time.Now().Add(-calendarFeedHistory), time.Now().AddDate(10, 0, 0)
+	caregiver := app.IsCaregiver(email)
+	if caregiver {
+		bookings, err = app.GetCaregiverSchedule(email, from, to)
+	} else {
+		bookings, err = app.GetPatientSchedule(email, from, to)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	host := "localhost"
+	if u, err := url.Parse(config.Email.BaseURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	stamp := icsTime(time.Now())
+	cal := &icsWriter{}
+	cal.line("BEGIN:VCALENDAR")
+	cal.line("VERSION:2.0")
+	cal.line("PRODID:-//" + icsText(config.Branding.Name) + "//Bookings//EN")
+	cal.line("CALSCALE:GREGORIAN")
+	cal.line("METHOD:PUBLISH")
+	cal.line("X-WR-CALNAME:" + icsText(config.Branding.Name+" bookings"))
+
+	names := map[string]string{}
+	for _, b := range bookings {
+		if b.Status == "cancelled" {
+			continue
+		}
+		other, summary := b.CaregiverEmail, "Care with %s"
+		if caregiver {
+			other, summary = b.PatientEmail, "Care for %s"
+		}
+		if _, ok := names[other]; !ok {
+			names[other] = app.displayName(other)
+		}
+		matchURL := fmt.Sprintf("%s/match?email=%s&caregiver_email=%s&patient_email=%s", config.Email.BaseURL,
+			url.QueryEscape(email), url.QueryEscape(b.CaregiverEmail), url.QueryEscape(b.PatientEmail))
+		cal.line("BEGIN:VEVENT")
+		cal.line(fmt.Sprintf("UID:booking-%d@%s", b.ID, host))
+		cal.line("DTSTAMP:" + stamp)
+		cal.line("DTSTART:" + icsTime(b.StartTime))
+		cal.line("DTEND:" + icsTime(b.EndTime))
+		cal.line("SUMMARY:" + icsText(fmt.Sprintf(summary, names[other])))
+		cal.line("DESCRIPTION:" + icsText("Booked through "+config.Branding.Name+". "+matchURL))
+		cal.line("URL:" + matchURL)
+		cal.line("STATUS:CONFIRMED")
+		cal.line("END:VEVENT")
+	}
+
+	if caregiver {
+		away, since, err := app.awayBlock(email)
+		if err != nil {
+			return "", err
+		}
+		if away.After(since) && away.After(from) {
+			cal.line("BEGIN:VEVENT")
+			cal.line("UID:away-" + since.UTC().Format("20060102T150405Z") + "@" + host)
+			cal.line("DTSTAMP:" + stamp)
+			cal.line("DTSTART;VALUE=DATE:" + since.Format("20060102"))
+			cal.line("DTEND;VALUE=DATE:" + away.Format("20060102"))
+			cal.line("SUMMARY:" + icsText("Away: not taking new matches"))
+			cal.line("TRANSP:TRANSPARENT")
+			cal.line("END:VEVENT")
+		}
+	}
+	cal.line("END:VCALENDAR")
+	return cal.String(), nil
+}
+
+// awayBlock returns when a caregiver's time away ends and when they set it,
+// or zero times if they haven't marked any
+func (app *App) awayBlock(email string) (time.Time, time.Time, error) {
+	var until, since time.Time
+	result, err := app.db.Query("SELECT unavailable_until, updated_at FROM caregiver_availability WHERE email = ?", email)
+	if err != nil {
+		return until, since, fmt.Errorf("failed to query availability: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&until, &since)
+	})
+	if err != nil {
+		return until, since, fmt.Errorf("failed to scan availability: %v", err)
+	}
+	return until, since, nil
+}
+
+// icsTime formats a time as an iCal UTC date-time
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsText escapes an iCal text value
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icsWriter builds an iCal document, folding lines longer than the 75
+// octets RFC 5545 allows
+type icsWriter struct {
+	strings.Builder
+}
+
+func (w *icsWriter) line(s string) {
+	for len(s) > 75 {
+		cut := 75
+		for cut > 0 && s[cut]&0xC0 == 0x80 { // Don't split a UTF-8 character
+			cut--
+		}
+		w.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+	}
+	w.WriteString(s + "\r\n")
+}
+
+// handleCalendarFeed serves /calendar/<token>.ics to calendar apps
+func handleCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/calendar/"), ".ics")
+	ics, builtAt, err := chatRoom.calendarFeed(token)
+	if err != nil {
+		log.Printf("Error serving calendar feed: %v", err)
+		http.Error(w, "Failed to load calendar", http.StatusInternalServerError)
+		return
+	}
+	if ics == "" {
+		http.Error(w, "No such calendar", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", contentETag([]byte(ics)))
+	if r.FormValue("download") != "" {
+		w.Header().Set("Content-Disposition", `attachment; filename="bookings.ics"`)
+	}
+	http.ServeContent(w, r, "", builtAt.UTC().Truncate(time.Second), strings.NewReader(ics))
+}
+
+// CalendarFeedLinks are the addresses a user subscribes to
+type CalendarFeedLinks struct {
+	URL    string `json:"url"`
+	Webcal string `json:"webcal_url"` // Opens the calendar app on most devices
+}
+
+func calendarFeedLinks(token string) CalendarFeedLinks {
+	links := CalendarFeedLinks{URL: calendarFeedURL(token), Webcal: calendarFeedURL(token)}
+	if u, err := url.Parse(links.URL); err == nil {
+		u.Scheme = "webcal"
+		links.Webcal = u.String()
+	}
+	return links
+}
+
+const calendarSettingsTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Calendar Feed</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Calendar Feed</h1>
+            <div class="app-description">See your bookings in Google Calendar, Apple Calendar or any app that subscribes to iCal feeds</div>
+        </div>
+        <div class="wizard-form">
+            <p><a href="{{.Webcal}}">Subscribe in your calendar app</a>, or add this address as a calendar from a URL:</p>
+            <label>Feed address <input type="text" readonly value="{{.Links.URL}}" onclick="this.select()"></label>
+            <p><a href="{{.Links.URL}}?download=1">Download the .ics file</a> to import your bookings once.</p>
+            <p><small>Anyone with this address can see your bookings. If you shared it by mistake, reset it: calendars subscribed to the old address stop updating.</small></p>
+        </div>
+        <form method="POST" class="wizard-form">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <button type="submit" name="action" value="reset" class="send-button">Reset address</button>
+        </form>
+        {{with .Google}}
+        <h3>Google Calendar</h3>
+        <form method="POST" action="google-calendar" class="wizard-form">
+            <input type="hidden" name="email" value="{{$.UserEmail}}">
+            {{if .SyncError}}<div class="status-banner">{{.SyncError}}</div>{{end}}
+            {{if .Connected}}
+            <p>Connected since {{.ConnectedAt.Format "Jan 2, 2006"}}{{if not .SyncedAt.IsZero}}, last synced {{.SyncedAt.Format "Jan 2 3:04 PM"}}{{end}}.
+            Your bookings are added to your Google Calendar, and you won't be matched or booked while it shows you busy.</p>
+            {{if .Busy}}<p>Busy coming up:</p>
+            <ul>{{range .Busy}}<li>{{.Describe}}</li>{{end}}</ul>{{end}}
+            <button type="submit" name="action" value="sync" class="send-button">Sync now</button>
+            <button type="submit" name="action" value="disconnect">Disconnect</button>
+            {{else}}
+            <p>Connect your Google Calendar to have your bookings added to it. You won't be matched or booked while it shows you busy.</p>
+            <button type="submit" name="action" value="connect" class="send-button">Connect Google Calendar</button>
+            {{end}}
+        </form>
+        {{end}}
+        <p><a href="./?email={{.UserEmail}}">Back to chat</a></p>
+    </div>
+</body>
+</html>
+`
+
+// handleCalendarSettings shows a user's feed address, resetting it on POST
+func handleCalendarSettings(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	if r.Method == "POST" && r.FormValue("action") == "reset" {
+		if _, err := chatRoom.ResetCalendarFeed(email); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("calendar?email=%s", url.QueryEscape(email)), http.StatusSeeOther)
+		return
+	}
+	token, err := chatRoom.CalendarFeedToken(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var google *GoogleCalendarLink
+	if chatRoom.IsCaregiver(email) {
+		if google, err = chatRoom.GoogleCalendarStatus(email); err != nil {
+			log.Printf("Error loading Google Calendar for %s: %v", email, err)
+		}
+	}
+	links := calendarFeedLinks(token)
+	renderTemplate(w, "calendar-settings", calendarSettingsTemplate, map[string]interface{}{
+		"UserEmail": email,
+		"Links":     links,
+		"Webcal":    template.URL(links.Webcal), // html/template doesn't trust webcal: links
+		"Google":    google,                     // Nil unless a caregiver can connect one
+	})
+}
+
+// handleCalendarFeedAPI returns a user's feed addresses (GET) or resets
+// them (POST)
+func handleCalendarFeedAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	var token string
+	var err error
+	switch r.Method {
+	case "GET":
+		token, err = chatRoom.CalendarFeedToken(email)
+	case "POST":
+		token, err = chatRoom.ResetCalendarFeed(email)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, calendarFeedLinks(token))
+}
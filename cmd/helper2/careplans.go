@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// A patient's care plan is what a caregiver needs to know to look after
+// them: the tasks, the medication schedule, who to call in an emergency and
+// their physician. The patient (or the family member running the account)
+// writes it, on the care plan page or with the assistant's help, and
+// caregivers whose match with them is accepted or active can read it.
+// Every save is a new version, so earlier ones can be read and restored,
+// and the caregivers are told what changed.
+
+const carePlansSchema = `
+	CREATE TABLE IF NOT EXISTS care_plans (
+		email TEXT,
+		version INTEGER,
+		plan TEXT,
+		changed TEXT,
+		edited_by TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (email, version)
+	)
+`
+
+// maxCarePlanRows caps each list in a care plan
+const maxCarePlanRows = 50
+
+// CareTask is something the caregiver does, and when
+type CareTask struct {
+	Task  string `json:"task"`
+	When  string `json:"when,omitempty"`
+	Notes string `json:"notes,omitempty"`
+}
+
+// Medication is a medicine the patient takes
+type Medication struct {
+	Name     string `json:"name"`
+	Dose     string `json:"dose,omitempty"`
+	Schedule string `json:"schedule,omitempty"`
+	Notes    string `json:"notes,omitempty"`
+}
+
+// EmergencyContact is someone to call if something goes wrong
+type EmergencyContact struct {
+	Name         string `json:"name"`
+	Relationship string `json:"relationship,omitempty"`
+	Phone        string `json:"phone"`
+}
+
+// Physician is the patient's doctor
+type Physician struct {
+	Name     string `json:"name,omitempty"`
+	Practice string `json:"practice,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+}
+
+// CarePlan is one version of a patient's care plan
+type CarePlan struct {
+	Email             string             `json:"email"`
+	Version           int                `json:"version"`
+	Tasks             []CareTask         `json:"tasks"`
+	Medications       []Medication       `json:"medications"`
+	EmergencyContacts []EmergencyContact `json:"emergency_contacts"`
+	Physician         Physician          `json:"physician"`
+	Notes             string             `json:"notes,omitempty"`
+	Changed           []string           `json:"changed,omitempty"` // Sections that differ from the version before
+	EditedBy          string             `json:"edited_by"`
+	CreatedAt         time.Time          `json:"created_at"`
+}
+
+// ChangedLabel lists the sections this version changed, for people
+func (p CarePlan) ChangedLabel() string {
+	return describeChanges(p.Changed)
+}
+
+// carePlanSections are the parts of a plan, by JSON name
+var carePlanSections = []string{"tasks", "medications", "emergency_contacts", "physician", "notes"}
+
+// carePlanSectionLabels name the sections for people
+var carePlanSectionLabels = map[string]string{
+	"tasks":              "tasks",
+	"medications":        "medications",
+	"emergency_contacts": "emergency contacts",
+	"physician":          "physician",
+	"notes":              "notes",
+}
+
+// describeChanges lists changed sections for people
+func describeChanges(sections []string) string {
+	var labels []string
+	for _, s := range sections {
+		labels = append(labels, carePlanSectionLabels[s])
+	}
+	return strings.Join(labels, ", ")
+}
+
+// clean trims the plan's fields, drops empty rows and normalizes phone
+// numbers, failing on rows it can't make sense of
+func (p *CarePlan) clean() error {
+	trim := strings.TrimSpace
+	var tasks []CareTask
+	for _, t := range p.Tasks {
+		t = CareTask{Task: trim(t.Task), When: trim(t.When), Notes: trim(t.Notes)}
+		if t.Task == "" {
+			if t.When != "" || t.Notes != "" {
+				return fmt.Errorf("every task needs saying what it is")
+			}
+			continue
+		}
+		tasks = append(tasks, t)
+	}
+	var meds []Medication
+	for _, m := range p.Medications {
+		m = Medication{Name: trim(m.Name), Dose: trim(m.Dose), Schedule: trim(m.Schedule), Notes: trim(m.Notes)}
+		if m.Name == "" {
+			if m.Dose != "" || m.Schedule != "" || m.Notes != "" {
+				return fmt.Errorf("every medication needs a name")
+			}
+			continue
+		}
+		meds = append(meds, m)
+	}
+	var contacts []EmergencyContact
+	for _, c := range p.EmergencyContacts {
+		c = EmergencyContact{Name: trim(c.Name), Relationship: trim(c.Relationship), Phone: trim(c.Phone)}
+		if c.Name == "" && c.Phone == "" {
+			continue
+		}
+		if c.Name == "" || c.Phone == "" {
+			return fmt.Errorf("every emergency contact needs a name and a phone number")
+		}
+		phone, err := normalizePhone(c.Phone)
+		if err != nil {
+			return fmt.Errorf("emergency contact %s: %v", c.Name, err)
+		}
+		c.Phone = phone
+		contacts = append(contacts, c)
+	}
+	if len(tasks) > maxCarePlanRows || len(meds) > maxCarePlanRows || len(contacts) > maxCarePlanRows {
+		return fmt.Errorf("a care plan can list at most %d of each thing", maxCarePlanRows)
+	}
+
+	p.Tasks, p.Medications, p.EmergencyContacts = tasks, meds, contacts
+	p.Physician = Physician{Name: trim(p.Physician.Name), Practice: trim(p.Physician.Practice), Phone: trim(p.Physician.Phone)}
+	if p.Physician.Phone != "" {
+		phone, err := normalizePhone(p.Physician.Phone)
+		if err != nil {
+			return fmt.Errorf("physician: %v", err)
+		}
+		p.Physician.Phone = phone
+	}
+	p.Notes = trim(p.Notes)
+	return nil
+}
+
+// changedSections lists the sections that differ between two plans, or
+// those filled in when there's no old plan
+func changedSections(old, new *CarePlan) []string {
+	if old == nil {
+		old = &CarePlan{}
+	}
+	oldFields, _ := recordFields(old)
+	newFields, _ := recordFields(new)
+	var changed []string
+	for _, s := range carePlanSections {
+		if fmt.Sprint(oldFields[s]) != fmt.Sprint(newFields[s]) {
+			changed = append(changed, s)
+		}
+	}
+	return changed
+}
+
+// queryCarePlans returns a patient's care plan versions matching a
+// condition, the latest first
+func (app *App) queryCarePlans(email, where string, args ...interface{}) ([]CarePlan, error) {
+	result, err := app.db.Query(`
+		SELECT email, version, plan, changed, edited_by, created_at
+		FROM care_plans WHERE email = ? `+where+`
+		ORDER BY version DESC
+	`, append([]interface{}{email}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query care plans: %v", err)
+	}
+	defer result.Close()
+
+	plans := []CarePlan{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var p CarePlan
+		var plan, changed, editedBy string
+		var version int
+		var createdAt time.Time
+		if err := r.Scan(&p.Email, &version, &plan, &changed, &editedBy, &createdAt); err != nil {
+			return fmt.Errorf("failed to scan care plan: %v", err)
+		}
+		if err := json.Unmarshal([]byte(plan), &p); err != nil {
+			return fmt.Errorf("failed to decode care plan: %v", err)
+		}
+		p.Version, p.EditedBy, p.CreatedAt = version, editedBy, createdAt
+		p.Changed = nil
+		if changed != "" {
+			p.Changed = strings.Split(changed, ",")
+		}
+		plans = append(plans, p)
+		return nil
+	})
+	return plans, err
+}
+
+// CarePlan returns a version of a patient's care plan, the latest for
+// version 0, or nil if there isn't one
+func (app *App) CarePlan(email string, version int) (*CarePlan, error) {
+	where, args := "", []interface{}{}
+	if version > 0 {
+		where, args = "AND version = ?", []interface{}{version}
+	}
+	plans, err := app.queryCarePlans(email, where, args...)
+	if err != nil || len(plans) == 0 {
+		return nil, err
+	}
+	return &plans[0], nil
+}
+
+// CarePlanVersions lists every version of a patient's care plan, the
+// latest first
+func (app *App) CarePlanVersions(email string) ([]CarePlan, error) {
+	return app.queryCarePlans(email, "")
+}
+
+// SaveCarePlan stores a new version of a patient's care plan and tells
+// their matched caregivers what changed. Saving a plan identical to the
+// latest stores nothing and returns the latest.
+func (app *App) SaveCarePlan(email string, plan *CarePlan, by string) (*CarePlan, error) {
+	if app.userRole(email) != "patient" {
+		return nil, fmt.Errorf("only patients have a care plan")
+	}
+	if err := plan.clean(); err != nil {
+		return nil, err
+	}
+	latest, err := app.CarePlan(email, 0)
+	if err != nil {
+		return nil, err
+	}
+	changed := changedSections(latest, plan)
+	if latest != nil && len(changed) == 0 {
+		return latest, nil
+	}
+
+	plan.Email, plan.Version, plan.Changed, plan.EditedBy, plan.CreatedAt = email, 1, changed, by, time.Now()
+	if latest != nil {
+		plan.Version = latest.Version + 1
+	}
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode care plan: %v", err)
+	}
+	err = app.db.Exec(`
+		INSERT INTO care_plans (email, version, plan, changed, edited_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, email, plan.Version, string(data), strings.Join(changed, ","), by, plan.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store care plan: %v", err)
+	}
+
+	if latest != nil {
+		app.announceCarePlan(email, changed)
+	}
+	return plan, nil
+}
+
+// RestoreCarePlan saves an earlier version of a patient's care plan as
+// the latest
+func (app *App) RestoreCarePlan(email string, version int, by string) (*CarePlan, error) {
+	old, err := app.CarePlan(email, version)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return nil, fmt.Errorf("there's no version %d of the care plan", version)
+	}
+	return app.SaveCarePlan(email, old, by)
+}
+
+// carePlanCaregivers returns the caregivers whose match with a patient is
+// accepted or active
+func (app *App) carePlanCaregivers(patientEmail string) ([]string, error) {
+	result, err := app.db.Query("SELECT caregiver_email, status FROM matches WHERE patient_email = ?", patientEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query matches: %v", err)
+	}
+	defer result.Close()
+
+	var caregivers []string
+	err = result.Iterate(func(r *chai.Row) error {
+		var email, status string
+		if err := r.Scan(&email, &status); err != nil {
+			return fmt.Errorf("failed to scan match: %v", err)
+		}
+		if status == MatchAccepted || status == MatchActive {
+			caregivers = append(caregivers, email)
+		}
+		return nil
+	})
+	return caregivers, err
+}
+
+// canViewCarePlan reports whether viewer may read a patient's care plan
+func (app *App) canViewCarePlan(viewer, patientEmail string) bool {
+	if viewer == patientEmail {
+		return true
+	}
+	match, err := app.GetMatch(viewer, patientEmail)
+	return err == nil && match != nil && (match.Status == MatchAccepted || match.Status == MatchActive)
+}
+
+// carePlanReadable reports whether a request may read a patient's care
+// plan, as someone canViewCarePlan allows or as a signed-in admin
+func carePlanReadable(r *http.Request, viewer, patientEmail string) bool {
+	return signedInAdmin(r) != "" || chatRoom.canViewCarePlan(viewer, patientEmail)
+}
+
+// carePlanURL links a user to a patient's care plan
+func carePlanURL(viewer, patientEmail string) string {
+	return fmt.Sprintf("care-plan?email=%s&patient=%s", url.QueryEscape(viewer), url.QueryEscape(patientEmail))
+}
+
+// announceCarePlan tells a patient's caregivers their care plan changed
+func (app *App) announceCarePlan(patientEmail string, changed []string) {
+	caregivers, err := app.carePlanCaregivers(patientEmail)
+	if err != nil {
+		log.Printf("Error finding caregivers for %s's care plan: %v", patientEmail, err)
+		return
+	}
+	for _, c := range caregivers {
+		message := fmt.Sprintf("%s's care plan changed (%s): %s",
+			app.displayName(patientEmail), describeChanges(changed), carePlanURL(c, patientEmail))
+		if err := app.AddMessageWithRecipient(c, "assistant", message, adminThread); err != nil {
+			log.Printf("Error telling %s about a care plan change: %v", c, err)
+		}
+	}
+}
+
+// carePlanBody renders a plan's contents; it's shared by the care plan
+// page and the get_care_plan tool
+const carePlanBody = `
+        {{with .Plan}}
+        <h3>Tasks</h3>
+        {{if .Tasks}}<ul>{{range .Tasks}}<li><strong>{{.Task}}</strong>{{if .When}} · {{.When}}{{end}}{{if .Notes}}<br><small>{{.Notes}}</small>{{end}}</li>{{end}}</ul>{{else}}<p>None yet.</p>{{end}}
+        <h3>Medications</h3>
+        {{if .Medications}}<ul>{{range .Medications}}<li><strong>{{.Name}}</strong>{{if .Dose}} {{.Dose}}{{end}}{{if .Schedule}} · {{.Schedule}}{{end}}{{if .Notes}}<br><small>{{.Notes}}</small>{{end}}</li>{{end}}</ul>{{else}}<p>None listed.</p>{{end}}
+        <h3>Emergency contacts</h3>
+        {{if .EmergencyContacts}}<ul>{{range .EmergencyContacts}}<li><strong>{{.Name}}</strong>{{if .Relationship}} ({{.Relationship}}){{end}}: <a href="tel:{{.Phone}}">{{.Phone}}</a></li>{{end}}</ul>{{else}}<p>None listed.</p>{{end}}
+        <h3>Physician</h3>
+        {{if or .Physician.Name .Physician.Phone}}<p>{{.Physician.Name}}{{if .Physician.Practice}}, {{.Physician.Practice}}{{end}}{{if .Physician.Phone}}: <a href="tel:{{.Physician.Phone}}">{{.Physician.Phone}}</a>{{end}}</p>{{else}}<p>None listed.</p>{{end}}
+        {{if .Notes}}<h3>Notes</h3><p>{{.Notes}}</p>{{end}}
+        <p><small>Version {{.Version}}, {{.CreatedAt.Format "Jan 2 2006 3:04 PM"}} by {{.EditedBy}}</small></p>
+        {{end}}
+`
+
+var carePlanBodyTemplate = template.Must(template.New("care_plan").Parse(carePlanBody))
+
+// formatCarePlan renders a care plan for the chat
+func formatCarePlan(plan *CarePlan) string {
+	var buf bytes.Buffer
+	if err := carePlanBodyTemplate.Execute(&buf, struct{ Plan *CarePlan }{plan}); err != nil {
+		return fmt.Sprintf("Error showing care plan: %v", err)
+	}
+	return "<div class='match-details'>" + buf.String() + "</div>"
+}
+
+var getCarePlanFunction = map[string]interface{}{
+	"name":        "get_care_plan",
+	"description": "Show a patient's care plan: tasks, medications, emergency contacts and physician. Patients see their own; caregivers see those of patients they're matched with.",
+	"parameters": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"patient_email": map[string]interface{}{
+				"type":        "string",
+				"description": "The patient whose plan to show; omit for the current user's own",
+			},
+		},
+	},
+}
+
+var updateCarePlanFunction = map[string]interface{}{
+	"name":        "update_care_plan",
+	"description": "Save the current patient's care plan as drafted with them. Only the sections given are replaced, each with its full new contents; earlier versions are kept.",
+	"parameters": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"tasks": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"task":  map[string]interface{}{"type": "string"},
+						"when":  map[string]interface{}{"type": "string", "description": "e.g. daily at 8am"},
+						"notes": map[string]interface{}{"type": "string"},
+					},
+					"required": []string{"task"},
+				},
+			},
+			"medications": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"name":     map[string]interface{}{"type": "string"},
+						"dose":     map[string]interface{}{"type": "string"},
+						"schedule": map[string]interface{}{"type": "string"},
+						"notes":    map[string]interface{}{"type": "string"},
+					},
+					"required": []string{"name"},
+				},
+			},
+			"emergency_contacts": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"name":         map[string]interface{}{"type": "string"},
+						"relationship": map[string]interface{}{"type": "string"},
+						"phone":        map[string]interface{}{"type": "string"},
+					},
+					"required": []string{"name", "phone"},
+				},
+			},
+			"physician": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"name":     map[string]interface{}{"type": "string"},
+					"practice": map[string]interface{}{"type": "string"},
+					"phone":    map[string]interface{}{"type": "string"},
+				},
+			},
+			"notes": map[string]interface{}{
+				"type":        "string",
+				"description": "Anything else a caregiver should know",
+			},
+		},
+	},
+}
+
+// getCarePlan carries out a get_care_plan call for email
+func (app *App) getCarePlan(email string, args map[string]interface{}) string {
+	patient := getStringArg(args, "patient_email", email)
+	if !app.canViewCarePlan(email, patient) {
+		return "You can only see the care plans of patients you're matched with."
+	}
+	plan, err := app.CarePlan(patient, 0)
+	if err != nil {
+		return fmt.Sprintf("Error loading care plan: %v", err)
+	}
+	if plan == nil {
+		if patient == email {
+			return "You don't have a care plan yet. I can help you write one: tell me about the daily tasks, medications, emergency contacts and physician."
+		}
+		return "They haven't written a care plan yet."
+	}
+	return formatCarePlan(plan)
+}
+
+// updateCarePlan carries out an update_care_plan call for email, keeping
+// the sections the call leaves out
+func (app *App) updateCarePlan(email string, args map[string]interface{}) string {
+	plan := &CarePlan{}
+	if latest, err := app.CarePlan(email, 0); err != nil {
+		return fmt.Sprintf("Error loading care plan: %v", err)
+	} else if latest != nil {
+		plan = latest
+	}
+	// Decoding over the latest version replaces only the sections given
+	if err := json.Unmarshal(mustMarshal(args), plan); err != nil {
+		return fmt.Sprintf("Error reading care plan: %v", err)
+	}
+	saved, err := app.SaveCarePlan(email, plan, "assistant")
+	if err != nil {
+		return fmt.Sprintf("Error saving care plan: %v", err)
+	}
+	return fmt.Sprintf("<p>Saved version %d of your care plan. You can check it, edit it or go back to an earlier version at <a href=\"%s\">your care plan</a>.</p>",
+		saved.Version, carePlanURL(email, email)) + formatCarePlan(saved)
+}
+
+// Rows in the care plan form are one per line, fields split by |
+func formatRows(rows [][]string) string {
+	var lines []string
+	for _, row := range rows {
+		lines = append(lines, strings.TrimRight(strings.Join(row, " | "), " |"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func parseRows(text string, fields int) [][]string {
+	var rows [][]string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "|", fields)
+		for len(parts) < fields {
+			parts = append(parts, "")
+		}
+		rows = append(rows, parts)
+	}
+	return rows
+}
+
+// carePlanFromForm builds a plan from the care plan page's form
+func carePlanFromForm(r *http.Request) *CarePlan {
+	plan := &CarePlan{
+		Physician: Physician{
+			Name:     r.FormValue("physician_name"),
+			Practice: r.FormValue("physician_practice"),
+			Phone:    r.FormValue("physician_phone"),
+		},
+		Notes: r.FormValue("notes"),
+	}
+	for _, row := range parseRows(r.FormValue("tasks"), 3) {
+		plan.Tasks = append(plan.Tasks, CareTask{Task: row[0], When: row[1], Notes: row[2]})
+	}
+	for _, row := range parseRows(r.FormValue("medications"), 4) {
+		plan.Medications = append(plan.Medications, Medication{Name: row[0], Dose: row[1], Schedule: row[2], Notes: row[3]})
+	}
+	for _, row := range parseRows(r.FormValue("emergency_contacts"), 3) {
+		plan.EmergencyContacts = append(plan.EmergencyContacts, EmergencyContact{Name: row[0], Relationship: row[1], Phone: row[2]})
+	}
+	return plan
+}
+
+const carePlanTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Care Plan</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Care Plan</h1>
+            <div class="app-description">{{.PatientName}}{{if and .Plan (ne .Plan.Version .Latest)}} · version {{.Plan.Version}} of {{.Latest}}{{end}}</div>
+        </div>
+        {{if .Plan}}` + carePlanBody + `{{else}}<p>There's no care plan yet.</p>{{end}}
+        {{if .Editable}}
+        {{if and .Plan (ne .Plan.Version .Latest)}}
+        <form class="schedule-form" action="care-plan" method="POST">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="hidden" name="version" value="{{.Plan.Version}}">
+            <button type="submit" name="action" value="restore">Restore this version</button>
+        </form>
+        {{else}}
+        <h3>Edit</h3>
+        <form class="wizard-form" action="care-plan" method="POST">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <label>Tasks, one per line: task | when | notes
+                <textarea name="tasks" rows="5">{{.Form.Tasks}}</textarea></label>
+            <label>Medications, one per line: name | dose | schedule | notes
+                <textarea name="medications" rows="5">{{.Form.Medications}}</textarea></label>
+            <label>Emergency contacts, one per line: name | relationship | phone
+                <textarea name="emergency_contacts" rows="3">{{.Form.EmergencyContacts}}</textarea></label>
+            <label>Physician <input type="text" name="physician_name" value="{{.Form.Physician.Name}}"></label>
+            <label>Practice <input type="text" name="physician_practice" value="{{.Form.Physician.Practice}}"></label>
+            <label>Physician's phone <input type="tel" name="physician_phone" value="{{.Form.Physician.Phone}}"></label>
+            <label>Anything else a caregiver should know
+                <textarea name="notes" rows="3">{{.Form.Notes}}</textarea></label>
+            <button type="submit" name="action" value="save" class="send-button">Save</button>
+        </form>
+        {{end}}
+        {{end}}
+        {{if .Versions}}
+        <h3>Versions</h3>
+        {{range .Versions}}<div><a href="care-plan?email={{$.UserEmail}}&patient={{.Email}}&version={{.Version}}">Version {{.Version}}</a>, {{.CreatedAt.Format "Jan 2 2006 3:04 PM"}} by {{.EditedBy}}{{if .Changed}}: {{.ChangedLabel}}{{end}}</div>{{end}}
+        {{end}}
+        <p><a href="./?email={{.UserEmail}}">Back to chat</a></p>
+    </div>
+</body>
+</html>
+`
+
+// handleCarePlan shows a care plan to the signed-in patient or someone
+// matched with them, with a form for the patient to edit it (POST
+// action=save) or restore an earlier version (action=restore)
+func handleCarePlan(w http.ResponseWriter, r *http.Request) {
+	email := requireUser(w, r)
+	if email == "" {
+		return
+	}
+	if r.Method == "POST" {
+		var err error
+		switch r.FormValue("action") {
+		case "save":
+			_, err = chatRoom.SaveCarePlan(email, carePlanFromForm(r), email)
+		case "restore":
+			version, _ := strconv.Atoi(r.FormValue("version"))
+			_, err = chatRoom.RestoreCarePlan(email, version, email)
+		default:
+			err = fmt.Errorf("unknown action")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, carePlanURL(email, email), http.StatusSeeOther)
+		return
+	}
+
+	patient := r.FormValue("patient")
+	if patient == "" {
+		patient = email
+	}
+	if !carePlanReadable(r, email, patient) {
+		http.Error(w, "You can only see the care plans of patients you're matched with", http.StatusForbidden)
+		return
+	}
+	version, _ := strconv.Atoi(r.FormValue("version"))
+	plan, err := chatRoom.CarePlan(patient, version)
+	if err != nil {
+		log.Printf("Error loading care plan: %v", err)
+		http.Error(w, "Failed to load care plan", http.StatusInternalServerError)
+		return
+	}
+	versions, err := chatRoom.CarePlanVersions(patient)
+	if err != nil {
+		log.Printf("Error loading care plan versions: %v", err)
+	}
+
+	// The form starts from the latest version
+	form := struct {
+		Tasks, Medications, EmergencyContacts, Notes string
+		Physician                                    Physician
+	}{}
+	latest := 0
+	if len(versions) > 0 {
+		p := versions[0]
+		latest = p.Version
+		var rows [][]string
+		for _, t := range p.Tasks {
+			rows = append(rows, []string{t.Task, t.When, t.Notes})
+		}
+		form.Tasks, rows = formatRows(rows), nil
+		for _, m := range p.Medications {
+			rows = append(rows, []string{m.Name, m.Dose, m.Schedule, m.Notes})
+		}
+		form.Medications, rows = formatRows(rows), nil
+		for _, c := range p.EmergencyContacts {
+			rows = append(rows, []string{c.Name, c.Relationship, c.Phone})
+		}
+		form.EmergencyContacts = formatRows(rows)
+		form.Physician, form.Notes = p.Physician, p.Notes
+	}
+
+	renderTemplate(w, "care_plan", carePlanTemplate, map[string]interface{}{
+		"Plan":        plan,
+		"Latest":      latest,
+		"Versions":    versions,
+		"Editable":    email == patient,
+		"Form":        form,
+		"UserEmail":   email,
+		"PatientName": chatRoom.displayName(patient),
+	})
+}
+
+// handleCarePlanAPI returns a care plan the signed-in user may read (GET,
+// patient and version optional) or saves their own from a JSON plan (PUT)
+func handleCarePlanAPI(w http.ResponseWriter, r *http.Request) {
+	email := requireUser(w, r)
+	if email == "" {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		patient := r.FormValue("patient")
+		if patient == "" {
+			patient = email
+		}
+		if !carePlanReadable(r, email, patient) {
+			http.Error(w, "not matched with this patient", http.StatusForbidden)
+			return
+		}
+		version, _ := strconv.Atoi(r.FormValue("version"))
+		plan, err := chatRoom.CarePlan(patient, version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if plan == nil {
+			http.Error(w, "no care plan", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, plan)
+
+	case "PUT":
+		var plan CarePlan
+		if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		saved, err := chatRoom.SaveCarePlan(email, &plan, email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, saved)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCarePlanVersionsAPI lists every version of a care plan the
+// signed-in user may read
+func handleCarePlanVersionsAPI(w http.ResponseWriter, r *http.Request) {
+	email := requireUser(w, r)
+	if email == "" {
+		return
+	}
+	patient := r.FormValue("patient")
+	if patient == "" {
+		patient = email
+	}
+	if !carePlanReadable(r, email, patient) {
+		http.Error(w, "not matched with this patient", http.StatusForbidden)
+		return
+	}
+	versions, err := chatRoom.CarePlanVersions(patient)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, versions)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCarePlanNeedsPatientOrMatch(t *testing.T) {
+	app := newTestApp(t)
+	const patient, caregiver = "patient@example.com", "caregiver@example.com"
+	err := app.StorePatient(&Patient{Email: patient, Name: "Pat", Location: "Austin", PhoneNumber: "+15125550100", Budget: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.db.Exec(`
+		INSERT INTO matches (caregiver_email, patient_email, status, created_at)
+		VALUES (?, ?, 'accepted', ?)
+	`, caregiver, patient, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.SaveCarePlan(patient, &CarePlan{Notes: "Walk daily"}, patient); err != nil {
+		t.Fatal(err)
+	}
+	own, matched, stranger := signIn(t, app, patient), signIn(t, app, caregiver), signIn(t, app, "stranger@example.com")
+
+	tests := []struct {
+		name    string
+		h       http.HandlerFunc
+		method  string
+		target  string
+		session string
+		want    int
+	}{
+		{"page without a session", handleCarePlan, "GET", "/care-plan?patient=" + patient, "", http.StatusUnauthorized},
+		{"page for a stranger", handleCarePlan, "GET", "/care-plan?patient=" + patient, stranger, http.StatusForbidden},
+		{"page for the caregiver", handleCarePlan, "GET", "/care-plan?patient=" + patient, matched, http.StatusOK},
+		{"page for the patient", handleCarePlan, "GET", "/care-plan", own, http.StatusOK},
+		{"API for a stranger", handleCarePlanAPI, "GET", "/api/v1/care-plan?patient=" + patient, stranger, http.StatusForbidden},
+		{"API for the caregiver", handleCarePlanAPI, "GET", "/api/v1/care-plan?patient=" + patient, matched, http.StatusOK},
+		{"saving as the patient from another session", handleCarePlanAPI, "PUT", "/api/v1/care-plan?email=" + patient, stranger, http.StatusForbidden},
+		{"versions without a session", handleCarePlanVersionsAPI, "GET", "/api/v1/care-plan/versions?patient=" + patient, "", http.StatusUnauthorized},
+		{"versions for a stranger", handleCarePlanVersionsAPI, "GET", "/api/v1/care-plan/versions?patient=" + patient, stranger, http.StatusForbidden},
+		{"versions for the caregiver", handleCarePlanVersionsAPI, "GET", "/api/v1/care-plan/versions?patient=" + patient, matched, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := serveSignedIn(tt.h, tt.method, tt.target, "", tt.session); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Caregivers prove their certifications by uploading a photo or PDF of
+// each. The document is kept as an attachment, and the vision model reads
+// its type, issuer, holder and expiry into the certifications table. A
+// caregiver whose name is on a current certificate is shown as document
+// verified, and caregivers hear about certificates that are about to
+// expire.
+
+const certificationsSchema = `
+	CREATE TABLE IF NOT EXISTS certifications (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		cert_type TEXT,
+		issuer TEXT,
+		holder_name TEXT,
+		expires_on TIMESTAMP,
+		name_matches BOOLEAN,
+		status TEXT,
+		error TEXT,
+		created_at TIMESTAMP,
+		extracted_at TIMESTAMP,
+		expiry_notified_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_certifications_email ON certifications(email)
+`
+
+var errCertificateType = errors.New("a certificate must be a photo or a PDF")
+
+// Certification statuses
+const (
+	CertPending   = "pending"   // Uploaded, not read yet
+	CertExtracted = "extracted" // Read successfully
+	CertFailed    = "failed"    // Couldn't be read as a certificate
+)
+
+// certTypeNames maps the ways a certificate names itself to the short
+// names used across the app
+var certTypeNames = map[string]string{
+	"cna":                             "CNA",
+	"certified nursing assistant":     "CNA",
+	"cpr":                             "CPR",
+	"bls":                             "BLS",
+	"basic life support":              "BLS",
+	"first aid":                       "First Aid",
+	"hha":                             "HHA",
+	"home health aide":                "HHA",
+	"lpn":                             "LPN",
+	"lvn":                             "LPN",
+	"licensed practical nurse":        "LPN",
+	"rn":                              "RN",
+	"registered nurse":                "RN",
+	"medication aide":                 "Medication Aide",
+	"certified medication aide":       "Medication Aide",
+	"dementia care":                   "Dementia Care",
+	"certified dementia practitioner": "Dementia Care",
+}
+
+const certificationInstructions = `You read photos and scans of caregiver certificates.
+Reply with only a JSON object with these fields:
+- "type": the certification, e.g. "CNA", "CPR", "First Aid", "HHA"
+- "issuer": the organisation that issued it
+- "holder_name": the name of the person it was issued to
+- "expires_on": the expiry date as YYYY-MM-DD, or "" if none is shown
+If the document is not a certificate, reply {"type": ""}.`
+
+// Certification is what was read from an uploaded certificate. ID is the
+// attachment holding the document.
+type Certification struct {
+	ID          string    `json:"id"`
+	Email       string    `json:"email"`
+	Type        string    `json:"type"`
+	Issuer      string    `json:"issuer"`
+	HolderName  string    `json:"holder_name"`
+	ExpiresOn   time.Time `json:"expires_on,omitempty"`
+	NameMatches bool      `json:"name_matches"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExtractedAt time.Time `json:"extracted_at,omitempty"`
+}
+
+// CertificationStatus is what the chat page shows a caregiver about their
+// certificates
+type CertificationStatus struct {
+	Verified bool
+	List     []Certification
+}
+
+// Expired reports whether the certificate has run out
+func (c Certification) Expired() bool {
+	return !c.ExpiresOn.IsZero() && c.ExpiresOn.Before(time.Now())
+}
+
+// ExpiresSoon reports whether the certificate runs out within the warning
+// period
+func (c Certification) ExpiresSoon() bool {
+	warning := time.Duration(config.Certifications.ExpiryWarningDays) * 24 * time.Hour
+	return !c.ExpiresOn.IsZero() && !c.Expired() && c.ExpiresOn.Before(time.Now().Add(warning))
+}
+
+// certTypeName gives a certificate's type its short name
+func certTypeName(t string) string {
+	t = strings.TrimSpace(t)
+	if name, ok := certTypeNames[strings.ToLower(strings.Trim(t, "."))]; ok {
+		return name
+	}
+	return t
+}
+
+// holderMatches reports whether the name on a certificate is the
+// caregiver's: their first and last names both appear on it
+func holderMatches(holder, name string) bool {
+	words := strings.Fields(strings.ToLower(holder))
+	has := func(w string) bool {
+		for _, h := range words {
+			if strings.Trim(h, ".,") == w {
+				return true
+			}
+		}
+		return false
+	}
+	fields := strings.Fields(strings.ToLower(name))
+	if len(fields) == 0 {
+		return false
+	}
+	return has(fields[0]) && has(fields[len(fields)-1])
+}
+
+// readCertificate asks the vision model what a certificate says
+func readCertificate(email string, a *Attachment, data []byte) (*Certification, error) {
+	encoded := "data:" + a.ContentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	var document map[string]interface{}
+	switch {
+	case strings.HasPrefix(a.ContentType, "image/"):
+		document = map[string]interface{}{"type": "image_url", "image_url": map[string]string{"url": encoded}}
+	case a.ContentType == "application/pdf":
+		document = map[string]interface{}{"type": "file", "file": map[string]string{"filename": a.Name, "file_data": encoded}}
+	default:
+		return nil, fmt.Errorf("only images and PDFs can be read")
+	}
+
+	model := config.Models.Vision
+	resp, err := postChatCompletion(map[string]interface{}{
+		"model":           model,
+		"response_format": map[string]string{"type": "json_object"},
+		"messages": []map[string]interface{}{
+			{"role": "system", "content": certificationInstructions},
+			{"role": "user", "content": []interface{}{document}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no reading returned")
+	}
+	chatRoom.RecordUsage(email, model, resp)
+
+	var read struct {
+		Type       string `json:"type"`
+		Issuer     string `json:"issuer"`
+		HolderName string `json:"holder_name"`
+		ExpiresOn  string `json:"expires_on"`
+	}
+	content := strings.TrimSpace(resp.Choices[0].Message.Content)
+	content = strings.TrimSuffix(strings.TrimPrefix(content, "```json"), "```")
+	if err := json.Unmarshal([]byte(strings.TrimSpace(content)), &read); err != nil {
+		return nil, fmt.Errorf("failed to parse reading: %v", err)
+	}
+	if strings.TrimSpace(read.Type) == "" {
+		return nil, fmt.Errorf("the document doesn't look like a certificate")
+	}
+	c := &Certification{
+		Type:       certTypeName(read.Type),
+		Issuer:     strings.TrimSpace(read.Issuer),
+		HolderName: strings.TrimSpace(read.HolderName),
+	}
+	if read.ExpiresOn != "" {
+		if c.ExpiresOn, err = time.Parse("2006-01-02", read.ExpiresOn); err != nil {
+			return nil, fmt.Errorf("unreadable expiry date %q", read.ExpiresOn)
+		}
+	}
+	return c, nil
+}
+
+// UploadCertification stores a caregiver's certificate and reads it in the
+// background
+func (app *App) UploadCertification(email, name string, data []byte) (*Certification, error) {
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") && contentType != "application/pdf" {
+		return nil, errCertificateType
+	}
+	a, err := app.SaveAttachment(email, name, data)
+	if err != nil {
+		return nil, err
+	}
+	c := &Certification{ID: a.ID, Email: email, Status: CertPending, CreatedAt: a.CreatedAt}
+	err = app.db.Exec(`
+		INSERT INTO certifications (id, email, cert_type, issuer, holder_name, expires_on, name_matches,
+			status, error, created_at, extracted_at, expiry_notified_at)
+		VALUES (?, ?, '', '', '', ?, false, ?, '', ?, ?, ?)
+	`, c.ID, email, time.Time{}, c.Status, c.CreatedAt, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store certification: %v", err)
+	}
+
+	go func() {
+		if err := app.ExtractCertification(email, a, data); err != nil {
+			log.Printf("Error reading certificate %s for %s: %v", a.ID, email, err)
+		}
+	}()
+	return c, nil
+}
+
+// ExtractCertification reads an uploaded certificate, records what it
+// says and tells the caregiver in the chat
+func (app *App) ExtractCertification(email string, a *Attachment, data []byte) error {
+	read, readErr := readCertificate(email, a, data)
+	if readErr != nil {
+		err := app.db.Exec("UPDATE certifications SET status = ?, error = ?, extracted_at = ? WHERE id = ?",
+			CertFailed, readErr.Error(), time.Now(), a.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update certification: %v", err)
+		}
+		return app.AddMessageWithRecipient(email, "assistant",
+			fmt.Sprintf("I couldn't read %s as a certificate (%v). A clear photo of the whole certificate works best.", a.Name, readErr), adminThread)
+	}
+
+	caregiver, err := app.GetCaregiver(email)
+	if err != nil {
+		return err
+	}
+	if caregiver != nil {
+		read.NameMatches = holderMatches(read.HolderName, caregiver.Name)
+	}
+	err = app.db.Exec(`
+		UPDATE certifications SET cert_type = ?, issuer = ?, holder_name = ?, expires_on = ?,
+			name_matches = ?, status = ?, error = '', extracted_at = ?
+		WHERE id = ?
+	`, read.Type, read.Issuer, read.HolderName, read.ExpiresOn, read.NameMatches, CertExtracted, time.Now(), a.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update certification: %v", err)
+	}
+
+	msg := fmt.Sprintf("I read your %s certificate", read.Type)
+	if read.Issuer != "" {
+		msg += " from " + read.Issuer
+	}
+	if !read.ExpiresOn.IsZero() {
+		msg += ", valid until " + read.ExpiresOn.Format("January 2, 2006")
+	}
+	msg += "."
+	switch {
+	case read.Expired():
+		msg += " It has expired, so it doesn't count towards document verification."
+	case !read.NameMatches:
+		msg += fmt.Sprintf(" The name on it (%s) doesn't match your profile, so it doesn't count towards document verification.", read.HolderName)
+	}
+	return app.AddMessageWithRecipient(email, "assistant", msg, adminThread)
+}
+
+// scanCertifications reads query results into certifications
+func scanCertifications(result *chai.Result) ([]Certification, error) {
+	defer result.Close()
+	var certs []Certification
+	err := result.Iterate(func(r *chai.Row) error {
+		var c Certification
+		if err := r.Scan(&c.ID, &c.Email, &c.Type, &c.Issuer, &c.HolderName, &c.ExpiresOn, &c.NameMatches,
+			&c.Status, &c.Error, &c.CreatedAt, &c.ExtractedAt); err != nil {
+			return fmt.Errorf("failed to scan certification: %v", err)
+		}
+		certs = append(certs, c)
+		return nil
+	})
+	return certs, err
+}
+
+const certificationColumns = `id, email, cert_type, issuer, holder_name, expires_on, name_matches,
+	status, error, created_at, extracted_at`
+
+// ListCertifications returns a caregiver's certificates, newest first
+func (app *App) ListCertifications(email string) ([]Certification, error) {
+	result, err := app.db.Query("SELECT "+certificationColumns+" FROM certifications WHERE email = ? ORDER BY created_at DESC", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query certifications: %v", err)
+	}
+	return scanCertifications(result)
+}
+
+// ExpiringCertifications returns read certificates that expire before
+// cutoff and haven't expired yet, soonest first
+func (app *App) ExpiringCertifications(cutoff time.Time) ([]Certification, error) {
+	result, err := app.db.Query(`
+		SELECT `+certificationColumns+` FROM certifications
+		WHERE status = ? AND expires_on > ? AND expires_on < ?
+		ORDER BY expires_on
+	`, CertExtracted, time.Now(), cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query certifications: %v", err)
+	}
+	return scanCertifications(result)
+}
+
+// DocumentVerified reports whether a caregiver has a current certificate
+// in their own name. Certificates without an expiry date count.
+func (app *App) DocumentVerified(email string) bool {
+	verified, err := rowExists(app.db, `
+		SELECT id FROM certifications
+		WHERE email = ? AND status = ? AND name_matches = true AND (expires_on > ? OR expires_on = ?)
+		LIMIT 1
+	`, email, CertExtracted, time.Now(), time.Time{})
+	if err != nil {
+		log.Printf("Error checking certifications for %s: %v", email, err)
+		return false
+	}
+	return verified
+}
+
+// certExpiryJob tells caregivers about certificates running out within the
+// warning period, once per certificate
+func (app *App) certExpiryJob() error {
+	cutoff := time.Now().AddDate(0, 0, config.Certifications.ExpiryWarningDays)
+	result, err := app.db.Query(`
+		SELECT `+certificationColumns+` FROM certifications
+		WHERE status = ? AND expires_on > ? AND expires_on < ? AND expiry_notified_at = ?
+	`, CertExtracted, time.Now(), cutoff, time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to query certifications: %v", err)
+	}
+	certs, err := scanCertifications(result)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range certs {
+		err := app.Notify(Notification{
+			Email: c.Email,
+			Kind:  NotifyCertExpiring,
+			Data: map[string]interface{}{
+				"Type":      c.Type,
+				"Issuer":    c.Issuer,
+				"ExpiresOn": c.ExpiresOn,
+			},
+		})
+		// Unsent notices are tried again on the next run
+		if err != nil {
+			if err != errQuietHours {
+				log.Printf("Error sending certificate expiry notice to %s: %v", c.Email, err)
+			}
+			continue
+		}
+		if err := app.db.Exec("UPDATE certifications SET expiry_notified_at = ? WHERE id = ?", time.Now(), c.ID); err != nil {
+			return fmt.Errorf("failed to update certification: %v", err)
+		}
+	}
+	return nil
+}
+
+// handleCertifications lists a caregiver's certificates as JSON on GET and
+// stores an uploaded certificate on POST
+func handleCertifications(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		certs, err := chatRoom.ListCertifications(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if certs == nil {
+			certs = []Certification{}
+		}
+		writeJSON(w, map[string]interface{}{
+			"document_verified": chatRoom.DocumentVerified(email),
+			"certifications":    certs,
+		})
+
+	case "POST":
+		if !chatRoom.IsCaregiver(email) {
+			http.Error(w, "Only caregivers can upload certifications", http.StatusForbidden)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+		data, name, err := readUpload(r, "file", maxAttachmentSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := chatRoom.UploadCertification(email, name, data); err != nil {
+			if err == errCertificateType {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error saving certification: %v", err)
+			http.Error(w, "Failed to save certification", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "./?email="+url.QueryEscape(email), http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCertificationsAPI lists certificates expiring within ?days=
+// (default the warning period), for admins following up with caregivers
+func handleCertificationsAPI(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+	days := config.Certifications.ExpiryWarningDays
+	if s := r.URL.Query().Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "days must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	certs, err := chatRoom.ExpiringCertifications(time.Now().AddDate(0, 0, days))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if certs == nil {
+		certs = []Certification{}
+	}
+	writeJSON(w, certs)
+}
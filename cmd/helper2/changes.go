@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Every write to a caregiver or patient record is logged with the record
+// before and after, so the latest one can be undone, e.g. when the
+// assistant got a budget or location wrong.
+
+const profileChangesSchema = `
+	CREATE TABLE IF NOT EXISTS profile_changes (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		role TEXT,
+		old_value TEXT,
+		new_value TEXT,
+		created_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_profile_changes_email ON profile_changes(email, created_at)
+`
+
+// unchangedFields aren't compared when deciding what a write changed
+var unchangedFields = map[string]bool{"email": true, "created_at": true, "match_reasons": true}
+
+// FieldChange is one field's value before and after a write. Old is nil
+// for a new record.
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// ProfileChange is one logged write to a user's record
+type ProfileChange struct {
+	ID        string        `json:"id"`
+	Email     string        `json:"email"`
+	Role      string        `json:"role"`
+	Created   bool          `json:"created"` // the write registered the user
+	Fields    []FieldChange `json:"fields"`
+	CreatedAt time.Time     `json:"created_at"`
+
+	oldValue string // JSON of the record before, "" if there was none
+}
+
+var undoLastChangeFunction = map[string]interface{}{
+	"name":        "undo_last_change",
+	"description": "Undo the most recent change to the current user's caregiver or patient profile, e.g. when a detail was saved wrongly",
+	"parameters": map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{},
+	},
+}
+
+// recordFields decodes a record into its fields by JSON name, or nil for
+// a nil record
+func recordFields(record interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// diffFields lists the fields that differ between two records, in name order
+func diffFields(old, new map[string]interface{}) []FieldChange {
+	var changes []FieldChange
+	for field, value := range new {
+		if unchangedFields[field] {
+			continue
+		}
+		before, ok := old[field]
+		if ok && fmt.Sprint(before) == fmt.Sprint(value) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: field, Old: before, New: value})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// recordProfileChange logs a write of new over old (a nil *Caregiver or
+// *Patient for a new record) in the write's own transaction. A write that
+// changes nothing isn't logged.
+func recordProfileChange(tx execer, email, role string, old, new interface{}) error {
+	oldFields, err := recordFields(old)
+	if err != nil {
+		return fmt.Errorf("failed to encode profile: %v", err)
+	}
+	newFields, err := recordFields(new)
+	if err != nil {
+		return fmt.Errorf("failed to encode profile: %v", err)
+	}
+	if oldFields != nil && len(diffFields(oldFields, newFields)) == 0 {
+		return nil
+	}
+
+	var oldValue string
+	if oldFields != nil {
+		data, _ := json.Marshal(old)
+		oldValue = string(data)
+	}
+	newValue, _ := json.Marshal(new)
+	b := make([]byte, 12)
+	rand.Read(b)
+	err = tx.Exec(`
+		INSERT INTO profile_changes (id, email, role, old_value, new_value, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, hex.EncodeToString(b), email, role, oldValue, string(newValue), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to log profile change: %v", err)
+	}
+	return nil
+}
+
+// lastProfileChange returns a user's most recent logged change, or nil
+func lastProfileChange(q execer, email string) (*ProfileChange, error) {
+	result, err := q.Query(`
+		SELECT id, role, old_value, new_value, created_at
+		FROM profile_changes WHERE email = ?
+		ORDER BY created_at DESC LIMIT 1
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profile changes: %v", err)
+	}
+	defer result.Close()
+
+	var found *ProfileChange
+	err = result.Iterate(func(r *chai.Row) error {
+		c := ProfileChange{Email: email}
+		var newValue string
+		if err := r.Scan(&c.ID, &c.Role, &c.oldValue, &newValue, &c.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan profile change: %v", err)
+		}
+		var oldFields, newFields map[string]interface{}
+		if c.oldValue != "" {
+			if err := json.Unmarshal([]byte(c.oldValue), &oldFields); err != nil {
+				return fmt.Errorf("failed to decode profile change: %v", err)
+			}
+		}
+		if err := json.Unmarshal([]byte(newValue), &newFields); err != nil {
+			return fmt.Errorf("failed to decode profile change: %v", err)
+		}
+		c.Created = c.oldValue == ""
+		c.Fields = diffFields(oldFields, newFields)
+		found = &c
+		return nil
+	})
+	return found, err
+}
+
+// UndoLastChange puts a user's record back as it was before their most
+// recent change, removing it if that change created it. It returns the
+// change undone, or nil if there was none.
+func (app *App) UndoLastChange(email string) (*ProfileChange, error) {
+	var change *ProfileChange
+	err := app.withTx(func(tx *chai.Tx) error {
+		var err error
+		if change, err = lastProfileChange(tx, email); err != nil || change == nil {
+			return err
+		}
+		if err := restoreProfile(tx, change); err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM profile_changes WHERE id = ?", change.ID); err != nil {
+			return fmt.Errorf("failed to drop profile change: %v", err)
+		}
+		return nil
+	})
+	if err != nil || change == nil {
+		return nil, err
+	}
+	app.onProfileWrite(email)
+	return change, nil
+}
+
+// restoreProfile writes back the record from before change
+func restoreProfile(tx *chai.Tx, change *ProfileChange) error {
+	table := "caregivers"
+	if change.Role == "patient" {
+		table = "patients"
+	}
+	if change.Created {
+		if err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE email = ?", table), change.Email); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", change.Role, err)
+		}
+		if err := tx.Exec("DELETE FROM profile_locations WHERE email = ? AND role = ?", change.Email, change.Role); err != nil {
+			return fmt.Errorf("failed to remove profile location: %v", err)
+		}
+		return nil
+	}
+
+	if change.Role == "patient" {
+		var p Patient
+		if err := json.Unmarshal([]byte(change.oldValue), &p); err != nil {
+			return fmt.Errorf("failed to decode profile change: %v", err)
+		}
+		if err := storeProfileLocation(tx, p.Email, "patient", p.Location, p.Budget); err != nil {
+			return err
+		}
+		err := tx.Exec(`
+			UPDATE patients
+			SET name = ?, care_needs = ?, location = ?, schedule_requirements = ?,
+				budget = ?, special_requirements = ?, phone_number = ?
+			WHERE email = ?
+		`, p.Name, p.CareNeeds, p.Location, p.ScheduleRequirements,
+			p.Budget, p.SpecialRequirements, p.PhoneNumber, p.Email)
+		if err != nil {
+			return fmt.Errorf("failed to restore patient: %v", err)
+		}
+		return nil
+	}
+
+	var c Caregiver
+	if err := json.Unmarshal([]byte(change.oldValue), &c); err != nil {
+		return fmt.Errorf("failed to decode profile change: %v", err)
+	}
+	if err := storeProfileLocation(tx, c.Email, "caregiver", c.Location, c.RateExpectations); err != nil {
+		return err
+	}
+	err := tx.Exec(`
+		UPDATE caregivers
+		SET name = ?, experience = ?, location = ?, availability = ?,
+			specializations = ?, rate_expectations = ?, certifications = ?
+		WHERE email = ?
+	`, c.Name, c.Experience, c.Location, c.Availability,
+		c.Specializations, c.RateExpectations, c.Certifications, c.Email)
+	if err != nil {
+		return fmt.Errorf("failed to restore caregiver: %v", err)
+	}
+	return nil
+}
+
+// formatUndoneChange tells the user what undoing change put back
+func formatUndoneChange(change *ProfileChange) string {
+	if change == nil {
+		return "There are no profile changes to undo."
+	}
+	if change.Created {
+		return fmt.Sprintf("Undone: your %s profile has been removed, as it was before you registered.", change.Role)
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Undone your last change to your %s profile:<ul>", change.Role))
+	for _, f := range change.Fields {
+		sb.WriteString(fmt.Sprintf("<li>%s is back to %s (was %s)</li>",
+			strings.ReplaceAll(f.Field, "_", " "),
+			template.HTMLEscapeString(fmt.Sprint(f.Old)), template.HTMLEscapeString(fmt.Sprint(f.New))))
+	}
+	sb.WriteString("</ul>")
+	return sb.String()
+}
+
+// handleProfileUndo undoes the user's most recent profile change (POST),
+// answering with the change undone, or 404 if there was none
+func handleProfileUndo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	change, err := chatRoom.UndoLastChange(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if change == nil {
+		http.Error(w, "No profile changes to undo", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, change)
+}
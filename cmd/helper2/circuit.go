@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Circuit states
+const (
+	CircuitClosed   = "closed"    // Requests go through
+	CircuitOpen     = "open"      // Requests fail fast until the cooldown ends
+	CircuitHalfOpen = "half-open" // One trial request is deciding which way to go
+)
+
+var errCircuitOpen = errors.New("OpenAI is unavailable; not retrying until the cooldown ends")
+
+// circuitBreaker stops calling an upstream that keeps failing. After
+// threshold failures in a row it opens and fails fast for cooldown; then
+// one trial request is let through, and its outcome closes or reopens it.
+type circuitBreaker struct {
+	next      http.RoundTripper // nil means http.DefaultTransport
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	onOpen   func(failures int) // Called when a closed breaker opens
+}
+
+// CircuitStatus describes a breaker for the status page
+type CircuitStatus struct {
+	State    string    `json:"state"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+}
+
+// openAICircuit guards every OpenAI request. Offline mode and fixtures
+// replace its next transport.
+var openAICircuit = &circuitBreaker{threshold: 5, cooldown: 30 * time.Second, state: CircuitClosed}
+
+// openAIClient carries every OpenAI request
+var openAIClient = &http.Client{Timeout: 30 * time.Second, Transport: openAICircuit}
+
+func (c *circuitBreaker) transport() http.RoundTripper {
+	if c.next == nil {
+		return http.DefaultTransport
+	}
+	return c.next
+}
+
+func (c *circuitBreaker) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < c.cooldown {
+			c.mu.Unlock()
+			return nil, errCircuitOpen
+		}
+		c.state = CircuitHalfOpen
+	case CircuitHalfOpen:
+		// The trial request is still out
+		c.mu.Unlock()
+		return nil, errCircuitOpen
+	}
+	c.mu.Unlock()
+
+	resp, err := c.transport().RoundTrip(r)
+	failed := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !failed {
+		c.state, c.failures = CircuitClosed, 0
+		return resp, err
+	}
+	c.failures++
+	if c.state == CircuitHalfOpen || c.failures >= c.threshold {
+		// A failed trial reopens it quietly; only the first opening is news
+		if c.state == CircuitClosed && c.onOpen != nil {
+			go c.onOpen(c.failures)
+		}
+		c.state, c.openedAt = CircuitOpen, time.Now()
+	}
+	return resp, err
+}
+
+// OnOpen sets fn to be called each time the breaker opens after being
+// closed
+func (c *circuitBreaker) OnOpen(fn func(failures int)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onOpen = fn
+}
+
+// Status reports the breaker's current state
+func (c *circuitBreaker) Status() CircuitStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CircuitStatus{State: c.state, Failures: c.failures}
+	if c.state != CircuitClosed {
+		s.OpenedAt = c.openedAt
+	}
+	return s
+}
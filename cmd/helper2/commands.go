@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"strings"
+)
+
+// Chat messages starting with a slash command are answered here without
+// the model, so they're instant and cost nothing. Anything else starting
+// with a slash, such as an unknown command, still goes to the model.
+
+// chatCommand is one slash command. run returns the assistant's reply.
+type chatCommand struct {
+	name  string
+	usage string
+	help  string
+	run   func(app *App, email string, args []string) (string, error)
+}
+
+var chatCommands = []chatCommand{
+	{"profile", "/profile", "Show what's stored in your profile", runProfileCommand},
+	{"matches", "/matches", "Show your best matches", runMatchesCommand},
+	{"skills", "/skills [add|remove SKILL]", "List, add or remove your skills", runSkillsCommand},
+	{"availability", "/availability [on|off|until DATE]", "Show, pause or resume being matched, or be away until a date", runAvailabilityCommand},
+	{"undo", "/undo", "Undo your last profile change", runUndoCommand},
+	{"new", "/new [NAME]", "Start a fresh conversation; your profile is kept", runNewCommand},
+	{"delete-my-data", "/delete-my-data", "Delete your profile, conversation and everything else stored about you", runDeleteCommand},
+	{"human", "/human", "Ask a person from our team to join the conversation", runHumanCommand},
+	{"help", "/help", "List these commands", nil},
+}
+
+// deleteConfirmation must follow /delete-my-data for it to go ahead
+const deleteConfirmation = "confirm"
+
+const dataDeletedMessage = "Everything stored about you has been deleted. You can start again any time by sending a message."
+
+// parseChatCommand splits a message into a known command and its
+// arguments. ok is false for anything that isn't one.
+func parseChatCommand(message string) (cmd chatCommand, args []string, ok bool) {
+	fields := strings.Fields(message)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return chatCommand{}, nil, false
+	}
+	name := strings.ToLower(strings.TrimPrefix(fields[0], "/"))
+	for _, c := range chatCommands {
+		if c.name == name {
+			return c, fields[1:], true
+		}
+	}
+	return chatCommand{}, nil, false
+}
+
+// RunChatCommand answers message if it's a slash command, reporting
+// whether it was one
+func (app *App) RunChatCommand(email, message string) (bool, error) {
+	cmd, args, ok := parseChatCommand(message)
+	if !ok {
+		return false, nil
+	}
+	log.Printf("Running /%s for %s", cmd.name, email)
+
+	var reply string
+	var err error
+	if cmd.name == "help" {
+		reply = commandHelp()
+	} else {
+		reply, err = cmd.run(app, email, args)
+	}
+	if err != nil {
+		log.Printf("Error running /%s for %s: %v", cmd.name, email, err)
+		reply = fmt.Sprintf("Sorry, /%s failed: %v", cmd.name, err)
+	}
+	return true, app.AddMessageWithRecipient(email, "assistant", reply, "admin")
+}
+
+func commandHelp() string {
+	var sb strings.Builder
+	sb.WriteString("<ul>")
+	for _, c := range chatCommands {
+		sb.WriteString(fmt.Sprintf("<li><code>%s</code>: %s</li>", template.HTMLEscapeString(c.usage), c.help))
+	}
+	sb.WriteString("</ul>")
+	return sb.String()
+}
+
+func runProfileCommand(app *App, email string, args []string) (string, error) {
+	status, err := app.ProfileStatus(email)
+	if err != nil {
+		return "", err
+	}
+	if status.Role == "unknown" {
+		return "You haven't set up a profile yet. Tell me whether you're a caregiver or looking for care to get started.", nil
+	}
+	card, err := app.formatProfileCard(email)
+	if err != nil {
+		return "", err
+	}
+	return card + formatProfileStatus(status), nil
+}
+
+func runMatchesCommand(app *App, email string, args []string) (string, error) {
+	switch app.userRole(email) {
+	case "caregiver":
+		return app.dispatchFunctionCall("find_matching_patients", nil, email), nil
+	case "patient":
+		return app.dispatchFunctionCall("find_matching_caregivers", nil, email), nil
+	}
+	return "Set up your profile first, then /matches will show who suits you.", nil
+}
+
+func runSkillsCommand(app *App, email string, args []string) (string, error) {
+	if !app.IsCaregiver(email) {
+		return "Skills are part of a caregiver's profile.", nil
+	}
+	if len(args) > 0 {
+		action := strings.ToLower(args[0])
+		skill := strings.Join(args[1:], " ")
+		if (action != "add" && action != "remove") || skill == "" {
+			return "Usage: <code>/skills add SKILL</code> or <code>/skills remove SKILL</code>", nil
+		}
+		if len(skill) > maxShortField {
+			return fmt.Sprintf("A skill can be at most %d characters.", maxShortField), nil
+		}
+		var err error
+		if action == "add" {
+			err = app.AddSkill(email, skill)
+		} else {
+			err = app.RemoveSkill(email, skill)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	skills, err := app.GetSkills(email)
+	if err != nil {
+		return "", err
+	}
+	if len(skills) == 0 {
+		return "You haven't listed any skills. Add one with <code>/skills add SKILL</code>.", nil
+	}
+	return template.HTMLEscapeString("Your skills: " + strings.Join(skills, ", ")), nil
+}
+
+func runAvailabilityCommand(app *App, email string, args []string) (string, error) {
+	if !app.IsCaregiver(email) {
+		return "Availability is part of a caregiver's profile.", nil
+	}
+	if len(args) == 0 {
+		a, err := app.GetAvailability(email)
+		if err != nil {
+			return "", err
+		}
+		return a.Describe(), nil
+	}
+
+	var call map[string]interface{}
+	switch strings.ToLower(args[0]) {
+	case "on":
+		call = map[string]interface{}{"active": true}
+	case "off":
+		call = map[string]interface{}{"active": false}
+	case "until":
+		call = map[string]interface{}{"unavailable_until": strings.Join(args[1:], " ")}
+	default:
+		return "Usage: <code>/availability on</code>, <code>/availability off</code> or <code>/availability until 2006-01-02</code>", nil
+	}
+	return app.updateAvailability(email, call), nil
+}
+
+func runHumanCommand(app *App, email string, args []string) (string, error) {
+	return app.requestHandoffReply(email, HandoffByUser, strings.Join(args, " ")), nil
+}
+
+func runNewCommand(app *App, email string, args []string) (string, error) {
+	t, err := app.NewThread(email, strings.Join(args, " "))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Started %s. I still know your profile, but not what we talked about before. How can I help?",
+		template.HTMLEscapeString(t.Name)), nil
+}
+
+func runUndoCommand(app *App, email string, args []string) (string, error) {
+	change, err := app.UndoLastChange(email)
+	if err != nil {
+		return "", err
+	}
+	return formatUndoneChange(change), nil
+}
+
+func runDeleteCommand(app *App, email string, args []string) (string, error) {
+	if len(args) != 1 || strings.ToLower(args[0]) != deleteConfirmation {
+		return fmt.Sprintf("This permanently deletes your profile, matches, conversation and uploads. "+
+			"Send <code>/delete-my-data %s</code> to go ahead.", deleteConfirmation), nil
+	}
+	if err := app.DeleteUserData(email); err != nil {
+		return "", err
+	}
+	return dataDeletedMessage, nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// summaryModel writes compaction summaries; they are short and not user facing
+const summaryModel = defaultChatModel
+
+// summariesInPrompt is how many of a user's latest summaries go into each turn
+const summariesInPrompt = 3
+
+const compactionSchema = `
+	CREATE TABLE IF NOT EXISTS chat_summaries (
+		email TEXT,
+		period_start TIMESTAMP,
+		period_end TIMESTAMP,
+		message_count INTEGER,
+		summary TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (email, period_end)
+	);
+
+	CREATE TABLE IF NOT EXISTS chat_archives (
+		email TEXT,
+		path TEXT,
+		period_start TIMESTAMP,
+		period_end TIMESTAMP,
+		message_count INTEGER,
+		created_at TIMESTAMP,
+		PRIMARY KEY (email, path)
+	);
+	CREATE INDEX IF NOT EXISTS idx_chat_archives_email ON chat_archives(email)
+`
+
+const summaryInstructions = `Summarise this conversation between a user of a caregiver matching service and its assistant. Keep facts the assistant will need later: who the user is, what care they need or offer, locations, rates, schedules, preferences, and any matches or decisions. Write plain prose, at most 150 words.`
+
+// ChatArchive records one archive of compacted messages; Path is its
+// object store key
+type ChatArchive struct {
+	Email        string    `json:"email"`
+	Path         string    `json:"path"`
+	PeriodStart  time.Time `json:"period_start"`
+	PeriodEnd    time.Time `json:"period_end"`
+	MessageCount int       `json:"message_count"`
+}
+
+// writeArchive stores entries in the object store as gzipped JSONL and
+// returns the object key
+func (app *App) writeArchive(email string, entries []ChatHistoryEntry) (string, error) {
+	key := fmt.Sprintf("archive/%s/%d.jsonl.gz", userKey(email), entries[len(entries)-1].CreatedAt.UnixNano())
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return "", fmt.Errorf("failed to write archive: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("failed to write archive: %v", err)
+	}
+	if err := app.objects.Put(key, &buf, "application/gzip"); err != nil {
+		return "", fmt.Errorf("failed to store archive: %v", err)
+	}
+	return key, nil
+}
+
+// readArchive calls fn for each message in an archive, in order
+func (app *App) readArchive(key string, fn func(ChatHistoryEntry) error) error {
+	body, err := app.objects.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to open archive %s: %v", key, err)
+	}
+	defer body.Close()
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %v", err)
+	}
+	defer zr.Close()
+
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e ChatHistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("failed to decode archived message: %v", err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// summarizeEntries asks the model for a short summary of a stretch of chat
+func summarizeEntries(email string, entries []ChatHistoryEntry) (string, error) {
+	var transcript strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&transcript, "[%s] %s: %s\n", e.CreatedAt.Format("2006-01-02"), e.Role, e.Content)
+	}
+	resp, err := postChatCompletion(map[string]interface{}{
+		"model": summaryModel,
+		"messages": []Message{
+			{Role: "system", Content: summaryInstructions},
+			{Role: "user", Content: transcript.String()},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("no summary returned")
+	}
+	chatRoom.RecordUsage(email, summaryModel, resp)
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// CompactUser archives and summarises a user's messages older than cutoff,
+// then removes them from chat_history. The archive is written before
+// anything is deleted, so a failure part way leaves the rows in place.
+func (app *App) CompactUser(email string, cutoff time.Time) (int, error) {
+	result, err := app.db.Query(`
+		SELECT email, role, content, recipient, thread_id, created_at
+		FROM chat_history
+		WHERE email = ? AND created_at < ?
+		ORDER BY created_at ASC
+	`, email, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query chat history: %v", err)
+	}
+	var entries []ChatHistoryEntry
+	err = result.Iterate(func(r *chai.Row) error {
+		var e ChatHistoryEntry
+		if err := r.Scan(&e.Email, &e.Role, &e.Content, &e.Recipient, &e.Thread, &e.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan message: %v", err)
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	result.Close()
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	summary, err := summarizeEntries(email, entries)
+	if err != nil {
+		return 0, fmt.Errorf("failed to summarise history: %v", err)
+	}
+	path, err := app.writeArchive(email, entries)
+	if err != nil {
+		return 0, err
+	}
+
+	start, end := entries[0].CreatedAt, entries[len(entries)-1].CreatedAt
+	err = app.withTx(func(tx *chai.Tx) error {
+		err := tx.Exec(`
+			INSERT INTO chat_archives (email, path, period_start, period_end, message_count, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, email, path, start, end, len(entries), time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to record archive: %v", err)
+		}
+		err = tx.Exec(`
+			INSERT INTO chat_summaries (email, period_start, period_end, message_count, summary, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, email, start, end, len(entries), summary, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to store summary: %v", err)
+		}
+		// Only the archived rows go; anything written since is kept
+		err = tx.Exec("DELETE FROM chat_history WHERE email = ? AND created_at <= ?", email, end)
+		if err != nil {
+			return fmt.Errorf("failed to delete compacted messages: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		if delErr := app.objects.Delete(path); delErr != nil {
+			log.Printf("Error removing unused archive %s: %v", path, delErr)
+		}
+		return 0, err
+	}
+	app.InvalidateSession(email)
+	return len(entries), nil
+}
+
+// compactionJob compacts every user with messages past the configured age
+func (app *App) compactionJob() error {
+	if config.Archive.CompactAfterDays <= 0 || os.Getenv("OPENAI_API_KEY") == "" {
+		return nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -config.Archive.CompactAfterDays)
+
+	result, err := app.db.Query("SELECT email FROM chat_history WHERE created_at < ?", cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to query old messages: %v", err)
+	}
+	users := make(map[string]bool)
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		if err := r.Scan(&email); err != nil {
+			return err
+		}
+		users[email] = true
+		return nil
+	})
+	result.Close()
+	if err != nil {
+		return fmt.Errorf("failed to iterate old messages: %v", err)
+	}
+
+	var failed []string
+	for email := range users {
+		n, err := app.CompactUser(email, cutoff)
+		if err != nil {
+			log.Printf("Error compacting history for %s: %v", email, err)
+			failed = append(failed, email)
+			continue
+		}
+		log.Printf("Compacted %d messages for %s", n, email)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("compaction failed for %d users", len(failed))
+	}
+	return nil
+}
+
+// ConversationSummary returns the user's latest compaction summaries as a
+// system note, or "" if nothing has been compacted
+func (app *App) ConversationSummary(email string) string {
+	result, err := app.db.Query(`
+		SELECT period_start, period_end, summary
+		FROM chat_summaries
+		WHERE email = ?
+		ORDER BY period_end DESC
+		LIMIT ?
+	`, email, summariesInPrompt)
+	if err != nil {
+		log.Printf("Error querying chat summaries: %v", err)
+		return ""
+	}
+	defer result.Close()
+
+	var parts []string
+	err = result.Iterate(func(r *chai.Row) error {
+		var start, end time.Time
+		var summary string
+		if err := r.Scan(&start, &end, &summary); err != nil {
+			return err
+		}
+		parts = append(parts, fmt.Sprintf("%s to %s: %s",
+			start.Format("Jan 2 2006"), end.Format("Jan 2 2006"), summary))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error scanning chat summaries: %v", err)
+		return ""
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	// Oldest first reads more naturally
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return "Summary of earlier conversation with this user:\n" + strings.Join(parts, "\n")
+}
+
+// ChatArchives lists a user's archive files, oldest first
+func (app *App) ChatArchives(email string) ([]ChatArchive, error) {
+	result, err := app.db.Query(`
+		SELECT email, path, period_start, period_end, message_count
+		FROM chat_archives
+		WHERE email = ?
+		ORDER BY period_start ASC
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chat archives: %v", err)
+	}
+	defer result.Close()
+
+	var archives []ChatArchive
+	err = result.Iterate(func(r *chai.Row) error {
+		var a ChatArchive
+		if err := r.Scan(&a.Email, &a.Path, &a.PeriodStart, &a.PeriodEnd, &a.MessageCount); err != nil {
+			return fmt.Errorf("failed to scan chat archive: %v", err)
+		}
+		archives = append(archives, a)
+		return nil
+	})
+	return archives, err
+}
+
+// purgeArchives deletes archive files whose newest message is older than
+// days, so compacted history follows the chat_history retention policy
+func (app *App) purgeArchives(days int, held map[string]bool, dryRun bool) PurgeReport {
+	cutoff := time.Now().AddDate(0, 0, -days)
+	report := PurgeReport{Table: "chat_archives", Days: days, Cutoff: cutoff}
+
+	result, err := app.db.Query(`
+		SELECT email, path, period_start, period_end, message_count
+		FROM chat_archives WHERE period_end < ?
+	`, cutoff)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to query chat_archives: %v", err)
+		return report
+	}
+	var expired []ChatArchive
+	err = result.Iterate(func(r *chai.Row) error {
+		var a ChatArchive
+		if err := r.Scan(&a.Email, &a.Path, &a.PeriodStart, &a.PeriodEnd, &a.MessageCount); err != nil {
+			return err
+		}
+		expired = append(expired, a)
+		return nil
+	})
+	result.Close()
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to iterate chat_archives: %v", err)
+		return report
+	}
+
+	for _, a := range expired {
+		report.Eligible += a.MessageCount
+		if held[a.Email] {
+			report.Held += a.MessageCount
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		if err := app.objects.Delete(a.Path); err != nil {
+			report.Error = fmt.Sprintf("failed to delete archive %s: %v", a.Path, err)
+			return report
+		}
+		err := app.db.Exec("DELETE FROM chat_archives WHERE email = ? AND path = ?", a.Email, a.Path)
+		if err != nil {
+			report.Error = fmt.Sprintf("failed to delete archive record %s: %v", a.Path, err)
+			return report
+		}
+		report.Deleted += a.MessageCount
+	}
+	return report
+}
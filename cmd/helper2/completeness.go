@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ProfileStatus says how much of a user's profile is filled in. The fields
+// and which of them are required are the onboarding wizard's.
+type ProfileStatus struct {
+	Role            string   `json:"role"`
+	Percent         int      `json:"percent"`
+	Filled          []string `json:"filled"`
+	MissingRequired []string `json:"missing_required"`
+	MissingOptional []string `json:"missing_optional"`
+}
+
+// Complete reports whether every required field is filled
+func (s *ProfileStatus) Complete() bool {
+	return s.Role != "unknown" && len(s.MissingRequired) == 0
+}
+
+// profileValues returns a user's stored profile by wizard field name
+func (app *App) profileValues(email, role string) (map[string]string, error) {
+	values := make(map[string]string)
+	money := func(f float64) string {
+		if f == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(f, 'f', 2, 64)
+	}
+
+	switch role {
+	case "caregiver":
+		c, err := app.GetCaregiver(email)
+		if err != nil || c == nil {
+			return values, err
+		}
+		values["name"] = c.Name
+		values["location"] = c.Location
+		values["experience"] = c.Experience
+		values["certifications"] = c.Certifications
+		values["availability"] = c.Availability
+		values["rate_expectations"] = money(c.RateExpectations)
+		values["specializations"] = c.Specializations
+		skills, err := app.GetSkills(email)
+		if err != nil {
+			return values, err
+		}
+		values["skills"] = strings.Join(skills, ", ")
+		if values["phone_number"], err = app.PhoneNumberFor(email); err != nil {
+			return values, err
+		}
+	case "patient":
+		p, err := app.GetPatient(email)
+		if err != nil || p == nil {
+			return values, err
+		}
+		values["name"] = p.Name
+		values["location"] = p.Location
+		values["phone_number"] = p.PhoneNumber
+		values["care_needs"] = p.CareNeeds
+		values["schedule_requirements"] = p.ScheduleRequirements
+		values["budget"] = money(p.Budget)
+		values["special_requirements"] = p.SpecialRequirements
+	}
+
+	custom, err := app.CustomFieldValues(email)
+	if err != nil {
+		return values, err
+	}
+	for name, v := range custom {
+		values[name] = v
+	}
+	return values, nil
+}
+
+// ProfileStatus works out which of a user's profile fields are filled.
+// Required fields count double towards the percentage.
+func (app *App) ProfileStatus(email string) (*ProfileStatus, error) {
+	status := &ProfileStatus{Role: app.userRole(email)}
+	if status.Role == "unknown" {
+		status.MissingRequired = []string{"role (caregiver or patient)"}
+		return status, nil
+	}
+	values, err := app.profileValues(email, status.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	var earned, total int
+	for step := 1; step < len(wizardSteps); step++ {
+		for _, f := range app.wizardFieldsFor(step, status.Role) {
+			weight := 1
+			if f.Required {
+				weight = 2
+			}
+			total += weight
+			switch {
+			case strings.TrimSpace(values[f.Name]) != "":
+				earned += weight
+				status.Filled = append(status.Filled, f.Label)
+			case f.Required:
+				status.MissingRequired = append(status.MissingRequired, f.Label)
+			default:
+				status.MissingOptional = append(status.MissingOptional, f.Label)
+			}
+		}
+	}
+	if total > 0 {
+		status.Percent = earned * 100 / total
+	}
+	return status, nil
+}
+
+// formatProfileStatus describes what's left to fill in, for the assistant
+func formatProfileStatus(s *ProfileStatus) string {
+	if s.Role == "unknown" {
+		return "Not registered yet: ask whether they are a caregiver or a patient."
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Registered as a %s; profile %d%% complete.", s.Role, s.Percent))
+	if len(s.MissingRequired) > 0 {
+		sb.WriteString(" Still required: " + strings.Join(s.MissingRequired, ", ") + ".")
+	}
+	if len(s.MissingOptional) > 0 {
+		sb.WriteString(" Optional, not yet given: " + strings.Join(s.MissingOptional, ", ") + ".")
+	}
+	if len(s.MissingRequired) == 0 && len(s.MissingOptional) == 0 {
+		sb.WriteString(" Nothing is missing.")
+	}
+	return sb.String()
+}
+
+// profileStatusFor is the chat page's view of a user's progress; nil hides it
+func (app *App) profileStatusFor(email string) *ProfileStatus {
+	status, err := app.ProfileStatus(email)
+	if err != nil {
+		log.Printf("Error computing profile status for %s: %v", email, err)
+		return nil
+	}
+	if status.Role == "unknown" || status.Percent == 100 {
+		return nil
+	}
+	return status
+}
+
+var profileStatusFunction = map[string]interface{}{
+	"name":        "get_profile_status",
+	"description": "Check which of the current user's profile fields are filled in and which are still missing. Use it before asking for details, so you only ask for what's missing",
+	"parameters": map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{},
+	},
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var configFile = flag.String("config", "", "Path to a JSON config file")
+
+// Config holds deployment settings. Every field has a working default, so
+// the config file only needs the values that differ.
+type Config struct {
+	Models           ModelConfig            `json:"models"`
+	Retention        RetentionConfig        `json:"retention"`
+	Archive          ArchiveConfig          `json:"archive"`
+	Storage          StorageConfig          `json:"storage"`
+	Events           EventsConfig           `json:"events"`
+	Redis            RedisConfig            `json:"redis"`
+	Branding         BrandingConfig         `json:"branding"`
+	Matching         MatchingConfig         `json:"matching"`
+	Digest           DigestConfig           `json:"digest"`
+	Email            EmailConfig            `json:"email"`
+	Database         DatabaseConfig         `json:"database"`
+	HTTP             HTTPConfig             `json:"http"`
+	Phone            PhoneConfig            `json:"phone"`
+	Bots             BotConfig              `json:"bots"`
+	Sessions         SessionsConfig         `json:"sessions"`
+	Tools            ToolConfig             `json:"tools"`
+	TestData         TestDataConfig         `json:"test_data"`
+	Ops              OpsConfig              `json:"ops"`
+	WhatsApp         WhatsAppConfig         `json:"whatsapp"`
+	Transcription    TranscriptionConfig    `json:"transcription"`
+	Speech           SpeechConfig           `json:"speech"`
+	Certifications   CertificationsConfig   `json:"certifications"`
+	BackgroundChecks BackgroundChecksConfig `json:"background_checks"`
+	Safety           SafetyConfig           `json:"safety"`
+	Moderation       ModerationConfig       `json:"moderation"`
+	Accounts         AccountsConfig         `json:"accounts"`
+	Shifts           ShiftsConfig           `json:"shifts"`
+	GoogleCalendar   GoogleCalendarConfig   `json:"google_calendar"`
+	Reminders        RemindersConfig        `json:"reminders"`
+	// Schedules overrides the cron expression of a scheduled job by name;
+	// "off" disables it
+	Schedules map[string]string `json:"schedules"`
+}
+
+// ModelConfig picks the OpenAI model for each kind of chat turn
+type ModelConfig struct {
+	Default    string `json:"default"`
+	SmallTalk  string `json:"small_talk"`
+	ToolCall   string `json:"tool_call"`
+	Extraction string `json:"extraction"`
+	// Vision reads uploaded documents such as certificates
+	Vision string `json:"vision"`
+	// ToolKeywords mark a message as likely to need a tool call
+	ToolKeywords []string `json:"tool_keywords"`
+	// SmallTalkMaxLength is the longest message still treated as small talk
+	SmallTalkMaxLength int `json:"small_talk_max_length"`
+}
+
+// RetentionConfig sets how long rows are kept in each table
+type RetentionConfig struct {
+	// Days maps a table name to the age in days after which its rows are
+	// purged. Zero keeps a table forever.
+	Days map[string]int `json:"days"`
+}
+
+// ArchiveConfig controls chat history compaction
+type ArchiveConfig struct {
+	// CompactAfterDays is the age at which messages are summarised and
+	// moved out of chat_history; zero disables compaction
+	CompactAfterDays int `json:"compact_after_days"`
+}
+
+// StorageConfig picks where uploads, saved exports and archives are kept.
+// S3 credentials come from S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY.
+type StorageConfig struct {
+	// Backend is "local" or "s3"
+	Backend string `json:"backend"`
+	// Dir is the root directory for the local backend
+	Dir string   `json:"dir"`
+	S3  S3Config `json:"s3"`
+}
+
+// S3Config addresses an S3 or S3-compatible (e.g. MinIO) bucket
+type S3Config struct {
+	Endpoint string `json:"endpoint"` // e.g. https://s3.amazonaws.com or http://minio:9000
+	Bucket   string `json:"bucket"`
+	Region   string `json:"region"`
+}
+
+// EventsConfig names the external systems domain events are published to.
+// Both are optional; events always reach in-process subscribers.
+type EventsConfig struct {
+	NATS struct {
+		URL           string `json:"url"` // e.g. nats://localhost:4222
+		SubjectPrefix string `json:"subject_prefix"`
+	} `json:"nats"`
+	Kafka struct {
+		RestURL string `json:"rest_url"` // Kafka REST proxy, e.g. http://localhost:8082
+		Topic   string `json:"topic"`
+	} `json:"kafka"`
+}
+
+// RedisConfig points at a Redis server shared by all instances. The
+// password comes from REDIS_PASSWORD.
+type RedisConfig struct {
+	Addr string `json:"addr"` // host:port; empty means no Redis
+}
+
+func (c RedisConfig) password() string {
+	return os.Getenv("REDIS_PASSWORD")
+}
+
+// BrandingConfig is the organization name, look and assistant persona of a
+// deployment
+type BrandingConfig struct {
+	Name    string `json:"name"`
+	Tagline string `json:"tagline"`
+	// LogoPath replaces the red cross in page headers, e.g. /static/logo.png
+	LogoPath     string `json:"logo_path"`
+	PrimaryColor string `json:"primary_color"`
+	PrimaryHover string `json:"primary_hover"`
+	AccentColor  string `json:"accent_color"`
+	// PromptPreamble is put ahead of every system prompt, e.g. to set the
+	// assistant's name and tone
+	PromptPreamble string `json:"prompt_preamble"`
+}
+
+// MatchingConfig tunes how candidates are filtered and ranked
+type MatchingConfig struct {
+	// RequireCareTypeOverlap drops candidates that share no care type with
+	// the user; otherwise sharing one only ranks a candidate higher
+	RequireCareTypeOverlap bool `json:"require_care_type_overlap"`
+}
+
+// DigestConfig tunes the nightly match recompute and its digest emails
+type DigestConfig struct {
+	// ActiveDays is how recently a user must have chatted to be rematched
+	ActiveDays int `json:"active_days"`
+	// CandidatesPerUser caps how many of a user's top candidates are
+	// proposed each night
+	CandidatesPerUser int `json:"candidates_per_user"`
+}
+
+// EmailConfig picks the provider notification emails are sent through.
+// Credentials come from the environment: SMTP_USERNAME and SMTP_PASSWORD,
+// SENDGRID_API_KEY, or SES_ACCESS_KEY_ID and SES_SECRET_ACCESS_KEY. With
+// no provider and no SMTP address, emails are only logged.
+type EmailConfig struct {
+	// Provider is "smtp", "sendgrid" or "ses"
+	Provider string `json:"provider"`
+	SMTPAddr string `json:"smtp_addr"` // e.g. smtp.example.com:587
+	From     string `json:"from"`
+	SES      struct {
+		Region string `json:"region"`
+	} `json:"ses"`
+	// BaseURL is the app's public address, used for links in emails
+	BaseURL string `json:"base_url"`
+	// ReplyTo is the address replies to emails go to, plus-addressed per
+	// email, e.g. reply@in.example.com; empty means replies aren't taken
+	ReplyTo string `json:"reply_to"`
+}
+
+// DatabaseConfig tunes database instrumentation
+type DatabaseConfig struct {
+	// SlowQueryMS is how long a query or transaction can take before it's
+	// logged; zero turns the log off
+	SlowQueryMS int `json:"slow_query_ms"`
+}
+
+// HTTPConfig limits how fast one client address can send chat messages,
+// uploads and contact requests
+type HTTPConfig struct {
+	// RateLimitPerMinute is the sustained rate; zero turns the limit off
+	RateLimitPerMinute int `json:"rate_limit_per_minute"`
+	// RateLimitBurst is how many can be sent at once after a quiet spell
+	RateLimitBurst int `json:"rate_limit_burst"`
+}
+
+// PhoneConfig says how to read phone numbers given without a country code
+type PhoneConfig struct {
+	// DefaultRegion is an ISO 3166 country code, e.g. "US" or "GB"
+	DefaultRegion string `json:"default_region"`
+}
+
+// SessionsConfig sets how long sign-ins last
+type SessionsConfig struct {
+	// IdleMinutes signs a session out after this long without a request
+	IdleMinutes int `json:"idle_minutes"`
+	// AbsoluteHours signs a session out this long after it began, however
+	// active it has been
+	AbsoluteHours int `json:"absolute_hours"`
+	// LinkMinutes is how long an emailed sign-in link works
+	LinkMinutes int `json:"link_minutes"`
+}
+
+// BotConfig screens a new user's first message for bots. The Turnstile
+// secret key is read from TURNSTILE_SECRET_KEY.
+type BotConfig struct {
+	// ScreenSignups turns the screening on
+	ScreenSignups bool `json:"screen_signups"`
+	// SignupsPerHourPerIP is how many new users one address can start;
+	// zero turns the limit off
+	SignupsPerHourPerIP int `json:"signups_per_hour_per_ip"`
+	// TurnstileSiteKey shows a Cloudflare Turnstile challenge to new users
+	TurnstileSiteKey string `json:"turnstile_site_key"`
+}
+
+// ToolConfig sets which tools the model is offered. Admins can override it
+// per tool while the app runs.
+type ToolConfig struct {
+	// Disabled names tools that are off by default, e.g.
+	// "execute_dynamic_query"
+	Disabled []string `json:"disabled"`
+}
+
+// TestDataConfig controls how -test plays testdata.txt
+type TestDataConfig struct {
+	// Concurrency is how many users' conversations run at once
+	Concurrency int `json:"concurrency"`
+	// RequestsPerMinute caps chat turns across all users, to stay inside
+	// the OpenAI quota; zero means no cap
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+// OpsConfig posts significant events to operators' Slack or Discord
+// channels
+type OpsConfig struct {
+	// Webhooks names incoming webhooks, e.g. {"oncall": {"url":
+	// "https://hooks.slack.com/services/..."}}. The URLs are secrets, so
+	// keep the config file private.
+	Webhooks map[string]OpsWebhook `json:"webhooks"`
+	// Routes maps an event type to the webhooks it's posted to; "*" covers
+	// event types not listed. With no routes every event goes to every
+	// webhook.
+	Routes map[string][]string `json:"routes"`
+	// ThrottleMinutes is how often one event type can be posted to one
+	// webhook; more in between are counted in the next post
+	ThrottleMinutes int `json:"throttle_minutes"`
+}
+
+// OpsWebhook is a Slack or Discord incoming webhook
+type OpsWebhook struct {
+	// Kind is "slack" or "discord"; empty guesses from the URL
+	Kind string `json:"kind"`
+	URL  string `json:"url"`
+}
+
+// WhatsAppConfig sets how notifications reach WhatsApp users who haven't
+// written in the last day, when only approved templates can be sent
+type WhatsAppConfig struct {
+	// Templates maps a notification kind to the Twilio Content SID of its
+	// template, which gets the notification's subject as {{1}}
+	Templates map[string]string `json:"templates"`
+}
+
+// TranscriptionConfig sets where voice notes are turned into text
+type TranscriptionConfig struct {
+	// Provider is "openai", "whisper_cpp" or "off"
+	Provider string `json:"provider"`
+	// Model is the OpenAI transcription model
+	Model string `json:"model"`
+	// URL is a whisper.cpp server's inference endpoint, e.g.
+	// http://localhost:8081/inference. The server needs --convert to take
+	// browser recordings, which aren't WAV.
+	URL string `json:"url"`
+	// Language is an ISO-639-1 hint; empty lets the model detect it
+	Language string `json:"language"`
+}
+
+// CertificationsConfig sets when caregivers hear about expiring
+// certificates
+type CertificationsConfig struct {
+	// ExpiryWarningDays is how long before expiry a certificate is flagged
+	ExpiryWarningDays int `json:"expiry_warning_days"`
+}
+
+// BackgroundChecksConfig sets how caregivers are background checked
+type BackgroundChecksConfig struct {
+	// Required hides a caregiver's contact details from patients until
+	// they are background checked
+	Required bool `json:"required"`
+	// Package is the provider's name for the checks to run
+	Package string `json:"package"`
+	// ValidDays is how long a clear check counts; zero keeps it forever
+	ValidDays int `json:"valid_days"`
+}
+
+// SafetyConfig sets how messages are screened for people at risk
+type SafetyConfig struct {
+	// Screen turns screening on
+	Screen bool `json:"screen"`
+	// Resources rewords the reply to a risk, keyed by self_harm, abuse or
+	// medical_emergency, e.g. with local helplines
+	Resources map[string]string `json:"resources"`
+}
+
+// ModerationConfig sets how direct messages are moderated
+type ModerationConfig struct {
+	// Actions maps a category (profanity, solicitation or pii) to what's
+	// done with a message in it: allow, warn, hold or block
+	Actions map[string]string `json:"actions"`
+	// StrikeLimit is how many strikes a user can have before everything
+	// they send is held for review; zero never holds them
+	StrikeLimit int `json:"strike_limit"`
+}
+
+// AccountsConfig sets when accounts are suspended without an admin
+type AccountsConfig struct {
+	// SuspendAfterReports suspends a user once this many reports against
+	// them are confirmed; zero never does
+	SuspendAfterReports int `json:"suspend_after_reports"`
+	// SuspendAfterStrikes suspends a user once they have this many
+	// moderation strikes; zero never does
+	SuspendAfterStrikes int `json:"suspend_after_strikes"`
+}
+
+// GoogleCalendarConfig sets how caregivers' Google Calendars are synced
+type GoogleCalendarConfig struct {
+	// LookaheadDays is how far ahead busy times are read from a calendar
+	LookaheadDays int `json:"lookahead_days"`
+}
+
+// RemindersConfig sets when people are reminded of their bookings
+type RemindersConfig struct {
+	// LeadMinutes is how long before a booking users are reminded of it,
+	// until they choose their own
+	LeadMinutes []int `json:"lead_minutes"`
+	// SnoozeMinutes is how long a snoozed reminder waits to be sent again
+	SnoozeMinutes int `json:"snooze_minutes"`
+}
+
+// ShiftsConfig sets the rules for logging shifts on an active match
+type ShiftsConfig struct {
+	// AutoConfirmDays confirms a shift the patient hasn't confirmed or
+	// disputed this many days after it ended; zero never does
+	AutoConfirmDays int `json:"auto_confirm_days"`
+	// MaxShiftHours is the longest shift that can be logged; shifts
+	// clocked out later are capped at it
+	MaxShiftHours int `json:"max_shift_hours"`
+}
+
+// SpeechConfig sets how assistant replies are read aloud
+type SpeechConfig struct {
+	// Provider is "openai", "local" or "off"
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Voice    string `json:"voice"`
+	// URL is a local server's OpenAI-compatible speech endpoint, e.g.
+	// http://localhost:8880/v1/audio/speech
+	URL string `json:"url"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Models: ModelConfig{
+			Default:    defaultChatModel,
+			SmallTalk:  defaultChatModel,
+			ToolCall:   defaultChatModel,
+			Extraction: defaultChatModel,
+			Vision:     "gpt-4o-mini",
+			ToolKeywords: []string{
+				"match", "caregiver", "patient", "list", "find", "search",
+				"how many", "average", "cheapest", "available", "near",
+			},
+			SmallTalkMaxLength: 40,
+		},
+		Retention: RetentionConfig{
+			Days: map[string]int{
+				"chat_history":        180,
+				"message_embeddings":  180,
+				"chat_turns":          365,
+				"experiment_turns":    365,
+				"llm_usage":           730,
+				"email_sends":         365,
+				"email_reply_threads": 365,
+				"audit_log":           730,
+				"profile_changes":     365,
+			},
+		},
+		Archive: ArchiveConfig{
+			CompactAfterDays: 30,
+		},
+		Storage: StorageConfig{
+			Backend: "local",
+			Dir:     "storage",
+		},
+		Branding: BrandingConfig{
+			Name:         "Helper",
+			Tagline:      "Connecting Caregivers to Patients",
+			PrimaryColor: "#4CAF50",
+			PrimaryHover: "#45a049",
+			AccentColor:  "#FF4444",
+		},
+		Digest: DigestConfig{
+			ActiveDays:        30,
+			CandidatesPerUser: 5,
+		},
+		Email: EmailConfig{
+			From:    "noreply@localhost",
+			BaseURL: "http://localhost:8080",
+		},
+		Database: DatabaseConfig{
+			SlowQueryMS: 250,
+		},
+		HTTP: HTTPConfig{
+			RateLimitPerMinute: 30,
+			RateLimitBurst:     10,
+		},
+		Phone: PhoneConfig{
+			DefaultRegion: "US",
+		},
+		Bots: BotConfig{
+			ScreenSignups:       true,
+			SignupsPerHourPerIP: 5,
+		},
+		Sessions: SessionsConfig{
+			IdleMinutes:   120,
+			AbsoluteHours: 24,
+			LinkMinutes:   15,
+		},
+		TestData: TestDataConfig{
+			Concurrency:       4,
+			RequestsPerMinute: 60,
+		},
+		Ops: OpsConfig{
+			ThrottleMinutes: 10,
+		},
+		Transcription: TranscriptionConfig{
+			Provider: "openai",
+			Model:    "whisper-1",
+		},
+		Certifications: CertificationsConfig{
+			ExpiryWarningDays: 30,
+		},
+		BackgroundChecks: BackgroundChecksConfig{
+			Package:   "tasker_standard",
+			ValidDays: 365,
+		},
+		Safety: SafetyConfig{
+			Screen: true,
+		},
+		Moderation: ModerationConfig{
+			Actions: map[string]string{
+				"profanity":    "warn",
+				"solicitation": "hold",
+				"pii":          "block",
+			},
+			StrikeLimit: 3,
+		},
+		Accounts: AccountsConfig{
+			SuspendAfterReports: 3,
+		},
+		Shifts: ShiftsConfig{
+			AutoConfirmDays: 7,
+			MaxShiftHours:   16,
+		},
+		GoogleCalendar: GoogleCalendarConfig{
+			LookaheadDays: 14,
+		},
+		Reminders: RemindersConfig{
+			LeadMinutes:   []int{24 * 60, 60},
+			SnoozeMinutes: 30,
+		},
+		Speech: SpeechConfig{
+			Provider: "off",
+			Model:    "tts-1",
+			Voice:    "alloy",
+		},
+	}
+}
+
+// config is the active configuration; main loads it before serving
+var config = defaultConfig()
+
+// loadConfig reads path over the defaults. An empty path keeps the defaults.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %v", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config: %v", err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+	"github.com/rfielding/helper2/internal/server"
+)
+
+// Admins publish versioned terms of service and privacy policies. Once one
+// is published, users must accept its latest version, on the chat page or
+// by replying "I agree", before they're matched or shown to anyone as a
+// match. Each acceptance is recorded with its version, time and address.
+// Until a document is published there's nothing to accept.
+
+const consentSchema = `
+	CREATE TABLE IF NOT EXISTS legal_documents (
+		kind TEXT,
+		version INTEGER,
+		body TEXT,
+		created_by TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (kind, version)
+	);
+	CREATE TABLE IF NOT EXISTS consents (
+		email TEXT,
+		kind TEXT,
+		version INTEGER,
+		ip TEXT,
+		accepted_at TIMESTAMP,
+		PRIMARY KEY (email, kind, version)
+	)
+`
+
+// Legal document kinds
+const (
+	DocumentTerms   = "terms"
+	DocumentPrivacy = "privacy"
+)
+
+var documentKinds = []string{DocumentTerms, DocumentPrivacy}
+
+var documentTitles = map[string]string{
+	DocumentTerms:   "Terms of Service",
+	DocumentPrivacy: "Privacy Policy",
+}
+
+// consentReplies are the chat replies that accept the pending documents
+var consentReplies = map[string]bool{"i agree": true, "agree": true, "i accept": true, "accept": true}
+
+// errConsentRequired is returned by the matcher for a user who hasn't
+// accepted the latest documents
+var errConsentRequired = errors.New("the latest terms of service and privacy policy must be accepted before matching")
+
+// LegalDocument is one published version of the terms or privacy policy
+type LegalDocument struct {
+	Kind      string    `json:"kind"`
+	Version   int       `json:"version"`
+	Body      string    `json:"body,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Title is the document's name as shown to users
+func (d LegalDocument) Title() string {
+	return documentTitles[d.Kind]
+}
+
+// Consent is a user's acceptance of one document version
+type Consent struct {
+	Kind       string    `json:"kind"`
+	Version    int       `json:"version"`
+	IP         string    `json:"ip"`
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+// CurrentDocuments returns the latest version of each published document
+func (app *App) CurrentDocuments() ([]LegalDocument, error) {
+	var docs []LegalDocument
+	for _, kind := range documentKinds {
+		d, err := app.GetDocument(kind, 0)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			docs = append(docs, *d)
+		}
+	}
+	return docs, nil
+}
+
+// GetDocument returns one version of a document, the latest for version 0,
+// or nil if there's no such version
+func (app *App) GetDocument(kind string, version int) (*LegalDocument, error) {
+	query := "SELECT kind, version, body, created_by, created_at FROM legal_documents WHERE kind = ?"
+	args := []interface{}{kind}
+	if version > 0 {
+		query += " AND version = ?"
+		args = append(args, version)
+	}
+	result, err := app.db.Query(query+" ORDER BY version DESC LIMIT 1", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query legal document: %v", err)
+	}
+	defer result.Close()
+
+	var found *LegalDocument
+	err = result.Iterate(func(r *chai.Row) error {
+		var d LegalDocument
+		if err := r.Scan(&d.Kind, &d.Version, &d.Body, &d.CreatedBy, &d.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan legal document: %v", err)
+		}
+		found = &d
+		return nil
+	})
+	return found, err
+}
+
+// PublishDocument saves a new version of a document. Everyone has to
+// accept it before they're matched again.
+func (app *App) PublishDocument(kind, body, author string) (*LegalDocument, error) {
+	if _, ok := documentTitles[kind]; !ok {
+		return nil, fmt.Errorf("kind must be %q or %q", DocumentTerms, DocumentPrivacy)
+	}
+	if strings.TrimSpace(body) == "" {
+		return nil, fmt.Errorf("body is required")
+	}
+	current, err := app.GetDocument(kind, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := &LegalDocument{Kind: kind, Version: 1, Body: body, CreatedBy: author, CreatedAt: time.Now()}
+	if current != nil {
+		d.Version = current.Version + 1
+	}
+	err = app.db.Exec(`
+		INSERT INTO legal_documents (kind, version, body, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, d.Kind, d.Version, d.Body, d.CreatedBy, d.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish legal document: %v", err)
+	}
+	app.invalidateToolCaches()
+	return d, nil
+}
+
+// PendingConsents returns the current documents a user hasn't accepted
+func (app *App) PendingConsents(email string) ([]LegalDocument, error) {
+	docs, err := app.CurrentDocuments()
+	if err != nil {
+		return nil, err
+	}
+	var pending []LegalDocument
+	for _, d := range docs {
+		accepted, err := rowExists(app.db, "SELECT email FROM consents WHERE email = ? AND kind = ? AND version = ?",
+			email, d.Kind, d.Version)
+		if err != nil {
+			return nil, err
+		}
+		if !accepted {
+			pending = append(pending, d)
+		}
+	}
+	return pending, nil
+}
+
+// RecordConsent records a user accepting every current document they
+// hadn't, from address ip, and returns those documents
+func (app *App) RecordConsent(email, ip string) ([]LegalDocument, error) {
+	pending, err := app.PendingConsents(email)
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+	now := time.Now()
+	err = app.withTx(func(tx *chai.Tx) error {
+		for _, d := range pending {
+			err := tx.Exec(`
+				INSERT INTO consents (email, kind, version, ip, accepted_at)
+				VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT DO NOTHING
+			`, email, d.Kind, d.Version, ip, now)
+			if err != nil {
+				return fmt.Errorf("failed to record consent: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Recorded consent from %s to %d documents", email, len(pending))
+	app.invalidateToolCaches()
+	return pending, nil
+}
+
+// Consents lists everything a user has accepted, newest first
+func (app *App) Consents(email string) ([]Consent, error) {
+	result, err := app.db.Query(`
+		SELECT email, kind, version, ip, accepted_at FROM consents
+		WHERE email = ?
+		ORDER BY accepted_at DESC
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query consents: %v", err)
+	}
+	defer result.Close()
+
+	var consents []Consent
+	err = result.Iterate(func(r *chai.Row) error {
+		// chai can only sort rows whose whole primary key is selected, and
+		// may return the columns in table order, so they're scanned by name
+		var c Consent
+		for column, dest := range map[string]interface{}{
+			"kind":        &c.Kind,
+			"version":     &c.Version,
+			"ip":          &c.IP,
+			"accepted_at": &c.AcceptedAt,
+		} {
+			if err := r.ScanColumn(column, dest); err != nil {
+				return fmt.Errorf("failed to scan consent: %v", err)
+			}
+		}
+		consents = append(consents, c)
+		return nil
+	})
+	return consents, err
+}
+
+// requireConsent returns errConsentRequired unless the user has accepted
+// every current document
+func (app *App) requireConsent(email string) error {
+	pending, err := app.PendingConsents(email)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return errConsentRequired
+	}
+	return nil
+}
+
+// consentedUsers returns who has accepted every current document, or nil
+// when nothing has been published
+func (app *App) consentedUsers() (map[string]bool, error) {
+	docs, err := app.CurrentDocuments()
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	var consented map[string]bool
+	for _, d := range docs {
+		result, err := app.db.Query("SELECT email FROM consents WHERE kind = ? AND version = ?", d.Kind, d.Version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query consents: %v", err)
+		}
+		accepted := map[string]bool{}
+		err = result.Iterate(func(r *chai.Row) error {
+			var email string
+			if err := r.Scan(&email); err != nil {
+				return fmt.Errorf("failed to scan consent: %v", err)
+			}
+			if consented == nil || consented[email] {
+				accepted[email] = true
+			}
+			return nil
+		})
+		result.Close()
+		if err != nil {
+			return nil, err
+		}
+		consented = accepted
+	}
+	return consented, nil
+}
+
+// withoutUnconsentedCaregivers drops caregivers who haven't accepted the
+// current documents
+func (app *App) withoutUnconsentedCaregivers(caregivers []Caregiver) ([]Caregiver, error) {
+	consented, err := app.consentedUsers()
+	if err != nil || consented == nil {
+		return caregivers, err
+	}
+	kept := caregivers[:0]
+	for _, c := range caregivers {
+		if consented[c.Email] {
+			kept = append(kept, c)
+		}
+	}
+	return kept, nil
+}
+
+// withoutUnconsentedPatients drops patients who haven't accepted the
+// current documents
+func (app *App) withoutUnconsentedPatients(patients []Patient) ([]Patient, error) {
+	consented, err := app.consentedUsers()
+	if err != nil || consented == nil {
+		return patients, err
+	}
+	kept := patients[:0]
+	for _, p := range patients {
+		if consented[p.Email] {
+			kept = append(kept, p)
+		}
+	}
+	return kept, nil
+}
+
+// formatConsentRequest asks the user to accept the pending documents
+func formatConsentRequest(email string, pending []LegalDocument) string {
+	var sb strings.Builder
+	sb.WriteString("<div class='proposal-card'>Before I can find matches, please read and accept:<ul>")
+	for _, d := range pending {
+		sb.WriteString(fmt.Sprintf("<li><a href='legal?kind=%s&version=%d' target='_blank'>%s</a> (version %d)</li>",
+			d.Kind, d.Version, d.Title(), d.Version))
+	}
+	sb.WriteString("</ul>")
+	sb.WriteString("<form method='POST' action='consent'>")
+	sb.WriteString(fmt.Sprintf("<input type='hidden' name='email' value='%s'>", template.HTMLEscapeString(email)))
+	sb.WriteString("<label><input type='checkbox' name='agree' value='yes' required> I have read and agree to these</label> ")
+	sb.WriteString("<button type='submit'>Continue</button>")
+	sb.WriteString("</form>")
+	sb.WriteString("<small>Or reply \"I agree\".</small></div>")
+	return sb.String()
+}
+
+// consentRequestFor is the reply to a user asking for matches before
+// accepting the current documents
+func (app *App) consentRequestFor(email string) string {
+	pending, err := app.PendingConsents(email)
+	if err != nil {
+		return fmt.Sprintf("Error finding matches: %v", err)
+	}
+	return formatConsentRequest(email, pending)
+}
+
+// answerConsentReply handles a chat reply of "I agree" while documents are
+// waiting to be accepted, reporting whether message was one. ip is where
+// the reply came from.
+func (app *App) answerConsentReply(email, message, ip string) (bool, error) {
+	answer := strings.ToLower(strings.Trim(strings.TrimSpace(message), ".!"))
+	if !consentReplies[answer] {
+		return false, nil
+	}
+	if pending, err := app.PendingConsents(email); err != nil || len(pending) == 0 {
+		return false, err
+	}
+	if err := app.AddMessageWithRecipient(email, "user", message, "admin"); err != nil {
+		return true, fmt.Errorf("failed to add message: %v", err)
+	}
+	accepted, err := app.RecordConsent(email, ip)
+	if err != nil {
+		return true, err
+	}
+	return true, app.AddMessageWithRecipient(email, "assistant", formatConsentRecorded(accepted), "admin")
+}
+
+func formatConsentRecorded(accepted []LegalDocument) string {
+	titles := make([]string, len(accepted))
+	for i, d := range accepted {
+		titles[i] = fmt.Sprintf("%s (version %d)", d.Title(), d.Version)
+	}
+	return fmt.Sprintf("Thanks, you've accepted the %s. You can be matched now.", strings.Join(titles, " and "))
+}
+
+const legalTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - {{.Title}}</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>{{.Title}}</h1>
+            <div class="app-description">Version {{.Version}} · published {{.CreatedAt.Format "January 2, 2006"}}</div>
+        </div>
+        {{range .Paragraphs}}<p>{{.}}</p>{{end}}
+    </div>
+</body>
+</html>
+`
+
+// handleLegal shows a published document: ?kind=terms or privacy, and
+// optionally &version=N, the latest otherwise
+func handleLegal(w http.ResponseWriter, r *http.Request) {
+	version, _ := strconv.Atoi(r.FormValue("version"))
+	doc, err := chatRoom.GetDocument(r.FormValue("kind"), version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		http.Error(w, "No such document", http.StatusNotFound)
+		return
+	}
+	renderTemplate(w, "legal", legalTemplate, struct {
+		LegalDocument
+		Paragraphs []string
+	}{*doc, strings.Split(strings.ReplaceAll(doc.Body, "\r\n", "\n"), "\n\n")})
+}
+
+// handleConsent records the user accepting the current documents from the
+// consent form. An admin viewing as the user can't accept for them.
+func handleConsent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	if impersonationFrom(r) != nil {
+		http.Error(w, "Only the user can accept the terms", http.StatusForbidden)
+		return
+	}
+	if r.FormValue("agree") != "yes" {
+		http.Error(w, "Tick the box to accept", http.StatusBadRequest)
+		return
+	}
+	accepted, err := chatRoom.RecordConsent(email, server.ClientAddr(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(accepted) > 0 {
+		if err := chatRoom.AddMessageWithRecipient(email, "assistant", formatConsentRecorded(accepted), "admin"); err != nil {
+			log.Printf("Error adding consent reply for %s: %v", email, err)
+		}
+	}
+	http.Redirect(w, r, "./?email="+url.QueryEscape(email), http.StatusSeeOther)
+}
+
+// handleConsentsAPI lists a user's consents and the documents still
+// waiting for them on GET, and records acceptance of those on POST
+func handleConsentsAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		consents, err := chatRoom.Consents(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pending, err := chatRoom.PendingConsents(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range pending {
+			pending[i].Body = ""
+		}
+		writeJSON(w, map[string]interface{}{"consents": consents, "pending": pending})
+
+	case "POST":
+		if impersonationFrom(r) != nil {
+			http.Error(w, "Only the user can accept the terms", http.StatusForbidden)
+			return
+		}
+		accepted, err := chatRoom.RecordConsent(email, server.ClientAddr(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range accepted {
+			accepted[i].Body = ""
+		}
+		writeJSON(w, accepted)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleLegalAPI lists the current documents on GET and publishes a new
+// version of one on POST {kind, body}
+func handleLegalAPI(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		docs, err := chatRoom.CurrentDocuments()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, docs)
+
+	case "POST":
+		var req struct {
+			Kind string `json:"kind"`
+			Body string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		doc, err := chatRoom.PublishDocument(req.Kind, req.Body, admin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chatRoom.Audit(r, admin, "legal.publish", doc.Kind, fmt.Sprintf("version %d", doc.Version))
+		writeJSON(w, doc)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestConsents(t *testing.T) {
+	app := newTestApp(t)
+	const email = "user@example.com"
+	for _, body := range []string{"First terms", "Second terms"} {
+		if _, err := app.PublishDocument(DocumentTerms, body, "admin@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := app.RecordConsent(email, "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(accepted) != 1 {
+			t.Fatalf("accepted %d documents, want 1", len(accepted))
+		}
+	}
+	if _, err := app.RecordConsent("other@example.com", "192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	consents, err := app.Consents(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consents) != 2 {
+		t.Fatalf("got %d consents, want 2: %+v", len(consents), consents)
+	}
+	for i, version := range []int{2, 1} {
+		c := consents[i]
+		if c.Kind != DocumentTerms || c.Version != version || c.IP != "192.0.2.1" || c.AcceptedAt.IsZero() {
+			t.Errorf("consent %d: got %+v, want terms version %d", i, c, version)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Contact request statuses
+const (
+	ContactPending  = "pending"
+	ContactAccepted = "accepted"
+	ContactDenied   = "denied"
+)
+
+const contactRequestsSchema = `
+	CREATE TABLE IF NOT EXISTS contact_requests (
+		requester TEXT,
+		recipient TEXT,
+		status TEXT,
+		created_at TIMESTAMP,
+		responded_at TIMESTAMP,
+		PRIMARY KEY (requester, recipient)
+	);
+	CREATE INDEX IF NOT EXISTS idx_contact_requests_recipient ON contact_requests(recipient)
+`
+
+// ContactRequest asks another user to share contact details. The requester
+// asking counts as their consent; the recipient accepting completes it.
+type ContactRequest struct {
+	Requester   string    `json:"requester"`
+	Recipient   string    `json:"recipient"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	RespondedAt time.Time `json:"responded_at,omitempty"`
+}
+
+// RequestContact records that requester wants to exchange details with
+// recipient. Asking again after a denial reopens the request.
+func (app *App) RequestContact(requester, recipient string) error {
+	if requester == "" || recipient == "" || requester == recipient {
+		return fmt.Errorf("invalid contact request")
+	}
+	if app.Suspended(requester) {
+		return errSuspended
+	}
+	if app.Blocked(requester, recipient) {
+		return errBlocked
+	}
+	if app.ContactShared(requester, recipient) {
+		return nil
+	}
+	err := app.db.Exec(`
+		INSERT INTO contact_requests (requester, recipient, status, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, requester, recipient, ContactPending, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store contact request: %v", err)
+	}
+	return nil
+}
+
+// RespondToContact lets recipient accept or deny a pending request
+func (app *App) RespondToContact(recipient, requester string, accept bool) error {
+	status := ContactDenied
+	if accept {
+		status = ContactAccepted
+	}
+	err := app.db.Exec(`
+		UPDATE contact_requests SET status = ?, responded_at = ?
+		WHERE requester = ? AND recipient = ? AND status = ?
+	`, status, time.Now(), requester, recipient, ContactPending)
+	if err != nil {
+		return fmt.Errorf("failed to update contact request: %v", err)
+	}
+	// Cards rendered before now were masked for this pair
+	app.invalidateToolCaches()
+	return nil
+}
+
+// PendingContactRequests returns requests waiting on email's answer
+func (app *App) PendingContactRequests(email string) ([]ContactRequest, error) {
+	result, err := app.db.Query(`
+		SELECT requester, recipient, status, created_at
+		FROM contact_requests
+		WHERE recipient = ? AND status = ?
+		ORDER BY created_at
+	`, email, ContactPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query contact requests: %v", err)
+	}
+	defer result.Close()
+
+	var requests []ContactRequest
+	err = result.Iterate(func(r *chai.Row) error {
+		var c ContactRequest
+		if err := r.Scan(&c.Requester, &c.Recipient, &c.Status, &c.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan contact request: %v", err)
+		}
+		requests = append(requests, c)
+		return nil
+	})
+	return requests, err
+}
+
+// contactStatus returns the status of a request from requester to
+// recipient, or "" if there is none
+func (app *App) contactStatus(requester, recipient string) string {
+	result, err := app.db.Query(`
+		SELECT status FROM contact_requests WHERE requester = ? AND recipient = ?
+	`, requester, recipient)
+	if err != nil {
+		log.Printf("Error querying contact request: %v", err)
+		return ""
+	}
+	defer result.Close()
+
+	var status string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&status)
+	})
+	if err != nil {
+		log.Printf("Error scanning contact request: %v", err)
+		return ""
+	}
+	return status
+}
+
+// ContactShared reports whether a and b have both agreed to share contact
+// details, either through an accepted contact request in either direction
+// or a match both sides have accepted, and any required background check
+// has cleared. Everyone may see their own details.
+func (app *App) ContactShared(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if !app.contactCleared(a, b) {
+		return false
+	}
+	if app.contactStatus(a, b) == ContactAccepted || app.contactStatus(b, a) == ContactAccepted {
+		return true
+	}
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		match, err := app.GetMatch(pair[0], pair[1])
+		if err != nil {
+			log.Printf("Error checking match for contact sharing: %v", err)
+			continue
+		}
+		if match != nil && (match.Status == MatchAccepted || match.Status == MatchActive) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskPatientContact hides a patient's phone number from viewers without consent
+func (app *App) maskPatientContact(viewer string, p *Patient) {
+	if !app.ContactShared(viewer, p.Email) {
+		p.PhoneNumber = ""
+	}
+}
+
+// maskQueryContacts removes phone numbers from dynamic query rows unless
+// viewer has consent for that row. Rows without an email can't be checked,
+// so they always lose the phone number.
+func (app *App) maskQueryContacts(viewer string, rows []map[string]interface{}) {
+	for _, row := range rows {
+		if _, ok := row["phone_number"]; !ok {
+			continue
+		}
+		email, _ := row["email"].(string)
+		if email == "" || !app.ContactShared(viewer, email) {
+			delete(row, "phone_number")
+		}
+	}
+}
+
+// formatContactRequest renders the masked-contact notice on a match card,
+// with a request button unless a request is already waiting
+func formatContactRequest(viewer, target string) string {
+	if !chatRoom.contactCleared(viewer, target) {
+		return "<span>🔒 Contact details are shared once the caregiver is background checked</span><br>"
+	}
+	switch chatRoom.contactStatus(viewer, target) {
+	case ContactPending:
+		return "<span>🔒 Contact request sent</span><br>"
+	default:
+		return fmt.Sprintf(`<span>🔒 Contact details are shared once you both agree</span>
+			<form class="schedule-form" action="contact/request" method="POST">
+				<input type="hidden" name="email" value="%s">
+				<input type="hidden" name="target" value="%s">
+				<button type="submit">Request contact</button>
+			</form>`, template.HTMLEscapeString(viewer), template.HTMLEscapeString(target))
+	}
+}
+
+// handleContactRequest records a request to exchange contact details
+func handleContactRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	if err := chatRoom.RequestContact(email, r.FormValue("target")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("../?email=%s", url.QueryEscape(email)), http.StatusSeeOther)
+}
+
+// handleContactRespond accepts or denies a contact request
+func handleContactRespond(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	accept := r.FormValue("decision") == "accept"
+	if err := chatRoom.RespondToContact(email, r.FormValue("requester"), accept); err != nil {
+		log.Printf("Error responding to contact request: %v", err)
+		http.Error(w, "Failed to respond to contact request", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("../?email=%s", url.QueryEscape(email)), http.StatusSeeOther)
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Custom field types
+const (
+	FieldText    = "text"
+	FieldNumber  = "number"
+	FieldBoolean = "boolean"
+	FieldChoice  = "choice"
+)
+
+const customFieldsSchema = `
+	CREATE TABLE IF NOT EXISTS custom_fields (
+		name TEXT PRIMARY KEY,
+		label TEXT,
+		type TEXT,
+		applies_to TEXT,
+		choices TEXT,
+		created_at TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS custom_field_values (
+		email TEXT,
+		field TEXT,
+		field_value TEXT,
+		PRIMARY KEY (email, field)
+	);
+	CREATE INDEX IF NOT EXISTS idx_custom_field_values_field ON custom_field_values(field)
+`
+
+var customFieldName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+// CustomField is a deployment-defined profile attribute such as
+// "languages" or "pets_ok"
+type CustomField struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  string `json:"type"`
+	// AppliesTo is "caregiver", "patient" or "both"
+	AppliesTo string    `json:"applies_to"`
+	Choices   []string  `json:"choices,omitempty"` // For choice fields
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// appliesTo reports whether the field is asked of users with role
+func (f CustomField) appliesTo(role string) bool {
+	return f.AppliesTo == "both" || f.AppliesTo == role
+}
+
+// normalize checks value against the field's type and returns it in the
+// form it is stored in
+func (f CustomField) normalize(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	switch f.Type {
+	case FieldNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s must be a number", f.Label)
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	case FieldBoolean:
+		b, err := strconv.ParseBool(strings.ToLower(value))
+		if err != nil {
+			switch strings.ToLower(value) {
+			case "yes", "y":
+				b = true
+			case "no", "n":
+				b = false
+			default:
+				return "", fmt.Errorf("%s must be yes or no", f.Label)
+			}
+		}
+		return strconv.FormatBool(b), nil
+	case FieldChoice:
+		for _, c := range f.Choices {
+			if strings.EqualFold(c, value) {
+				return c, nil
+			}
+		}
+		return "", fmt.Errorf("%s must be one of %s", f.Label, strings.Join(f.Choices, ", "))
+	default:
+		return value, nil
+	}
+}
+
+// builtinProfileFields can't be shadowed by a custom field, since
+// DynamicQuery would no longer know which one a filter means
+var builtinProfileFields = map[string]bool{
+	"email": true, "name": true, "experience": true, "location": true,
+	"availability": true, "specializations": true, "rate_expectations": true,
+	"certifications": true, "created_at": true, "care_needs": true,
+	"schedule_requirements": true, "budget": true, "special_requirements": true,
+	"status": true, "skill": true, "phone_number": true,
+}
+
+// DefineCustomField adds a field or replaces an existing field's definition.
+// Stored values are kept when a field is redefined.
+func (app *App) DefineCustomField(f CustomField) error {
+	if !customFieldName.MatchString(f.Name) || builtinProfileFields[f.Name] {
+		return fmt.Errorf("invalid field name: %q", f.Name)
+	}
+	switch f.Type {
+	case FieldText, FieldNumber, FieldBoolean:
+	case FieldChoice:
+		if len(f.Choices) == 0 {
+			return fmt.Errorf("choice field %s needs choices", f.Name)
+		}
+	default:
+		return fmt.Errorf("invalid field type: %q", f.Type)
+	}
+	switch f.AppliesTo {
+	case "caregiver", "patient", "both":
+	case "":
+		f.AppliesTo = "both"
+	default:
+		return fmt.Errorf("invalid applies_to: %q", f.AppliesTo)
+	}
+	if f.Label == "" {
+		f.Label = strings.ReplaceAll(f.Name, "_", " ")
+	}
+
+	err := app.db.Exec(`
+		INSERT INTO custom_fields (name, label, type, applies_to, choices, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, f.Name, f.Label, f.Type, f.AppliesTo, strings.Join(f.Choices, ","), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to define custom field: %v", err)
+	}
+	app.invalidateToolCaches()
+	return nil
+}
+
+// DeleteCustomField removes a field and every value stored for it
+func (app *App) DeleteCustomField(name string) error {
+	return app.withTx(func(tx *chai.Tx) error {
+		if err := tx.Exec("DELETE FROM custom_field_values WHERE field = ?", name); err != nil {
+			return fmt.Errorf("failed to delete custom field values: %v", err)
+		}
+		if err := tx.Exec("DELETE FROM custom_fields WHERE name = ?", name); err != nil {
+			return fmt.Errorf("failed to delete custom field: %v", err)
+		}
+		return nil
+	})
+}
+
+// CustomFields returns every defined field, by name
+func (app *App) CustomFields() ([]CustomField, error) {
+	result, err := app.db.Query(`
+		SELECT name, label, type, applies_to, choices, created_at
+		FROM custom_fields
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query custom fields: %v", err)
+	}
+	defer result.Close()
+
+	var fields []CustomField
+	err = result.Iterate(func(r *chai.Row) error {
+		var f CustomField
+		var choices string
+		if err := r.Scan(&f.Name, &f.Label, &f.Type, &f.AppliesTo, &choices, &f.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan custom field: %v", err)
+		}
+		if choices != "" {
+			f.Choices = strings.Split(choices, ",")
+		}
+		fields = append(fields, f)
+		return nil
+	})
+	return fields, err
+}
+
+// customFieldsFor returns the fields that apply to role, logging failures
+// since callers only use them to decorate output
+func (app *App) customFieldsFor(role string) []CustomField {
+	fields, err := app.CustomFields()
+	if err != nil {
+		log.Printf("Error loading custom fields: %v", err)
+		return nil
+	}
+	var applicable []CustomField
+	for _, f := range fields {
+		if f.appliesTo(role) {
+			applicable = append(applicable, f)
+		}
+	}
+	return applicable
+}
+
+// SetCustomFieldValues stores values by field name for a user with role.
+// Unknown fields are an error; an empty value clears the field.
+func (app *App) SetCustomFieldValues(email, role string, values map[string]string) error {
+	byName := app.customFieldsByName(role)
+	normalized := make(map[string]string, len(values))
+	for name, value := range values {
+		f, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown field: %s", name)
+		}
+		v, err := f.normalize(value)
+		if err != nil {
+			return err
+		}
+		normalized[name] = v
+	}
+
+	err := app.withTx(func(tx *chai.Tx) error {
+		for name, value := range normalized {
+			var err error
+			if value == "" {
+				err = tx.Exec("DELETE FROM custom_field_values WHERE email = ? AND field = ?", email, name)
+			} else {
+				err = tx.Exec(`
+					INSERT INTO custom_field_values (email, field, field_value)
+					VALUES (?, ?, ?)
+					ON CONFLICT DO REPLACE
+				`, email, name, value)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to store custom field %s: %v", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	app.invalidateToolCaches()
+	return nil
+}
+
+// CustomFieldValues returns a user's stored values by field name
+func (app *App) CustomFieldValues(email string) (map[string]string, error) {
+	result, err := app.db.Query("SELECT field, field_value FROM custom_field_values WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query custom field values: %v", err)
+	}
+	defer result.Close()
+
+	values := make(map[string]string)
+	err = result.Iterate(func(r *chai.Row) error {
+		var field, value string
+		if err := r.Scan(&field, &value); err != nil {
+			return fmt.Errorf("failed to scan custom field value: %v", err)
+		}
+		values[field] = value
+		return nil
+	})
+	return values, err
+}
+
+// customFieldValuesByEmail returns every stored value of one field
+func (app *App) customFieldValuesByEmail(field string) (map[string]string, error) {
+	result, err := app.db.Query("SELECT email, field_value FROM custom_field_values WHERE field = ?", field)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query custom field values: %v", err)
+	}
+	defer result.Close()
+
+	values := make(map[string]string)
+	err = result.Iterate(func(r *chai.Row) error {
+		var email, value string
+		if err := r.Scan(&email, &value); err != nil {
+			return fmt.Errorf("failed to scan custom field value: %v", err)
+		}
+		values[email] = value
+		return nil
+	})
+	return values, err
+}
+
+// storeCustomFieldArgs saves the custom fields present in a store_caregiver
+// or store_patient tool call
+func (app *App) storeCustomFieldArgs(email, role string, args map[string]interface{}) error {
+	values := make(map[string]string)
+	for _, f := range app.customFieldsFor(role) {
+		if v, ok := args[f.Name]; ok && v != nil {
+			values[f.Name] = fmt.Sprint(v)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return app.SetCustomFieldValues(email, role, values)
+}
+
+// customFieldSchema describes a field as a tool parameter
+func customFieldSchema(f CustomField) map[string]interface{} {
+	schema := map[string]interface{}{"description": f.Label}
+	switch f.Type {
+	case FieldNumber:
+		schema["type"] = "number"
+	case FieldBoolean:
+		schema["type"] = "boolean"
+	case FieldChoice:
+		schema["type"] = "string"
+		schema["enum"] = f.Choices
+	default:
+		schema["type"] = "string"
+	}
+	return schema
+}
+
+// addCustomFieldParameters extends the store_caregiver and store_patient
+// tool definitions with the deployment's custom fields, and tells the query
+// tool they can be filtered on. functionDefs must be freshly built, since
+// the store definitions are modified in place.
+func (app *App) addCustomFieldParameters(functionDefs []map[string]interface{}) {
+	fields, err := app.CustomFields()
+	if err != nil {
+		log.Printf("Error loading custom fields: %v", err)
+		return
+	}
+	if len(fields) == 0 {
+		return
+	}
+	roles := map[string]string{"store_caregiver": "caregiver", "store_patient": "patient"}
+	var names []string
+	for _, f := range fields {
+		names = append(names, f.Name)
+	}
+	for i, def := range functionDefs {
+		name := def["name"].(string)
+		if name == dynamicQueryFunction["name"] {
+			// Shared definition, so describe the fields on a copy
+			extended := make(map[string]interface{}, len(def))
+			for k, v := range def {
+				extended[k] = v
+			}
+			extended["description"] = fmt.Sprintf("%s. Caregivers and patients can also be filtered on custom fields: %s",
+				def["description"], strings.Join(names, ", "))
+			functionDefs[i] = extended
+			continue
+		}
+		role, ok := roles[name]
+		if !ok {
+			continue
+		}
+		properties := def["parameters"].(map[string]interface{})["properties"].(map[string]interface{})
+		for _, f := range fields {
+			if f.appliesTo(role) {
+				properties[f.Name] = customFieldSchema(f)
+			}
+		}
+	}
+}
+
+// customFieldsByName returns the fields that apply to role, by name
+func (app *App) customFieldsByName(role string) map[string]CustomField {
+	byName := make(map[string]CustomField)
+	for _, f := range app.customFieldsFor(role) {
+		byName[f.Name] = f
+	}
+	return byName
+}
+
+// tableRoles maps the DynamicQuery tables whose rows are user profiles to
+// the role their custom fields apply to
+var tableRoles = map[string]string{
+	"caregivers": "caregiver",
+	"patients":   "patient",
+}
+
+// rewriteCustomFilters replaces comparisons on custom fields with email
+// filters. Values live in their own table and chai can't join, so the
+// comparison runs here and the query only sees the matching emails.
+func (app *App) rewriteCustomFilters(filters []QueryFilter, fields map[string]CustomField) ([]QueryFilter, error) {
+	var rewritten []QueryFilter
+	for _, f := range filters {
+		if len(f.Any) > 0 || len(f.All) > 0 {
+			anyOf, err := app.rewriteCustomFilters(f.Any, fields)
+			if err != nil {
+				return nil, err
+			}
+			allOf, err := app.rewriteCustomFilters(f.All, fields)
+			if err != nil {
+				return nil, err
+			}
+			rewritten = append(rewritten, QueryFilter{Any: anyOf, All: allOf})
+			continue
+		}
+		field, ok := fields[f.Field]
+		if !ok || !allowedQueryOperators[f.Operator] {
+			rewritten = append(rewritten, f)
+			continue
+		}
+
+		values, err := app.customFieldValuesByEmail(field.Name)
+		if err != nil {
+			return nil, err
+		}
+		emails := []interface{}{}
+		operator := "IN"
+		for email, value := range values {
+			if f.Operator == "IS NULL" || f.Operator == "IS NOT NULL" || matchCustomValue(field, value, f.Operator, f.Value) {
+				emails = append(emails, email)
+			}
+		}
+		if f.Operator == "IS NULL" {
+			operator = "NOT IN"
+		}
+		rewritten = append(rewritten, QueryFilter{Field: "email", Operator: operator, Value: emails})
+	}
+	return rewritten, nil
+}
+
+// matchCustomValue applies a DynamicQuery comparison to a stored value
+func matchCustomValue(f CustomField, stored, operator string, want interface{}) bool {
+	switch operator {
+	case "IN", "NOT IN":
+		list, _ := want.([]interface{})
+		found := false
+		for _, w := range list {
+			if compareCustomValue(f, stored, w) == 0 {
+				found = true
+				break
+			}
+		}
+		return found == (operator == "IN")
+	case "LIKE", "NOT LIKE":
+		pattern := regexp.QuoteMeta(fmt.Sprint(want))
+		pattern = strings.NewReplacer("%", ".*", "_", ".").Replace(pattern)
+		re, err := regexp.Compile("(?is)^" + pattern + "$")
+		if err != nil {
+			return false
+		}
+		return re.MatchString(stored) == (operator == "LIKE")
+	}
+
+	c := compareCustomValue(f, stored, want)
+	switch operator {
+	case "=":
+		return c == 0
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	}
+	return false
+}
+
+// compareCustomValue orders a stored value against a query value, numerically
+// for number fields and case-insensitively otherwise
+func compareCustomValue(f CustomField, stored string, want interface{}) int {
+	if f.Type == FieldNumber {
+		a, errA := strconv.ParseFloat(stored, 64)
+		b, errB := strconv.ParseFloat(fmt.Sprint(want), 64)
+		if errA == nil && errB == nil {
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
+			return 0
+		}
+	}
+	w := fmt.Sprint(want)
+	if normalized, err := f.normalize(w); err == nil && normalized != "" {
+		w = normalized
+	}
+	return strings.Compare(strings.ToLower(stored), strings.ToLower(w))
+}
+
+// attachCustomFields adds custom field values to dynamic query rows that
+// carry an email, limited to the requested fields when any were named
+func (app *App) attachCustomFields(q DynamicQuery, fields map[string]CustomField, rows []map[string]interface{}) {
+	if len(q.Aggregates) > 0 || len(fields) == 0 {
+		return
+	}
+	wanted := fields
+	if len(q.Fields) > 0 {
+		wanted = make(map[string]CustomField)
+		for _, name := range q.Fields {
+			if f, ok := fields[name]; ok {
+				wanted[name] = f
+			}
+		}
+	}
+	if len(wanted) == 0 {
+		return
+	}
+	for _, row := range rows {
+		email, _ := row["email"].(string)
+		if email == "" {
+			continue
+		}
+		values, err := app.CustomFieldValues(email)
+		if err != nil {
+			log.Printf("Error loading custom fields for %s: %v", email, err)
+			continue
+		}
+		for name := range wanted {
+			if v, ok := values[name]; ok {
+				row[name] = v
+			}
+		}
+	}
+}
+
+// formatCustomFields renders a user's custom field values for a match card
+func formatCustomFields(email, role string) string {
+	fields := chatRoom.customFieldsFor(role)
+	if len(fields) == 0 {
+		return ""
+	}
+	values, err := chatRoom.CustomFieldValues(email)
+	if err != nil {
+		log.Printf("Error loading custom fields for %s: %v", email, err)
+		return ""
+	}
+	var sb strings.Builder
+	for _, f := range fields {
+		if v, ok := values[f.Name]; ok {
+			sb.WriteString(fmt.Sprintf("<span>🏷️ %s: %s</span><br>", html.EscapeString(f.Label), html.EscapeString(v)))
+		}
+	}
+	return sb.String()
+}
+
+// CustomFieldInput is one custom field on the profile form
+type CustomFieldInput struct {
+	Field CustomField
+	Value string
+}
+
+// customFieldInputs lists the fields a user can fill in with their values
+func (app *App) customFieldInputs(email string) []CustomFieldInput {
+	fields := app.customFieldsFor(app.userRole(email))
+	if len(fields) == 0 {
+		return nil
+	}
+	values, err := app.CustomFieldValues(email)
+	if err != nil {
+		log.Printf("Error loading custom fields for %s: %v", email, err)
+	}
+	inputs := make([]CustomFieldInput, len(fields))
+	for i, f := range fields {
+		inputs[i] = CustomFieldInput{Field: f, Value: values[f.Name]}
+	}
+	return inputs
+}
+
+// handleProfileFields saves the custom fields posted from the chat page
+func handleProfileFields(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	role := chatRoom.userRole(email)
+	values := make(map[string]string)
+	for _, f := range chatRoom.customFieldsFor(role) {
+		if _, ok := r.Form[f.Name]; ok {
+			values[f.Name] = r.FormValue(f.Name)
+		}
+	}
+	if err := chatRoom.SetCustomFieldValues(email, role, values); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("../?email=%s", url.QueryEscape(email)), http.StatusSeeOther)
+}
+
+// handleCustomFieldsAPI lists (GET), defines (POST) and deletes (DELETE
+// with name) custom fields
+func handleCustomFieldsAPI(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fields, err := chatRoom.CustomFields()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSONCached(w, r, fields, time.Time{})
+
+	case "POST":
+		var f CustomField
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.DefineCustomField(f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		if err := chatRoom.DeleteCustomField(r.FormValue("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
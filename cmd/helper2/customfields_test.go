@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestCustomFieldValues(t *testing.T) {
+	app := newTestApp(t)
+	for _, f := range []CustomField{
+		{Name: "languages", Label: "Languages", Type: FieldText, AppliesTo: "both"},
+		{Name: "pets_ok", Label: "Pets OK", Type: FieldBoolean, AppliesTo: "caregiver"},
+	} {
+		if err := app.DefineCustomField(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := app.SetCustomFieldValues("a@example.com", "caregiver", map[string]string{
+		"languages": "English, Spanish",
+		"pets_ok":   "yes",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := app.CustomFieldValues("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["languages"] != "English, Spanish" || values["pets_ok"] != "true" {
+		t.Errorf("stored values = %v", values)
+	}
+
+	byEmail, err := app.customFieldValuesByEmail("pets_ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byEmail["a@example.com"] != "true" {
+		t.Errorf("pets_ok by email = %v", byEmail)
+	}
+}
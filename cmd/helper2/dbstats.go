@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "helper2_db_query_duration_seconds",
+	Help:    "Time spent in database queries, statements and transactions.",
+	Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"op", "table"})
+
+func init() {
+	prometheus.MustRegister(dbQueryDuration)
+}
+
+// instrumentedDB is the app's database handle. Query and Exec are timed
+// into dbQueryDuration, and ones slower than config.Database.SlowQueryMS
+// are logged; everything else is chai's.
+type instrumentedDB struct {
+	*chai.DB
+}
+
+func (db *instrumentedDB) Query(q string, args ...interface{}) (*chai.Result, error) {
+	defer observeQuery("query", q, len(args), time.Now())
+	return db.DB.Query(q, args...)
+}
+
+func (db *instrumentedDB) Exec(q string, args ...interface{}) error {
+	defer observeQuery("exec", q, len(args), time.Now())
+	return db.DB.Exec(q, args...)
+}
+
+// Update times the whole transaction; the statements inside it run on the
+// transaction and aren't timed one by one
+func (db *instrumentedDB) Update(fn func(tx *chai.Tx) error) error {
+	defer observeQuery("tx", "", 0, time.Now())
+	return db.DB.Update(fn)
+}
+
+var (
+	queryTablePattern = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE|TABLE(?: IF NOT EXISTS)?|ON)\s+(\w+)`)
+	queryWhitespace   = regexp.MustCompile(`\s+`)
+)
+
+// queryTable names the first table a statement touches, for the metric label
+func queryTable(q string) string {
+	if m := queryTablePattern.FindStringSubmatch(q); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return "unknown"
+}
+
+func observeQuery(op, q string, args int, started time.Time) {
+	elapsed := time.Since(started)
+	table := ""
+	if q != "" {
+		table = queryTable(q)
+	}
+	dbQueryDuration.WithLabelValues(op, table).Observe(elapsed.Seconds())
+
+	threshold := time.Duration(config.Database.SlowQueryMS) * time.Millisecond
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+	if q == "" {
+		log.Printf("Slow transaction (%s)", elapsed.Round(time.Millisecond))
+		return
+	}
+	// Statements use placeholders, so the text carries no user data; the
+	// arguments are only counted
+	log.Printf("Slow %s on %s (%s, %d args): %s", op, table, elapsed.Round(time.Millisecond), args,
+		strings.TrimSpace(queryWhitespace.ReplaceAllString(q, " ")))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// When OpenAI can't be reached, a chat message still gets an answer: the
+// few requests that map straight onto a tool are answered without the
+// model, and the message is queued so the assistant replies properly once
+// OpenAI is back. The chat page says the assistant is down meanwhile.
+
+const pendingRepliesSchema = `
+	CREATE TABLE IF NOT EXISTS pending_replies (
+		email TEXT PRIMARY KEY,
+		message TEXT,
+		queued_at TIMESTAMP,
+		attempts INTEGER
+	);
+	CREATE INDEX IF NOT EXISTS idx_pending_replies_queued ON pending_replies(queued_at)
+`
+
+// maxPendingReplyAge is how long a queued message waits for OpenAI before
+// the user is asked to send it again
+const maxPendingReplyAge = 24 * time.Hour
+
+const (
+	assistantDownMessage = "The assistant is unavailable right now. Your message is saved, and you'll get a reply as soon as it's back. Meanwhile you can ask to see your matches or your profile."
+	assistantDownLookup  = "The assistant is unavailable right now, so here's what I could look up. You'll get a full reply as soon as it's back."
+	pendingExpiredReply  = "Sorry, the assistant was unavailable for too long to answer your last message. Please send it again."
+)
+
+var (
+	matchIntentPattern   = regexp.MustCompile(`(?i)\bmatch(es|ed|ing)?\b|\bfind\b`)
+	profileIntentPattern = regexp.MustCompile(`(?i)\bprofile\b`)
+)
+
+// errAssistantUnavailable is a failed OpenAI call, as opposed to a failure
+// acting on what it returned
+type errAssistantUnavailable struct {
+	err error
+}
+
+func (e *errAssistantUnavailable) Error() string {
+	return fmt.Sprintf("failed to call OpenAI: %v", e.err)
+}
+
+// AssistantDown reports whether OpenAI requests are currently failing
+func AssistantDown() bool {
+	return openAICircuit.Status().State != CircuitClosed
+}
+
+// fallbackTool picks the tool answering a message without the model, or ""
+func fallbackTool(message, role string) string {
+	switch {
+	case matchIntentPattern.MatchString(message) && role == "caregiver":
+		return "find_matching_patients"
+	case matchIntentPattern.MatchString(message) && role == "patient":
+		return "find_matching_caregivers"
+	case profileIntentPattern.MatchString(message):
+		return "get_profile_status"
+	}
+	return ""
+}
+
+// replyWhileDown answers a message OpenAI couldn't, and queues it for the
+// assistant to answer later
+func (app *App) replyWhileDown(email, message string, cause error) error {
+	log.Printf("Assistant unavailable for %s, queueing message: %v", email, cause)
+	err := app.db.Exec(`
+		INSERT INTO pending_replies (email, message, queued_at, attempts)
+		VALUES (?, ?, ?, 0)
+		ON CONFLICT DO REPLACE
+	`, email, message, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to queue message: %v", err)
+	}
+
+	tool := fallbackTool(message, app.userRole(email))
+	if tool == "" || !app.tools.Enabled(tool) {
+		return app.AddMessageWithRecipient(email, "assistant", assistantDownMessage, "admin")
+	}
+	if err := app.AddMessageWithRecipient(email, "assistant", assistantDownLookup, "admin"); err != nil {
+		return err
+	}
+	return app.AddMessageWithRecipient(email, "assistant", app.dispatchFunctionCall(tool, nil, email), "admin")
+}
+
+// HasPendingReply reports whether a user is waiting for the assistant to
+// answer a message it couldn't
+func (app *App) HasPendingReply(email string) bool {
+	exists, err := rowExists(app.db, "SELECT email FROM pending_replies WHERE email = ?", email)
+	if err != nil {
+		log.Printf("Error checking pending reply for %s: %v", email, err)
+		return false
+	}
+	return exists
+}
+
+type pendingReply struct {
+	email    string
+	message  string
+	queuedAt time.Time
+	attempts int
+}
+
+// pendingRepliesJob asks the assistant again about queued messages, oldest
+// first, stopping at the first that still fails
+func (app *App) pendingRepliesJob() error {
+	if openAICircuit.Status().State == CircuitOpen {
+		return nil
+	}
+
+	result, err := app.db.Query(`
+		SELECT email, message, queued_at, attempts
+		FROM pending_replies
+		ORDER BY queued_at
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to query pending replies: %v", err)
+	}
+	var pending []pendingReply
+	err = result.Iterate(func(r *chai.Row) error {
+		var p pendingReply
+		if err := r.Scan(&p.email, &p.message, &p.queuedAt, &p.attempts); err != nil {
+			return fmt.Errorf("failed to scan pending reply: %v", err)
+		}
+		pending = append(pending, p)
+		return nil
+	})
+	result.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pending {
+		if time.Since(p.queuedAt) > maxPendingReplyAge {
+			log.Printf("Giving up on queued message from %s after %d attempts", p.email, p.attempts)
+			if err := app.AddMessageWithRecipient(p.email, "assistant", pendingExpiredReply, "admin"); err != nil {
+				return err
+			}
+			if err := app.db.Exec("DELETE FROM pending_replies WHERE email = ?", p.email); err != nil {
+				return fmt.Errorf("failed to drop pending reply: %v", err)
+			}
+			continue
+		}
+
+		err := app.replyTo(p.email, p.message)
+		if unavailable, ok := err.(*errAssistantUnavailable); ok {
+			if err := app.db.Exec("UPDATE pending_replies SET attempts = ? WHERE email = ?", p.attempts+1, p.email); err != nil {
+				return fmt.Errorf("failed to update pending reply: %v", err)
+			}
+			return unavailable
+		}
+		if err != nil {
+			log.Printf("Error replying to queued message from %s: %v", p.email, err)
+		}
+		if err := app.db.Exec("DELETE FROM pending_replies WHERE email = ?", p.email); err != nil {
+			return fmt.Errorf("failed to drop pending reply: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	_ "net/http/pprof" // Registers /debug/pprof on the default mux
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var debugAddr = flag.String("debug-addr", "", "Address to serve pprof, expvar and /debug/status on, e.g. 127.0.0.1:6060; empty disables them")
+
+var startedAt = time.Now()
+
+// DebugStatus is what /debug/status reports
+type DebugStatus struct {
+	Uptime        string            `json:"uptime"`
+	GoVersion     string            `json:"go_version"`
+	Goroutines    int               `json:"goroutines"`
+	HeapAllocMB   float64           `json:"heap_alloc_mb"`
+	SysMB         float64           `json:"sys_mb"`
+	NumGC         uint32            `json:"num_gc"`
+	Database      string            `json:"database"`
+	DatabaseMB    float64           `json:"database_mb"`
+	Sessions      int               `json:"sessions"`
+	Streams       int               `json:"streams"`
+	JobsScheduled int               `json:"jobs_scheduled"`
+	JobsRunning   int               `json:"jobs_running"`
+	OpenAICircuit CircuitStatus     `json:"openai_circuit"`
+	Maintenance   MaintenanceStatus `json:"maintenance"`
+}
+
+// Streams counts open event streams across all users
+func (h *realtimeHub) Streams() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, subs := range h.streams {
+		n += len(subs)
+	}
+	return n
+}
+
+func (app *App) debugStatus() DebugStatus {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	status := DebugStatus{
+		Uptime:        time.Since(startedAt).Round(time.Second).String(),
+		GoVersion:     runtime.Version(),
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAllocMB:   float64(mem.HeapAlloc) / (1 << 20),
+		SysMB:         float64(mem.Sys) / (1 << 20),
+		NumGC:         mem.NumGC,
+		Database:      databasePath(),
+		Streams:       app.realtime.Streams(),
+		OpenAICircuit: openAICircuit.Status(),
+		Maintenance:   maintenance.Status(),
+	}
+	if info, err := os.Stat(status.Database); err == nil {
+		status.DatabaseMB = float64(info.Size()) / (1 << 20)
+	}
+	app.mu.RLock()
+	status.Sessions = len(app.sessions)
+	app.mu.RUnlock()
+	status.JobsScheduled, status.JobsRunning = app.scheduler.Load()
+	return status
+}
+
+func handleDebugStatus(w http.ResponseWriter, r *http.Request) {
+	status := chatRoom.debugStatus()
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, status)
+		return
+	}
+	renderTemplate(w, "debugStatus", debugStatusTemplate, status)
+}
+
+// requireDebugToken guards the debug server with DEBUG_TOKEN, given as a
+// bearer token or a token query parameter. Without DEBUG_TOKEN the server
+// is open, so it should only listen on a private address.
+func requireDebugToken(next http.Handler) http.Handler {
+	token := os.Getenv("DEBUG_TOKEN")
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); len(auth) > 7 && auth[:7] == "Bearer " {
+			got = auth[7:]
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveDebug starts the debug server if -debug-addr is set. It serves the
+// default mux, where net/http/pprof and expvar register themselves, along
+// with Prometheus metrics at /metrics; the
+// app's own routes are on a separate mux so none of this reaches the
+// public port.
+func serveDebug(app *App) {
+	if *debugAddr == "" {
+		return
+	}
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("openai_circuit", expvar.Func(func() interface{} { return openAICircuit.Status() }))
+	expvar.Publish("status", expvar.Func(func() interface{} { return app.debugStatus() }))
+	http.HandleFunc("/debug/status", handleDebugStatus)
+	http.Handle("/metrics", promhttp.Handler())
+
+	if os.Getenv("DEBUG_TOKEN") == "" {
+		log.Printf("DEBUG_TOKEN is not set; the debug server on %s is unauthenticated", *debugAddr)
+	}
+	go func() {
+		log.Printf("Debug server stopped: %v", http.ListenAndServe(*debugAddr, requireDebugToken(http.DefaultServeMux)))
+	}()
+}
+
+const debugStatusTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Status</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Status</h1>
+            <div class="app-description">Up {{.Uptime}} on {{.GoVersion}} &middot; <a href="/debug/pprof/">pprof</a> &middot; <a href="/debug/vars">expvar</a> &middot; <a href="/metrics">metrics</a> &middot; <a href="?format=json">JSON</a></div>
+        </div>
+        <table class="query-results">
+            <tr><th>Goroutines</th><td>{{.Goroutines}}</td></tr>
+            <tr><th>Heap</th><td>{{printf "%.1f" .HeapAllocMB}} MB ({{printf "%.1f" .SysMB}} MB from the OS, {{.NumGC}} GCs)</td></tr>
+            <tr><th>Database</th><td>{{.Database}}{{if .DatabaseMB}} ({{printf "%.1f" .DatabaseMB}} MB){{end}}</td></tr>
+            <tr><th>Cached sessions</th><td>{{.Sessions}}</td></tr>
+            <tr><th>Open event streams</th><td>{{.Streams}}</td></tr>
+            <tr><th>Jobs</th><td>{{.JobsRunning}} running of {{.JobsScheduled}} registered</td></tr>
+            <tr><th>OpenAI circuit</th><td>{{.OpenAICircuit.State}}{{if .OpenAICircuit.Failures}}, {{.OpenAICircuit.Failures}} failures in a row{{end}}{{if ne .OpenAICircuit.State "closed"}} since {{.OpenAICircuit.OpenedAt.Format "15:04:05"}}{{end}}</td></tr>
+        </table>
+    </div>
+</body>
+</html>
+`
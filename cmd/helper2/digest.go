@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// matcherActor is recorded as the actor on matches the nightly job proposes
+const matcherActor = "matcher"
+
+const digestSchema = `
+	CREATE TABLE IF NOT EXISTS digest_items (
+		email TEXT,
+		counterpart TEXT,
+		name TEXT,
+		created_at TIMESTAMP,
+		sent_at TIMESTAMP,
+		PRIMARY KEY (email, counterpart)
+	)
+`
+
+// activeUsers returns the registered users who have chatted within days,
+// caregivers first
+func (app *App) activeUsers(days int) (caregivers, patients []string, err error) {
+	since := time.Now().AddDate(0, 0, -days)
+	result, err := app.db.Query("SELECT email FROM chat_history WHERE created_at > ?", since)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query active users: %v", err)
+	}
+	defer result.Close()
+
+	seen := make(map[string]bool)
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		if err := r.Scan(&email); err != nil {
+			return fmt.Errorf("failed to scan active user: %v", err)
+		}
+		if seen[email] {
+			return nil
+		}
+		seen[email] = true
+		switch app.userRole(email) {
+		case "caregiver":
+			caregivers = append(caregivers, email)
+		case "patient":
+			patients = append(patients, email)
+		}
+		return nil
+	})
+	return caregivers, patients, err
+}
+
+// proposeMatch stores a match the nightly job found unless the pair already
+// has one, in any status, and queues it for both parties' digests. Users
+// who want new matches immediately are notified now instead. It reports
+// whether the match was new.
+func (app *App) proposeMatch(caregiver *Caregiver, patient *Patient) (bool, error) {
+	existing, err := app.GetMatch(caregiver.Email, patient.Email)
+	if err != nil || existing != nil {
+		return false, err
+	}
+	if err := app.CreateMatch(&Match{CaregiverEmail: caregiver.Email, PatientEmail: patient.Email}, matcherActor); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	for _, item := range [][3]string{
+		{caregiver.Email, patient.Email, patient.Name},
+		{patient.Email, caregiver.Email, caregiver.Name},
+	} {
+		err := app.db.Exec(`
+			INSERT INTO digest_items (email, counterpart, name, created_at)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT DO NOTHING
+		`, item[0], item[1], item[2], now)
+		if err != nil {
+			return true, fmt.Errorf("failed to queue digest item: %v", err)
+		}
+		app.notifyNewMatch(digestItem{Email: item[0], Counterpart: item[1], Name: item[2], CreatedAt: now})
+	}
+	return true, nil
+}
+
+// notifyNewMatch sends a single new match to a user who asked for
+// immediate notifications. Anything not sent stays queued for the digest.
+func (app *App) notifyNewMatch(item digestItem) {
+	prefs, err := app.GetNotificationPrefs(item.Email)
+	if err != nil || prefs.Frequency != FrequencyImmediate {
+		return
+	}
+	err = app.Notify(Notification{
+		Email: item.Email,
+		Kind:  NotifyNewMatch,
+		Data:  map[string]interface{}{"Matches": []digestItem{item}},
+	})
+	if err == errQuietHours {
+		return
+	}
+	if err != nil {
+		log.Printf("Error sending new match notification: %v", err)
+		return
+	}
+	if err := app.markDigestSent([]digestItem{item}); err != nil {
+		log.Printf("Error marking new match sent: %v", err)
+	}
+}
+
+func (app *App) markDigestSent(items []digestItem) error {
+	now := time.Now()
+	for _, item := range items {
+		err := app.db.Exec("UPDATE digest_items SET sent_at = ? WHERE email = ? AND counterpart = ?",
+			now, item.Email, item.Counterpart)
+		if err != nil {
+			return fmt.Errorf("failed to mark digest sent: %v", err)
+		}
+	}
+	return nil
+}
+
+// RecomputeMatches runs the matcher for every active user and proposes the
+// best candidates they aren't already matched with
+func (app *App) RecomputeMatches() (int, error) {
+	caregivers, patients, err := app.activeUsers(config.Digest.ActiveDays)
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, email := range patients {
+		patient, err := app.GetPatient(email)
+		if err != nil || patient == nil {
+			log.Printf("Error loading patient %s for recompute: %v", email, err)
+			continue
+		}
+		candidates, err := app.FindMatchingCaregivers(email)
+		if err == errConsentRequired {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error matching patient %s: %v", email, err)
+			continue
+		}
+		for i := 0; i < len(candidates) && i < config.Digest.CandidatesPerUser; i++ {
+			isNew, err := app.proposeMatch(&candidates[i], patient)
+			if err != nil {
+				log.Printf("Error proposing match %s/%s: %v", candidates[i].Email, email, err)
+			} else if isNew {
+				created++
+			}
+		}
+	}
+	for _, email := range caregivers {
+		caregiver, err := app.GetCaregiver(email)
+		if err != nil || caregiver == nil {
+			log.Printf("Error loading caregiver %s for recompute: %v", email, err)
+			continue
+		}
+		candidates, err := app.FindMatchingPatients(email)
+		if err == errConsentRequired {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error matching caregiver %s: %v", email, err)
+			continue
+		}
+		for i := 0; i < len(candidates) && i < config.Digest.CandidatesPerUser; i++ {
+			isNew, err := app.proposeMatch(caregiver, &candidates[i])
+			if err != nil {
+				log.Printf("Error proposing match %s/%s: %v", email, candidates[i].Email, err)
+			} else if isNew {
+				created++
+			}
+		}
+	}
+	return created, nil
+}
+
+func (app *App) recomputeJob() error {
+	created, err := app.RecomputeMatches()
+	if err != nil {
+		return err
+	}
+	log.Printf("Match recompute proposed %d new matches", created)
+	return nil
+}
+
+// digestItem is one new match waiting to be mailed
+type digestItem struct {
+	Email       string
+	Counterpart string
+	Name        string
+	CreatedAt   time.Time
+}
+
+func (app *App) pendingDigestItems() (map[string][]digestItem, error) {
+	result, err := app.db.Query(`
+		SELECT email, counterpart, name, created_at
+		FROM digest_items
+		WHERE sent_at IS NULL
+		ORDER BY created_at
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query digest items: %v", err)
+	}
+	defer result.Close()
+
+	pending := make(map[string][]digestItem)
+	err = result.Iterate(func(r *chai.Row) error {
+		var item digestItem
+		if err := r.Scan(&item.Email, &item.Counterpart, &item.Name, &item.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan digest item: %v", err)
+		}
+		pending[item.Email] = append(pending[item.Email], item)
+		return nil
+	})
+	return pending, err
+}
+
+// SendDigests mails every user their unsent new matches in one email.
+// Users in their quiet hours get theirs on a later run.
+func (app *App) SendDigests() (int, error) {
+	pending, err := app.pendingDigestItems()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for email, items := range pending {
+		err := app.Notify(Notification{
+			Email: email,
+			Kind:  NotifyMatchDigest,
+			Data:  map[string]interface{}{"Matches": items},
+		})
+		if err == errQuietHours {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error sending digest: %v", err)
+			continue
+		}
+		if err := app.markDigestSent(items); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+func (app *App) digestJob() error {
+	sent, err := app.SendDigests()
+	if err != nil {
+		return err
+	}
+	log.Printf("Sent %d match digests", sent)
+	return nil
+}
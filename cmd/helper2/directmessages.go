@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Each chat_history row's recipient says who it's for: the assistant
+// ("admin", or "system" in older rows) or another user, by email. A user's
+// threads are the admin thread, which is their conversation with the
+// assistant, and one thread per peer they've exchanged direct messages
+// with, named by the peer's email. Users can message each other once their
+// contact details are shared.
+
+// assistantMessages matches the chat_history rows of the admin thread
+const assistantMessages = `(recipient IS NULL OR recipient IN ('admin', 'system', ''))`
+
+// directMessages matches the chat_history rows sent to another user
+const directMessages = `recipient NOT IN ('admin', 'system', '')`
+
+// maxDirectMessage caps the length of a direct message
+const maxDirectMessage = 2000
+
+var errNotConnected = errors.New("you can message someone once you've shared contact details")
+
+// PeerThread is a user's direct messages with one peer
+type PeerThread struct {
+	Peer          string    `json:"peer"`
+	LastMessageAt time.Time `json:"last_message_at"`
+	Unread        int       `json:"unread"`
+}
+
+// threadFilter returns the chat_history condition, and its arguments, for
+// the messages in one of a user's threads
+func (app *App) threadFilter(email, thread string) (string, []interface{}, error) {
+	if thread == adminThread {
+		conversation, err := app.ActiveThread(email)
+		if err != nil {
+			return "", nil, err
+		}
+		return "email = ? AND thread_id = ? AND " + assistantMessages, []interface{}{email, conversation}, nil
+	}
+	if !isUserRecipient(thread) || thread == email {
+		return "", nil, fmt.Errorf("no such thread")
+	}
+	return "((email = ? AND recipient = ?) OR (email = ? AND recipient = ?))",
+		[]interface{}{email, thread, thread, email}, nil
+}
+
+// PeerMessages returns the latest direct messages between a user and a
+// peer, oldest first. The user's own messages have the role "user" and the
+// peer's "peer".
+func (app *App) PeerMessages(email, peer string) ([]Message, error) {
+	page, err := app.MessagePage(email, peer, time.Time{}, app.maxHistory)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]Message, len(page.Messages))
+	for i, m := range page.Messages {
+		role := "user"
+		if m.From != email {
+			role = "peer"
+		}
+		messages[i] = Message{Role: role, Content: m.Content}
+	}
+	return messages, nil
+}
+
+// PeerThreads lists the peers a user has exchanged direct messages with,
+// the most recent first
+func (app *App) PeerThreads(email string) ([]PeerThread, error) {
+	last := make(map[string]time.Time)
+	seen := func(peer string, createdAt time.Time) {
+		if createdAt.After(last[peer]) {
+			last[peer] = createdAt
+		}
+	}
+
+	result, err := app.db.Query(`
+		SELECT recipient, created_at FROM chat_history
+		WHERE email = ? AND `+directMessages, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sent messages: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		var peer string
+		var createdAt time.Time
+		if err := r.Scan(&peer, &createdAt); err != nil {
+			return fmt.Errorf("failed to scan sent message: %v", err)
+		}
+		seen(peer, createdAt)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err = app.db.Query(`
+		SELECT email, created_at FROM chat_history
+		WHERE recipient = ? AND email != ?
+	`, email, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query received messages: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		var peer string
+		var createdAt time.Time
+		if err := r.Scan(&peer, &createdAt); err != nil {
+			return fmt.Errorf("failed to scan received message: %v", err)
+		}
+		seen(peer, createdAt)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	unread, err := app.GetUnreadCounts(email)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(unread))
+	for _, t := range unread {
+		counts[t.Thread] = t.Count
+	}
+
+	threads := make([]PeerThread, 0, len(last))
+	for peer, at := range last {
+		threads = append(threads, PeerThread{Peer: peer, LastMessageAt: at, Unread: counts[peer]})
+	}
+	sort.Slice(threads, func(i, j int) bool { return threads[i].LastMessageAt.After(threads[j].LastMessageAt) })
+	return threads, nil
+}
+
+// SendDirectMessage moderates a message from one user to another and
+// stores it, unless moderation holds it for review or blocks it
+func (app *App) SendDirectMessage(sender, recipient, content string) (*Delivery, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil, fmt.Errorf("message cannot be empty")
+	}
+	if len(content) > maxDirectMessage {
+		return nil, fmt.Errorf("a message can be at most %d characters", maxDirectMessage)
+	}
+	if !isUserRecipient(recipient) || recipient == sender {
+		return nil, fmt.Errorf("no such recipient")
+	}
+	if app.Suspended(sender) {
+		return nil, errSuspended
+	}
+	if app.Blocked(sender, recipient) {
+		return nil, errBlocked
+	}
+	if !app.ContactShared(sender, recipient) {
+		return nil, errNotConnected
+	}
+	app.ScreenMessage(sender, recipient, content)
+
+	action, categories := app.moderate(sender, content)
+	switch action {
+	case ModBlock:
+		if err := app.recordModeration(sender, recipient, content, action, ModStatusBlocked, categories); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", errMessageBlocked, moderationReason(categories))
+	case ModHold:
+		if err := app.recordModeration(sender, recipient, content, action, ModStatusHeld, categories); err != nil {
+			return nil, err
+		}
+		return &Delivery{Status: ModStatusHeld, Notice: moderationNotice(action, categories), Categories: categories}, nil
+	case ModWarn:
+		if err := app.recordModeration(sender, recipient, content, action, ModStatusWarned, categories); err != nil {
+			return nil, err
+		}
+	}
+	if err := app.AddMessageWithRecipient(sender, "user", content, recipient); err != nil {
+		return nil, err
+	}
+	return &Delivery{Status: "sent", Notice: moderationNotice(action, categories), Categories: categories}, nil
+}
+
+// directMessageStatus is the HTTP status for a failure to send a direct
+// message
+func directMessageStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotConnected), errors.Is(err, errBlocked), errors.Is(err, errSuspended):
+		return http.StatusForbidden
+	case errors.Is(err, errMessageBlocked):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
+const threadTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Messages with {{.Peer}}</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Messages with {{.Peer}}</h1>
+            <div class="app-description"><a href="./?email={{.UserEmail}}">Back to the assistant</a></div>
+        </div>
+        <div id="messages">
+            {{range .Messages}}
+            <div class="message {{if eq .From $.UserEmail}}user{{else}}assistant{{end}}">
+                <strong>{{if eq .From $.UserEmail}}You{{else}}{{.From}}{{end}}:</strong> {{.Content}}
+                <small>{{.CreatedAt.Format "Jan 2, 3:04 PM"}}</small>
+            </div>
+            {{else}}
+            <p>No messages yet.</p>
+            {{end}}
+        </div>
+        {{with .Notice}}<div class="status-banner">{{.}}</div>{{end}}
+        {{if .CanSend}}
+        <form method="POST" action="thread" class="message-form">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="hidden" name="peer" value="{{.Peer}}">
+            <input type="text" name="message" placeholder="Message {{.Peer}}..." class="message-input" maxlength="2000" required>
+            <button type="submit" class="send-button">Send</button>
+        </form>
+        {{else if .YouBlocked}}
+        <form method="POST" action="block" class="status-banner">
+            You blocked {{.Peer}}.
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="hidden" name="target" value="{{.Peer}}">
+            <input type="hidden" name="from" value="thread">
+            <button type="submit" name="action" value="unblock">Unblock</button>
+        </form>
+        {{else if .Blocked}}
+        <p>You can't message {{.Peer}}.</p>
+        {{else if .Suspended}}
+        <p>Your account is suspended, so you can't send messages for now.</p>
+        {{else}}
+        <p>You can message {{.Peer}} once you've shared contact details.</p>
+        {{end}}
+        {{if .Messages}}{{safeHTML .ReportBlock}}{{end}}
+    </div>
+</body>
+</html>
+`
+
+// handleThread shows the direct messages between a user and a peer
+// (?email=&peer=) and sends one on POST. An admin viewing as the user can
+// read the thread but not send to it.
+func handleThread(w http.ResponseWriter, r *http.Request) {
+	email, peer := r.FormValue("email"), r.FormValue("peer")
+	if email == "" || peer == "" {
+		http.Error(w, "email and peer are required", http.StatusBadRequest)
+		return
+	}
+	impersonation := impersonationFrom(r)
+
+	if r.Method == "POST" {
+		if impersonation != nil {
+			http.Error(w, "Only the user can send direct messages", http.StatusForbidden)
+			return
+		}
+		delivery, err := chatRoom.SendDirectMessage(email, peer, r.FormValue("message"))
+		if err != nil {
+			http.Error(w, err.Error(), directMessageStatus(err))
+			return
+		}
+		target := "thread?email=" + url.QueryEscape(email) + "&peer=" + url.QueryEscape(peer)
+		if delivery.Notice != "" {
+			target += "&moderated=" + url.QueryEscape(delivery.Status) +
+				"&reason=" + url.QueryEscape(strings.Join(delivery.Categories, ","))
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	}
+
+	page, err := chatRoom.MessagePage(email, peer, time.Time{}, messagePageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var notice string
+	if status := r.FormValue("moderated"); status != "" {
+		notice = deliveryNotice(status, r.FormValue("reason"))
+	}
+	blocked, suspended := chatRoom.Blocked(email, peer), chatRoom.Suspended(email)
+	renderTemplate(w, "thread", threadTemplate, struct {
+		UserEmail   string
+		Peer        string
+		Messages    []HistoryMessage
+		CanSend     bool
+		Notice      string
+		Blocked     bool
+		YouBlocked  bool
+		Suspended   bool
+		ReportBlock string
+	}{
+		email, peer, page.Messages,
+		impersonation == nil && !blocked && !suspended && chatRoom.ContactShared(email, peer),
+		notice, blocked, blocked && chatRoom.HasBlocked(email, peer), suspended,
+		formatReportBlock(email, peer, "thread"),
+	})
+
+	if impersonation == nil {
+		if err := chatRoom.MarkThreadRead(email, peer); err != nil {
+			log.Printf("Error marking thread read for %s: %v", email, err)
+		}
+	}
+}
+
+// handleDirectMessagesAPI lists a user's peer threads on GET and sends a
+// direct message (email, recipient, message) on POST. A held message gets
+// 202 and a warned one 200, both with the Delivery.
+func handleDirectMessagesAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		threads, err := chatRoom.PeerThreads(email)
+		if err != nil {
+			log.Printf("Error listing direct messages for %s: %v", email, err)
+			http.Error(w, "Failed to list direct messages", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, threads)
+
+	case "POST":
+		if impersonationFrom(r) != nil {
+			http.Error(w, "Only the user can send direct messages", http.StatusForbidden)
+			return
+		}
+		delivery, err := chatRoom.SendDirectMessage(email, r.FormValue("recipient"), r.FormValue("message"))
+		if err != nil {
+			http.Error(w, err.Error(), directMessageStatus(err))
+			return
+		}
+		switch {
+		case delivery.Status == ModStatusHeld:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(delivery)
+		case delivery.Notice != "":
+			writeJSON(w, delivery)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chaisql/chai"
+)
+
+// The directory at /directory lets families browse caregivers without
+// chatting. It lists the caregivers who've turned on a public page and are
+// taking new families, showing what their public page shows. Rates filter
+// by the band the page shows, so the filters can't be used to work out a
+// caregiver's exact rate.
+
+// directoryPageSize is how many caregivers a directory page lists
+const directoryPageSize = 20
+
+// DirectoryFilter narrows the directory. Zero values don't filter.
+type DirectoryFilter struct {
+	Location string   `json:"location,omitempty"` // Matches any location containing it
+	MinRate  float64  `json:"min_rate,omitempty"`
+	MaxRate  float64  `json:"max_rate,omitempty"`
+	Skills   []string `json:"skills,omitempty"` // The caregiver must have all of them
+}
+
+// DirectoryPage is one page of directory results
+type DirectoryPage struct {
+	Filter     DirectoryFilter   `json:"filter"`
+	Caregivers []PublicCaregiver `json:"caregivers"`
+	Page       int               `json:"page"`
+	Pages      int               `json:"pages"`
+	Total      int               `json:"total"`
+}
+
+// parseDirectoryFilter reads the filter from ?location=&min_rate=&max_rate=
+// and a comma-separated &skills=
+func parseDirectoryFilter(r *http.Request) DirectoryFilter {
+	f := DirectoryFilter{Location: strings.TrimSpace(r.FormValue("location"))}
+	f.MinRate, _ = strconv.ParseFloat(r.FormValue("min_rate"), 64)
+	f.MaxRate, _ = strconv.ParseFloat(r.FormValue("max_rate"), 64)
+	for _, skill := range strings.Split(r.FormValue("skills"), ",") {
+		if skill = strings.TrimSpace(skill); skill != "" {
+			f.Skills = append(f.Skills, skill)
+		}
+	}
+	return f
+}
+
+// Query encodes the filter and a page number for a directory link
+func (f DirectoryFilter) Query(page int) string {
+	q := url.Values{}
+	if f.Location != "" {
+		q.Set("location", f.Location)
+	}
+	if f.MinRate > 0 {
+		q.Set("min_rate", strconv.FormatFloat(f.MinRate, 'f', -1, 64))
+	}
+	if f.MaxRate > 0 {
+		q.Set("max_rate", strconv.FormatFloat(f.MaxRate, 'f', -1, 64))
+	}
+	if len(f.Skills) > 0 {
+		q.Set("skills", strings.Join(f.Skills, ", "))
+	}
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page))
+	}
+	return q.Encode()
+}
+
+// matches reports whether a caregiver with these details passes the filter
+func (f DirectoryFilter) matches(c Caregiver, skills []string) bool {
+	if f.Location != "" && !strings.Contains(strings.ToLower(c.Location), strings.ToLower(f.Location)) {
+		return false
+	}
+	if f.MinRate > 0 || f.MaxRate > 0 {
+		if c.RateExpectations <= 0 {
+			return false
+		}
+		low := math.Floor(c.RateExpectations/rateBandWidth) * rateBandWidth
+		if f.MinRate > 0 && low+rateBandWidth < f.MinRate {
+			return false
+		}
+		if f.MaxRate > 0 && low > f.MaxRate {
+			return false
+		}
+	}
+	for _, want := range f.Skills {
+		found := false
+		for _, skill := range skills {
+			if strings.EqualFold(skill, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// publicSlugs maps the caregivers with a public page turned on to its
+// slug, leaving out those who are suspended
+func (app *App) publicSlugs() (map[string]string, error) {
+	restricted, err := app.restrictedAccounts()
+	if err != nil {
+		return nil, err
+	}
+	result, err := app.db.Query("SELECT email, slug FROM public_profiles WHERE enabled = true")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query public profiles: %v", err)
+	}
+	defer result.Close()
+
+	slugs := make(map[string]string)
+	err = result.Iterate(func(r *chai.Row) error {
+		var email, slug string
+		if err := r.Scan(&email, &slug); err != nil {
+			return fmt.Errorf("failed to scan public profile: %v", err)
+		}
+		if !restricted[email] {
+			slugs[email] = slug
+		}
+		return nil
+	})
+	return slugs, err
+}
+
+// Directory returns a page (from 1) of the caregivers that pass the
+// filter, by name
+func (app *App) Directory(f DirectoryFilter, page int) (*DirectoryPage, error) {
+	listed, err := app.listDirectory(f)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := (len(listed) + directoryPageSize - 1) / directoryPageSize
+	if page < 1 {
+		page = 1
+	}
+	start := (page - 1) * directoryPageSize
+	if start > len(listed) {
+		start = len(listed)
+	}
+	end := start + directoryPageSize
+	if end > len(listed) {
+		end = len(listed)
+	}
+	return &DirectoryPage{
+		Filter:     f,
+		Caregivers: listed[start:end],
+		Page:       page,
+		Pages:      pages,
+		Total:      len(listed),
+	}, nil
+}
+
+// listDirectory returns every caregiver that passes the filter, by name
+func (app *App) listDirectory(f DirectoryFilter) ([]PublicCaregiver, error) {
+	slugs, err := app.publicSlugs()
+	if err != nil {
+		return nil, err
+	}
+
+	listed := []PublicCaregiver{}
+	err = app.IterateCaregivers(func(c Caregiver) error {
+		slug, ok := slugs[c.Email]
+		if !ok {
+			return nil
+		}
+		p, err := app.PublicCaregiverFor(&c, slug)
+		if err != nil {
+			return err
+		}
+		if p.Available && f.matches(c, p.Skills) {
+			listed = append(listed, *p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		if listed[i].Name != listed[j].Name {
+			return listed[i].Name < listed[j].Name
+		}
+		return listed[i].Slug < listed[j].Slug
+	})
+	return listed, nil
+}
+
+const directoryTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.Title}} - {{(brand).Name}}</title>
+    <meta name="description" content="{{.Description}}">
+    <meta property="og:type" content="website">
+    <meta property="og:title" content="{{.Title}} - {{(brand).Name}}">
+    <meta property="og:description" content="{{.Description}}">
+    <meta property="og:url" content="{{.URL}}">
+    <meta property="og:site_name" content="{{(brand).Name}}">
+    <link rel="canonical" href="{{.URL}}">
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>{{.Title}}</h1>
+            <div class="app-description">{{.Total}} caregiver{{if ne .Total 1}}s{{end}} taking new families</div>
+        </div>
+        <form method="GET" action="directory" class="upload-form">
+            <input type="text" name="location" value="{{.Filter.Location}}" placeholder="Location">
+            <input type="number" name="min_rate" value="{{if .Filter.MinRate}}{{.Filter.MinRate}}{{end}}" min="0" step="1" placeholder="Min $/hour">
+            <input type="number" name="max_rate" value="{{if .Filter.MaxRate}}{{.Filter.MaxRate}}{{end}}" min="0" step="1" placeholder="Max $/hour">
+            <input type="text" name="skills" value="{{range $i, $s := .Filter.Skills}}{{if $i}}, {{end}}{{$s}}{{end}}" placeholder="Skills, comma separated">
+            <button type="submit">Search</button>
+        </form>
+        {{range .Caregivers}}
+        <div class="message system">
+            <strong><a href="c/{{.Slug}}">{{.Name}}</a></strong>{{if .Location}} · {{.Location}}{{end}}{{if .RateRange}} · {{.RateRange}}{{end}}{{if .DocVerified}} · <span class="verified">✓ Document verified</span>{{end}}{{if .Checked}} · <span class="verified">✓ Background checked</span>{{end}}
+            {{if .Experience}}<p>{{.Experience}}</p>{{end}}
+            {{if .Skills}}<p><small>{{range $i, $s := .Skills}}{{if $i}}, {{end}}{{$s}}{{end}}</small></p>{{end}}
+        </div>
+        {{else}}
+        <p>No caregivers match. Try fewer filters.</p>
+        {{end}}
+        {{if gt .Pages 1}}
+        <p>
+            {{with .PrevURL}}<a href="{{.}}">Previous</a>{{end}}
+            Page {{.Page}} of {{.Pages}}
+            {{with .NextURL}}<a href="{{.}}">Next</a>{{end}}
+        </p>
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// handleDirectory renders a page of the directory, filtered and paged by
+// the query string
+func handleDirectory(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	dir, err := chatRoom.Directory(parseDirectoryFilter(r), page)
+	if err != nil {
+		log.Printf("Error listing directory: %v", err)
+		http.Error(w, "Failed to list caregivers", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		*DirectoryPage
+		PrevURL string
+		NextURL string
+	}{DirectoryPage: dir}
+	if dir.Page > 1 {
+		data.PrevURL = "directory?" + dir.Filter.Query(dir.Page-1)
+	}
+	if dir.Page < dir.Pages {
+		data.NextURL = "directory?" + dir.Filter.Query(dir.Page+1)
+	}
+	renderTemplate(w, "directory", directoryTemplate, data)
+}
+
+// handleDirectoryAPI returns a page of the directory as JSON
+func handleDirectoryAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	dir, err := chatRoom.Directory(parseDirectoryFilter(r), page)
+	if err != nil {
+		log.Printf("Error listing directory: %v", err)
+		http.Error(w, "Failed to list caregivers", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, dir)
+}
@@ -0,0 +1,835 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/chaisql/chai"
+)
+
+// People who re-register under a second email lose their history. The
+// duplicates job flags pairs of accounts that look like one person, with
+// the same phone number or a near-identical name in the same place, and
+// queues them for an admin. Merging a pair moves everything stored about
+// the secondary account under the primary email.
+
+const duplicatesSchema = `
+	CREATE TABLE IF NOT EXISTS duplicate_candidates (
+		id TEXT PRIMARY KEY,
+		email_a TEXT,
+		email_b TEXT,
+		reason TEXT,
+		status TEXT,
+		detected_at TIMESTAMP,
+		reviewed_by TEXT,
+		reviewed_at TIMESTAMP,
+		primary_email TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_duplicate_candidates_status ON duplicate_candidates(status);
+	CREATE INDEX IF NOT EXISTS idx_duplicate_candidates_email_a ON duplicate_candidates(email_a)
+`
+
+// Duplicate candidate statuses
+const (
+	DuplicateOpen      = "open"
+	DuplicateMerged    = "merged"
+	DuplicateDismissed = "dismissed"
+)
+
+// AccountSummary is what the review queue shows of each account
+type AccountSummary struct {
+	Email     string    `json:"email"`
+	Roles     []string  `json:"roles"`
+	Name      string    `json:"name"`
+	Location  string    `json:"location"`
+	Phones    []string  `json:"phones,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DuplicateCandidate is a pair of accounts that may be one person.
+// EmailA sorts before EmailB.
+type DuplicateCandidate struct {
+	ID           string          `json:"id"`
+	EmailA       string          `json:"email_a"`
+	EmailB       string          `json:"email_b"`
+	Reason       string          `json:"reason"`
+	Status       string          `json:"status"`
+	DetectedAt   time.Time       `json:"detected_at"`
+	ReviewedBy   string          `json:"reviewed_by,omitempty"`
+	ReviewedAt   time.Time       `json:"reviewed_at,omitempty"`
+	PrimaryEmail string          `json:"primary_email,omitempty"`
+	A            *AccountSummary `json:"a,omitempty"` // Set when listing
+	B            *AccountSummary `json:"b,omitempty"`
+}
+
+// accountSummaries gathers every registered account's name, location and
+// phone numbers, keyed by email
+func (app *App) accountSummaries() (map[string]*AccountSummary, error) {
+	accounts := map[string]*AccountSummary{}
+	account := func(email string) *AccountSummary {
+		a := accounts[email]
+		if a == nil {
+			a = &AccountSummary{Email: email}
+			accounts[email] = a
+		}
+		return a
+	}
+	addPhone := func(a *AccountSummary, number string) {
+		if phone, err := normalizePhone(number); err == nil && !containsString(a.Phones, phone) {
+			a.Phones = append(a.Phones, phone)
+		}
+	}
+
+	for _, q := range []struct {
+		role, query string
+	}{
+		{"caregiver", "SELECT email, name, location, '', created_at FROM caregivers"},
+		{"patient", "SELECT email, name, location, phone_number, created_at FROM patients"},
+	} {
+		result, err := app.db.Query(q.query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query %ss: %v", q.role, err)
+		}
+		err = result.Iterate(func(r *chai.Row) error {
+			var email, name, location, phone string
+			var createdAt time.Time
+			if err := r.Scan(&email, &name, &location, &phone, &createdAt); err != nil {
+				return fmt.Errorf("failed to scan %s: %v", q.role, err)
+			}
+			a := account(email)
+			a.Roles = append(a.Roles, q.role)
+			if a.Name == "" {
+				a.Name, a.Location = name, location
+			}
+			if a.CreatedAt.IsZero() || createdAt.Before(a.CreatedAt) {
+				a.CreatedAt = createdAt
+			}
+			addPhone(a, phone)
+			return nil
+		})
+		result.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Numbers given for relaying or verified by text count too
+	for _, table := range []string{"user_phones", "phone_verifications"} {
+		result, err := app.db.Query("SELECT email, phone_number FROM " + table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query %s: %v", table, err)
+		}
+		err = result.Iterate(func(r *chai.Row) error {
+			var email, phone string
+			if err := r.Scan(&email, &phone); err != nil {
+				return fmt.Errorf("failed to scan %s: %v", table, err)
+			}
+			if a := accounts[email]; a != nil {
+				addPhone(a, phone)
+			}
+			return nil
+		})
+		result.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return accounts, nil
+}
+
+// normalizeName keeps a name's letters, lower-cased, with single spaces
+func normalizeName(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}), " ")
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// nearlySameName allows one typo in a short name and two in a long one
+func nearlySameName(a, b string) bool {
+	a, b = normalizeName(a), normalizeName(b)
+	if len(a) < 3 || len(b) < 3 {
+		return false
+	}
+	allowed := 1
+	if len(a) >= 10 {
+		allowed = 2
+	}
+	return editDistance(a, b) <= allowed
+}
+
+// DetectDuplicates queues every pair of accounts sharing a phone number or
+// with near-identical names in the same location, unless the pair has
+// been queued before. It returns how many pairs were added.
+func (app *App) DetectDuplicates() (int, error) {
+	accounts, err := app.accountSummaries()
+	if err != nil {
+		return 0, err
+	}
+	emails := make([]string, 0, len(accounts))
+	for email := range accounts {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	reasons := map[[2]string]string{}
+	for i, a := range emails {
+		for _, b := range emails[i+1:] {
+			x, y := accounts[a], accounts[b]
+			for _, phone := range x.Phones {
+				if containsString(y.Phones, phone) {
+					reasons[[2]string{a, b}] = "same phone number " + phone
+				}
+			}
+			if _, ok := reasons[[2]string{a, b}]; !ok && locationKey(x.Location) != "" &&
+				locationKey(x.Location) == locationKey(y.Location) && nearlySameName(x.Name, y.Name) {
+				reasons[[2]string{a, b}] = fmt.Sprintf("similar names (%s, %s) in %s", x.Name, y.Name, x.Location)
+			}
+		}
+	}
+
+	added := 0
+	for pair, reason := range reasons {
+		exists, err := rowExists(app.db, "SELECT id FROM duplicate_candidates WHERE email_a = ? AND email_b = ?", pair[0], pair[1])
+		if err != nil {
+			return added, err
+		}
+		if exists {
+			continue
+		}
+		err = app.db.Exec(`
+			INSERT INTO duplicate_candidates (`+duplicateColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT DO NOTHING
+		`, duplicateID(pair[0], pair[1]), pair[0], pair[1], reason, DuplicateOpen, time.Now(), "", time.Time{}, "")
+		if err != nil {
+			return added, fmt.Errorf("failed to store duplicate candidate: %v", err)
+		}
+		added++
+	}
+	if added > 0 {
+		log.Printf("Found %d possible duplicate accounts", added)
+	}
+	return added, nil
+}
+
+// duplicateID names a pair, so that registrations detected at once can't
+// queue it twice
+func duplicateID(a, b string) string {
+	sum := sha256.Sum256([]byte(a + "\n" + b))
+	return hex.EncodeToString(sum[:12])
+}
+
+// duplicatesJob looks for duplicate accounts
+func (app *App) duplicatesJob() error {
+	_, err := app.DetectDuplicates()
+	return err
+}
+
+// subscribeDuplicates checks for duplicates as soon as someone registers
+func (app *App) subscribeDuplicates() {
+	detect := func(e Event) {
+		if _, err := app.DetectDuplicates(); err != nil {
+			log.Printf("Error detecting duplicate accounts: %v", err)
+		}
+	}
+	app.events.Subscribe(EventCaregiverRegistered, detect)
+	app.events.Subscribe(EventPatientRegistered, detect)
+}
+
+const duplicateColumns = "id, email_a, email_b, reason, status, detected_at, reviewed_by, reviewed_at, primary_email"
+
+func (app *App) queryDuplicates(where string, args ...interface{}) ([]DuplicateCandidate, error) {
+	result, err := app.db.Query("SELECT "+duplicateColumns+" FROM duplicate_candidates "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query duplicate candidates: %v", err)
+	}
+	defer result.Close()
+
+	candidates := []DuplicateCandidate{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var d DuplicateCandidate
+		if err := r.Scan(&d.ID, &d.EmailA, &d.EmailB, &d.Reason, &d.Status, &d.DetectedAt, &d.ReviewedBy,
+			&d.ReviewedAt, &d.PrimaryEmail); err != nil {
+			return fmt.Errorf("failed to scan duplicate candidate: %v", err)
+		}
+		candidates = append(candidates, d)
+		return nil
+	})
+	return candidates, err
+}
+
+// DuplicateCandidates returns the candidates with a status, oldest first,
+// with a summary of each account that still exists
+func (app *App) DuplicateCandidates(status string) ([]DuplicateCandidate, error) {
+	candidates, err := app.queryDuplicates("WHERE status = ? ORDER BY detected_at", status)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := app.accountSummaries()
+	if err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		candidates[i].A, candidates[i].B = accounts[candidates[i].EmailA], accounts[candidates[i].EmailB]
+	}
+	return candidates, nil
+}
+
+// ReviewDuplicate dismisses an open candidate (action "dismiss"), or
+// merges it (action "merge") keeping primary, which must be one of the pair
+func (app *App) ReviewDuplicate(id, actor, action, primary string) error {
+	candidates, err := app.queryDuplicates("WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no such duplicate candidate")
+	}
+	d := candidates[0]
+	if d.Status != DuplicateOpen {
+		return fmt.Errorf("this pair has already been %s", d.Status)
+	}
+
+	status := DuplicateDismissed
+	switch action {
+	case "dismiss":
+		primary = ""
+	case "merge":
+		secondary := d.EmailB
+		if primary == d.EmailB {
+			secondary = d.EmailA
+		} else if primary != d.EmailA {
+			return fmt.Errorf("the primary account must be %s or %s", d.EmailA, d.EmailB)
+		}
+		if err := app.MergeAccounts(primary, secondary); err != nil {
+			return err
+		}
+		status = DuplicateMerged
+	default:
+		return fmt.Errorf("action must be merge or dismiss")
+	}
+
+	err = app.db.Exec(`
+		UPDATE duplicate_candidates SET status = ?, reviewed_by = ?, reviewed_at = ?, primary_email = ?
+		WHERE id = ?
+	`, status, actor, time.Now(), primary, id)
+	if err != nil {
+		return fmt.Errorf("failed to update duplicate candidate: %v", err)
+	}
+	return nil
+}
+
+// mergeCaregivers fills the blanks in the primary profile from the secondary
+func mergeCaregivers(primary, secondary *Caregiver) Caregiver {
+	c := *primary
+	for _, f := range []struct{ dst, src *string }{
+		{&c.Name, &secondary.Name}, {&c.Experience, &secondary.Experience}, {&c.Location, &secondary.Location},
+		{&c.Availability, &secondary.Availability}, {&c.Specializations, &secondary.Specializations},
+		{&c.Certifications, &secondary.Certifications},
+	} {
+		if *f.dst == "" {
+			*f.dst = *f.src
+		}
+	}
+	if c.RateExpectations == 0 {
+		c.RateExpectations = secondary.RateExpectations
+	}
+	if secondary.CreatedAt.Before(c.CreatedAt) {
+		c.CreatedAt = secondary.CreatedAt
+	}
+	return c
+}
+
+// mergePatients fills the blanks in the primary profile from the secondary
+func mergePatients(primary, secondary *Patient) Patient {
+	p := *primary
+	for _, f := range []struct{ dst, src *string }{
+		{&p.Name, &secondary.Name}, {&p.CareNeeds, &secondary.CareNeeds}, {&p.Location, &secondary.Location},
+		{&p.ScheduleRequirements, &secondary.ScheduleRequirements},
+		{&p.SpecialRequirements, &secondary.SpecialRequirements}, {&p.PhoneNumber, &secondary.PhoneNumber},
+	} {
+		if *f.dst == "" {
+			*f.dst = *f.src
+		}
+	}
+	if p.Budget == 0 {
+		p.Budget = secondary.Budget
+	}
+	if secondary.CreatedAt.Before(p.CreatedAt) {
+		p.CreatedAt = secondary.CreatedAt
+	}
+	return p
+}
+
+// matchProgress ranks match statuses by how far along they are
+func matchProgress(status string) int {
+	for i, s := range []string{MatchEnded, MatchProposed, MatchContacted, MatchAccepted, MatchActive} {
+		if s == status {
+			return i
+		}
+	}
+	return -1
+}
+
+// mergeAlsoMoves are the columns, besides those in userDataColumns, that
+// a merge moves: the ones naming the user to others, which erasure keeps.
+// The audit log and the columns naming staff stay as they were written.
+var mergeAlsoMoves = map[string][]string{
+	"chat_history":       {"recipient"},
+	"message_deliveries": {"recipient"},
+	"moderated_messages": {"recipient"},
+	"consents":           {"email"},
+	"waitlist":           {"matched_caregiver"},
+	"match_events":       {"actor"},
+	"rate_offers":        {"offered_by"},
+	"care_plans":         {"edited_by"},
+}
+
+// mergeSkips are the tables a merge leaves alone: the review queue keeps
+// the accounts as they were detected
+var mergeSkips = map[string]bool{"duplicate_candidates": true}
+
+var primaryKeyPattern = regexp.MustCompile(`PRIMARY KEY \(([^)]*)\)`)
+
+// primaryKeys returns the columns of each table's primary key
+func primaryKeys(db *instrumentedDB) (map[string][]string, error) {
+	tables, err := db.catalog("table")
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]string)
+	for _, t := range tables {
+		if m := primaryKeyPattern.FindStringSubmatch(t.SQL); m != nil {
+			for _, column := range strings.Split(m[1], ",") {
+				keys[t.Name] = append(keys[t.Name], strings.TrimSpace(column))
+			}
+		}
+	}
+	return keys, nil
+}
+
+// moveRows puts primary in place of secondary in the given columns of a
+// table. Rows between the two accounts are dropped, and a row whose key
+// would then clash with one of primary's gives way to it.
+func moveRows(tx *chai.Tx, table string, columns, key []string, primary, secondary string) error {
+	for _, column := range columns {
+		for _, other := range columns {
+			if other == column {
+				continue
+			}
+			err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ? AND %s = ?", table, column, other), secondary, primary)
+			if err != nil {
+				return fmt.Errorf("failed to merge %s: %v", table, err)
+			}
+		}
+	}
+
+	for _, column := range columns {
+		if containsString(key, column) {
+			result, err := tx.Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", strings.Join(key, ", "), table, column), secondary)
+			if err != nil {
+				return fmt.Errorf("failed to query %s: %v", table, err)
+			}
+			var rows []map[string]interface{}
+			err = result.Iterate(func(r *chai.Row) error {
+				row := make(map[string]interface{})
+				if err := r.MapScan(row); err != nil {
+					return fmt.Errorf("failed to scan %s: %v", table, err)
+				}
+				rows = append(rows, row)
+				return nil
+			})
+			result.Close()
+			if err != nil {
+				return err
+			}
+
+			var where []string
+			for _, k := range key {
+				where = append(where, k+" = ?")
+			}
+			for _, row := range rows {
+				var at, clash []interface{}
+				for _, k := range key {
+					at = append(at, row[k])
+					if k == column {
+						clash = append(clash, primary)
+					} else {
+						clash = append(clash, row[k])
+					}
+				}
+				taken, err := rowExists(tx, fmt.Sprintf("SELECT %s FROM %s WHERE %s", column, table, strings.Join(where, " AND ")), clash...)
+				if err != nil {
+					return err
+				}
+				if !taken {
+					continue
+				}
+				if err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", table, strings.Join(where, " AND ")), at...); err != nil {
+					return fmt.Errorf("failed to merge %s: %v", table, err)
+				}
+			}
+		}
+		err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", table, column, column), primary, secondary)
+		if err != nil {
+			return fmt.Errorf("failed to move %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// MergeAccounts moves everything stored about secondary under primary, in
+// one transaction. A profile both accounts have keeps primary's answers,
+// with blanks filled from secondary's. A match both accounts have with the
+// same person keeps the one further along, and a match between the two
+// accounts is dropped, as is anything else between them. Where both
+// accounts have the one row a user can have, such as their preferences,
+// primary's is kept. Accounts under a legal hold can't be merged.
+func (app *App) MergeAccounts(primary, secondary string) error {
+	if primary == "" || primary == secondary {
+		return fmt.Errorf("pick two different accounts to merge")
+	}
+	keys, err := primaryKeys(app.db)
+	if err != nil {
+		return err
+	}
+
+	var moved, dropped int
+	err = app.withTx(func(tx *chai.Tx) error {
+		for _, email := range []string{primary, secondary} {
+			held, err := rowExists(tx, "SELECT email FROM legal_holds WHERE email = ?", email)
+			if err != nil {
+				return err
+			}
+			if held {
+				return fmt.Errorf("%s is under a legal hold", email)
+			}
+		}
+		primaryCaregiver, err := getCaregiver(tx, primary)
+		if err != nil {
+			return err
+		}
+		secondaryCaregiver, err := getCaregiver(tx, secondary)
+		if err != nil {
+			return err
+		}
+		primaryPatient, err := getPatient(tx, primary)
+		if err != nil {
+			return err
+		}
+		secondaryPatient, err := getPatient(tx, secondary)
+		if err != nil {
+			return err
+		}
+		if secondaryCaregiver == nil && secondaryPatient == nil {
+			return fmt.Errorf("%s has no profile to merge", secondary)
+		}
+
+		if secondaryCaregiver != nil {
+			c := *secondaryCaregiver
+			if primaryCaregiver != nil {
+				c = mergeCaregivers(primaryCaregiver, secondaryCaregiver)
+				if err := tx.Exec("DELETE FROM caregivers WHERE email = ?", primary); err != nil {
+					return fmt.Errorf("failed to merge caregiver profile: %v", err)
+				}
+			}
+			if err := tx.Exec("DELETE FROM caregivers WHERE email = ?", secondary); err != nil {
+				return fmt.Errorf("failed to merge caregiver profile: %v", err)
+			}
+			err := tx.Exec(`
+				INSERT INTO caregivers (
+					email, name, experience, location, availability,
+					specializations, rate_expectations, certifications, created_at
+				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`, primary, c.Name, c.Experience, c.Location, c.Availability,
+				c.Specializations, c.RateExpectations, c.Certifications, c.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("failed to merge caregiver profile: %v", err)
+			}
+			if err := storeProfileLocation(tx, primary, "caregiver", c.Location, c.RateExpectations); err != nil {
+				return err
+			}
+		}
+		if secondaryPatient != nil {
+			p := *secondaryPatient
+			if primaryPatient != nil {
+				p = mergePatients(primaryPatient, secondaryPatient)
+				if err := tx.Exec("DELETE FROM patients WHERE email = ?", primary); err != nil {
+					return fmt.Errorf("failed to merge patient profile: %v", err)
+				}
+			}
+			if err := tx.Exec("DELETE FROM patients WHERE email = ?", secondary); err != nil {
+				return fmt.Errorf("failed to merge patient profile: %v", err)
+			}
+			err := tx.Exec(`
+				INSERT INTO patients (
+					email, name, care_needs, location, schedule_requirements,
+					budget, special_requirements, phone_number, created_at
+				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`, primary, p.Name, p.CareNeeds, p.Location, p.ScheduleRequirements,
+				p.Budget, p.SpecialRequirements, p.PhoneNumber, p.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("failed to merge patient profile: %v", err)
+			}
+			if err := storeProfileLocation(tx, primary, "patient", p.Location, p.Budget); err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("DELETE FROM profile_locations WHERE email = ?", secondary); err != nil {
+			return fmt.Errorf("failed to merge profile location: %v", err)
+		}
+
+		// Of two matches with the same person, the one further along is
+		// kept; moveRows would keep primary's
+		for _, column := range []string{"caregiver_email", "patient_email"} {
+			result, err := tx.Query("SELECT caregiver_email, patient_email FROM matches WHERE "+column+" = ?", secondary)
+			if err != nil {
+				return fmt.Errorf("failed to query matches: %v", err)
+			}
+			var pairs [][2]string
+			err = result.Iterate(func(r *chai.Row) error {
+				var pair [2]string
+				if err := r.Scan(&pair[0], &pair[1]); err != nil {
+					return fmt.Errorf("failed to scan match: %v", err)
+				}
+				pairs = append(pairs, pair)
+				return nil
+			})
+			result.Close()
+			if err != nil {
+				return err
+			}
+			for _, pair := range pairs {
+				target := pair
+				if column == "caregiver_email" {
+					target[0] = primary
+				} else {
+					target[1] = primary
+				}
+				drop := &Match{CaregiverEmail: pair[0], PatientEmail: pair[1]}
+				if target[0] != target[1] {
+					existing, err := getMatch(tx, target[0], target[1])
+					if err != nil {
+						return err
+					}
+					if existing == nil {
+						moved++
+						continue
+					}
+					incoming, err := getMatch(tx, pair[0], pair[1])
+					if err != nil {
+						return err
+					}
+					if matchProgress(incoming.Status) > matchProgress(existing.Status) {
+						drop = existing
+						moved++
+					}
+				}
+				dropped++
+				err = tx.Exec("DELETE FROM matches WHERE caregiver_email = ? AND patient_email = ?", drop.CaregiverEmail, drop.PatientEmail)
+				if err != nil {
+					return fmt.Errorf("failed to merge matches: %v", err)
+				}
+			}
+		}
+
+		for table, columns := range userDataColumns {
+			if mergeSkips[table] {
+				continue
+			}
+			columns = append(append([]string{}, columns...), mergeAlsoMoves[table]...)
+			if err := moveRows(tx, table, columns, keys[table], primary, secondary); err != nil {
+				return err
+			}
+		}
+		for table, columns := range mergeAlsoMoves {
+			if _, done := userDataColumns[table]; done {
+				continue
+			}
+			if err := moveRows(tx, table, columns, keys[table], primary, secondary); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := app.presence.Forget(secondary); err != nil {
+		log.Printf("Error deleting presence for %s: %v", secondary, err)
+	}
+	log.Printf("Merged %s into %s: %d matches moved, %d dropped", secondary, primary, moved, dropped)
+	app.onProfileWrite(primary)
+	app.InvalidateSession(primary)
+	app.InvalidateSession(secondary)
+	app.invalidateToolCaches()
+	app.refreshCalendars(primary, secondary)
+	return nil
+}
+
+const adminDuplicatesTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Duplicate accounts</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Duplicate accounts</h1>
+            <div class="app-description">Accounts that may belong to the same person</div>
+        </div>
+        {{range .Candidates}}
+        <div class="calendar-event">
+            <strong>{{.EmailA}}</strong> and <strong>{{.EmailB}}</strong>: {{.Reason}} · found {{.DetectedAt.Format "Jan 2 3:04 PM"}}
+            {{template "account" .A}}
+            {{template "account" .B}}
+            <form class="schedule-form" method="POST" action="duplicates">
+                <input type="hidden" name="email" value="{{$.UserEmail}}">
+                <input type="hidden" name="id" value="{{.ID}}">
+                <input type="hidden" name="action" value="merge">
+                <button type="submit" name="primary" value="{{.EmailA}}">Merge into {{.EmailA}}</button>
+                <button type="submit" name="primary" value="{{.EmailB}}">Merge into {{.EmailB}}</button>
+            </form>
+            <form class="schedule-form" method="POST" action="duplicates">
+                <input type="hidden" name="email" value="{{$.UserEmail}}">
+                <input type="hidden" name="id" value="{{.ID}}">
+                <button type="submit" name="action" value="dismiss">Not the same person</button>
+            </form>
+        </div>
+        {{else}}
+        <p>No possible duplicates are waiting for review.</p>
+        {{end}}
+        <form class="schedule-form" method="POST" action="duplicates">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <button type="submit" name="action" value="detect">Look for duplicates now</button>
+        </form>
+    </div>
+</body>
+</html>
+{{define "account"}}{{with .}}
+<p>{{.Email}}: {{.Name}}, {{.Location}} · {{range $i, $r := .Roles}}{{if $i}} and {{end}}{{$r}}{{end}}
+    · registered {{.CreatedAt.Format "Jan 2 2006"}}{{range .Phones}} · {{.}}{{end}}</p>
+{{end}}{{end}}
+`
+
+// applyDuplicateAction reviews a duplicate candidate for an admin and
+// audits it
+func applyDuplicateAction(r *http.Request, actor, id, action, primary string) error {
+	if err := chatRoom.ReviewDuplicate(id, actor, action, primary); err != nil {
+		return err
+	}
+	chatRoom.Audit(r, actor, "duplicate."+action, id, primary)
+	return nil
+}
+
+// handleAdminDuplicates shows the open duplicate candidates and takes
+// review actions: merge (with primary), dismiss, or detect to look again
+func handleAdminDuplicates(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	if r.Method == "POST" {
+		var err error
+		if r.FormValue("action") == "detect" {
+			_, err = chatRoom.DetectDuplicates()
+		} else {
+			err = applyDuplicateAction(r, admin, r.FormValue("id"), r.FormValue("action"), r.FormValue("primary"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "duplicates?email="+url.QueryEscape(admin), http.StatusSeeOther)
+		return
+	}
+
+	candidates, err := chatRoom.DuplicateCandidates(DuplicateOpen)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "duplicates", adminDuplicatesTemplate, struct {
+		UserEmail  string
+		Candidates []DuplicateCandidate
+	}{admin, candidates})
+}
+
+// handleAdminDuplicatesAPI lists duplicate candidates (GET, open ones
+// unless status is given) and reviews one from a JSON body {"id",
+// "action": "merge"|"dismiss", "primary"} (POST)
+func handleAdminDuplicatesAPI(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		status := r.FormValue("status")
+		if status == "" {
+			status = DuplicateOpen
+		}
+		candidates, err := chatRoom.DuplicateCandidates(status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, candidates)
+
+	case "POST":
+		var req struct {
+			ID      string `json:"id"`
+			Action  string `json:"action"`
+			Primary string `json:"primary"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := applyDuplicateAction(r, actor, req.ID, req.Action, req.Primary); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chaisql/chai"
+)
+
+// mergeKeeps are the columns that may still name a merged account
+var mergeKeeps = map[string]string{
+	"audit_log.actor":                    "the audit log is kept",
+	"audit_log.subject":                  "the audit log is kept",
+	"duplicate_candidates.email_a":       "the review queue keeps the accounts as detected",
+	"duplicate_candidates.email_b":       "the review queue keeps the accounts as detected",
+	"duplicate_candidates.primary_email": "the review queue keeps the accounts as detected",
+	"duplicate_candidates.reviewed_by":   "the review queue keeps the accounts as detected",
+	"admin_notes.created_by":             "staff acting on someone else's record",
+	"background_checks.requested_by":     "staff acting on someone else's record",
+	"broadcasts.created_by":              "staff acting on someone else's record",
+	"handoffs.agent":                     "staff acting on someone else's record",
+	"legal_documents.created_by":         "staff acting on someone else's record",
+	"legal_holds.created_by":             "staff acting on someone else's record",
+	"moderated_messages.reviewed_by":     "staff acting on someone else's record",
+	"prompts.created_by":                 "staff acting on someone else's record",
+	"reports.reviewed_by":                "staff acting on someone else's record",
+	"safety_escalations.resolved_by":     "staff acting on someone else's record",
+	"signup_flags.reviewed_by":           "staff acting on someone else's record",
+	"suspensions.suspended_by":           "staff acting on someone else's record",
+	"tool_policy.updated_by":             "staff acting on someone else's record",
+	"user_tags.created_by":               "staff acting on someone else's record",
+}
+
+// mergeRebuilds are rebuilt from the merged profile once a merge is done,
+// so needn't hold what was moved
+var mergeRebuilds = map[string]bool{"profile_care_types.email": true, "profile_embeddings.email": true}
+
+func TestMergeAccountsMovesEverything(t *testing.T) {
+	app := newTestApp(t)
+	const primary, secondary = "primary@example.com", "secondary@example.com"
+	tables := seedUser(t, app, secondary)
+	before := findUser(t, app, tables, secondary)
+
+	// Both accounts have preferences, and a match with each other
+	seedRow(t, app, "user_preferences", tables["user_preferences"], map[string]interface{}{"email": primary})
+	seedRow(t, app, "matches", tables["matches"], map[string]interface{}{"caregiver_email": primary, "patient_email": secondary})
+	preferences := func() []map[string]interface{} {
+		result, err := app.db.Query("SELECT * FROM user_preferences WHERE email = ?", primary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer result.Close()
+		var rows []map[string]interface{}
+		err = result.Iterate(func(r *chai.Row) error {
+			row := map[string]interface{}{}
+			rows = append(rows, row)
+			return r.MapScan(row)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rows
+	}
+	kept := preferences()
+
+	if err := app.MergeAccounts(primary, secondary); err != nil {
+		t.Fatal(err)
+	}
+	app.profileWork.Wait()
+
+	for _, column := range findUser(t, app, tables, secondary) {
+		if _, kept := mergeKeeps[column]; !kept {
+			t.Errorf("%s still names the merged account", column)
+		}
+	}
+	merged := map[string]bool{}
+	for _, column := range findUser(t, app, tables, primary) {
+		merged[column] = true
+	}
+	for _, column := range before {
+		// Presence is forgotten rather than moved
+		_, kept := mergeKeeps[column]
+		if kept || mergeRebuilds[column] || strings.HasPrefix(column, "presence.") {
+			continue
+		}
+		if !merged[column] {
+			t.Errorf("%s wasn't moved to the primary account", column)
+		}
+	}
+
+	if rows := preferences(); len(rows) != 1 || rows[0]["languages"] != kept[0]["languages"] {
+		t.Errorf("got preferences %v, want the primary account's %v", rows, kept)
+	}
+	if m, err := app.GetMatch(primary, secondary); err != nil || m != nil {
+		t.Errorf("the match between the accounts: got %v, %v; want it dropped", m, err)
+	}
+}
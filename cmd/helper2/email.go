@@ -0,0 +1,933 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Email send statuses
+const (
+	EmailSent       = "sent"
+	EmailFailed     = "failed"
+	EmailBounced    = "bounced"
+	EmailComplained = "complained"
+)
+
+const emailSendsSchema = `
+	CREATE TABLE IF NOT EXISTS email_sends (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		kind TEXT,
+		subject TEXT,
+		provider TEXT,
+		provider_id TEXT,
+		status TEXT,
+		error TEXT,
+		created_at TIMESTAMP,
+		updated_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_email_sends_email ON email_sends(email);
+	CREATE INDEX IF NOT EXISTS idx_email_sends_provider_id ON email_sends(provider_id)
+`
+
+// emailTemplate is one kind of transactional email. Subject and Text are
+// text templates; HTML is an html template rendered inside emailLayout.
+// Every template sees the notification's data plus Brand, Email,
+// SettingsURL and UnsubscribeURL.
+type emailTemplate struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// emailTemplates are keyed by notification kind
+var emailTemplates = map[string]emailTemplate{
+	NotifyWelcome: {
+		Subject: `Welcome to {{.Brand.Name}}`,
+		Text: `Hi {{.Name}},
+
+Thanks for registering with {{.Brand.Name}} as a {{.Role}}. We'll let you know as soon as we find good matches for you.
+
+Open the app any time to chat with the assistant: {{.AppURL}}
+`,
+		HTML: `<p>Hi {{.Name}},</p>
+<p>Thanks for registering with {{.Brand.Name}} as a {{.Role}}. We'll let you know as soon as we find good matches for you.</p>
+<p><a class="button" href="{{.AppURL}}">Open {{.Brand.Name}}</a></p>`,
+	},
+	NotifyNewMatch: {
+		Subject: `New match on {{.Brand.Name}}: {{(index .Matches 0).Name}}`,
+		Text: `We found a new match for you: {{(index .Matches 0).Name}}
+
+Open the app to see why they fit and to get in touch: {{.AppURL}}
+`,
+		HTML: `<p>We found a new match for you: <strong>{{(index .Matches 0).Name}}</strong></p>
+<p><a class="button" href="{{.AppURL}}">See why they fit</a></p>`,
+	},
+	NotifyMatchDigest: {
+		Subject: `{{len .Matches}} new {{if eq (len .Matches) 1}}match{{else}}matches{{end}} on {{.Brand.Name}}`,
+		Text: `We found {{len .Matches}} new {{if eq (len .Matches) 1}}match{{else}}matches{{end}} for you:
+
+{{range .Matches}}- {{.Name}}
+{{end}}
+Open the app to see why they fit and to get in touch: {{.AppURL}}
+`,
+		HTML: `<p>We found {{len .Matches}} new {{if eq (len .Matches) 1}}match{{else}}matches{{end}} for you:</p>
+<ul>{{range .Matches}}<li>{{.Name}}</li>{{end}}</ul>
+<p><a class="button" href="{{.AppURL}}">See why they fit</a></p>`,
+	},
+	NotifyMessageReceived: {
+		Subject: `New message from {{.From}}`,
+		Text: `{{.From}} sent you a message on {{.Brand.Name}}:
+
+{{.Preview}}
+
+Reply in the app: {{.AppURL}}
+`,
+		HTML: `<p>{{.From}} sent you a message on {{.Brand.Name}}:</p>
+<blockquote>{{.Preview}}</blockquote>
+<p><a class="button" href="{{.AppURL}}">Reply</a></p>`,
+	},
+	NotifyBookingConfirmed: {
+		Subject: `Booking confirmed: {{.Start.Format "Mon Jan 2, 3:04 PM"}}`,
+		Text: `Your care visit with {{.With}} is booked for {{.Start.Format "Monday, January 2"}} from {{.Start.Format "3:04 PM"}} to {{.End.Format "3:04 PM"}}.
+
+See your schedule in the app: {{.AppURL}}
+`,
+		HTML: `<p>Your care visit with <strong>{{.With}}</strong> is booked for {{.Start.Format "Monday, January 2"}}
+from {{.Start.Format "3:04 PM"}} to {{.End.Format "3:04 PM"}}.</p>
+<p><a class="button" href="{{.AppURL}}">See your schedule</a></p>`,
+	},
+	NotifySignIn: {
+		Subject: `Sign in to {{.Brand.Name}}`,
+		Text: `Follow this link to sign in to {{.Brand.Name}}. It works once, for {{.Minutes}} minutes:
+
+{{.SignInURL}}
+
+If you didn't ask to sign in, you can ignore this email.
+`,
+		HTML: `<p>Follow this link to sign in to {{.Brand.Name}}. It works once, for {{.Minutes}} minutes.</p>
+<p><a class="button" href="{{.SignInURL}}">Sign in</a></p>
+<p>If you didn't ask to sign in, you can ignore this email.</p>`,
+	},
+	NotifyUrgentRequest: {
+		Subject: `Urgent: {{.Name}} needs care in {{.Location}}`,
+		Text: `{{.Name}} in {{.Location}} needs care urgently and is within your rate:
+
+{{.CareNeeds}}
+
+Open the app to see if you're a fit and get in touch: {{.AppURL}}
+`,
+		HTML: `<p><strong>{{.Name}}</strong> in {{.Location}} needs care urgently and is within your rate:</p>
+<blockquote>{{.CareNeeds}}</blockquote>
+<p><a class="button" href="{{.AppURL}}">See if you're a fit</a></p>`,
+	},
+	NotifyAnnouncement: {
+		Subject: `{{.Subject}}`,
+		Text: `{{.Body}}
+
+Open the app: {{.AppURL}}
+`,
+		HTML: `<p><strong>{{.Subject}}</strong></p>
+<p>{{.Body}}</p>
+<p><a class="button" href="{{.AppURL}}">Open {{.Brand.Name}}</a></p>`,
+	},
+	NotifyCertExpiring: {
+		Subject: `Your {{.Type}} certification expires {{.ExpiresOn.Format "January 2"}}`,
+		Text: `Your {{.Type}} certification{{if .Issuer}} from {{.Issuer}}{{end}} expires on {{.ExpiresOn.Format "Monday, January 2, 2006"}}.
+
+Once you've renewed it, upload the new certificate in the app so families can see you're certified: {{.AppURL}}
+`,
+		HTML: `<p>Your {{.Type}} certification{{if .Issuer}} from {{.Issuer}}{{end}} expires on <strong>{{.ExpiresOn.Format "Monday, January 2, 2006"}}</strong>.</p>
+<p>Once you've renewed it, upload the new certificate so families can see you're certified.</p>
+<p><a class="button" href="{{.AppURL}}">Upload your certificate</a></p>`,
+	},
+	NotifyTimesheet: {
+		Subject: `Your timesheet with {{.With}} for the week of {{.WeekStart.Format "January 2"}}`,
+		Text: `Here's the week of {{.WeekStart.Format "Monday, January 2"}} with {{.With}}: {{.Shifts}} shift{{if ne .Shifts 1}}s{{end}}.
+
+Confirmed: {{.Confirmed}}, {{.Amount}} at {{.Rate}}/hour
+Waiting to be confirmed: {{.Pending}}
+Disputed: {{.Disputed}}
+
+You can see every shift on your match page in the app: {{.AppURL}}
+`,
+		HTML: `<p>Here's the week of {{.WeekStart.Format "Monday, January 2"}} with {{.With}}: {{.Shifts}} shift{{if ne .Shifts 1}}s{{end}}.</p>
+<ul>
+<li>Confirmed: <strong>{{.Confirmed}}</strong>, {{.Amount}} at {{.Rate}}/hour</li>
+<li>Waiting to be confirmed: {{.Pending}}</li>
+<li>Disputed: {{.Disputed}}</li>
+</ul>
+<p><a class="button" href="{{.AppURL}}">See your shifts</a></p>`,
+	},
+	NotifyInvoice: {
+		Subject: `Invoice {{.Number}} for care in {{.Month.Format "January"}}: {{.Amount}}`,
+		Text: `Here's your invoice for care from {{.Caregiver}} in {{.Month.Format "January 2006"}}.
+
+Invoice: {{.Number}}
+Hours: {{.Hours}}
+Amount due: {{.Amount}}
+
+See the shifts it covers, or download it as a PDF: {{.InvoiceURL}}
+`,
+		HTML: `<p>Here's your invoice for care from {{.Caregiver}} in {{.Month.Format "January 2006"}}.</p>
+<ul>
+<li>Invoice: {{.Number}}</li>
+<li>Hours: {{.Hours}}</li>
+<li>Amount due: <strong>{{.Amount}}</strong></li>
+</ul>
+<p><a class="button" href="{{.InvoiceURL}}">View your invoice</a></p>`,
+	},
+	NotifyBookingReminder: {
+		Subject: `Reminder: care with {{.With}} in {{.In}}`,
+		Text: `Your care visit with {{.With}} is {{.Start.Format "Monday, January 2"}} from {{.Start.Format "3:04 PM"}} to {{.End.Format "3:04 PM"}}.
+
+Got it, or remind me again in {{.Snooze}}: {{.ReminderURL}}
+`,
+		HTML: `<p>Your care visit with {{.With}} is {{.Start.Format "Monday, January 2"}} from <strong>{{.Start.Format "3:04 PM"}}</strong> to {{.End.Format "3:04 PM"}}.</p>
+<p><a class="button" href="{{.ReminderURL}}">Got it, or snooze</a></p>`,
+	},
+	NotifyWaitlistMatch: {
+		Subject: `A caregiver who fits what you're looking for just joined`,
+		Text: `Good news: after {{.Waited}} on our waitlist, a caregiver who fits your search has joined {{.Brand.Name}}.
+
+{{.Caregiver}}, {{.Location}}, {{.Rate}}/hour
+
+See them with your other matches in the app: {{.AppURL}}
+`,
+		HTML: `<p>Good news: after {{.Waited}} on our waitlist, a caregiver who fits your search has joined {{.Brand.Name}}.</p>
+<p><strong>{{.Caregiver}}</strong>, {{.Location}}, {{.Rate}}/hour</p>
+<p><a class="button" href="{{.AppURL}}">See your matches</a></p>`,
+	},
+	NotifyFavoriteChanged: {
+		Subject: `{{.Caregiver}}, on your shortlist, has made changes`,
+		Text: `{{.Caregiver}}, who you shortlisted, has changed:
+{{range .Changes}}
+- {{.}}{{end}}
+
+See your shortlist: {{.ShortlistURL}}
+`,
+		HTML: `<p>{{.Caregiver}}, who you shortlisted, has changed:</p>
+<ul>{{range .Changes}}<li>{{.}}</li>{{end}}</ul>
+<p><a class="button" href="{{.ShortlistURL}}">See your shortlist</a></p>`,
+	},
+}
+
+// emailLayout wraps every HTML email
+const emailLayout = `<!DOCTYPE html>
+<html>
+<head>
+<style>
+    body { font-family: Arial, sans-serif; color: #333; }
+    .content { max-width: 560px; margin: 0 auto; padding: 20px; }
+    .brand { color: {{.Brand.PrimaryColor}}; font-size: 1.4em; font-weight: bold; }
+    .button { display: inline-block; padding: 10px 18px; border-radius: 4px; color: #fff;
+              background-color: {{.Brand.PrimaryColor}}; text-decoration: none; }
+    .footer { color: #888; font-size: 0.8em; margin-top: 30px; }
+</style>
+</head>
+<body>
+<div class="content">
+    <div class="brand">{{.Brand.Name}}</div>
+    {{template "body" .}}
+    <div class="footer">
+        <a href="{{.SettingsURL}}">Change how {{.Brand.Name}} contacts you</a> ·
+        <a href="{{.UnsubscribeURL}}">Unsubscribe from these emails</a>
+    </div>
+</div>
+</body>
+</html>`
+
+const emailTextFooter = `
+--
+Change how {{.Brand.Name}} contacts you: {{.SettingsURL}}
+Unsubscribe from these emails: {{.UnsubscribeURL}}
+`
+
+// emailData merges a notification's data with the fields every template
+// can use
+func (app *App) emailData(n Notification) (map[string]interface{}, error) {
+	unsubscribe, err := app.unsubscribeLink(n.Email, "email")
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{
+		"Brand":          config.Branding,
+		"Email":          n.Email,
+		"AppURL":         fmt.Sprintf("%s/?email=%s", config.Email.BaseURL, url.QueryEscape(n.Email)),
+		"SettingsURL":    fmt.Sprintf("%s/settings/notifications?email=%s", config.Email.BaseURL, url.QueryEscape(n.Email)),
+		"UnsubscribeURL": unsubscribe,
+	}
+	for k, v := range n.Data {
+		data[k] = v
+	}
+	return data, nil
+}
+
+// renderEmail renders the subject and bodies for a notification
+func renderEmail(kind string, data map[string]interface{}) (subject, text, html string, err error) {
+	tmpl, ok := emailTemplates[kind]
+	if !ok {
+		return "", "", "", fmt.Errorf("no email template for %q", kind)
+	}
+
+	var sb bytes.Buffer
+	render := func(name, src string) (string, error) {
+		sb.Reset()
+		t, err := texttemplate.New(name).Parse(src)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse email template %s: %v", name, err)
+		}
+		if err := t.Execute(&sb, data); err != nil {
+			return "", fmt.Errorf("failed to render email template %s: %v", name, err)
+		}
+		return sb.String(), nil
+	}
+	if subject, err = render(kind+" subject", tmpl.Subject); err != nil {
+		return "", "", "", err
+	}
+	if text, err = render(kind+" text", tmpl.Text+emailTextFooter); err != nil {
+		return "", "", "", err
+	}
+
+	sb.Reset()
+	t, err := htmltemplate.New("layout").Parse(emailLayout)
+	if err == nil {
+		_, err = t.New("body").Parse(tmpl.HTML)
+	}
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to parse email template %s: %v", kind, err)
+	}
+	if err := t.Execute(&sb, data); err != nil {
+		return "", "", "", fmt.Errorf("failed to render email template %s: %v", kind, err)
+	}
+	return strings.TrimSpace(subject), text, sb.String(), nil
+}
+
+// outgoingEmail is one rendered email. Unsubscribe, if set, is the one-click
+// unsubscribe link sent in the List-Unsubscribe header.
+type outgoingEmail struct {
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Unsubscribe string
+	SendID      string // Our send record, passed to providers that echo it in webhooks
+	ReplyTo     string // Where replies go, if they're taken
+}
+
+// mailer is an email provider. Send returns the provider's message ID,
+// which bounce and complaint webhooks refer back to.
+type mailer interface {
+	Name() string
+	Send(e outgoingEmail) (string, error)
+}
+
+func newMailer(cfg EmailConfig) mailer {
+	switch cfg.Provider {
+	case "sendgrid":
+		return &sendgridMailer{
+			apiKey: os.Getenv("SENDGRID_API_KEY"),
+			from:   cfg.From,
+			client: &http.Client{Timeout: 30 * time.Second},
+		}
+	case "ses":
+		return &sesMailer{
+			region:    cfg.SES.Region,
+			accessKey: os.Getenv("SES_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("SES_SECRET_ACCESS_KEY"),
+			from:      cfg.From,
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}
+	}
+	if cfg.SMTPAddr == "" {
+		return logMailer{}
+	}
+	return &smtpMailer{addr: cfg.SMTPAddr, from: cfg.From}
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// smtpMailer sends through an SMTP relay. The username and password come
+// from SMTP_USERNAME and SMTP_PASSWORD. Bounces come back by mail, so SMTP
+// sends are never marked bounced.
+type smtpMailer struct {
+	addr string // host:port
+	from string
+}
+
+func (m *smtpMailer) Name() string { return "smtp" }
+
+func (m *smtpMailer) Send(e outgoingEmail) (string, error) {
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host := m.addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	id := newMessageID()
+	domain := "localhost"
+	if i := strings.LastIndex(m.from, "@"); i >= 0 {
+		domain = m.from[i+1:]
+	}
+	messageID := fmt.Sprintf("<%s@%s>", id, domain)
+	boundary := "alt-" + id
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMessage-ID: %s\r\nMIME-Version: 1.0\r\n",
+		m.from, e.To, e.Subject, messageID)
+	if e.Unsubscribe != "" {
+		fmt.Fprintf(&msg, "List-Unsubscribe: <%s>\r\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n", e.Unsubscribe)
+	}
+	if e.ReplyTo != "" {
+		fmt.Fprintf(&msg, "Reply-To: %s\r\n", e.ReplyTo)
+	}
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, strings.ReplaceAll(e.Text, "\n", "\r\n"))
+	fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n%s\r\n", boundary, strings.ReplaceAll(e.HTML, "\n", "\r\n"))
+	fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+
+	if err := smtp.SendMail(m.addr, auth, m.from, []string{e.To}, []byte(msg.String())); err != nil {
+		return "", fmt.Errorf("failed to send email: %v", err)
+	}
+	return messageID, nil
+}
+
+// sendgridMailer sends through the SendGrid v3 API with the key in
+// SENDGRID_API_KEY
+type sendgridMailer struct {
+	apiKey string
+	from   string
+	client *http.Client
+}
+
+func (m *sendgridMailer) Name() string { return "sendgrid" }
+
+func (m *sendgridMailer) Send(e outgoingEmail) (string, error) {
+	payload := map[string]interface{}{
+		"personalizations": []map[string]interface{}{{
+			"to": []map[string]string{{"email": e.To}},
+		}},
+		"from":    map[string]string{"email": m.from},
+		"subject": e.Subject,
+		"content": []map[string]string{
+			{"type": "text/plain", "value": e.Text},
+			{"type": "text/html", "value": e.HTML},
+		},
+		// Echoed back on every webhook event for this message
+		"custom_args": map[string]string{"send_id": e.SendID},
+	}
+	if e.ReplyTo != "" {
+		payload["reply_to"] = map[string]string{"email": e.ReplyTo}
+	}
+	if e.Unsubscribe != "" {
+		payload["headers"] = map[string]string{
+			"List-Unsubscribe":      "<" + e.Unsubscribe + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal email: %v", err)
+	}
+
+	request, err := http.NewRequest("POST", "https://api.sendgrid.com/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+m.apiKey)
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to send email: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("email send failed with status %d: %s", resp.StatusCode, msg)
+	}
+	return resp.Header.Get("X-Message-Id"), nil
+}
+
+// sesMailer sends through the Amazon SES v2 API. Credentials come from
+// SES_ACCESS_KEY_ID and SES_SECRET_ACCESS_KEY.
+type sesMailer struct {
+	region    string
+	accessKey string
+	secretKey string
+	from      string
+	client    *http.Client
+}
+
+func (m *sesMailer) Name() string { return "ses" }
+
+func (m *sesMailer) Send(e outgoingEmail) (string, error) {
+	content := map[string]interface{}{
+		"Subject": map[string]string{"Data": e.Subject},
+		"Body": map[string]interface{}{
+			"Text": map[string]string{"Data": e.Text},
+			"Html": map[string]string{"Data": e.HTML},
+		},
+	}
+	if e.Unsubscribe != "" {
+		content["Headers"] = []map[string]string{
+			{"Name": "List-Unsubscribe", "Value": "<" + e.Unsubscribe + ">"},
+			{"Name": "List-Unsubscribe-Post", "Value": "List-Unsubscribe=One-Click"},
+		}
+	}
+	message := map[string]interface{}{
+		"FromEmailAddress": m.from,
+		"Destination":      map[string][]string{"ToAddresses": {e.To}},
+		"Content":          map[string]interface{}{"Simple": content},
+	}
+	if e.ReplyTo != "" {
+		message["ReplyToAddresses"] = []string{e.ReplyTo}
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal email: %v", err)
+	}
+
+	uri := "/v2/email/outbound-emails"
+	request, err := http.NewRequest("POST", fmt.Sprintf("https://email.%s.amazonaws.com%s", m.region, uri), bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	signAWSV4(request, uri, body, m.accessKey, m.secretKey, m.region, "ses")
+
+	resp, err := m.client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to send email: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("email send failed with status %d: %s", resp.StatusCode, respBody)
+	}
+	var result struct {
+		MessageId string
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("failed to decode email response: %v", err)
+	}
+	return result.MessageId, nil
+}
+
+// logMailer stands in when no email provider is configured
+type logMailer struct{}
+
+func (logMailer) Name() string { return "log" }
+
+func (logMailer) Send(e outgoingEmail) (string, error) {
+	log.Printf("Email to %s (not sent, no email provider configured): %s", e.To, e.Subject)
+	return "", nil
+}
+
+// EmailSend is the record of one email
+type EmailSend struct {
+	ID         string    `json:"id"`
+	Email      string    `json:"email"`
+	Kind       string    `json:"kind"`
+	Subject    string    `json:"subject"`
+	Provider   string    `json:"provider"`
+	ProviderID string    `json:"provider_id"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// renderedEmail is a notification's email, ready to send
+type renderedEmail struct {
+	Subject     string
+	Text        string
+	HTML        string
+	Unsubscribe string
+}
+
+// renderNotification renders the email for a notification
+func (app *App) renderNotification(n Notification) (*renderedEmail, error) {
+	data, err := app.emailData(n)
+	if err != nil {
+		return nil, err
+	}
+	subject, text, html, err := renderEmail(n.Kind, data)
+	if err != nil {
+		return nil, err
+	}
+	return &renderedEmail{Subject: subject, Text: text, HTML: html, Unsubscribe: data["UnsubscribeURL"].(string)}, nil
+}
+
+// sendEmail sends a notification's rendered email and records the send
+func (app *App) sendEmail(n Notification, e *renderedEmail) error {
+	rec := EmailSend{
+		ID:        newMessageID(),
+		Email:     n.Email,
+		Kind:      n.Kind,
+		Subject:   e.Subject,
+		Provider:  app.mailer.Name(),
+		Status:    EmailSent,
+		CreatedAt: time.Now(),
+	}
+	providerID, sendErr := app.mailer.Send(outgoingEmail{
+		To:          n.Email,
+		Subject:     e.Subject,
+		Text:        e.Text,
+		HTML:        e.HTML,
+		Unsubscribe: e.Unsubscribe,
+		SendID:      rec.ID,
+		ReplyTo:     app.replyAddressFor(n, rec.ID),
+	})
+	rec.ProviderID = providerID
+	if sendErr != nil {
+		rec.Status, rec.Error = EmailFailed, sendErr.Error()
+	}
+	rec.UpdatedAt = rec.CreatedAt
+
+	err := app.db.Exec(`
+		INSERT INTO email_sends (id, email, kind, subject, provider, provider_id, status, error, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, rec.ID, rec.Email, rec.Kind, rec.Subject, rec.Provider, rec.ProviderID, rec.Status, rec.Error, rec.CreatedAt, rec.UpdatedAt)
+	if err != nil {
+		log.Printf("Error recording email send to %s: %v", n.Email, err)
+	}
+	return sendErr
+}
+
+// EmailSends returns the most recent email records, optionally for one user
+func (app *App) EmailSends(email string, limit int) ([]EmailSend, error) {
+	query := `SELECT id, email, kind, subject, provider, provider_id, status, error, created_at, updated_at FROM email_sends`
+	var args []interface{}
+	if email != "" {
+		query += " WHERE email = ?"
+		args = append(args, email)
+	}
+	query += " ORDER BY created_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	result, err := app.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query email sends: %v", err)
+	}
+	defer result.Close()
+
+	var sends []EmailSend
+	err = result.Iterate(func(r *chai.Row) error {
+		var s EmailSend
+		if err := r.Scan(&s.ID, &s.Email, &s.Kind, &s.Subject, &s.Provider, &s.ProviderID,
+			&s.Status, &s.Error, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			return fmt.Errorf("failed to scan email send: %v", err)
+		}
+		sends = append(sends, s)
+		return nil
+	})
+	return sends, err
+}
+
+// recordEmailOutcome marks a send bounced or complained. column is "id" or
+// "provider_id". Permanent bounces and complaints also turn off email for
+// the user, so we stop mailing an address that can't or doesn't want to
+// receive it.
+func (app *App) recordEmailOutcome(column, id, status, detail string, permanent bool) error {
+	result, err := app.db.Query("SELECT email FROM email_sends WHERE "+column+" = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to query email send: %v", err)
+	}
+	defer result.Close()
+
+	var emails []string
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		if err := r.Scan(&email); err != nil {
+			return fmt.Errorf("failed to scan email send: %v", err)
+		}
+		emails = append(emails, email)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(emails) == 0 {
+		return fmt.Errorf("unknown email %s", id)
+	}
+
+	err = app.db.Exec("UPDATE email_sends SET status = ?, error = ?, updated_at = ? WHERE "+column+" = ?",
+		status, detail, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update email send: %v", err)
+	}
+	if !permanent {
+		return nil
+	}
+	for _, email := range emails {
+		prefs, err := app.GetNotificationPrefs(email)
+		if err != nil {
+			return err
+		}
+		prefs.Email = false
+		if err := app.SaveNotificationPrefs(email, prefs); err != nil {
+			return err
+		}
+		log.Printf("Turned off email for %s after %s: %s", email, status, detail)
+	}
+	return nil
+}
+
+// webhookAuthorized checks the token configured in EMAIL_WEBHOOK_TOKEN,
+// which providers are set up to pass in the webhook URL
+func webhookAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token := os.Getenv("EMAIL_WEBHOOK_TOKEN")
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// handleSendGridWebhook takes SendGrid event webhook batches
+func handleSendGridWebhook(w http.ResponseWriter, r *http.Request) {
+	if !webhookAuthorized(w, r) {
+		return
+	}
+	var events []struct {
+		Event  string `json:"event"`
+		Type   string `json:"type"` // "bounce" or "blocked" on bounce events
+		Reason string `json:"reason"`
+		SendID string `json:"send_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	for _, e := range events {
+		if e.SendID == "" {
+			continue
+		}
+		var err error
+		switch e.Event {
+		case "bounce":
+			err = chatRoom.recordEmailOutcome("id", e.SendID, EmailBounced, e.Reason, e.Type != "blocked")
+		case "dropped":
+			err = chatRoom.recordEmailOutcome("id", e.SendID, EmailBounced, e.Reason, false)
+		case "spamreport":
+			err = chatRoom.recordEmailOutcome("id", e.SendID, EmailComplained, "marked as spam", true)
+		}
+		if err != nil {
+			log.Printf("Error handling SendGrid %s event: %v", e.Event, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSESWebhook takes SES bounce and complaint notifications, and mail
+// received for replies, delivered by SNS, confirming the SNS subscription
+// when it is first set up
+func handleSESWebhook(w http.ResponseWriter, r *http.Request) {
+	if !webhookAuthorized(w, r) {
+		return
+	}
+	var envelope struct {
+		Type         string
+		Message      string
+		SubscribeURL string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	switch envelope.Type {
+	case "SubscriptionConfirmation":
+		u, err := url.Parse(envelope.SubscribeURL)
+		if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Host, ".amazonaws.com") {
+			http.Error(w, "Invalid subscribe URL", http.StatusBadRequest)
+			return
+		}
+		resp, err := http.Get(envelope.SubscribeURL)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to confirm subscription: %v", err), http.StatusBadGateway)
+			return
+		}
+		resp.Body.Close()
+
+	case "Notification":
+		var n struct {
+			NotificationType string `json:"notificationType"`
+			Bounce           struct {
+				BounceType string `json:"bounceType"` // "Permanent", "Transient" or "Undetermined"
+			} `json:"bounce"`
+			Complaint struct {
+				FeedbackType string `json:"complaintFeedbackType"`
+			} `json:"complaint"`
+			Mail struct {
+				MessageID string `json:"messageId"`
+			} `json:"mail"`
+			// Received mail, from a receipt rule's SNS action
+			Receipt struct {
+				Action struct {
+					Encoding string `json:"encoding"` // "UTF8" or "BASE64"
+				} `json:"action"`
+			} `json:"receipt"`
+			Content string `json:"content"`
+		}
+		if err := json.Unmarshal([]byte(envelope.Message), &n); err != nil {
+			http.Error(w, "Invalid notification", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch n.NotificationType {
+		case "Bounce":
+			err = chatRoom.recordEmailOutcome("provider_id", n.Mail.MessageID, EmailBounced,
+				n.Bounce.BounceType+" bounce", n.Bounce.BounceType == "Permanent")
+		case "Complaint":
+			err = chatRoom.recordEmailOutcome("provider_id", n.Mail.MessageID, EmailComplained,
+				"complaint: "+n.Complaint.FeedbackType, true)
+		case "Received":
+			if InMaintenance() {
+				// SNS retries, so the reply isn't lost
+				http.Error(w, "Maintenance", http.StatusServiceUnavailable)
+				return
+			}
+			var raw io.Reader = strings.NewReader(n.Content)
+			if n.Receipt.Action.Encoding == "BASE64" {
+				raw = base64.NewDecoder(base64.StdEncoding, raw)
+			}
+			var in *inboundEmail
+			if in, err = parseRawEmail(raw); err == nil {
+				chatRoom.receiveLogged(in)
+			}
+		}
+		if err != nil {
+			log.Printf("Error handling SES %s notification: %v", n.NotificationType, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleEmailSendsAPI lists recent emails, optionally for one user
+func handleEmailSendsAPI(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+	sends, err := chatRoom.EmailSends(r.FormValue("user"), 200)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, sends)
+}
+
+// subscribeEmails sends the transactional emails that follow domain events
+func (app *App) subscribeEmails() {
+	welcome := func(role string) func(Event) {
+		return func(e Event) {
+			email, _ := e.Data["email"].(string)
+			name := email
+			if role == "caregiver" {
+				if c, err := app.GetCaregiver(email); err == nil && c != nil {
+					name = c.Name
+				}
+			} else if p, err := app.GetPatient(email); err == nil && p != nil {
+				name = p.Name
+			}
+			app.notifyLogged(Notification{
+				Email: email,
+				Kind:  NotifyWelcome,
+				Data:  map[string]interface{}{"Name": name, "Role": role},
+			})
+		}
+	}
+	app.events.Subscribe(EventCaregiverRegistered, welcome("caregiver"))
+	app.events.Subscribe(EventPatientRegistered, welcome("patient"))
+
+	// Direct messages are emailed only when the recipient has no page open
+	// to see them arrive
+	app.events.Subscribe(EventMessageSent, func(e Event) {
+		sender, _ := e.Data["email"].(string)
+		recipient, _ := e.Data["recipient"].(string)
+		if !isUserRecipient(recipient) || recipient == sender || app.realtime.Connected(recipient) {
+			return
+		}
+		createdAt, _ := e.Data["created_at"].(time.Time)
+		preview, err := app.messagePreview(sender, createdAt)
+		if err != nil {
+			log.Printf("Error loading message for notification: %v", err)
+		}
+		app.notifyLogged(Notification{
+			Email: recipient,
+			Kind:  NotifyMessageReceived,
+			Data:  map[string]interface{}{"From": sender, "Preview": preview},
+		})
+	})
+}
+
+// notifyBooking confirms a new booking to both parties in the background
+func (app *App) notifyBooking(caregiverEmail, patientEmail string, start, end time.Time) {
+	caregiverName, patientName := caregiverEmail, patientEmail
+	if c, err := app.GetCaregiver(caregiverEmail); err == nil && c != nil {
+		caregiverName = c.Name
+	}
+	if p, err := app.GetPatient(patientEmail); err == nil && p != nil {
+		patientName = p.Name
+	}
+	go func() {
+		for _, n := range []Notification{
+			{Email: caregiverEmail, Kind: NotifyBookingConfirmed, Data: map[string]interface{}{"With": patientName, "Start": start, "End": end}},
+			{Email: patientEmail, Kind: NotifyBookingConfirmed, Data: map[string]interface{}{"With": caregiverName, "Start": start, "End": end}},
+		} {
+			app.notifyLogged(n)
+		}
+	}()
+}
+
+// messagePreview returns the start of a stored message
+func (app *App) messagePreview(email string, createdAt time.Time) (string, error) {
+	result, err := app.db.Query("SELECT content FROM chat_history WHERE email = ? AND created_at = ?", email, createdAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to query message: %v", err)
+	}
+	defer result.Close()
+
+	var content string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&content)
+	})
+	if runes := []rune(content); len(runes) > 200 {
+		content = string(runes[:200]) + "…"
+	}
+	return content, err
+}
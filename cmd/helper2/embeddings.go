@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+const embeddingModel = "text-embedding-3-small"
+
+// Vectors are stored as JSON text; chai has no array column type
+const profileEmbeddingsSchema = `
+	CREATE TABLE IF NOT EXISTS profile_embeddings (
+		email TEXT PRIMARY KEY,
+		model TEXT,
+		vector TEXT,
+		updated_at TIMESTAMP
+	)
+`
+
+type embeddingResponse struct {
+	Data []struct {
+		Embedding []float64 `json:"embedding"`
+		Index     int       `json:"index"`
+	} `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// callOpenAIEmbeddings returns one vector per input, in input order
+func callOpenAIEmbeddings(input []string) ([][]float64, error) {
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"model": embeddingModel,
+		"input": input,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	request, err := http.NewRequest("POST", "https://api.openai.com/v1/embeddings", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("OPENAI_API_KEY")))
+
+	resp, err := openAIClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make API request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	var embResp embeddingResponse
+	if err := json.Unmarshal(respBody, &embResp); err != nil {
+		return nil, fmt.Errorf("failed to decode API response: %v", err)
+	}
+	if embResp.Error != nil {
+		return nil, fmt.Errorf("embedding request failed: %s", embResp.Error.Message)
+	}
+	if len(embResp.Data) != len(input) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(input), len(embResp.Data))
+	}
+
+	vectors := make([][]float64, len(input))
+	for _, d := range embResp.Data {
+		if d.Index < 0 || d.Index >= len(vectors) {
+			return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return vectors, nil
+}
+
+// profileText is the free text that describes what a user offers or needs.
+// Caregivers are described by what they do, patients by what they need, so
+// the two sides land near each other when they fit.
+func (app *App) profileText(email string) (string, error) {
+	var parts []string
+	if c, err := app.GetCaregiver(email); err != nil {
+		return "", err
+	} else if c != nil {
+		skills, err := app.GetSkills(email)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, c.Specializations, c.Experience, c.Certifications, strings.Join(skills, ", "))
+	}
+	if p, err := app.GetPatient(email); err != nil {
+		return "", err
+	} else if p != nil {
+		parts = append(parts, p.CareNeeds, p.SpecialRequirements)
+	}
+
+	var nonEmpty []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "\n"), nil
+}
+
+// IndexProfileEmbedding vectorizes a user's profile text and stores it
+func (app *App) IndexProfileEmbedding(email string) error {
+	if os.Getenv("OPENAI_API_KEY") == "" {
+		return nil
+	}
+
+	text, err := app.profileText(email)
+	if err != nil {
+		return err
+	}
+	if text == "" {
+		return nil
+	}
+
+	vectors, err := callOpenAIEmbeddings([]string{text})
+	if err != nil {
+		return err
+	}
+	vector, err := json.Marshal(vectors[0])
+	if err != nil {
+		return fmt.Errorf("failed to marshal embedding: %v", err)
+	}
+
+	err = app.db.Exec(`
+		INSERT INTO profile_embeddings (email, model, vector, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, embeddingModel, string(vector), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store embedding: %v", err)
+	}
+	return nil
+}
+
+// GetProfileEmbedding returns a user's stored vector, or nil if none exists
+func (app *App) GetProfileEmbedding(email string) ([]float64, error) {
+	result, err := app.db.Query("SELECT vector FROM profile_embeddings WHERE email = ? AND model = ?",
+		email, embeddingModel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query embedding: %v", err)
+	}
+	defer result.Close()
+
+	var vector []float64
+	err = result.Iterate(func(r *chai.Row) error {
+		var encoded string
+		if err := r.Scan(&encoded); err != nil {
+			return fmt.Errorf("failed to scan embedding: %v", err)
+		}
+		return json.Unmarshal([]byte(encoded), &vector)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vector, nil
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// similarityScores returns the similarity of each candidate to email's
+// profile. ok is false when email has no vector, in which case the caller
+// should keep its own ordering.
+func (app *App) similarityScores(email string, candidates []string) (scores map[string]float64, ok bool) {
+	target, err := app.GetProfileEmbedding(email)
+	if err != nil || target == nil {
+		return nil, false
+	}
+
+	scores = make(map[string]float64)
+	for _, candidate := range candidates {
+		vector, err := app.GetProfileEmbedding(candidate)
+		if err != nil || vector == nil {
+			continue
+		}
+		scores[candidate] = cosineSimilarity(target, vector)
+	}
+	return scores, true
+}
+
+func semanticReason(score float64) string {
+	return fmt.Sprintf("%.0f%% fit between care needs and specializations", score*100)
+}
+
+// rankCaregiversBySimilarity reorders caregivers that already passed the hard
+// filters so the closest semantic fits come first. Caregivers without a
+// vector keep their relative order after the scored ones.
+func (app *App) rankCaregiversBySimilarity(patientEmail string, caregivers []Caregiver) {
+	emails := make([]string, len(caregivers))
+	for i, c := range caregivers {
+		emails[i] = c.Email
+	}
+	scores, ok := app.similarityScores(patientEmail, emails)
+	if !ok {
+		return
+	}
+
+	for i := range caregivers {
+		if score, ok := scores[caregivers[i].Email]; ok {
+			caregivers[i].MatchReasons = append(caregivers[i].MatchReasons, semanticReason(score))
+		}
+	}
+	sort.SliceStable(caregivers, func(i, j int) bool {
+		si, iok := scores[caregivers[i].Email]
+		sj, jok := scores[caregivers[j].Email]
+		if iok != jok {
+			return iok
+		}
+		return si > sj
+	})
+}
+
+// rankPatientsBySimilarity is rankCaregiversBySimilarity for the caregiver side
+func (app *App) rankPatientsBySimilarity(caregiverEmail string, patients []Patient) {
+	emails := make([]string, len(patients))
+	for i, p := range patients {
+		emails[i] = p.Email
+	}
+	scores, ok := app.similarityScores(caregiverEmail, emails)
+	if !ok {
+		return
+	}
+
+	for i := range patients {
+		if score, ok := scores[patients[i].Email]; ok {
+			patients[i].MatchReasons = append(patients[i].MatchReasons, semanticReason(score))
+		}
+	}
+	sort.SliceStable(patients, func(i, j int) bool {
+		si, iok := scores[patients[i].Email]
+		sj, jok := scores[patients[j].Email]
+		if iok != jok {
+			return iok
+		}
+		return si > sj
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/chaisql/chai"
+)
+
+// userDataColumns lists, for each table holding a user's data, the
+// columns that can name them. Messages other users sent them and the
+// audit log are kept; they belong to someone else. So are consents, the
+// record of what the user agreed to, and the columns naming the staff who
+// acted on someone else's record. Presence is keyed by userKey, and is
+// forgotten separately. Merging accounts moves the same columns.
+var userDataColumns = map[string][]string{
+	"caregivers":               {"email"},
+	"patients":                 {"email"},
+	"skills":                   {"email"},
+	"chat_history":             {"email"},
+	"chat_summaries":           {"email"},
+	"chat_archives":            {"email"},
+	"chat_turns":               {"email"},
+	"message_embeddings":       {"email"},
+	"message_deliveries":       {"sender"},
+	"matches":                  {"caregiver_email", "patient_email"},
+	"match_events":             {"caregiver_email", "patient_email"},
+	"match_relays":             {"caregiver_email", "patient_email"},
+	"assignments":              {"caregiver_email", "patient_email"},
+	"contact_requests":         {"requester", "recipient"},
+	"custom_field_values":      {"email"},
+	"digest_items":             {"email", "counterpart"},
+	"email_sends":              {"email"},
+	"profile_embeddings":       {"email"},
+	"profile_locations":        {"email"},
+	"profile_care_types":       {"email"},
+	"experiment_assignments":   {"email"},
+	"experiment_turns":         {"email"},
+	"llm_usage":                {"email"},
+	"notification_prefs":       {"email"},
+	"onboarding_drafts":        {"email"},
+	"phone_verification_codes": {"email"},
+	"phone_verifications":      {"email"},
+	"user_phones":              {"email"},
+	"user_preferences":         {"email"},
+	"read_markers":             {"email"},
+	"organization_members":     {"email"},
+	"invite_codes":             {"owner", "created_by"},
+	"referrals":                {"invitee", "inviter"},
+	"user_tags":                {"email"},
+	"admin_notes":              {"email"},
+	"attachments":              {"email"},
+	"signup_flags":             {"email"},
+	"login_links":              {"email"},
+	"login_sessions":           {"email"},
+	"pending_replies":          {"email"},
+	"profile_proposals":        {"email"},
+	"profile_changes":          {"email"},
+	"chat_threads":             {"email"},
+	"active_threads":           {"email"},
+	"caregiver_availability":   {"email"},
+	"patient_urgency":          {"email"},
+	"payment_types":            {"email"},
+	"impersonations":           {"email", "admin"},
+	"broadcast_deliveries":     {"email"},
+	"public_profiles":          {"email"},
+	"profile_inquiries":        {"caregiver_email", "email"},
+	"telegram_links":           {"email"},
+	"telegram_link_codes":      {"email"},
+	"whatsapp_links":           {"email"},
+	"email_reply_threads":      {"email"},
+	"speech_clips":             {"email"},
+	"certifications":           {"email"},
+	"background_checks":        {"email"},
+	"safety_escalations":       {"email"},
+	"handoffs":                 {"email"},
+	"moderated_messages":       {"sender"},
+	"moderation_strikes":       {"email"},
+	"blocks":                   {"blocker", "blocked"},
+	"reports":                  {"reporter", "reported"},
+	"suspensions":              {"email"},
+	"shifts":                   {"caregiver_email", "patient_email"},
+	"timesheets":               {"caregiver_email", "patient_email"},
+	"invoices":                 {"caregiver_email", "patient_email"},
+	"rate_offers":              {"caregiver_email", "patient_email"},
+	"care_plans":               {"email"},
+	"visit_notes":              {"caregiver_email", "patient_email"},
+	"calendar_feeds":           {"email"},
+	"google_calendars":         {"email"},
+	"google_calendar_events":   {"email"},
+	"calendar_busy":            {"email"},
+	"reminder_settings":        {"email"},
+	"reminders":                {"email"},
+	"waitlist":                 {"email"},
+	"favorites":                {"patient_email", "caregiver_email"},
+	"duplicate_candidates":     {"email_a", "email_b"},
+}
+
+// DeleteUserData erases everything stored about email: profile, matches,
+// conversation, uploads and settings. Users under a legal hold can't be
+// erased.
+func (app *App) DeleteUserData(email string) error {
+	held, err := rowExists(app.db, "SELECT email FROM legal_holds WHERE email = ?", email)
+	if err != nil {
+		return err
+	}
+	if held {
+		return fmt.Errorf("%s is under a legal hold", email)
+	}
+
+	// Objects go once their rows are gone, so a failure part way leaves
+	// nothing pointing at a missing object
+	archives, err := app.ChatArchives(email)
+	if err != nil {
+		return err
+	}
+	attachments, err := app.ListAttachments(email)
+	if err != nil {
+		return err
+	}
+	speech, err := app.SpeechClipKeys(email)
+	if err != nil {
+		return err
+	}
+
+	err = app.withTx(func(tx *chai.Tx) error {
+		for table, columns := range userDataColumns {
+			for _, column := range columns {
+				if err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, column), email); err != nil {
+					return fmt.Errorf("failed to delete from %s: %v", table, err)
+				}
+			}
+		}
+		// Patients waiting for care keep their place, without the
+		// caregiver they were told about
+		if err := tx.Exec("UPDATE waitlist SET matched_caregiver = ? WHERE matched_caregiver = ?", "", email); err != nil {
+			return fmt.Errorf("failed to update waitlist: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := []string{avatarKey(email)}
+	for _, a := range archives {
+		keys = append(keys, a.Path)
+	}
+	for _, a := range attachments {
+		keys = append(keys, a.ObjectKey)
+	}
+	keys = append(keys, speech...)
+	for _, key := range keys {
+		if err := app.objects.Delete(key); err != nil {
+			log.Printf("Error deleting %s for %s: %v", key, email, err)
+		}
+	}
+
+	if err := app.presence.Forget(email); err != nil {
+		log.Printf("Error deleting presence for %s: %v", email, err)
+	}
+
+	app.InvalidateSession(email)
+	app.invalidateToolCaches()
+	log.Printf("Deleted all data for %s", email)
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// tableColumn is a column as chai's catalog describes it
+type tableColumn struct {
+	Name, Type string
+}
+
+// appTables returns the columns of every table the app creates, read from
+// chai's catalog so that tables added later are covered too
+func appTables(t *testing.T, app *App) map[string][]tableColumn {
+	t.Helper()
+	result, err := app.db.Query("SELECT name, sql FROM __chai_catalog WHERE type = 'table'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Close()
+
+	tables := map[string][]tableColumn{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var name, sql string
+		if err := r.Scan(&name, &sql); err != nil {
+			return err
+		}
+		if strings.HasPrefix(name, "__chai") {
+			return nil
+		}
+		// CREATE TABLE name (col TYPE ..., ..., CONSTRAINT ...)
+		body := sql[strings.Index(sql, "(")+1 : strings.LastIndex(sql, ")")]
+		depth, start := 0, 0
+		for i := 0; i <= len(body); i++ {
+			if i < len(body) {
+				switch body[i] {
+				case '(', '[':
+					depth++
+				case ')', ']':
+					depth--
+				}
+				if body[i] != ',' || depth > 0 {
+					continue
+				}
+			}
+			fields := strings.Fields(body[start:i])
+			start = i + 1
+			if len(fields) >= 2 && fields[0] != "CONSTRAINT" {
+				tables[name] = append(tables[name], tableColumn{Name: fields[0], Type: fields[1]})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tables
+}
+
+// userColumnNames are the columns, besides email and *_email ones, that
+// hold a user's email
+var userColumnNames = map[string]bool{
+	"owner": true, "sender": true, "recipient": true, "requester": true, "blocker": true, "blocked": true,
+	"reporter": true, "reported": true, "invitee": true, "inviter": true, "admin": true, "actor": true,
+	"email_a": true, "email_b": true, "counterpart": true, "matched_caregiver": true, "agent": true,
+}
+
+// namesUser reports whether a column holds a user's email
+func namesUser(column string) bool {
+	return column == "email" || strings.HasSuffix(column, "_email") || strings.HasSuffix(column, "_by") ||
+		userColumnNames[column]
+}
+
+// seedValues are the values a seeded column must take to pass its
+// table's checks
+var seedValues = map[string]interface{}{
+	"assignments.status": "scheduled",
+}
+
+var seedCount int
+
+// seedRow inserts a row into table, with values for the columns given and
+// filler for the rest, distinct from every other row's
+func seedRow(t *testing.T, app *App, table string, columns []tableColumn, values map[string]interface{}) {
+	t.Helper()
+	seedCount++
+	var names, marks []string
+	var args []interface{}
+	for _, c := range columns {
+		v, ok := values[c.Name]
+		if !ok {
+			v, ok = seedValues[table+"."+c.Name]
+		}
+		if !ok {
+			switch c.Type {
+			case "TEXT":
+				v = fmt.Sprintf("%s-%d", c.Name, seedCount)
+			case "INTEGER", "BIGINT":
+				v = seedCount
+			case "DOUBLE", "REAL":
+				v = 1.5
+			case "BOOLEAN", "BOOL":
+				v = false
+			case "TIMESTAMP":
+				v = time.Now().Add(time.Duration(seedCount) * time.Second)
+			default:
+				continue
+			}
+		}
+		names, marks, args = append(names, c.Name), append(marks, "?"), append(args, v)
+	}
+	q := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(names, ", "), strings.Join(marks, ", "))
+	if err := app.db.Exec(q, args...); err != nil {
+		t.Fatalf("failed to seed %s: %v", table, err)
+	}
+}
+
+// seedUser puts a row naming email in each user column of every table,
+// and returns the tables
+func seedUser(t *testing.T, app *App, email string) map[string][]tableColumn {
+	t.Helper()
+	tables := appTables(t, app)
+	for table, columns := range tables {
+		// A legal hold would stop the user's data being erased or merged
+		if table == "legal_holds" {
+			continue
+		}
+		for _, c := range columns {
+			if namesUser(c.Name) && c.Type == "TEXT" {
+				seedRow(t, app, table, columns, map[string]interface{}{c.Name: email})
+			}
+		}
+	}
+	if err := app.presence.store.Touch(userKey(email), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return tables
+}
+
+// findUser returns the table.column of every value naming email
+func findUser(t *testing.T, app *App, tables map[string][]tableColumn, email string) []string {
+	t.Helper()
+	var found []string
+	for table := range tables {
+		result, err := app.db.Query("SELECT * FROM " + table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = result.Iterate(func(r *chai.Row) error {
+			row := map[string]interface{}{}
+			if err := r.MapScan(row); err != nil {
+				return err
+			}
+			for column, v := range row {
+				if v == email || v == userKey(email) {
+					found = append(found, table+"."+column)
+				}
+			}
+			return nil
+		})
+		result.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// erasureKeeps are the columns that may still name an erased user
+var erasureKeeps = map[string]string{
+	"audit_log.actor":                    "the audit log is kept",
+	"audit_log.subject":                  "the audit log is kept",
+	"consents.email":                     "consents are kept",
+	"chat_history.recipient":             "messages others sent them are kept",
+	"message_deliveries.recipient":       "messages others sent them are kept",
+	"moderated_messages.recipient":       "messages others sent them are kept",
+	"admin_notes.created_by":             "staff acting on someone else's record",
+	"background_checks.requested_by":     "staff acting on someone else's record",
+	"broadcasts.created_by":              "staff acting on someone else's record",
+	"duplicate_candidates.reviewed_by":   "staff acting on someone else's record",
+	"handoffs.agent":                     "staff acting on someone else's record",
+	"legal_documents.created_by":         "staff acting on someone else's record",
+	"legal_holds.created_by":             "staff acting on someone else's record",
+	"moderated_messages.reviewed_by":     "staff acting on someone else's record",
+	"prompts.created_by":                 "staff acting on someone else's record",
+	"reports.reviewed_by":                "staff acting on someone else's record",
+	"safety_escalations.resolved_by":     "staff acting on someone else's record",
+	"signup_flags.reviewed_by":           "staff acting on someone else's record",
+	"suspensions.suspended_by":           "staff acting on someone else's record",
+	"tool_policy.updated_by":             "staff acting on someone else's record",
+	"user_tags.created_by":               "staff acting on someone else's record",
+	"care_plans.edited_by":               "only the patient, whose rows go, or staff",
+	"match_events.actor":                 "only a party to the match, whose rows go, or staff",
+	"rate_offers.offered_by":             "only a party to the match, whose rows go",
+	"duplicate_candidates.primary_email": "only one of the pair, whose rows go",
+}
+
+func TestDeleteUserDataLeavesNothing(t *testing.T) {
+	app := newTestApp(t)
+	const email = "erased@example.com"
+	tables := seedUser(t, app, email)
+
+	if err := app.DeleteUserData(email); err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range findUser(t, app, tables, email) {
+		if _, kept := erasureKeeps[column]; !kept {
+			t.Errorf("%s still names the erased user", column)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Domain event types
+const (
+	EventCaregiverRegistered = "CaregiverRegistered"
+	EventPatientRegistered   = "PatientRegistered"
+	EventMatchCreated        = "MatchCreated"
+	EventMatchAccepted       = "MatchAccepted"
+	EventMessageSent         = "MessageSent"
+	EventPatientUrgent       = "PatientUrgent"
+	EventCircuitOpened       = "OpenAICircuitOpened"
+	EventJobFailed           = "JobFailed"
+	EventSafetyEscalated     = "SafetyEscalated"
+	EventHandoffRequested    = "HandoffRequested"
+	EventUserReported        = "UserReported"
+)
+
+// Event is something that happened in the domain. Data carries identifiers
+// and small facts only; subscribers look up anything else they need.
+type Event struct {
+	Type       string                 `json:"type"`
+	OccurredAt time.Time              `json:"occurred_at"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// eventPublisher forwards events to an external system
+type eventPublisher interface {
+	Publish(e Event) error
+}
+
+// eventBus fans events out to in-process subscribers and external
+// publishers. Delivery is asynchronous, so a slow subscriber never holds
+// up the request that raised the event.
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers map[string][]func(Event) // keyed by event type; "*" gets all
+	publishers  []eventPublisher
+}
+
+func newEventBus(cfg EventsConfig) *eventBus {
+	bus := &eventBus{subscribers: make(map[string][]func(Event))}
+	if cfg.NATS.URL != "" {
+		bus.publishers = append(bus.publishers, &natsPublisher{
+			addr:   cfg.NATS.URL,
+			prefix: cfg.NATS.SubjectPrefix,
+		})
+	}
+	if cfg.Kafka.RestURL != "" {
+		bus.publishers = append(bus.publishers, &kafkaRestPublisher{
+			url:    strings.TrimRight(cfg.Kafka.RestURL, "/") + "/topics/" + url.PathEscape(cfg.Kafka.Topic),
+			client: &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+	return bus
+}
+
+// Subscribe calls fn for every event of the given type, or for all events
+// when eventType is "*"
+func (b *eventBus) Subscribe(eventType string, fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[eventType] = append(b.subscribers[eventType], fn)
+}
+
+// Publish delivers an event to subscribers and publishers
+func (b *eventBus) Publish(eventType string, data map[string]interface{}) {
+	e := Event{Type: eventType, OccurredAt: time.Now(), Data: data}
+
+	b.mu.RLock()
+	handlers := append(append([]func(Event){}, b.subscribers[eventType]...), b.subscribers["*"]...)
+	publishers := b.publishers
+	b.mu.RUnlock()
+
+	for _, fn := range handlers {
+		go func(fn func(Event)) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Event subscriber for %s panicked: %v", e.Type, r)
+				}
+			}()
+			fn(e)
+		}(fn)
+	}
+	for _, p := range publishers {
+		go func(p eventPublisher) {
+			if err := p.Publish(e); err != nil {
+				log.Printf("Error publishing %s event: %v", e.Type, err)
+			}
+		}(p)
+	}
+}
+
+// natsPublisher speaks just enough of the NATS text protocol to publish:
+// CONNECT once, then PUB per event, answering the server's PINGs
+type natsPublisher struct {
+	addr   string // host:port, or a nats:// URL
+	prefix string // subject prefix, e.g. "helper"
+	mu     sync.Mutex
+	conn   net.Conn
+}
+
+func (n *natsPublisher) connect() error {
+	addr := strings.TrimPrefix(n.addr, "nats://")
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	info, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting %q: %v", info, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if _, err := io.WriteString(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"helper\"}\r\n"); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send NATS CONNECT: %v", err)
+	}
+
+	// Keep the connection alive; the server drops clients that ignore PING
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "PING") {
+				n.mu.Lock()
+				io.WriteString(conn, "PONG\r\n")
+				n.mu.Unlock()
+			} else if strings.HasPrefix(line, "-ERR") {
+				log.Printf("NATS error: %s", strings.TrimSpace(line))
+			}
+		}
+	}()
+	n.conn = conn
+	return nil
+}
+
+func (n *natsPublisher) Publish(e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	subject := e.Type
+	if n.prefix != "" {
+		subject = n.prefix + "." + e.Type
+	}
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(payload), payload)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// One retry on a fresh connection covers a server restart
+	for attempt := 0; attempt < 2; attempt++ {
+		if n.conn == nil {
+			if err = n.connect(); err != nil {
+				return err
+			}
+		}
+		n.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err = io.WriteString(n.conn, msg); err == nil {
+			return nil
+		}
+		n.conn.Close()
+		n.conn = nil
+	}
+	return fmt.Errorf("failed to publish to NATS: %v", err)
+}
+
+// kafkaRestPublisher produces to a Kafka topic through a Confluent-style
+// REST proxy, which keeps the binary free of a Kafka client library
+type kafkaRestPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (k *kafkaRestPublisher) Publish(e Event) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{{"key": e.Type, "value": e}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	request, err := http.NewRequest("POST", k.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+
+	resp, err := k.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to reach Kafka REST proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("kafka REST proxy returned %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+const experimentsSchema = `
+	CREATE TABLE IF NOT EXISTS experiments (
+		name TEXT PRIMARY KEY,
+		variants TEXT,
+		active BOOLEAN,
+		created_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS experiment_assignments (
+		experiment TEXT,
+		email TEXT,
+		variant TEXT,
+		assigned_at TIMESTAMP,
+		PRIMARY KEY (experiment, email)
+	);
+
+	CREATE TABLE IF NOT EXISTS experiment_turns (
+		email TEXT,
+		created_at TIMESTAMP,
+		experiment TEXT,
+		variant TEXT,
+		prompt TEXT,
+		model TEXT,
+		PRIMARY KEY (email, created_at)
+	);
+	CREATE INDEX IF NOT EXISTS idx_experiment_turns_experiment ON experiment_turns(experiment)
+`
+
+// ExperimentVariant is one arm of an experiment. Empty Prompt or Model
+// fields keep the default for that turn.
+type ExperimentVariant struct {
+	Name   string `json:"name"`
+	Prompt string `json:"prompt,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Weight int    `json:"weight"`
+}
+
+// Experiment splits users between variants. Only one experiment is active
+// at a time, so turns never mix two experiments' changes.
+type Experiment struct {
+	Name      string              `json:"name"`
+	Variants  []ExperimentVariant `json:"variants"`
+	Active    bool                `json:"active"`
+	CreatedAt time.Time           `json:"created_at"`
+}
+
+// VariantReport is the completion funnel for one variant
+type VariantReport struct {
+	Variant        string  `json:"variant"`
+	Users          int     `json:"users"`
+	Turns          int     `json:"turns"`
+	Registered     int     `json:"registered"`
+	RegisteredRate float64 `json:"registered_rate"`
+	Accepted       int     `json:"accepted"`
+	AcceptedRate   float64 `json:"accepted_rate"`
+}
+
+// pickVariant deterministically maps email to a variant by weight, so a
+// user lands in the same arm no matter which instance serves them
+func pickVariant(experiment, email string, variants []ExperimentVariant) ExperimentVariant {
+	total := 0
+	for _, v := range variants {
+		if v.Weight > 0 {
+			total += v.Weight
+		}
+	}
+	if total == 0 {
+		return variants[0]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(experiment + "/" + email))
+	bucket := int(h.Sum32() % uint32(total))
+	for _, v := range variants {
+		if v.Weight <= 0 {
+			continue
+		}
+		if bucket < v.Weight {
+			return v
+		}
+		bucket -= v.Weight
+	}
+	return variants[len(variants)-1]
+}
+
+// SaveExperiment creates or replaces an experiment. Activating one
+// deactivates any other.
+func (app *App) SaveExperiment(e *Experiment) error {
+	if e.Name == "" || len(e.Variants) == 0 {
+		return fmt.Errorf("experiment needs a name and at least one variant")
+	}
+	for _, v := range e.Variants {
+		if v.Name == "" {
+			return fmt.Errorf("every variant needs a name")
+		}
+	}
+	variants, err := json.Marshal(e.Variants)
+	if err != nil {
+		return fmt.Errorf("failed to marshal variants: %v", err)
+	}
+
+	if e.Active {
+		if err := app.db.Exec("UPDATE experiments SET active = false WHERE name != ?", e.Name); err != nil {
+			return fmt.Errorf("failed to deactivate experiments: %v", err)
+		}
+	}
+	e.CreatedAt = time.Now()
+	err = app.db.Exec(`
+		INSERT INTO experiments (name, variants, active, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, e.Name, string(variants), e.Active, e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store experiment: %v", err)
+	}
+	return nil
+}
+
+func scanExperiment(r *chai.Row) (Experiment, error) {
+	var e Experiment
+	var variants string
+	if err := r.Scan(&e.Name, &variants, &e.Active, &e.CreatedAt); err != nil {
+		return e, fmt.Errorf("failed to scan experiment: %v", err)
+	}
+	if err := json.Unmarshal([]byte(variants), &e.Variants); err != nil {
+		return e, fmt.Errorf("failed to decode variants: %v", err)
+	}
+	return e, nil
+}
+
+// ListExperiments returns all experiments, active or not
+func (app *App) ListExperiments() ([]Experiment, error) {
+	result, err := app.db.Query("SELECT name, variants, active, created_at FROM experiments ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query experiments: %v", err)
+	}
+	defer result.Close()
+
+	var experiments []Experiment
+	err = result.Iterate(func(r *chai.Row) error {
+		e, err := scanExperiment(r)
+		if err != nil {
+			return err
+		}
+		experiments = append(experiments, e)
+		return nil
+	})
+	return experiments, err
+}
+
+// activeExperiment returns the running experiment, or nil
+func (app *App) activeExperiment() (*Experiment, error) {
+	result, err := app.db.Query("SELECT name, variants, active, created_at FROM experiments WHERE active = true")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query experiments: %v", err)
+	}
+	defer result.Close()
+
+	var active *Experiment
+	err = result.Iterate(func(r *chai.Row) error {
+		e, err := scanExperiment(r)
+		if err != nil {
+			return err
+		}
+		active = &e
+		return nil
+	})
+	return active, err
+}
+
+// ExperimentVariantFor returns the experiment and variant serving email,
+// assigning one on first contact. It returns nil when nothing is running.
+func (app *App) ExperimentVariantFor(email string) (*Experiment, *ExperimentVariant) {
+	e, err := app.activeExperiment()
+	if err != nil {
+		log.Printf("Error loading active experiment: %v", err)
+		return nil, nil
+	}
+	if e == nil {
+		return nil, nil
+	}
+
+	// Keep earlier assignments even if the weights have changed since
+	result, err := app.db.Query("SELECT variant FROM experiment_assignments WHERE experiment = ? AND email = ?",
+		e.Name, email)
+	if err != nil {
+		log.Printf("Error loading experiment assignment: %v", err)
+		return nil, nil
+	}
+	defer result.Close()
+	var assigned string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&assigned)
+	})
+	if err != nil {
+		log.Printf("Error scanning experiment assignment: %v", err)
+		return nil, nil
+	}
+	for i := range e.Variants {
+		if e.Variants[i].Name == assigned {
+			return e, &e.Variants[i]
+		}
+	}
+
+	v := pickVariant(e.Name, email, e.Variants)
+	err = app.db.Exec(`
+		INSERT INTO experiment_assignments (experiment, email, variant, assigned_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, e.Name, email, v.Name, time.Now())
+	if err != nil {
+		log.Printf("Error storing experiment assignment: %v", err)
+	}
+	return e, &v
+}
+
+// RecordExperimentTurn notes which variant, prompt and model served a turn
+func (app *App) RecordExperimentTurn(email, experiment, variant, prompt, model string) {
+	err := app.db.Exec(`
+		INSERT INTO experiment_turns (email, created_at, experiment, variant, prompt, model)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, email, time.Now(), experiment, variant, prompt, model)
+	if err != nil {
+		log.Printf("Error recording experiment turn: %v", err)
+	}
+}
+
+// ExperimentReport computes the funnel for each variant of an experiment:
+// how many assigned users finished registering and how many have had a
+// match accepted
+func (app *App) ExperimentReport(name string) ([]VariantReport, error) {
+	reports := make(map[string]*VariantReport)
+	var order []string
+	report := func(variant string) *VariantReport {
+		if reports[variant] == nil {
+			reports[variant] = &VariantReport{Variant: variant}
+			order = append(order, variant)
+		}
+		return reports[variant]
+	}
+
+	result, err := app.db.Query("SELECT email, variant FROM experiment_assignments WHERE experiment = ?", name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query assignments: %v", err)
+	}
+	defer result.Close()
+	assignments := make(map[string]string)
+	err = result.Iterate(func(r *chai.Row) error {
+		var email, variant string
+		if err := r.Scan(&email, &variant); err != nil {
+			return err
+		}
+		assignments[email] = variant
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate assignments: %v", err)
+	}
+
+	result, err = app.db.Query("SELECT variant FROM experiment_turns WHERE experiment = ?", name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query turns: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		var variant string
+		if err := r.Scan(&variant); err != nil {
+			return err
+		}
+		report(variant).Turns++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate turns: %v", err)
+	}
+
+	accepted, err := app.acceptedMatchParties()
+	if err != nil {
+		return nil, err
+	}
+	for email, variant := range assignments {
+		rep := report(variant)
+		rep.Users++
+		if app.userRole(email) != "unknown" {
+			rep.Registered++
+		}
+		if accepted[email] {
+			rep.Accepted++
+		}
+	}
+
+	out := make([]VariantReport, 0, len(order))
+	for _, variant := range order {
+		rep := reports[variant]
+		if rep.Users > 0 {
+			rep.RegisteredRate = float64(rep.Registered) / float64(rep.Users)
+			rep.AcceptedRate = float64(rep.Accepted) / float64(rep.Users)
+		}
+		out = append(out, *rep)
+	}
+	return out, nil
+}
+
+// acceptedMatchParties returns everyone who has been in a match that reached
+// the accepted status
+func (app *App) acceptedMatchParties() (map[string]bool, error) {
+	result, err := app.db.Query("SELECT caregiver_email, patient_email FROM match_events WHERE to_status = ?",
+		MatchAccepted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query accepted matches: %v", err)
+	}
+	defer result.Close()
+
+	parties := make(map[string]bool)
+	err = result.Iterate(func(r *chai.Row) error {
+		var caregiverEmail, patientEmail string
+		if err := r.Scan(&caregiverEmail, &patientEmail); err != nil {
+			return err
+		}
+		parties[caregiverEmail] = true
+		parties[patientEmail] = true
+		return nil
+	})
+	return parties, err
+}
+
+// handleExperimentsAPI lists experiments with their funnel reports on GET and
+// creates or replaces one from a JSON body on POST
+func handleExperimentsAPI(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		experiments, err := chatRoom.ListExperiments()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		type experimentWithReport struct {
+			Experiment
+			Report []VariantReport `json:"report"`
+		}
+		out := make([]experimentWithReport, 0, len(experiments))
+		for _, e := range experiments {
+			report, err := chatRoom.ExperimentReport(e.Name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			out = append(out, experimentWithReport{e, report})
+		}
+		writeJSON(w, out)
+
+	case "POST":
+		var e Experiment
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.SaveExperiment(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, e)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
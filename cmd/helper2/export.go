@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// ChatHistoryEntry is a full chat_history row, as used by exports
+type ChatHistoryEntry struct {
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	Recipient string    `json:"recipient"`
+	Thread    string    `json:"thread,omitempty"` // Empty for the main conversation
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UserProfile is everything stored about a user outside of chat_history
+type UserProfile struct {
+	Email     string     `json:"email"`
+	Caregiver *Caregiver `json:"caregiver,omitempty"`
+	Patient   *Patient   `json:"patient,omitempty"`
+	Skills    []string   `json:"skills,omitempty"`
+	// CustomFields holds the deployment's extra profile fields by name
+	CustomFields map[string]string `json:"custom_fields,omitempty"`
+	Preferences  *Preferences      `json:"preferences,omitempty"`
+	// Availability is set for caregivers
+	Availability *CaregiverAvailability `json:"availability,omitempty"`
+	// Urgency is set for patients
+	Urgency string `json:"urgency,omitempty"`
+	// PaymentTypes are those a caregiver accepts, or the one a patient
+	// pays with
+	PaymentTypes []string `json:"payment_types,omitempty"`
+}
+
+// GetUserProfile collects the caregiver/patient records and skills for an email
+func (app *App) GetUserProfile(email string) (*UserProfile, error) {
+	caregiver, err := app.GetCaregiver(email)
+	if err != nil {
+		return nil, err
+	}
+	patient, err := app.GetPatient(email)
+	if err != nil {
+		return nil, err
+	}
+	skills, err := app.GetSkills(email)
+	if err != nil {
+		return nil, err
+	}
+	custom, err := app.CustomFieldValues(email)
+	if err != nil {
+		return nil, err
+	}
+	preferences, err := app.GetPreferences(email)
+	if err != nil {
+		return nil, err
+	}
+	profile := &UserProfile{Email: email, Caregiver: caregiver, Patient: patient, Skills: skills,
+		CustomFields: custom, Preferences: preferences}
+	if caregiver != nil {
+		availability, err := app.GetAvailability(email)
+		if err != nil {
+			return nil, err
+		}
+		profile.Availability = &availability
+	}
+	if patient != nil {
+		if profile.Urgency, err = app.GetUrgency(email); err != nil {
+			return nil, err
+		}
+	}
+	role := "caregiver"
+	if caregiver == nil {
+		role = "patient"
+	}
+	if profile.PaymentTypes, err = app.GetPaymentTypes(email, role); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// IterateChatHistory calls fn for each of a user's messages, oldest first,
+// without holding the whole history in memory. Compacted messages are read
+// back from their archives first.
+func (app *App) IterateChatHistory(email string, fn func(ChatHistoryEntry) error) error {
+	archives, err := app.ChatArchives(email)
+	if err != nil {
+		return err
+	}
+	for _, a := range archives {
+		if err := app.readArchive(a.Path, fn); err != nil {
+			return err
+		}
+	}
+
+	result, err := app.db.Query(`
+		SELECT email, role, content, recipient, thread_id, created_at
+		FROM chat_history
+		WHERE email = ?
+		ORDER BY created_at ASC
+	`, email)
+	if err != nil {
+		return fmt.Errorf("failed to query chat history: %v", err)
+	}
+	defer result.Close()
+
+	return result.Iterate(func(r *chai.Row) error {
+		var e ChatHistoryEntry
+		if err := r.Scan(&e.Email, &e.Role, &e.Content, &e.Recipient, &e.Thread, &e.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan message: %v", err)
+		}
+		return fn(e)
+	})
+}
+
+// exportJSON streams the profile followed by the messages array
+func exportJSON(w io.Writer, profile *UserProfile, app *App) error {
+	profileJSON, err := json.Marshal(profile)
+	if err != nil {
+		return fmt.Errorf("failed to marshal profile: %v", err)
+	}
+	if _, err := fmt.Fprintf(w, `{"exported_at":%q,"profile":%s,"messages":[`,
+		time.Now().Format(time.RFC3339), profileJSON); err != nil {
+		return err
+	}
+
+	first := true
+	err = app.IterateChatHistory(profile.Email, func(e ChatHistoryEntry) error {
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		msg, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(msg)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+var exportHeaderTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>Conversation export for {{.Email}}</title>
+    <style>
+        body { font-family: Arial, sans-serif; max-width: 800px; margin: 0 auto; padding: 20px; }
+        .message { border-bottom: 1px solid #ccc; padding: 8px 0; }
+        .meta { color: #666; font-size: 0.9em; }
+    </style>
+</head>
+<body>
+    <h1>Conversation export for {{.Email}}</h1>
+    {{with .Caregiver}}
+    <h2>Caregiver profile</h2>
+    <p>Name: {{.Name}}<br>Location: {{.Location}}<br>Rate: ${{printf "%.2f" .RateExpectations}}/hour<br>
+    Experience: {{.Experience}}<br>Availability: {{.Availability}}<br>
+    Specializations: {{.Specializations}}<br>Certifications: {{.Certifications}}</p>
+    {{end}}
+    {{with .Patient}}
+    <h2>Patient profile</h2>
+    <p>Name: {{.Name}}<br>Location: {{.Location}}<br>Budget: ${{printf "%.2f" .Budget}}/hour<br>
+    Care needs: {{.CareNeeds}}<br>Schedule: {{.ScheduleRequirements}}<br>
+    Special requirements: {{.SpecialRequirements}}<br>Phone: {{.PhoneNumber}}</p>
+    {{end}}
+    {{if .Skills}}<p>Skills: {{range $i, $s := .Skills}}{{if $i}}, {{end}}{{$s}}{{end}}</p>{{end}}
+    <h2>Messages</h2>
+`))
+
+// exportHTML streams a printable transcript. Message content is escaped,
+// since assistant replies contain markup meant for the live chat page.
+func exportHTML(w io.Writer, profile *UserProfile, app *App) error {
+	if err := exportHeaderTemplate.Execute(w, profile); err != nil {
+		return err
+	}
+
+	err := app.IterateChatHistory(profile.Email, func(e ChatHistoryEntry) error {
+		_, err := fmt.Fprintf(w, "<div class=\"message\"><div class=\"meta\">%s &middot; %s</div>%s</div>\n",
+			e.CreatedAt.Format("Jan 2 2006 3:04 PM"),
+			template.HTMLEscapeString(e.Role),
+			template.HTMLEscapeString(e.Content))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "</body>\n</html>\n")
+	return err
+}
+
+// handleExport downloads the signed-in user's conversation and profile as
+// JSON or HTML
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	email := requireUser(w, r)
+	if email == "" {
+		return
+	}
+
+	profile, err := chatRoom.GetUserProfile(email)
+	if err != nil {
+		log.Printf("Error loading profile for export: %v", err)
+		http.Error(w, "Failed to load profile", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("save") == "true" {
+		saveExport(w, r, profile)
+		return
+	}
+
+	stamp := time.Now().Format("20060102")
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="conversation-%s.json"`, stamp))
+		err = exportJSON(w, profile, chatRoom)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = exportHTML(w, profile, chatRoom)
+	default:
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	// Headers are already sent by now, so all we can do is log
+	if err != nil {
+		log.Printf("Error exporting conversation for %s: %v", email, err)
+	}
+}
+
+// handleTableExport streams a whole table to an admin as CSV or
+// newline-delimited JSON. Rows are written as they're read, so memory stays
+// flat however large the table is.
+func handleTableExport(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+	q := DynamicQuery{Table: r.URL.Query().Get("table")}
+	if _, _, err := chatRoom.BuildDynamicQuery(q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stamp := time.Now().Format("20060102")
+	var write func(row map[string]interface{}) error
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.csv"`, q.Table, stamp))
+		cw := csv.NewWriter(w)
+		defer cw.Flush()
+		var cols []string
+		write = func(row map[string]interface{}) error {
+			if cols == nil {
+				// Custom fields are only on rows that have a value, so the
+				// header takes them from the definitions instead
+				seen := make(map[string]bool)
+				for col := range row {
+					seen[col] = true
+				}
+				if role, ok := tableRoles[q.Table]; ok {
+					for name := range chatRoom.customFieldsByName(role) {
+						seen[name] = true
+					}
+				}
+				for col := range seen {
+					cols = append(cols, col)
+				}
+				sort.Strings(cols)
+				if err := cw.Write(cols); err != nil {
+					return err
+				}
+			}
+			record := make([]string, len(cols))
+			for i, col := range cols {
+				if v := row[col]; v != nil {
+					record[i] = fmt.Sprint(v)
+				}
+			}
+			return cw.Write(record)
+		}
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.ndjson"`, q.Table, stamp))
+		enc := json.NewEncoder(w)
+		write = func(row map[string]interface{}) error {
+			return enc.Encode(row)
+		}
+	default:
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	// Headers are already sent once rows start, so all we can do is log
+	if err := chatRoom.IterateDynamicQuery(q, write); err != nil {
+		log.Printf("Error exporting %s: %v", q.Table, err)
+	}
+}
+
+// exportKey is where a user's saved export with the given file name lives
+func exportKey(email, name string) string {
+	return fmt.Sprintf("exports/%s/%s", userKey(email), name)
+}
+
+// saveExport writes the export to the object store instead of streaming it,
+// and returns where to download it from
+func saveExport(w http.ResponseWriter, r *http.Request, profile *UserProfile) {
+	var buf bytes.Buffer
+	var err error
+	format := r.URL.Query().Get("format")
+	name := "conversation-" + time.Now().Format("20060102-150405")
+	contentType := "application/json"
+	switch format {
+	case "", "json":
+		name += ".json"
+		err = exportJSON(&buf, profile, chatRoom)
+	case "html":
+		name += ".html"
+		contentType = "text/html; charset=utf-8"
+		err = exportHTML(&buf, profile, chatRoom)
+	default:
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = chatRoom.objects.Put(exportKey(profile.Email, name), &buf, contentType)
+	}
+	if err != nil {
+		log.Printf("Error saving export for %s: %v", profile.Email, err)
+		http.Error(w, "Failed to save export", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]string{
+		"name":     name,
+		"download": fmt.Sprintf("export/saved?email=%s&name=%s", url.QueryEscape(profile.Email), url.QueryEscape(name)),
+	})
+}
+
+// handleSavedExport downloads an export stored by saveExport for the
+// signed-in user
+func handleSavedExport(w http.ResponseWriter, r *http.Request) {
+	email := requireUser(w, r)
+	if email == "" {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	contentType := "application/json"
+	if strings.HasSuffix(name, ".html") {
+		contentType = "text/html; charset=utf-8"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	serveObject(w, exportKey(email, name), contentType)
+}
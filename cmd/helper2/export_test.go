@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExportNeedsOwnSession(t *testing.T) {
+	app := newTestApp(t)
+	if err := app.AddMessageWithRecipient("a@example.com", "user", "Hello", adminThread); err != nil {
+		t.Fatal(err)
+	}
+	handler := withLoginSession(http.HandlerFunc(handleExport))
+	export := func(target, session string) int {
+		req := httptest.NewRequest("GET", target, nil)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: loginCookie, Value: session})
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := export("/export", ""); code != http.StatusUnauthorized {
+		t.Errorf("export without a session: got %d, want 401", code)
+	}
+	b := signIn(t, app, "b@example.com")
+	if code := export("/export?email=a@example.com", b); code != http.StatusForbidden {
+		t.Errorf("export of someone else: got %d, want 403", code)
+	}
+	if code := export("/export", signIn(t, app, "a@example.com")); code != http.StatusOK {
+		t.Errorf("export of own data: got %d, want 200", code)
+	}
+}
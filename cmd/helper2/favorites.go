@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Patients star caregivers on their match cards to keep a shortlist. Each
+// favorite remembers the caregiver's rate, availability and whether they
+// were taking families when it was last checked, so that the patient can
+// be told when one of those changes.
+
+const favoritesSchema = `
+	CREATE TABLE IF NOT EXISTS favorites (
+		patient_email TEXT,
+		caregiver_email TEXT,
+		rate REAL,
+		availability TEXT,
+		status TEXT,
+		created_at TIMESTAMP,
+		checked_at TIMESTAMP,
+		PRIMARY KEY (patient_email, caregiver_email)
+	);
+	CREATE INDEX IF NOT EXISTS idx_favorites_caregiver ON favorites(caregiver_email)
+`
+
+// Favorite is a caregiver on a patient's shortlist, as they were when last
+// checked
+type Favorite struct {
+	PatientEmail   string     `json:"patient_email"`
+	CaregiverEmail string     `json:"caregiver_email"`
+	Rate           float64    `json:"rate"`
+	Availability   string     `json:"availability"`
+	Status         string     `json:"status"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CheckedAt      time.Time  `json:"checked_at"`
+	Caregiver      *Caregiver `json:"caregiver,omitempty"` // Set when listing
+}
+
+// shortlistStatus says whether a caregiver is taking new families
+func shortlistStatus(a CaregiverAvailability) string {
+	switch {
+	case !a.Active:
+		return "not taking new families"
+	case a.Paused(time.Now()):
+		return "away until " + a.UnavailableUntil.Format("Jan 2, 2006")
+	}
+	return "taking new families"
+}
+
+// AddFavorite puts a caregiver on a patient's shortlist
+func (app *App) AddFavorite(patientEmail, caregiverEmail string) error {
+	if p, err := app.GetPatient(patientEmail); err != nil || p == nil {
+		return fmt.Errorf("only patients can shortlist caregivers")
+	}
+	c, err := app.GetCaregiver(caregiverEmail)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return fmt.Errorf("no such caregiver")
+	}
+	availability, err := app.GetAvailability(caregiverEmail)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = app.db.Exec(`
+		INSERT INTO favorites (patient_email, caregiver_email, rate, availability, status, created_at, checked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`, patientEmail, caregiverEmail, c.RateExpectations, c.Availability, shortlistStatus(availability), now, now)
+	if err != nil {
+		return fmt.Errorf("failed to store favorite: %v", err)
+	}
+	// Match cards show whether a caregiver is starred
+	app.invalidateToolCaches()
+	return nil
+}
+
+// RemoveFavorite takes a caregiver off a patient's shortlist
+func (app *App) RemoveFavorite(patientEmail, caregiverEmail string) error {
+	err := app.db.Exec("DELETE FROM favorites WHERE patient_email = ? AND caregiver_email = ?", patientEmail, caregiverEmail)
+	if err != nil {
+		return fmt.Errorf("failed to remove favorite: %v", err)
+	}
+	app.invalidateToolCaches()
+	return nil
+}
+
+func (app *App) queryFavorites(where string, args ...interface{}) ([]Favorite, error) {
+	result, err := app.db.Query(`
+		SELECT patient_email, caregiver_email, rate, availability, status, created_at, checked_at
+		FROM favorites `+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query favorites: %v", err)
+	}
+	defer result.Close()
+
+	favorites := []Favorite{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var f Favorite
+		if err := r.Scan(&f.PatientEmail, &f.CaregiverEmail, &f.Rate, &f.Availability, &f.Status, &f.CreatedAt,
+			&f.CheckedAt); err != nil {
+			return fmt.Errorf("failed to scan favorite: %v", err)
+		}
+		favorites = append(favorites, f)
+		return nil
+	})
+	return favorites, err
+}
+
+// Favorites returns a patient's shortlist, with each caregiver's current
+// profile, most recently starred first
+func (app *App) Favorites(patientEmail string) ([]Favorite, error) {
+	favorites, err := app.queryFavorites("WHERE patient_email = ? ORDER BY created_at DESC", patientEmail)
+	if err != nil {
+		return nil, err
+	}
+	for i := range favorites {
+		if favorites[i].Caregiver, err = app.GetCaregiver(favorites[i].CaregiverEmail); err != nil {
+			return nil, err
+		}
+	}
+	return favorites, nil
+}
+
+// shortlisted returns the caregivers a patient has starred
+func (app *App) shortlisted(patientEmail string) map[string]bool {
+	favorites, err := app.queryFavorites("WHERE patient_email = ?", patientEmail)
+	if err != nil {
+		log.Printf("Error loading shortlist for %s: %v", patientEmail, err)
+	}
+	starred := map[string]bool{}
+	for _, f := range favorites {
+		starred[f.CaregiverEmail] = true
+	}
+	return starred
+}
+
+// checkFavorites tells every patient who shortlisted a caregiver what's
+// changed in their rate or availability since it was last checked
+func (app *App) checkFavorites(caregiverEmail string) error {
+	favorites, err := app.queryFavorites("WHERE caregiver_email = ?", caregiverEmail)
+	if err != nil || len(favorites) == 0 {
+		return err
+	}
+	c, err := app.GetCaregiver(caregiverEmail)
+	if err != nil || c == nil {
+		return err
+	}
+	availability, err := app.GetAvailability(caregiverEmail)
+	if err != nil {
+		return err
+	}
+	status := shortlistStatus(availability)
+
+	for _, f := range favorites {
+		var changes []string
+		if f.Rate != c.RateExpectations {
+			changes = append(changes, fmt.Sprintf("Rate: $%.2f/hour, was $%.2f/hour", c.RateExpectations, f.Rate))
+		}
+		if f.Availability != c.Availability {
+			change := "Availability: " + c.Availability
+			if c.Availability == "" {
+				change = "Availability: no longer listed"
+			}
+			if f.Availability != "" {
+				change += ", was " + f.Availability
+			}
+			changes = append(changes, change)
+		}
+		if f.Status != status {
+			changes = append(changes, fmt.Sprintf("Now %s, was %s", status, f.Status))
+		}
+		if len(changes) == 0 {
+			continue
+		}
+
+		err := app.db.Exec(`
+			UPDATE favorites SET rate = ?, availability = ?, status = ?, checked_at = ?
+			WHERE patient_email = ? AND caregiver_email = ?
+		`, c.RateExpectations, c.Availability, status, time.Now(), f.PatientEmail, f.CaregiverEmail)
+		if err != nil {
+			return fmt.Errorf("failed to update favorite: %v", err)
+		}
+		app.notifyLogged(Notification{
+			Email: f.PatientEmail,
+			Kind:  NotifyFavoriteChanged,
+			Data: map[string]interface{}{
+				"Caregiver":    c.Name,
+				"Changes":      changes,
+				"ShortlistURL": fmt.Sprintf("%s/favorites?email=%s", config.Email.BaseURL, url.QueryEscape(f.PatientEmail)),
+			},
+		})
+	}
+	return nil
+}
+
+// formatFavoriteStar is the star button on a caregiver's match card
+func formatFavoriteStar(viewer, caregiverEmail string, starred bool) string {
+	action, label := "add", "☆ Shortlist"
+	if starred {
+		action, label = "remove", "★ Shortlisted"
+	}
+	return fmt.Sprintf(`<form class="schedule-form" action="favorites" method="POST">
+				<input type="hidden" name="email" value="%s">
+				<input type="hidden" name="caregiver_email" value="%s">
+				<button type="submit" name="action" value="%s">%s</button>
+			</form>`, template.HTMLEscapeString(viewer), template.HTMLEscapeString(caregiverEmail), action, label)
+}
+
+const favoritesTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Shortlist</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Your shortlist</h1>
+            <div class="app-description">Caregivers you've starred. We'll tell you if their rate or availability changes.</div>
+        </div>
+        {{if .Error}}<div class="message system">{{.Error}}</div>{{end}}
+        {{if .Favorites}}
+        <ul class="matches-list">
+            {{range .Favorites}}{{with .Caregiver}}
+            <li class="match-item">
+                <div class="match-details">
+                    <strong>{{.Name}}</strong><br>
+                    <span>📍 Location: {{.Location}}</span><br>
+                    <span>💰 Rate: ${{printf "%.2f" .RateExpectations}}/hour</span><br>
+                    <span>🕒 Availability: {{.Availability}}</span><br>
+                    <span>{{$.Status .Email}}</span><br>
+                    <form class="schedule-form" method="POST">
+                        <input type="hidden" name="email" value="{{$.UserEmail}}">
+                        <input type="hidden" name="caregiver_email" value="{{.Email}}">
+                        <input type="hidden" name="from" value="shortlist">
+                        <button type="submit" name="action" value="remove">Remove from shortlist</button>
+                    </form>
+                </div>
+            </li>
+            {{end}}{{end}}
+        </ul>
+        {{else}}
+        <p>Nobody yet. Star caregivers on your match cards to keep them here.</p>
+        {{end}}
+        <p><a href="./?email={{.UserEmail}}">Back to chat</a></p>
+    </div>
+</body>
+</html>
+`
+
+// favoritesPage is the data behind the shortlist page
+type favoritesPage struct {
+	UserEmail string
+	Favorites []Favorite
+	Error     string
+	statuses  map[string]string
+}
+
+// Status says whether a shortlisted caregiver is taking new families
+func (p favoritesPage) Status(caregiverEmail string) string {
+	return "Currently " + p.statuses[caregiverEmail]
+}
+
+// handleFavorites shows a patient's shortlist on GET. POST stars
+// (action=add) or unstars (action=remove) caregiver_email, then goes back
+// to the shortlist when from=shortlist or to the chat.
+func handleFavorites(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		var err error
+		if r.FormValue("action") == "remove" {
+			err = chatRoom.RemoveFavorite(email, r.FormValue("caregiver_email"))
+		} else {
+			err = chatRoom.AddFavorite(email, r.FormValue("caregiver_email"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		back := "./?email=" + url.QueryEscape(email)
+		if r.FormValue("from") == "shortlist" {
+			back = "favorites?email=" + url.QueryEscape(email)
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	page := favoritesPage{UserEmail: email, statuses: map[string]string{}}
+	favorites, err := chatRoom.Favorites(email)
+	if err != nil {
+		page.Error = err.Error()
+	}
+	for _, f := range favorites {
+		if f.Caregiver == nil {
+			continue // Erased since it was starred
+		}
+		availability, err := chatRoom.GetAvailability(f.CaregiverEmail)
+		if err != nil {
+			log.Printf("Error getting availability for %s: %v", f.CaregiverEmail, err)
+		}
+		page.statuses[f.CaregiverEmail] = shortlistStatus(availability)
+		page.Favorites = append(page.Favorites, f)
+	}
+	renderTemplate(w, "favorites", favoritesTemplate, page)
+}
+
+// handleFavoritesAPI returns a patient's shortlist (GET), or stars (POST)
+// or unstars (DELETE) caregiver_email
+func handleFavoritesAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		favorites, err := chatRoom.Favorites(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, favorites)
+
+	case "POST", "DELETE":
+		var err error
+		if r.Method == "POST" {
+			err = chatRoom.AddFavorite(email, r.FormValue("caregiver_email"))
+		} else {
+			err = chatRoom.RemoveFavorite(email, r.FormValue("caregiver_email"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
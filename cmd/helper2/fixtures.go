@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	recordOpenAI = flag.String("record-openai", "", "Directory to record OpenAI request/response fixtures to")
+	replayOpenAI = flag.String("replay-openai", "", "Directory of OpenAI fixtures to answer from instead of calling the API")
+)
+
+// openAIFixture is one recorded request and its response. The request is
+// kept so fixtures can be read and reviewed; lookups go by its hash.
+type openAIFixture struct {
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Request  json.RawMessage `json:"request"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+}
+
+// fixtureKey identifies a request by its path and body. The body is
+// re-encoded first so that key order and whitespace don't matter.
+func fixtureKey(path string, body []byte) (string, []byte) {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		if canonical, err := json.Marshal(v); err == nil {
+			body = canonical
+		}
+	}
+	sum := sha256.Sum256(append([]byte(path+"\n"), body...))
+	return hex.EncodeToString(sum[:8]), body
+}
+
+// readRequestBody reads a request's body and puts it back for the next reader
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %v", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// recordingTransport passes requests on and saves each exchange as a
+// fixture file named by its key
+type recordingTransport struct {
+	next http.RoundTripper
+	dir  string
+	mu   sync.Mutex // Serialises fixture writes
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	key, canonical := fixtureKey(r.URL.Path, body)
+	fixture := openAIFixture{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Request:  canonical,
+		Status:   resp.StatusCode,
+		Response: respBody,
+	}
+	if !json.Valid(respBody) {
+		fixture.Response, _ = json.Marshal(string(respBody))
+	}
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding fixture %s: %v", key, err)
+		return resp, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := os.WriteFile(filepath.Join(t.dir, key+".json"), data, 0o644); err != nil {
+		log.Printf("Error writing fixture %s: %v", key, err)
+	}
+	return resp, nil
+}
+
+// replayTransport answers requests from fixture files and never touches
+// the network. A request with no fixture fails, naming the file it wanted,
+// so a missing recording is obvious.
+type replayTransport struct {
+	dir string
+}
+
+func (t *replayTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+	key, _ := fixtureKey(r.URL.Path, body)
+	path := filepath.Join(t.dir, key+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no fixture for %s request (%s): %v", r.URL.Path, path, err)
+	}
+	var fixture openAIFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse fixture %s: %v", path, err)
+	}
+	return &http.Response{
+		StatusCode: fixture.Status,
+		Status:     fmt.Sprintf("%d %s", fixture.Status, http.StatusText(fixture.Status)),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(fixture.Response)),
+		Request:    r,
+	}, nil
+}
+
+// useOpenAIFixtures installs the recording or replaying transport the
+// flags ask for. Replaying needs no API key.
+func useOpenAIFixtures(record, replay string) error {
+	switch {
+	case record != "" && replay != "":
+		return fmt.Errorf("-record-openai and -replay-openai can't be used together")
+	case record != "":
+		if err := os.MkdirAll(record, 0o755); err != nil {
+			return fmt.Errorf("failed to create fixture directory: %v", err)
+		}
+		openAICircuit.next = &recordingTransport{next: openAICircuit.transport(), dir: record}
+		log.Printf("Recording OpenAI fixtures to %s", record)
+	case replay != "":
+		openAICircuit.next = &replayTransport{dir: replay}
+		log.Printf("Replaying OpenAI fixtures from %s", replay)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postJSON sends body through client and returns the response status and body
+func postJSON(t *testing.T, client *http.Client, url, body string) (int, []byte, error) {
+	t.Helper()
+	resp, err := client.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data, nil
+}
+
+func TestFixtureRoundTrip(t *testing.T) {
+	calls := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"model":"gpt-4o-mini","choices":[{"message":{"role":"assistant","content":"Hi there"},"finish_reason":"stop"}]}`)
+	}))
+	defer api.Close()
+	dir := t.TempDir()
+
+	recording := &http.Client{Transport: &recordingTransport{next: http.DefaultTransport, dir: dir}}
+	status, recorded, err := postJSON(t, recording, api.URL+"/v1/chat/completions",
+		`{"model":"gpt-4o-mini","messages":[{"role":"user","content":"Hello"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same request, with its keys in another order, is answered from
+	// the fixture without reaching the API
+	replaying := &http.Client{Transport: &replayTransport{dir: dir}}
+	replayStatus, replayed, err := postJSON(t, replaying, api.URL+"/v1/chat/completions",
+		`{"messages": [{"content": "Hello", "role": "user"}], "model": "gpt-4o-mini"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("API called %d times, want 1", calls)
+	}
+	// Fixture files are indented for review, so compare compacted
+	var want, got bytes.Buffer
+	if err := json.Compact(&want, recorded); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Compact(&got, replayed); err != nil {
+		t.Fatalf("replayed invalid JSON %s: %v", replayed, err)
+	}
+	if replayStatus != status || got.String() != want.String() {
+		t.Errorf("replayed %d %s, recorded %d %s", replayStatus, got.String(), status, want.String())
+	}
+
+	if _, _, err := postJSON(t, replaying, api.URL+"/v1/chat/completions",
+		`{"model":"gpt-4o-mini","messages":[{"role":"user","content":"Something else"}]}`); err == nil ||
+		!strings.Contains(err.Error(), "no fixture") {
+		t.Errorf("unrecorded request: got %v, want a missing fixture error", err)
+	}
+}
+
+// testdata/openai holds a recorded exchange in which the model answers a
+// patient by calling find_matching_caregivers
+func TestReplayCheckedInFixture(t *testing.T) {
+	replaying := &http.Client{Transport: &replayTransport{dir: "testdata/openai"}}
+	status, body, err := postJSON(t, replaying, "https://api.openai.com/v1/chat/completions", `{
+		"model": "gpt-4o-mini",
+		"messages": [
+			{"role": "system", "content": "You are a helpful assistant matching caregivers with patients."},
+			{"role": "user", "content": "Can you find me a caregiver in Chicago?"}
+		],
+		"functions": [{"name": "find_matching_caregivers", "parameters": {"type": "object", "properties": {}}}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	var resp ChatResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].Message.FunctionCall == nil ||
+		resp.Choices[0].Message.FunctionCall.Name != "find_matching_caregivers" {
+		t.Errorf("replayed %s, want a find_matching_caregivers call", body)
+	}
+	if resp.Usage == nil || resp.Usage.TotalTokens != 95 {
+		t.Errorf("replayed usage %+v, want 95 tokens", resp.Usage)
+	}
+}
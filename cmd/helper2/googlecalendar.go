@@ -0,0 +1,748 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Caregivers can connect their Google Calendar. Their confirmed bookings
+// are added to it as events, and the events already on it are read back as
+// busy times: a caregiver isn't matched while one is under way, and can't
+// be booked over one. Connecting goes through Google's consent screen with
+// the app's OAuth client, configured from GOOGLE_CLIENT_ID and
+// GOOGLE_CLIENT_SECRET; its redirect URI is <base_url>/oauth/google/callback.
+// The google_calendar job keeps every connected calendar in sync, and
+// bookings are pushed as soon as they're made.
+
+const googleCalendarSchema = `
+	CREATE TABLE IF NOT EXISTS google_calendars (
+		email TEXT PRIMARY KEY,
+		state TEXT,
+		refresh_token TEXT,
+		access_token TEXT,
+		token_expires_at TIMESTAMP,
+		connected_at TIMESTAMP,
+		synced_at TIMESTAMP,
+		sync_error TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_google_calendars_state ON google_calendars(state);
+
+	CREATE TABLE IF NOT EXISTS google_calendar_events (
+		assignment_id INTEGER PRIMARY KEY,
+		email TEXT,
+		event_id TEXT,
+		pushed_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS calendar_busy (
+		email TEXT,
+		start_time TIMESTAMP,
+		end_time TIMESTAMP,
+		PRIMARY KEY (email, start_time, end_time)
+	)
+`
+
+// googleCalendarScope lets the app add events and read the ones there
+const googleCalendarScope = "https://www.googleapis.com/auth/calendar.events"
+
+// errGoogleRevoked means the caregiver withdrew the app's access from
+// their Google account, so they have to connect again
+var errGoogleRevoked = errors.New("Google Calendar access was revoked; connect it again")
+
+// googleCalendar talks to Google's OAuth and Calendar APIs
+type googleCalendar struct {
+	clientID     string
+	clientSecret string
+	client       *http.Client
+	authURL      string
+	tokenURL     string
+	revokeURL    string
+	apiURL       string
+}
+
+// newGoogleCalendar returns nil if no OAuth client is configured
+func newGoogleCalendar() *googleCalendar {
+	clientID, secret := os.Getenv("GOOGLE_CLIENT_ID"), os.Getenv("GOOGLE_CLIENT_SECRET")
+	if clientID == "" || secret == "" {
+		return nil
+	}
+	return &googleCalendar{
+		clientID:     clientID,
+		clientSecret: secret,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		authURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+		tokenURL:     "https://oauth2.googleapis.com/token",
+		revokeURL:    "https://oauth2.googleapis.com/revoke",
+		apiURL:       "https://www.googleapis.com/calendar/v3",
+	}
+}
+
+// redirectURI is where Google sends caregivers back after consenting
+func (g *googleCalendar) redirectURI() string {
+	return config.Email.BaseURL + "/oauth/google/callback"
+}
+
+// AuthCodeURL is Google's consent screen for a connection attempt. Offline
+// access with a forced prompt makes Google return a refresh token, which
+// the sync job needs when the caregiver isn't around.
+func (g *googleCalendar) AuthCodeURL(state string) string {
+	return g.authURL + "?" + url.Values{
+		"client_id":     {g.clientID},
+		"redirect_uri":  {g.redirectURI()},
+		"response_type": {"code"},
+		"scope":         {googleCalendarScope},
+		"access_type":   {"offline"},
+		"prompt":        {"consent"},
+		"state":         {state},
+	}.Encode()
+}
+
+// googleToken is a reply from Google's token endpoint
+type googleToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"` // Only when first connecting
+	ExpiresIn    int    `json:"expires_in"`    // Seconds
+}
+
+// token calls the token endpoint with a grant; an invalid_grant reply
+// gives errGoogleRevoked
+func (g *googleCalendar) token(grant url.Values) (*googleToken, error) {
+	grant.Set("client_id", g.clientID)
+	grant.Set("client_secret", g.clientSecret)
+	resp, err := g.client.PostForm(g.tokenURL, grant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call Google: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Google response: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		var reply struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &reply) == nil && reply.Error == "invalid_grant" {
+			return nil, errGoogleRevoked
+		}
+		return nil, fmt.Errorf("Google token request failed with status %d: %s", resp.StatusCode, body)
+	}
+	var t googleToken
+	if err := json.Unmarshal(body, &t); err != nil {
+		return nil, fmt.Errorf("failed to decode Google token: %v", err)
+	}
+	return &t, nil
+}
+
+// Exchange trades the code from the consent screen for tokens
+func (g *googleCalendar) Exchange(code string) (*googleToken, error) {
+	return g.token(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {g.redirectURI()},
+	})
+}
+
+// Refresh gets a new access token
+func (g *googleCalendar) Refresh(refreshToken string) (*googleToken, error) {
+	return g.token(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+}
+
+// Revoke withdraws a token, which also disconnects the app in the
+// caregiver's Google account
+func (g *googleCalendar) Revoke(token string) error {
+	resp, err := g.client.PostForm(g.revokeURL, url.Values{"token": {token}})
+	if err != nil {
+		return fmt.Errorf("failed to call Google: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Google revoke failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// call sends a Calendar API request and decodes the reply into out
+func (g *googleCalendar) call(method, path, accessToken string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		body = bytes.NewReader(mustMarshal(in))
+	}
+	request, err := http.NewRequest(method, g.apiURL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	if in != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to call Google Calendar: %v", err)
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read Google Calendar response: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Google Calendar %s %s failed with status %d: %s", method, path, resp.StatusCode, reply)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(reply, out); err != nil {
+		return fmt.Errorf("failed to decode Google Calendar response: %v", err)
+	}
+	return nil
+}
+
+// googleEventTime is an event's start or end: a time, or a date for
+// all-day events
+type googleEventTime struct {
+	DateTime string `json:"dateTime,omitempty"`
+	Date     string `json:"date,omitempty"`
+}
+
+// Time reads the start or end; all-day events run midnight to midnight in
+// server time
+func (t googleEventTime) Time() (time.Time, error) {
+	if t.DateTime != "" {
+		return time.Parse(time.RFC3339, t.DateTime)
+	}
+	return time.ParseInLocation("2006-01-02", t.Date, time.Local)
+}
+
+// googleEvent is the part of a Calendar event the app uses
+type googleEvent struct {
+	ID                 string          `json:"id,omitempty"`
+	Status             string          `json:"status,omitempty"`
+	Summary            string          `json:"summary,omitempty"`
+	Description        string          `json:"description,omitempty"`
+	Transparency       string          `json:"transparency,omitempty"` // "transparent" events don't block time
+	Start              googleEventTime `json:"start"`
+	End                googleEventTime `json:"end"`
+	ExtendedProperties struct {
+		Private map[string]string `json:"private,omitempty"`
+	} `json:"extendedProperties"`
+}
+
+// googleBookingProperty marks the events the app added, so they aren't
+// read back as busy time
+const googleBookingProperty = "booking_id"
+
+// BusyBlock is a stretch of time a caregiver's calendar is busy
+type BusyBlock struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Describe formats a busy time for the settings page
+func (b BusyBlock) Describe() string {
+	if b.End.Sub(b.Start) >= 24*time.Hour && b.Start.Hour() == 0 && b.Start.Minute() == 0 {
+		days := int(b.End.Sub(b.Start).Hours() / 24)
+		if days == 1 {
+			return b.Start.Format("Mon Jan 2") + ", all day"
+		}
+		return fmt.Sprintf("%s to %s", b.Start.Format("Mon Jan 2"), b.End.AddDate(0, 0, -1).Format("Mon Jan 2"))
+	}
+	if b.Start.Format("2006-01-02") == b.End.Format("2006-01-02") {
+		return b.Start.Format("Mon Jan 2 3:04 PM") + " – " + b.End.Format("3:04 PM")
+	}
+	return b.Start.Format("Mon Jan 2 3:04 PM") + " – " + b.End.Format("Mon Jan 2 3:04 PM")
+}
+
+// GoogleCalendarLink is a caregiver's Google Calendar connection
+type GoogleCalendarLink struct {
+	Connected   bool        `json:"connected"`
+	ConnectedAt time.Time   `json:"connected_at,omitempty"`
+	SyncedAt    time.Time   `json:"synced_at,omitempty"`
+	SyncError   string      `json:"sync_error,omitempty"`
+	Busy        []BusyBlock `json:"busy"` // Upcoming, soonest first
+}
+
+// googleCalendarRow is a caregiver's stored connection
+type googleCalendarRow struct {
+	email, state, refreshToken, accessToken string
+	expiresAt, connectedAt, syncedAt        time.Time
+	syncError                               string
+}
+
+// googleCalendarRow returns the connection stored where a column has a
+// value, or nil
+func (app *App) googleCalendarRow(column, value string) (*googleCalendarRow, error) {
+	result, err := app.db.Query(`
+		SELECT email, state, refresh_token, access_token, token_expires_at, connected_at, synced_at, sync_error
+		FROM google_calendars WHERE `+column+` = ?
+	`, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Google Calendar connection: %v", err)
+	}
+	defer result.Close()
+
+	var row *googleCalendarRow
+	err = result.Iterate(func(r *chai.Row) error {
+		c := googleCalendarRow{}
+		if err := r.Scan(&c.email, &c.state, &c.refreshToken, &c.accessToken, &c.expiresAt, &c.connectedAt,
+			&c.syncedAt, &c.syncError); err != nil {
+			return fmt.Errorf("failed to scan Google Calendar connection: %v", err)
+		}
+		row = &c
+		return nil
+	})
+	return row, err
+}
+
+// GoogleCalendarStatus returns a caregiver's connection, or nil when
+// Google Calendar isn't configured
+func (app *App) GoogleCalendarStatus(email string) (*GoogleCalendarLink, error) {
+	if app.gcal == nil {
+		return nil, nil
+	}
+	row, err := app.googleCalendarRow("email", email)
+	if err != nil {
+		return nil, err
+	}
+	link := &GoogleCalendarLink{}
+	if row != nil {
+		link.Connected = row.refreshToken != ""
+		link.ConnectedAt, link.SyncedAt, link.SyncError = row.connectedAt, row.syncedAt, row.syncError
+	}
+	link.Busy, err = app.BusyBlocks(email, time.Now(), time.Now().AddDate(0, 0, config.GoogleCalendar.LookaheadDays))
+	return link, err
+}
+
+// ConnectGoogleCalendar starts connecting a caregiver's calendar, returning
+// the consent screen to send them to
+func (app *App) ConnectGoogleCalendar(email string) (string, error) {
+	if app.gcal == nil {
+		return "", fmt.Errorf("Google Calendar isn't set up")
+	}
+	if !app.IsCaregiver(email) {
+		return "", fmt.Errorf("only caregivers can connect a calendar")
+	}
+	state := newUnsubscribeToken()
+	exists, err := rowExists(app.db, "SELECT 1 FROM google_calendars WHERE email = ?", email)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		err = app.db.Exec("UPDATE google_calendars SET state = ? WHERE email = ?", state, email)
+	} else {
+		err = app.db.Exec(`
+			INSERT INTO google_calendars (email, state, refresh_token, access_token, token_expires_at,
+				connected_at, synced_at, sync_error)
+			VALUES (?, ?, '', '', ?, ?, ?, '')
+		`, email, state, time.Time{}, time.Time{}, time.Time{})
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to store Google Calendar connection: %v", err)
+	}
+	return app.gcal.AuthCodeURL(state), nil
+}
+
+// FinishGoogleCalendar completes a connection with the code Google sent
+// back for a state, returning whose calendar it is. An empty code means the
+// caregiver didn't consent.
+func (app *App) FinishGoogleCalendar(state, code string) (string, error) {
+	if app.gcal == nil {
+		return "", fmt.Errorf("Google Calendar isn't set up")
+	}
+	row, err := app.googleCalendarRow("state", state)
+	if err != nil {
+		return "", err
+	}
+	if row == nil || state == "" {
+		return "", fmt.Errorf("this link has expired; connect your calendar again")
+	}
+	if code == "" {
+		err := app.db.Exec("UPDATE google_calendars SET state = '' WHERE email = ?", row.email)
+		return row.email, err
+	}
+	t, err := app.gcal.Exchange(code)
+	if err != nil {
+		return row.email, err
+	}
+	if t.RefreshToken == "" {
+		t.RefreshToken = row.refreshToken
+	}
+	err = app.db.Exec(`
+		UPDATE google_calendars SET state = '', refresh_token = ?, access_token = ?, token_expires_at = ?,
+			connected_at = ?, sync_error = ''
+		WHERE email = ?
+	`, t.RefreshToken, t.AccessToken, time.Now().Add(time.Duration(t.ExpiresIn)*time.Second), time.Now(), row.email)
+	if err != nil {
+		return row.email, fmt.Errorf("failed to store Google Calendar connection: %v", err)
+	}
+	log.Printf("Google Calendar connected for %s", row.email)
+	go app.pushGoogleCalendar(row.email)
+	return row.email, nil
+}
+
+// DisconnectGoogleCalendar forgets a caregiver's calendar and its busy
+// times. The events already added stay on their calendar.
+func (app *App) DisconnectGoogleCalendar(email string) error {
+	row, err := app.googleCalendarRow("email", email)
+	if err != nil {
+		return err
+	}
+	if row != nil && row.refreshToken != "" && app.gcal != nil {
+		if err := app.gcal.Revoke(row.refreshToken); err != nil {
+			log.Printf("Error revoking Google Calendar access for %s: %v", email, err)
+		}
+	}
+	return app.withTx(func(tx *chai.Tx) error {
+		for _, table := range []string{"google_calendars", "google_calendar_events", "calendar_busy"} {
+			if err := tx.Exec("DELETE FROM "+table+" WHERE email = ?", email); err != nil {
+				return fmt.Errorf("failed to disconnect Google Calendar: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// googleAccessToken returns a current access token for a caregiver's
+// calendar, refreshing it when it's about to expire. A revoked connection
+// is marked disconnected.
+func (app *App) googleAccessToken(row *googleCalendarRow) (string, error) {
+	if row.accessToken != "" && time.Until(row.expiresAt) > time.Minute {
+		return row.accessToken, nil
+	}
+	t, err := app.gcal.Refresh(row.refreshToken)
+	if err == errGoogleRevoked {
+		if err := app.db.Exec("UPDATE google_calendars SET refresh_token = '', access_token = '', sync_error = ? WHERE email = ?",
+			errGoogleRevoked.Error(), row.email); err != nil {
+			log.Printf("Error disconnecting Google Calendar for %s: %v", row.email, err)
+		}
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	row.accessToken, row.expiresAt = t.AccessToken, time.Now().Add(time.Duration(t.ExpiresIn)*time.Second)
+	err = app.db.Exec("UPDATE google_calendars SET access_token = ?, token_expires_at = ? WHERE email = ?",
+		row.accessToken, row.expiresAt, row.email)
+	if err != nil {
+		return "", fmt.Errorf("failed to store Google access token: %v", err)
+	}
+	return row.accessToken, nil
+}
+
+// SyncGoogleCalendar adds a caregiver's bookings that aren't on their
+// calendar yet and reads back its busy times for the next few weeks. The
+// outcome is recorded for the settings page.
+func (app *App) SyncGoogleCalendar(email string) error {
+	if app.gcal == nil {
+		return fmt.Errorf("Google Calendar isn't set up")
+	}
+	row, err := app.googleCalendarRow("email", email)
+	if err != nil {
+		return err
+	}
+	if row == nil || row.refreshToken == "" {
+		return fmt.Errorf("no Google Calendar is connected")
+	}
+
+	token, err := app.googleAccessToken(row)
+	if err == errGoogleRevoked {
+		return err
+	}
+	if err == nil {
+		err = app.pushBookings(email, token)
+	}
+	if err == nil {
+		err = app.pullBusyBlocks(email, token)
+	}
+	status := ""
+	if err != nil {
+		status = err.Error()
+	}
+	if err := app.db.Exec("UPDATE google_calendars SET synced_at = ?, sync_error = ? WHERE email = ?",
+		time.Now(), status, email); err != nil {
+		log.Printf("Error recording Google Calendar sync for %s: %v", email, err)
+	}
+	return err
+}
+
+// pushGoogleCalendar syncs a caregiver's calendar, if they've connected
+// one, after their bookings changed
+func (app *App) pushGoogleCalendar(email string) {
+	if app.gcal == nil {
+		return
+	}
+	connected, err := rowExists(app.db, "SELECT 1 FROM google_calendars WHERE email = ? AND refresh_token != ''", email)
+	if err != nil || !connected {
+		return
+	}
+	if err := app.SyncGoogleCalendar(email); err != nil {
+		log.Printf("Error syncing Google Calendar for %s: %v", email, err)
+	}
+}
+
+// pushBookings adds a caregiver's scheduled bookings from today on that
+// aren't on their calendar yet
+func (app *App) pushBookings(email, token string) error {
+	bookings, err := app.GetCaregiverSchedule(email, time.Now().AddDate(0, 0, -1), time.Now().AddDate(10, 0, 0))
+	if err != nil {
+		return err
+	}
+	for _, b := range bookings {
+		if b.Status != "scheduled" {
+			continue
+		}
+		pushed, err := rowExists(app.db, "SELECT 1 FROM google_calendar_events WHERE assignment_id = ?", b.ID)
+		if err != nil {
+			return err
+		}
+		if pushed {
+			continue
+		}
+
+		event := googleEvent{
+			Summary: fmt.Sprintf("Care for %s", app.displayName(b.PatientEmail)),
+			Description: fmt.Sprintf("Booked through %s. %s/match?email=%s&caregiver_email=%s&patient_email=%s",
+				config.Branding.Name, config.Email.BaseURL, url.QueryEscape(email), url.QueryEscape(email),
+				url.QueryEscape(b.PatientEmail)),
+			Start: googleEventTime{DateTime: b.StartTime.Format(time.RFC3339)},
+			End:   googleEventTime{DateTime: b.EndTime.Format(time.RFC3339)},
+		}
+		event.ExtendedProperties.Private = map[string]string{googleBookingProperty: strconv.FormatInt(b.ID, 10)}
+		var created googleEvent
+		if err := app.gcal.call("POST", "/calendars/primary/events", token, event, &created); err != nil {
+			return err
+		}
+		err = app.db.Exec("INSERT INTO google_calendar_events (assignment_id, email, event_id, pushed_at) VALUES (?, ?, ?, ?)",
+			b.ID, email, created.ID, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to record Google Calendar event: %v", err)
+		}
+	}
+	return nil
+}
+
+// pullBusyBlocks replaces a caregiver's busy times with the events on their
+// calendar over the lookahead, except free time and the app's own bookings
+func (app *App) pullBusyBlocks(email, token string) error {
+	from, to := time.Now(), time.Now().AddDate(0, 0, config.GoogleCalendar.LookaheadDays)
+	query := url.Values{
+		"timeMin":      {from.UTC().Format(time.RFC3339)},
+		"timeMax":      {to.UTC().Format(time.RFC3339)},
+		"singleEvents": {"true"},
+		"orderBy":      {"startTime"},
+		"maxResults":   {"250"},
+	}
+	var blocks []BusyBlock
+	for {
+		var page struct {
+			Items         []googleEvent `json:"items"`
+			NextPageToken string        `json:"nextPageToken"`
+		}
+		if err := app.gcal.call("GET", "/calendars/primary/events?"+query.Encode(), token, nil, &page); err != nil {
+			return err
+		}
+		for _, e := range page.Items {
+			if e.Status == "cancelled" || e.Transparency == "transparent" || e.ExtendedProperties.Private[googleBookingProperty] != "" {
+				continue
+			}
+			start, err := e.Start.Time()
+			if err != nil {
+				continue
+			}
+			end, err := e.End.Time()
+			if err != nil || !end.After(start) {
+				continue
+			}
+			blocks = append(blocks, BusyBlock{Start: start, End: end})
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+
+	return app.withTx(func(tx *chai.Tx) error {
+		if err := tx.Exec("DELETE FROM calendar_busy WHERE email = ?", email); err != nil {
+			return fmt.Errorf("failed to clear busy times: %v", err)
+		}
+		for _, b := range blocks {
+			err := tx.Exec(`
+				INSERT INTO calendar_busy (email, start_time, end_time) VALUES (?, ?, ?)
+				ON CONFLICT DO NOTHING
+			`, email, b.Start, b.End)
+			if err != nil {
+				return fmt.Errorf("failed to store busy time: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// BusyBlocks lists the busy times on a caregiver's calendar that overlap
+// [from, to), soonest first
+func (app *App) BusyBlocks(email string, from, to time.Time) ([]BusyBlock, error) {
+	result, err := app.db.Query(`
+		SELECT email, start_time, end_time FROM calendar_busy
+		WHERE email = ? AND start_time < ? AND end_time > ?
+		ORDER BY start_time
+	`, email, to, from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query busy times: %v", err)
+	}
+	defer result.Close()
+
+	blocks := []BusyBlock{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var b BusyBlock
+		var owner string
+		if err := r.Scan(&owner, &b.Start, &b.End); err != nil {
+			return fmt.Errorf("failed to scan busy time: %v", err)
+		}
+		blocks = append(blocks, b)
+		return nil
+	})
+	return blocks, err
+}
+
+// busyCaregivers returns the caregivers whose calendar is busy at t
+func (app *App) busyCaregivers(t time.Time) (map[string]bool, error) {
+	result, err := app.db.Query("SELECT email FROM calendar_busy WHERE start_time <= ? AND end_time > ?", t, t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query busy caregivers: %v", err)
+	}
+	defer result.Close()
+
+	busy := map[string]bool{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		if err := r.Scan(&email); err != nil {
+			return fmt.Errorf("failed to scan busy caregiver: %v", err)
+		}
+		busy[email] = true
+		return nil
+	})
+	return busy, err
+}
+
+// googleCalendarJob syncs every connected calendar
+func (app *App) googleCalendarJob() error {
+	if app.gcal == nil {
+		return nil
+	}
+	result, err := app.db.Query("SELECT email FROM google_calendars WHERE refresh_token != ''")
+	if err != nil {
+		return fmt.Errorf("failed to query Google Calendar connections: %v", err)
+	}
+	var emails []string
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		if err := r.Scan(&email); err != nil {
+			return fmt.Errorf("failed to scan Google Calendar connection: %v", err)
+		}
+		emails = append(emails, email)
+		return nil
+	})
+	result.Close()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, email := range emails {
+		if err := app.SyncGoogleCalendar(email); err != nil {
+			log.Printf("Error syncing Google Calendar for %s: %v", email, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to sync %d of %d Google Calendars", failed, len(emails))
+	}
+	return nil
+}
+
+// handleGoogleCalendar connects (action=connect), syncs (action=sync) or
+// disconnects (action=disconnect) a caregiver's Google Calendar from the
+// calendar settings page
+func handleGoogleCalendar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	var err error
+	switch r.FormValue("action") {
+	case "connect":
+		var consent string
+		if consent, err = chatRoom.ConnectGoogleCalendar(email); err == nil {
+			http.Redirect(w, r, consent, http.StatusSeeOther)
+			return
+		}
+	case "sync":
+		err = chatRoom.SyncGoogleCalendar(email)
+	case "disconnect":
+		err = chatRoom.DisconnectGoogleCalendar(email)
+	default:
+		err = fmt.Errorf("unknown action")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("calendar?email=%s", url.QueryEscape(email)), http.StatusSeeOther)
+}
+
+// handleGoogleCallback is where Google's consent screen returns to
+func handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
+	email, err := chatRoom.FinishGoogleCalendar(r.FormValue("state"), r.FormValue("code"))
+	if err != nil {
+		log.Printf("Error connecting Google Calendar: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/calendar?email=%s", url.QueryEscape(email)), http.StatusSeeOther)
+}
+
+// handleGoogleCalendarAPI returns a caregiver's connection and upcoming
+// busy times (GET), syncs it now (POST) or disconnects it (DELETE)
+func handleGoogleCalendarAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if chatRoom.gcal == nil {
+		http.Error(w, "Google Calendar isn't set up", http.StatusNotFound)
+		return
+	}
+	var err error
+	switch r.Method {
+	case "GET":
+	case "POST":
+		err = chatRoom.SyncGoogleCalendar(email)
+	case "DELETE":
+		err = chatRoom.DisconnectGoogleCalendar(email)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	link, err := chatRoom.GoogleCalendarStatus(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, link)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// A user can ask for a person instead of the assistant, with /human, the
+// button on the chat page or by asking the assistant, and a message the
+// safety screen flags asks on their behalf. The conversation joins the live
+// queue at /admin/live, where an admin takes it over. While an admin has
+// it the assistant stays quiet, and the admin's messages appear in the chat
+// as "staff" rather than "assistant". Closing the handoff gives the
+// conversation back to the assistant.
+
+const handoffsSchema = `
+	CREATE TABLE IF NOT EXISTS handoffs (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		reason TEXT,
+		detail TEXT,
+		status TEXT,
+		agent TEXT,
+		requested_at TIMESTAMP,
+		taken_at TIMESTAMP,
+		closed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_handoffs_email ON handoffs(email);
+	CREATE INDEX IF NOT EXISTS idx_handoffs_status ON handoffs(status)
+`
+
+// Handoff statuses
+const (
+	HandoffWaiting = "waiting" // In the live queue
+	HandoffActive  = "active"  // An admin has taken over
+	HandoffClosed  = "closed"  // Back with the assistant
+)
+
+// Why a handoff was asked for
+const (
+	HandoffByUser   = "user"
+	HandoffBySafety = "safety"
+)
+
+// staffRole is the chat_history role of messages an admin writes during a
+// handoff
+const staffRole = "staff"
+
+var requestHumanFunction = map[string]interface{}{
+	"name":        "request_human",
+	"description": "Ask a person from the team to join the conversation, when the user wants to talk to a human rather than the assistant",
+	"parameters": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"reason": map[string]interface{}{
+				"type":        "string",
+				"description": "What the user wants help with, in a few words",
+			},
+		},
+	},
+}
+
+// liveQueuePreview is how many recent messages the live queue shows of
+// each conversation
+const liveQueuePreview = 10
+
+// Handoff is a conversation passed from the assistant to a person
+type Handoff struct {
+	ID          string    `json:"id"`
+	Email       string    `json:"email"`
+	Reason      string    `json:"reason"`
+	Detail      string    `json:"detail,omitempty"`
+	Status      string    `json:"status"`
+	Agent       string    `json:"agent,omitempty"` // The admin who took it over
+	RequestedAt time.Time `json:"requested_at"`
+	TakenAt     time.Time `json:"taken_at,omitempty"`
+	ClosedAt    time.Time `json:"closed_at,omitempty"`
+}
+
+const handoffColumns = "id, email, reason, detail, status, agent, requested_at, taken_at, closed_at"
+
+func scanHandoffs(result *chai.Result) ([]Handoff, error) {
+	defer result.Close()
+	var handoffs []Handoff
+	err := result.Iterate(func(r *chai.Row) error {
+		var h Handoff
+		if err := r.Scan(&h.ID, &h.Email, &h.Reason, &h.Detail, &h.Status, &h.Agent,
+			&h.RequestedAt, &h.TakenAt, &h.ClosedAt); err != nil {
+			return fmt.Errorf("failed to scan handoff: %v", err)
+		}
+		handoffs = append(handoffs, h)
+		return nil
+	})
+	return handoffs, err
+}
+
+// OpenHandoff returns a user's waiting or active handoff, or nil
+func (app *App) OpenHandoff(email string) (*Handoff, error) {
+	result, err := app.db.Query("SELECT "+handoffColumns+" FROM handoffs WHERE email = ? AND status IN (?, ?)",
+		email, HandoffWaiting, HandoffActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query handoffs: %v", err)
+	}
+	handoffs, err := scanHandoffs(result)
+	if err != nil || len(handoffs) == 0 {
+		return nil, err
+	}
+	return &handoffs[0], nil
+}
+
+// getHandoff returns a handoff by id, or nil
+func (app *App) getHandoff(id string) (*Handoff, error) {
+	result, err := app.db.Query("SELECT "+handoffColumns+" FROM handoffs WHERE id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query handoffs: %v", err)
+	}
+	handoffs, err := scanHandoffs(result)
+	if err != nil || len(handoffs) == 0 {
+		return nil, err
+	}
+	return &handoffs[0], nil
+}
+
+// StaffHandling reports whether an admin has taken over a user's
+// conversation, so the assistant shouldn't answer
+func (app *App) StaffHandling(email string) bool {
+	h, err := app.OpenHandoff(email)
+	if err != nil {
+		log.Printf("Error checking handoff for %s: %v", email, err)
+		return false
+	}
+	return h != nil && h.Status == HandoffActive
+}
+
+// RequestHandoff puts a user's conversation in the live queue, unless it's
+// there already. created is false when an open handoff was returned.
+func (app *App) RequestHandoff(email, reason, detail string) (h *Handoff, created bool, err error) {
+	if h, err = app.OpenHandoff(email); err != nil || h != nil {
+		return h, false, err
+	}
+	h = &Handoff{
+		ID:          newAttachmentID(),
+		Email:       email,
+		Reason:      reason,
+		Detail:      detail,
+		Status:      HandoffWaiting,
+		RequestedAt: time.Now(),
+	}
+	err = app.db.Exec(`
+		INSERT INTO handoffs (`+handoffColumns+`)
+		VALUES (?, ?, ?, ?, ?, '', ?, ?, ?)
+	`, h.ID, h.Email, h.Reason, h.Detail, h.Status, h.RequestedAt, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to store handoff: %v", err)
+	}
+	app.events.Publish(EventHandoffRequested, map[string]interface{}{
+		"id":     h.ID,
+		"email":  email,
+		"reason": reason,
+	})
+	return h, true, nil
+}
+
+// requestHandoffReply asks for a person for a user and words the answer
+func (app *App) requestHandoffReply(email, reason, detail string) string {
+	h, created, err := app.RequestHandoff(email, reason, detail)
+	switch {
+	case err != nil:
+		log.Printf("Error requesting handoff for %s: %v", email, err)
+		return "Sorry, I couldn't reach our team just now. Please try again in a moment."
+	case h.Status == HandoffActive:
+		return "You're already talking with a person from our team."
+	case !created:
+		return "A person from our team has already been asked to join and will reply here soon."
+	}
+	return "I've asked a person from our team to join this conversation. They'll reply here; until then I'm happy to keep helping."
+}
+
+// LiveQueue lists waiting and active handoffs, oldest first
+func (app *App) LiveQueue() ([]Handoff, error) {
+	result, err := app.db.Query("SELECT "+handoffColumns+" FROM handoffs WHERE status IN (?, ?) ORDER BY requested_at",
+		HandoffWaiting, HandoffActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query handoffs: %v", err)
+	}
+	return scanHandoffs(result)
+}
+
+// TakeHandoff has an admin take over a waiting conversation
+func (app *App) TakeHandoff(id, agent string) error {
+	h, err := app.getHandoff(id)
+	if err != nil {
+		return err
+	}
+	if h == nil || h.Status != HandoffWaiting {
+		return fmt.Errorf("no waiting handoff %s", id)
+	}
+	err = app.db.Exec("UPDATE handoffs SET status = ?, agent = ?, taken_at = ? WHERE id = ?",
+		HandoffActive, agent, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to take handoff: %v", err)
+	}
+	greeting := fmt.Sprintf("Hi, this is a person from the %s team. I've joined the conversation and the assistant will stay quiet until we're done.",
+		config.Branding.Name)
+	return app.AddMessageWithRecipient(h.Email, staffRole, greeting, adminThread)
+}
+
+// SendStaffMessage posts an admin's message in a conversation they've
+// taken over
+func (app *App) SendStaffMessage(id, agent, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return fmt.Errorf("message cannot be empty")
+	}
+	h, err := app.getHandoff(id)
+	if err != nil {
+		return err
+	}
+	if h == nil || h.Status != HandoffActive {
+		return fmt.Errorf("no active handoff %s", id)
+	}
+	if h.Agent != agent {
+		return fmt.Errorf("%s is handling this conversation", h.Agent)
+	}
+	// Chat messages are shown as HTML, and this one is plain text
+	return app.AddMessageWithRecipient(h.Email, staffRole, html.EscapeString(text), adminThread)
+}
+
+// CloseHandoff gives a conversation back to the assistant
+func (app *App) CloseHandoff(id string) error {
+	h, err := app.getHandoff(id)
+	if err != nil {
+		return err
+	}
+	if h == nil || h.Status == HandoffClosed {
+		return fmt.Errorf("no open handoff %s", id)
+	}
+	err = app.db.Exec("UPDATE handoffs SET status = ?, closed_at = ? WHERE id = ?", HandoffClosed, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to close handoff: %v", err)
+	}
+	if h.Status != HandoffActive {
+		return nil
+	}
+	return app.AddMessageWithRecipient(h.Email, "assistant",
+		"You're back with the assistant. Send /human any time to talk to a person again.", adminThread)
+}
+
+// applyHandoffAction takes, replies in or closes a handoff for an admin
+func applyHandoffAction(r *http.Request, actor, id, action, message string) error {
+	var err error
+	switch action {
+	case "take":
+		err = chatRoom.TakeHandoff(id, actor)
+	case "reply":
+		err = chatRoom.SendStaffMessage(id, actor, message)
+	case "close":
+		err = chatRoom.CloseHandoff(id)
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		return err
+	}
+	if action != "reply" {
+		chatRoom.Audit(r, actor, "handoff."+action, id, "")
+	}
+	return nil
+}
+
+// liveQueueEntry is a handoff with the end of its conversation
+type liveQueueEntry struct {
+	Handoff
+	Messages []HistoryMessage
+}
+
+const adminLiveTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Live queue</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Live queue</h1>
+            <div class="app-description">Conversations waiting for a person · <a href="live?email={{.UserEmail}}">Refresh</a></div>
+        </div>
+        {{range .Entries}}
+        <div class="calendar-event">
+            <strong>{{.Email}}</strong> · {{if eq .Reason "safety"}}<strong>flagged by the safety screen ({{.Detail}})</strong>{{else}}asked for a person{{end}}
+            · {{.RequestedAt.Format "Jan 2 3:04 PM"}}
+            · {{if eq .Status "active"}}handled by {{.Agent}}{{else}}waiting{{end}}
+            {{range .Messages}}
+            <div class="message {{.Role}}"><strong>{{.Role}}:</strong> {{.Content | safeHTML}}</div>
+            {{end}}
+            <form class="schedule-form" method="POST" action="live">
+                <input type="hidden" name="email" value="{{$.UserEmail}}">
+                <input type="hidden" name="id" value="{{.ID}}">
+                {{if eq .Status "waiting"}}
+                <button type="submit" name="action" value="take">Take over</button>
+                {{else if eq .Agent $.UserEmail}}
+                <input type="text" name="message" placeholder="Reply as staff" class="message-input">
+                <button type="submit" name="action" value="reply">Send</button>
+                {{end}}
+                <button type="submit" name="action" value="close">Hand back to the assistant</button>
+            </form>
+        </div>
+        {{else}}
+        <p>Nobody is waiting.</p>
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// handleAdminLive shows the live queue and takes admins' actions on it
+func handleAdminLive(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	if r.Method == "POST" {
+		if err := applyHandoffAction(r, admin, r.FormValue("id"), r.FormValue("action"), r.FormValue("message")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "live?email="+url.QueryEscape(admin), http.StatusSeeOther)
+		return
+	}
+
+	queue, err := chatRoom.LiveQueue()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries := make([]liveQueueEntry, len(queue))
+	for i, h := range queue {
+		entries[i].Handoff = h
+		page, err := chatRoom.MessagePage(h.Email, adminThread, time.Time{}, liveQueuePreview)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries[i].Messages = page.Messages
+	}
+	renderTemplate(w, "live", adminLiveTemplate, struct {
+		UserEmail string
+		Entries   []liveQueueEntry
+	}{admin, entries})
+}
+
+// handleHandoffsAPI lists the live queue (GET) and takes, replies in or
+// closes a handoff from a JSON body {"id", "action": "take"|"reply"|"close",
+// "message"} (POST)
+func handleHandoffsAPI(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		queue, err := chatRoom.LiveQueue()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, queue)
+
+	case "POST":
+		var req struct {
+			ID      string `json:"id"`
+			Action  string `json:"action"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := applyHandoffAction(r, actor, req.ID, req.Action, req.Message); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
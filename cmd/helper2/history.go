@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// messagePageSize is how many messages the chat page and the history API
+// return per page unless asked for fewer
+const messagePageSize = 50
+
+// maxMessagePageSize caps the limit parameter of the history API
+const maxMessagePageSize = 200
+
+// HistoryMessage is a message as returned by the history API
+type HistoryMessage struct {
+	From      string    `json:"from,omitempty"` // The sender, in direct messages
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	Recipient string    `json:"recipient,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MessagePage is one page of history, oldest first. Passing NextCursor as
+// before fetches the page preceding it; it is empty on the oldest page.
+type MessagePage struct {
+	Messages   []HistoryMessage `json:"messages"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// Cursors are opaque to clients; they encode the created_at of the oldest
+// message already seen, which is unique per thread
+func encodeCursor(t time.Time) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(t.UnixNano(), 10)))
+}
+
+func decodeCursor(cursor string) (time.Time, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cursor")
+	}
+	nanos, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cursor")
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// MessagePage returns up to limit of the messages in one of a user's
+// threads older than before, or the latest when before is zero. The admin
+// thread pages the active conversation with the assistant; a peer's thread
+// pages the direct messages between the two. Only live chat_history is
+// paged; compacted messages are available through the export.
+func (app *App) MessagePage(email, thread string, before time.Time, limit int) (*MessagePage, error) {
+	where, args, err := app.threadFilter(email, thread)
+	if err != nil {
+		return nil, err
+	}
+	if !before.IsZero() {
+		where += " AND created_at < ?"
+		args = append(args, before)
+	}
+	query := `
+		SELECT email, role, content, recipient, created_at
+		FROM chat_history
+		WHERE ` + where + `
+		ORDER BY created_at DESC
+		LIMIT ?
+	`
+	args = append(args, limit+1)
+
+	result, err := app.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chat history: %v", err)
+	}
+	defer result.Close()
+
+	var messages []HistoryMessage
+	err = result.Iterate(func(r *chai.Row) error {
+		// Scanned by name: with the OR of a direct message thread, chai
+		// returns the columns in table order rather than as selected
+		var m HistoryMessage
+		for column, dest := range map[string]interface{}{
+			"email":      &m.From,
+			"role":       &m.Role,
+			"content":    &m.Content,
+			"recipient":  &m.Recipient,
+			"created_at": &m.CreatedAt,
+		} {
+			if err := r.ScanColumn(column, dest); err != nil {
+				return fmt.Errorf("failed to scan message: %v", err)
+			}
+		}
+		if thread == adminThread {
+			m.From = ""
+		}
+		messages = append(messages, m)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate chat history: %v", err)
+	}
+
+	// The extra row only tells us whether an older page exists
+	page := &MessagePage{}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		page.NextCursor = encodeCursor(messages[limit-1].CreatedAt)
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	page.Messages = messages
+	return page, nil
+}
+
+// handleMessagesAPI serves /api/v1/messages?email=...&before=<cursor>&limit=50,
+// with &thread=<peer email> for direct messages instead of the assistant
+func handleMessagesAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	thread := r.URL.Query().Get("thread")
+	if thread == "" {
+		thread = adminThread
+	}
+
+	limit := messagePageSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if n > maxMessagePageSize {
+			n = maxMessagePageSize
+		}
+		limit = n
+	}
+
+	var before time.Time
+	if cursor := r.URL.Query().Get("before"); cursor != "" {
+		var err error
+		if before, err = decodeCursor(cursor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := chatRoom.MessagePage(email, thread, before, limit)
+	if err != nil {
+		log.Printf("Error loading message page: %v", err)
+		http.Error(w, "Failed to load messages", http.StatusInternalServerError)
+		return
+	}
+	var modified time.Time
+	for _, m := range page.Messages {
+		modified = latest(modified, m.CreatedAt)
+	}
+	writeJSONCached(w, r, page, modified)
+}
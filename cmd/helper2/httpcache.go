@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"time"
+)
+
+// contentETag is a strong validator for a response body
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// writeJSONCached writes v like writeJSON, but supports conditional
+// requests: the ETag is a hash of the encoded response, and modified, when
+// known, is sent as Last-Modified. A client that already has this version
+// gets 304 Not Modified and no body. Responses are per user, so shared
+// caches mustn't keep them, and clients must revalidate before reuse.
+func writeJSONCached(w http.ResponseWriter, r *http.Request, v interface{}, modified time.Time) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", contentETag(body))
+	// ServeContent answers If-None-Match and If-Modified-Since from these
+	// headers; a zero modified time sends no Last-Modified
+	http.ServeContent(w, r, "", modified.UTC().Truncate(time.Second), bytes.NewReader(body))
+}
+
+// latest returns the newest of times
+func latest(times ...time.Time) time.Time {
+	var t time.Time
+	for _, c := range times {
+		if c.After(t) {
+			t = c
+		}
+	}
+	return t
+}
+
+// withStaticETags sets an ETag on every embedded file before next serves
+// it. Embedded files have no modification time, so without one clients
+// re-download unchanged assets; http.FileServer honours If-None-Match
+// against the header set here.
+func withStaticETags(files fs.FS, next http.Handler) http.Handler {
+	etags := make(map[string]string)
+	fs.WalkDir(files, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if data, err := fs.ReadFile(files, path); err == nil {
+			etags["/"+path] = contentETag(data)
+		}
+		return nil
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if len(path) == 0 || path[0] != '/' {
+			path = "/" + path
+		}
+		if etag, ok := etags[path]; ok {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
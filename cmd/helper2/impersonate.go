@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+	"github.com/rfielding/helper2/internal/server"
+)
+
+// Support staff can see the app as a user sees it. Starting impersonation
+// sets a cookie naming a server-side record; while it's valid and the
+// admin who started it is still signed in, requests for the impersonated
+// user's email carry the impersonation, the chat page
+// shows a banner, and every page view and change is audited. Read-only
+// impersonation refuses anything but reads.
+
+const impersonationsSchema = `
+	CREATE TABLE IF NOT EXISTS impersonations (
+		token TEXT PRIMARY KEY,
+		admin TEXT,
+		email TEXT,
+		mode TEXT,
+		started_at TIMESTAMP,
+		expires_at TIMESTAMP
+	)
+`
+
+// Impersonation modes
+const (
+	ImpersonateReadOnly = "read"
+	ImpersonateFull     = "full"
+)
+
+// impersonationTTL is how long an impersonation lasts unless ended sooner
+const impersonationTTL = time.Hour
+
+const impersonationCookie = "impersonation"
+
+// Impersonation is an admin viewing the app as another user
+type Impersonation struct {
+	Token     string    `json:"-"`
+	Admin     string    `json:"admin"`
+	Email     string    `json:"email"`
+	Mode      string    `json:"mode"`
+	StartedAt time.Time `json:"started_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (i *Impersonation) ReadOnly() bool {
+	return i.Mode != ImpersonateFull
+}
+
+type impersonationKey struct{}
+
+// impersonationFrom returns the impersonation a request is made under, or nil
+func impersonationFrom(r *http.Request) *Impersonation {
+	i, _ := r.Context().Value(impersonationKey{}).(*Impersonation)
+	return i
+}
+
+// StartImpersonation opens an impersonation of email by admin
+func (app *App) StartImpersonation(admin, email, mode string) (*Impersonation, error) {
+	if mode != ImpersonateReadOnly && mode != ImpersonateFull {
+		return nil, fmt.Errorf("mode must be %q or %q", ImpersonateReadOnly, ImpersonateFull)
+	}
+	if email == "" || strings.EqualFold(email, admin) {
+		return nil, fmt.Errorf("choose another user to impersonate")
+	}
+	if app.isFirstContact(email) {
+		return nil, fmt.Errorf("%s has never used the app", email)
+	}
+
+	b := make([]byte, 24)
+	rand.Read(b)
+	now := time.Now()
+	i := &Impersonation{
+		Token:     hex.EncodeToString(b),
+		Admin:     admin,
+		Email:     email,
+		Mode:      mode,
+		StartedAt: now,
+		ExpiresAt: now.Add(impersonationTTL),
+	}
+	err := app.db.Exec(`
+		INSERT INTO impersonations (token, admin, email, mode, started_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, i.Token, i.Admin, i.Email, i.Mode, i.StartedAt, i.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start impersonation: %v", err)
+	}
+	return i, nil
+}
+
+// GetImpersonation returns the live impersonation with token, or nil
+func (app *App) GetImpersonation(token string) (*Impersonation, error) {
+	result, err := app.db.Query(`
+		SELECT token, admin, email, mode, started_at, expires_at
+		FROM impersonations WHERE token = ?
+	`, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query impersonation: %v", err)
+	}
+	defer result.Close()
+
+	var found *Impersonation
+	err = result.Iterate(func(r *chai.Row) error {
+		var i Impersonation
+		if err := r.Scan(&i.Token, &i.Admin, &i.Email, &i.Mode, &i.StartedAt, &i.ExpiresAt); err != nil {
+			return fmt.Errorf("failed to scan impersonation: %v", err)
+		}
+		found = &i
+		return nil
+	})
+	if err != nil || found == nil || time.Now().After(found.ExpiresAt) {
+		return nil, err
+	}
+	return found, nil
+}
+
+// EndImpersonation closes an impersonation
+func (app *App) EndImpersonation(token string) error {
+	if err := app.db.Exec("DELETE FROM impersonations WHERE token = ?", token); err != nil {
+		return fmt.Errorf("failed to end impersonation: %v", err)
+	}
+	return nil
+}
+
+// impersonationBy returns the live impersonation named by the request's
+// cookie if admin started it, or nil
+func impersonationBy(r *http.Request, admin string) *Impersonation {
+	cookie, err := r.Cookie(impersonationCookie)
+	if err != nil || cookie.Value == "" || !isAdmin(admin) {
+		return nil
+	}
+	i, err := chatRoom.GetImpersonation(cookie.Value)
+	if err != nil {
+		log.Printf("Error loading impersonation: %v", err)
+	}
+	if i == nil || !strings.EqualFold(admin, i.Admin) {
+		return nil
+	}
+	return i
+}
+
+// auditedImpersonationRequest reports whether a request made while
+// impersonating is worth an audit entry: any change, and page views, but
+// not the background reads a page makes
+func auditedImpersonationRequest(r *http.Request) bool {
+	if !server.IsSafeMethod(r.Method) {
+		return true
+	}
+	return !strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/static/") &&
+		r.URL.Path != "/avatar"
+}
+
+// withImpersonation attaches an admin's impersonation to requests for the
+// impersonated user, refuses changes under a read-only one, and audits
+func withImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(impersonationCookie)
+		if err != nil || cookie.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		i, err := chatRoom.GetImpersonation(cookie.Value)
+		if err != nil {
+			log.Printf("Error loading impersonation: %v", err)
+		}
+		// Signing out ends what the admin's session started
+		if i == nil || !strings.EqualFold(signedInAdmin(r), i.Admin) {
+			http.SetCookie(w, &http.Cookie{Name: impersonationCookie, Path: "/", MaxAge: -1})
+			next.ServeHTTP(w, r)
+			return
+		}
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			email = r.FormValue("email")
+		}
+		if !strings.EqualFold(email, i.Email) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		detail := r.Method + " " + r.URL.Path
+		if i.ReadOnly() && !server.IsSafeMethod(r.Method) {
+			chatRoom.Audit(r, i.Admin, "impersonation.blocked", i.Email, detail)
+			http.Error(w, "This is a read-only impersonation; nothing can be changed", http.StatusForbidden)
+			return
+		}
+		if auditedImpersonationRequest(r) {
+			chatRoom.Audit(r, i.Admin, "impersonation.request", i.Email, detail)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), impersonationKey{}, i)))
+	})
+}
+
+// handleImpersonate starts (action=start with target and mode) or ends
+// (action=end) the admin's impersonation
+func handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "start":
+		i, err := chatRoom.StartImpersonation(admin, r.FormValue("target"), r.FormValue("mode"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chatRoom.Audit(r, admin, "impersonation.start", i.Email, "mode "+i.Mode)
+		http.SetCookie(w, &http.Cookie{
+			Name:     impersonationCookie,
+			Value:    i.Token,
+			Path:     "/",
+			Expires:  i.ExpiresAt,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Redirect(w, r, "../?email="+url.QueryEscape(i.Email), http.StatusSeeOther)
+
+	case "end":
+		if cookie, err := r.Cookie(impersonationCookie); err == nil && cookie.Value != "" {
+			if i, err := chatRoom.GetImpersonation(cookie.Value); err == nil && i != nil {
+				chatRoom.Audit(r, admin, "impersonation.end", i.Email, "")
+			}
+			if err := chatRoom.EndImpersonation(cookie.Value); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		http.SetCookie(w, &http.Cookie{Name: impersonationCookie, Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "users?email="+url.QueryEscape(admin), http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
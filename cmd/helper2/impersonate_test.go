@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImpersonationNeedsAdminSession(t *testing.T) {
+	t.Setenv("ADMIN_EMAILS", "admin@example.com")
+	app := newTestApp(t)
+	handler := newRouter()
+	if err := app.AddMessageWithRecipient("user@example.com", "user", "Hello", adminThread); err != nil {
+		t.Fatal(err)
+	}
+	i, err := app.StartImpersonation("admin@example.com", "user@example.com", ImpersonateReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	impersonating := func(session string) (int, bool) {
+		req := httptest.NewRequest("GET", "/?email=user@example.com", nil)
+		req.AddCookie(&http.Cookie{Name: impersonationCookie, Value: i.Token})
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: loginCookie, Value: session})
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, strings.Contains(rec.Body.String(), `class="impersonation-banner"`)
+	}
+
+	if code, _ := impersonating(""); code != http.StatusUnauthorized {
+		t.Errorf("impersonation cookie without a session: got %d, want 401", code)
+	}
+	if code, _ := impersonating(signIn(t, app, "other-admin@example.com")); code != http.StatusForbidden {
+		t.Errorf("impersonation cookie in a non-admin's session: got %d, want 403", code)
+	}
+	if code, banner := impersonating(signIn(t, app, "admin@example.com")); code != http.StatusOK || !banner {
+		t.Errorf("impersonation cookie in the admin's own session: got %d, banner %v", code, banner)
+	}
+
+	// Nor can an impersonation be started by naming an admin's email
+	req := httptest.NewRequest("POST", "/admin/impersonate",
+		strings.NewReader("email=admin@example.com&action=start&target=user@example.com&mode=full"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://example.com")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("starting impersonation without a session: got %d, want 401", rec.Code)
+	}
+}
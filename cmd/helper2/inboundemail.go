@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Users can answer a notification email by replying to it. With a reply
+// address configured, each email's Reply-To is that address plus-addressed
+// with the send's id, e.g. reply+3f2a...@in.example.com. The id says who
+// the email went to and which thread a reply belongs in: a reply to a
+// direct message notification goes to the person who sent the message,
+// and anything else goes to the assistant. Mail clients that drop the
+// plus-address still send In-Reply-To, which is matched against the
+// provider's message id. Replies are only taken from the address the email
+// was sent to, and quoted text is cut off.
+
+const emailReplyThreadsSchema = `
+	CREATE TABLE IF NOT EXISTS email_reply_threads (
+		send_id TEXT PRIMARY KEY,
+		email TEXT,
+		thread TEXT,
+		created_at TIMESTAMP
+	)
+`
+
+// maxEmailReply caps how much of a reply becomes a chat message
+const maxEmailReply = 4000
+
+var errUnknownReply = errors.New("not a reply to one of our emails")
+
+// replyQuoteStart matches the lines mail clients put before quoted text
+var replyQuoteStart = regexp.MustCompile(`^(>|On .+ wrote:\s*$|-+\s*Original Message|--\s*$|_{5,}|From:\s)`)
+
+// replyThread is the thread a reply to a notification belongs in
+func replyThread(n Notification) string {
+	if n.Kind == NotifyMessageReceived {
+		if from, ok := n.Data["From"].(string); ok && isUserRecipient(from) {
+			return from
+		}
+	}
+	return adminThread
+}
+
+// replyAddressFor returns the Reply-To address for a notification's email,
+// remembering where replies to it go, or "" when replies aren't taken
+func (app *App) replyAddressFor(n Notification, sendID string) string {
+	at := strings.LastIndex(config.Email.ReplyTo, "@")
+	if at < 0 {
+		return ""
+	}
+	err := app.db.Exec("INSERT INTO email_reply_threads (send_id, email, thread, created_at) VALUES (?, ?, ?, ?)",
+		sendID, n.Email, replyThread(n), time.Now())
+	if err != nil {
+		log.Printf("Error storing reply thread for %s: %v", n.Email, err)
+		return ""
+	}
+	return config.Email.ReplyTo[:at] + "+" + sendID + config.Email.ReplyTo[at:]
+}
+
+// inboundEmail is what's read from a received email
+type inboundEmail struct {
+	From       string   // Bare address
+	Recipients []string // Bare addresses from To, Cc and the envelope
+	References []string // Message ids from In-Reply-To and References
+	Text       string
+}
+
+// readInboundHeader fills in an inbound email's addresses and references
+// from its header
+func readInboundHeader(in *inboundEmail, h mail.Header) {
+	if from, err := mail.ParseAddress(h.Get("From")); err == nil {
+		in.From = from.Address
+	}
+	for _, field := range []string{"To", "Cc", "Delivered-To"} {
+		if list, err := h.AddressList(field); err == nil {
+			for _, a := range list {
+				in.Recipients = append(in.Recipients, a.Address)
+			}
+		}
+	}
+	for _, field := range []string{"In-Reply-To", "References"} {
+		for _, id := range strings.Fields(h.Get(field)) {
+			in.References = append(in.References, strings.Trim(id, "<>"))
+		}
+	}
+}
+
+// parseRawEmail reads a whole MIME message
+func parseRawEmail(raw io.Reader) (*inboundEmail, error) {
+	msg, err := mail.ReadMessage(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email: %v", err)
+	}
+	in := &inboundEmail{}
+	readInboundHeader(in, msg.Header)
+	in.Text, err = plainTextPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// plainTextPart returns the first text/plain part of a body, looking
+// inside multipart bodies
+func plainTextPart(contentType, encoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextRawPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", fmt.Errorf("failed to read email part: %v", err)
+			}
+			text, err := plainTextPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil || text != "" {
+				return text, err
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+	text, err := io.ReadAll(io.LimitReader(body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read email body: %v", err)
+	}
+	return string(text), nil
+}
+
+// replyText is what the user wrote above any quoted text
+func replyText(body string) string {
+	var kept []string
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		if replyQuoteStart.MatchString(strings.TrimSpace(line)) {
+			break
+		}
+		kept = append(kept, line)
+	}
+	text := strings.TrimSpace(strings.Join(kept, "\n"))
+	if len(text) > maxEmailReply {
+		text = text[:maxEmailReply]
+	}
+	return text
+}
+
+// replySendID finds the send an inbound email answers, from its
+// plus-address or, failing that, its references
+func (app *App) replySendID(in *inboundEmail) (string, error) {
+	at := strings.LastIndex(config.Email.ReplyTo, "@")
+	if at < 0 {
+		return "", errUnknownReply
+	}
+	local, domain := config.Email.ReplyTo[:at], config.Email.ReplyTo[at+1:]
+	for _, addr := range in.Recipients {
+		i := strings.LastIndex(addr, "@")
+		if i < 0 || !strings.EqualFold(addr[i+1:], domain) {
+			continue
+		}
+		if token, ok := strings.CutPrefix(addr[:i], local+"+"); ok && token != "" {
+			return token, nil
+		}
+	}
+
+	// Providers record message ids in different shapes: SMTP with angle
+	// brackets, SES as the part before the @, SendGrid as the part before
+	// the first dot
+	var candidates []interface{}
+	for _, ref := range in.References {
+		candidates = append(candidates, "<"+ref+">")
+		if i := strings.Index(ref, "@"); i > 0 {
+			candidates = append(candidates, ref[:i])
+		}
+		if i := strings.Index(ref, "."); i > 0 {
+			candidates = append(candidates, ref[:i])
+		}
+	}
+	if len(candidates) == 0 {
+		return "", errUnknownReply
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(candidates)), ", ")
+	result, err := app.db.Query("SELECT id FROM email_sends WHERE provider_id IN ("+placeholders+")", candidates...)
+	if err != nil {
+		return "", fmt.Errorf("failed to query email sends: %v", err)
+	}
+	defer result.Close()
+
+	var sendID string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&sendID)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to scan email send: %v", err)
+	}
+	if sendID == "" {
+		return "", errUnknownReply
+	}
+	return sendID, nil
+}
+
+// ReceiveEmail takes a reply to one of our emails as a chat message in the
+// thread the email belonged to. The chat turn runs in the background.
+func (app *App) ReceiveEmail(in *inboundEmail) error {
+	sendID, err := app.replySendID(in)
+	if err != nil {
+		return err
+	}
+	result, err := app.db.Query("SELECT email, thread FROM email_reply_threads WHERE send_id = ?", sendID)
+	if err != nil {
+		return fmt.Errorf("failed to query reply thread: %v", err)
+	}
+	var email, thread string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&email, &thread)
+	})
+	result.Close()
+	if err != nil {
+		return fmt.Errorf("failed to scan reply thread: %v", err)
+	}
+	if email == "" {
+		return errUnknownReply
+	}
+	if !strings.EqualFold(in.From, email) {
+		return fmt.Errorf("reply from %s to an email sent to %s", in.From, email)
+	}
+	text := replyText(in.Text)
+	if text == "" {
+		return fmt.Errorf("empty reply from %s", email)
+	}
+
+	go func() {
+		var err error
+		if thread == adminThread {
+			err = app.RunChatTurn(email, text)
+		} else {
+			_, err = app.SendDirectMessage(email, thread, text)
+		}
+		if err != nil {
+			log.Printf("Error taking email reply from %s: %v", email, err)
+		}
+	}()
+	return nil
+}
+
+// receiveLogged takes an inbound email, logging rather than returning
+// failures, so providers don't resend mail that will never be taken
+func (app *App) receiveLogged(in *inboundEmail) {
+	if err := app.ReceiveEmail(in); err != nil {
+		log.Printf("Dropped inbound email from %s: %v", in.From, err)
+	}
+}
+
+// handleSendGridInbound takes mail from SendGrid's Inbound Parse webhook,
+// either parsed into fields or, with "send raw" on, as the whole message
+func handleSendGridInbound(w http.ResponseWriter, r *http.Request) {
+	if !webhookAuthorized(w, r) {
+		return
+	}
+	if InMaintenance() {
+		// SendGrid retries, so the reply isn't lost
+		http.Error(w, "Maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	var in *inboundEmail
+	if raw := r.FormValue("email"); raw != "" {
+		var err error
+		if in, err = parseRawEmail(strings.NewReader(raw)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		in = &inboundEmail{Text: r.FormValue("text")}
+		if msg, err := mail.ReadMessage(strings.NewReader(r.FormValue("headers") + "\n\n")); err == nil {
+			readInboundHeader(in, msg.Header)
+		}
+	}
+	chatRoom.receiveLogged(in)
+	w.WriteHeader(http.StatusOK)
+}
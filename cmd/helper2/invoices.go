@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Each month the invoices job bills every match for its confirmed shifts
+// of the month before, at the match's agreed rate, and emails the patient
+// a link to the invoice. An invoice copies its shifts, so it reads the same
+// however the shifts change later, and each shift records the invoice that
+// billed it; shifts confirmed after their month was billed go on a further
+// invoice for that month the next time one is generated, as do those of a
+// voided invoice. Invoices start out issued and are marked paid against a
+// payment reference, which the payment integration fills in once there is
+// one.
+
+const invoicesSchema = `
+	CREATE TABLE IF NOT EXISTS invoices (
+		id TEXT PRIMARY KEY,
+		caregiver_email TEXT,
+		patient_email TEXT,
+		period_start TIMESTAMP,
+		period_end TIMESTAMP,
+		lines TEXT,
+		minutes INTEGER,
+		rate REAL,
+		amount REAL,
+		status TEXT,
+		payment_ref TEXT,
+		created_at TIMESTAMP,
+		paid_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_invoices_caregiver ON invoices(caregiver_email);
+	CREATE INDEX IF NOT EXISTS idx_invoices_patient ON invoices(patient_email)
+`
+
+// Invoice statuses
+const (
+	InvoiceIssued = "issued"
+	InvoicePaid   = "paid"
+	InvoiceVoid   = "void"
+)
+
+// InvoiceLine is a shift billed on an invoice
+type InvoiceLine struct {
+	ShiftID   string    `json:"shift_id"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	Minutes   int       `json:"minutes"`
+	Note      string    `json:"note,omitempty"`
+	Amount    float64   `json:"amount"`
+}
+
+// Duration formats the line's length for people
+func (l InvoiceLine) Duration() string {
+	return formatMinutes(l.Minutes)
+}
+
+// Invoice bills a patient for a caregiver's confirmed shifts in a month
+type Invoice struct {
+	ID             string        `json:"id"`
+	CaregiverEmail string        `json:"caregiver_email"`
+	PatientEmail   string        `json:"patient_email"`
+	PeriodStart    time.Time     `json:"period_start"`
+	PeriodEnd      time.Time     `json:"period_end"` // Exclusive
+	Lines          []InvoiceLine `json:"lines"`
+	Minutes        int           `json:"minutes"`
+	Rate           float64       `json:"rate"` // Per hour
+	Amount         float64       `json:"amount"`
+	Status         string        `json:"status"`
+	PaymentRef     string        `json:"payment_ref,omitempty"`
+	CreatedAt      time.Time     `json:"created_at"`
+	PaidAt         time.Time     `json:"paid_at,omitempty"`
+}
+
+// Number is the invoice's reference for people, such as INV-202609-3F2A9C
+func (inv Invoice) Number() string {
+	return fmt.Sprintf("INV-%s-%s", inv.PeriodStart.Format("200601"), strings.ToUpper(inv.ID[:6]))
+}
+
+// Hours formats the invoice's billed time for people
+func (inv Invoice) Hours() string {
+	return formatMinutes(inv.Minutes)
+}
+
+// roundCents rounds an amount of money to the cent
+func roundCents(amount float64) float64 {
+	return float64(int64(amount*100+0.5)) / 100
+}
+
+// matchRate returns the hourly rate a match is billed at: its agreed rate,
+// or what the caregiver asks until one is agreed
+func matchRate(q execer, caregiverEmail, patientEmail string) (float64, error) {
+	match, err := getMatch(q, caregiverEmail, patientEmail)
+	if err != nil {
+		return 0, err
+	}
+	if match != nil && match.AgreedRate > 0 {
+		return match.AgreedRate, nil
+	}
+	c, err := getCaregiver(q, caregiverEmail)
+	if err != nil {
+		return 0, err
+	}
+	if c == nil {
+		return 0, fmt.Errorf("no caregiver %s", caregiverEmail)
+	}
+	return c.RateExpectations, nil
+}
+
+// migrateInvoicedShifts adds the column recording which invoice billed a
+// shift, and fills it in from the invoices issued before it existed
+func migrateInvoicedShifts(db *instrumentedDB) error {
+	if err := addColumn(db, "shifts", "invoice_id", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	result, err := db.Query("SELECT id, lines FROM invoices WHERE status != ?", InvoiceVoid)
+	if err != nil {
+		return fmt.Errorf("failed to query invoices: %v", err)
+	}
+	defer result.Close()
+
+	err = result.Iterate(func(r *chai.Row) error {
+		var id, encoded string
+		if err := r.Scan(&id, &encoded); err != nil {
+			return fmt.Errorf("failed to scan invoice: %v", err)
+		}
+		var lines []InvoiceLine
+		if err := json.Unmarshal([]byte(encoded), &lines); err != nil {
+			return fmt.Errorf("failed to decode invoice lines: %v", err)
+		}
+		for _, l := range lines {
+			if err := db.Exec("UPDATE shifts SET invoice_id = ? WHERE id = ? AND invoice_id = ''", id, l.ShiftID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to backfill invoiced shifts: %v", err)
+	}
+	return nil
+}
+
+const invoiceColumns = "id, caregiver_email, patient_email, period_start, period_end, lines, minutes, rate, amount, status, payment_ref, created_at, paid_at"
+
+// queryInvoices returns the invoices matching a condition, the latest
+// period first
+func (app *App) queryInvoices(where string, args ...interface{}) ([]Invoice, error) {
+	result, err := app.db.Query("SELECT "+invoiceColumns+" FROM invoices "+where+" ORDER BY period_start DESC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invoices: %v", err)
+	}
+	defer result.Close()
+
+	invoices := []Invoice{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var inv Invoice
+		var lines string
+		if err := r.Scan(&inv.ID, &inv.CaregiverEmail, &inv.PatientEmail, &inv.PeriodStart, &inv.PeriodEnd, &lines,
+			&inv.Minutes, &inv.Rate, &inv.Amount, &inv.Status, &inv.PaymentRef, &inv.CreatedAt, &inv.PaidAt); err != nil {
+			return fmt.Errorf("failed to scan invoice: %v", err)
+		}
+		if err := json.Unmarshal([]byte(lines), &inv.Lines); err != nil {
+			return fmt.Errorf("failed to decode invoice lines: %v", err)
+		}
+		invoices = append(invoices, inv)
+		return nil
+	})
+	return invoices, err
+}
+
+// GetInvoice returns an invoice by ID, or nil
+func (app *App) GetInvoice(id string) (*Invoice, error) {
+	invoices, err := app.queryInvoices("WHERE id = ?", id)
+	if err != nil || len(invoices) == 0 {
+		return nil, err
+	}
+	return &invoices[0], nil
+}
+
+// Invoices lists a match's invoices, the latest period first
+func (app *App) Invoices(caregiverEmail, patientEmail string) ([]Invoice, error) {
+	return app.queryInvoices("WHERE caregiver_email = ? AND patient_email = ?", caregiverEmail, patientEmail)
+}
+
+// IssueInvoice bills a match for its confirmed shifts in the month of t
+// that no invoice covers yet. It returns nil when there's nothing to bill.
+// The shifts are read and marked billed in one transaction, so a shift
+// can't go on two invoices however many runs overlap.
+func (app *App) IssueInvoice(caregiverEmail, patientEmail string, t time.Time) (*Invoice, error) {
+	start := monthStart(t.UTC())
+	end := start.AddDate(0, 1, 0)
+	inv := &Invoice{
+		ID:             newAttachmentID(),
+		CaregiverEmail: caregiverEmail,
+		PatientEmail:   patientEmail,
+		PeriodStart:    start,
+		PeriodEnd:      end,
+		Status:         InvoiceIssued,
+		CreatedAt:      time.Now(),
+	}
+	err := app.withTx(func(tx *chai.Tx) error {
+		shifts, err := selectShifts(tx, `WHERE caregiver_email = ? AND patient_email = ? AND status = ? AND invoice_id = ''
+			AND started_at >= ? AND started_at < ?`, caregiverEmail, patientEmail, ShiftConfirmed, start, end)
+		if err != nil || len(shifts) == 0 {
+			return err
+		}
+		if inv.Rate, err = matchRate(tx, caregiverEmail, patientEmail); err != nil {
+			return err
+		}
+		for _, s := range shifts {
+			err := tx.Exec("UPDATE shifts SET invoice_id = ? WHERE id = ? AND invoice_id = ''", inv.ID, s.ID)
+			if err != nil {
+				return fmt.Errorf("failed to mark shift invoiced: %v", err)
+			}
+			marked, err := rowExists(tx, "SELECT id FROM shifts WHERE id = ? AND invoice_id = ?", s.ID, inv.ID)
+			if err != nil {
+				return err
+			}
+			if !marked {
+				return fmt.Errorf("shift %s is already invoiced", s.ID)
+			}
+			amount := roundCents(float64(s.Minutes) / 60 * inv.Rate)
+			inv.Lines = append(inv.Lines, InvoiceLine{
+				ShiftID:   s.ID,
+				StartedAt: s.StartedAt,
+				EndedAt:   s.EndedAt,
+				Minutes:   s.Minutes,
+				Note:      s.Note,
+				Amount:    amount,
+			})
+			inv.Minutes += s.Minutes
+			inv.Amount += amount
+		}
+		inv.Amount = roundCents(inv.Amount)
+
+		lines, err := json.Marshal(inv.Lines)
+		if err != nil {
+			return fmt.Errorf("failed to encode invoice lines: %v", err)
+		}
+		err = tx.Exec(`
+			INSERT INTO invoices (`+invoiceColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, '', ?, ?)
+		`, inv.ID, inv.CaregiverEmail, inv.PatientEmail, inv.PeriodStart, inv.PeriodEnd, string(lines),
+			inv.Minutes, inv.Rate, inv.Amount, inv.Status, inv.CreatedAt, time.Time{})
+		if err != nil {
+			return fmt.Errorf("failed to store invoice: %v", err)
+		}
+		return nil
+	})
+	if err != nil || len(inv.Lines) == 0 {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// invoiceURL links a user to an invoice
+func invoiceURL(email, id string) string {
+	return fmt.Sprintf("%s/invoice?email=%s&id=%s", config.Email.BaseURL, url.QueryEscape(email), url.QueryEscape(id))
+}
+
+// sendInvoice emails the patient their invoice
+func (app *App) sendInvoice(inv *Invoice) {
+	caregiver := app.displayName(inv.CaregiverEmail)
+	app.notifyLogged(Notification{
+		Email: inv.PatientEmail,
+		Kind:  NotifyInvoice,
+		Data: map[string]interface{}{
+			"Number":     inv.Number(),
+			"Caregiver":  caregiver,
+			"Month":      inv.PeriodStart,
+			"Hours":      inv.Hours(),
+			"Amount":     fmt.Sprintf("$%.2f", inv.Amount),
+			"InvoiceURL": invoiceURL(inv.PatientEmail, inv.ID),
+		},
+	})
+}
+
+// IssueInvoices bills every match with unbilled confirmed shifts in the
+// month of t and emails the patients, returning the new invoices
+func (app *App) IssueInvoices(t time.Time) ([]Invoice, error) {
+	start := monthStart(t.UTC())
+	shifts, err := app.queryShifts("WHERE status = ? AND started_at >= ? AND started_at < ?",
+		ShiftConfirmed, start, start.AddDate(0, 1, 0))
+	if err != nil {
+		return nil, err
+	}
+	pairs := make(map[[2]string]bool)
+	for _, s := range shifts {
+		pairs[[2]string{s.CaregiverEmail, s.PatientEmail}] = true
+	}
+	var keys [][2]string
+	for pair := range pairs {
+		keys = append(keys, pair)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	invoices := []Invoice{}
+	for _, pair := range keys {
+		inv, err := app.IssueInvoice(pair[0], pair[1], start)
+		if err != nil {
+			return invoices, err
+		}
+		if inv == nil {
+			continue
+		}
+		app.sendInvoice(inv)
+		invoices = append(invoices, *inv)
+	}
+	return invoices, nil
+}
+
+// invoiceJob bills last month
+func (app *App) invoiceJob() error {
+	invoices, err := app.IssueInvoices(monthStart(time.Now().UTC()).AddDate(0, -1, 0))
+	if len(invoices) > 0 {
+		log.Printf("Issued %d invoices", len(invoices))
+	}
+	return err
+}
+
+// SetInvoiceStatus marks an invoice paid, with the payment's reference, or
+// void, which leaves its shifts to be billed again
+func (app *App) SetInvoiceStatus(id, status, paymentRef string) error {
+	inv, err := app.GetInvoice(id)
+	if err != nil {
+		return err
+	}
+	if inv == nil {
+		return fmt.Errorf("no such invoice")
+	}
+	var paidAt time.Time
+	switch status {
+	case InvoicePaid:
+		paidAt = time.Now()
+	case InvoiceVoid:
+		paymentRef = ""
+	default:
+		return fmt.Errorf("status must be %s or %s", InvoicePaid, InvoiceVoid)
+	}
+	if inv.Status != InvoiceIssued {
+		return fmt.Errorf("this invoice is already %s", inv.Status)
+	}
+	return app.withTx(func(tx *chai.Tx) error {
+		err := tx.Exec("UPDATE invoices SET status = ?, payment_ref = ?, paid_at = ? WHERE id = ?",
+			status, paymentRef, paidAt, id)
+		if err != nil {
+			return fmt.Errorf("failed to update invoice: %v", err)
+		}
+		// A void invoice's shifts go on the next one
+		if status == InvoiceVoid {
+			if err := tx.Exec("UPDATE shifts SET invoice_id = '' WHERE invoice_id = ?", id); err != nil {
+				return fmt.Errorf("failed to release invoiced shifts: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// invoicePDF lays an invoice out as a PDF
+func (app *App) invoicePDF(inv *Invoice) []byte {
+	caregiver, patient := inv.CaregiverEmail, inv.PatientEmail
+	if c, err := app.GetCaregiver(inv.CaregiverEmail); err == nil && c != nil && c.Name != "" {
+		caregiver = fmt.Sprintf("%s <%s>", c.Name, c.Email)
+	}
+	if p, err := app.GetPatient(inv.PatientEmail); err == nil && p != nil && p.Name != "" {
+		patient = fmt.Sprintf("%s <%s>", p.Name, p.Email)
+	}
+
+	lines := []string{
+		config.Branding.Name,
+		"",
+		"Invoice " + inv.Number(),
+		"Issued " + inv.CreatedAt.Format("January 2, 2006"),
+		"Period " + inv.PeriodStart.Format("January 2006"),
+		"Status " + inv.Status,
+		"",
+		"Care by " + caregiver,
+		"Billed to " + patient,
+		"",
+		fmt.Sprintf("%-28s %-10s %10s", "Shift", "Hours", "Amount"),
+	}
+	for _, l := range inv.Lines {
+		lines = append(lines, fmt.Sprintf("%-28s %-10s %10s",
+			l.StartedAt.Format("Mon Jan 2 3:04PM")+"-"+l.EndedAt.Format("3:04PM"), l.Duration(), fmt.Sprintf("$%.2f", l.Amount)))
+	}
+	lines = append(lines,
+		"",
+		fmt.Sprintf("%-28s %-10s %10s", fmt.Sprintf("Total at $%.2f/hour", inv.Rate), inv.Hours(), fmt.Sprintf("$%.2f", inv.Amount)),
+	)
+	if inv.Status == InvoicePaid {
+		lines = append(lines, "", "Paid "+inv.PaidAt.Format("January 2, 2006"))
+	}
+	return textPDF(lines)
+}
+
+// textPDF writes lines of text as a PDF in a fixed-width font, on as many
+// letter-size pages as they need. Characters outside ASCII print as "?".
+func textPDF(lines []string) []byte {
+	const perPage = 54
+	var pages [][]string
+	for len(lines) > perPage {
+		pages = append(pages, lines[:perPage])
+		lines = lines[perPage:]
+	}
+	pages = append(pages, lines)
+
+	// Objects 1 and 2 are the catalog and page tree, 3 the font, then a
+	// page and its content stream for each page
+	var objects []string
+	var kids []string
+	for i, page := range pages {
+		var content bytes.Buffer
+		content.WriteString("BT /F1 10 Tf 12 TL 54 738 Td\n")
+		for _, line := range page {
+			content.WriteString("(" + pdfEscape(line) + ") Tj T*\n")
+		}
+		content.WriteString("ET")
+		pageObj, contentObj := 4+2*i, 5+2*i
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageObj))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", contentObj),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+	objects = append([]string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+	}, objects...)
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape makes s safe inside a PDF string
+func pdfEscape(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			sb.WriteRune('\\')
+			sb.WriteRune(r)
+		case r < 32 || r > 126:
+			sb.WriteRune('?')
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// loadInvoice returns the invoice named by the request's id if the
+// requester may see it: either party to the match, or a signed-in admin
+func loadInvoice(r *http.Request) (*Invoice, int, error) {
+	email := r.FormValue("email")
+	inv, err := chatRoom.GetInvoice(r.FormValue("id"))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if inv == nil || (email != inv.CaregiverEmail && email != inv.PatientEmail && signedInAdmin(r) == "") {
+		return nil, http.StatusNotFound, fmt.Errorf("invoice not found")
+	}
+	return inv, http.StatusOK, nil
+}
+
+const invoiceTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Invoice {{.Invoice.Number}}</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Invoice {{.Invoice.Number}}</h1>
+            <div class="app-description">{{.Invoice.PeriodStart.Format "January 2006"}} · {{.Invoice.Status}}</div>
+        </div>
+        <div class="match-details">
+            <span>Care by {{.Caregiver}}</span>
+            <span>Billed to {{.Patient}}</span>
+            <span>Issued {{.Invoice.CreatedAt.Format "January 2, 2006"}}{{if eq .Invoice.Status "paid"}}, paid {{.Invoice.PaidAt.Format "January 2, 2006"}}{{end}}</span>
+        </div>
+        <table class="query-results">
+            <tr><th>Shift</th><th>Hours</th><th>Amount</th></tr>
+            {{range .Invoice.Lines}}
+            <tr><td>{{.StartedAt.Format "Mon Jan 2 3:04 PM"}} – {{.EndedAt.Format "3:04 PM"}}{{if .Note}}<br><small>{{.Note}}</small>{{end}}</td><td>{{.Duration}}</td><td>${{printf "%.2f" .Amount}}</td></tr>
+            {{end}}
+            <tr><th>Total at ${{printf "%.2f" .Invoice.Rate}}/hour</th><th>{{.Invoice.Hours}}</th><th>${{printf "%.2f" .Invoice.Amount}}</th></tr>
+        </table>
+        <p><a href="invoice/pdf?email={{.UserEmail}}&id={{.Invoice.ID}}">Download PDF</a> · <a href="./?email={{.UserEmail}}">Back to chat</a></p>
+    </div>
+</body>
+</html>
+`
+
+// handleInvoice shows an invoice
+func handleInvoice(w http.ResponseWriter, r *http.Request) {
+	inv, status, err := loadInvoice(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	caregiver, patient := inv.CaregiverEmail, inv.PatientEmail
+	if c, err := chatRoom.GetCaregiver(inv.CaregiverEmail); err == nil && c != nil && c.Name != "" {
+		caregiver = c.Name + " (" + c.Email + ")"
+	}
+	if p, err := chatRoom.GetPatient(inv.PatientEmail); err == nil && p != nil && p.Name != "" {
+		patient = p.Name + " (" + p.Email + ")"
+	}
+	renderTemplate(w, "invoice", invoiceTemplate, struct {
+		Invoice   *Invoice
+		Caregiver string
+		Patient   string
+		UserEmail string
+	}{inv, caregiver, patient, r.FormValue("email")})
+}
+
+// handleInvoicePDF downloads an invoice as a PDF
+func handleInvoicePDF(w http.ResponseWriter, r *http.Request) {
+	inv, status, err := loadInvoice(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, inv.Number()))
+	w.Write(chatRoom.invoicePDF(inv))
+}
+
+// handleInvoicesAPI lists a match's invoices for either party
+func handleInvoicesAPI(w http.ResponseWriter, r *http.Request) {
+	_, caregiverEmail, patientEmail, err := shiftParties(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	invoices, err := chatRoom.Invoices(caregiverEmail, patientEmail)
+	if err != nil {
+		log.Printf("Error listing invoices: %v", err)
+		http.Error(w, "Failed to list invoices", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, invoices)
+}
+
+// handleAdminInvoicesAPI lists invoices (GET, optionally by status), bills
+// a month (POST with month as 2006-01) or marks an invoice paid or void
+// (POST with id, status and for paid payment_ref)
+func handleAdminInvoicesAPI(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		where, args := "", []interface{}{}
+		if status := r.FormValue("status"); status != "" {
+			where, args = "WHERE status = ?", append(args, status)
+		}
+		invoices, err := chatRoom.queryInvoices(where, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, invoices)
+
+	case "POST":
+		if id := r.FormValue("id"); id != "" {
+			status := r.FormValue("status")
+			if err := chatRoom.SetInvoiceStatus(id, status, r.FormValue("payment_ref")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			chatRoom.Audit(r, actor, "invoice_"+status, id, r.FormValue("payment_ref"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		month, err := time.Parse("2006-01", r.FormValue("month"))
+		if err != nil {
+			http.Error(w, "month must be like 2006-01, or id an invoice", http.StatusBadRequest)
+			return
+		}
+		invoices, err := chatRoom.IssueInvoices(month)
+		if err != nil {
+			log.Printf("Error issuing invoices: %v", err)
+			http.Error(w, "Failed to issue invoices", http.StatusInternalServerError)
+			return
+		}
+		chatRoom.Audit(r, actor, "invoices_issued", month.Format("2006-01"), fmt.Sprintf("%d invoices", len(invoices)))
+		writeJSON(w, invoices)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
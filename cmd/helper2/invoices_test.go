@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIssueInvoiceOnce(t *testing.T) {
+	app := newTestApp(t)
+	const caregiver, patient = "caregiver@example.com", "patient@example.com"
+	err := app.db.Exec(`
+		INSERT INTO matches (caregiver_email, patient_email, status, created_at, agreed_rate)
+		VALUES (?, ?, 'active', ?, 30)
+	`, caregiver, patient, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	month := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	for day := 2; day <= 3; day++ {
+		start := month.AddDate(0, 0, day)
+		err := app.insertShift(&Shift{
+			ID:             newAttachmentID(),
+			CaregiverEmail: caregiver,
+			PatientEmail:   patient,
+			StartedAt:      start,
+			EndedAt:        start.Add(2 * time.Hour),
+			Minutes:        120,
+			Source:         ShiftLogged,
+			Status:         ShiftConfirmed,
+			CreatedAt:      start,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two runs at once bill the shifts on one invoice between them
+	var wg sync.WaitGroup
+	issued := make([]*Invoice, 2)
+	for i := range issued {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inv, err := app.IssueInvoice(caregiver, patient, month)
+			if err != nil {
+				t.Error(err)
+			}
+			issued[i] = inv
+		}(i)
+	}
+	wg.Wait()
+	if (issued[0] == nil) == (issued[1] == nil) {
+		t.Fatalf("want exactly one run to issue an invoice, got %v and %v", issued[0], issued[1])
+	}
+	invoices, err := app.Invoices(caregiver, patient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invoices) != 1 {
+		t.Fatalf("got %d invoices, want 1", len(invoices))
+	}
+	if inv := invoices[0]; len(inv.Lines) != 2 || inv.Minutes != 240 || inv.Amount != 120 {
+		t.Errorf("got %d lines, %d minutes, $%.2f; want 2, 240, $120.00", len(inv.Lines), inv.Minutes, inv.Amount)
+	}
+	if inv, err := app.IssueInvoice(caregiver, patient, month); err != nil || inv != nil {
+		t.Errorf("issuing again: got %v, %v; want nothing to bill", inv, err)
+	}
+
+	// Voiding the invoice lets its shifts be billed again
+	if err := app.SetInvoiceStatus(invoices[0].ID, InvoiceVoid, ""); err != nil {
+		t.Fatal(err)
+	}
+	inv, err := app.IssueInvoice(caregiver, patient, month)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv == nil || len(inv.Lines) != 2 {
+		t.Errorf("after voiding: got %+v, want the two shifts billed again", inv)
+	}
+}
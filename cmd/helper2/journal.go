@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Caregivers write a visit note after each visit: what happened in their
+// own words, how the patient seemed and any vitals they took. A note can
+// belong to a logged shift or a booking. Together a patient's notes are
+// their care journal, which the patient's family reads on the account and
+// every caregiver who can read the care plan sees too, so whoever comes
+// next knows how the last visit went. The journal can be exported as CSV
+// or JSON, e.g. for a doctor's appointment.
+
+const visitNotesSchema = `
+	CREATE TABLE IF NOT EXISTS visit_notes (
+		id TEXT PRIMARY KEY,
+		caregiver_email TEXT,
+		patient_email TEXT,
+		shift_id TEXT,
+		assignment_id INTEGER,
+		visited_at TIMESTAMP,
+		note TEXT,
+		mood TEXT,
+		vitals TEXT,
+		created_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_visit_notes_patient ON visit_notes(patient_email, visited_at)
+`
+
+// Moods a caregiver can record, best first
+var visitMoods = []string{"great", "good", "okay", "low", "distressed"}
+
+// maxVisitNoteLength caps a note's free text
+const maxVisitNoteLength = 5000
+
+var errNoVisits = errors.New("visit notes can only be written for an active match")
+
+// Vitals are the measurements taken on a visit; zero values weren't taken
+type Vitals struct {
+	BloodPressure string  `json:"blood_pressure,omitempty"` // e.g. 120/80
+	HeartRate     int     `json:"heart_rate,omitempty"`     // Beats per minute
+	Temperature   float64 `json:"temperature,omitempty"`    // °F
+	BloodSugar    int     `json:"blood_sugar,omitempty"`    // mg/dL
+}
+
+// Describe formats the vitals that were taken for people
+func (v Vitals) Describe() string {
+	var parts []string
+	if v.BloodPressure != "" {
+		parts = append(parts, "BP "+v.BloodPressure)
+	}
+	if v.HeartRate > 0 {
+		parts = append(parts, fmt.Sprintf("pulse %d", v.HeartRate))
+	}
+	if v.Temperature > 0 {
+		parts = append(parts, fmt.Sprintf("temp %.1f°F", v.Temperature))
+	}
+	if v.BloodSugar > 0 {
+		parts = append(parts, fmt.Sprintf("blood sugar %d", v.BloodSugar))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// validate checks the vitals are plausible readings
+func (v Vitals) validate() error {
+	if v.BloodPressure != "" {
+		var systolic, diastolic int
+		if n, _ := fmt.Sscanf(v.BloodPressure, "%d/%d", &systolic, &diastolic); n != 2 ||
+			systolic < 50 || systolic > 260 || diastolic < 30 || diastolic > 160 {
+			return fmt.Errorf("blood pressure should be like 120/80")
+		}
+	}
+	if v.HeartRate != 0 && (v.HeartRate < 20 || v.HeartRate > 250) {
+		return fmt.Errorf("heart rate should be in beats per minute")
+	}
+	if v.Temperature != 0 && (v.Temperature < 90 || v.Temperature > 110) {
+		return fmt.Errorf("temperature should be in °F")
+	}
+	if v.BloodSugar != 0 && (v.BloodSugar < 20 || v.BloodSugar > 600) {
+		return fmt.Errorf("blood sugar should be in mg/dL")
+	}
+	return nil
+}
+
+// VisitNote is a caregiver's record of a visit
+type VisitNote struct {
+	ID             string    `json:"id"`
+	CaregiverEmail string    `json:"caregiver_email"`
+	PatientEmail   string    `json:"patient_email"`
+	ShiftID        string    `json:"shift_id,omitempty"`
+	AssignmentID   int64     `json:"assignment_id,omitempty"` // The booking it was for
+	VisitedAt      time.Time `json:"visited_at"`
+	Note           string    `json:"note"`
+	Mood           string    `json:"mood,omitempty"`
+	Vitals         Vitals    `json:"vitals"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// AddVisitNote stores a caregiver's note of a visit to a patient they have
+// an active match with. A note for a shift or booking must be for one of
+// theirs with the patient, and is dated by it unless VisitedAt is set.
+func (app *App) AddVisitNote(n *VisitNote) error {
+	if err := app.requireEngagement(n.CaregiverEmail, n.PatientEmail); err == errNoEngagement {
+		return errNoVisits
+	} else if err != nil {
+		return err
+	}
+	n.Note, n.Mood = strings.TrimSpace(n.Note), strings.ToLower(strings.TrimSpace(n.Mood))
+	if n.Note == "" {
+		return fmt.Errorf("say how the visit went")
+	}
+	if len(n.Note) > maxVisitNoteLength {
+		return fmt.Errorf("a note can be at most %d characters", maxVisitNoteLength)
+	}
+	if n.Mood != "" && !containsString(visitMoods, n.Mood) {
+		return fmt.Errorf("mood must be one of %s", strings.Join(visitMoods, ", "))
+	}
+	n.Vitals.BloodPressure = strings.ReplaceAll(n.Vitals.BloodPressure, " ", "")
+	if err := n.Vitals.validate(); err != nil {
+		return err
+	}
+
+	var dated time.Time
+	if n.ShiftID != "" {
+		shifts, err := app.queryShifts("WHERE id = ? AND caregiver_email = ? AND patient_email = ?",
+			n.ShiftID, n.CaregiverEmail, n.PatientEmail)
+		if err != nil {
+			return err
+		}
+		if len(shifts) == 0 {
+			return fmt.Errorf("no such shift")
+		}
+		dated = shifts[0].StartedAt
+	}
+	if n.AssignmentID != 0 {
+		result, err := app.db.Query("SELECT start_time FROM assignments WHERE id = ? AND caregiver_email = ? AND patient_email = ?",
+			n.AssignmentID, n.CaregiverEmail, n.PatientEmail)
+		if err != nil {
+			return fmt.Errorf("failed to query booking: %v", err)
+		}
+		found := false
+		err = result.Iterate(func(r *chai.Row) error {
+			found = true
+			return r.Scan(&dated)
+		})
+		result.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read booking: %v", err)
+		}
+		if !found {
+			return fmt.Errorf("no such booking")
+		}
+	}
+	if n.VisitedAt.IsZero() {
+		n.VisitedAt = dated
+	}
+	if n.VisitedAt.IsZero() {
+		n.VisitedAt = time.Now()
+	}
+	if n.VisitedAt.After(time.Now().Add(time.Hour)) {
+		return fmt.Errorf("a visit note is for a visit that's happened")
+	}
+
+	vitals, err := json.Marshal(n.Vitals)
+	if err != nil {
+		return fmt.Errorf("failed to encode vitals: %v", err)
+	}
+	n.ID, n.CreatedAt = newAttachmentID(), time.Now()
+	err = app.db.Exec(`
+		INSERT INTO visit_notes (id, caregiver_email, patient_email, shift_id, assignment_id, visited_at,
+			note, mood, vitals, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, n.ID, n.CaregiverEmail, n.PatientEmail, n.ShiftID, n.AssignmentID, n.VisitedAt, n.Note, n.Mood,
+		string(vitals), n.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store visit note: %v", err)
+	}
+
+	message := fmt.Sprintf("%s wrote a note about their visit on %s", app.displayName(n.CaregiverEmail),
+		n.VisitedAt.Format("Mon Jan 2"))
+	if n.Mood != "" {
+		message += fmt.Sprintf(" (mood: %s)", n.Mood)
+	}
+	message += ". Read it in the care journal: " + journalURL(n.PatientEmail, n.PatientEmail)
+	if err := app.AddMessageWithRecipient(n.PatientEmail, "assistant", message, adminThread); err != nil {
+		log.Printf("Error telling %s about a visit note: %v", n.PatientEmail, err)
+	}
+	return nil
+}
+
+// containsString reports whether list has s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Journal lists a patient's visit notes from every caregiver in [from,
+// to), the latest visit first
+func (app *App) Journal(patientEmail string, from, to time.Time) ([]VisitNote, error) {
+	result, err := app.db.Query(`
+		SELECT id, caregiver_email, patient_email, shift_id, assignment_id, visited_at, note, mood, vitals, created_at
+		FROM visit_notes WHERE patient_email = ? AND visited_at >= ? AND visited_at < ?
+		ORDER BY visited_at DESC
+	`, patientEmail, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query visit notes: %v", err)
+	}
+	defer result.Close()
+
+	notes := []VisitNote{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var n VisitNote
+		var vitals string
+		if err := r.Scan(&n.ID, &n.CaregiverEmail, &n.PatientEmail, &n.ShiftID, &n.AssignmentID, &n.VisitedAt,
+			&n.Note, &n.Mood, &vitals, &n.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan visit note: %v", err)
+		}
+		if err := json.Unmarshal([]byte(vitals), &n.Vitals); err != nil {
+			return fmt.Errorf("failed to decode vitals: %v", err)
+		}
+		notes = append(notes, n)
+		return nil
+	})
+	return notes, err
+}
+
+// journalURL links a user to a patient's care journal
+func journalURL(viewer, patientEmail string) string {
+	return fmt.Sprintf("journal?email=%s&patient=%s", url.QueryEscape(viewer), url.QueryEscape(patientEmail))
+}
+
+// journalRange reads the optional from and to dates of a journal request;
+// to is inclusive
+func journalRange(r *http.Request) (time.Time, time.Time, error) {
+	from, to := time.Time{}, time.Now().Add(24*time.Hour)
+	if s := r.FormValue("from"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("from must be a date like 2006-01-02")
+		}
+		from = t
+	}
+	if s := r.FormValue("to"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("to must be a date like 2006-01-02")
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	return from, to, nil
+}
+
+// journalPatient returns the patient whose journal a request from the
+// signed-in email is for, if they're the patient or matched with them
+func journalPatient(r *http.Request, email string) (string, error) {
+	patient := r.FormValue("patient")
+	if patient == "" {
+		patient = email
+	}
+	if !carePlanReadable(r, email, patient) {
+		return "", fmt.Errorf("you can only read the journals of patients you're matched with")
+	}
+	return patient, nil
+}
+
+// visitNoteFromForm builds the signed-in caregiver's visit note from the
+// journal page's form
+func visitNoteFromForm(r *http.Request, caregiver string) (*VisitNote, error) {
+	n := &VisitNote{
+		CaregiverEmail: caregiver,
+		PatientEmail:   r.FormValue("patient"),
+		ShiftID:        r.FormValue("shift_id"),
+		Note:           r.FormValue("note"),
+		Mood:           r.FormValue("mood"),
+		Vitals:         Vitals{BloodPressure: r.FormValue("blood_pressure")},
+	}
+	for _, f := range []struct {
+		name string
+		dest *int
+	}{{"heart_rate", &n.Vitals.HeartRate}, {"blood_sugar", &n.Vitals.BloodSugar}} {
+		if s := strings.TrimSpace(r.FormValue(f.name)); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a whole number", strings.ReplaceAll(f.name, "_", " "))
+			}
+			*f.dest = v
+		}
+	}
+	if s := strings.TrimSpace(r.FormValue("temperature")); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("temperature must be a number")
+		}
+		n.Vitals.Temperature = v
+	}
+	return n, nil
+}
+
+const journalTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Care Journal</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Care Journal</h1>
+            <div class="app-description">{{.PatientName}}</div>
+        </div>
+        {{if .CanWrite}}
+        <form class="wizard-form" action="journal" method="POST">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="hidden" name="patient" value="{{.Patient}}">
+            <label>How did the visit go?
+                <textarea name="note" rows="4" required></textarea></label>
+            {{if .Shifts}}<label>Shift
+                <select name="shift_id"><option value="">None</option>{{range .Shifts}}<option value="{{.ID}}">{{.StartedAt.Format "Mon Jan 2 3:04 PM"}}</option>{{end}}</select></label>{{end}}
+            <label>Mood
+                <select name="mood"><option value="">Not noted</option>{{range .Moods}}<option value="{{.}}">{{.}}</option>{{end}}</select></label>
+            <label>Blood pressure <input type="text" name="blood_pressure" placeholder="120/80"></label>
+            <label>Heart rate <input type="number" name="heart_rate" placeholder="bpm"></label>
+            <label>Temperature <input type="number" name="temperature" step="0.1" placeholder="°F"></label>
+            <label>Blood sugar <input type="number" name="blood_sugar" placeholder="mg/dL"></label>
+            <button type="submit" class="send-button">Add note</button>
+        </form>
+        {{end}}
+        <div class="calendar">
+            {{range .Notes}}
+            <div class="calendar-event">
+                <span><strong>{{.VisitedAt.Format "Mon Jan 2 2006 3:04 PM"}}</strong> · {{index $.Names .CaregiverEmail}}{{if .Mood}} · mood: {{.Mood}}{{end}}</span><br>
+                {{with .Vitals.Describe}}<span>🩺 {{.}}</span><br>{{end}}
+                <span>{{.Note}}</span>
+            </div>
+            {{else}}
+            <p>No visit notes yet.</p>
+            {{end}}
+        </div>
+        <p>Export: <a href="journal/export?email={{.UserEmail}}&patient={{.Patient}}&format=csv">CSV</a> · <a href="journal/export?email={{.UserEmail}}&patient={{.Patient}}&format=json">JSON</a></p>
+        <p><a href="./?email={{.UserEmail}}">Back to chat</a></p>
+    </div>
+</body>
+</html>
+`
+
+// handleJournal shows a patient's care journal to them or someone matched
+// with them, with a form for their active caregivers to add a note (POST)
+func handleJournal(w http.ResponseWriter, r *http.Request) {
+	email := requireUser(w, r)
+	if email == "" {
+		return
+	}
+	if r.Method == "POST" {
+		n, err := visitNoteFromForm(r, email)
+		if err == nil {
+			err = chatRoom.AddVisitNote(n)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, journalURL(email, n.PatientEmail), http.StatusSeeOther)
+		return
+	}
+
+	patient, err := journalPatient(r, email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	notes, err := chatRoom.Journal(patient, time.Time{}, time.Now().Add(24*time.Hour))
+	if err != nil {
+		log.Printf("Error loading journal: %v", err)
+		http.Error(w, "Failed to load journal", http.StatusInternalServerError)
+		return
+	}
+	names := map[string]string{}
+	for _, n := range notes {
+		if _, ok := names[n.CaregiverEmail]; !ok {
+			names[n.CaregiverEmail] = chatRoom.displayName(n.CaregiverEmail)
+		}
+	}
+
+	// Caregivers note the shifts of the last two weeks
+	canWrite := chatRoom.requireEngagement(email, patient) == nil
+	var shifts []Shift
+	if canWrite {
+		shifts, err = chatRoom.Shifts(email, patient, time.Now().AddDate(0, 0, -14), time.Now())
+		if err != nil {
+			log.Printf("Error loading shifts: %v", err)
+		}
+		for i, j := 0, len(shifts)-1; i < j; i, j = i+1, j-1 {
+			shifts[i], shifts[j] = shifts[j], shifts[i]
+		}
+	}
+
+	renderTemplate(w, "journal", journalTemplate, map[string]interface{}{
+		"Notes":       notes,
+		"Names":       names,
+		"CanWrite":    canWrite,
+		"Shifts":      shifts,
+		"Moods":       visitMoods,
+		"UserEmail":   email,
+		"Patient":     patient,
+		"PatientName": chatRoom.displayName(patient),
+	})
+}
+
+// handleJournalExport downloads a care journal the signed-in user may read
+// (optionally from and to dates) as CSV or, with format=json, JSON
+func handleJournalExport(w http.ResponseWriter, r *http.Request) {
+	email := requireUser(w, r)
+	if email == "" {
+		return
+	}
+	patient, err := journalPatient(r, email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	from, to, err := journalRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	notes, err := chatRoom.Journal(patient, from, to)
+	if err != nil {
+		log.Printf("Error exporting journal: %v", err)
+		http.Error(w, "Failed to export journal", http.StatusInternalServerError)
+		return
+	}
+
+	stamp := time.Now().Format("20060102")
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="care-journal-%s.json"`, stamp))
+		writeJSON(w, notes)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="care-journal-%s.csv"`, stamp))
+	out := csv.NewWriter(w)
+	out.Write([]string{"visited_at", "caregiver", "mood", "blood_pressure", "heart_rate", "temperature", "blood_sugar", "note"})
+	number := func(v float64) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	for _, n := range notes {
+		out.Write([]string{
+			n.VisitedAt.Format(time.RFC3339), n.CaregiverEmail, n.Mood, n.Vitals.BloodPressure,
+			number(float64(n.Vitals.HeartRate)), number(n.Vitals.Temperature), number(float64(n.Vitals.BloodSugar)), n.Note,
+		})
+	}
+	out.Flush()
+}
+
+// handleVisitNotesAPI lists the visit notes of a patient the signed-in
+// user may read (GET, optionally from and to dates) or adds one as the
+// signed-in caregiver from a JSON note (POST)
+func handleVisitNotesAPI(w http.ResponseWriter, r *http.Request) {
+	email := requireUser(w, r)
+	if email == "" {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		patient, err := journalPatient(r, email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		from, to, err := journalRange(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		notes, err := chatRoom.Journal(patient, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, notes)
+
+	case "POST":
+		var n VisitNote
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		n.CaregiverEmail = email
+		if err := chatRoom.AddVisitNote(&n); err != nil {
+			status := http.StatusBadRequest
+			if err == errNoVisits {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, n)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
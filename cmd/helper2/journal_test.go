@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestJournalNeedsPatientOrCaregiver(t *testing.T) {
+	app := newTestApp(t)
+	const patient, caregiver = "patient@example.com", "caregiver@example.com"
+	err := app.db.Exec(`
+		INSERT INTO matches (caregiver_email, patient_email, status, created_at)
+		VALUES (?, ?, 'active', ?)
+	`, caregiver, patient, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, matched, stranger := signIn(t, app, patient), signIn(t, app, caregiver), signIn(t, app, "stranger@example.com")
+	note := `{"patient_email": "` + patient + `", "note": "Went for a walk"}`
+
+	tests := []struct {
+		name    string
+		h       http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		session string
+		want    int
+	}{
+		{"page without a session", handleJournal, "GET", "/journal?patient=" + patient, "", "", http.StatusUnauthorized},
+		{"page for a stranger", handleJournal, "GET", "/journal?patient=" + patient, "", stranger, http.StatusForbidden},
+		{"page for the caregiver", handleJournal, "GET", "/journal?patient=" + patient, "", matched, http.StatusOK},
+		{"page for the patient", handleJournal, "GET", "/journal", "", own, http.StatusOK},
+		{"export for a stranger", handleJournalExport, "GET", "/journal/export?patient=" + patient, "", stranger, http.StatusForbidden},
+		{"export for the patient", handleJournalExport, "GET", "/journal/export", "", own, http.StatusOK},
+		{"notes for a stranger", handleVisitNotesAPI, "GET", "/api/v1/visit-notes?patient=" + patient, "", stranger, http.StatusForbidden},
+		{"notes for the caregiver", handleVisitNotesAPI, "GET", "/api/v1/visit-notes?patient=" + patient, "", matched, http.StatusOK},
+		{"note written as the caregiver from another session", handleVisitNotesAPI, "POST", "/api/v1/visit-notes?email=" + caregiver, note, stranger, http.StatusForbidden},
+		{"note written by a stranger", handleVisitNotesAPI, "POST", "/api/v1/visit-notes", note, stranger, http.StatusConflict},
+		{"note written by the caregiver", handleVisitNotesAPI, "POST", "/api/v1/visit-notes", note, matched, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if got := serveSignedIn(tt.h, tt.method, tt.target, tt.body, tt.session); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
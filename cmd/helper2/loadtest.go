@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadTestMessages are what simulated users say, a mix of small talk and
+// messages that lead to tool calls
+var loadTestMessages = []string{
+	"Hello!",
+	"I need help finding care for my father",
+	"Can you list caregivers?",
+	"Show me my profile",
+	"What are typical rates near Springfield?",
+	"Do you have any matches for me?",
+	"Thanks, that's all for now",
+}
+
+// loadTestResult is one request's outcome
+type loadTestResult struct {
+	latency time.Duration
+	status  int // 0 when the request failed before a response
+}
+
+// runLoadTest is the "loadtest" subcommand. Without -url it serves the app
+// offline in this process (fake LLM, in-memory database) and drives that.
+func runLoadTest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	users := fs.Int("users", 50, "Simulated users, each sending one message at a time")
+	rps := fs.Float64("rps", 10, "Requests per second across all users")
+	duration := fs.Duration("duration", 30*time.Second, "How long to send requests")
+	target := fs.String("url", "", "Server to drive; empty serves the app offline in this process")
+	fs.Parse(args)
+	if *users <= 0 || *rps <= 0 {
+		return fmt.Errorf("-users and -rps must be positive")
+	}
+
+	base := strings.TrimRight(*target, "/")
+	if base == "" {
+		addr, err := serveOffline()
+		if err != nil {
+			return err
+		}
+		base = "http://" + addr
+	}
+	fmt.Printf("Driving %s/chat with %d users at %.1f requests/second for %s\n", base, *users, *rps, *duration)
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+		// A successful chat post redirects back to the page; the post is
+		// what's being measured
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	// Tokens are issued at the target rate; a user holds its next request
+	// until it gets one, so slow responses lower throughput rather than
+	// piling up requests
+	tokens := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rps))
+		defer ticker.Stop()
+		deadline := time.After(*duration)
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case tokens <- struct{}{}:
+				default: // Every user is busy; the request is skipped
+				}
+			case <-deadline:
+				close(stop)
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var results []loadTestResult
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			email := fmt.Sprintf("loadtest-%d@example.com", i)
+			for n := i; ; n++ {
+				select {
+				case <-stop:
+					return
+				case <-tokens:
+				}
+				r := postChatMessage(client, base, email, loadTestMessages[n%len(loadTestMessages)])
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	fmt.Print(formatLoadTestReport(results, time.Since(start)))
+	return nil
+}
+
+func postChatMessage(client *http.Client, base, email, message string) loadTestResult {
+	started := time.Now()
+	resp, err := client.PostForm(base+"/chat", url.Values{"email": {email}, "message": {message}})
+	if err != nil {
+		return loadTestResult{latency: time.Since(started)}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return loadTestResult{latency: time.Since(started), status: resp.StatusCode}
+}
+
+// serveOffline starts the app offline on a free local port and returns its
+// address
+func serveOffline() (string, error) {
+	*offline = true
+	if err := goOffline(); err != nil {
+		return "", err
+	}
+	app, err := NewApp("")
+	if err != nil {
+		return "", err
+	}
+	chatRoom = app
+	// Every simulated user comes from this host and posts without the chat
+	// page, so per-client limits and bot screening would stop the test
+	config.HTTP.RateLimitPerMinute = 0
+	config.Bots.ScreenSignups = false
+	handler := newRouter()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to listen: %v", err)
+	}
+	go func() {
+		log.Printf("Load test server stopped: %v", http.Serve(listener, handler))
+	}()
+	return listener.Addr().String(), nil
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+func formatLoadTestReport(results []loadTestResult, elapsed time.Duration) string {
+	var sb strings.Builder
+	if len(results) == 0 {
+		return "No requests were sent\n"
+	}
+
+	latencies := make([]time.Duration, len(results))
+	statuses := make(map[int]int)
+	errors := 0
+	for i, r := range results {
+		latencies[i] = r.latency
+		statuses[r.status]++
+		if r.status == 0 || r.status >= 400 {
+			errors++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Fprintf(&sb, "Requests:   %d in %s (%.1f/second)\n", len(results), elapsed.Round(time.Millisecond),
+		float64(len(results))/elapsed.Seconds())
+	fmt.Fprintf(&sb, "Errors:     %d (%.2f%%)\n", errors, 100*float64(errors)/float64(len(results)))
+	fmt.Fprintf(&sb, "Latency:    p50 %s  p90 %s  p95 %s  p99 %s  max %s\n",
+		percentile(latencies, 50).Round(time.Microsecond), percentile(latencies, 90).Round(time.Microsecond),
+		percentile(latencies, 95).Round(time.Microsecond), percentile(latencies, 99).Round(time.Microsecond),
+		latencies[len(latencies)-1].Round(time.Microsecond))
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	sb.WriteString("Statuses:  ")
+	for _, code := range codes {
+		label := fmt.Sprint(code)
+		if code == 0 {
+			label = "no response"
+		}
+		fmt.Fprintf(&sb, " %s: %d", label, statuses[code])
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
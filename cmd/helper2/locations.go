@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// profileLocationsSchema keeps a normalized copy of each profile's location
+// and rate or budget. chai can't add a location_key column to the profile
+// tables or index an expression like LOWER(location), so the key lives in
+// its own table, written in the same transaction as the profile.
+const profileLocationsSchema = `
+	CREATE TABLE IF NOT EXISTS profile_locations (
+		email TEXT,
+		role TEXT,
+		location TEXT,
+		location_key TEXT,
+		amount REAL,
+		PRIMARY KEY (email, role)
+	);
+	CREATE INDEX IF NOT EXISTS idx_profile_locations_key ON profile_locations(role, location_key, amount);
+
+	CREATE INDEX IF NOT EXISTS idx_caregivers_rate ON caregivers(rate_expectations);
+	CREATE INDEX IF NOT EXISTS idx_patients_budget ON patients(budget)
+`
+
+// locationIndexes are the indexes added for matching and benchmarks. The
+// index benchmark drops them to measure what they're worth.
+var locationIndexes = []string{"idx_profile_locations_key", "idx_caregivers_rate", "idx_patients_budget"}
+
+// storeProfileLocation records a profile's location key. role is
+// "caregiver" with the hourly rate or "patient" with the budget.
+func storeProfileLocation(q execer, email, role, location string, amount float64) error {
+	err := q.Exec(`
+		INSERT INTO profile_locations (email, role, location, location_key, amount)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, role, location, locationKey(location), amount)
+	if err != nil {
+		return fmt.Errorf("failed to store profile location: %v", err)
+	}
+	return nil
+}
+
+// backfillProfileLocations keys profiles stored before profile_locations
+// existed. Profiles that already have a key are left alone.
+func backfillProfileLocations(db *instrumentedDB) error {
+	for _, t := range []struct{ role, query string }{
+		{"caregiver", "SELECT email, location, rate_expectations FROM caregivers"},
+		{"patient", "SELECT email, location, budget FROM patients"},
+	} {
+		result, err := db.Query(t.query)
+		if err != nil {
+			return fmt.Errorf("failed to query %s locations: %v", t.role, err)
+		}
+		err = result.Iterate(func(r *chai.Row) error {
+			var email, location string
+			var amount float64
+			if err := r.Scan(&email, &location, &amount); err != nil {
+				return fmt.Errorf("failed to scan %s location: %v", t.role, err)
+			}
+			return db.Exec(`
+				INSERT INTO profile_locations (email, role, location, location_key, amount)
+				VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT DO NOTHING
+			`, email, t.role, location, locationKey(location), amount)
+		})
+		result.Close()
+		if err != nil {
+			return fmt.Errorf("failed to backfill profile locations: %v", err)
+		}
+	}
+	return nil
+}
+
+// profilesIn returns the emails of role's profiles whose location has the
+// same key as location, by an index lookup on profile_locations
+func (app *App) profilesIn(role, location string) (map[string]bool, error) {
+	emails := make(map[string]bool)
+	key := locationKey(location)
+	if key == "" {
+		return emails, nil
+	}
+	result, err := app.db.Query("SELECT email FROM profile_locations WHERE role = ? AND location_key = ?", role, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profiles by location: %v", err)
+	}
+	defer result.Close()
+
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		if err := r.Scan(&email); err != nil {
+			return fmt.Errorf("failed to scan profile location: %v", err)
+		}
+		emails[email] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// benchmarkPlace is the location of the i-th synthetic profile, spread
+// over locations towns. Case and spacing vary so the key has something to
+// normalize.
+func benchmarkPlace(i, locations int) string {
+	if i%2 == 0 {
+		return fmt.Sprintf("Town %d", i%locations)
+	}
+	return fmt.Sprintf("  town   %d ", i%locations)
+}
+
+// seedBenchmarkProfiles stores profiles synthetic caregivers and as many
+// patients, caregiver-<i>@example.com and patient-<i>@example.com
+func seedBenchmarkProfiles(app *App, profiles, locations int) error {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < profiles; i++ {
+		c := &Caregiver{
+			Email:            fmt.Sprintf("caregiver-%d@example.com", i),
+			Name:             fmt.Sprintf("Caregiver %d", i),
+			Location:         benchmarkPlace(i, locations),
+			RateExpectations: 15 + float64(rng.Intn(30)),
+		}
+		if err := app.StoreCaregiver(c); err != nil {
+			return err
+		}
+		p := &Patient{
+			Email:       fmt.Sprintf("patient-%d@example.com", i),
+			Name:        fmt.Sprintf("Patient %d", i),
+			Location:    benchmarkPlace(i+1, locations),
+			Budget:      15 + float64(rng.Intn(30)),
+			PhoneNumber: fmt.Sprintf("+1555%07d", i),
+		}
+		if err := app.StorePatient(p); err != nil {
+			return err
+		}
+		// Let each pair's indexing finish rather than piling up hundreds
+		// of background writers on the database at once
+		app.profileWork.Wait()
+	}
+	return nil
+}
+
+// dropLocationIndexes drops locationIndexes, to measure queries without
+// them
+func dropLocationIndexes(app *App) error {
+	for _, name := range locationIndexes {
+		if err := app.db.Exec("DROP INDEX " + name); err != nil {
+			return fmt.Errorf("failed to drop index %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// runIndexBenchmark is the "indexbench" subcommand. It fills an in-memory
+// database with synthetic profiles, times location benchmarks and matching
+// with the location indexes and again without them, and prints both.
+// BenchmarkFindMatchingCaregivers measures matching the same way under go
+// test -bench.
+func runIndexBenchmark(args []string) error {
+	fs := flag.NewFlagSet("indexbench", flag.ExitOnError)
+	profiles := fs.Int("profiles", 2000, "Caregivers and patients to create, each")
+	locations := fs.Int("locations", 50, "Distinct locations to spread them over")
+	queries := fs.Int("queries", 200, "Queries to time per measurement")
+	fs.Parse(args)
+	if *profiles <= 0 || *locations <= 0 || *queries <= 0 {
+		return fmt.Errorf("-profiles, -locations and -queries must be positive")
+	}
+
+	*offline = true
+	if err := goOffline(); err != nil {
+		return err
+	}
+	app, err := openApp(":memory:", "")
+	if err != nil {
+		return err
+	}
+	defer app.Close()
+
+	fmt.Printf("Creating %d caregivers and %d patients in %d locations\n", *profiles, *profiles, *locations)
+	if err := seedBenchmarkProfiles(app, *profiles, *locations); err != nil {
+		return err
+	}
+
+	measure := func() (benchmarks, matching time.Duration, err error) {
+		start := time.Now()
+		for i := 0; i < *queries; i++ {
+			if _, err := app.RateBenchmarks(benchmarkPlace(i, *locations)); err != nil {
+				return 0, 0, err
+			}
+		}
+		benchmarks = time.Since(start) / time.Duration(*queries)
+
+		start = time.Now()
+		for i := 0; i < *queries; i++ {
+			if _, err := app.FindMatchingCaregivers(fmt.Sprintf("patient-%d@example.com", i%*profiles)); err != nil {
+				return 0, 0, err
+			}
+		}
+		matching = time.Since(start) / time.Duration(*queries)
+		return benchmarks, matching, nil
+	}
+
+	withBenchmarks, withMatching, err := measure()
+	if err != nil {
+		return err
+	}
+	if err := dropLocationIndexes(app); err != nil {
+		return err
+	}
+	withoutBenchmarks, withoutMatching, err := measure()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-26s %14s %14s %8s\n", "Query (mean)", "indexed", "unindexed", "speedup")
+	for _, row := range []struct {
+		name          string
+		with, without time.Duration
+	}{
+		{"Rate benchmarks for a town", withBenchmarks, withoutBenchmarks},
+		{"Matching caregivers", withMatching, withoutMatching},
+	} {
+		fmt.Printf("%-26s %14s %14s %7.1fx\n", row.name, row.with.Round(time.Microsecond),
+			row.without.Round(time.Microsecond), float64(row.without)/float64(row.with))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestProfilesInMatchesLocationKey(t *testing.T) {
+	app := newTestApp(t)
+	if err := seedBenchmarkProfiles(app, 4, 2); err != nil {
+		t.Fatal(err)
+	}
+	// Caregivers 0 and 2 are in "Town 0"; the lookup ignores case
+	nearby, err := app.profilesIn("caregiver", "TOWN 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearby) != 2 || !nearby["caregiver-0@example.com"] || !nearby["caregiver-2@example.com"] {
+		t.Errorf("caregivers in Town 0: got %v", nearby)
+	}
+	if nearby, _ := app.profilesIn("caregiver", ""); len(nearby) != 0 {
+		t.Errorf("caregivers with no location: got %v, want none", nearby)
+	}
+}
+
+// BenchmarkFindMatchingCaregivers matches patients among synthetic
+// profiles with the location indexes, then without them
+func BenchmarkFindMatchingCaregivers(b *testing.B) {
+	b.Setenv("OPENAI_API_KEY", "")
+	previous := openAICircuit.next
+	openAICircuit.next = fakeOpenAI{}
+	defer func() { openAICircuit.next = previous }()
+
+	app := newTestApp(b)
+	const profiles, locations = 500, 25
+	if err := seedBenchmarkProfiles(app, profiles, locations); err != nil {
+		b.Fatal(err)
+	}
+
+	match := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := app.FindMatchingCaregivers(fmt.Sprintf("patient-%d@example.com", i%profiles)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("indexed", match)
+	if err := dropLocationIndexes(app); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("unindexed", match)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// People sign in by email: /login sends a link, and following it opens a
+// session, a server-side record named by a cookie. Each request made in a
+// session refreshes it. A session ends when it's been idle too long, when
+// it reaches its absolute lifetime however busy it is, when its owner
+// signs out, or when they sign out everywhere, which ends every session
+// for their email.
+
+const loginSchema = `
+	CREATE TABLE IF NOT EXISTS login_links (
+		token TEXT PRIMARY KEY,
+		email TEXT,
+		created_at TIMESTAMP,
+		expires_at TIMESTAMP,
+		used_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS login_sessions (
+		token TEXT PRIMARY KEY,
+		email TEXT,
+		created_at TIMESTAMP,
+		last_seen_at TIMESTAMP,
+		expires_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_login_sessions_email ON login_sessions(email)
+`
+
+const loginCookie = "session"
+
+// loginRefreshInterval is how stale a session's last request may get
+// before a request records a new one, so that not every request writes
+const loginRefreshInterval = time.Minute
+
+// LoginSession is one signed-in browser
+type LoginSession struct {
+	Token      string    `json:"-"`
+	Email      string    `json:"email"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"` // However active it is
+}
+
+// idleExpiry is when the session ends if no further requests are made
+func (s *LoginSession) idleExpiry() time.Time {
+	return s.LastSeenAt.Add(time.Duration(config.Sessions.IdleMinutes) * time.Minute)
+}
+
+// expired reports whether the session has ended by either limit
+func (s *LoginSession) expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt) || !now.Before(s.idleExpiry())
+}
+
+func newLoginToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SendSignInLink emails a link that signs email in. Without an email
+// provider the link is logged instead, so a development server can still
+// be signed in to.
+func (app *App) SendSignInLink(email string) error {
+	email = strings.TrimSpace(email)
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("enter your email address")
+	}
+	now := time.Now()
+	token := newLoginToken()
+	err := app.db.Exec("INSERT INTO login_links (token, email, created_at, expires_at, used_at) VALUES (?, ?, ?, ?, ?)",
+		token, email, now, now.Add(time.Duration(config.Sessions.LinkMinutes)*time.Minute), time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to store sign-in link: %v", err)
+	}
+
+	link := fmt.Sprintf("%s/login/verify?token=%s", config.Email.BaseURL, token)
+	n := Notification{
+		Email: email,
+		Kind:  NotifySignIn,
+		Data: map[string]interface{}{
+			"SignInURL": link,
+			"Minutes":   config.Sessions.LinkMinutes,
+		},
+	}
+	rendered, err := app.renderNotification(n)
+	if err != nil {
+		return err
+	}
+	// Sent whatever the user's notification settings, which only cover
+	// what we'd tell them unasked
+	if err := app.sendEmail(n, rendered); err != nil {
+		return err
+	}
+	if app.mailer.Name() == "log" {
+		log.Printf("Sign-in link for %s: %s", email, link)
+	}
+	return nil
+}
+
+// RedeemSignInLink opens a session for the email a sign-in link was sent
+// to. Each link works once.
+func (app *App) RedeemSignInLink(token string) (*LoginSession, error) {
+	var s *LoginSession
+	err := app.withTx(func(tx *chai.Tx) error {
+		var email string
+		var expiresAt, usedAt time.Time
+		result, err := tx.Query("SELECT email, expires_at, used_at FROM login_links WHERE token = ?", token)
+		if err != nil {
+			return fmt.Errorf("failed to query sign-in link: %v", err)
+		}
+		found := false
+		err = result.Iterate(func(r *chai.Row) error {
+			found = true
+			return r.Scan(&email, &expiresAt, &usedAt)
+		})
+		result.Close()
+		if err != nil {
+			return fmt.Errorf("failed to scan sign-in link: %v", err)
+		}
+		now := time.Now()
+		if !found || !usedAt.IsZero() || now.After(expiresAt) || token == "" {
+			return fmt.Errorf("this sign-in link has expired or was already used; ask for another")
+		}
+		if err := tx.Exec("UPDATE login_links SET used_at = ? WHERE token = ?", now, token); err != nil {
+			return fmt.Errorf("failed to use sign-in link: %v", err)
+		}
+
+		s = &LoginSession{
+			Token:      newLoginToken(),
+			Email:      email,
+			CreatedAt:  now,
+			LastSeenAt: now,
+			ExpiresAt:  now.Add(time.Duration(config.Sessions.AbsoluteHours) * time.Hour),
+		}
+		err = tx.Exec(`
+			INSERT INTO login_sessions (token, email, created_at, last_seen_at, expires_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, s.Token, s.Email, s.CreatedAt, s.LastSeenAt, s.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to store session: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetLoginSession returns the live session named by token, or nil, and
+// refreshes its idle clock
+func (app *App) GetLoginSession(token string) (*LoginSession, error) {
+	result, err := app.db.Query(`
+		SELECT token, email, created_at, last_seen_at, expires_at
+		FROM login_sessions WHERE token = ?
+	`, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query session: %v", err)
+	}
+	defer result.Close()
+
+	var s *LoginSession
+	err = result.Iterate(func(r *chai.Row) error {
+		var found LoginSession
+		if err := r.Scan(&found.Token, &found.Email, &found.CreatedAt, &found.LastSeenAt, &found.ExpiresAt); err != nil {
+			return fmt.Errorf("failed to scan session: %v", err)
+		}
+		s = &found
+		return nil
+	})
+	now := time.Now()
+	if err != nil || s == nil || s.expired(now) {
+		return nil, err
+	}
+
+	if now.Sub(s.LastSeenAt) >= loginRefreshInterval {
+		if err := app.db.Exec("UPDATE login_sessions SET last_seen_at = ? WHERE token = ?", now, token); err != nil {
+			return nil, fmt.Errorf("failed to refresh session: %v", err)
+		}
+		s.LastSeenAt = now
+	}
+	return s, nil
+}
+
+// EndLoginSession signs one session out
+func (app *App) EndLoginSession(token string) error {
+	if err := app.db.Exec("DELETE FROM login_sessions WHERE token = ?", token); err != nil {
+		return fmt.Errorf("failed to end session: %v", err)
+	}
+	return nil
+}
+
+// EndAllLoginSessions signs email out everywhere
+func (app *App) EndAllLoginSessions(email string) error {
+	if err := app.db.Exec("DELETE FROM login_sessions WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to end sessions: %v", err)
+	}
+	return nil
+}
+
+// loginPurgeJob deletes ended sessions and sign-in links no longer usable
+func (app *App) loginPurgeJob() error {
+	now := time.Now()
+	idleSince := now.Add(-time.Duration(config.Sessions.IdleMinutes) * time.Minute)
+	err := app.db.Exec("DELETE FROM login_sessions WHERE expires_at <= ? OR last_seen_at <= ?", now, idleSince)
+	if err != nil {
+		return fmt.Errorf("failed to purge sessions: %v", err)
+	}
+	if err := app.db.Exec("DELETE FROM login_links WHERE expires_at <= ?", now); err != nil {
+		return fmt.Errorf("failed to purge sign-in links: %v", err)
+	}
+	return nil
+}
+
+type loginSessionKey struct{}
+
+// loginSessionFrom returns the session a request was made in, or nil
+func loginSessionFrom(r *http.Request) *LoginSession {
+	s, _ := r.Context().Value(loginSessionKey{}).(*LoginSession)
+	return s
+}
+
+// signedInEmail is the email a request's session was signed in as, or ""
+func signedInEmail(r *http.Request) string {
+	if s := loginSessionFrom(r); s != nil {
+		return s.Email
+	}
+	return ""
+}
+
+// requireUser writes a 401 and returns "" unless the request was made in
+// a session, or a 403 if its email parameter names anyone else. It returns
+// who the request acts for: the signed-in user, or the user an admin is
+// impersonating.
+func requireUser(w http.ResponseWriter, r *http.Request) string {
+	email := signedInEmail(r)
+	if i := impersonationFrom(r); i != nil {
+		email = i.Email
+	}
+	if email == "" {
+		http.Error(w, "Sign in at /login to continue", http.StatusUnauthorized)
+		return ""
+	}
+	if claimed := r.FormValue("email"); claimed != "" && !strings.EqualFold(claimed, email) {
+		http.Error(w, "You're signed in as someone else", http.StatusForbidden)
+		return ""
+	}
+	return email
+}
+
+// notRequesterEmail lists the paths whose email parameter names someone
+// other than whoever is asking: the address a sign-in link goes to, a
+// visitor's reply address on a public profile, and a provider's payload
+var notRequesterEmail = []string{"/login", "/c/", "/webhooks/"}
+
+// withLoginSession attaches the session named by the request's cookie,
+// and clears the cookie once the session has ended.
+//
+// The session, not the request, says who a request acts for. An email
+// parameter sent without a session is refused until its owner signs in,
+// one naming anyone but the session's owner is refused unless an admin is
+// impersonating them, and a missing one is filled in from the session, so
+// handlers reading the parameter get the signed-in user.
+func withLoginSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s *LoginSession
+		if cookie, err := r.Cookie(loginCookie); err == nil && cookie.Value != "" {
+			if s, err = chatRoom.GetLoginSession(cookie.Value); err != nil {
+				log.Printf("Error loading session: %v", err)
+			}
+			if s == nil {
+				http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1})
+			}
+		}
+		ctx := r.Context()
+		if s != nil {
+			ctx = context.WithValue(ctx, loginSessionKey{}, s)
+		}
+		for _, prefix := range notRequesterEmail {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
+
+		// Multipart bodies aren't read here; the parameter set below comes
+		// first wherever the handler looks
+		r.ParseForm()
+		claimed := strings.TrimSpace(r.Form.Get("email"))
+		switch {
+		case s == nil && claimed != "":
+			http.Error(w, "Sign in at /login to continue", http.StatusUnauthorized)
+			return
+		case s == nil:
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		acting := s.Email
+		if claimed != "" && !strings.EqualFold(claimed, s.Email) {
+			i := impersonationBy(r, s.Email)
+			if i == nil || !strings.EqualFold(claimed, i.Email) {
+				http.Error(w, "You're signed in as "+s.Email+", not "+claimed, http.StatusForbidden)
+				return
+			}
+			acting = i.Email
+		}
+
+		r = r.Clone(ctx)
+		q := r.URL.Query()
+		q.Set("email", acting)
+		r.URL.RawQuery = q.Encode()
+		r.Form.Set("email", acting)
+		if r.PostForm.Get("email") != "" {
+			r.PostForm.Set("email", acting)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+const loginTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Sign in</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Sign in</h1>
+        </div>
+        {{if .Error}}
+        <div class="message system">{{.Error}}</div>
+        {{end}}
+        {{if .Notice}}
+        <div class="message system">{{.Notice}}</div>
+        {{end}}
+        {{if .Session}}
+        <p>You're signed in as {{.Session.Email}} until {{.Session.ExpiresAt.Format "Jan 2, 3:04 PM"}}.
+        <a href="{{.Root}}?email={{.Session.Email}}">Open {{(brand).Name}}</a></p>
+        <form method="POST" action="{{.Root}}logout" class="message-form">
+            <button type="submit" class="send-button">Sign out</button>
+        </form>
+        <form method="POST" action="{{.Root}}logout" class="message-form">
+            <input type="hidden" name="everywhere" value="1">
+            <button type="submit" class="send-button">Sign out everywhere</button>
+        </form>
+        {{else if .Token}}
+        <form method="POST" class="message-form">
+            <input type="hidden" name="token" value="{{.Token}}">
+            <button type="submit" class="send-button">Sign in</button>
+        </form>
+        {{else if not .Sent}}
+        <form method="POST" action="{{.Root}}login" class="message-form">
+            <input type="email" name="email" class="message-input" placeholder="Your email address" value="{{.Email}}" required>
+            <button type="submit" class="send-button">Email me a sign-in link</button>
+        </form>
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// loginPage is what the sign-in pages show
+type loginPage struct {
+	Root          string // Relative path to the site root
+	Session       *LoginSession
+	Email, Token  string
+	Notice, Error string
+	Sent          bool
+}
+
+// handleLogin shows who's signed in, or sends a sign-in link on POST
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	page := loginPage{Root: "./", Session: loginSessionFrom(r), Email: r.FormValue("email")}
+	if r.Method == "POST" && page.Session == nil {
+		if err := chatRoom.SendSignInLink(page.Email); err != nil {
+			page.Error = err.Error()
+		} else {
+			page.Sent = true
+			page.Notice = fmt.Sprintf("We've emailed a sign-in link to %s. It works once, for %d minutes.",
+				page.Email, config.Sessions.LinkMinutes)
+		}
+	}
+	renderTemplate(w, "login", loginTemplate, page)
+}
+
+// handleLoginVerify signs in with an emailed link. Like unsubscribe links,
+// GET only asks, so link scanners that follow it don't use it up.
+func handleLoginVerify(w http.ResponseWriter, r *http.Request) {
+	page := loginPage{Root: "../", Token: r.FormValue("token")}
+	if r.Method != "POST" {
+		renderTemplate(w, "login", loginTemplate, page)
+		return
+	}
+	s, err := chatRoom.RedeemSignInLink(page.Token)
+	if err != nil {
+		page.Token, page.Error = "", err.Error()
+		renderTemplate(w, "login", loginTemplate, page)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    s.Token,
+		Path:     "/",
+		Expires:  s.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "../?email="+url.QueryEscape(s.Email), http.StatusSeeOther)
+}
+
+// handleLogout signs this session out, or with everywhere=1 every
+// session for its email
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page := loginPage{Root: "./", Notice: "You're signed out."}
+	if s := loginSessionFrom(r); s != nil {
+		var err error
+		if r.FormValue("everywhere") == "1" {
+			err = chatRoom.EndAllLoginSessions(s.Email)
+			page.Notice = "You're signed out on every device."
+		} else {
+			err = chatRoom.EndLoginSession(s.Token)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Email = s.Email
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1})
+	renderTemplate(w, "login", loginTemplate, page)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// signInLinkToken returns the token of the latest link sent to email
+func signInLinkToken(t *testing.T, app *App, email string) string {
+	t.Helper()
+	result, err := app.db.Query("SELECT token, created_at FROM login_links WHERE email = ?", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Close()
+	var token string
+	var latest time.Time
+	err = result.Iterate(func(r *chai.Row) error {
+		var tok string
+		var created time.Time
+		if err := r.Scan(&tok, &created); err != nil {
+			return err
+		}
+		if created.After(latest) {
+			token, latest = tok, created
+		}
+		return nil
+	})
+	if err != nil || token == "" {
+		t.Fatalf("no sign-in link for %s: %v", email, err)
+	}
+	return token
+}
+
+// serveSignedIn sends a request through withLoginSession to h, in session
+// if it isn't "", and returns the response status. A body is sent as JSON
+// if it looks like JSON, and otherwise as a form.
+func serveSignedIn(h http.HandlerFunc, method, target, body, session string) int {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if strings.HasPrefix(body, "{") {
+		req.Header.Set("Content-Type", "application/json")
+	} else if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: loginCookie, Value: session})
+	}
+	rec := httptest.NewRecorder()
+	withLoginSession(h).ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestSignInLinkOpensSessionOnce(t *testing.T) {
+	app := newTestApp(t)
+	if err := app.SendSignInLink("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	token := signInLinkToken(t, app, "a@example.com")
+
+	s, err := app.RedeemSignInLink(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Email != "a@example.com" {
+		t.Errorf("signed in as %q, want a@example.com", s.Email)
+	}
+	if _, err := app.RedeemSignInLink(token); err == nil {
+		t.Error("a sign-in link worked twice")
+	}
+
+	got, err := app.GetLoginSession(s.Token)
+	if err != nil || got == nil || got.Email != "a@example.com" {
+		t.Fatalf("GetLoginSession = %+v, %v", got, err)
+	}
+}
+
+func TestLoginSessionExpiry(t *testing.T) {
+	app := newTestApp(t)
+	open := func() *LoginSession {
+		t.Helper()
+		if err := app.SendSignInLink("a@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		s, err := app.RedeemSignInLink(signInLinkToken(t, app, "a@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	live := func(s *LoginSession) bool {
+		t.Helper()
+		got, err := app.GetLoginSession(s.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got != nil
+	}
+
+	// A request refreshes an idle session
+	idle := open()
+	lastSeen := time.Now().Add(-time.Duration(config.Sessions.IdleMinutes-1) * time.Minute)
+	if err := app.db.Exec("UPDATE login_sessions SET last_seen_at = ? WHERE token = ?", lastSeen, idle.Token); err != nil {
+		t.Fatal(err)
+	}
+	if !live(idle) {
+		t.Fatal("session ended before its idle timeout")
+	}
+	refreshed, _ := app.GetLoginSession(idle.Token)
+	if !refreshed.LastSeenAt.After(lastSeen) {
+		t.Error("request didn't refresh the session")
+	}
+
+	// ...but not one that's been idle too long
+	lastSeen = time.Now().Add(-time.Duration(config.Sessions.IdleMinutes+1) * time.Minute)
+	if err := app.db.Exec("UPDATE login_sessions SET last_seen_at = ? WHERE token = ?", lastSeen, idle.Token); err != nil {
+		t.Fatal(err)
+	}
+	if live(idle) {
+		t.Error("idle session still live")
+	}
+
+	// However busy, a session ends at its absolute expiry
+	old := open()
+	if err := app.db.Exec("UPDATE login_sessions SET expires_at = ? WHERE token = ?", time.Now(), old.Token); err != nil {
+		t.Fatal(err)
+	}
+	if live(old) {
+		t.Error("session live past its absolute expiry")
+	}
+}
+
+func TestSignOutEverywhere(t *testing.T) {
+	app := newTestApp(t)
+	var sessions []*LoginSession
+	for i := 0; i < 2; i++ {
+		if err := app.SendSignInLink("a@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		s, err := app.RedeemSignInLink(signInLinkToken(t, app, "a@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	if err := app.EndLoginSession(sessions[0].Token); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := app.GetLoginSession(sessions[0].Token); s != nil {
+		t.Error("signed-out session still live")
+	}
+	if s, _ := app.GetLoginSession(sessions[1].Token); s == nil {
+		t.Fatal("signing out one session ended another")
+	}
+
+	if err := app.EndAllLoginSessions("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := app.GetLoginSession(sessions[1].Token); s != nil {
+		t.Error("session live after signing out everywhere")
+	}
+}
+
+func TestSessionDecidesWhoRequestActsFor(t *testing.T) {
+	app := newTestApp(t)
+	session := signIn(t, app, "a@example.com")
+	handler := withLoginSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.FormValue("email"), " ", r.URL.Query().Get("email"))
+	}))
+
+	serve := func(method, target, body, session string) (int, string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: loginCookie, Value: session})
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	tests := []struct {
+		name, method, target, body, session string
+		code                                int
+		acting                              string
+	}{
+		{"no session", "GET", "/export?email=a@example.com", "", "", http.StatusUnauthorized, ""},
+		{"someone else's email", "GET", "/export?email=b@example.com", "", session, http.StatusForbidden, ""},
+		{"someone else's email in a form", "POST", "/chat", "email=b@example.com", session, http.StatusForbidden, ""},
+		{"own email", "GET", "/export?email=A@example.com", "", session, http.StatusOK, "a@example.com a@example.com"},
+		{"email left out", "POST", "/chat", "message=hi", session, http.StatusOK, "a@example.com a@example.com"},
+		{"sign-in link for anyone", "POST", "/login", "email=b@example.com", "", http.StatusOK, "b@example.com "},
+	}
+	for _, tt := range tests {
+		code, body := serve(tt.method, tt.target, tt.body, tt.session)
+		if code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.code)
+		} else if tt.acting != "" && body != tt.acting {
+			t.Errorf("%s: handler saw %q, want %q", tt.name, body, tt.acting)
+		}
+	}
+}
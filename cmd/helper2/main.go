@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -13,12 +13,14 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/chaisql/chai"
+	"github.com/rfielding/helper2/internal/server"
 )
 
 // Database models
@@ -32,6 +34,7 @@ type Caregiver struct {
 	RateExpectations float64   `json:"rate_expectations"`
 	Certifications   string    `json:"certifications"`
 	CreatedAt        time.Time `json:"created_at"`
+	MatchReasons     []string  `json:"match_reasons,omitempty"` // Set on match results only
 }
 
 type Patient struct {
@@ -44,6 +47,7 @@ type Patient struct {
 	SpecialRequirements  string    `json:"special_requirements"`
 	PhoneNumber          string    `json:"phone_number"`
 	CreatedAt            time.Time `json:"created_at"`
+	MatchReasons         []string  `json:"match_reasons,omitempty"` // Set on match results only
 }
 
 type Match struct {
@@ -51,6 +55,7 @@ type Match struct {
 	PatientEmail   string    `json:"patient_email"`
 	Status         string    `json:"status"`
 	CreatedAt      time.Time `json:"created_at"`
+	AgreedRate     float64   `json:"agreed_rate,omitempty"` // Hourly; zero until both sides agree one
 }
 
 type Message struct {
@@ -79,7 +84,16 @@ type Choice struct {
 }
 
 type ChatResponse struct {
+	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
+}
+
+// Usage is the token accounting OpenAI returns with each completion
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 type UserContext struct {
@@ -88,11 +102,31 @@ type UserContext struct {
 }
 
 type App struct {
-	db           *chai.DB
-	userSessions map[string][]Message // Map of email -> messages
-	apiKey       string
-	maxHistory   int
-	mu           sync.RWMutex // Mutex for thread-safe access
+	db          *instrumentedDB
+	sessions    map[string]*session // Map of email -> recent messages
+	apiKey      string
+	maxHistory  int          // Messages kept per session
+	maxSessions int          // Sessions kept before the least recently used is evicted
+	mu          sync.RWMutex // Guards sessions
+	prompts     *promptStore
+	tools       *toolPolicy
+	cache       *ttlCache     // LLM completions and tool results
+	relay       relayProvider // nil when phone relays aren't configured
+	scheduler   *Scheduler
+	objects     ObjectStore // Uploads, saved exports and archives
+	events      *eventBus
+	presence    *presenceTracker
+	realtime    *realtimeHub
+	mailer      mailer
+	sms         *smsSender        // nil when text messages aren't configured
+	telegram    *telegramBot      // nil when the Telegram bot isn't configured
+	whatsapp    *whatsAppSender   // nil when WhatsApp isn't configured
+	checks      backgroundChecker // nil when background checks aren't configured
+	gcal        *googleCalendar   // nil when Google Calendar isn't configured
+	profileWork sync.WaitGroup    // Indexing after profile writes, which Close waits for
+	// onToolCall, if set, sees every tool call the model makes before it
+	// runs; the scenario runner uses it to check expected calls
+	onToolCall func(email, name string, args map[string]interface{})
 }
 
 var (
@@ -100,17 +134,16 @@ var (
 )
 
 const (
-	htmlTemplate = `
-<!DOCTYPE html>
-<html>
-<head>
-    <title>Helper - Connecting Caregivers to Patients</title>
+	// pageStyles is shared by every server-rendered page. It also defines
+	// the "logo" template used in page headers.
+	pageStyles = `{{define "logo"}}{{with brand}}{{if .LogoPath}}<img class="logo" src="{{.LogoPath}}" alt="{{.Name}}">{{else}}<div class="red-cross">✚</div>{{end}}{{end}}{{end}}
     <style>
         :root {
             --bg-color: #1a1a1a;
             --text-color: #e0e0e0;
-            --primary-color: #4CAF50;
-            --primary-hover: #45a049;
+            --primary-color: {{(brand).PrimaryColor}};
+            --primary-hover: {{(brand).PrimaryHover}};
+            --accent-color: {{(brand).AccentColor}};
             --secondary-bg: #2d2d2d;
             --border-color: #404040;
             --highlight-bg: #333333;
@@ -134,11 +167,16 @@ const (
         }
 
         .red-cross {
-            color: #FF4444;
+            color: var(--accent-color);
             font-size: 2em;
             margin-bottom: 10px;
         }
 
+        .logo {
+            max-height: 64px;
+            margin-bottom: 10px;
+        }
+
         .app-description {
             color: #888;
             font-style: italic;
@@ -151,6 +189,80 @@ const (
             padding: 20px;
         }
 
+        .upload-form {
+            text-align: right;
+            color: #888;
+            font-size: 0.9em;
+        }
+
+        .typing {
+            color: #888;
+            font-style: italic;
+            min-height: 1.6em;
+        }
+
+        .presence {
+            color: #888;
+            font-size: 0.9em;
+        }
+
+        .presence.online {
+            color: var(--primary-color);
+        }
+
+        .impersonation-banner {
+            background: var(--accent-color);
+            color: #fff;
+            padding: 8px 12px;
+            margin-bottom: 10px;
+            border-radius: 4px;
+        }
+
+        .impersonation-banner form {
+            display: inline;
+        }
+
+        .proposal-card table {
+            margin: 8px 0;
+        }
+
+        .proposal-card th {
+            text-align: left;
+            padding-right: 12px;
+        }
+
+        .thread-form {
+            margin-bottom: 10px;
+        }
+
+        .status-banner {
+            background: #fff3cd;
+            color: #664d03;
+            padding: 8px 12px;
+            margin-bottom: 10px;
+            border-radius: 4px;
+        }
+
+        .hp {
+            position: absolute;
+            left: -10000px;
+        }
+
+        .verified {
+            color: var(--primary-color);
+            font-size: 0.9em;
+        }
+
+        .attachments {
+            text-align: right;
+            margin-bottom: 10px;
+        }
+
+        #messages {
+            max-height: 60vh;
+            overflow-y: auto;
+        }
+
         .message {
             margin: 10px 0;
             padding: 15px;
@@ -170,6 +282,11 @@ const (
             background-color: #2c3440;
         }
 
+        .staff {
+            background-color: #3d3420;
+            border-left: 4px solid #f1c40f;
+        }
+
         .message-form {
             display: flex;
             gap: 10px;
@@ -275,6 +392,12 @@ const (
             font-size: 1.1em;
         }
 
+        .report-block summary {
+            cursor: pointer;
+            color: #888;
+            font-size: 0.9em;
+        }
+
         .calendar {
             background-color: var(--secondary-bg);
             border-radius: 8px;
@@ -322,35 +445,538 @@ const (
             background-color: var(--primary-hover);
         }
 
+        .profile-status {
+            color: #888;
+            font-size: 0.9em;
+            margin-bottom: 10px;
+        }
+
+        .profile-status progress {
+            accent-color: var(--primary-color);
+            vertical-align: middle;
+        }
+
+        .wizard-form label {
+            display: block;
+            margin-bottom: 15px;
+        }
+
+        .wizard-form input,
+        .wizard-form textarea,
+        .wizard-form select {
+            display: block;
+            width: 100%;
+            box-sizing: border-box;
+            padding: 8px;
+            margin-top: 4px;
+            border-radius: 4px;
+            border: 1px solid var(--border-color);
+            background-color: var(--bg-color);
+            color: var(--text-color);
+        }
+
+        .wizard-form input[type="checkbox"] {
+            display: inline;
+            width: auto;
+        }
+
+        .wizard-form small {
+            color: #888;
+        }
+
+        .unread-threads {
+            display: flex;
+            flex-wrap: wrap;
+            gap: 10px;
+            margin-bottom: 20px;
+        }
+
+        .unread-badge {
+            background-color: var(--secondary-bg);
+            border: 1px solid var(--border-color);
+            border-radius: 16px;
+            padding: 4px 12px;
+        }
+
+        .unread-badge b {
+            background-color: var(--primary-color);
+            color: white;
+            border-radius: 10px;
+            padding: 0 8px;
+            margin-left: 6px;
+        }
+
+        .query-results {
+            border-collapse: collapse;
+            width: 100%;
+        }
+
+        .query-results th,
+        .query-results td {
+            border: 1px solid var(--border-color);
+            padding: 6px 10px;
+            text-align: left;
+        }
+
         h1, h2, h3, h4 {
             color: var(--text-color);
         }
     </style>
-</head>
+`
+
+	htmlTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - {{(brand).Tagline}}</title>
+` + pageStyles + `</head>
 <body>
     <div class="chat-container">
         <div class="header">
-            <div class="red-cross">✚</div>
-            <h1>Helper</h1>
-            <div class="app-description">Connecting Caregivers to Patients</div>
+            {{template "logo"}}
+            <h1>{{(brand).Name}}</h1>
+            <div class="app-description">{{(brand).Tagline}}</div>
+        </div>
+        {{with .Impersonation}}
+        <div class="impersonation-banner">
+            Viewing as {{.Email}} ({{if .ReadOnly}}read-only{{else}}full access{{end}}) · signed in as {{.Admin}} · ends {{.ExpiresAt.Format "3:04 PM"}}
+            <form method="POST" action="admin/impersonate">
+                <input type="hidden" name="email" value="{{.Admin}}">
+                <button type="submit" name="action" value="end">End impersonation</button>
+            </form>
+        </div>
+        {{end}}
+        {{with .Maintenance}}
+        <div class="status-banner">{{.Message}}</div>
+        {{end}}
+        {{if or .AssistantDown .ReplyPending}}
+        <div class="status-banner">
+            {{if .AssistantDown}}The assistant is having trouble right now. You can still ask to see your matches or your profile.{{end}}
+            {{if .ReplyPending}}Your last message is saved and will be answered as soon as the assistant is back.{{end}}
         </div>
+        {{end}}
+        {{with .Handoff}}
+        <div class="status-banner">
+            {{if eq .Status "active"}}You're talking with a person from our team; the assistant is paused.{{else}}A person from our team has been asked to join and will reply here.{{end}}
+        </div>
+        {{end}}
+        {{with .Suspension}}
+        <div class="status-banner">Your account is suspended{{if not .EndsAt.IsZero}} until {{.EndsAt.Format "Jan 2"}}{{end}}, so you can't be matched or message other users{{if .EndsAt.IsZero}} for now{{end}}.</div>
+        {{end}}
+        {{if .PendingConsents}}
+        <form class="status-banner" method="POST" action="consent">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            Before you can be matched, please read and accept the
+            {{range $i, $d := .PendingConsents}}{{if $i}} and {{end}}<a href="legal?kind={{$d.Kind}}&version={{$d.Version}}" target="_blank">{{$d.Title}}</a>{{end}}.
+            <label><input type="checkbox" name="agree" value="yes" required> I agree</label>
+            <button type="submit">Continue</button>
+        </form>
+        {{end}}
         <div class="user-email">
-            <img src="static/images/default-avatar.png" alt="User Avatar" class="avatar">
+            <img src="avatar?email={{.UserEmail}}" alt="User Avatar" class="avatar">
             Logged in as: {{.UserEmail}}
+            <a href="export?email={{.UserEmail}}">Download my conversation</a>
+            <a href="export?email={{.UserEmail}}&format=html">Printable transcript</a>
+            <a href="settings/notifications?email={{.UserEmail}}">Notification settings</a>
+            <a href="settings/calendar?email={{.UserEmail}}">Calendar feed</a>
+            {{with .Shortlisted}}<a href="favorites?email={{$.UserEmail}}">Shortlist ({{.}})</a>{{end}}
+            {{with .Referral}}
+            <div>Invite others with <a href="{{.Link}}">this link</a> (code {{.Code}}) · {{.Invited}} invited, {{.Registered}} registered</div>
+            {{end}}
+        </div>
+        <form class="thread-form" method="POST" action="threads">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <select name="thread" aria-label="Conversation">
+                {{range .Threads}}<option value="{{.ID}}"{{if .Active}} selected{{end}}>{{.Name}}</option>{{end}}
+            </select>
+            <button type="submit" name="action" value="switch">Switch</button>
+            <input type="text" name="name" placeholder="Name (optional)" maxlength="60">
+            <button type="submit" name="action" value="new">New conversation</button>
+        </form>
+        <form class="upload-form" method="POST" action="avatar" enctype="multipart/form-data">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <label>Profile photo <input type="file" name="avatar" accept="image/*" required></label>
+            <button type="submit">Upload</button>
+        </form>
+        <form class="upload-form" method="POST" action="attachments" enctype="multipart/form-data">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <label>Document <input type="file" name="file" required></label>
+            <button type="submit">Attach</button>
+        </form>
+        {{if .ShowOnboarding}}
+        <div class="message system">
+            New here? <a href="onboarding?email={{.UserEmail}}">Set up your profile with a short form</a>,
+            or just tell the assistant about yourself below.
+        </div>
+        {{end}}
+        {{with .ProfileStatus}}
+        <div class="profile-status">
+            <progress value="{{.Percent}}" max="100"></progress> Profile {{.Percent}}% complete
+            {{if .MissingRequired}}· still needed: {{range $i, $f := .MissingRequired}}{{if $i}}, {{end}}{{$f}}{{end}}
+            {{else if .MissingOptional}}· you could also add: {{range $i, $f := .MissingOptional}}{{if $i}}, {{end}}{{$f}}{{end}}{{end}}
+        </div>
+        {{end}}
+        {{with .Phone}}
+        {{if .Verified}}
+        <div class="profile-status">📱 {{.Number}} <span class="verified">✅ verified</span>{{with .WhatsApp}} · <a href="{{.}}" target="_blank">Chat on WhatsApp</a>{{end}}</div>
+        {{else if .CanVerify}}
+        <form class="upload-form" method="POST" action="phone/verify">
+            <input type="hidden" name="email" value="{{$.UserEmail}}">
+            📱 {{.Number}} isn't verified yet.
+            <button type="submit">Text me a code</button>
+        </form>
+        <form class="upload-form" method="POST" action="phone/verify">
+            <input type="hidden" name="email" value="{{$.UserEmail}}">
+            <label>Code <input type="text" name="code" inputmode="numeric" autocomplete="one-time-code" size="6" required></label>
+            <button type="submit">Verify</button>
+        </form>
+        {{end}}
+        {{end}}
+        {{with .Telegram}}
+        <form class="upload-form" method="POST" action="telegram/link">
+            <input type="hidden" name="email" value="{{$.UserEmail}}">
+            {{if .Linked}}✈️ Telegram connected
+            <button type="submit" name="action" value="unlink">Disconnect</button>
+            {{else}}✈️ Chat from Telegram too
+            <button type="submit" name="action" value="link">Connect Telegram</button>{{end}}
+        </form>
+        {{end}}
+        {{with .Availability}}
+        <form class="upload-form" method="POST" action="profile/availability">
+            <input type="hidden" name="email" value="{{$.UserEmail}}">
+            {{.Describe}}
+            {{if .Available}}<button type="submit" name="action" value="pause">Pause matching</button>
+            {{else}}<button type="submit" name="action" value="resume">Resume matching</button>{{end}}
+            <label>Away until <input type="date" name="until"></label>
+            <button type="submit" name="action" value="away">Save</button>
+        </form>
+        {{end}}
+        {{with .PublicProfile}}
+        <form class="upload-form" method="POST" action="profile/public">
+            <input type="hidden" name="email" value="{{$.UserEmail}}">
+            {{if .Enabled}}Your public page: <a href="{{.URL}}" target="_blank">{{.URL}}</a>
+            <button type="submit" name="action" value="disable">Hide my public page</button>
+            {{else}}Share a public page with families outside the app
+            <button type="submit" name="action" value="enable">Create my public page</button>{{end}}
+        </form>
+        {{end}}
+        {{if .CustomFields}}
+        <form class="upload-form" method="POST" action="profile/fields">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            {{range .CustomFields}}
+            <label>{{.Field.Label}}
+                {{if eq .Field.Type "choice"}}
+                <select name="{{.Field.Name}}">
+                    <option value=""></option>
+                    {{$value := .Value}}{{range .Field.Choices}}<option{{if eq . $value}} selected{{end}}>{{.}}</option>{{end}}
+                </select>
+                {{else if eq .Field.Type "boolean"}}
+                <select name="{{.Field.Name}}">
+                    <option value=""></option>
+                    <option value="true"{{if eq .Value "true"}} selected{{end}}>Yes</option>
+                    <option value="false"{{if eq .Value "false"}} selected{{end}}>No</option>
+                </select>
+                {{else}}
+                <input type="{{if eq .Field.Type "number"}}number{{else}}text{{end}}" name="{{.Field.Name}}" value="{{.Value}}">
+                {{end}}
+            </label>
+            {{end}}
+            <button type="submit">Save details</button>
+        </form>
+        {{end}}
+        {{with .Certifications}}
+        <div class="attachments">
+            Certifications{{if .Verified}} <span class="verified">✓ Document verified</span>{{end}}:
+            {{range .List}}
+            <span>{{if eq .Status "extracted"}}{{.Type}}{{if .Issuer}} ({{.Issuer}}){{end}}{{if not .ExpiresOn.IsZero}}, {{if .Expired}}<strong>expired</strong>{{else}}{{if .ExpiresSoon}}<strong>expires</strong>{{else}}expires{{end}}{{end}} {{.ExpiresOn.Format "Jan 2, 2006"}}{{end}}{{else if eq .Status "pending"}}Reading…{{else}}Unreadable{{end}}</span> ·
+            {{else}}none yet ·
+            {{end}}
+            <form class="upload-form" method="POST" action="certifications" enctype="multipart/form-data" style="display:inline">
+                <input type="hidden" name="email" value="{{$.UserEmail}}">
+                <input type="file" name="file" accept="image/*,application/pdf" required aria-label="Certificate photo or PDF">
+                <button type="submit">Add certificate</button>
+            </form>
+        </div>
+        {{end}}
+        {{with .BackgroundCheck}}
+        <div class="attachments">
+            Background check:
+            {{if .Checked}}<span class="verified">✓ Background checked</span>
+            {{else if .Latest}}{{.Latest.Status}}{{if and (eq .Latest.Status "invited") .Latest.InvitationURL}} · <a href="{{.Latest.InvitationURL}}" target="_blank" rel="noopener">Give consent</a>{{end}}
+            {{else}}not started
+            {{end}}
+            {{if .CanRequest}}
+            <form class="upload-form" method="POST" action="background-check" style="display:inline">
+                <input type="hidden" name="email" value="{{$.UserEmail}}">
+                <button type="submit">Start background check</button>
+            </form>
+            {{end}}
+        </div>
+        {{end}}
+        {{if .Attachments}}
+        <div class="attachments">
+            {{range .Attachments}}<a href="attachments/download?email={{$.UserEmail}}&id={{.ID}}">📎 {{.Name}}</a> {{end}}
+        </div>
+        {{end}}
+        {{if .PeerThreads}}
+        <div class="unread-threads">
+            Messages:
+            {{range .PeerThreads}}<a class="unread-badge" href="thread?email={{$.UserEmail}}&peer={{.Peer}}">{{.Peer}}{{if .Unread}} <b>{{.Unread}}</b>{{end}}</a> {{end}}
+        </div>
+        {{end}}
+        {{range .ContactRequests}}
+        <div class="message system">
+            <strong>{{.Requester}}</strong> would like to exchange contact details with you.
+            <form class="schedule-form" method="POST" action="contact/respond">
+                <input type="hidden" name="email" value="{{$.UserEmail}}">
+                <input type="hidden" name="requester" value="{{.Requester}}">
+                <button type="submit" name="decision" value="accept">Share my contact details</button>
+                <button type="submit" name="decision" value="deny">Decline</button>
+            </form>
         </div>
-        <div id="messages">
+        {{end}}
+        <div id="messages" data-email="{{.UserEmail}}" data-cursor="{{.OlderCursor}}"{{if .Speech}} data-speech="1"{{end}}>
             {{range .Messages}}
             <div class="message {{.Role}}">
                 <strong>{{.Role}}:</strong> {{.Content | safeHTML}}
+                {{if and $.Speech (eq .Role "assistant")}}<button type="button" class="speak-button" data-at="{{.CreatedAt.Format "2006-01-02T15:04:05.999999999Z07:00"}}" aria-label="Read this reply aloud">Listen</button>{{end}}
             </div>
             {{end}}
         </div>
-        <form method="POST" action="chat" class="message-form">
+        <div id="typing" class="typing"></div>
+        <form method="POST" action="chat" class="message-form" id="message-form">
             <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="hidden" name="form_time" value="{{.FormTime}}">
+            <input type="text" name="` + honeypotField + `" class="hp" tabindex="-1" autocomplete="off" aria-hidden="true">
             <input type="text" name="message" placeholder="Type your message..." class="message-input" required>
+            {{if .Challenge}}<div class="cf-turnstile" data-sitekey="{{.Challenge}}"></div>{{end}}
             <button type="submit" class="send-button">Send</button>
         </form>
+        {{if and (not .Handoff) (not .Challenge)}}
+        <form method="POST" action="chat" class="upload-form">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="hidden" name="form_time" value="{{.FormTime}}">
+            <input type="hidden" name="message" value="/human">
+            <button type="submit">Talk to a person</button>
+        </form>
+        {{end}}
+        {{if .VoiceNotes}}
+        <form method="POST" action="chat/voice" enctype="multipart/form-data" class="upload-form" id="voice-form">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <label>Voice note <input type="file" name="audio" accept="audio/*" required></label>
+            <button type="submit">Send voice note</button>
+            <button type="button" id="record-button" hidden>Record</button>
+        </form>
+        <script>
+        // Record a voice note in the browser where it can, keeping the file
+        // picker for browsers without MediaRecorder
+        (function() {
+            var form = document.getElementById('voice-form');
+            var button = document.getElementById('record-button');
+            if (!window.MediaRecorder || !navigator.mediaDevices) return;
+            button.hidden = false;
+            var recorder = null;
+            button.addEventListener('click', function() {
+                if (recorder) {
+                    recorder.stop();
+                    return;
+                }
+                navigator.mediaDevices.getUserMedia({audio: true}).then(function(stream) {
+                    var chunks = [];
+                    recorder = new MediaRecorder(stream);
+                    recorder.ondataavailable = function(e) { chunks.push(e.data); };
+                    recorder.onstop = function() {
+                        stream.getTracks().forEach(function(t) { t.stop(); });
+                        var type = recorder.mimeType || 'audio/webm';
+                        var ext = type.indexOf('mp4') >= 0 ? 'mp4' : type.indexOf('ogg') >= 0 ? 'ogg' : 'webm';
+                        var data = new FormData();
+                        data.append('email', form.elements.email.value);
+                        data.append('audio', new Blob(chunks, {type: type.split(';')[0]}), 'voice-note.' + ext);
+                        recorder = null;
+                        button.textContent = 'Sending...';
+                        button.disabled = true;
+                        fetch(form.action, {method: 'POST', body: data}).then(function(resp) {
+                            if (!resp.ok) return resp.text().then(function(t) { alert(t); });
+                            window.location.reload();
+                        }).finally(function() {
+                            button.textContent = 'Record';
+                            button.disabled = false;
+                        });
+                    };
+                    recorder.start();
+                    button.textContent = 'Stop and send';
+                }).catch(function(err) {
+                    alert('Could not use the microphone: ' + err.message);
+                });
+            });
+        })();
+        </script>
+        {{end}}
+        {{if .Challenge}}<script src="https://challenges.cloudflare.com/turnstile/v0/api.js" async defer></script>{{end}}
     </div>
+    <script>
+    // Load older messages a page at a time as the user scrolls up
+    (function() {
+        var box = document.getElementById('messages');
+        var loading = false;
+        box.scrollTop = box.scrollHeight;
+        box.addEventListener('scroll', function() {
+            var cursor = box.dataset.cursor;
+            if (loading || !cursor || box.scrollTop > 50) {
+                return;
+            }
+            loading = true;
+            fetch('api/v1/messages?email=' + encodeURIComponent(box.dataset.email) +
+                  '&before=' + encodeURIComponent(cursor))
+                .then(function(resp) { return resp.json(); })
+                .then(function(page) {
+                    var oldHeight = box.scrollHeight;
+                    var html = '';
+                    (page.messages || []).forEach(function(m) {
+                        var role = m.role.replace(/[^a-z]/g, '');
+                        var listen = '';
+                        if (box.dataset.speech && role === 'assistant') {
+                            listen = ' <button type="button" class="speak-button" data-at="' + m.created_at +
+                                '" aria-label="Read this reply aloud">Listen</button>';
+                        }
+                        html += '<div class="message ' + role + '"><strong>' + role + ':</strong> ' + m.content + listen + '</div>';
+                    });
+                    box.insertAdjacentHTML('afterbegin', html);
+                    box.dataset.cursor = page.next_cursor || '';
+                    box.scrollTop = box.scrollHeight - oldHeight;
+                })
+                .finally(function() { loading = false; });
+        });
+    })();
+
+    // Play an assistant reply read aloud in place of its Listen button
+    (function() {
+        var box = document.getElementById('messages');
+        box.addEventListener('click', function(e) {
+            var button = e.target.closest('.speak-button');
+            if (!button) return;
+            var audio = document.createElement('audio');
+            audio.controls = true;
+            audio.autoplay = true;
+            audio.src = 'chat/speech?email=' + encodeURIComponent(box.dataset.email) +
+                '&at=' + encodeURIComponent(button.dataset.at);
+            audio.setAttribute('aria-label', 'Reply read aloud');
+            button.replaceWith(audio);
+            audio.focus();
+        });
+    })();
+
+    // Report that this user is here, and refresh presence on match cards
+    (function() {
+        var email = document.getElementById('messages').dataset.email;
+        function refresh() {
+            fetch('api/v1/presence', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/x-www-form-urlencoded'},
+                body: 'email=' + encodeURIComponent(email)
+            });
+            var badges = document.querySelectorAll('.presence[data-user]');
+            if (!badges.length) {
+                return;
+            }
+            var ids = Array.prototype.map.call(badges, function(b) {
+                return 'id=' + encodeURIComponent(b.dataset.user);
+            });
+            fetch('api/v1/presence?' + ids.join('&'))
+                .then(function(resp) { return resp.json(); })
+                .then(function(statuses) {
+                    badges.forEach(function(b) {
+                        var s = statuses[b.dataset.user];
+                        if (s) {
+                            b.textContent = s.label;
+                            b.classList.toggle('online', s.online);
+                        }
+                    });
+                });
+        }
+        refresh();
+        setInterval(refresh, 60000);
+    })();
+
+    // Live updates: new messages, typing indicators and delivery receipts
+    // arrive over a server-sent event stream, and sending doesn't reload
+    (function() {
+        if (!window.EventSource) {
+            return;
+        }
+        var box = document.getElementById('messages');
+        var email = box.dataset.email;
+        var typing = document.getElementById('typing');
+        var typingTimer = null;
+        var stream = new EventSource('api/v1/stream?email=' + encodeURIComponent(email));
+
+        function escapeHTML(s) {
+            var div = document.createElement('div');
+            div.textContent = s;
+            return div.innerHTML;
+        }
+
+        stream.addEventListener('message', function(e) {
+            var m = JSON.parse(e.data);
+            // Direct messages belong to their own thread page
+            var direct = m.recipient && m.recipient !== 'admin' && m.recipient !== 'system';
+            if (!direct) {
+                var role = m.role.replace(/[^a-z]/g, '');
+                var content = role === 'user' ? escapeHTML(m.content) : m.content;
+                box.insertAdjacentHTML('beforeend',
+                    '<div class="message ' + role + '"><strong>' + role + ':</strong> ' + content + '</div>');
+                box.scrollTop = box.scrollHeight;
+                typing.textContent = '';
+            } else if (m.email !== email) {
+                typing.textContent = 'New message from ' + m.email;
+            }
+            if (m.recipient === email && m.email !== email) {
+                fetch('api/v1/delivered', {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/x-www-form-urlencoded'},
+                    body: 'email=' + encodeURIComponent(email) + '&sender=' + encodeURIComponent(m.email) +
+                          '&created_at=' + encodeURIComponent(m.created_at)
+                });
+            }
+        });
+
+        stream.addEventListener('typing', function(e) {
+            var t = JSON.parse(e.data);
+            typing.textContent = (t.from === 'assistant' ? 'Assistant' : t.from) + ' is typing…';
+            clearTimeout(typingTimer);
+            typingTimer = setTimeout(function() { typing.textContent = ''; }, t.expires_in);
+        });
+
+        stream.addEventListener('delivered', function(e) {
+            var d = JSON.parse(e.data);
+            typing.textContent = 'Delivered to ' + d.recipient;
+        });
+
+        stream.addEventListener('notification', function(e) {
+            var n = JSON.parse(e.data);
+            if (window.Notification && Notification.permission === 'granted') {
+                new Notification(n.subject);
+            } else {
+                typing.textContent = n.subject;
+            }
+        });
+
+        var form = document.getElementById('message-form');
+        form.addEventListener('submit', function(e) {
+            if (stream.readyState !== EventSource.OPEN) {
+                return;
+            }
+            e.preventDefault();
+            var data = new URLSearchParams(new FormData(form));
+            form.reset();
+            fetch('chat', {method: 'POST', body: data}).then(function(resp) {
+                if (!resp.ok) {
+                    location.reload();
+                }
+            });
+        });
+    })();
+    </script>
 </body>
 </html>
 `
@@ -358,6 +984,11 @@ const (
 	dbFile = "chat.data"
 )
 
+// defaultChatModel serves chat turns unless the config routes them elsewhere
+const defaultChatModel = "gpt-3.5-turbo"
+
+// systemPrompt is the default for the "system" prompt template, used until an
+// admin saves a version of their own
 const systemPrompt = `You are a matchmaking assistant helping to connect caregivers with patients. 
 
 When a user connects, their email is already provided in the URL or form data. Use this email as their identifier 
@@ -387,23 +1018,130 @@ Once you have collected all required information:
 - For patients: Show them matching caregivers immediately
 
 Always maintain context from previous messages to avoid asking for information that was already provided.
+When a user mentions languages, gender preference, pets, smoking or driving, save it with set_preferences,
+noting which ones they say are must-haves.
+If a user's rate or budget seems far from what others nearby charge or pay, check get_rate_benchmarks and advise them.
+For a registered user, call get_profile_status to see exactly which details are still missing, and ask only for those.
+If the user asks to talk to a person rather than the assistant, call request_human.
+When matched users want to settle what care will cost, use negotiate_rate to make, counter or answer rate offers.
+Help patients write their care plan (tasks, medications, emergency contacts, physician) a section at a time,
+confirming each with them before saving it with update_care_plan; get_care_plan shows it.
 If a patient hasn't provided their phone number, ask for it before proceeding with registration.
 `
 
 // Add these new types and methods
 
+// QueryFilter is either a single comparison (Field, Operator, Value) or a
+// group: Any holds alternatives joined with OR, All holds conditions joined
+// with AND. Groups may nest up to maxFilterDepth levels.
 type QueryFilter struct {
-	Field    string
-	Operator string
-	Value    interface{}
+	Field    string        `json:"field,omitempty"`
+	Operator string        `json:"operator,omitempty"`
+	Value    interface{}   `json:"value,omitempty"`
+	Any      []QueryFilter `json:"any,omitempty"`
+	All      []QueryFilter `json:"all,omitempty"`
+}
+
+// QueryAggregate applies an aggregate function to a field, or to every row
+// when Field is empty (COUNT only). The result column is named by Alias.
+type QueryAggregate struct {
+	Function string `json:"function"`
+	Field    string `json:"field,omitempty"`
+}
+
+// Alias is the result column name, e.g. "avg_rate_expectations" or "count"
+func (a QueryAggregate) Alias() string {
+	if a.Field == "" {
+		return strings.ToLower(a.Function)
+	}
+	return strings.ToLower(a.Function) + "_" + a.Field
 }
 
+// DynamicQuery describes a query; its top-level Filters are ANDed together.
+// With Aggregates set, the result has one row per GroupBy combination.
 type DynamicQuery struct {
-	Table   string
-	Fields  []string
-	Filters []QueryFilter
-	OrderBy string
-	Limit   int
+	Table      string           `json:"table"`
+	Fields     []string         `json:"fields,omitempty"`
+	Filters    []QueryFilter    `json:"filters,omitempty"`
+	Aggregates []QueryAggregate `json:"aggregates,omitempty"`
+	GroupBy    []string         `json:"group_by,omitempty"`
+	OrderBy    string           `json:"order_by,omitempty"`
+	Limit      int              `json:"limit,omitempty"`
+}
+
+var allowedAggregates = map[string]bool{
+	"COUNT": true,
+	"AVG":   true,
+	"MIN":   true,
+	"MAX":   true,
+}
+
+const maxFilterDepth = 4
+
+var allowedQueryOperators = map[string]bool{
+	"=":           true,
+	">":           true,
+	"<":           true,
+	">=":          true,
+	"<=":          true,
+	"LIKE":        true,
+	"NOT LIKE":    true,
+	"IN":          true,
+	"NOT IN":      true,
+	"IS NULL":     true,
+	"IS NOT NULL": true,
+}
+
+// buildFilter renders one filter as a SQL condition. A comparison on a
+// field or with an operator outside the whitelists is an error, however
+// deeply it's nested.
+func buildFilter(f QueryFilter, allowedFields map[string]bool, depth int) (string, []interface{}, error) {
+	if depth > maxFilterDepth {
+		return "", nil, fmt.Errorf("filters nested deeper than %d levels", maxFilterDepth)
+	}
+
+	if len(f.Any) > 0 || len(f.All) > 0 {
+		var conditions []string
+		var params []interface{}
+		joinGroup := func(filters []QueryFilter, sep string) error {
+			var group []string
+			for _, child := range filters {
+				cond, p, err := buildFilter(child, allowedFields, depth+1)
+				if err != nil {
+					return err
+				}
+				if cond != "" {
+					group = append(group, cond)
+					params = append(params, p...)
+				}
+			}
+			if len(group) > 0 {
+				conditions = append(conditions, "("+strings.Join(group, sep)+")")
+			}
+			return nil
+		}
+		if err := joinGroup(f.Any, " OR "); err != nil {
+			return "", nil, err
+		}
+		if err := joinGroup(f.All, " AND "); err != nil {
+			return "", nil, err
+		}
+		return strings.Join(conditions, " AND "), params, nil
+	}
+
+	if !allowedFields[f.Field] {
+		return "", nil, fmt.Errorf("invalid filter field: %s", f.Field)
+	}
+	if !allowedQueryOperators[f.Operator] {
+		return "", nil, fmt.Errorf("invalid filter operator: %s", f.Operator)
+	}
+
+	switch f.Operator {
+	case "IS NULL", "IS NOT NULL":
+		return fmt.Sprintf("%s %s", f.Field, f.Operator), nil, nil
+	default:
+		return fmt.Sprintf("%s %s ?", f.Field, f.Operator), []interface{}{f.Value}, nil
+	}
 }
 
 // BuildDynamicQuery safely constructs a parameterized SQL query
@@ -439,7 +1177,39 @@ func (app *App) BuildDynamicQuery(q DynamicQuery) (string, []interface{}, error)
 
 	// Build SELECT clause
 	selectFields := "*"
-	if len(q.Fields) > 0 {
+	orderable := allowedFields
+	if len(q.Aggregates) > 0 {
+		var columns, groupBy []string
+		for _, f := range q.GroupBy {
+			if !allowedFields[f] {
+				return "", nil, fmt.Errorf("invalid group by field: %s", f)
+			}
+			groupBy = append(groupBy, f)
+		}
+		columns = append(columns, groupBy...)
+
+		orderable = make(map[string]bool)
+		for _, f := range groupBy {
+			orderable[f] = true
+		}
+		for _, a := range q.Aggregates {
+			a.Function = strings.ToUpper(a.Function)
+			if !allowedAggregates[a.Function] {
+				return "", nil, fmt.Errorf("invalid aggregate function: %s", a.Function)
+			}
+			arg := a.Field
+			switch {
+			case a.Field == "" && a.Function == "COUNT":
+				arg = "*"
+			case !allowedFields[a.Field]:
+				return "", nil, fmt.Errorf("invalid aggregate field: %s", a.Field)
+			}
+			columns = append(columns, fmt.Sprintf("%s(%s) AS %s", a.Function, arg, a.Alias()))
+			orderable[a.Alias()] = true
+		}
+		selectFields = strings.Join(columns, ", ")
+		q.GroupBy = groupBy
+	} else if len(q.Fields) > 0 {
 		validFields := make([]string, 0)
 		for _, f := range q.Fields {
 			if allowedFields[f] {
@@ -452,44 +1222,20 @@ func (app *App) BuildDynamicQuery(q DynamicQuery) (string, []interface{}, error)
 	}
 
 	// Build WHERE clause and params
-	var whereConditions []string
-	var params []interface{}
-	allowedOperators := map[string]bool{
-		"=":           true,
-		">":           true,
-		"<":           true,
-		">=":          true,
-		"<=":          true,
-		"LIKE":        true,
-		"NOT LIKE":    true,
-		"IN":          true,
-		"NOT IN":      true,
-		"IS NULL":     true,
-		"IS NOT NULL": true,
-	}
-
-	for _, filter := range q.Filters {
-		if !allowedFields[filter.Field] || !allowedOperators[filter.Operator] {
-			continue
-		}
-
-		switch filter.Operator {
-		case "IS NULL", "IS NOT NULL":
-			whereConditions = append(whereConditions,
-				fmt.Sprintf("%s %s", filter.Field, filter.Operator))
-		default:
-			whereConditions = append(whereConditions,
-				fmt.Sprintf("%s %s ?", filter.Field, filter.Operator))
-			params = append(params, filter.Value)
-		}
+	whereClause, params, err := buildFilter(QueryFilter{All: q.Filters}, allowedFields, 0)
+	if err != nil {
+		return "", nil, err
 	}
 
 	// Construct final query
 	query := fmt.Sprintf("SELECT %s FROM %s", selectFields, q.Table)
-	if len(whereConditions) > 0 {
-		query += " WHERE " + strings.Join(whereConditions, " AND ")
+	if whereClause != "" {
+		query += " WHERE " + whereClause
+	}
+	if len(q.Aggregates) > 0 && len(q.GroupBy) > 0 {
+		query += " GROUP BY " + strings.Join(q.GroupBy, ", ")
 	}
-	if q.OrderBy != "" && allowedFields[strings.TrimSuffix(q.OrderBy, " DESC")] {
+	if q.OrderBy != "" && orderable[strings.TrimSuffix(q.OrderBy, " DESC")] {
 		query += " ORDER BY " + q.OrderBy
 	}
 	if q.Limit > 0 {
@@ -501,18 +1247,62 @@ func (app *App) BuildDynamicQuery(q DynamicQuery) (string, []interface{}, error)
 
 // ExecuteDynamicQuery executes a dynamic query and returns results
 func (app *App) ExecuteDynamicQuery(q DynamicQuery) ([]map[string]interface{}, error) {
-	query, params, err := app.BuildDynamicQuery(q)
+	var results []map[string]interface{}
+	err := app.IterateDynamicQuery(q, func(row map[string]interface{}) error {
+		results = append(results, row)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return results, nil
+}
+
+// maxToolQueryRows caps the rows execute_dynamic_query hands to the model
+const maxToolQueryRows = 200
+
+// errStopIteration ends an iteration early without it counting as a failure
+var errStopIteration = errors.New("stop iteration")
+
+// IterateDynamicQuery executes a dynamic query and calls fn for each row as
+// it's read, so memory doesn't grow with the result. fn can return
+// errStopIteration to stop early.
+func (app *App) IterateDynamicQuery(q DynamicQuery, fn func(row map[string]interface{}) error) error {
+	var customFields map[string]CustomField
+	if role, ok := tableRoles[q.Table]; ok {
+		customFields = app.customFieldsByName(role)
+		filters, err := app.rewriteTagFilters(q.Filters)
+		if err != nil {
+			return err
+		}
+		q.Filters = filters
+	}
+	if len(customFields) > 0 {
+		filters, err := app.rewriteCustomFilters(q.Filters, customFields)
+		if err != nil {
+			return err
+		}
+		q.Filters = filters
+		for _, f := range q.Fields {
+			if _, ok := customFields[f]; ok {
+				// Custom values are looked up by email after the query
+				q.Fields = append(q.Fields, "email")
+				break
+			}
+		}
+	}
+
+	query, params, err := app.BuildDynamicQuery(q)
+	if err != nil {
+		return err
+	}
 
 	result, err := app.db.Query(query, params...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute query: %v", err)
+		return fmt.Errorf("failed to execute query: %v", err)
 	}
 	defer result.Close()
 
-	var results []map[string]interface{}
 	err = result.Iterate(func(r *chai.Row) error {
 		// Get column names
 		cols, err := r.Columns()
@@ -537,17 +1327,54 @@ func (app *App) ExecuteDynamicQuery(q DynamicQuery) ([]map[string]interface{}, e
 		for i, col := range cols {
 			row[col] = values[i]
 		}
-		results = append(results, row)
-		return nil
+		app.attachCustomFields(q, customFields, []map[string]interface{}{row})
+		return fn(row)
 	})
+	if errors.Is(err, errStopIteration) {
+		return nil
+	}
+	return err
+}
 
-	return results, err
+// filterSchema describes a QueryFilter to the model, allowing groups to
+// nest depth more levels. BuildDynamicQuery accepts deeper nesting, but a
+// couple of levels covers the questions users actually ask.
+func filterSchema(depth int) map[string]interface{} {
+	operators := make([]string, 0, len(allowedQueryOperators))
+	for op := range allowedQueryOperators {
+		operators = append(operators, op)
+	}
+	sort.Strings(operators)
+
+	properties := map[string]interface{}{
+		"field":    map[string]interface{}{"type": "string"},
+		"operator": map[string]interface{}{"type": "string", "enum": operators},
+		"value": map[string]interface{}{
+			"description": "Value to compare against; an array for IN and NOT IN",
+		},
+	}
+	if depth > 0 {
+		properties["any"] = map[string]interface{}{
+			"type":        "array",
+			"description": "Filters of which at least one must match (OR)",
+			"items":       filterSchema(depth - 1),
+		}
+		properties["all"] = map[string]interface{}{
+			"type":        "array",
+			"description": "Filters which must all match (AND)",
+			"items":       filterSchema(depth - 1),
+		}
+	}
+	return map[string]interface{}{
+		"type":        "object",
+		"description": "Either a comparison (field, operator, value) or a group using any/all",
+		"properties":  properties,
+	}
 }
 
-// Fix the dynamicQueryFunction definition
 var dynamicQueryFunction = map[string]interface{}{
 	"name":        "execute_dynamic_query",
-	"description": "Execute a dynamic database query with filters",
+	"description": "Execute a dynamic database query. Top-level filters are ANDed; use any/all groups for OR and nested conditions. Caregivers and patients can be filtered with field \"tag\" (= or IN), e.g. background-check-passed",
 	"parameters": map[string]interface{}{
 		"type": "object",
 		"properties": map[string]interface{}{
@@ -562,18 +1389,34 @@ var dynamicQueryFunction = map[string]interface{}{
 				},
 			},
 			"filters": map[string]interface{}{
-				"type": "array",
+				"type":  "array",
+				"items": filterSchema(2),
+			},
+			"aggregates": map[string]interface{}{
+				"type":        "array",
+				"description": "Aggregates to compute instead of returning rows, e.g. AVG of rate_expectations. Omit field to COUNT rows",
 				"items": map[string]interface{}{
 					"type": "object",
 					"properties": map[string]interface{}{
-						"field":    map[string]interface{}{"type": "string"},
-						"operator": map[string]interface{}{"type": "string"},
-						"value":    map[string]interface{}{"type": "string"},
+						"function": map[string]interface{}{
+							"type": "string",
+							"enum": []string{"COUNT", "AVG", "MIN", "MAX"},
+						},
+						"field": map[string]interface{}{"type": "string"},
 					},
+					"required": []string{"function"},
 				},
 			},
-			"order_by": map[string]interface{}{"type": "string"},
-			"limit":    map[string]interface{}{"type": "integer"},
+			"group_by": map[string]interface{}{
+				"type":        "array",
+				"description": "Fields to group aggregates by, e.g. location",
+				"items":       map[string]interface{}{"type": "string"},
+			},
+			"order_by": map[string]interface{}{
+				"type":        "string",
+				"description": "Field to sort by, optionally followed by DESC. With aggregates, a group_by field or an alias such as avg_rate_expectations",
+			},
+			"limit": map[string]interface{}{"type": "integer"},
 		},
 		"required": []string{"table"},
 	},
@@ -598,10 +1441,16 @@ type Assignment struct {
 }
 
 func NewApp(apiKey string) (*App, error) {
-	db, err := chai.Open(dbFile)
+	return openApp(databasePath(), apiKey)
+}
+
+// openApp opens the database at path, creating the schema if needed
+func openApp(path, apiKey string) (*App, error) {
+	raw, err := chai.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
+	db := &instrumentedDB{DB: raw}
 
 	// First create tables without foreign key constraints
 	err = db.Exec(`
@@ -636,6 +1485,7 @@ func NewApp(apiKey string) (*App, error) {
 			patient_email TEXT,
 			status TEXT,
 			created_at TIMESTAMP,
+			agreed_rate REAL DEFAULT 0,
 			PRIMARY KEY (caregiver_email, patient_email)
 		);
 		CREATE INDEX IF NOT EXISTS idx_matches_caregiver_email ON matches(caregiver_email);
@@ -678,6 +1528,10 @@ func NewApp(apiKey string) (*App, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create assignments table: %v", err)
 	}
+	// Bookings are numbered from a sequence; chai doesn't assign integer keys
+	if err := db.Exec("CREATE SEQUENCE IF NOT EXISTS assignments_seq"); err != nil {
+		return nil, fmt.Errorf("failed to create assignments sequence: %v", err)
+	}
 
 	// Create indexes for assignments table
 	err = db.Exec(`
@@ -688,124 +1542,330 @@ func NewApp(apiKey string) (*App, error) {
 		return nil, fmt.Errorf("failed to create assignments indexes: %v", err)
 	}
 
+	// Create tables for the subsystems that live outside this file
+	for _, schema := range []string{
+		matchEventsSchema,
+		readMarkersSchema,
+		profileEmbeddingsSchema,
+		messageEmbeddingsSchema,
+		promptsSchema,
+		experimentsSchema,
+		llmUsageSchema,
+		chatTurnsSchema,
+		contactRequestsSchema,
+		relaySchema,
+		legalHoldsSchema,
+		analyticsSchema,
+		schedulerSchema,
+		compactionSchema,
+		attachmentsSchema,
+		presenceSchema,
+		deliveriesSchema,
+		customFieldsSchema,
+		tagsSchema,
+		referralsSchema,
+		onboardingSchema,
+		careTypesSchema,
+		preferencesSchema,
+		digestSchema,
+		notificationPrefsSchema,
+		emailSendsSchema,
+		profileLocationsSchema,
+		phoneVerificationSchema,
+		signupFlagsSchema,
+		loginSchema,
+		auditLogSchema,
+		impersonationsSchema,
+		toolPolicySchema,
+		pendingRepliesSchema,
+		profileProposalsSchema,
+		profileChangesSchema,
+		chatThreadsSchema,
+		caregiverAvailabilitySchema,
+		patientUrgencySchema,
+		paymentTypesSchema,
+		consentSchema,
+		broadcastsSchema,
+		publicProfilesSchema,
+		sitemapSchema,
+		telegramSchema,
+		whatsAppSchema,
+		emailReplyThreadsSchema,
+		speechClipsSchema,
+		certificationsSchema,
+		backgroundChecksSchema,
+		safetyEscalationsSchema,
+		handoffsSchema,
+		moderationSchema,
+		reportsSchema,
+		accountsSchema,
+		shiftsSchema,
+		invoicesSchema,
+		rateOffersSchema,
+		carePlansSchema,
+		visitNotesSchema,
+		calendarFeedsSchema,
+		googleCalendarSchema,
+		remindersSchema,
+		waitlistSchema,
+		favoritesSchema,
+		duplicatesSchema,
+	} {
+		if err := db.Exec(schema); err != nil {
+			return nil, fmt.Errorf("failed to create schema: %v", err)
+		}
+	}
+	if err := migrateChatThreads(db); err != nil {
+		return nil, err
+	}
+	if err := migrateSuspensions(db); err != nil {
+		return nil, err
+	}
+	if err := migrateMatchRates(db); err != nil {
+		return nil, err
+	}
+	if err := migrateInvoicedShifts(db); err != nil {
+		return nil, err
+	}
+
+	if err := backfillProfileLocations(db); err != nil {
+		return nil, err
+	}
+	if err := normalizeStoredPhones(db); err != nil {
+		return nil, err
+	}
+
+	objects, err := newObjectStore(config.Storage)
+	if err != nil {
+		return nil, err
+	}
+
 	return &App{
-		db:           db,
-		userSessions: make(map[string][]Message),
-		apiKey:       apiKey,
-		maxHistory:   100,
+		db:          db,
+		objects:     objects,
+		events:      newEventBus(config.Events),
+		presence:    newPresenceTracker(db),
+		realtime:    newRealtimeHub(),
+		mailer:      newMailer(config.Email),
+		sms:         newSMSSender(),
+		telegram:    newTelegramBot(),
+		whatsapp:    newWhatsAppSender(),
+		checks:      newBackgroundChecker(),
+		gcal:        newGoogleCalendar(),
+		prompts:     newPromptStore(db),
+		tools:       newToolPolicy(db),
+		cache:       newTTLCache(),
+		relay:       newRelayProvider(),
+		scheduler:   newScheduler(db),
+		sessions:    make(map[string]*session),
+		apiKey:      apiKey,
+		maxHistory:  100,
+		maxSessions: 1000,
 	}, nil
 }
 
 func (app *App) Close() error {
+	app.profileWork.Wait()
 	return app.db.Close()
 }
 
 // Database operations
 func (app *App) StoreCaregiver(c *Caregiver) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
 	c.CreatedAt = time.Now()
 
-	// Check if caregiver exists
-	result, err := app.db.Query("SELECT email FROM caregivers WHERE email = ?", c.Email)
-	if err != nil {
-		return fmt.Errorf("failed to check caregiver existence: %v", err)
-	}
-	defer result.Close()
+	// Check and write in one transaction so concurrent registrations for the
+	// same email can't both insert
+	var exists bool
+	err := app.withTx(func(tx *chai.Tx) error {
+		old, err := getCaregiver(tx, c.Email)
+		if err != nil {
+			return err
+		}
+		exists = old != nil
+		if err := recordProfileChange(tx, c.Email, "caregiver", old, c); err != nil {
+			return err
+		}
 
-	exists := false
-	err = result.Iterate(func(r *chai.Row) error {
-		exists = true
-		return nil
+		if err := storeProfileLocation(tx, c.Email, "caregiver", c.Location, c.RateExpectations); err != nil {
+			return err
+		}
+
+		if exists {
+			// Update existing caregiver
+			return tx.Exec(`
+				UPDATE caregivers 
+				SET name = ?,
+					experience = ?,
+					location = ?,
+					availability = ?,
+					specializations = ?,
+					rate_expectations = ?,
+					certifications = ?
+				WHERE email = ?
+			`, c.Name, c.Experience, c.Location, c.Availability,
+				c.Specializations, c.RateExpectations, c.Certifications,
+				c.Email)
+		}
+		// Insert new caregiver
+		return tx.Exec(`
+			INSERT INTO caregivers (
+				email, name, experience, location, availability, 
+				specializations, rate_expectations, certifications, created_at
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, c.Email, c.Name, c.Experience, c.Location, c.Availability,
+			c.Specializations, c.RateExpectations, c.Certifications, c.CreatedAt)
 	})
 	if err != nil {
-		return fmt.Errorf("failed to iterate results: %v", err)
-	}
-
-	if exists {
-		// Update existing caregiver
-		return app.db.Exec(`
-			UPDATE caregivers 
-			SET name = ?,
-				experience = ?,
-				location = ?,
-				availability = ?,
-				specializations = ?,
-				rate_expectations = ?,
-				certifications = ?
-			WHERE email = ?
-		`, c.Name, c.Experience, c.Location, c.Availability,
-			c.Specializations, c.RateExpectations, c.Certifications,
-			c.Email)
-	}
-
-	// Insert new caregiver
-	return app.db.Exec(`
-		INSERT INTO caregivers (
-			email, name, experience, location, availability, 
-			specializations, rate_expectations, certifications, created_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, c.Email, c.Name, c.Experience, c.Location, c.Availability,
-		c.Specializations, c.RateExpectations, c.Certifications, c.CreatedAt)
+		return err
+	}
+
+	app.onProfileWrite(c.Email)
+	if !exists {
+		app.events.Publish(EventCaregiverRegistered, map[string]interface{}{
+			"email":    c.Email,
+			"location": c.Location,
+		})
+	}
+	return nil
 }
 
 func (app *App) StorePatient(p *Patient) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
 	p.CreatedAt = time.Now()
 
-	// Check if patient exists
-	result, err := app.db.Query("SELECT email FROM patients WHERE email = ?", p.Email)
-	if err != nil {
-		return fmt.Errorf("failed to check patient existence: %v", err)
-	}
-	defer result.Close()
+	var exists bool
+	err := app.withTx(func(tx *chai.Tx) error {
+		old, err := getPatient(tx, p.Email)
+		if err != nil {
+			return err
+		}
+		exists = old != nil
+		if err := recordProfileChange(tx, p.Email, "patient", old, p); err != nil {
+			return err
+		}
 
-	exists := false
-	err = result.Iterate(func(r *chai.Row) error {
-		exists = true
-		return nil
+		if err := storeProfileLocation(tx, p.Email, "patient", p.Location, p.Budget); err != nil {
+			return err
+		}
+
+		if exists {
+			// Update existing patient
+			return tx.Exec(`
+				UPDATE patients 
+				SET name = ?,
+					care_needs = ?,
+					location = ?,
+					schedule_requirements = ?,
+					budget = ?,
+					special_requirements = ?,
+					phone_number = ?
+				WHERE email = ?
+			`, p.Name, p.CareNeeds, p.Location, p.ScheduleRequirements,
+				p.Budget, p.SpecialRequirements, p.PhoneNumber,
+				p.Email)
+		}
+		// Insert new patient
+		return tx.Exec(`
+			INSERT INTO patients (
+				email, name, care_needs, location, schedule_requirements,
+				budget, special_requirements, phone_number, created_at
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, p.Email, p.Name, p.CareNeeds, p.Location, p.ScheduleRequirements,
+			p.Budget, p.SpecialRequirements, p.PhoneNumber, p.CreatedAt)
 	})
 	if err != nil {
-		return fmt.Errorf("failed to iterate results: %v", err)
-	}
-
-	if exists {
-		// Update existing patient
-		return app.db.Exec(`
-			UPDATE patients 
-			SET name = ?,
-				care_needs = ?,
-				location = ?,
-				schedule_requirements = ?,
-				budget = ?,
-				special_requirements = ?,
-				phone_number = ?
-			WHERE email = ?
-		`, p.Name, p.CareNeeds, p.Location, p.ScheduleRequirements,
-			p.Budget, p.SpecialRequirements, p.PhoneNumber,
-			p.Email)
-	}
-
-	// Insert new patient
-	return app.db.Exec(`
-		INSERT INTO patients (
-			email, name, care_needs, location, schedule_requirements,
-			budget, special_requirements, phone_number, created_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, p.Email, p.Name, p.CareNeeds, p.Location, p.ScheduleRequirements,
-		p.Budget, p.SpecialRequirements, p.PhoneNumber, p.CreatedAt)
-}
-
-func (app *App) CreateMatch(m *Match) error {
+		return err
+	}
+
+	app.onProfileWrite(p.Email)
+	if !exists {
+		app.events.Publish(EventPatientRegistered, map[string]interface{}{
+			"email":    p.Email,
+			"location": p.Location,
+		})
+	}
+	return nil
+}
+
+// onProfileWrite runs after a caregiver or patient record has been stored
+func (app *App) onProfileWrite(email string) {
+	app.invalidateToolCaches()
+
+	// Embedding calls OpenAI, so keep it off the request path
+	app.profileWork.Add(1)
+	go func() {
+		defer app.profileWork.Done()
+		if err := app.IndexProfileEmbedding(email); err != nil {
+			log.Printf("Error indexing profile embedding for %s: %v", email, err)
+		}
+		if err := app.ClassifyProfile(email); err != nil {
+			log.Printf("Error classifying care types for %s: %v", email, err)
+		}
+		if err := app.checkFavorites(email); err != nil {
+			log.Printf("Error checking shortlists for %s: %v", email, err)
+		}
+	}()
+}
+
+// CreateMatch inserts a new match and records its first status event
+func (app *App) CreateMatch(m *Match, actor string) error {
 	m.CreatedAt = time.Now()
-	return app.db.Exec(`
-		INSERT INTO matches (caregiver_email, patient_email, status, created_at)
-		VALUES (?, ?, ?, ?)
-	`, m.CaregiverEmail, m.PatientEmail, m.Status, m.CreatedAt)
+	if m.Status == "" {
+		m.Status = MatchProposed
+	}
+	err := app.withTx(func(tx *chai.Tx) error {
+		err := tx.Exec(`
+			INSERT INTO matches (caregiver_email, patient_email, status, created_at)
+			VALUES (?, ?, ?, ?)
+		`, m.CaregiverEmail, m.PatientEmail, m.Status, m.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to create match: %v", err)
+		}
+		return recordMatchEvent(tx, m.CaregiverEmail, m.PatientEmail, "", m.Status, actor)
+	})
+	if err != nil {
+		return err
+	}
+	app.invalidateToolCaches()
+	app.events.Publish(EventMatchCreated, map[string]interface{}{
+		"caregiver_email": m.CaregiverEmail,
+		"patient_email":   m.PatientEmail,
+		"status":          m.Status,
+		"actor":           actor,
+	})
+	return nil
 }
 
 func callOpenAI(req ChatRequest) (*ChatResponse, error) {
 	// Add logging before API call
 	log.Printf("Calling OpenAI API...")
 
-	functionDefs := []map[string]interface{}{
+	functionDefs := toolDefinitions()
+	if chatRoom != nil {
+		functionDefs = chatRoom.tools.filter(functionDefs)
+		chatRoom.addCustomFieldParameters(functionDefs)
+	}
+
+	requestBody := map[string]interface{}{
+		"model":    req.Model,
+		"messages": req.Messages,
+	}
+	// OpenAI rejects an empty function list
+	if len(functionDefs) > 0 {
+		requestBody["functions"] = functionDefs
+	}
+	return postChatCompletion(requestBody)
+}
+
+// toolDefinitions builds the definition of every tool the model can call,
+// whether or not it's currently enabled
+func toolDefinitions() []map[string]interface{} {
+	return []map[string]interface{}{
 		{
 			"name":        "store_caregiver",
 			"description": "Store a new caregiver's information in the system",
@@ -844,6 +1904,15 @@ func callOpenAI(req ChatRequest) (*ChatResponse, error) {
 						"type":        "string",
 						"description": "Professional certifications",
 					},
+					"payment_types": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string", "enum": paymentTypes},
+						"description": "Ways of paying the caregiver accepts: private pay, Medicaid, Medicare, long-term care insurance",
+					},
+					"phone_number": map[string]interface{}{
+						"type":        "string",
+						"description": "Phone number for masked calls and texts with matched patients",
+					},
 				},
 				"required": []string{"email", "name", "location", "rate_expectations"},
 			},
@@ -886,8 +1955,18 @@ func callOpenAI(req ChatRequest) (*ChatResponse, error) {
 						"type":        "string",
 						"description": "Patient's contact phone number (required)",
 					},
+					"urgency": map[string]interface{}{
+						"type":        "string",
+						"enum":        urgencyLevels,
+						"description": "How soon care is needed: routine, soon (within a week or two) or urgent (within days)",
+					},
+					"payment_type": map[string]interface{}{
+						"type":        "string",
+						"enum":        paymentTypes,
+						"description": "How the patient will pay for care: private pay, Medicaid, Medicare or long-term care insurance",
+					},
 				},
-				"required": []string{"email", "name", "care_needs", "location", "phone_number"},
+				"required": []string{"email", "name", "care_needs", "location", "budget", "phone_number"},
 			},
 		},
 		{
@@ -921,14 +2000,21 @@ func callOpenAI(req ChatRequest) (*ChatResponse, error) {
 			},
 		},
 		dynamicQueryFunction,
+		profileStatusFunction,
+		setPreferencesFunction,
+		rateBenchmarksFunction,
+		undoLastChangeFunction,
+		myProfileFunction,
+		setAvailabilityFunction,
+		requestHumanFunction,
+		negotiateRateFunction,
+		getCarePlanFunction,
+		updateCarePlanFunction,
 	}
+}
 
-	requestBody := map[string]interface{}{
-		"model":     req.Model,
-		"messages":  req.Messages,
-		"functions": functionDefs,
-	}
-
+// postChatCompletion sends a chat completions request body to OpenAI
+func postChatCompletion(requestBody map[string]interface{}) (*ChatResponse, error) {
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %v", err)
@@ -946,13 +2032,8 @@ func callOpenAI(req ChatRequest) (*ChatResponse, error) {
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("OPENAI_API_KEY")))
 
-	// Add timeout to the client
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
 	log.Printf("Waiting for OpenAI response...")
-	resp, err := client.Do(request)
+	resp, err := openAIClient.Do(request)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make API request: %v", err)
 	}
@@ -965,6 +2046,9 @@ func callOpenAI(req ChatRequest) (*ChatResponse, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %v", err)
 	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("OpenAI returned %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
 
 	var chatResp ChatResponse
 	if err := json.NewDecoder(bytes.NewBuffer(respBody)).Decode(&chatResp); err != nil {
@@ -991,6 +2075,15 @@ func (fc *FunctionCall) GetArguments() (map[string]interface{}, error) {
 	return args, nil
 }
 
+// mustMarshal re-encodes already-decoded JSON, which cannot fail
+func mustMarshal(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
 // Update the data structure passed to the template
 type TemplateData struct {
 	Messages  []Message
@@ -998,6 +2091,166 @@ type TemplateData struct {
 	Calendar  string
 }
 
+// RunChatTurn stores a user's message, sends their recent conversation to
+// OpenAI, and stores whatever the assistant says or does in reply.
+func (app *App) RunChatTurn(email, message string) error {
+	maintenance.begin()
+	defer maintenance.end()
+
+	if err := app.AddMessageWithRecipient(email, "user", message, "admin"); err != nil {
+		return fmt.Errorf("failed to add message: %v", err)
+	}
+	app.ScreenMessage(email, adminThread, message)
+	if handled, err := app.RunChatCommand(email, message); handled {
+		return err
+	}
+	if handled, err := app.answerProposalReply(email, message); handled {
+		return err
+	}
+	// Someone from the team is answering instead
+	if app.StaffHandling(email) {
+		return nil
+	}
+
+	if app.OverMonthlyCap(email) {
+		return app.AddMessageWithRecipient(email, "assistant", usageCapMessage, "admin")
+	}
+	if app.HeldForReview(email) {
+		return app.AddMessageWithRecipient(email, "assistant", signupReviewMessage, "admin")
+	}
+	if app.Banned(email) {
+		return app.AddMessageWithRecipient(email, "assistant", accountBannedMessage, "admin")
+	}
+
+	err := app.replyTo(email, message)
+	if _, ok := err.(*errAssistantUnavailable); ok {
+		return app.replyWhileDown(email, message, err)
+	}
+	if err != nil {
+		return err
+	}
+	// Answered now, so an earlier message queued while OpenAI was down
+	// needn't be
+	if err := app.db.Exec("DELETE FROM pending_replies WHERE email = ?", email); err != nil {
+		log.Printf("Error clearing pending reply for %s: %v", email, err)
+	}
+	return nil
+}
+
+// ChatTurnReplies runs a chat turn for a message from outside the chat
+// page and returns what the assistant said in reply, oldest first, for the
+// channel to send back
+func (app *App) ChatTurnReplies(email, message string) ([]string, error) {
+	started := time.Now()
+	if err := app.RunChatTurn(email, message); err != nil {
+		return nil, err
+	}
+	page, err := app.MessagePage(email, adminThread, time.Time{}, messagePageSize)
+	if err != nil {
+		return nil, err
+	}
+	var replies []string
+	for _, m := range page.Messages {
+		if m.Role == "assistant" && !m.CreatedAt.Before(started) {
+			replies = append(replies, m.Content)
+		}
+	}
+	return replies, nil
+}
+
+// replyTo sends a user's recent conversation, ending in message, to OpenAI
+// and stores whatever the assistant says or does in reply
+func (app *App) replyTo(email, message string) error {
+	// Send only the recent part of the conversation, plus whatever older
+	// messages are relevant to what the user just said
+	history := app.GetUserMessages(email, adminThread)
+	if len(history) > promptWindow {
+		history = history[len(history)-promptWindow:]
+	}
+	requestType := classifyRequest(message, app.userRole(email))
+	promptName, model := systemPromptName, routeModel(requestType)
+	experiment, variant := app.ExperimentVariantFor(email)
+	if variant != nil {
+		if variant.Prompt != "" {
+			promptName = variant.Prompt
+		}
+		if variant.Model != "" {
+			model = variant.Model
+		}
+	}
+
+	messages := []Message{
+		{Role: "system", Content: app.RenderPrompt(promptName, email)},
+	}
+	// A fresh conversation starts with only the profile as context
+	thread, err := app.ActiveThread(email)
+	if err != nil {
+		return err
+	}
+	if thread == mainThread {
+		if summary := app.ConversationSummary(email); summary != "" {
+			messages = append(messages, Message{Role: "system", Content: summary})
+		}
+		if recalled := app.RecallRelevantMessages(email, message, history); recalled != "" {
+			messages = append(messages, Message{Role: "system", Content: recalled})
+		}
+	}
+	for _, m := range history {
+		// The model only knows its own replies; the team's are shown as
+		// replies, marked as not its own
+		if m.Role == staffRole {
+			m = Message{Role: "assistant", Content: "[A person from the team wrote:] " + m.Content}
+		}
+		messages = append(messages, m)
+	}
+	if n := len(history); n == 0 || history[n-1].Role != "user" {
+		// Retrying a message queued while OpenAI was down, which has been
+		// answered without the model since
+		messages = append(messages, Message{Role: "user", Content: message})
+	}
+
+	chatReq := ChatRequest{
+		Model:    model,
+		Messages: messages,
+	}
+
+	chatResp, cached, err := app.completeChat(chatReq)
+	if err != nil {
+		return &errAssistantUnavailable{err}
+	}
+	if variant != nil {
+		app.RecordExperimentTurn(email, experiment.Name, variant.Name, promptName, model)
+	}
+	if !cached {
+		app.RecordUsage(email, model, chatResp)
+	}
+	app.RecordChatTurn(email, requestType, model)
+
+	if err := handleOpenAIResponse(chatResp, email, app); err != nil {
+		return fmt.Errorf("failed to handle OpenAI response: %v", err)
+	}
+	return nil
+}
+
+// takeChatMessage answers a message the user sent from the chat page
+func (app *App) takeChatMessage(r *http.Request, userEmail, message string) error {
+	log.Printf("Processing message from %s: %s", userEmail, message)
+	app.realtime.Send(userEmail, "typing", map[string]interface{}{
+		"from":       "assistant",
+		"thread":     adminThread,
+		"expires_in": (30 * time.Second).Milliseconds(),
+	})
+
+	// Only the user can accept the terms, so an admin's "I agree" goes
+	// to the assistant like any other message
+	if impersonationFrom(r) == nil {
+		if handled, err := app.answerConsentReply(userEmail, message, server.ClientAddr(r)); handled {
+			return err
+		}
+	}
+	return app.RunChatTurn(userEmail, message)
+}
+
 // Update handleChat function to include user email
 func handleChat(w http.ResponseWriter, r *http.Request) {
 	userEmail := r.URL.Query().Get("email")
@@ -1005,10 +2258,9 @@ func handleChat(w http.ResponseWriter, r *http.Request) {
 		userEmail = r.FormValue("email")
 	}
 
-	// Create a PageData instance to store all template data
-	data := PageData{
-		Messages:  chatRoom.GetUserMessages(userEmail),
-		UserEmail: userEmail,
+	impersonation := impersonationFrom(r)
+	if impersonation == nil {
+		chatRoom.presence.Seen(userEmail)
 	}
 
 	if r.Method == "POST" {
@@ -1018,72 +2270,32 @@ func handleChat(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		log.Printf("Processing message from %s: %s", userEmail, message)
-
-		// Add user's message to chat history
-		if err := chatRoom.AddMessageWithRecipient(userEmail, "user", message, "admin"); err != nil {
-			log.Printf("Error adding message: %v", err)
-			http.Error(w, "Failed to add message", http.StatusInternalServerError)
-			return
-		}
-
-		// Get chat history for OpenAI
-		messages := []Message{
-			{Role: "system", Content: systemPrompt},
-		}
-		messages = append(messages, chatRoom.GetUserMessages(userEmail)...)
-
-		// Call OpenAI
-		chatReq := ChatRequest{
-			Model:    "gpt-3.5-turbo",
-			Messages: messages,
+		if chatRoom.isFirstContact(userEmail) {
+			if err := chatRoom.screenFirstContact(r, userEmail); err != nil {
+				var rejected *errRejected
+				if !errors.As(err, &rejected) {
+					log.Printf("Error screening first message from %s: %v", userEmail, err)
+				} else {
+					log.Printf("Turned away first message from %s: %v", userEmail, err)
+					http.Error(w, "Your message could not be sent", rejected.status)
+					return
+				}
+			}
 		}
 
-		chatResp, err := callOpenAI(chatReq)
-		if err != nil {
-			log.Printf("Error calling OpenAI: %v", err)
+		if err := chatRoom.takeChatMessage(r, userEmail, message); err != nil {
+			log.Printf("Error processing message: %v", err)
 			http.Error(w, "Failed to process message", http.StatusInternalServerError)
 			return
 		}
 
-		// Process OpenAI response
-		if err := handleOpenAIResponse(chatResp, userEmail, chatRoom); err != nil {
-			log.Printf("Error handling OpenAI response: %v", err)
-			http.Error(w, "Failed to process OpenAI response", http.StatusInternalServerError)
-			return
-		}
-
 		http.Redirect(w, r, fmt.Sprintf("./?email=%s", url.QueryEscape(userEmail)), http.StatusSeeOther)
 		return
 	}
 
-	// If user is a caregiver, get and display their schedule
-	if chatRoom.IsCaregiver(userEmail) {
-		now := time.Now()
-		weekFromNow := now.AddDate(0, 0, 7)
-		assignments, err := chatRoom.GetCaregiverSchedule(userEmail, now, weekFromNow)
-		if err != nil {
-			log.Printf("Error getting schedule: %v", err)
-		} else {
-			data.Calendar = formatCalendar(assignments)
-		}
-	}
-
-	// Create template with the safeHTML function
-	tmpl, err := template.New("chat").Funcs(template.FuncMap{
-		"safeHTML": func(s string) template.HTML {
-			return template.HTML(s)
-		},
-	}).Parse(htmlTemplate)
-	if err != nil {
-		http.Error(w, "Failed to parse template", http.StatusInternalServerError)
-		return
-	}
-
-	if err := tmpl.Execute(w, data); err != nil {
-		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
-		return
-	}
+	data := newPageData(userEmail)
+	data.Impersonation = impersonation
+	renderTemplate(w, "chat", htmlTemplate, data)
 }
 
 // Helper functions to safely get values from the arguments map
@@ -1119,17 +2331,12 @@ func (app *App) AddMessage(email, role, content string) error {
 	return app.AddMessageWithRecipient(email, role, content, "admin")
 }
 
-// GetMessagesByRole returns messages filtered by role for a specific user
+// GetMessagesByRole returns a user's recent messages filtered by role
 func (app *App) GetMessagesByRole(email, role string) ([]Message, error) {
-	app.mu.RLock()
-	defer app.mu.RUnlock()
-
 	var filtered []Message
-	if messages, exists := app.userSessions[email]; exists {
-		for _, msg := range messages {
-			if msg.Role == role {
-				filtered = append(filtered, msg)
-			}
+	for _, msg := range app.GetUserMessages(email, adminThread) {
+		if msg.Role == role {
+			filtered = append(filtered, msg)
 		}
 	}
 	return filtered, nil
@@ -1138,9 +2345,22 @@ func (app *App) GetMessagesByRole(email, role string) ([]Message, error) {
 // ListPatients returns all patients from the database
 func (app *App) ListPatients() ([]Patient, error) {
 	var patients []Patient
+	err := app.IteratePatients(func(p Patient) error {
+		patients = append(patients, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return patients, nil
+}
+
+// IteratePatients calls fn for each patient as it's read from the database.
+// fn can return errStopIteration to stop early.
+func (app *App) IteratePatients(fn func(Patient) error) error {
 	result, err := app.db.Query("SELECT * FROM patients")
 	if err != nil {
-		return nil, fmt.Errorf("failed to query patients: %v", err)
+		return fmt.Errorf("failed to query patients: %v", err)
 	}
 	defer result.Close()
 
@@ -1150,22 +2370,33 @@ func (app *App) ListPatients() ([]Patient, error) {
 			&p.ScheduleRequirements, &p.Budget, &p.SpecialRequirements, &p.PhoneNumber, &p.CreatedAt); err != nil {
 			return fmt.Errorf("failed to scan patient: %v", err)
 		}
-		patients = append(patients, p)
-		return nil
+		return fn(p)
 	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to iterate patients: %v", err)
+	if err != nil && !errors.Is(err, errStopIteration) {
+		return fmt.Errorf("failed to iterate patients: %v", err)
 	}
-
-	return patients, nil
+	return nil
 }
 
 // ListCaregivers returns all caregivers from the database
 func (app *App) ListCaregivers() ([]Caregiver, error) {
 	var caregivers []Caregiver
+	err := app.IterateCaregivers(func(c Caregiver) error {
+		caregivers = append(caregivers, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return caregivers, nil
+}
+
+// IterateCaregivers calls fn for each caregiver as it's read from the
+// database. fn can return errStopIteration to stop early.
+func (app *App) IterateCaregivers(fn func(Caregiver) error) error {
 	result, err := app.db.Query("SELECT * FROM caregivers")
 	if err != nil {
-		return nil, fmt.Errorf("failed to query caregivers: %v", err)
+		return fmt.Errorf("failed to query caregivers: %v", err)
 	}
 	defer result.Close()
 
@@ -1175,18 +2406,80 @@ func (app *App) ListCaregivers() ([]Caregiver, error) {
 			&c.Availability, &c.Specializations, &c.RateExpectations, &c.Certifications, &c.CreatedAt); err != nil {
 			return fmt.Errorf("failed to scan caregiver: %v", err)
 		}
-		caregivers = append(caregivers, c)
+		return fn(c)
+	})
+	if err != nil && !errors.Is(err, errStopIteration) {
+		return fmt.Errorf("failed to iterate caregivers: %v", err)
+	}
+	return nil
+}
+
+// GetCaregiver returns the caregiver with the given email, or nil if none exists
+func (app *App) GetCaregiver(email string) (*Caregiver, error) {
+	return getCaregiver(app.db, email)
+}
+
+func getCaregiver(q execer, email string) (*Caregiver, error) {
+	result, err := q.Query("SELECT * FROM caregivers WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query caregiver: %v", err)
+	}
+	defer result.Close()
+
+	var caregiver *Caregiver
+	err = result.Iterate(func(r *chai.Row) error {
+		var c Caregiver
+		if err := r.Scan(&c.Email, &c.Name, &c.Experience, &c.Location,
+			&c.Availability, &c.Specializations, &c.RateExpectations, &c.Certifications, &c.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan caregiver: %v", err)
+		}
+		caregiver = &c
 		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to iterate caregivers: %v", err)
+		return nil, err
 	}
+	return caregiver, nil
+}
 
-	return caregivers, nil
+// GetPatient returns the patient with the given email, or nil if none exists
+func (app *App) GetPatient(email string) (*Patient, error) {
+	return getPatient(app.db, email)
+}
+
+func getPatient(q execer, email string) (*Patient, error) {
+	result, err := q.Query("SELECT * FROM patients WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query patient: %v", err)
+	}
+	defer result.Close()
+
+	var patient *Patient
+	err = result.Iterate(func(r *chai.Row) error {
+		var p Patient
+		if err := r.Scan(&p.Email, &p.Name, &p.CareNeeds, &p.Location,
+			&p.ScheduleRequirements, &p.Budget, &p.SpecialRequirements, &p.PhoneNumber, &p.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan patient: %v", err)
+		}
+		patient = &p
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return patient, nil
 }
 
 // Update FindMatchingCaregivers to remove location filter
 func (app *App) FindMatchingCaregivers(patientEmail string) ([]Caregiver, error) {
+	if err := app.requireConsent(patientEmail); err != nil {
+		return nil, err
+	}
+	// Suspended users aren't matched either way
+	if app.Suspended(patientEmail) {
+		return nil, nil
+	}
+
 	// First get the patient's requirements
 	var patient Patient
 	result, err := app.db.Query("SELECT * FROM patients WHERE email = ?", patientEmail)
@@ -1233,12 +2526,58 @@ func (app *App) FindMatchingCaregivers(patientEmail string) ([]Caregiver, error)
 		caregivers = append(caregivers, c)
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Paused and away caregivers aren't taking new families
+	if caregivers, err = app.withoutPausedCaregivers(caregivers); err != nil {
+		return nil, err
+	}
+	if caregivers, err = app.withoutUnconsentedCaregivers(caregivers); err != nil {
+		return nil, err
+	}
+	if caregivers, err = app.withoutBlockedCaregivers(patientEmail, caregivers); err != nil {
+		return nil, err
+	}
 
+	// Caregivers in the patient's location come from the location index
+	// rather than comparing each one's free-text location
+	nearby, err := app.profilesIn("caregiver", patient.Location)
+	if err != nil {
+		return nil, err
+	}
+	for i := range caregivers {
+		skills, err := app.GetSkills(caregivers[i].Email)
+		if err != nil {
+			return nil, err
+		}
+		caregivers[i].MatchReasons = explainMatch(&patient, &caregivers[i], skills, nearby[caregivers[i].Email])
+	}
+	if caregivers, err = app.filterCaregiversByPayment(patientEmail, caregivers); err != nil {
+		return nil, err
+	}
+
+	app.rankCaregiversBySimilarity(patientEmail, caregivers)
+	caregivers = app.rankCaregiversByPreferences(patientEmail, caregivers)
+	caregivers = app.rankCaregiversByCareType(patientEmail, caregivers)
+
+	// A search that finds no one puts the patient on the waitlist
+	if err := app.updateWaitlist(&patient, caregivers); err != nil {
+		log.Printf("Error updating the waitlist for %s: %v", patientEmail, err)
+	}
 	return caregivers, nil
 }
 
 // Update FindMatchingPatients to remove location filter
 func (app *App) FindMatchingPatients(caregiverEmail string) ([]Patient, error) {
+	if err := app.requireConsent(caregiverEmail); err != nil {
+		return nil, err
+	}
+	if app.Suspended(caregiverEmail) {
+		return nil, nil
+	}
+
 	// First get the caregiver's details
 	var caregiver Caregiver
 	result, err := app.db.Query("SELECT * FROM caregivers WHERE email = ?", caregiverEmail)
@@ -1264,6 +2603,15 @@ func (app *App) FindMatchingPatients(caregiverEmail string) ([]Patient, error) {
 		return nil, fmt.Errorf("caregiver not found")
 	}
 
+	skills, err := app.GetSkills(caregiverEmail)
+	if err != nil {
+		return nil, err
+	}
+	nearby, err := app.profilesIn("patient", caregiver.Location)
+	if err != nil {
+		return nil, err
+	}
+
 	// Only filter by budget, not location
 	result, err = app.db.Query(`
 		SELECT * FROM patients 
@@ -1282,24 +2630,42 @@ func (app *App) FindMatchingPatients(caregiverEmail string) ([]Patient, error) {
 			&p.ScheduleRequirements, &p.Budget, &p.SpecialRequirements, &p.PhoneNumber, &p.CreatedAt); err != nil {
 			return fmt.Errorf("failed to scan patient: %v", err)
 		}
+		p.MatchReasons = explainMatch(&p, &caregiver, skills, nearby[p.Email])
 		patients = append(patients, p)
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return patients, nil
+	if patients, err = app.withoutUnconsentedPatients(patients); err != nil {
+		return nil, err
+	}
+	if patients, err = app.withoutBlockedPatients(caregiverEmail, patients); err != nil {
+		return nil, err
+	}
+	if patients, err = app.filterPatientsByPayment(caregiverEmail, patients); err != nil {
+		return nil, err
+	}
+
+	app.rankPatientsBySimilarity(caregiverEmail, patients)
+	patients = app.rankPatientsByPreferences(caregiverEmail, patients)
+	patients = app.rankPatientsByCareType(caregiverEmail, patients)
+	return app.rankPatientsByUrgency(patients), nil
 }
 
-// Add new method to load chat history
-func (app *App) LoadChatHistory(email string) ([]Message, error) {
+// LoadChatHistory returns the latest messages of one of a user's
+// conversations
+func (app *App) LoadChatHistory(email, thread string) ([]Message, error) {
 	var messages []Message
 
 	result, err := app.db.Query(`
 		SELECT role, content 
 		FROM chat_history 
-		WHERE email = ? 
+		WHERE email = ? AND thread_id = ? AND `+assistantMessages+`
 		ORDER BY created_at DESC 
 		LIMIT ?
-	`, email, app.maxHistory)
+	`, email, thread, app.maxHistory)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query chat history: %v", err)
 	}
@@ -1328,86 +2694,47 @@ func (app *App) LoadChatHistory(email string) ([]Message, error) {
 
 // Add methods to manage skills
 func (app *App) AddSkill(email, skill string) error {
-	return app.db.Exec(`
+	err := app.db.Exec(`
 		INSERT INTO skills (email, skill, created_at)
 		VALUES (?, ?, ?)
 		ON CONFLICT (email, skill) DO NOTHING
 	`, email, skill, time.Now())
-}
-
-func (app *App) GetSkills(email string) ([]string, error) {
-	var skills []string
-	result, err := app.db.Query("SELECT skill FROM skills WHERE email = ?", email)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query skills: %v", err)
+		return err
 	}
-	defer result.Close()
-
-	err = result.Iterate(func(r *chai.Row) error {
-		var skill string
-		if err := r.Scan(&skill); err != nil {
-			return fmt.Errorf("failed to scan skill: %v", err)
-		}
-		skills = append(skills, skill)
-		return nil
-	})
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to iterate skills: %v", err)
-	}
-
-	return skills, nil
-}
-
-func (app *App) RemoveSkill(email, skill string) error {
-	return app.db.Exec("DELETE FROM skills WHERE email = ? AND skill = ?", email, skill)
+	app.onProfileWrite(email)
+	return nil
 }
 
-// GetUserMessages gets all messages for a specific email from the database
-func (app *App) GetUserMessages(email string) []Message {
-	var messages []Message
-	result, err := app.db.Query(`
-		SELECT role, content 
-		FROM chat_history 
-		WHERE email = ? 
-		ORDER BY created_at ASC
-	`, email)
+func (app *App) GetSkills(email string) ([]string, error) {
+	var skills []string
+	result, err := app.db.Query("SELECT skill FROM skills WHERE email = ?", email)
 	if err != nil {
-		log.Printf("Error querying chat history for %s: %v", email, err)
-		return messages
+		return nil, fmt.Errorf("failed to query skills: %v", err)
 	}
 	defer result.Close()
 
 	err = result.Iterate(func(r *chai.Row) error {
-		var msg Message
-		if err := r.Scan(&msg.Role, &msg.Content); err != nil {
-			log.Printf("Error scanning message: %v", err)
-			return err
+		var skill string
+		if err := r.Scan(&skill); err != nil {
+			return fmt.Errorf("failed to scan skill: %v", err)
 		}
-		messages = append(messages, msg)
+		skills = append(skills, skill)
 		return nil
 	})
+
 	if err != nil {
-		log.Printf("Error iterating chat history: %v", err)
-		return messages
+		return nil, fmt.Errorf("failed to iterate skills: %v", err)
 	}
 
-	return messages
+	return skills, nil
 }
 
-// AddMessageWithRecipient adds a message to the chat history
-func (app *App) AddMessageWithRecipient(email, role, content, recipient string) error {
-	// Store in database
-	err := app.db.Exec(`
-		INSERT INTO chat_history (
-			email, role, content, recipient, created_at
-		) VALUES (?, ?, ?, ?, ?)
-	`, email, role, content, recipient, time.Now())
-
-	if err != nil {
-		return fmt.Errorf("failed to store message: %v", err)
+func (app *App) RemoveSkill(email, skill string) error {
+	if err := app.db.Exec("DELETE FROM skills WHERE email = ? AND skill = ?", email, skill); err != nil {
+		return err
 	}
-
+	app.onProfileWrite(email)
 	return nil
 }
 
@@ -1442,73 +2769,9 @@ type ChatMessage struct {
 	Message string
 }
 
-// Simplified processTestData that processes messages sequentially
-func processTestData(filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("failed to open test data file: %v", err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
-
-		parts := strings.SplitN(line, ": ", 2)
-		if len(parts) != 2 {
-			log.Printf("Skipping invalid line format: %s", line)
-			continue
-		}
-
-		email, message := parts[0], parts[1]
-		log.Printf("Processing message from %s: %s", email, message)
-
-		// Add user message
-		if err := chatRoom.AddMessageWithRecipient(email, "user", message, "admin"); err != nil {
-			log.Printf("Error adding message for %s: %v", email, err)
-			continue
-		}
-
-		// Get chat history and process with OpenAI
-		messages := []Message{
-			{Role: "system", Content: systemPrompt},
-		}
-		messages = append(messages, chatRoom.GetUserMessages(email)...)
-
-		// Process with OpenAI
-		chatReq := ChatRequest{
-			Model:    "gpt-3.5-turbo",
-			Messages: messages,
-		}
-
-		resp, err := callOpenAI(chatReq)
-		if err != nil {
-			log.Printf("Error calling OpenAI for %s: %v", email, err)
-			continue
-		}
-
-		// Handle OpenAI response
-		if err := handleOpenAIResponse(resp, email, chatRoom); err != nil {
-			log.Printf("Error handling OpenAI response for %s: %v", email, err)
-			continue
-		}
-
-		log.Printf("Completed processing message for %s", email)
-	}
-
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading test data: %v", err)
-	}
-
-	return nil
-}
-
-// Update formatPatientList to include accept buttons for caregivers
-func formatPatientList(patients []Patient, isCaregiver bool) string {
+// formatPatientList renders patient cards as seen by viewer; contact details
+// stay masked until viewer and the patient have agreed to share them
+func formatPatientList(patients []Patient, isCaregiver bool, viewer string) string {
 	var sb strings.Builder
 	if len(patients) == 0 {
 		return "<p>No matching patients found.</p>"
@@ -1519,17 +2782,24 @@ func formatPatientList(patients []Patient, isCaregiver bool) string {
 
 	for _, p := range patients {
 		sb.WriteString("<li class='match-item'>")
-		sb.WriteString("<img src='static/images/default-avatar.png' alt='Patient Avatar' class='match-avatar'>")
+		sb.WriteString(avatarImg(p.Email, p.Name))
 		sb.WriteString("<div class='match-details'>")
 		sb.WriteString(fmt.Sprintf("<strong>%s</strong><br>", p.Name))
+		sb.WriteString(presenceBadge(p.Email))
+		sb.WriteString(phoneVerifiedBadge(p.Email))
 		sb.WriteString(fmt.Sprintf("<span>📍 %s</span><br>", p.Location))
 		sb.WriteString(fmt.Sprintf("<span>💰 Budget: $%.2f/hour</span><br>", p.Budget))
 		sb.WriteString(fmt.Sprintf("<span>🕒 Schedule: %s</span><br>", p.ScheduleRequirements))
 		sb.WriteString(fmt.Sprintf("<span>ℹ️ Care Needs: %s</span><br>", p.CareNeeds))
+		sb.WriteString(formatCustomFields(p.Email, "patient"))
+		sb.WriteString(formatMatchReasons(p.MatchReasons))
 
 		if isCaregiver {
 			// Add schedule selection form
 			sb.WriteString(`<form class="schedule-form" action="schedule" method="POST">
+				<input type="hidden" name="email" value="`)
+			sb.WriteString(viewer)
+			sb.WriteString(`">
 				<input type="hidden" name="patient_email" value="`)
 			sb.WriteString(p.Email)
 			sb.WriteString(`">
@@ -1541,10 +2811,13 @@ func formatPatientList(patients []Patient, isCaregiver bool) string {
 				</select>
 				<button type="submit">Schedule Care</button>
 			</form>`)
-		} else {
-			// Show contact info for patients
+		}
+		if chatRoom.ContactShared(viewer, p.Email) {
 			sb.WriteString(fmt.Sprintf("<span>📱 Contact: %s</span><br>", p.PhoneNumber))
+		} else {
+			sb.WriteString(formatContactRequest(viewer, p.Email))
 		}
+		sb.WriteString(formatReportBlock(viewer, p.Email, ""))
 
 		sb.WriteString("</div></li>")
 	}
@@ -1552,16 +2825,27 @@ func formatPatientList(patients []Patient, isCaregiver bool) string {
 	return sb.String()
 }
 
-func formatCaregiverList(caregivers []Caregiver) string {
+// formatCaregiverList renders caregiver cards as seen by viewer; contact
+// details stay masked until viewer and the caregiver have agreed to share them
+func formatCaregiverList(caregivers []Caregiver, viewer string) string {
 	var sb strings.Builder
 
 	if len(caregivers) == 0 {
+		if entry, err := chatRoom.WaitlistEntry(viewer); err == nil && entry != nil && entry.Status == WaitlistWaiting {
+			return "<p>No matching caregivers found yet. You're on our waitlist, and we'll let you know as soon as a caregiver who fits joins.</p>"
+		}
 		return "<p>No matching caregivers found.</p>"
 	}
 
 	sb.WriteString("<h3>Matching Caregivers</h3>")
 	sb.WriteString("<ul class='matches-list'>")
 
+	// Patients can star caregivers to shortlist them
+	var starred map[string]bool
+	if chatRoom.userRole(viewer) == "patient" {
+		starred = chatRoom.shortlisted(viewer)
+	}
+
 	for _, c := range caregivers {
 		// Get skills for this caregiver
 		skills, err := chatRoom.GetSkills(c.Email)
@@ -1571,10 +2855,15 @@ func formatCaregiverList(caregivers []Caregiver) string {
 		}
 
 		sb.WriteString("<li class='match-item'>")
-		sb.WriteString("<img src='static/images/default-avatar.png' class='match-avatar'>")
+		sb.WriteString(avatarImg(c.Email, c.Name))
 		sb.WriteString("<div class='match-details'>")
 		sb.WriteString(fmt.Sprintf("<strong>%s</strong><br>", c.Name))
-		sb.WriteString(fmt.Sprintf("<span>✉️ Email: %s</span><br>", c.Email))
+		sb.WriteString(presenceBadge(c.Email))
+		sb.WriteString(phoneVerifiedBadge(c.Email))
+		sb.WriteString(backgroundCheckBadge(c.Email))
+		if chatRoom.ContactShared(viewer, c.Email) {
+			sb.WriteString(fmt.Sprintf("<span>✉️ Email: %s</span><br>", c.Email))
+		}
 		sb.WriteString(fmt.Sprintf("<span>📍 Location: %s</span><br>", c.Location))
 		sb.WriteString(fmt.Sprintf("<span>💰 Rate: $%.2f/hour</span><br>", c.RateExpectations))
 		sb.WriteString(fmt.Sprintf("<span>🕒 Availability: %s</span><br>", c.Availability))
@@ -1588,8 +2877,17 @@ func formatCaregiverList(caregivers []Caregiver) string {
 				}
 				sb.WriteString(skill)
 			}
-			sb.WriteString("</span>")
+			sb.WriteString("</span><br>")
+		}
+		sb.WriteString(formatCustomFields(c.Email, "caregiver"))
+		sb.WriteString(formatMatchReasons(c.MatchReasons))
+		if !chatRoom.ContactShared(viewer, c.Email) {
+			sb.WriteString(formatContactRequest(viewer, c.Email))
 		}
+		if starred != nil {
+			sb.WriteString(formatFavoriteStar(viewer, c.Email, starred[c.Email]))
+		}
+		sb.WriteString(formatReportBlock(viewer, c.Email, ""))
 		sb.WriteString("</div></li>")
 	}
 
@@ -1597,88 +2895,200 @@ func formatCaregiverList(caregivers []Caregiver) string {
 	return sb.String()
 }
 
-func handleOpenAIResponse(resp *ChatResponse, email string, app *App) error {
-	if len(resp.Choices) == 0 {
-		return nil
+// formatQueryResults renders dynamic query rows as an HTML table
+func formatQueryResults(rows []map[string]interface{}) string {
+	if len(rows) == 0 {
+		return "<p>No results found.</p>"
 	}
 
-	choice := resp.Choices[0].Message
-	if choice.FunctionCall != nil {
-		args, err := choice.FunctionCall.GetArguments()
+	var cols []string
+	for col := range rows[0] {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+
+	var sb strings.Builder
+	sb.WriteString("<table class='query-results'><tr>")
+	for _, col := range cols {
+		sb.WriteString(fmt.Sprintf("<th>%s</th>", template.HTMLEscapeString(col)))
+	}
+	sb.WriteString("</tr>")
+	for _, row := range rows {
+		sb.WriteString("<tr>")
+		for _, col := range cols {
+			sb.WriteString(fmt.Sprintf("<td>%s</td>", template.HTMLEscapeString(fmt.Sprint(row[col]))))
+		}
+		sb.WriteString("</tr>")
+	}
+	sb.WriteString("</table>")
+	return sb.String()
+}
+
+// dispatchFunctionCall runs the tool the model asked for on behalf of email
+// and returns the text to show the user
+func (app *App) dispatchFunctionCall(name string, args map[string]interface{}, email string) string {
+	if !app.tools.Enabled(name) {
+		log.Printf("Refusing call to disabled tool %s for %s", name, email)
+		return fmt.Sprintf("The %s tool is turned off right now.", name)
+	}
+
+	var cacheKey string
+	if cacheableTools[name] {
+		cacheKey = toolCacheKey(name, args, email)
+		if cached, ok := app.cache.Get(cacheKey); ok {
+			return cached.(string)
+		}
+	}
+
+	var response string
+	switch name {
+	case "list_patients":
+		patients, err := app.ListPatients()
 		if err != nil {
-			return fmt.Errorf("error parsing function arguments: %v", err)
+			response = fmt.Sprintf("Error listing patients: %v", err)
+		} else {
+			response = formatPatientList(patients, true, email)
 		}
 
-		var response string
-		switch choice.FunctionCall.Name {
-		case "list_patients":
-			patients, err := app.ListPatients()
-			if err != nil {
-				response = fmt.Sprintf("Error listing patients: %v", err)
-			} else {
-				response = formatPatientList(patients, true)
-			}
+	case "list_caregivers":
+		caregivers, err := app.ListCaregivers()
+		if err != nil {
+			response = fmt.Sprintf("Error listing caregivers: %v", err)
+		} else {
+			response = formatCaregiverList(caregivers, email)
+		}
 
-		case "list_caregivers":
-			caregivers, err := app.ListCaregivers()
-			if err != nil {
-				response = fmt.Sprintf("Error listing caregivers: %v", err)
-			} else {
-				response = formatCaregiverList(caregivers)
-			}
+	case "find_matching_caregivers":
+		caregivers, err := app.FindMatchingCaregivers(email)
+		if err == errConsentRequired {
+			response = app.consentRequestFor(email)
+		} else if err != nil {
+			response = fmt.Sprintf("Error finding matches: %v", err)
+		} else {
+			response = formatCaregiverList(caregivers, email)
+		}
 
-		case "find_matching_caregivers":
-			caregivers, err := app.FindMatchingCaregivers(email)
-			if err != nil {
-				response = fmt.Sprintf("Error finding matches: %v", err)
-			} else {
-				response = formatCaregiverList(caregivers)
-			}
+	case "find_matching_patients":
+		patients, err := app.FindMatchingPatients(email)
+		if err == errConsentRequired {
+			response = app.consentRequestFor(email)
+		} else if err != nil {
+			response = fmt.Sprintf("Error finding matches: %v", err)
+		} else {
+			response = formatPatientList(patients, true, email)
+		}
+
+	case "get_profile_status":
+		status, err := app.ProfileStatus(email)
+		if err != nil {
+			response = fmt.Sprintf("Error checking profile: %v", err)
+		} else {
+			response = formatProfileStatus(status)
+		}
+
+	case "set_preferences":
+		prefs, err := app.updatePreferencesFromArgs(email, args)
+		if err != nil {
+			response = fmt.Sprintf("Error saving preferences: %v", err)
+		} else {
+			response = formatPreferences(prefs)
+		}
+
+	case "get_rate_benchmarks":
+		benchmarks, err := app.RateBenchmarks(getStringArg(args, "location", ""))
+		if err != nil {
+			response = fmt.Sprintf("Error computing rate benchmarks: %v", err)
+		} else {
+			response = app.formatRateBenchmarks(email, benchmarks)
+		}
 
-		case "find_matching_patients":
-			patients, err := app.FindMatchingPatients(email)
+	case "execute_dynamic_query":
+		var q DynamicQuery
+		if err := json.Unmarshal(mustMarshal(args), &q); err != nil {
+			response = fmt.Sprintf("Error parsing query: %v", err)
+		} else {
+			// Only the rows the model will see are kept
+			var rows []map[string]interface{}
+			truncated := false
+			err := app.IterateDynamicQuery(q, func(row map[string]interface{}) error {
+				if len(rows) == maxToolQueryRows {
+					truncated = true
+					return errStopIteration
+				}
+				rows = append(rows, row)
+				return nil
+			})
 			if err != nil {
-				response = fmt.Sprintf("Error finding matches: %v", err)
+				response = fmt.Sprintf("Error running query: %v", err)
 			} else {
-				response = formatPatientList(patients, true)
+				app.maskQueryContacts(email, rows)
+				response = formatQueryResults(rows)
+				if truncated {
+					response += fmt.Sprintf("<p>Showing the first %d rows; add filters or a limit to narrow the results.</p>", maxToolQueryRows)
+				}
 			}
+		}
 
-		case "store_caregiver":
-			caregiver := &Caregiver{
-				Email:            email, // Use current user's email
-				Name:             getStringArg(args, "name", ""),
-				Experience:       getStringArg(args, "experience", ""),
-				Location:         getStringArg(args, "location", ""),
-				Availability:     getStringArg(args, "availability", ""),
-				Specializations:  getStringArg(args, "specializations", ""),
-				RateExpectations: getFloatArg(args, "rate_expectations", 0),
-				Certifications:   getStringArg(args, "certifications", ""),
-			}
-			if err := app.StoreCaregiver(caregiver); err != nil {
-				response = fmt.Sprintf("Error storing caregiver: %v", err)
-			} else {
-				response = "Successfully registered as a caregiver."
-			}
+	case "get_my_profile":
+		card, err := app.formatProfileCard(email)
+		if err != nil {
+			response = fmt.Sprintf("Error loading profile: %v", err)
+		} else {
+			response = card
+		}
 
-		case "store_patient":
-			patient := &Patient{
-				Email:                email, // Use current user's email
-				Name:                 getStringArg(args, "name", ""),
-				CareNeeds:            getStringArg(args, "care_needs", ""),
-				Location:             getStringArg(args, "location", ""),
-				ScheduleRequirements: getStringArg(args, "schedule_requirements", ""),
-				Budget:               getFloatArg(args, "budget", 0),
-				SpecialRequirements:  getStringArg(args, "special_requirements", ""),
-				PhoneNumber:          getStringArg(args, "phone_number", ""),
-				CreatedAt:            time.Now(),
-			}
-			if err := app.StorePatient(patient); err != nil {
-				response = fmt.Sprintf("Error storing patient: %v", err)
-			} else {
-				response = "Successfully registered as a patient."
-			}
+	case "set_availability":
+		response = app.updateAvailability(email, args)
+
+	case "get_care_plan":
+		response = app.getCarePlan(email, args)
+
+	case "update_care_plan":
+		response = app.updateCarePlan(email, args)
+
+	case "negotiate_rate":
+		response = app.negotiateRate(email, args)
+
+	case "request_human":
+		response = app.requestHandoffReply(email, HandoffByUser, getStringArg(args, "reason", ""))
+
+	case "undo_last_change":
+		change, err := app.UndoLastChange(email)
+		if err != nil {
+			response = fmt.Sprintf("Error undoing change: %v", err)
+		} else {
+			response = formatUndoneChange(change)
+		}
+
+	case "store_caregiver":
+		response = app.ProposeProfile(email, "caregiver", args)
+
+	case "store_patient":
+		response = app.ProposeProfile(email, "patient", args)
+	}
+
+	if cacheKey != "" && !strings.HasPrefix(response, "Error") {
+		app.cache.Set(cacheKey, response, toolCacheTTL)
+	}
+	return response
+}
+
+func handleOpenAIResponse(resp *ChatResponse, email string, app *App) error {
+	if len(resp.Choices) == 0 {
+		return nil
+	}
+
+	choice := resp.Choices[0].Message
+	if choice.FunctionCall != nil {
+		args, err := choice.FunctionCall.GetArguments()
+		if err != nil {
+			return fmt.Errorf("error parsing function arguments: %v", err)
 		}
 
+		if app.onToolCall != nil {
+			app.onToolCall(email, choice.FunctionCall.Name, args)
+		}
+		response := app.dispatchFunctionCall(choice.FunctionCall.Name, args, email)
 		if response != "" {
 			if err := app.AddMessageWithRecipient(email, "assistant", response, "admin"); err != nil {
 				return fmt.Errorf("error adding function response: %v", err)
@@ -1696,43 +3106,6 @@ func handleOpenAIResponse(resp *ChatResponse, email string, app *App) error {
 }
 
 // Add this function to test all matches
-func testAllMatches(app *App) {
-	log.Println("\n=== Testing All Matches ===")
-
-	// Get all caregivers and patients
-	caregivers, err := app.ListCaregivers()
-	if err != nil {
-		log.Printf("Error listing caregivers: %v", err)
-		return
-	}
-
-	patients, err := app.ListPatients()
-	if err != nil {
-		log.Printf("Error listing patients: %v", err)
-		return
-	}
-
-	// Show all patient -> caregiver matches
-	log.Println("\nPatient -> Caregiver Matches:")
-	for _, p := range patients {
-		log.Printf("\nPatient: %s", p.Email)
-		log.Printf("Matches with all caregivers:")
-		for _, c := range caregivers {
-			log.Printf("  • %s", c.Email)
-		}
-	}
-
-	// Show all caregiver -> patient matches
-	log.Println("\nCaregiver -> Patient Matches:")
-	for _, c := range caregivers {
-		log.Printf("\nCaregiver: %s", c.Email)
-		log.Printf("Matches with all patients:")
-		for _, p := range patients {
-			log.Printf("  • %s", p.Email)
-		}
-	}
-}
-
 func (app *App) handlePatientRegistration(email string, messages []Message) error {
 	// Extract patient information from messages
 	patient := &Patient{
@@ -1884,12 +3257,59 @@ var loadTest = flag.Bool("test", false, "Load test data on startup")
 
 func main() {
 	flag.Parse()
+	var err error
+	if config, err = loadConfig(*configFile); err != nil {
+		log.Fatal(err)
+	}
+	if *offline {
+		if err := goOffline(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := useOpenAIFixtures(*recordOpenAI, *replayOpenAI); err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "loadtest" {
+		if err := runLoadTest(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "db" {
+		if err := runDBCommand(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "matchcheck" {
+		if err := runMatchCheck(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "indexbench" {
+		if err := runIndexBenchmark(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
+	if apiKey == "" && !*offline && *replayOpenAI == "" {
 		log.Fatal("OPENAI_API_KEY environment variable is required")
 	}
 
-	var err error
+	if flag.Arg(0) == "scenario" {
+		if !runScenarios(flag.Args()[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Fix: Assign to global chatRoom variable
 	chatRoom, err = NewApp(apiKey)
 	if err != nil {
@@ -1897,13 +3317,17 @@ func main() {
 	}
 	defer chatRoom.Close()
 
-	// Serve static files before other routes
-	fs := http.FileServer(http.Dir("static"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	handler := newRouter()
 
-	http.HandleFunc("/", handleRoot)
-	http.HandleFunc("/chat", handleChat)
-	http.HandleFunc("/schedule", handleSchedule)
+	if err := chatRoom.registerJobs(); err != nil {
+		log.Fatal(err)
+	}
+	chatRoom.subscribeEmails()
+	chatRoom.subscribeOps()
+	chatRoom.subscribeWaitlist()
+	chatRoom.subscribeDuplicates()
+	go chatRoom.scheduler.Start()
+	serveDebug(chatRoom)
 
 	// Process test data if the file exists
 	go func() {
@@ -1915,15 +3339,15 @@ func main() {
 				}
 				log.Println("Completed processing test data")
 
-				// Run matching tests after processing test data
-				testAllMatches(chatRoom)
+				// Show who the test users are matched with
+				logMatchReport(chatRoom)
 			}
 		}
 	}()
 
 	port := ":8080"
 	fmt.Printf("Server starting on http://localhost%s\n", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	log.Fatal(http.ListenAndServe(port, handler))
 }
 
 func (app *App) handleChat(email string, message string) (string, error) {
@@ -1932,7 +3356,7 @@ func (app *App) handleChat(email string, message string) (string, error) {
 		return "", err
 	}
 
-	messages := app.GetUserMessages(email)
+	messages := app.GetUserMessages(email, adminThread)
 
 	// Check if this is a patient registration flow and all info is provided
 	if isPatientRegistration(messages) && hasAllRequiredInfo(messages) {
@@ -1958,7 +3382,7 @@ func (app *App) handleChat(email string, message string) (string, error) {
 		if err != nil {
 			return "", fmt.Errorf("failed to find matches: %v", err)
 		}
-		return formatCaregiverList(caregivers), nil
+		return formatCaregiverList(caregivers, email), nil
 	}
 
 	// Handle match command
@@ -1967,7 +3391,7 @@ func (app *App) handleChat(email string, message string) (string, error) {
 		if err != nil {
 			return "", fmt.Errorf("failed to find matches: %v", err)
 		}
-		return formatCaregiverList(caregivers), nil
+		return formatCaregiverList(caregivers, email), nil
 	}
 
 	// Rest of chat handling...
@@ -2145,15 +3569,29 @@ func (app *App) AcceptMatch(caregiverEmail, patientEmail string, startTime, endT
 	if hasConflict {
 		return fmt.Errorf("time slot is not available")
 	}
+	busy, err := app.BusyBlocks(caregiverEmail, startTime, endTime)
+	if err != nil {
+		return err
+	}
+	if len(busy) > 0 {
+		return fmt.Errorf("the caregiver's calendar is busy then")
+	}
 
 	// Create the assignment
-	return app.db.Exec(`
+	err = app.db.Exec(`
 		INSERT INTO assignments (
-			caregiver_email, patient_email, 
+			id, caregiver_email, patient_email, 
 			start_time, end_time, 
 			status, created_at
-		) VALUES (?, ?, ?, ?, 'scheduled', ?)
+		) VALUES (NEXT VALUE FOR assignments_seq, ?, ?, ?, ?, 'scheduled', ?)
 	`, caregiverEmail, patientEmail, startTime, endTime, time.Now())
+	if err != nil {
+		return err
+	}
+	app.notifyBooking(caregiverEmail, patientEmail, startTime, endTime)
+	app.refreshCalendars(caregiverEmail, patientEmail)
+	go app.pushGoogleCalendar(caregiverEmail)
+	return nil
 }
 
 func (app *App) GetCaregiverSchedule(email string, start, end time.Time) ([]Assignment, error) {
@@ -2291,23 +3729,53 @@ func formatCalendar(assignments []Assignment) string {
 
 // Add this struct at the top level with other type definitions
 type PageData struct {
-	Messages  []Message
-	UserEmail string
-	Calendar  string
-}
-
-// Update handleRoot function
-func handleRoot(w http.ResponseWriter, r *http.Request) {
-	email := r.URL.Query().Get("email")
-	if email == "" {
-		http.Error(w, "Email is required", http.StatusBadRequest)
-		return
-	}
-
-	// Create the PageData instance first
-	data := PageData{
-		Messages:  chatRoom.GetUserMessages(email),
-		UserEmail: email,
+	Messages        []HistoryMessage // Latest page; older pages load on scroll
+	OlderCursor     string
+	UserEmail       string
+	Calendar        string
+	ContactRequests []ContactRequest // Pending requests awaiting this user's answer
+	Attachments     []Attachment
+	Certifications  *CertificationStatus   // Set for caregivers
+	BackgroundCheck *BackgroundCheckStatus // Set for caregivers when checks are in use
+	CustomFields    []CustomFieldInput
+	Referral        *ReferralStats
+	ShowOnboarding  bool                   // Not registered yet, so offer the wizard
+	ProfileStatus   *ProfileStatus         // Set while the profile is incomplete
+	Phone           *PhoneStatus           // Set once the user has given a number
+	Telegram        *TelegramStatus        // Set when the Telegram bot is configured
+	FormTime        int64                  // When the page was rendered, for bot screening
+	Challenge       string                 // Turnstile site key, set for a new user's first message
+	VoiceNotes      bool                   // Transcription is set up and the user has typed a first message
+	Speech          bool                   // Assistant replies can be read aloud
+	Impersonation   *Impersonation         // Set when an admin is viewing as this user
+	AssistantDown   bool                   // OpenAI is failing, so replies are rule-based
+	Maintenance     *MaintenanceStatus     // Set while new messages are turned away
+	ReplyPending    bool                   // A message is queued for the assistant
+	Handoff         *Handoff               // Set while the user is waiting for or talking with the team
+	Suspension      *Suspension            // Set while the user is suspended
+	Threads         []ChatThread           // The user's conversations, to switch between
+	Availability    *CaregiverAvailability // Set for caregivers, to pause matching
+	PublicProfile   *PublicProfile         // Set for caregivers; Slug is empty until first turned on
+	PendingConsents []LegalDocument        // Documents to accept before matching
+	PeerThreads     []PeerThread           // Direct messages with other users
+	Shortlisted     *int                   // Set for patients: how many caregivers they've starred
+}
+
+// newPageData gathers everything the chat page shows for a user
+func newPageData(email string) PageData {
+	data := PageData{UserEmail: email, FormTime: time.Now().Unix()}
+	if config.Bots.ScreenSignups && chatRoom.isFirstContact(email) {
+		data.Challenge = config.Bots.TurnstileSiteKey
+	}
+	data.VoiceNotes = voiceNotesEnabled() && !chatRoom.isFirstContact(email)
+	data.Speech = speechEnabled()
+
+	page, err := chatRoom.MessagePage(email, adminThread, time.Time{}, messagePageSize)
+	if err != nil {
+		log.Printf("Error loading messages: %v", err)
+	} else {
+		data.Messages = page.Messages
+		data.OlderCursor = page.NextCursor
 	}
 
 	// If user is a caregiver, get and display their schedule
@@ -2320,14 +3788,122 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 		} else {
 			data.Calendar = formatCalendar(assignments)
 		}
+		if availability, err := chatRoom.GetAvailability(email); err != nil {
+			log.Printf("Error getting availability: %v", err)
+		} else {
+			data.Availability = &availability
+		}
+		if data.PublicProfile, err = chatRoom.GetPublicProfile(email); err != nil {
+			log.Printf("Error getting public profile: %v", err)
+		}
+		if data.PublicProfile == nil {
+			data.PublicProfile = &PublicProfile{}
+		}
+		data.Certifications = &CertificationStatus{Verified: chatRoom.DocumentVerified(email)}
+		if data.Certifications.List, err = chatRoom.ListCertifications(email); err != nil {
+			log.Printf("Error listing certifications: %v", err)
+		}
+		if data.BackgroundCheck, err = chatRoom.BackgroundCheckStatus(email); err != nil {
+			log.Printf("Error getting background check: %v", err)
+		}
+	}
+
+	requests, err := chatRoom.PendingContactRequests(email)
+	if err != nil {
+		log.Printf("Error getting contact requests: %v", err)
+	}
+	data.ContactRequests = requests
+
+	if data.Attachments, err = chatRoom.ListAttachments(email); err != nil {
+		log.Printf("Error listing attachments: %v", err)
+	}
+	data.CustomFields = chatRoom.customFieldInputs(email)
+	data.ShowOnboarding = chatRoom.userRole(email) == "unknown"
+	if chatRoom.userRole(email) == "patient" {
+		shortlisted := len(chatRoom.shortlisted(email))
+		data.Shortlisted = &shortlisted
+	}
+	data.ProfileStatus = chatRoom.profileStatusFor(email)
+	data.Phone = chatRoom.phoneStatusFor(email)
+	data.Telegram = chatRoom.telegramStatusFor(email)
+	data.AssistantDown = AssistantDown()
+	if status := maintenance.Status(); status.Enabled {
+		data.Maintenance = &status
+	}
+	if data.Threads, err = chatRoom.ChatThreads(email); err != nil {
+		log.Printf("Error listing threads: %v", err)
+	}
+	data.ReplyPending = chatRoom.HasPendingReply(email)
+	if data.Handoff, err = chatRoom.OpenHandoff(email); err != nil {
+		log.Printf("Error checking handoff: %v", err)
+	}
+	if data.Suspension, err = chatRoom.GetSuspension(email); err != nil {
+		log.Printf("Error checking suspension: %v", err)
+	}
+	if data.PendingConsents, err = chatRoom.PendingConsents(email); err != nil {
+		log.Printf("Error checking consents: %v", err)
+	}
+	if data.Referral, err = chatRoom.ReferralStatsFor(email); err != nil {
+		log.Printf("Error loading referral stats: %v", err)
+	}
+
+	if data.PeerThreads, err = chatRoom.PeerThreads(email); err != nil {
+		log.Printf("Error listing direct messages: %v", err)
+	}
+
+	return data
+}
+
+// Update handleRoot function
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	// An admin viewing as the user leaves their presence and unread counts
+	// as they were
+	impersonation := impersonationFrom(r)
+	if impersonation == nil {
+		chatRoom.presence.Seen(email)
+		redeemInviteParam(r, email)
+	}
+	data := newPageData(email)
+	data.Impersonation = impersonation
+	renderTemplate(w, "chat", htmlTemplate, data)
+	if impersonation != nil {
+		return
 	}
 
-	// Create template with the safeHTML function
-	tmpl, err := template.New("chat").Funcs(template.FuncMap{
+	// The assistant thread is on screen now, so it no longer counts as unread
+	if err := chatRoom.MarkThreadRead(email, adminThread); err != nil {
+		log.Printf("Error marking thread read for %s: %v", email, err)
+	}
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+// renderTemplate parses text with the safeHTML helper and executes it into w
+func renderTemplate(w http.ResponseWriter, name, text string, data interface{}) {
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
 		"safeHTML": func(s string) template.HTML {
 			return template.HTML(s)
 		},
-	}).Parse(htmlTemplate)
+		"percent": func(f float64) float64 {
+			return f * 100
+		},
+		"brand": func() BrandingConfig {
+			return config.Branding
+		},
+		"formatMinutes": formatMinutes,
+	}).Parse(text)
 	if err != nil {
 		http.Error(w, "Failed to parse template", http.StatusInternalServerError)
 		return
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+// newTestApp opens an app on a fresh in-memory database and makes it
+// chatRoom, which handlers and tool calls reach it through, for the test
+func newTestApp(t testing.TB) *App {
+	t.Helper()
+	app, err := openApp(":memory:", "")
+	if err != nil {
+		t.Fatalf("openApp: %v", err)
+	}
+	previous := chatRoom
+	chatRoom = app
+	t.Cleanup(func() {
+		chatRoom = previous
+		app.Close()
+	})
+	return app
+}
+
+// Opening a database creates every table and runs every migration;
+// opening it again must find them all in place
+func TestOpenAppMigrates(t *testing.T) {
+	path := t.TempDir() + "/helper2.db"
+	for i := 0; i < 2; i++ {
+		app, err := openApp(path, "")
+		if err != nil {
+			t.Fatalf("open %d: %v", i+1, err)
+		}
+		if err := app.Close(); err != nil {
+			t.Fatalf("close %d: %v", i+1, err)
+		}
+	}
+}
+
+// A filter outside the whitelists is refused at any depth, not dropped
+// from the WHERE clause
+func TestBuildDynamicQueryRejectsFilters(t *testing.T) {
+	app := newTestApp(t)
+	valid := QueryFilter{Field: "location", Operator: "=", Value: "Austin"}
+	tests := []struct {
+		name   string
+		filter QueryFilter
+	}{
+		{"unknown field", QueryFilter{Field: "password", Operator: "=", Value: "x"}},
+		{"unknown operator", QueryFilter{Field: "location", Operator: "; DROP", Value: "x"}},
+		{"nested field", QueryFilter{Any: []QueryFilter{valid, {Field: "password", Operator: "=", Value: "x"}}}},
+		{"deeply nested operator", QueryFilter{All: []QueryFilter{valid, {Any: []QueryFilter{{Field: "budget", Operator: "<>", Value: 1}}}}}},
+	}
+	for _, tt := range tests {
+		q := DynamicQuery{Table: "patients", Filters: []QueryFilter{tt.filter}}
+		if sql, _, err := app.BuildDynamicQuery(q); err == nil {
+			t.Errorf("%s: built %q, want an error", tt.name, sql)
+		}
+	}
+
+	q := DynamicQuery{Table: "patients", Filters: []QueryFilter{{Any: []QueryFilter{valid, {Field: "budget", Operator: ">", Value: 20}}}}}
+	if _, params, err := app.BuildDynamicQuery(q); err != nil || len(params) != 2 {
+		t.Errorf("valid nested filter: got %v params, %v", params, err)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// TableStats describes one table for the maintenance report
+type TableStats struct {
+	Name string `json:"name"`
+	Rows int    `json:"rows"`
+	// Error is why the integrity check couldn't read the whole table
+	Error string `json:"error,omitempty"`
+}
+
+// catalogEntry is a table or index definition from chai's catalog
+type catalogEntry struct {
+	Name string
+	SQL  string
+}
+
+// catalog lists user tables or indexes ("table" or "index") with the SQL
+// that creates them
+func (db *instrumentedDB) catalog(kind string) ([]catalogEntry, error) {
+	result, err := db.Query("SELECT name, sql FROM __chai_catalog WHERE type = ?", kind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %v", err)
+	}
+	defer result.Close()
+
+	var entries []catalogEntry
+	err = result.Iterate(func(r *chai.Row) error {
+		var e catalogEntry
+		if err := r.Scan(&e.Name, &e.SQL); err != nil {
+			return fmt.Errorf("failed to scan catalog entry: %v", err)
+		}
+		if !strings.HasPrefix(e.Name, "__chai") {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// copyRows calls fn with every row of a table, decoded into column names
+// and values
+func copyRows(q execer, table string, fn func(cols []string, values []interface{}) error) error {
+	result, err := q.Query("SELECT * FROM " + table)
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %v", table, err)
+	}
+	defer result.Close()
+
+	return result.Iterate(func(r *chai.Row) error {
+		cols, err := r.Columns()
+		if err != nil {
+			return err
+		}
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := r.Scan(ptrs...); err != nil {
+			return err
+		}
+		return fn(cols, values)
+	})
+}
+
+// CheckTables counts every table's rows by reading each one in full, so a
+// row that can't be decoded shows up here rather than later in a request
+func (app *App) CheckTables() ([]TableStats, error) {
+	tables, err := app.db.catalog("table")
+	if err != nil {
+		return nil, err
+	}
+	var stats []TableStats
+	for _, t := range tables {
+		s := TableStats{Name: t.Name}
+		err := copyRows(app.db, t.Name, func([]string, []interface{}) error {
+			s.Rows++
+			return nil
+		})
+		if err != nil {
+			s.Error = err.Error()
+			log.Printf("Integrity check of %s stopped after %d rows: %v", t.Name, s.Rows, err)
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// Reindex rebuilds every index from its table
+func (app *App) Reindex() error {
+	if err := app.db.Exec("REINDEX"); err != nil {
+		return fmt.Errorf("failed to rebuild indexes: %v", err)
+	}
+	return nil
+}
+
+// maintenanceJob is the online part of maintenance: it checks every table
+// and rebuilds indexes. Compaction needs the server stopped, so it's only
+// done by the "db maintain" command.
+func (app *App) maintenanceJob() error {
+	stats, err := app.CheckTables()
+	if err != nil {
+		return err
+	}
+	for _, s := range stats {
+		if s.Error != "" {
+			return fmt.Errorf("table %s failed the integrity check: %s", s.Name, s.Error)
+		}
+	}
+	return app.Reindex()
+}
+
+// dirSize totals the files under path
+func dirSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// compactDatabase rewrites the database at path into a fresh copy, which
+// leaves behind the space held by deleted and overwritten rows, then swaps
+// the copy in. The original is kept alongside as path.bak-<time>. The
+// database must not be open anywhere else.
+func compactDatabase(path string) (string, error) {
+	src, err := openApp(path, "")
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tables, err := src.db.catalog("table")
+	if err != nil {
+		return "", err
+	}
+	indexes, err := src.db.catalog("index")
+	if err != nil {
+		return "", err
+	}
+
+	tmp := path + ".compact"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", fmt.Errorf("failed to clear %s: %v", tmp, err)
+	}
+	raw, err := chai.Open(tmp)
+	if err != nil {
+		return "", fmt.Errorf("failed to create compacted database: %v", err)
+	}
+	dst := &instrumentedDB{DB: raw}
+
+	err = func() error {
+		defer dst.Close()
+		for _, t := range tables {
+			if err := dst.Exec(t.SQL); err != nil {
+				return fmt.Errorf("failed to create %s: %v", t.Name, err)
+			}
+			err := dst.Update(func(tx *chai.Tx) error {
+				return copyRows(src.db, t.Name, func(cols []string, values []interface{}) error {
+					marks := strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ")
+					return tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+						t.Name, strings.Join(cols, ", "), marks), values...)
+				})
+			})
+			if err != nil {
+				return fmt.Errorf("failed to copy %s: %v", t.Name, err)
+			}
+		}
+		// Indexes that belong to a table's constraints were created with it
+		for _, idx := range indexes {
+			stmt := strings.Replace(idx.SQL, "INDEX ", "INDEX IF NOT EXISTS ", 1)
+			if err := dst.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to create index %s: %v", idx.Name, err)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	// Close before the rename; the deferred Close is then a no-op
+	src.Close()
+
+	backup := fmt.Sprintf("%s.bak-%s", path, time.Now().Format("20060102-150405"))
+	if err := os.Rename(path, backup); err != nil {
+		return "", fmt.Errorf("failed to move the old database aside: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", fmt.Errorf("failed to move the compacted database into place (the original is at %s): %v", backup, err)
+	}
+	return backup, nil
+}
+
+// runDBCommand is the "db" subcommand. "db maintain" checks every table,
+// rebuilds indexes, reports row counts and, with -compact, rewrites the
+// database to reclaim space. Stop the server first: the database can only
+// be open in one process.
+func runDBCommand(args []string) error {
+	if len(args) == 0 || args[0] != "maintain" {
+		return fmt.Errorf("usage: helper2 [flags] db maintain [-compact] [-reindex=false]")
+	}
+	fs := flag.NewFlagSet("db maintain", flag.ExitOnError)
+	compact := fs.Bool("compact", false, "Rewrite the database into a fresh copy to reclaim space, keeping the original as a backup")
+	reindex := fs.Bool("reindex", true, "Rebuild every index")
+	fs.Parse(args[1:])
+
+	path := databasePath()
+	if path == ":memory:" {
+		return fmt.Errorf("there's nothing to maintain in an in-memory database")
+	}
+	before := dirSize(path)
+
+	app, err := openApp(path, "")
+	if err != nil {
+		return fmt.Errorf("%v (is the server still running?)", err)
+	}
+	stats, err := app.CheckTables()
+	if err == nil && *reindex {
+		err = app.Reindex()
+	}
+	app.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-28s %10s\n", "Table", "Rows")
+	total, bad := 0, 0
+	for _, s := range stats {
+		total += s.Rows
+		fmt.Printf("%-28s %10d\n", s.Name, s.Rows)
+		if s.Error != "" {
+			fmt.Printf("    FAILED after %d rows: %s\n", s.Rows, s.Error)
+			bad++
+		}
+	}
+	fmt.Printf("%-28s %10d\n", "Total", total)
+	if *reindex {
+		fmt.Println("Indexes rebuilt")
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d tables failed the integrity check; not compacting", bad)
+	}
+
+	fmt.Printf("Size on disk: %.1f MB\n", float64(before)/(1<<20))
+	if !*compact {
+		return nil
+	}
+	backup, err := compactDatabase(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Compacted to %.1f MB; the original is at %s\n", float64(dirSize(path))/(1<<20), backup)
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rfielding/helper2/internal/server"
+)
+
+// Admins can put the app into maintenance mode while it runs. New chat
+// posts get a "back shortly" page instead of a turn, while turns already
+// talking to OpenAI finish. Scheduled jobs don't start, and /readyz fails
+// so load balancers stop sending traffic. The mode lives in memory, so a
+// restart ends it.
+
+// maintenanceRetryAfter is what clients turned away are told to wait
+const maintenanceRetryAfter = 5 * time.Minute
+
+// maxDrainWait caps how long turning maintenance on waits for chat turns
+// in flight
+const maxDrainWait = 2 * time.Minute
+
+const defaultMaintenanceMessage = "We're doing some quick maintenance and will be back shortly. Your conversation is saved."
+
+// MaintenanceStatus is whether maintenance mode is on, and how many chat
+// turns are still running
+type MaintenanceStatus struct {
+	Enabled  bool       `json:"enabled"`
+	Message  string     `json:"message,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+	By       string     `json:"by,omitempty"`
+	InFlight int        `json:"in_flight"`
+}
+
+// maintenanceMode is the app's maintenance switch and its count of chat
+// turns in flight
+type maintenanceMode struct {
+	mu       sync.Mutex
+	enabled  bool
+	message  string
+	since    time.Time
+	by       string
+	inFlight int
+}
+
+var maintenance = &maintenanceMode{}
+
+// InMaintenance reports whether maintenance mode is on
+func InMaintenance() bool {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	return maintenance.enabled
+}
+
+// Set turns maintenance mode on with a message for users, or off
+func (m *maintenanceMode) Set(enabled bool, message, admin string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	if enabled && !m.enabled {
+		m.since = time.Now()
+	}
+	m.enabled, m.message, m.by = enabled, message, admin
+	if enabled {
+		log.Printf("Maintenance mode on (by %s)", admin)
+	} else {
+		log.Printf("Maintenance mode off (by %s)", admin)
+	}
+}
+
+// Status reports the current state
+func (m *maintenanceMode) Status() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := MaintenanceStatus{Enabled: m.enabled, InFlight: m.inFlight}
+	if m.enabled {
+		since := m.since
+		status.Message, status.Since, status.By = m.message, &since, m.by
+	}
+	return status
+}
+
+// begin and end bracket a chat turn, so draining can wait for it
+func (m *maintenanceMode) begin() {
+	m.mu.Lock()
+	m.inFlight++
+	m.mu.Unlock()
+}
+
+func (m *maintenanceMode) end() {
+	m.mu.Lock()
+	m.inFlight--
+	m.mu.Unlock()
+}
+
+// Drain waits up to timeout for the chat turns in flight to finish and
+// returns how many are still running
+func (m *maintenanceMode) Drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		status := m.Status()
+		if status.InFlight == 0 || time.Now().After(deadline) {
+			return status.InFlight
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+const maintenanceTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Back shortly</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Back shortly</h1>
+        </div>
+        <div class="message system">
+            <p>{{.Message}}</p>
+            <p>Your message wasn't sent. Please <a href="javascript:history.back()">go back</a> and send it again in a few minutes.</p>
+        </div>
+    </div>
+</body>
+</html>
+`
+
+// pausedForMaintenance turns away posts while maintenance mode is on, with
+// a page for people and a problem for API clients
+func pausedForMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := maintenance.Status()
+		if !status.Enabled || server.IsSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+		if wantsProblemJSON(r) {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(Problem{
+				Type:      "about:blank",
+				Title:     http.StatusText(http.StatusServiceUnavailable),
+				Status:    http.StatusServiceUnavailable,
+				Detail:    status.Message,
+				Instance:  r.URL.Path,
+				Code:      "maintenance",
+				RequestID: server.RequestID(r),
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		renderTemplate(w, "maintenance", maintenanceTemplate, status)
+	})
+}
+
+// handleHealthz is the liveness check: the process is up, whether or not
+// it's in maintenance
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	status := maintenance.Status()
+	state := "ok"
+	if status.Enabled {
+		state = "maintenance"
+	}
+	writeJSON(w, map[string]interface{}{"status": state, "maintenance": status})
+}
+
+// handleReadyz is the readiness check: it fails during maintenance so load
+// balancers drain the instance
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := maintenance.Status()
+	if status.Enabled {
+		w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "maintenance", "maintenance": status})
+		return
+	}
+	writeJSON(w, map[string]interface{}{"status": "ready", "maintenance": status})
+}
+
+// handleMaintenanceAPI reports maintenance mode on GET and switches it on
+// POST: {"enabled": true, "message": "...", "drain_seconds": 30}. Turning
+// it on waits up to drain_seconds for chat turns in flight to finish.
+func handleMaintenanceAPI(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, maintenance.Status())
+
+	case "POST":
+		var req struct {
+			Enabled      bool   `json:"enabled"`
+			Message      string `json:"message"`
+			DrainSeconds int    `json:"drain_seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		maintenance.Set(req.Enabled, req.Message, admin)
+		action := "maintenance.off"
+		if req.Enabled {
+			action = "maintenance.on"
+			if wait := time.Duration(req.DrainSeconds) * time.Second; wait > 0 {
+				if wait > maxDrainWait {
+					wait = maxDrainWait
+				}
+				if left := maintenance.Drain(wait); left > 0 {
+					log.Printf("%d chat turns still running after waiting %s", left, wait)
+				}
+			}
+		}
+		chatRoom.Audit(r, admin, action, "", req.Message)
+		writeJSON(w, maintenance.Status())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
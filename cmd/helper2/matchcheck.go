@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// The match check runs the real matcher for every user and compares what
+// it returns with a fixture of expected matches, so a change to matching
+// can be checked against a known database before it ships.
+
+// MatchFixture maps each user's email to the emails they should be
+// matched with, best first
+type MatchFixture map[string][]string
+
+// UserMatchResult is what the matcher returned for one user and how it
+// differs from the fixture
+type UserMatchResult struct {
+	Email   string   `json:"email"`
+	Role    string   `json:"role"`
+	Matches []string `json:"matches"`
+	Error   string   `json:"error,omitempty"`
+	// Set when compared with a fixture that lists this user
+	Expected   []string `json:"expected,omitempty"`
+	Missing    []string `json:"missing,omitempty"`    // Expected but not returned
+	Unexpected []string `json:"unexpected,omitempty"` // Returned but not expected
+	Reordered  bool     `json:"reordered,omitempty"`  // Same matches in another order
+}
+
+// Passed reports whether the user's matches are as expected
+func (u UserMatchResult) Passed() bool {
+	return u.Error == "" && len(u.Missing) == 0 && len(u.Unexpected) == 0 && !u.Reordered
+}
+
+// MatchReport is the machine-readable result of a match check
+type MatchReport struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Users       []UserMatchResult `json:"users"`
+	Checked     int               `json:"checked"` // Users the fixture lists
+	Failed      int               `json:"failed"`
+	Unlisted    []string          `json:"unlisted,omitempty"` // In the fixture but not in the database
+}
+
+// Passed reports whether every checked user matched the fixture
+func (r *MatchReport) Passed() bool {
+	return r.Failed == 0 && len(r.Unlisted) == 0
+}
+
+// Fixture returns the report's matches as a fixture, to record the
+// current behaviour as expected
+func (r *MatchReport) Fixture() MatchFixture {
+	fixture := MatchFixture{}
+	for _, u := range r.Users {
+		if u.Error == "" {
+			fixture[u.Email] = u.Matches
+		}
+	}
+	return fixture
+}
+
+// ComputeAllMatches runs FindMatchingCaregivers for every patient and
+// FindMatchingPatients for every caregiver
+func (app *App) ComputeAllMatches() (*MatchReport, error) {
+	patients, err := app.ListPatients()
+	if err != nil {
+		return nil, err
+	}
+	caregivers, err := app.ListCaregivers()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MatchReport{GeneratedAt: time.Now()}
+	for _, p := range patients {
+		u := UserMatchResult{Email: p.Email, Role: "patient", Matches: []string{}}
+		found, err := app.FindMatchingCaregivers(p.Email)
+		if err != nil {
+			u.Error = err.Error()
+		}
+		for _, c := range found {
+			u.Matches = append(u.Matches, c.Email)
+		}
+		report.Users = append(report.Users, u)
+	}
+	for _, c := range caregivers {
+		u := UserMatchResult{Email: c.Email, Role: "caregiver", Matches: []string{}}
+		found, err := app.FindMatchingPatients(c.Email)
+		if err != nil {
+			u.Error = err.Error()
+		}
+		for _, p := range found {
+			u.Matches = append(u.Matches, p.Email)
+		}
+		report.Users = append(report.Users, u)
+	}
+	return report, nil
+}
+
+// Compare checks each user the fixture lists against their expected
+// matches. Users the fixture doesn't list are reported but not checked.
+func (r *MatchReport) Compare(expected MatchFixture) {
+	seen := map[string]bool{}
+	for i := range r.Users {
+		u := &r.Users[i]
+		want, ok := expected[u.Email]
+		if !ok {
+			continue
+		}
+		seen[u.Email] = true
+		r.Checked++
+		u.Expected = want
+		u.Missing = difference(want, u.Matches)
+		u.Unexpected = difference(u.Matches, want)
+		if len(u.Missing) == 0 && len(u.Unexpected) == 0 {
+			for j := range want {
+				if want[j] != u.Matches[j] {
+					u.Reordered = true
+					break
+				}
+			}
+		}
+		if !u.Passed() {
+			r.Failed++
+		}
+	}
+	for email := range expected {
+		if !seen[email] {
+			r.Unlisted = append(r.Unlisted, email)
+		}
+	}
+	sort.Strings(r.Unlisted)
+}
+
+// difference returns the items of a that aren't in b, in a's order
+func difference(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	var out []string
+	for _, s := range a {
+		if !in[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// LoadMatchFixture reads a fixture of expected matches
+func LoadMatchFixture(path string) (MatchFixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read match fixture: %v", err)
+	}
+	var fixture MatchFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse match fixture %s: %v", path, err)
+	}
+	return fixture, nil
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if path == "" || path == "-" {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// logMatchReport logs who each user is matched with, after the test data
+// has been loaded
+func logMatchReport(app *App) {
+	report, err := app.ComputeAllMatches()
+	if err != nil {
+		log.Printf("Error computing matches: %v", err)
+		return
+	}
+	log.Println("=== Matches ===")
+	for _, u := range report.Users {
+		if u.Error != "" {
+			log.Printf("%s %s: %s", u.Role, u.Email, u.Error)
+			continue
+		}
+		log.Printf("%s %s: %d matches %v", u.Role, u.Email, len(u.Matches), u.Matches)
+	}
+}
+
+// runMatchCheck is the "matchcheck" subcommand. It runs the matcher for
+// every user in the database and writes the report as JSON. With
+// -expected it compares with a fixture and fails on any difference; with
+// -update it writes the current matches to the fixture instead.
+func runMatchCheck(args []string) error {
+	fs := flag.NewFlagSet("matchcheck", flag.ExitOnError)
+	expectedPath := fs.String("expected", "", "Fixture of expected matches to compare with")
+	update := fs.Bool("update", false, "Write the current matches to the -expected fixture instead of comparing")
+	out := fs.String("out", "-", "Where to write the JSON report; - for standard output")
+	fs.Parse(args)
+	if *update && *expectedPath == "" {
+		return fmt.Errorf("-update needs -expected")
+	}
+
+	app, err := openApp(databasePath(), "")
+	if err != nil {
+		return fmt.Errorf("%v (is the server still running?)", err)
+	}
+	defer app.Close()
+	chatRoom = app
+
+	report, err := app.ComputeAllMatches()
+	if err != nil {
+		return err
+	}
+	if *update {
+		if err := writeJSONFile(*expectedPath, report.Fixture()); err != nil {
+			return fmt.Errorf("failed to write match fixture: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Recorded matches for %d users in %s\n", len(report.Users), *expectedPath)
+		return nil
+	}
+	if *expectedPath != "" {
+		fixture, err := LoadMatchFixture(*expectedPath)
+		if err != nil {
+			return err
+		}
+		report.Compare(fixture)
+	}
+	if err := writeJSONFile(*out, report); err != nil {
+		return fmt.Errorf("failed to write match report: %v", err)
+	}
+	if !report.Passed() {
+		return fmt.Errorf("%d of %d users matched differently than expected, %d expected users missing",
+			report.Failed, report.Checked, len(report.Unlisted))
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Match statuses, in the order a match normally moves through them
+const (
+	MatchProposed  = "proposed"
+	MatchContacted = "contacted"
+	MatchAccepted  = "accepted"
+	MatchActive    = "active"
+	MatchEnded     = "ended"
+)
+
+// matchTransitions lists the statuses a match may move to from each status.
+// Any open match can be ended early by either party.
+var matchTransitions = map[string][]string{
+	MatchProposed:  {MatchContacted, MatchEnded},
+	MatchContacted: {MatchAccepted, MatchEnded},
+	MatchAccepted:  {MatchActive, MatchEnded},
+	MatchActive:    {MatchEnded},
+	MatchEnded:     {},
+}
+
+const matchEventsSchema = `
+	CREATE TABLE IF NOT EXISTS match_events (
+		caregiver_email TEXT,
+		patient_email TEXT,
+		from_status TEXT,
+		to_status TEXT,
+		actor TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (caregiver_email, patient_email, created_at)
+	);
+	CREATE INDEX IF NOT EXISTS idx_match_events_caregiver_email ON match_events(caregiver_email);
+	CREATE INDEX IF NOT EXISTS idx_match_events_patient_email ON match_events(patient_email)
+`
+
+// MatchEvent is one status transition in a match's history
+type MatchEvent struct {
+	CaregiverEmail string    `json:"caregiver_email"`
+	PatientEmail   string    `json:"patient_email"`
+	FromStatus     string    `json:"from_status"`
+	ToStatus       string    `json:"to_status"`
+	Actor          string    `json:"actor"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// MatchTimeline is a match together with its full event history
+type MatchTimeline struct {
+	Match  Match        `json:"match"`
+	Events []MatchEvent `json:"events"`
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range matchTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func recordMatchEvent(q execer, caregiverEmail, patientEmail, from, to, actor string) error {
+	err := q.Exec(`
+		INSERT INTO match_events (
+			caregiver_email, patient_email, from_status, to_status, actor, created_at
+		) VALUES (?, ?, ?, ?, ?, ?)
+	`, caregiverEmail, patientEmail, from, to, actor, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to record match event: %v", err)
+	}
+	return nil
+}
+
+// GetMatch returns the match between a caregiver and a patient, or nil if none exists
+func (app *App) GetMatch(caregiverEmail, patientEmail string) (*Match, error) {
+	return getMatch(app.db, caregiverEmail, patientEmail)
+}
+
+func getMatch(q execer, caregiverEmail, patientEmail string) (*Match, error) {
+	result, err := q.Query(`
+		SELECT caregiver_email, patient_email, status, created_at, agreed_rate
+		FROM matches
+		WHERE caregiver_email = ? AND patient_email = ?
+	`, caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query match: %v", err)
+	}
+	defer result.Close()
+
+	var match *Match
+	err = result.Iterate(func(r *chai.Row) error {
+		var m Match
+		if err := r.Scan(&m.CaregiverEmail, &m.PatientEmail, &m.Status, &m.CreatedAt, &m.AgreedRate); err != nil {
+			return fmt.Errorf("failed to scan match: %v", err)
+		}
+		match = &m
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return match, nil
+}
+
+// TransitionMatch moves a match to a new status and records who did it
+func (app *App) TransitionMatch(caregiverEmail, patientEmail, to, actor string) error {
+	// Read and write in one transaction so two parties changing the status
+	// at once can't both pass the transition check
+	err := app.withTx(func(tx *chai.Tx) error {
+		match, err := getMatch(tx, caregiverEmail, patientEmail)
+		if err != nil {
+			return err
+		}
+		if match == nil {
+			return fmt.Errorf("match not found")
+		}
+		if !canTransition(match.Status, to) {
+			return fmt.Errorf("cannot move match from %s to %s", match.Status, to)
+		}
+
+		err = tx.Exec(`
+			UPDATE matches SET status = ?
+			WHERE caregiver_email = ? AND patient_email = ?
+		`, to, caregiverEmail, patientEmail)
+		if err != nil {
+			return fmt.Errorf("failed to update match status: %v", err)
+		}
+		return recordMatchEvent(tx, caregiverEmail, patientEmail, match.Status, to, actor)
+	})
+	if err != nil {
+		return err
+	}
+	app.invalidateToolCaches()
+	app.syncMatchRelay(caregiverEmail, patientEmail, to)
+	if to == MatchAccepted {
+		app.events.Publish(EventMatchAccepted, map[string]interface{}{
+			"caregiver_email": caregiverEmail,
+			"patient_email":   patientEmail,
+			"actor":           actor,
+		})
+	}
+	return nil
+}
+
+// GetMatchEvents returns a match's status history, oldest first
+func (app *App) GetMatchEvents(caregiverEmail, patientEmail string) ([]MatchEvent, error) {
+	result, err := app.db.Query(`
+		SELECT caregiver_email, patient_email, from_status, to_status, actor, created_at
+		FROM match_events
+		WHERE caregiver_email = ? AND patient_email = ?
+		ORDER BY created_at ASC
+	`, caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query match events: %v", err)
+	}
+	defer result.Close()
+
+	var events []MatchEvent
+	err = result.Iterate(func(r *chai.Row) error {
+		var e MatchEvent
+		if err := r.Scan(&e.CaregiverEmail, &e.PatientEmail, &e.FromStatus,
+			&e.ToStatus, &e.Actor, &e.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan match event: %v", err)
+		}
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate match events: %v", err)
+	}
+	return events, nil
+}
+
+// loadMatchTimeline fetches the timeline for the match named in the request,
+// making sure the requesting user is one of its two parties.
+func loadMatchTimeline(r *http.Request) (*MatchTimeline, int, error) {
+	email := r.FormValue("email")
+	caregiverEmail := r.FormValue("caregiver_email")
+	patientEmail := r.FormValue("patient_email")
+	if caregiverEmail == "" || patientEmail == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("caregiver_email and patient_email are required")
+	}
+	if email != caregiverEmail && email != patientEmail {
+		return nil, http.StatusForbidden, fmt.Errorf("not a party to this match")
+	}
+
+	match, err := chatRoom.GetMatch(caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if match == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("match not found")
+	}
+
+	events, err := chatRoom.GetMatchEvents(caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return &MatchTimeline{Match: *match, Events: events}, http.StatusOK, nil
+}
+
+// handleMatchTimeline serves a match's event history as JSON
+func handleMatchTimeline(w http.ResponseWriter, r *http.Request) {
+	timeline, status, err := loadMatchTimeline(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	modified := timeline.Match.CreatedAt
+	for _, e := range timeline.Events {
+		modified = latest(modified, e.CreatedAt)
+	}
+	writeJSONCached(w, r, timeline, modified)
+}
+
+const matchDetailTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Match Details</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Match Details</h1>
+            <div class="app-description">{{.Timeline.Match.CaregiverEmail}} &amp; {{.Timeline.Match.PatientEmail}}</div>
+        </div>
+        <div class="match-details">
+            <strong>Status: {{.Timeline.Match.Status}}</strong>
+            <span>Created {{.Timeline.Match.CreatedAt.Format "Mon Jan 2 2006 3:04 PM"}}</span>
+            <span>💰 {{if .Timeline.Match.AgreedRate}}Agreed rate: ${{printf "%.2f" .Timeline.Match.AgreedRate}}/hour{{else}}No rate agreed yet{{end}}</span>
+            {{if or (eq .Timeline.Match.Status "accepted") (eq .Timeline.Match.Status "active")}}<span>📋 <a href="care-plan?email={{.UserEmail}}&patient={{.Timeline.Match.PatientEmail}}">Care plan</a> · 📓 <a href="journal?email={{.UserEmail}}&patient={{.Timeline.Match.PatientEmail}}">Care journal</a></span>{{end}}
+            {{if .RelayNumber}}<span>📞 Call or text the other party at {{.RelayNumber}}; your own number stays private</span>{{end}}
+        </div>
+        <h3>Timeline</h3>
+        <div class="calendar">
+            {{range .Timeline.Events}}
+            <div class="calendar-event">
+                <span>{{.CreatedAt.Format "Mon Jan 2 2006 3:04 PM"}}</span><br>
+                <span>{{if .FromStatus}}{{.FromStatus}} → {{end}}<strong>{{.ToStatus}}</strong> by {{.Actor}}</span>
+            </div>
+            {{end}}
+        </div>
+        {{if ne .Timeline.Match.Status "ended"}}
+        {{with .RateOffer}}<div class="match-details">
+            <span>{{if eq .OfferedBy $.UserEmail}}You offered{{else}}{{.OfferedBy}} offered{{end}} ${{printf "%.2f" .Rate}}/hour on {{.CreatedAt.Format "Jan 2"}}{{if .Note}}: {{.Note}}{{end}}</span>
+        </div>
+        {{if ne .OfferedBy $.UserEmail}}
+        <form class="schedule-form" action="match/rate" method="POST">
+            <input type="hidden" name="email" value="{{$.UserEmail}}">
+            <input type="hidden" name="caregiver_email" value="{{$.Timeline.Match.CaregiverEmail}}">
+            <input type="hidden" name="patient_email" value="{{$.Timeline.Match.PatientEmail}}">
+            <button type="submit" name="action" value="accept">Accept ${{printf "%.2f" .Rate}}/hour</button>
+            <button type="submit" name="action" value="decline">Decline</button>
+        </form>
+        {{end}}{{end}}
+        <form class="schedule-form" action="match/rate" method="POST">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="hidden" name="caregiver_email" value="{{.Timeline.Match.CaregiverEmail}}">
+            <input type="hidden" name="patient_email" value="{{.Timeline.Match.PatientEmail}}">
+            <input type="number" name="rate" min="1" step="0.01" placeholder="$/hour" required aria-label="Hourly rate">
+            <input type="text" name="note" placeholder="Note (optional)">
+            <button type="submit" name="action" value="offer">{{if .RateOffer}}{{if ne .RateOffer.OfferedBy .UserEmail}}Counter{{else}}Change offer{{end}}{{else}}Offer a rate{{end}}</button>
+        </form>
+        {{end}}
+        {{if .NextStatuses}}
+        <form class="schedule-form" action="match/status" method="POST">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="hidden" name="caregiver_email" value="{{.Timeline.Match.CaregiverEmail}}">
+            <input type="hidden" name="patient_email" value="{{.Timeline.Match.PatientEmail}}">
+            <select name="status" required>
+                {{range .NextStatuses}}<option value="{{.}}">{{.}}</option>{{end}}
+            </select>
+            <button type="submit">Update Status</button>
+        </form>
+        {{end}}
+        {{if or .Shifts (eq .Timeline.Match.Status "active")}}
+        <h3>Shifts</h3>
+        {{with .Week}}<div class="match-details">
+            <span>This week: {{.Shifts}} shift{{if ne .Shifts 1}}s{{end}}, {{formatMinutes .ConfirmedMinutes}} confirmed (${{printf "%.2f" .ConfirmedAmount}} at ${{printf "%.2f" .Rate}}/hour){{if .PendingMinutes}}, {{formatMinutes .PendingMinutes}} waiting{{end}}{{if .DisputedMinutes}}, {{formatMinutes .DisputedMinutes}} disputed{{end}}</span>
+        </div>{{end}}
+        <div class="calendar">
+            {{range .Shifts}}
+            <div class="calendar-event">
+                <span>{{.StartedAt.Format "Mon Jan 2 3:04 PM"}}{{if eq .Status "open"}}, under way{{else}} – {{.EndedAt.Format "3:04 PM"}} ({{.Duration}}){{end}}</span><br>
+                <span><strong>{{.Status}}</strong>{{if eq .Source "log"}}, logged afterwards{{end}}{{if .Note}}: {{.Note}}{{end}}{{if .DisputeReason}} · {{.DisputeReason}}{{end}}</span>
+                {{if and $.IsPatient (eq .Status "pending")}}
+                <form action="match/shifts" method="POST">
+                    <input type="hidden" name="email" value="{{$.UserEmail}}">
+                    <input type="hidden" name="caregiver_email" value="{{$.Timeline.Match.CaregiverEmail}}">
+                    <input type="hidden" name="patient_email" value="{{$.Timeline.Match.PatientEmail}}">
+                    <input type="hidden" name="id" value="{{.ID}}">
+                    <button type="submit" name="action" value="confirm">Confirm</button>
+                    <input type="text" name="reason" placeholder="What's wrong?">
+                    <button type="submit" name="action" value="dispute">Dispute</button>
+                </form>
+                {{end}}
+            </div>
+            {{end}}
+        </div>
+        {{if and .IsCaregiver (eq .Timeline.Match.Status "active")}}
+        <form class="schedule-form" action="match/shifts" method="POST">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="hidden" name="caregiver_email" value="{{.Timeline.Match.CaregiverEmail}}">
+            <input type="hidden" name="patient_email" value="{{.Timeline.Match.PatientEmail}}">
+            {{if .OpenShift}}
+            <button type="submit" name="action" value="clock_out">Clock out (in since {{.OpenShift.StartedAt.Format "3:04 PM"}})</button>
+            {{else}}
+            <input type="text" name="note" placeholder="Note (optional)">
+            <button type="submit" name="action" value="clock_in">Clock in</button>
+            {{end}}
+        </form>
+        <form class="schedule-form" action="match/shifts" method="POST">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="hidden" name="caregiver_email" value="{{.Timeline.Match.CaregiverEmail}}">
+            <input type="hidden" name="patient_email" value="{{.Timeline.Match.PatientEmail}}">
+            <input type="datetime-local" name="start" required>
+            <input type="datetime-local" name="end" required>
+            <input type="text" name="note" placeholder="Note (optional)">
+            <button type="submit" name="action" value="log">Log a shift</button>
+        </form>
+        {{end}}
+        {{range .Timesheets}}<div>Week of {{.WeekStart.Format "Jan 2"}}: {{formatMinutes .ConfirmedMinutes}} confirmed over {{.Shifts}} shift{{if ne .Shifts 1}}s{{end}}{{if .DisputedMinutes}}, {{formatMinutes .DisputedMinutes}} disputed{{end}}</div>{{end}}
+        {{if .Invoices}}<h3>Invoices</h3>
+        {{range .Invoices}}<div><a href="invoice?email={{$.UserEmail}}&id={{.ID}}">{{.Number}}</a>: {{.PeriodStart.Format "January 2006"}}, {{.Hours}}, ${{printf "%.2f" .Amount}} ({{.Status}})</div>{{end}}
+        {{end}}
+        {{end}}
+        <p><a href="./?email={{.UserEmail}}">Back to chat</a></p>
+    </div>
+</body>
+</html>
+`
+
+// handleMatchDetail renders a match with its status timeline
+func handleMatchDetail(w http.ResponseWriter, r *http.Request) {
+	timeline, status, err := loadMatchTimeline(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// The last four weeks of shifts, and the current week's totals
+	m := timeline.Match
+	from := weekStart(time.Now()).AddDate(0, 0, -21)
+	shifts, err := chatRoom.Shifts(m.CaregiverEmail, m.PatientEmail, from, time.Now().Add(24*time.Hour))
+	if err != nil {
+		log.Printf("Error loading shifts: %v", err)
+	}
+	week, err := chatRoom.BuildTimesheet(m.CaregiverEmail, m.PatientEmail, time.Now())
+	if err != nil {
+		log.Printf("Error totalling shifts: %v", err)
+	}
+	timesheets, err := chatRoom.Timesheets(m.CaregiverEmail, m.PatientEmail)
+	if err != nil {
+		log.Printf("Error loading timesheets: %v", err)
+	}
+	invoices, err := chatRoom.Invoices(m.CaregiverEmail, m.PatientEmail)
+	if err != nil {
+		log.Printf("Error loading invoices: %v", err)
+	}
+	offer, err := chatRoom.PendingRateOffer(m.CaregiverEmail, m.PatientEmail)
+	if err != nil {
+		log.Printf("Error loading rate offer: %v", err)
+	}
+	var open *Shift
+	if s, err := chatRoom.OpenShift(m.CaregiverEmail); err == nil && s != nil && s.PatientEmail == m.PatientEmail {
+		open = s
+	}
+
+	email := r.FormValue("email")
+	renderTemplate(w, "match", matchDetailTemplate, struct {
+		Timeline     *MatchTimeline
+		UserEmail    string
+		NextStatuses []string
+		RelayNumber  string
+		IsCaregiver  bool
+		IsPatient    bool
+		Shifts       []Shift
+		OpenShift    *Shift
+		Week         *Timesheet
+		Timesheets   []Timesheet
+		Invoices     []Invoice
+		RateOffer    *RateOffer
+	}{
+		Timeline:     timeline,
+		UserEmail:    email,
+		NextStatuses: matchTransitions[m.Status],
+		RelayNumber:  chatRoom.relayNumberFor(m.CaregiverEmail, m.PatientEmail, email),
+		IsCaregiver:  email == m.CaregiverEmail,
+		IsPatient:    email == m.PatientEmail,
+		Shifts:       shifts,
+		OpenShift:    open,
+		Week:         week,
+		Timesheets:   timesheets,
+		Invoices:     invoices,
+		RateOffer:    offer,
+	})
+}
+
+// handleMatchStatus applies a status transition posted from the match detail view
+func handleMatchStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email := r.FormValue("email")
+	caregiverEmail := r.FormValue("caregiver_email")
+	patientEmail := r.FormValue("patient_email")
+	if email != caregiverEmail && email != patientEmail {
+		http.Error(w, "not a party to this match", http.StatusForbidden)
+		return
+	}
+
+	if err := chatRoom.TransitionMatch(caregiverEmail, patientEmail, r.FormValue("status"), email); err != nil {
+		log.Printf("Error updating match status: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to update match: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("../match?email=%s&caregiver_email=%s&patient_email=%s",
+		url.QueryEscape(email), url.QueryEscape(caregiverEmail), url.QueryEscape(patientEmail)),
+		http.StatusSeeOther)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// explainMatch lists the reasons a caregiver fits a patient, in the order
+// users tend to care about them: price, place, then what the caregiver does.
+// sameLocation says whether their location keys match.
+func explainMatch(p *Patient, c *Caregiver, skills []string, sameLocation bool) []string {
+	var reasons []string
+
+	switch diff := p.Budget - c.RateExpectations; {
+	case diff > 0:
+		reasons = append(reasons, fmt.Sprintf("Rate is $%.2f/hour under budget", diff))
+	case diff == 0:
+		reasons = append(reasons, "Rate matches budget exactly")
+	}
+
+	if sameLocation {
+		reasons = append(reasons, fmt.Sprintf("Both in %s", strings.TrimSpace(c.Location)))
+	}
+
+	if overlap := overlappingSkills(p, c, skills); len(overlap) > 0 {
+		noun := "skill"
+		if len(overlap) > 1 {
+			noun = "skills"
+		}
+		reasons = append(reasons, fmt.Sprintf("%d overlapping %s: %s", len(overlap), noun, strings.Join(overlap, ", ")))
+	}
+
+	return reasons
+}
+
+// overlappingSkills returns the caregiver's skills and specializations that
+// the patient's care needs or special requirements mention
+func overlappingSkills(p *Patient, c *Caregiver, skills []string) []string {
+	needs := strings.ToLower(p.CareNeeds + " " + p.SpecialRequirements)
+	terms := append([]string(nil), skills...)
+	terms = append(terms, strings.Split(c.Specializations, ",")...)
+
+	seen := make(map[string]bool)
+	var overlap []string
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		key := strings.ToLower(term)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if strings.Contains(needs, key) {
+			overlap = append(overlap, term)
+		}
+	}
+	return overlap
+}
+
+// formatMatchReasons renders reasons for a match card
+func formatMatchReasons(reasons []string) string {
+	if len(reasons) == 0 {
+		return ""
+	}
+	escaped := make([]string, len(reasons))
+	for i, r := range reasons {
+		escaped[i] = template.HTMLEscapeString(r)
+	}
+	return fmt.Sprintf("<span>✅ Why: %s</span><br>", strings.Join(escaped, "; "))
+}
+
+// keepTagged filters match results to the users carrying every one of tags
+func keepTagged(emails []string, tags []string) map[string]bool {
+	keep := make(map[string]bool)
+	if len(tags) == 0 {
+		for _, email := range emails {
+			keep[email] = true
+		}
+		return keep
+	}
+	filtered, err := chatRoom.filterByTags(emails, tags)
+	if err != nil {
+		log.Printf("Error filtering matches by tag: %v", err)
+	}
+	for _, email := range filtered {
+		keep[email] = true
+	}
+	return keep
+}
+
+// handleMatches returns the user's current matches, with reasons, as JSON.
+// Repeated tag parameters keep only matches carrying all of those tags.
+func handleMatches(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	tags := r.URL.Query()["tag"]
+	var matches interface{}
+	var err error
+	if chatRoom.IsCaregiver(email) {
+		var patients, tagged []Patient
+		patients, err = chatRoom.FindMatchingPatients(email)
+		emails := make([]string, len(patients))
+		for i := range patients {
+			chatRoom.maskPatientContact(email, &patients[i])
+			emails[i] = patients[i].Email
+		}
+		keep := keepTagged(emails, tags)
+		for _, p := range patients {
+			if keep[p.Email] {
+				tagged = append(tagged, p)
+			}
+		}
+		matches = tagged
+	} else {
+		var caregivers, tagged []Caregiver
+		caregivers, err = chatRoom.FindMatchingCaregivers(email)
+		emails := make([]string, len(caregivers))
+		for i, c := range caregivers {
+			emails[i] = c.Email
+		}
+		keep := keepTagged(emails, tags)
+		for _, c := range caregivers {
+			if keep[c.Email] {
+				tagged = append(tagged, c)
+			}
+		}
+		matches = tagged
+	}
+	if err == errConsentRequired {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Error finding matches for %s: %v", email, err)
+		http.Error(w, fmt.Sprintf("Failed to find matches: %v", err), http.StatusNotFound)
+		return
+	}
+	writeJSONCached(w, r, matches, time.Time{})
+}
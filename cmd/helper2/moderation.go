@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Direct messages are checked before they're delivered, for profanity,
+// solicitation (taking payment off the platform, or asking for sex) and
+// personal details nobody should send in a chat, like a social security or
+// card number. Each kind of problem has an action: warn delivers the
+// message and tells the sender, hold keeps it for an admin to approve or
+// reject, and block turns it away. Warned, blocked and rejected messages
+// give the sender a strike, and once they have moderation.strike_limit of
+// them everything they send is held.
+
+const moderationSchema = `
+	CREATE TABLE IF NOT EXISTS moderated_messages (
+		id TEXT PRIMARY KEY,
+		sender TEXT,
+		recipient TEXT,
+		content TEXT,
+		categories TEXT,
+		action TEXT,
+		status TEXT,
+		created_at TIMESTAMP,
+		reviewed_by TEXT,
+		reviewed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_moderated_messages_status ON moderated_messages(status);
+
+	CREATE TABLE IF NOT EXISTS moderation_strikes (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		message_id TEXT,
+		categories TEXT,
+		created_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_moderation_strikes_email ON moderation_strikes(email)
+`
+
+// Moderation categories. ModStrikes is the sender having too many strikes
+// rather than anything in the message.
+const (
+	ModProfanity    = "profanity"
+	ModSolicitation = "solicitation"
+	ModPII          = "pii"
+	ModStrikes      = "strikes"
+)
+
+// Moderation actions, least severe first
+const (
+	ModAllow = "allow"
+	ModWarn  = "warn"
+	ModHold  = "hold"
+	ModBlock = "block"
+)
+
+var modActionRank = map[string]int{ModAllow: 0, ModWarn: 1, ModHold: 2, ModBlock: 3}
+
+// Moderated message statuses
+const (
+	ModStatusWarned   = "warned"
+	ModStatusHeld     = "held"
+	ModStatusBlocked  = "blocked"
+	ModStatusApproved = "approved"
+	ModStatusRejected = "rejected"
+)
+
+var errMessageBlocked = errors.New("your message wasn't sent")
+
+var (
+	profanityPattern = regexp.MustCompile(`(?i)\b(fuck\w*|shit\w*|bitch\w*|asshole\w*|cunt\w*|bastard\w*|motherfuck\w*|slut\w*|whore\w*|retard\w*|dickhead\w*)\b`)
+
+	solicitationPattern = regexp.MustCompile(`(?i)\b(venmo|cash ?app|zelle|paypal|western union|moneygram|wire (me|the money|transfer)|gift ?cards?|bitcoin|crypto|pay (me )?(directly|off the app|outside the app|upfront|up front)|off the (app|platform)|sugar (daddy|baby)|escort|hook ?up|nudes?)\b`)
+
+	ssnPattern      = regexp.MustCompile(`\b\d{3}[- ]\d{2}[- ]\d{4}\b`)
+	cardPattern     = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	piiWordsPattern = regexp.MustCompile(`(?i)\b(social security (number|no)|ssn|routing number|account number|pin (number|code)|my password)\b`)
+)
+
+// luhnValid reports whether a string of digits passes the Luhn check card
+// numbers carry
+func luhnValid(digits string) bool {
+	sum, double := 0, false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// oversharesPII reports whether text holds a social security or card
+// number, or talks about sending bank or login details
+func oversharesPII(text string) bool {
+	if ssnPattern.MatchString(text) || piiWordsPattern.MatchString(text) {
+		return true
+	}
+	for _, m := range cardPattern.FindAllString(text, -1) {
+		digits := strings.NewReplacer(" ", "", "-", "").Replace(m)
+		if len(digits) >= 13 && luhnValid(digits) {
+			return true
+		}
+	}
+	return false
+}
+
+// moderationCategories lists what's wrong with a message, if anything
+func moderationCategories(text string) []string {
+	var categories []string
+	if profanityPattern.MatchString(text) {
+		categories = append(categories, ModProfanity)
+	}
+	if solicitationPattern.MatchString(text) {
+		categories = append(categories, ModSolicitation)
+	}
+	if oversharesPII(text) {
+		categories = append(categories, ModPII)
+	}
+	return categories
+}
+
+// moderationAction is the configured action for a category
+func moderationAction(category string) string {
+	action := config.Moderation.Actions[category]
+	if _, ok := modActionRank[action]; !ok {
+		return ModAllow
+	}
+	return action
+}
+
+// moderationWarnings words the warning a sender gets for each category
+var moderationWarnings = map[string]string{
+	ModProfanity:    "Please keep messages respectful.",
+	ModSolicitation: "Payments and arrangements should stay on the platform, and soliciting is against our rules.",
+	ModPII:          "For your safety, don't send social security numbers, card or bank details, or passwords in messages.",
+	ModStrikes:      "Your messages are being reviewed before delivery because earlier ones broke our rules.",
+}
+
+// moderationReason words why a message was moderated
+func moderationReason(categories []string) string {
+	var reasons []string
+	for _, c := range categories {
+		if w, ok := moderationWarnings[c]; ok {
+			reasons = append(reasons, w)
+		}
+	}
+	return strings.Join(reasons, " ")
+}
+
+// moderationNotice is what the sender is told about a message that was
+// delivered or held
+func moderationNotice(action string, categories []string) string {
+	switch action {
+	case ModHold:
+		return "Your message will be delivered once our team has reviewed it. " + moderationReason(categories)
+	case ModWarn:
+		return "Your message was sent. " + moderationReason(categories)
+	}
+	return ""
+}
+
+// Delivery is what became of a direct message: "sent" or "held". Notice,
+// when set, is something to tell the sender about it, because of the
+// moderation categories listed.
+type Delivery struct {
+	Status     string   `json:"status"`
+	Notice     string   `json:"notice,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+}
+
+// deliveryNotice rebuilds the notice for a delivery status and categories
+// passed back to the thread page
+func deliveryNotice(status, categories string) string {
+	action := ModWarn
+	if status == ModStatusHeld {
+		action = ModHold
+	}
+	return moderationNotice(action, strings.Split(categories, ","))
+}
+
+// ModeratedMessage is a direct message moderation acted on
+type ModeratedMessage struct {
+	ID         string    `json:"id"`
+	Sender     string    `json:"sender"`
+	Recipient  string    `json:"recipient"`
+	Content    string    `json:"content"`
+	Categories []string  `json:"categories"`
+	Action     string    `json:"action"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReviewedBy string    `json:"reviewed_by,omitempty"`
+	ReviewedAt time.Time `json:"reviewed_at,omitempty"`
+}
+
+// Strike is one count against a user for a message that broke the rules
+type Strike struct {
+	ID         string    `json:"id"`
+	MessageID  string    `json:"message_id"`
+	Categories []string  `json:"categories"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// moderate decides what to do with a direct message: the most severe
+// action among what's wrong with it, or hold for a sender at the strike
+// limit
+func (app *App) moderate(sender, content string) (action string, categories []string) {
+	action = ModAllow
+	for _, c := range moderationCategories(content) {
+		a := moderationAction(c)
+		if a == ModAllow {
+			continue
+		}
+		categories = append(categories, c)
+		if modActionRank[a] > modActionRank[action] {
+			action = a
+		}
+	}
+	if limit := config.Moderation.StrikeLimit; limit > 0 && modActionRank[action] < modActionRank[ModHold] {
+		if strikes, err := app.StrikeCount(sender); err != nil {
+			log.Printf("Error counting strikes for %s: %v", sender, err)
+		} else if strikes >= limit {
+			action, categories = ModHold, append(categories, ModStrikes)
+		}
+	}
+	return action, categories
+}
+
+// recordModeration stores a message moderation acted on, and a strike for
+// the sender unless it's held, which waits on the review
+func (app *App) recordModeration(sender, recipient, content, action, status string, categories []string) error {
+	id := newAttachmentID()
+	now := time.Now()
+	joined := strings.Join(categories, ",")
+	err := app.withTx(func(tx *chai.Tx) error {
+		err := tx.Exec(`
+			INSERT INTO moderated_messages (id, sender, recipient, content, categories, action, status,
+				created_at, reviewed_by, reviewed_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, '', ?)
+		`, id, sender, recipient, content, joined, action, status, now, time.Time{})
+		if err != nil {
+			return fmt.Errorf("failed to store moderated message: %v", err)
+		}
+		if status == ModStatusHeld {
+			return nil
+		}
+		return addStrike(tx, sender, id, joined, now)
+	})
+	if err != nil {
+		return err
+	}
+	if status != ModStatusHeld {
+		app.suspendForStrikes(sender)
+	}
+	return nil
+}
+
+func addStrike(tx *chai.Tx, email, messageID, categories string, at time.Time) error {
+	err := tx.Exec("INSERT INTO moderation_strikes (id, email, message_id, categories, created_at) VALUES (?, ?, ?, ?, ?)",
+		newAttachmentID(), email, messageID, categories, at)
+	if err != nil {
+		return fmt.Errorf("failed to store strike: %v", err)
+	}
+	return nil
+}
+
+// StrikeCount returns how many strikes a user has
+func (app *App) StrikeCount(email string) (int, error) {
+	strikes, err := app.Strikes(email)
+	return len(strikes), err
+}
+
+// Strikes lists a user's strikes, newest first
+func (app *App) Strikes(email string) ([]Strike, error) {
+	result, err := app.db.Query(`
+		SELECT id, message_id, categories, created_at FROM moderation_strikes
+		WHERE email = ? ORDER BY created_at DESC
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query strikes: %v", err)
+	}
+	defer result.Close()
+
+	var strikes []Strike
+	err = result.Iterate(func(r *chai.Row) error {
+		var s Strike
+		var categories string
+		if err := r.Scan(&s.ID, &s.MessageID, &categories, &s.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan strike: %v", err)
+		}
+		s.Categories = strings.Split(categories, ",")
+		strikes = append(strikes, s)
+		return nil
+	})
+	return strikes, err
+}
+
+// ClearStrikes forgives a user's strikes
+func (app *App) ClearStrikes(email string) error {
+	if err := app.db.Exec("DELETE FROM moderation_strikes WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to clear strikes: %v", err)
+	}
+	return nil
+}
+
+// ModeratedMessages lists moderated messages with a status, oldest first
+func (app *App) ModeratedMessages(status string) ([]ModeratedMessage, error) {
+	result, err := app.db.Query(`
+		SELECT id, sender, recipient, content, categories, action, status, created_at, reviewed_by, reviewed_at
+		FROM moderated_messages WHERE status = ? ORDER BY created_at
+	`, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query moderated messages: %v", err)
+	}
+	defer result.Close()
+
+	var messages []ModeratedMessage
+	err = result.Iterate(func(r *chai.Row) error {
+		var m ModeratedMessage
+		var categories string
+		if err := r.Scan(&m.ID, &m.Sender, &m.Recipient, &m.Content, &categories, &m.Action, &m.Status,
+			&m.CreatedAt, &m.ReviewedBy, &m.ReviewedAt); err != nil {
+			return fmt.Errorf("failed to scan moderated message: %v", err)
+		}
+		m.Categories = strings.Split(categories, ",")
+		messages = append(messages, m)
+		return nil
+	})
+	return messages, err
+}
+
+// ReviewHeldMessage approves a held message, delivering it, or rejects it,
+// which gives the sender a strike and tells them it wasn't delivered
+func (app *App) ReviewHeldMessage(id, reviewer string, approve bool) error {
+	held, err := app.ModeratedMessages(ModStatusHeld)
+	if err != nil {
+		return err
+	}
+	var m *ModeratedMessage
+	for i := range held {
+		if held[i].ID == id {
+			m = &held[i]
+		}
+	}
+	if m == nil {
+		return fmt.Errorf("no held message %s", id)
+	}
+
+	status := ModStatusRejected
+	if approve {
+		status = ModStatusApproved
+	}
+	now := time.Now()
+	err = app.withTx(func(tx *chai.Tx) error {
+		err := tx.Exec("UPDATE moderated_messages SET status = ?, reviewed_by = ?, reviewed_at = ? WHERE id = ?",
+			status, reviewer, now, id)
+		if err != nil {
+			return fmt.Errorf("failed to review message: %v", err)
+		}
+		if approve {
+			return nil
+		}
+		return addStrike(tx, m.Sender, id, strings.Join(m.Categories, ","), now)
+	})
+	if err != nil {
+		return err
+	}
+
+	if approve {
+		return app.AddMessageWithRecipient(m.Sender, "user", m.Content, m.Recipient)
+	}
+	app.suspendForStrikes(m.Sender)
+	return app.AddMessageWithRecipient(m.Sender, "assistant",
+		fmt.Sprintf("Your message to %s wasn't delivered because it broke our messaging rules.", m.Recipient), adminThread)
+}
+
+const adminModerationTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Held messages</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Held messages</h1>
+            <div class="app-description">Direct messages waiting for review</div>
+        </div>
+        {{range .Messages}}
+        <div class="calendar-event">
+            <strong>{{.Sender}}</strong> to <strong>{{.Recipient}}</strong> · {{.CreatedAt.Format "Jan 2 3:04 PM"}}
+            · {{range .Categories}}<span class="unread-badge">{{.}}</span> {{end}}
+            <div class="message user">{{.Content}}</div>
+            <form class="schedule-form" method="POST" action="moderation">
+                <input type="hidden" name="email" value="{{$.UserEmail}}">
+                <input type="hidden" name="id" value="{{.ID}}">
+                <button type="submit" name="decision" value="approve">Deliver</button>
+                <button type="submit" name="decision" value="reject">Reject</button>
+            </form>
+        </div>
+        {{else}}
+        <p>No messages are waiting.</p>
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// reviewDecision applies an admin's "approve" or "reject" to a held message
+func reviewDecision(r *http.Request, actor, id, decision string) error {
+	if decision != "approve" && decision != "reject" {
+		return fmt.Errorf("decision must be approve or reject")
+	}
+	if err := chatRoom.ReviewHeldMessage(id, actor, decision == "approve"); err != nil {
+		return err
+	}
+	chatRoom.Audit(r, actor, "moderation."+decision, id, "")
+	return nil
+}
+
+// handleAdminModeration shows held messages and takes review decisions
+func handleAdminModeration(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	if r.Method == "POST" {
+		if err := reviewDecision(r, admin, r.FormValue("id"), r.FormValue("decision")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "moderation?email="+url.QueryEscape(admin), http.StatusSeeOther)
+		return
+	}
+
+	held, err := chatRoom.ModeratedMessages(ModStatusHeld)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "moderation", adminModerationTemplate, struct {
+		UserEmail string
+		Messages  []ModeratedMessage
+	}{admin, held})
+}
+
+// handleModerationAPI lists moderated messages (GET, held ones unless
+// status is given) and reviews a held one from a JSON body {"id",
+// "decision": "approve"|"reject"} (POST)
+func handleModerationAPI(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		status := r.FormValue("status")
+		if status == "" {
+			status = ModStatusHeld
+		}
+		messages, err := chatRoom.ModeratedMessages(status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, messages)
+
+	case "POST":
+		var req struct {
+			ID       string `json:"id"`
+			Decision string `json:"decision"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := reviewDecision(r, actor, req.ID, req.Decision); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleStrikesAPI lists a user's strikes (GET with target) and clears
+// them (DELETE with target)
+func handleStrikesAPI(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+	target := r.FormValue("target")
+
+	switch r.Method {
+	case "GET":
+		strikes, err := chatRoom.Strikes(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, strikes)
+
+	case "DELETE":
+		if err := chatRoom.ClearStrikes(target); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		chatRoom.Audit(r, actor, "moderation.clear_strikes", target, "")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Notification kinds. Each has an email template of the same name.
+const (
+	NotifyWelcome          = "welcome"
+	NotifyNewMatch         = "new_match"
+	NotifyMatchDigest      = "match_digest"
+	NotifyMessageReceived  = "message_received"
+	NotifyBookingConfirmed = "booking_confirmed"
+	NotifySignIn           = "sign_in"
+	NotifyUrgentRequest    = "urgent_request"
+	NotifyAnnouncement     = "announcement"
+	NotifyCertExpiring     = "cert_expiring"
+	NotifyTimesheet        = "timesheet"
+	NotifyInvoice          = "invoice"
+	NotifyBookingReminder  = "booking_reminder"
+	NotifyWaitlistMatch    = "waitlist_match"
+	NotifyFavoriteChanged  = "favorite_changed"
+)
+
+// errQuietHours is returned by Notify when a notification wasn't sent
+// because the user is in their quiet hours; callers retry later
+var errQuietHours = errors.New("user is in quiet hours")
+
+// Notification is a message to a user outside the chat page. Data fills
+// in the email template for its kind; text messages and in-app alerts
+// carry the rendered subject.
+type Notification struct {
+	Email string
+	Kind  string
+	Data  map[string]interface{}
+}
+
+// smsSender sends text messages through the Twilio Messages API, from the
+// number in TWILIO_SMS_FROM
+type smsSender struct {
+	accountSID string
+	authToken  string
+	from       string
+	client     *http.Client
+}
+
+// newSMSSender returns nil if text messages are not set up
+func newSMSSender() *smsSender {
+	accountSID := os.Getenv("TWILIO_ACCOUNT_SID")
+	authToken := os.Getenv("TWILIO_AUTH_TOKEN")
+	from := os.Getenv("TWILIO_SMS_FROM")
+	if accountSID == "" || authToken == "" || from == "" {
+		return nil
+	}
+	return &smsSender{
+		accountSID: accountSID,
+		authToken:  authToken,
+		from:       from,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *smsSender) Send(to, text string) error {
+	endpoint := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", s.accountSID)
+	form := url.Values{"To": {to}, "From": {s.from}, "Body": {text}}
+	request, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	request.SetBasicAuth(s.accountSID, s.authToken)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to send text message: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("text message failed with status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// Notify delivers a notification on each channel the user has turned on.
+// Every notification outside the chat page goes through here, so this is
+// where notification preferences are enforced. During the user's quiet
+// hours nothing is sent and errQuietHours is returned.
+func (app *App) Notify(n Notification) error {
+	prefs, err := app.GetNotificationPrefs(n.Email)
+	if err != nil {
+		return err
+	}
+	if prefs.inQuietHours(time.Now()) {
+		return errQuietHours
+	}
+
+	email, err := app.renderNotification(n)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	if prefs.Email {
+		if err := app.sendEmail(n, email); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if prefs.SMS && app.sms != nil {
+		phone, err := app.PhoneNumberFor(n.Email)
+		if err == nil && phone != "" {
+			err = app.sms.Send(phone, email.Subject)
+		}
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	// Linking WhatsApp is the user's opt-in, and STOP their opt-out
+	if app.whatsapp != nil {
+		if err := app.notifyWhatsApp(n, email.Subject); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if prefs.Push {
+		app.realtime.Send(n.Email, "notification", map[string]string{
+			"kind":    n.Kind,
+			"subject": email.Subject,
+		})
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to notify %s: %s", n.Email, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// notifyLogged sends a notification in the background of some other work,
+// where a failure is only worth logging
+func (app *App) notifyLogged(n Notification) {
+	if err := app.Notify(n); err != nil && err != errQuietHours {
+		log.Printf("Error sending %s notification: %v", n.Kind, err)
+	}
+}
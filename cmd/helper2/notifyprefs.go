@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Notification frequencies
+const (
+	FrequencyDigest    = "digest"    // New matches wait for the daily digest
+	FrequencyImmediate = "immediate" // New matches are sent as they're found
+)
+
+const notificationPrefsSchema = `
+	CREATE TABLE IF NOT EXISTS notification_prefs (
+		email TEXT PRIMARY KEY,
+		email_enabled BOOLEAN,
+		sms_enabled BOOLEAN,
+		push_enabled BOOLEAN,
+		frequency TEXT,
+		quiet_start INTEGER,
+		quiet_end INTEGER,
+		unsubscribe_token TEXT,
+		updated_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_notification_prefs_token ON notification_prefs(unsubscribe_token)
+`
+
+// NotificationPrefs are a user's choices about notifications outside the
+// chat page. Quiet hours are whole hours in server time; a window such as
+// 22 to 7 wraps past midnight, and equal hours mean no quiet hours.
+type NotificationPrefs struct {
+	Email      bool   `json:"email"`
+	SMS        bool   `json:"sms"`
+	Push       bool   `json:"push"`
+	Frequency  string `json:"frequency"`
+	QuietStart int    `json:"quiet_start"`
+	QuietEnd   int    `json:"quiet_end"`
+	token      string
+}
+
+// defaultNotificationPrefs apply until a user saves their own
+func defaultNotificationPrefs() NotificationPrefs {
+	return NotificationPrefs{Email: true, Push: true, Frequency: FrequencyDigest}
+}
+
+// inQuietHours reports whether t falls in the quiet hours window
+func (p NotificationPrefs) inQuietHours(t time.Time) bool {
+	h := t.Hour()
+	switch {
+	case p.QuietStart == p.QuietEnd:
+		return false
+	case p.QuietStart < p.QuietEnd:
+		return h >= p.QuietStart && h < p.QuietEnd
+	default:
+		return h >= p.QuietStart || h < p.QuietEnd
+	}
+}
+
+func (p NotificationPrefs) validate() error {
+	if p.Frequency != FrequencyDigest && p.Frequency != FrequencyImmediate {
+		return fmt.Errorf("frequency must be %q or %q", FrequencyDigest, FrequencyImmediate)
+	}
+	if p.QuietStart < 0 || p.QuietStart > 23 || p.QuietEnd < 0 || p.QuietEnd > 23 {
+		return fmt.Errorf("quiet hours must be between 0 and 23")
+	}
+	return nil
+}
+
+func newUnsubscribeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func scanNotificationPrefs(result *chai.Result) (*NotificationPrefs, string, error) {
+	var prefs *NotificationPrefs
+	var email string
+	err := result.Iterate(func(r *chai.Row) error {
+		p := NotificationPrefs{}
+		err := r.Scan(&email, &p.Email, &p.SMS, &p.Push, &p.Frequency, &p.QuietStart, &p.QuietEnd, &p.token)
+		if err != nil {
+			return fmt.Errorf("failed to scan notification preferences: %v", err)
+		}
+		prefs = &p
+		return nil
+	})
+	return prefs, email, err
+}
+
+const notificationPrefsColumns = `email, email_enabled, sms_enabled, push_enabled, frequency,
+	quiet_start, quiet_end, unsubscribe_token`
+
+// GetNotificationPrefs returns a user's notification preferences, or the
+// defaults if they haven't saved any
+func (app *App) GetNotificationPrefs(email string) (NotificationPrefs, error) {
+	result, err := app.db.Query("SELECT "+notificationPrefsColumns+" FROM notification_prefs WHERE email = ?", email)
+	if err != nil {
+		return defaultNotificationPrefs(), fmt.Errorf("failed to query notification preferences: %v", err)
+	}
+	defer result.Close()
+
+	prefs, _, err := scanNotificationPrefs(result)
+	if err != nil || prefs == nil {
+		return defaultNotificationPrefs(), err
+	}
+	return *prefs, nil
+}
+
+// SaveNotificationPrefs stores a user's notification preferences, keeping
+// their unsubscribe token
+func (app *App) SaveNotificationPrefs(email string, p NotificationPrefs) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	existing, err := app.GetNotificationPrefs(email)
+	if err != nil {
+		return err
+	}
+	if existing.token == "" {
+		existing.token = newUnsubscribeToken()
+	}
+	err = app.db.Exec(`
+		INSERT INTO notification_prefs (`+notificationPrefsColumns+`, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, p.Email, p.SMS, p.Push, p.Frequency, p.QuietStart, p.QuietEnd, existing.token, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store notification preferences: %v", err)
+	}
+	return nil
+}
+
+// unsubscribeToken returns the token in a user's unsubscribe links, saving
+// their current preferences to create one if needed
+func (app *App) unsubscribeToken(email string) (string, error) {
+	prefs, err := app.GetNotificationPrefs(email)
+	if err != nil {
+		return "", err
+	}
+	if prefs.token != "" {
+		return prefs.token, nil
+	}
+	if err := app.SaveNotificationPrefs(email, prefs); err != nil {
+		return "", err
+	}
+	prefs, err = app.GetNotificationPrefs(email)
+	return prefs.token, err
+}
+
+// unsubscribeLink returns the one-click link that turns off a channel
+func (app *App) unsubscribeLink(email, channel string) (string, error) {
+	token, err := app.unsubscribeToken(email)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/unsubscribe?token=%s&channel=%s", config.Email.BaseURL, token, channel), nil
+}
+
+// Unsubscribe turns off a channel ("email", "sms", "push" or "all") for the
+// user a token belongs to, returning their email
+func (app *App) Unsubscribe(token, channel string) (string, error) {
+	result, err := app.db.Query("SELECT "+notificationPrefsColumns+" FROM notification_prefs WHERE unsubscribe_token = ?", token)
+	if err != nil {
+		return "", fmt.Errorf("failed to query notification preferences: %v", err)
+	}
+	defer result.Close()
+
+	prefs, email, err := scanNotificationPrefs(result)
+	if err != nil {
+		return "", err
+	}
+	if prefs == nil || token == "" {
+		return "", fmt.Errorf("unknown unsubscribe link")
+	}
+
+	switch channel {
+	case "email":
+		prefs.Email = false
+	case "sms":
+		prefs.SMS = false
+	case "push":
+		prefs.Push = false
+	case "all", "":
+		prefs.Email, prefs.SMS, prefs.Push = false, false, false
+	default:
+		return "", fmt.Errorf("unknown channel %q", channel)
+	}
+	return email, app.SaveNotificationPrefs(email, *prefs)
+}
+
+// notificationSettingsPage is the data behind the settings page
+type notificationSettingsPage struct {
+	UserEmail string
+	Prefs     NotificationPrefs
+	Hours     []int
+	Reminders []reminderChoice
+	Saved     bool
+	Error     string
+}
+
+const notificationSettingsTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Notification settings</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Notification settings</h1>
+            <div class="app-description">How {{(brand).Name}} reaches you outside the app</div>
+        </div>
+        {{if .Saved}}<div class="message system">Your settings were saved.</div>{{end}}
+        {{if .Error}}<div class="message system">{{.Error}}</div>{{end}}
+        <form method="POST" class="wizard-form">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <label><input type="checkbox" name="email_enabled"{{if .Prefs.Email}} checked{{end}}> Email</label>
+            <label><input type="checkbox" name="sms_enabled"{{if .Prefs.SMS}} checked{{end}}> Text message</label>
+            <label><input type="checkbox" name="push_enabled"{{if .Prefs.Push}} checked{{end}}> Alerts in the app</label>
+            <label>New matches
+                <select name="frequency">
+                    <option value="digest"{{if eq .Prefs.Frequency "digest"}} selected{{end}}>In a daily digest</option>
+                    <option value="immediate"{{if eq .Prefs.Frequency "immediate"}} selected{{end}}>As soon as they're found</option>
+                </select>
+            </label>
+            <label>Quiet hours from
+                <select name="quiet_start">{{range .Hours}}<option value="{{.}}"{{if eq . $.Prefs.QuietStart}} selected{{end}}>{{printf "%02d:00" .}}</option>{{end}}</select>
+                to
+                <select name="quiet_end">{{range .Hours}}<option value="{{.}}"{{if eq . $.Prefs.QuietEnd}} selected{{end}}>{{printf "%02d:00" .}}</option>{{end}}</select>
+            </label>
+            <div class="app-description">Pick the same hour twice for no quiet hours.</div>
+            <div>Remind me of a booking
+                {{range .Reminders}}<label><input type="checkbox" name="reminder" value="{{.Minutes}}"{{if .Checked}} checked{{end}}> {{.Label}} before</label>{{end}}
+            </div>
+            <button type="submit" class="send-button">Save</button>
+        </form>
+        <p><a href="../?email={{.UserEmail}}">Back to chat</a></p>
+    </div>
+    <script>
+    // In-app alerts use browser notifications when the user allows them
+    document.querySelector('[name=push_enabled]').addEventListener('change', function() {
+        if (this.checked && window.Notification) {
+            Notification.requestPermission();
+        }
+    });
+    </script>
+</body>
+</html>
+`
+
+// reminderChoice is a lead time offered on the settings page
+type reminderChoice struct {
+	Minutes int
+	Label   string
+	Checked bool
+}
+
+// reminderChoices offers the usual lead times plus any others the user
+// chose through the API, so saving the page keeps them
+func reminderChoices(leads []int) []reminderChoice {
+	checked := map[int]bool{}
+	for _, lead := range leads {
+		checked[lead] = true
+	}
+	minutes := append([]int{}, reminderLeadChoices...)
+	for _, lead := range leads {
+		if !containsInt(minutes, lead) {
+			minutes = append(minutes, lead)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(minutes)))
+	var choices []reminderChoice
+	for _, m := range minutes {
+		choices = append(choices, reminderChoice{Minutes: m, Label: describeLead(m), Checked: checked[m]})
+	}
+	return choices
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// prefsFromForm reads preferences posted from the settings page
+func prefsFromForm(r *http.Request) NotificationPrefs {
+	p := NotificationPrefs{
+		Email:     r.FormValue("email_enabled") != "",
+		SMS:       r.FormValue("sms_enabled") != "",
+		Push:      r.FormValue("push_enabled") != "",
+		Frequency: r.FormValue("frequency"),
+	}
+	p.QuietStart, _ = strconv.Atoi(r.FormValue("quiet_start"))
+	p.QuietEnd, _ = strconv.Atoi(r.FormValue("quiet_end"))
+	return p
+}
+
+// handleNotificationSettings shows the settings page on GET and saves it on POST
+func handleNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	page := notificationSettingsPage{UserEmail: email, Saved: r.FormValue("saved") != ""}
+	for h := 0; h < 24; h++ {
+		page.Hours = append(page.Hours, h)
+	}
+	if r.Method == "POST" {
+		page.Prefs = prefsFromForm(r)
+		var leads []int
+		for _, v := range r.Form["reminder"] {
+			if lead, err := strconv.Atoi(v); err == nil {
+				leads = append(leads, lead)
+			}
+		}
+		page.Reminders = reminderChoices(leads)
+		err := chatRoom.SaveNotificationPrefs(email, page.Prefs)
+		if err == nil {
+			err = chatRoom.SaveReminderLeads(email, leads)
+		}
+		if err != nil {
+			page.Error = err.Error()
+		} else {
+			http.Redirect(w, r, fmt.Sprintf("notifications?email=%s&saved=1", url.QueryEscape(email)), http.StatusSeeOther)
+			return
+		}
+	} else {
+		prefs, err := chatRoom.GetNotificationPrefs(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Prefs = prefs
+		leads, err := chatRoom.ReminderLeads(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Reminders = reminderChoices(leads)
+	}
+	renderTemplate(w, "notification-settings", notificationSettingsTemplate, page)
+}
+
+// handleNotificationPrefsAPI returns (GET) or replaces (POST with a JSON
+// body) a user's notification preferences
+func handleNotificationPrefsAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		prefs, err := chatRoom.GetNotificationPrefs(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSONCached(w, r, prefs, time.Time{})
+
+	case "POST":
+		prefs := defaultNotificationPrefs()
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.SaveNotificationPrefs(email, prefs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+const unsubscribeTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Unsubscribe</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Unsubscribe</h1>
+        </div>
+        {{if .Error}}
+        <div class="message system">{{.Error}}</div>
+        {{else if .Done}}
+        <p>You won't get {{if eq .Channel "all"}}any more notifications{{else}}notifications by {{.Channel}}{{end}} from {{(brand).Name}}.
+        You can turn them back on in your <a href="settings/notifications?email={{.Email}}">notification settings</a>.</p>
+        {{else}}
+        <form method="POST" class="message-form">
+            <input type="hidden" name="token" value="{{.Token}}">
+            <input type="hidden" name="channel" value="{{.Channel}}">
+            <button type="submit" class="send-button">Stop {{if eq .Channel "all"}}all notifications{{else}}{{.Channel}} notifications{{end}}</button>
+        </form>
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// handleUnsubscribe serves unsubscribe links. POST unsubscribes in one
+// step, which is what mail clients send for List-Unsubscribe-Post; GET asks
+// first, so link scanners that follow the link don't unsubscribe anyone.
+func handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Token, Channel, Email, Error string
+		Done                         bool
+	}{Token: r.FormValue("token"), Channel: r.FormValue("channel")}
+	if page.Channel == "" {
+		page.Channel = "all"
+	}
+	if r.Method == "POST" {
+		email, err := chatRoom.Unsubscribe(page.Token, page.Channel)
+		if err != nil {
+			page.Error = err.Error()
+		}
+		page.Email, page.Done = email, err == nil
+	}
+	renderTemplate(w, "unsubscribe", unsubscribeTemplate, page)
+}
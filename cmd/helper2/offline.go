@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var offline = flag.Bool("offline", false, "Run without credentials or network: stub OpenAI, email and text messages, and keep the database in memory")
+
+// databasePath is where the database lives; offline it's in memory
+func databasePath() string {
+	if *offline {
+		return ":memory:"
+	}
+	return dbFile
+}
+
+// goOffline points every external client at a stub. OPENAI_API_KEY is
+// cleared, so the features that need it (embeddings, recall, LLM care type
+// classification, compaction) take the same fallbacks they do without one;
+// chat turns are answered by fakeOpenAI, which also transcribes voice notes.
+func goOffline() error {
+	log.Println("Running offline: OpenAI, email and text messages are stubbed and the database is in memory")
+
+	openAICircuit.next = fakeOpenAI{}
+	for _, name := range []string{
+		"OPENAI_API_KEY",
+		"TWILIO_ACCOUNT_SID", // phone relays and text messages
+		"SENDGRID_API_KEY",
+		"SES_ACCESS_KEY_ID",
+		"TURNSTILE_SECRET_KEY",
+		"CHECKR_API_KEY",
+		"GOOGLE_CLIENT_ID",
+	} {
+		os.Unsetenv(name)
+	}
+
+	dir, err := os.MkdirTemp("", "helper2-offline")
+	if err != nil {
+		return fmt.Errorf("failed to create offline storage: %v", err)
+	}
+	config.Storage = StorageConfig{Backend: "local", Dir: dir}
+	config.Email = EmailConfig{From: config.Email.From, BaseURL: config.Email.BaseURL}
+	config.Events = EventsConfig{}
+	config.Redis = RedisConfig{}
+	return nil
+}
+
+// fakeOpenAI answers chat completions without a network. A message that
+// names something a tool can show gets that tool called, if the request
+// offers it; anything else gets a canned reply.
+type fakeOpenAI struct{}
+
+// fakeToolKeywords map words in the user's message to the tool the fake
+// calls, checked in order
+var fakeToolKeywords = []struct {
+	keyword string
+	tool    string
+}{
+	{"match", "find_matching_caregivers"},
+	{"caregivers", "list_caregivers"},
+	{"patients", "list_patients"},
+	{"profile", "get_profile_status"},
+	{"rate", "get_rate_benchmarks"},
+	{"care plan", "get_care_plan"},
+}
+
+// fakeTranscript is what every voice note says offline
+const fakeTranscript = "This is a voice note recorded offline."
+
+func (fakeOpenAI) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Path == "/v1/audio/transcriptions" {
+		return fakeResponse(r, http.StatusOK, map[string]string{"text": fakeTranscript}), nil
+	}
+	if r.URL.Path != "/v1/chat/completions" {
+		return fakeResponse(r, http.StatusNotFound, map[string]interface{}{
+			"error": map[string]string{"message": "not available offline: " + r.URL.Path},
+		}), nil
+	}
+
+	var req struct {
+		Model     string    `json:"model"`
+		Messages  []Message `json:"messages"`
+		Functions []struct {
+			Name string `json:"name"`
+		} `json:"functions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("failed to decode offline request: %v", err)
+	}
+
+	var last string
+	prompt := 0
+	for _, m := range req.Messages {
+		prompt += len(m.Content) / 4
+		if m.Role == "user" {
+			last = m.Content
+		}
+	}
+	offered := make(map[string]bool)
+	for _, f := range req.Functions {
+		offered[f.Name] = true
+	}
+
+	var choice Choice
+	choice.Message.Role = "assistant"
+	choice.FinishReason = "stop"
+	lower := strings.ToLower(last)
+	for _, k := range fakeToolKeywords {
+		if strings.Contains(lower, k.keyword) && offered[k.tool] {
+			choice.Message.FunctionCall = &FunctionCall{Name: k.tool, Arguments: json.RawMessage(`{}`)}
+			choice.FinishReason = "function_call"
+			break
+		}
+	}
+	if choice.Message.FunctionCall == nil {
+		choice.Message.Content = fmt.Sprintf("(offline) You said: %s", last)
+	}
+
+	completion := len(choice.Message.Content) / 4
+	return fakeResponse(r, http.StatusOK, ChatResponse{
+		Model:   req.Model,
+		Choices: []Choice{choice},
+		Usage:   &Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion},
+	}), nil
+}
+
+func fakeResponse(r *http.Request, status int, body interface{}) *http.Response {
+	data, _ := json.Marshal(body)
+	return &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(data)),
+		Request:    r,
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// The onboarding wizard is a form-based alternative to registering through
+// chat. Answers are saved after every step, so a user can leave and pick up
+// where they stopped.
+
+const onboardingSchema = `
+	CREATE TABLE IF NOT EXISTS onboarding_drafts (
+		email TEXT PRIMARY KEY,
+		step INTEGER,
+		data TEXT,
+		updated_at TIMESTAMP
+	)
+`
+
+// wizardField is one input on a wizard step
+type wizardField struct {
+	Name     string
+	Label    string
+	Type     string   // "text", "textarea", "number", "tel" or "select"
+	Choices  []string // For "select"
+	Required bool
+	Roles    string // "caregiver", "patient" or "both"
+	Help     string
+}
+
+// wizardStep is one page of the wizard
+type wizardStep struct {
+	Title  string
+	Fields []wizardField
+}
+
+// wizardSteps are shown in order; the custom fields are added to the
+// "More about you" step, and a review step follows the last one
+var wizardSteps = []wizardStep{
+	{Title: "What brings you here?", Fields: []wizardField{
+		{Name: "role", Label: "I am", Type: "role", Required: true, Roles: "both"},
+	}},
+	{Title: "Your profile", Fields: []wizardField{
+		{Name: "name", Label: "Full name", Type: "text", Required: true, Roles: "both"},
+		{Name: "location", Label: "Location", Type: "text", Required: true, Roles: "both", Help: "City or neighborhood"},
+		{Name: "phone_number", Label: "Phone number", Type: "tel", Roles: "caregiver",
+			Help: "Used for masked calls and texts with matched patients"},
+		{Name: "phone_number", Label: "Phone number", Type: "tel", Required: true, Roles: "patient"},
+		{Name: "experience", Label: "Experience", Type: "textarea", Roles: "caregiver", Help: "Years of experience"},
+		{Name: "certifications", Label: "Certifications", Type: "text", Roles: "caregiver", Help: "e.g. CNA, CPR"},
+		{Name: "care_needs", Label: "Care needs", Type: "textarea", Required: true, Roles: "patient"},
+	}},
+	{Title: "Availability", Fields: []wizardField{
+		{Name: "availability", Label: "When are you available?", Type: "textarea", Roles: "caregiver",
+			Help: "e.g. weekday mornings"},
+		{Name: "rate_expectations", Label: "Hourly rate ($)", Type: "number", Required: true, Roles: "caregiver"},
+		{Name: "schedule_requirements", Label: "When do you need care?", Type: "textarea", Roles: "patient"},
+		{Name: "budget", Label: "Hourly budget ($)", Type: "number", Required: true, Roles: "patient"},
+		{Name: "urgency", Label: "How soon do you need care?", Type: "select", Choices: urgencyLevels, Roles: "patient",
+			Help: "Urgent requests are sent to available caregivers nearby straight away"},
+	}},
+	{Title: "More about you", Fields: []wizardField{
+		{Name: "specializations", Label: "Specializations", Type: "text", Roles: "caregiver",
+			Help: "e.g. dementia care, mobility assistance"},
+		{Name: "skills", Label: "Skills", Type: "text", Roles: "caregiver", Help: "Separate with commas"},
+		{Name: "special_requirements", Label: "Special requirements", Type: "textarea", Roles: "patient"},
+	}},
+}
+
+// OnboardingDraft is a wizard in progress
+type OnboardingDraft struct {
+	Email     string
+	Step      int // Index into wizardSteps; len(wizardSteps) is the review
+	Data      map[string]string
+	UpdatedAt time.Time
+}
+
+func (d *OnboardingDraft) role() string {
+	return d.Data["role"]
+}
+
+// wizardFieldsFor returns the inputs a step shows for the draft's role
+func (app *App) wizardFieldsFor(step int, role string) []wizardField {
+	var fields []wizardField
+	for _, f := range wizardSteps[step].Fields {
+		if f.Roles == "both" || f.Roles == role {
+			fields = append(fields, f)
+		}
+	}
+	if step == len(wizardSteps)-1 {
+		for _, cf := range app.customFieldsFor(role) {
+			fieldType := "text"
+			if cf.Type == FieldNumber {
+				fieldType = "number"
+			}
+			help := ""
+			if cf.Type == FieldBoolean {
+				help = "yes or no"
+			} else if cf.Type == FieldChoice {
+				help = strings.Join(cf.Choices, ", ")
+			}
+			fields = append(fields, wizardField{Name: cf.Name, Label: cf.Label, Type: fieldType, Roles: role, Help: help})
+		}
+	}
+	return fields
+}
+
+// GetOnboardingDraft returns a user's wizard progress, or a fresh draft
+func (app *App) GetOnboardingDraft(email string) (*OnboardingDraft, error) {
+	draft := &OnboardingDraft{Email: email, Data: make(map[string]string)}
+	result, err := app.db.Query("SELECT step, data, updated_at FROM onboarding_drafts WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query onboarding draft: %v", err)
+	}
+	defer result.Close()
+
+	err = result.Iterate(func(r *chai.Row) error {
+		var data string
+		if err := r.Scan(&draft.Step, &data, &draft.UpdatedAt); err != nil {
+			return fmt.Errorf("failed to scan onboarding draft: %v", err)
+		}
+		return json.Unmarshal([]byte(data), &draft.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if draft.Step < 0 || draft.Step > len(wizardSteps) {
+		draft.Step = 0
+	}
+	return draft, nil
+}
+
+// SaveOnboardingDraft stores a user's wizard progress
+func (app *App) SaveOnboardingDraft(d *OnboardingDraft) error {
+	data, err := json.Marshal(d.Data)
+	if err != nil {
+		return fmt.Errorf("failed to encode onboarding draft: %v", err)
+	}
+	d.UpdatedAt = time.Now()
+	err = app.db.Exec(`
+		INSERT INTO onboarding_drafts (email, step, data, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, d.Email, d.Step, string(data), d.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save onboarding draft: %v", err)
+	}
+	return nil
+}
+
+// validateWizardStep checks the answers to one step
+func (app *App) validateWizardStep(d *OnboardingDraft) error {
+	if d.Step == 0 {
+		if r := d.role(); r != "caregiver" && r != "patient" {
+			return fmt.Errorf("please choose caregiver or patient")
+		}
+		return nil
+	}
+	custom := app.customFieldsByName(d.role())
+	for _, f := range app.wizardFieldsFor(d.Step, d.role()) {
+		value := strings.TrimSpace(d.Data[f.Name])
+		if f.Required && value == "" {
+			return fmt.Errorf("%s is required", f.Label)
+		}
+		if f.Type == "number" && value != "" {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", f.Label)
+			}
+			if (f.Name == "rate_expectations" || f.Name == "budget") && (n < minHourlyAmount || n > maxHourlyAmount) {
+				return fmt.Errorf("%s must be between $%d and $%d", f.Label, minHourlyAmount, maxHourlyAmount)
+			}
+		}
+		if f.Type == "select" && value != "" {
+			valid := false
+			for _, c := range f.Choices {
+				valid = valid || c == value
+			}
+			if !valid {
+				return fmt.Errorf("%s must be one of %s", f.Label, strings.Join(f.Choices, ", "))
+			}
+		}
+		if f.Type == "tel" && value != "" {
+			if _, err := normalizePhone(value); err != nil {
+				return err
+			}
+		}
+		if cf, ok := custom[f.Name]; ok {
+			if _, err := cf.normalize(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CompleteOnboarding writes the records a finished wizard describes, the
+// same ones the store_caregiver and store_patient tools write
+func (app *App) CompleteOnboarding(d *OnboardingDraft) error {
+	number := func(name string) float64 {
+		n, _ := strconv.ParseFloat(d.Data[name], 64)
+		return n
+	}
+
+	switch d.role() {
+	case "caregiver":
+		err := app.StoreCaregiver(&Caregiver{
+			Email:            d.Email,
+			Name:             d.Data["name"],
+			Experience:       d.Data["experience"],
+			Location:         d.Data["location"],
+			Availability:     d.Data["availability"],
+			Specializations:  d.Data["specializations"],
+			RateExpectations: number("rate_expectations"),
+			Certifications:   d.Data["certifications"],
+		})
+		if err != nil {
+			return err
+		}
+		for _, skill := range strings.Split(d.Data["skills"], ",") {
+			if skill = strings.TrimSpace(skill); skill != "" {
+				if err := app.AddSkill(d.Email, skill); err != nil {
+					return err
+				}
+			}
+		}
+		if phone := d.Data["phone_number"]; phone != "" {
+			if err := app.SetPhoneNumber(d.Email, phone); err != nil {
+				return err
+			}
+		}
+	case "patient":
+		err := app.StorePatient(&Patient{
+			Email:                d.Email,
+			Name:                 d.Data["name"],
+			CareNeeds:            d.Data["care_needs"],
+			Location:             d.Data["location"],
+			ScheduleRequirements: d.Data["schedule_requirements"],
+			Budget:               number("budget"),
+			SpecialRequirements:  d.Data["special_requirements"],
+			PhoneNumber:          d.Data["phone_number"],
+			CreatedAt:            time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		if err := app.SetUrgency(d.Email, d.Data["urgency"]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("no role chosen")
+	}
+
+	custom := make(map[string]string)
+	for name := range app.customFieldsByName(d.role()) {
+		if v, ok := d.Data[name]; ok {
+			custom[name] = v
+		}
+	}
+	if err := app.SetCustomFieldValues(d.Email, d.role(), custom); err != nil {
+		return err
+	}
+
+	if err := app.db.Exec("DELETE FROM onboarding_drafts WHERE email = ?", d.Email); err != nil {
+		return fmt.Errorf("failed to clear onboarding draft: %v", err)
+	}
+	welcome := fmt.Sprintf("Thanks %s, you're registered as a %s. Ask me to find matches whenever you're ready.",
+		d.Data["name"], d.role())
+	return app.AddMessageWithRecipient(d.Email, "assistant", welcome, adminThread)
+}
+
+// wizardInput is a field with its current answer
+type wizardInput struct {
+	wizardField
+	Value string
+}
+
+const onboardingTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Get started</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>{{.Title}}</h1>
+            <div class="app-description">Step {{.StepNumber}} of {{.StepCount}}</div>
+        </div>
+        {{if .Error}}<div class="message system">{{.Error}}</div>{{end}}
+        <form class="wizard-form" method="POST" action="onboarding">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            {{if .Review}}
+            <table class="query-results">
+                {{range .Inputs}}{{if .Value}}<tr><th>{{.Label}}</th><td>{{.Value}}</td></tr>{{end}}{{end}}
+            </table>
+            {{else}}
+            {{range .Inputs}}
+            <label>{{.Label}}{{if .Required}} *{{end}}
+                {{if eq .Type "role"}}
+                <select name="role" required>
+                    <option value=""></option>
+                    <option value="caregiver"{{if eq .Value "caregiver"}} selected{{end}}>A caregiver looking for patients</option>
+                    <option value="patient"{{if eq .Value "patient"}} selected{{end}}>Looking for care for myself or a family member</option>
+                </select>
+                {{else if eq .Type "select"}}
+                <select name="{{.Name}}"{{if .Required}} required{{end}}>
+                    <option value=""></option>
+                    {{$value := .Value}}{{range .Choices}}<option{{if eq . $value}} selected{{end}}>{{.}}</option>{{end}}
+                </select>
+                {{else if eq .Type "textarea"}}
+                <textarea name="{{.Name}}" rows="3"{{if .Required}} required{{end}}>{{.Value}}</textarea>
+                {{else}}
+                <input type="{{.Type}}"{{if eq .Type "number"}} step="0.01"{{end}} name="{{.Name}}" value="{{.Value}}"{{if .Required}} required{{end}}>
+                {{end}}
+                {{if .Help}}<small>{{.Help}}</small>{{end}}
+            </label>
+            {{end}}
+            {{end}}
+            <div class="schedule-form">
+                {{if gt .StepNumber 1}}<button type="submit" name="action" value="back" formnovalidate>Back</button>{{end}}
+                {{if .Review}}<button type="submit" name="action" value="finish">Finish</button>
+                {{else}}<button type="submit" name="action" value="next">Next</button>{{end}}
+            </div>
+        </form>
+        <p><a href="./?email={{.UserEmail}}">I'd rather just chat</a></p>
+    </div>
+</body>
+</html>
+`
+
+// handleOnboarding shows the current wizard step on GET and saves it on POST
+func handleOnboarding(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	draft, err := chatRoom.GetOnboardingDraft(email)
+	if err != nil {
+		log.Printf("Error loading onboarding draft: %v", err)
+		http.Error(w, "Failed to load your progress", http.StatusInternalServerError)
+		return
+	}
+
+	var formError string
+	if r.Method == "POST" {
+		if draft.Step < len(wizardSteps) {
+			for _, f := range chatRoom.wizardFieldsFor(draft.Step, draft.Data["role"]) {
+				if _, ok := r.PostForm[f.Name]; ok {
+					draft.Data[f.Name] = strings.TrimSpace(r.PostFormValue(f.Name))
+				}
+			}
+		}
+
+		switch r.FormValue("action") {
+		case "back":
+			if draft.Step > 0 {
+				draft.Step--
+			}
+		case "next":
+			if err := chatRoom.validateWizardStep(draft); err != nil {
+				formError = err.Error()
+			} else if draft.Step < len(wizardSteps) {
+				draft.Step++
+			}
+		case "finish":
+			if draft.Step != len(wizardSteps) {
+				formError = "Please complete every step first"
+				break
+			}
+			if err := chatRoom.CompleteOnboarding(draft); err != nil {
+				log.Printf("Error completing onboarding for %s: %v", email, err)
+				formError = "We couldn't save your profile: " + err.Error()
+				break
+			}
+			http.Redirect(w, r, "./?email="+url.QueryEscape(email), http.StatusSeeOther)
+			return
+		}
+		if err := chatRoom.SaveOnboardingDraft(draft); err != nil {
+			log.Printf("Error saving onboarding draft: %v", err)
+			http.Error(w, "Failed to save your progress", http.StatusInternalServerError)
+			return
+		}
+		if formError == "" {
+			http.Redirect(w, r, "onboarding?email="+url.QueryEscape(email), http.StatusSeeOther)
+			return
+		}
+	}
+
+	data := struct {
+		UserEmail  string
+		Title      string
+		StepNumber int
+		StepCount  int
+		Review     bool
+		Inputs     []wizardInput
+		Error      string
+	}{
+		UserEmail:  email,
+		StepNumber: draft.Step + 1,
+		StepCount:  len(wizardSteps) + 1,
+		Review:     draft.Step == len(wizardSteps),
+		Error:      formError,
+	}
+	if data.Review {
+		data.Title = "Review your answers"
+		for step := range wizardSteps {
+			for _, f := range chatRoom.wizardFieldsFor(step, draft.role()) {
+				data.Inputs = append(data.Inputs, wizardInput{f, draft.Data[f.Name]})
+			}
+		}
+	} else {
+		data.Title = wizardSteps[draft.Step].Title
+		for _, f := range chatRoom.wizardFieldsFor(draft.Step, draft.role()) {
+			data.Inputs = append(data.Inputs, wizardInput{f, draft.Data[f.Name]})
+		}
+	}
+	renderTemplate(w, "onboarding", onboardingTemplate, data)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operators hear about significant events in Slack or Discord: new
+// registrations, urgent patients, safety escalations, the OpenAI circuit
+// opening and failed jobs. Each event type goes to the webhooks its route
+// names, and a burst of the same event is posted once, with the rest
+// counted in the next post. Safety escalations are never held back.
+
+// opsMessage words an event for operators, or returns "" for events they
+// don't need to hear about
+func opsMessage(e Event) string {
+	str := func(key string) string {
+		s, _ := e.Data[key].(string)
+		return s
+	}
+	where := func() string {
+		if location := str("location"); location != "" {
+			return " in " + location
+		}
+		return ""
+	}
+	switch e.Type {
+	case EventCaregiverRegistered:
+		return "New caregiver: " + str("email") + where()
+	case EventPatientRegistered:
+		return "New patient: " + str("email") + where()
+	case EventPatientUrgent:
+		return "Urgent patient: " + str("email") + " needs care as soon as possible"
+	case EventCircuitOpened:
+		return fmt.Sprintf("OpenAI circuit opened after %v failures in a row; chat is degraded", e.Data["failures"])
+	case EventJobFailed:
+		return fmt.Sprintf("Job %s failed: %s", str("job"), str("error"))
+	case EventSafetyEscalated:
+		return fmt.Sprintf("Safety escalation %s: %s may be at risk (%s); they were sent resources and need a follow up",
+			str("id"), str("email"), riskLabel(str("category")))
+	case EventHandoffRequested:
+		if str("reason") == HandoffBySafety {
+			return str("email") + " was flagged by the safety screen and is in the live queue"
+		}
+		return str("email") + " asked to talk to a person and is in the live queue"
+	case EventUserReported:
+		return fmt.Sprintf("%s reported %s for %s; report %s is in the queue", str("reporter"), str("reported"), str("reason"), str("id"))
+	}
+	return ""
+}
+
+// opsNotifier posts events to webhooks, throttled per event type and
+// webhook
+type opsNotifier struct {
+	cfg    OpsConfig
+	client *http.Client
+
+	mu         sync.Mutex
+	lastPosted map[string]time.Time // keyed by event type and webhook name
+	suppressed map[string]int
+}
+
+func newOpsNotifier(cfg OpsConfig) *opsNotifier {
+	return &opsNotifier{
+		cfg:        cfg,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		lastPosted: make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+// routes returns the names of the webhooks an event type goes to
+func (n *opsNotifier) routes(eventType string) []string {
+	if len(n.cfg.Routes) == 0 {
+		names := make([]string, 0, len(n.cfg.Webhooks))
+		for name := range n.cfg.Webhooks {
+			names = append(names, name)
+		}
+		return names
+	}
+	if names, ok := n.cfg.Routes[eventType]; ok {
+		return names
+	}
+	return n.cfg.Routes["*"]
+}
+
+// admit reports whether an event can be posted to a webhook now, and how
+// many were held back since the last post
+func (n *opsNotifier) admit(eventType, webhook string, at time.Time) (bool, int) {
+	key := eventType + "|" + webhook
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	window := time.Duration(n.cfg.ThrottleMinutes) * time.Minute
+	if last, ok := n.lastPosted[key]; ok && at.Sub(last) < window {
+		n.suppressed[key]++
+		return false, 0
+	}
+	held := n.suppressed[key]
+	n.lastPosted[key] = at
+	delete(n.suppressed, key)
+	return true, held
+}
+
+// handle posts an event to each webhook on its route
+func (n *opsNotifier) handle(e Event) {
+	text := opsMessage(e)
+	if text == "" {
+		return
+	}
+	text = "[" + config.Branding.Name + "] " + text
+	for _, name := range n.routes(e.Type) {
+		hook, ok := n.cfg.Webhooks[name]
+		if !ok {
+			log.Printf("Ops route for %s names unknown webhook %q", e.Type, name)
+			continue
+		}
+		post, held := true, 0
+		if e.Type != EventSafetyEscalated {
+			post, held = n.admit(e.Type, name, e.OccurredAt)
+		}
+		if !post {
+			continue
+		}
+		msg := text
+		if held > 0 {
+			msg += fmt.Sprintf(" (and %d more since the last alert)", held)
+		}
+		if err := n.post(hook, msg); err != nil {
+			log.Printf("Error posting %s to ops webhook %s: %v", e.Type, name, err)
+		}
+	}
+}
+
+// post sends text to a Slack or Discord webhook
+func (n *opsNotifier) post(hook OpsWebhook, text string) error {
+	kind := hook.Kind
+	if kind == "" {
+		kind = "slack"
+		if strings.Contains(hook.URL, "discord") {
+			kind = "discord"
+		}
+	}
+	var payload map[string]string
+	switch kind {
+	case "slack":
+		payload = map[string]string{"text": text}
+	case "discord":
+		payload = map[string]string{"content": text}
+	default:
+		return fmt.Errorf("unknown webhook kind %q", kind)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %v", err)
+	}
+	resp, err := n.client.Post(hook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post to webhook: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// subscribeOps raises events for the OpenAI circuit opening and failed
+// jobs, and posts events to the configured ops webhooks
+func (app *App) subscribeOps() {
+	openAICircuit.OnOpen(func(failures int) {
+		app.events.Publish(EventCircuitOpened, map[string]interface{}{"failures": failures})
+	})
+	app.scheduler.onFailure = func(job string, err error) {
+		app.events.Publish(EventJobFailed, map[string]interface{}{"job": job, "error": err.Error()})
+	}
+
+	if len(config.Ops.Webhooks) == 0 {
+		return
+	}
+	app.events.Subscribe("*", newOpsNotifier(config.Ops).handle)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Caregivers list the ways of paying they accept and patients say how
+// they'll pay. A patient is only matched with caregivers who accept their
+// payment type. Caregivers who haven't listed any are taken to accept
+// private pay only; patients who haven't said aren't filtered.
+
+const paymentTypesSchema = `
+	CREATE TABLE IF NOT EXISTS payment_types (
+		email TEXT,
+		role TEXT,
+		types TEXT,
+		updated_at TIMESTAMP,
+		PRIMARY KEY (email, role)
+	)
+`
+
+// Payment types
+const (
+	PaymentPrivate  = "private_pay"
+	PaymentMedicaid = "medicaid"
+	PaymentMedicare = "medicare"
+	PaymentLTC      = "ltc_insurance"
+)
+
+var paymentTypes = []string{PaymentPrivate, PaymentMedicaid, PaymentMedicare, PaymentLTC}
+
+// paymentTypeAliases are other ways users and the model name payment types
+var paymentTypeAliases = map[string]string{
+	"private":                  PaymentPrivate,
+	"self_pay":                 PaymentPrivate,
+	"out_of_pocket":            PaymentPrivate,
+	"ltc":                      PaymentLTC,
+	"long_term_care":           PaymentLTC,
+	"long_term_care_insurance": PaymentLTC,
+}
+
+var paymentTypeLabels = map[string]string{
+	PaymentPrivate:  "private pay",
+	PaymentMedicaid: "Medicaid",
+	PaymentMedicare: "Medicare",
+	PaymentLTC:      "long-term care insurance",
+}
+
+// normalizePaymentType maps a payment type as written to one of
+// paymentTypes
+func normalizePaymentType(s string) (string, error) {
+	key := strings.ToLower(strings.TrimSpace(s))
+	key = strings.NewReplacer(" ", "_", "-", "_").Replace(key)
+	if alias, ok := paymentTypeAliases[key]; ok {
+		key = alias
+	}
+	for _, t := range paymentTypes {
+		if t == key {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("payment type must be one of %s", strings.Join(paymentTypes, ", "))
+}
+
+// paymentTypesArg reads a list of payment types from a tool argument,
+// given as an array or a comma-separated string
+func paymentTypesArg(args map[string]interface{}, key string) ([]string, error) {
+	var raw []string
+	switch v := args[key].(type) {
+	case []interface{}:
+		for _, item := range v {
+			raw = append(raw, splitList(fmt.Sprint(item))...)
+		}
+	case string:
+		raw = splitList(v)
+	}
+	var types []string
+	seen := map[string]bool{}
+	for _, s := range raw {
+		t, err := normalizePaymentType(s)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+// storePaymentTypeArgs stores the payment types in a store tool call, if
+// it has any
+func (app *App) storePaymentTypeArgs(email, role string, args map[string]interface{}) error {
+	key := "payment_types"
+	if role == "patient" {
+		key = "payment_type"
+	}
+	types, err := paymentTypesArg(args, key)
+	if err != nil || len(types) == 0 {
+		return err
+	}
+	return app.SetPaymentTypes(email, role, types)
+}
+
+// formatPaymentTypes lists payment types for people to read
+func formatPaymentTypes(types []string) string {
+	labels := make([]string, len(types))
+	for i, t := range types {
+		labels[i] = paymentTypeLabels[t]
+	}
+	return strings.Join(labels, ", ")
+}
+
+// SetPaymentTypes stores the payment types a caregiver accepts, or the one
+// a patient pays with. Nil leaves them as they were.
+func (app *App) SetPaymentTypes(email, role string, types []string) error {
+	if types == nil {
+		return nil
+	}
+	if role == "patient" && len(types) > 1 {
+		return fmt.Errorf("a patient has one payment type")
+	}
+	err := app.db.Exec(`
+		INSERT INTO payment_types (email, role, types, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, role, strings.Join(types, ","), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store payment types: %v", err)
+	}
+	app.invalidateToolCaches()
+	return nil
+}
+
+// GetPaymentTypes returns a user's payment types for a role
+func (app *App) GetPaymentTypes(email, role string) ([]string, error) {
+	result, err := app.db.Query("SELECT types FROM payment_types WHERE email = ? AND role = ?", email, role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query payment types: %v", err)
+	}
+	defer result.Close()
+
+	var types []string
+	err = result.Iterate(func(r *chai.Row) error {
+		var s string
+		if err := r.Scan(&s); err != nil {
+			return fmt.Errorf("failed to scan payment types: %v", err)
+		}
+		types = splitList(s)
+		return nil
+	})
+	return types, err
+}
+
+// paymentTypesByEmail returns everyone's payment types for a role
+func (app *App) paymentTypesByEmail(role string) (map[string][]string, error) {
+	result, err := app.db.Query("SELECT email, types FROM payment_types WHERE role = ?", role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query payment types: %v", err)
+	}
+	defer result.Close()
+
+	byEmail := map[string][]string{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var email, s string
+		if err := r.Scan(&email, &s); err != nil {
+			return fmt.Errorf("failed to scan payment types: %v", err)
+		}
+		byEmail[email] = splitList(s)
+		return nil
+	})
+	return byEmail, err
+}
+
+// acceptsPayment reports whether a caregiver accepting accepted can take a
+// patient paying with required
+func acceptsPayment(accepted []string, required string) bool {
+	if required == "" {
+		return true
+	}
+	if len(accepted) == 0 {
+		return required == PaymentPrivate
+	}
+	for _, t := range accepted {
+		if t == required {
+			return true
+		}
+	}
+	return false
+}
+
+// patientPaymentType returns how a patient pays, "" if they haven't said
+func (app *App) patientPaymentType(email string) string {
+	types, err := app.GetPaymentTypes(email, "patient")
+	if err != nil {
+		log.Printf("Error loading payment type for %s: %v", email, err)
+	}
+	if len(types) == 0 {
+		return ""
+	}
+	return types[0]
+}
+
+// filterCaregiversByPayment drops caregivers who don't accept the patient's
+// payment type
+func (app *App) filterCaregiversByPayment(patientEmail string, caregivers []Caregiver) ([]Caregiver, error) {
+	required := app.patientPaymentType(patientEmail)
+	if required == "" {
+		return caregivers, nil
+	}
+	accepted, err := app.paymentTypesByEmail("caregiver")
+	if err != nil {
+		return nil, err
+	}
+	kept := caregivers[:0]
+	for _, c := range caregivers {
+		if acceptsPayment(accepted[c.Email], required) {
+			c.MatchReasons = append(c.MatchReasons, "Accepts "+paymentTypeLabels[required])
+			kept = append(kept, c)
+		}
+	}
+	return kept, nil
+}
+
+// filterPatientsByPayment drops patients whose payment type the caregiver
+// doesn't accept
+func (app *App) filterPatientsByPayment(caregiverEmail string, patients []Patient) ([]Patient, error) {
+	accepted, err := app.GetPaymentTypes(caregiverEmail, "caregiver")
+	if err != nil {
+		return nil, err
+	}
+	required, err := app.paymentTypesByEmail("patient")
+	if err != nil {
+		return nil, err
+	}
+	kept := patients[:0]
+	for _, p := range patients {
+		var t string
+		if len(required[p.Email]) > 0 {
+			t = required[p.Email][0]
+		}
+		if acceptsPayment(accepted, t) {
+			kept = append(kept, p)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Phone numbers are stored in E.164 form. A user can prove a number is
+// theirs by texting back a code; the proof holds only while the number
+// stays the same.
+
+const phoneVerificationSchema = `
+	CREATE TABLE IF NOT EXISTS phone_verification_codes (
+		email TEXT PRIMARY KEY,
+		phone_number TEXT,
+		code_hash TEXT,
+		attempts INTEGER,
+		sent_at TIMESTAMP,
+		expires_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS phone_verifications (
+		email TEXT PRIMARY KEY,
+		phone_number TEXT,
+		phone_verified_at TIMESTAMP
+	)
+`
+
+const (
+	phoneCodeTTL         = 10 * time.Minute
+	phoneCodeResendAfter = time.Minute
+	phoneCodeMaxAttempts = 5
+)
+
+// phoneRegion is how numbers are dialled within a country: its calling
+// code, the trunk prefix dropped when dialling from abroad, the prefix for
+// dialling out, and the lengths of national numbers without the trunk
+// prefix
+type phoneRegion struct {
+	CallingCode   string
+	TrunkPrefix   string
+	International string
+	Lengths       []int
+}
+
+// phoneRegions are the regions a deployment can set as its default, by
+// ISO 3166 code
+var phoneRegions = map[string]phoneRegion{
+	"US": {"1", "1", "011", []int{10}},
+	"CA": {"1", "1", "011", []int{10}},
+	"GB": {"44", "0", "00", []int{9, 10}},
+	"IE": {"353", "0", "00", []int{7, 8, 9}},
+	"AU": {"61", "0", "0011", []int{9}},
+	"NZ": {"64", "0", "00", []int{8, 9, 10}},
+	"DE": {"49", "0", "00", []int{6, 7, 8, 9, 10, 11}},
+	"FR": {"33", "0", "00", []int{9}},
+	"ES": {"34", "", "00", []int{9}},
+	"IT": {"39", "", "00", []int{6, 7, 8, 9, 10, 11}},
+	"MX": {"52", "", "00", []int{10}},
+	"IN": {"91", "0", "00", []int{10}},
+}
+
+// defaultPhoneRegion is the region numbers without a + are read in
+func defaultPhoneRegion() phoneRegion {
+	if region, ok := phoneRegions[strings.ToUpper(config.Phone.DefaultRegion)]; ok {
+		return region
+	}
+	return phoneRegions["US"]
+}
+
+// normalizePhone returns a phone number in E.164 form (+ and 8 to 15
+// digits). Spaces, dots, dashes, slashes and parentheses are dropped. A
+// number with a leading + or the default region's international prefix is
+// taken as international; anything else is a national number in the
+// default region, with or without its trunk prefix.
+func normalizePhone(s string) (string, error) {
+	var digits strings.Builder
+	plus := false
+	for i, r := range strings.TrimSpace(s) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			plus = true
+		case strings.ContainsRune(" -./()", r):
+		default:
+			return "", fmt.Errorf("%q is not a valid phone number", s)
+		}
+	}
+
+	number := digits.String()
+	if !plus {
+		region := defaultPhoneRegion()
+		switch {
+		case strings.HasPrefix(number, region.International):
+			number = strings.TrimPrefix(number, region.International)
+		case region.nationalLength(number):
+			number = region.CallingCode + number
+		case region.TrunkPrefix != "" && strings.HasPrefix(number, region.TrunkPrefix) &&
+			region.nationalLength(strings.TrimPrefix(number, region.TrunkPrefix)):
+			number = region.CallingCode + strings.TrimPrefix(number, region.TrunkPrefix)
+		default:
+			return "", fmt.Errorf("%q is not a valid phone number; include the country code, e.g. +44", s)
+		}
+	}
+	if len(number) < 8 || len(number) > 15 || number[0] == '0' {
+		return "", fmt.Errorf("%q is not a valid phone number", s)
+	}
+	return "+" + number, nil
+}
+
+func (p phoneRegion) nationalLength(number string) bool {
+	for _, n := range p.Lengths {
+		if len(number) == n {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeStoredPhones rewrites phone numbers stored before numbers were
+// normalized. Ones that can't be parsed are left alone and logged.
+func normalizeStoredPhones(db *instrumentedDB) error {
+	for _, t := range []struct{ table, column string }{
+		{"user_phones", "phone_number"},
+		{"patients", "phone_number"},
+	} {
+		result, err := db.Query(fmt.Sprintf("SELECT email, %s FROM %s", t.column, t.table))
+		if err != nil {
+			return fmt.Errorf("failed to query %s: %v", t.table, err)
+		}
+		changed := make(map[string]string)
+		err = result.Iterate(func(r *chai.Row) error {
+			var email, phone string
+			if err := r.Scan(&email, &phone); err != nil {
+				return fmt.Errorf("failed to scan %s: %v", t.table, err)
+			}
+			if phone == "" {
+				return nil
+			}
+			normalized, err := normalizePhone(phone)
+			if err != nil {
+				log.Printf("Leaving phone number for %s in %s as is: %v", email, t.table, err)
+				return nil
+			}
+			if normalized != phone {
+				changed[email] = normalized
+			}
+			return nil
+		})
+		result.Close()
+		if err != nil {
+			return err
+		}
+		for email, phone := range changed {
+			err := db.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE email = ?", t.table, t.column), phone, email)
+			if err != nil {
+				return fmt.Errorf("failed to normalize phone number in %s: %v", t.table, err)
+			}
+		}
+		if len(changed) > 0 {
+			log.Printf("Normalized %d phone numbers in %s", len(changed), t.table)
+		}
+	}
+	return nil
+}
+
+func phoneCodeHash(email, code string) string {
+	sum := sha256.Sum256([]byte(email + "\n" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// SendPhoneVerification texts the user a code that proves their current
+// phone number is theirs
+func (app *App) SendPhoneVerification(email string) error {
+	if app.sms == nil {
+		return fmt.Errorf("text messages are not set up")
+	}
+	phone, err := app.PhoneNumberFor(email)
+	if err != nil {
+		return err
+	}
+	if phone == "" {
+		return fmt.Errorf("add a phone number first")
+	}
+
+	var sentAt time.Time
+	result, err := app.db.Query("SELECT sent_at FROM phone_verification_codes WHERE email = ?", email)
+	if err != nil {
+		return fmt.Errorf("failed to query verification code: %v", err)
+	}
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&sentAt)
+	})
+	result.Close()
+	if err != nil {
+		return fmt.Errorf("failed to scan verification code: %v", err)
+	}
+	if time.Since(sentAt) < phoneCodeResendAfter {
+		return fmt.Errorf("a code was just sent; wait a minute before asking for another")
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return fmt.Errorf("failed to generate verification code: %v", err)
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	now := time.Now()
+	err = app.db.Exec(`
+		INSERT INTO phone_verification_codes (email, phone_number, code_hash, attempts, sent_at, expires_at)
+		VALUES (?, ?, ?, 0, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, phone, phoneCodeHash(email, code), now, now.Add(phoneCodeTTL))
+	if err != nil {
+		return fmt.Errorf("failed to store verification code: %v", err)
+	}
+	text := fmt.Sprintf("Your %s verification code is %s. It expires in %d minutes.",
+		config.Branding.Name, code, int(phoneCodeTTL.Minutes()))
+	return app.sms.Send(phone, text)
+}
+
+// ConfirmPhoneVerification checks a code from SendPhoneVerification and, if
+// it's right, marks the number the code was sent to as verified
+func (app *App) ConfirmPhoneVerification(email, code string) error {
+	var phone, hash string
+	var attempts int
+	var expiresAt time.Time
+	found := false
+	result, err := app.db.Query(`
+		SELECT phone_number, code_hash, attempts, expires_at
+		FROM phone_verification_codes WHERE email = ?
+	`, email)
+	if err != nil {
+		return fmt.Errorf("failed to query verification code: %v", err)
+	}
+	err = result.Iterate(func(r *chai.Row) error {
+		found = true
+		return r.Scan(&phone, &hash, &attempts, &expiresAt)
+	})
+	result.Close()
+	if err != nil {
+		return fmt.Errorf("failed to scan verification code: %v", err)
+	}
+
+	switch {
+	case !found:
+		return fmt.Errorf("no verification code is waiting; ask for a new one")
+	case time.Now().After(expiresAt):
+		return fmt.Errorf("that code has expired; ask for a new one")
+	case attempts >= phoneCodeMaxAttempts:
+		return fmt.Errorf("too many wrong codes; ask for a new one")
+	}
+	if current, err := app.PhoneNumberFor(email); err != nil {
+		return err
+	} else if current != phone {
+		return fmt.Errorf("your phone number has changed since the code was sent; ask for a new one")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(phoneCodeHash(email, strings.TrimSpace(code)))) != 1 {
+		err := app.db.Exec("UPDATE phone_verification_codes SET attempts = attempts + 1 WHERE email = ?", email)
+		if err != nil {
+			return fmt.Errorf("failed to record verification attempt: %v", err)
+		}
+		return fmt.Errorf("that code isn't right")
+	}
+
+	return app.withTx(func(tx *chai.Tx) error {
+		err := tx.Exec(`
+			INSERT INTO phone_verifications (email, phone_number, phone_verified_at)
+			VALUES (?, ?, ?)
+			ON CONFLICT DO REPLACE
+		`, email, phone, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to store phone verification: %v", err)
+		}
+		if err := tx.Exec("DELETE FROM phone_verification_codes WHERE email = ?", email); err != nil {
+			return fmt.Errorf("failed to clear verification code: %v", err)
+		}
+		return nil
+	})
+}
+
+// PhoneVerifiedAt returns when the user verified their current phone
+// number, or the zero time if they haven't
+func (app *App) PhoneVerifiedAt(email string) (time.Time, error) {
+	result, err := app.db.Query(`
+		SELECT phone_number, phone_verified_at FROM phone_verifications WHERE email = ?
+	`, email)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query phone verification: %v", err)
+	}
+	defer result.Close()
+
+	var phone string
+	var verifiedAt time.Time
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&phone, &verifiedAt)
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to scan phone verification: %v", err)
+	}
+	if phone == "" {
+		return time.Time{}, nil
+	}
+	current, err := app.PhoneNumberFor(email)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if current != phone {
+		return time.Time{}, nil
+	}
+	return verifiedAt, nil
+}
+
+// PhoneStatus is what the chat page shows about the user's phone number
+type PhoneStatus struct {
+	Number    string
+	Verified  bool
+	CanVerify bool   // Text messages are set up, so a code can be sent
+	WhatsApp  string // Opens a WhatsApp chat with the app, once verified
+}
+
+func (app *App) phoneStatusFor(email string) *PhoneStatus {
+	phone, err := app.PhoneNumberFor(email)
+	if err != nil {
+		log.Printf("Error loading phone number for %s: %v", email, err)
+		return nil
+	}
+	if phone == "" {
+		return nil
+	}
+	verifiedAt, err := app.PhoneVerifiedAt(email)
+	if err != nil {
+		log.Printf("Error loading phone verification for %s: %v", email, err)
+	}
+	status := &PhoneStatus{Number: phone, Verified: !verifiedAt.IsZero(), CanVerify: app.sms != nil}
+	if status.Verified && app.whatsapp != nil {
+		status.WhatsApp = app.whatsapp.chatURL()
+	}
+	return status
+}
+
+// phoneVerifiedBadge marks a match card whose person has verified their
+// phone number
+func phoneVerifiedBadge(email string) string {
+	verifiedAt, err := chatRoom.PhoneVerifiedAt(email)
+	if err != nil {
+		log.Printf("Error loading phone verification for %s: %v", email, err)
+		return ""
+	}
+	if verifiedAt.IsZero() {
+		return ""
+	}
+	return "<span class='verified'>✅ Phone verified</span><br>"
+}
+
+// handlePhoneVerify texts the user a code when posted without one, and
+// checks the code when posted with one
+func handlePhoneVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	if code := r.FormValue("code"); code == "" {
+		if err := chatRoom.SendPhoneVerification(email); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if err := chatRoom.ConfirmPhoneVerification(email, code); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "../?email="+url.QueryEscape(email), http.StatusSeeOther)
+}
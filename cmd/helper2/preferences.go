@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+const preferencesSchema = `
+	CREATE TABLE IF NOT EXISTS user_preferences (
+		email TEXT PRIMARY KEY,
+		languages TEXT,
+		gender TEXT,
+		preferred_gender TEXT,
+		has_pets TEXT,
+		pets_ok TEXT,
+		smoker TEXT,
+		smoke_free TEXT,
+		drives TEXT,
+		needs_driver TEXT,
+		hard TEXT,
+		updated_at TIMESTAMP
+	)
+`
+
+// Preference constraint names, as used in Preferences.Hard
+const (
+	PrefLanguage = "language"
+	PrefGender   = "gender"
+	PrefPets     = "pets"
+	PrefSmoking  = "smoking"
+	PrefDriving  = "driving"
+)
+
+var preferenceNames = []string{PrefLanguage, PrefGender, PrefPets, PrefSmoking, PrefDriving}
+
+// Preferences are the structured matching preferences of either side. The
+// yes/no fields are "yes", "no" or "" when the user hasn't said.
+type Preferences struct {
+	Email           string   `json:"email"`
+	Languages       []string `json:"languages,omitempty"`
+	Gender          string   `json:"gender,omitempty"`
+	PreferredGender string   `json:"preferred_gender,omitempty"` // Of the other party
+	HasPets         string   `json:"has_pets,omitempty"`         // Patient has pets at home
+	PetsOK          string   `json:"pets_ok,omitempty"`          // Caregiver is fine with pets
+	Smoker          string   `json:"smoker,omitempty"`
+	SmokeFree       string   `json:"smoke_free,omitempty"` // Wants a non-smoker
+	Drives          string   `json:"drives,omitempty"`     // Caregiver can drive
+	NeedsDriver     string   `json:"needs_driver,omitempty"`
+	// Hard lists the constraints that rule a match out when unmet; the
+	// rest only affect ranking
+	Hard      []string  `json:"hard,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// yesNo normalizes a boolean-ish answer to "yes", "no" or ""
+func yesNo(v interface{}) string {
+	switch s := strings.ToLower(strings.TrimSpace(fmt.Sprint(v))); s {
+	case "yes", "y", "true":
+		return "yes"
+	case "no", "n", "false":
+		return "no"
+	}
+	return ""
+}
+
+// GetPreferences returns a user's preferences; nothing stored gives empty ones
+func (app *App) GetPreferences(email string) (*Preferences, error) {
+	result, err := app.db.Query(`
+		SELECT languages, gender, preferred_gender, has_pets, pets_ok, smoker,
+			smoke_free, drives, needs_driver, hard, updated_at
+		FROM user_preferences
+		WHERE email = ?
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query preferences: %v", err)
+	}
+	defer result.Close()
+
+	p := &Preferences{Email: email}
+	err = result.Iterate(func(r *chai.Row) error {
+		var languages, hard string
+		if err := r.Scan(&languages, &p.Gender, &p.PreferredGender, &p.HasPets, &p.PetsOK, &p.Smoker,
+			&p.SmokeFree, &p.Drives, &p.NeedsDriver, &hard, &p.UpdatedAt); err != nil {
+			return fmt.Errorf("failed to scan preferences: %v", err)
+		}
+		p.Languages = splitList(languages)
+		p.Hard = splitList(hard)
+		return nil
+	})
+	return p, err
+}
+
+// SavePreferences stores a user's preferences, replacing what was there
+func (app *App) SavePreferences(p *Preferences) error {
+	for _, h := range p.Hard {
+		known := false
+		for _, name := range preferenceNames {
+			known = known || h == name
+		}
+		if !known {
+			return fmt.Errorf("unknown preference: %s", h)
+		}
+	}
+	p.UpdatedAt = time.Now()
+	err := app.db.Exec(`
+		INSERT INTO user_preferences (
+			email, languages, gender, preferred_gender, has_pets, pets_ok, smoker,
+			smoke_free, drives, needs_driver, hard, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, p.Email, strings.Join(p.Languages, ","), p.Gender, p.PreferredGender, p.HasPets, p.PetsOK,
+		p.Smoker, p.SmokeFree, p.Drives, p.NeedsDriver, strings.Join(p.Hard, ","), p.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store preferences: %v", err)
+	}
+	app.invalidateToolCaches()
+	return nil
+}
+
+// updatePreferencesFromArgs merges the fields present in a set_preferences
+// tool call into the user's stored preferences
+func (app *App) updatePreferencesFromArgs(email string, args map[string]interface{}) (*Preferences, error) {
+	p, err := app.GetPreferences(email)
+	if err != nil {
+		return nil, err
+	}
+	switch v := args["languages"].(type) {
+	case []interface{}:
+		p.Languages = nil
+		for _, l := range v {
+			p.Languages = append(p.Languages, splitList(fmt.Sprint(l))...)
+		}
+	case string:
+		p.Languages = splitList(v)
+	}
+	text := map[string]*string{"gender": &p.Gender, "preferred_gender": &p.PreferredGender}
+	for name, field := range text {
+		if v, ok := args[name]; ok {
+			*field = strings.ToLower(strings.TrimSpace(fmt.Sprint(v)))
+			if *field == "any" {
+				*field = ""
+			}
+		}
+	}
+	flags := map[string]*string{
+		"has_pets": &p.HasPets, "pets_ok": &p.PetsOK, "smoker": &p.Smoker,
+		"smoke_free": &p.SmokeFree, "drives": &p.Drives, "needs_driver": &p.NeedsDriver,
+	}
+	for name, field := range flags {
+		if v, ok := args[name]; ok {
+			*field = yesNo(v)
+		}
+	}
+	if v, ok := args["hard_constraints"].([]interface{}); ok {
+		p.Hard = nil
+		for _, h := range v {
+			p.Hard = append(p.Hard, fmt.Sprint(h))
+		}
+	}
+	if err := app.SavePreferences(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// preferenceCheck is the outcome of one constraint between a patient and a
+// caregiver. Unknown means one side hasn't said, which never rules a match out.
+type preferenceCheck struct {
+	Name    string
+	Known   bool
+	Met     bool
+	Reason  string // Shown on the match card when met
+	HardFor bool   // The side that raised the constraint insists on it
+}
+
+func hasHard(p *Preferences, name string) bool {
+	for _, h := range p.Hard {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreferences evaluates every constraint either side has raised
+func checkPreferences(patient, caregiver *Preferences) []preferenceCheck {
+	var checks []preferenceCheck
+	flag := func(name, want, have, reason string, raisedBy *Preferences) {
+		if want != "yes" {
+			return
+		}
+		checks = append(checks, preferenceCheck{
+			Name: name, Known: have != "", Met: have == "yes", Reason: reason, HardFor: hasHard(raisedBy, name),
+		})
+	}
+
+	if len(patient.Languages) > 0 && len(caregiver.Languages) > 0 {
+		var shared []string
+		for _, a := range patient.Languages {
+			for _, b := range caregiver.Languages {
+				if strings.EqualFold(a, b) {
+					shared = append(shared, a)
+				}
+			}
+		}
+		checks = append(checks, preferenceCheck{
+			Name: PrefLanguage, Known: true, Met: len(shared) > 0,
+			Reason:  "Speaks " + strings.Join(shared, ", "),
+			HardFor: hasHard(patient, PrefLanguage) || hasHard(caregiver, PrefLanguage),
+		})
+	}
+	for _, pair := range [][2]*Preferences{{patient, caregiver}, {caregiver, patient}} {
+		wants, other := pair[0], pair[1]
+		if wants.PreferredGender != "" {
+			checks = append(checks, preferenceCheck{
+				Name: PrefGender, Known: other.Gender != "", Met: strings.EqualFold(other.Gender, wants.PreferredGender),
+				Reason: "Gender preference met", HardFor: hasHard(wants, PrefGender),
+			})
+		}
+		if wants.SmokeFree == "yes" && other.Smoker != "" {
+			checks = append(checks, preferenceCheck{
+				Name: PrefSmoking, Known: true, Met: other.Smoker == "no",
+				Reason: "Non-smoker", HardFor: hasHard(wants, PrefSmoking),
+			})
+		}
+	}
+	flag(PrefPets, patient.HasPets, caregiver.PetsOK, "Comfortable with pets", patient)
+	flag(PrefDriving, patient.NeedsDriver, caregiver.Drives, "Can drive", patient)
+	return checks
+}
+
+// preferenceScore rules a pairing out (ok false) when a hard constraint is
+// known to be unmet, and otherwise scores it: +1 per met constraint, -1 per
+// unmet one. Reasons are the met constraints.
+func preferenceScore(patient, caregiver *Preferences) (score int, reasons []string, ok bool) {
+	for _, c := range checkPreferences(patient, caregiver) {
+		switch {
+		case !c.Known:
+		case c.Met:
+			score++
+			reasons = append(reasons, c.Reason)
+		case c.HardFor:
+			return 0, nil, false
+		default:
+			score--
+		}
+	}
+	return score, reasons, true
+}
+
+// applyPreferences returns the indexes of the candidates to keep, best
+// preference score first, with the reasons for each. patientSide says
+// whether the user is the patient.
+func (app *App) applyPreferences(user string, candidates []string, patientSide bool) ([]int, map[int][]string) {
+	mine, err := app.GetPreferences(user)
+	if err != nil {
+		log.Printf("Error loading preferences for %s: %v", user, err)
+		mine = &Preferences{Email: user}
+	}
+	scores := make(map[int]int)
+	reasons := make(map[int][]string)
+	var keep []int
+	for i, email := range candidates {
+		theirs, err := app.GetPreferences(email)
+		if err != nil {
+			log.Printf("Error loading preferences for %s: %v", email, err)
+			theirs = &Preferences{Email: email}
+		}
+		patient, caregiver := mine, theirs
+		if !patientSide {
+			patient, caregiver = theirs, mine
+		}
+		score, why, ok := preferenceScore(patient, caregiver)
+		if !ok {
+			continue
+		}
+		scores[i], reasons[i] = score, why
+		keep = append(keep, i)
+	}
+	sort.SliceStable(keep, func(a, b int) bool {
+		return scores[keep[a]] > scores[keep[b]]
+	})
+	return keep, reasons
+}
+
+// rankCaregiversByPreferences drops caregivers that break one of the
+// patient's or their own hard constraints and ranks the rest by how many
+// preferences they meet
+func (app *App) rankCaregiversByPreferences(patientEmail string, caregivers []Caregiver) []Caregiver {
+	emails := make([]string, len(caregivers))
+	for i, c := range caregivers {
+		emails[i] = c.Email
+	}
+	keep, reasons := app.applyPreferences(patientEmail, emails, true)
+	ranked := make([]Caregiver, 0, len(keep))
+	for _, i := range keep {
+		c := caregivers[i]
+		c.MatchReasons = append(c.MatchReasons, reasons[i]...)
+		ranked = append(ranked, c)
+	}
+	return ranked
+}
+
+// rankPatientsByPreferences is rankCaregiversByPreferences for the caregiver side
+func (app *App) rankPatientsByPreferences(caregiverEmail string, patients []Patient) []Patient {
+	emails := make([]string, len(patients))
+	for i, p := range patients {
+		emails[i] = p.Email
+	}
+	keep, reasons := app.applyPreferences(caregiverEmail, emails, false)
+	ranked := make([]Patient, 0, len(keep))
+	for _, i := range keep {
+		p := patients[i]
+		p.MatchReasons = append(p.MatchReasons, reasons[i]...)
+		ranked = append(ranked, p)
+	}
+	return ranked
+}
+
+// formatPreferences confirms what was saved, for the assistant
+func formatPreferences(p *Preferences) string {
+	var parts []string
+	if len(p.Languages) > 0 {
+		parts = append(parts, "languages: "+strings.Join(p.Languages, ", "))
+	}
+	for _, f := range []struct{ label, value string }{
+		{"gender", p.Gender}, {"preferred gender", p.PreferredGender}, {"has pets", p.HasPets},
+		{"fine with pets", p.PetsOK}, {"smoker", p.Smoker}, {"wants a non-smoker", p.SmokeFree},
+		{"drives", p.Drives}, {"needs a driver", p.NeedsDriver},
+	} {
+		if f.value != "" {
+			parts = append(parts, f.label+": "+f.value)
+		}
+	}
+	if len(parts) == 0 {
+		return "No preferences saved."
+	}
+	saved := "Saved your preferences (" + strings.Join(parts, "; ") + ")."
+	if len(p.Hard) > 0 {
+		saved += " Must-haves: " + strings.Join(p.Hard, ", ") + "."
+	}
+	return saved
+}
+
+var setPreferencesFunction = map[string]interface{}{
+	"name":        "set_preferences",
+	"description": "Save the current user's matching preferences. Only include what the user actually said; omitted fields are left unchanged",
+	"parameters": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"languages": map[string]interface{}{
+				"type":        "array",
+				"items":       map[string]interface{}{"type": "string"},
+				"description": "Languages the user speaks",
+			},
+			"gender":           map[string]interface{}{"type": "string", "description": "The user's own gender, if they chose to say"},
+			"preferred_gender": map[string]interface{}{"type": "string", "description": "Gender the user prefers in the other party, or \"any\""},
+			"has_pets":         map[string]interface{}{"type": "boolean", "description": "Patient: there are pets in the home"},
+			"pets_ok":          map[string]interface{}{"type": "boolean", "description": "Caregiver: comfortable working around pets"},
+			"smoker":           map[string]interface{}{"type": "boolean", "description": "The user smokes"},
+			"smoke_free":       map[string]interface{}{"type": "boolean", "description": "The user wants the other party to be a non-smoker"},
+			"drives":           map[string]interface{}{"type": "boolean", "description": "Caregiver: can drive"},
+			"needs_driver":     map[string]interface{}{"type": "boolean", "description": "Patient: needs a caregiver who can drive"},
+			"hard_constraints": map[string]interface{}{
+				"type":        "array",
+				"items":       map[string]interface{}{"type": "string", "enum": preferenceNames},
+				"description": "Preferences the user said are must-haves rather than nice-to-haves",
+			},
+		},
+	},
+}
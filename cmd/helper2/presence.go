@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// onlineWindow is how recently a user must have been seen to count as online
+const onlineWindow = 2 * time.Minute
+
+// presenceWriteInterval throttles presence writes for busy users
+const presenceWriteInterval = 30 * time.Second
+
+// presenceTTL is how long Redis keeps a user's last-seen time
+const presenceTTL = 90 * 24 * time.Hour
+
+const presenceSchema = `
+	CREATE TABLE IF NOT EXISTS presence (
+		user_key TEXT PRIMARY KEY,
+		last_seen TIMESTAMP
+	)
+`
+
+// presenceStore records when users were last active, keyed by userKey so
+// presence can be looked up from match cards without revealing emails
+type presenceStore interface {
+	Touch(key string, at time.Time) error
+	LastSeen(keys []string) (map[string]time.Time, error)
+	Forget(key string) error
+}
+
+// dbPresence keeps presence in the app database
+type dbPresence struct {
+	db *instrumentedDB
+}
+
+func (p *dbPresence) Touch(key string, at time.Time) error {
+	err := p.db.Exec(`
+		INSERT INTO presence (user_key, last_seen) VALUES (?, ?)
+		ON CONFLICT DO REPLACE
+	`, key, at)
+	if err != nil {
+		return fmt.Errorf("failed to store presence: %v", err)
+	}
+	return nil
+}
+
+func (p *dbPresence) LastSeen(keys []string) (map[string]time.Time, error) {
+	seen := make(map[string]time.Time, len(keys))
+	for _, key := range keys {
+		result, err := p.db.Query("SELECT last_seen FROM presence WHERE user_key = ?", key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query presence: %v", err)
+		}
+		err = result.Iterate(func(r *chai.Row) error {
+			var t time.Time
+			if err := r.Scan(&t); err != nil {
+				return err
+			}
+			seen[key] = t
+			return nil
+		})
+		result.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan presence: %v", err)
+		}
+	}
+	return seen, nil
+}
+
+func (p *dbPresence) Forget(key string) error {
+	if err := p.db.Exec("DELETE FROM presence WHERE user_key = ?", key); err != nil {
+		return fmt.Errorf("failed to delete presence: %v", err)
+	}
+	return nil
+}
+
+// redisPresence shares presence between instances through Redis
+type redisPresence struct {
+	client *redisClient
+}
+
+func (p *redisPresence) Touch(key string, at time.Time) error {
+	_, err := p.client.Do("SET", "presence:"+key, strconv.FormatInt(at.Unix(), 10),
+		"EX", strconv.Itoa(int(presenceTTL.Seconds())))
+	return err
+}
+
+func (p *redisPresence) LastSeen(keys []string) (map[string]time.Time, error) {
+	seen := make(map[string]time.Time, len(keys))
+	if len(keys) == 0 {
+		return seen, nil
+	}
+	args := []string{"MGET"}
+	for _, key := range keys {
+		args = append(args, "presence:"+key)
+	}
+	reply, err := p.client.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]interface{})
+	for i, v := range values {
+		if s, ok := v.(string); ok && i < len(keys) {
+			if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+				seen[keys[i]] = time.Unix(unix, 0)
+			}
+		}
+	}
+	return seen, nil
+}
+
+func (p *redisPresence) Forget(key string) error {
+	_, err := p.client.Do("DEL", "presence:"+key)
+	return err
+}
+
+// presenceTracker throttles writes to the presence store
+type presenceTracker struct {
+	store   presenceStore
+	mu      sync.Mutex
+	written map[string]time.Time
+}
+
+func newPresenceTracker(db *instrumentedDB) *presenceTracker {
+	var store presenceStore = &dbPresence{db: db}
+	if config.Redis.Addr != "" {
+		store = &redisPresence{client: newRedisClient(config.Redis.Addr, config.Redis.password())}
+	}
+	return &presenceTracker{store: store, written: make(map[string]time.Time)}
+}
+
+// Seen marks a user active now
+func (t *presenceTracker) Seen(email string) {
+	if email == "" {
+		return
+	}
+	key := userKey(email)
+	now := time.Now()
+
+	t.mu.Lock()
+	if now.Sub(t.written[key]) < presenceWriteInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.written[key] = now
+	t.mu.Unlock()
+
+	if err := t.store.Touch(key, now); err != nil {
+		log.Printf("Error updating presence: %v", err)
+	}
+}
+
+// Forget drops what's known of a user's activity
+func (t *presenceTracker) Forget(email string) error {
+	key := userKey(email)
+	t.mu.Lock()
+	delete(t.written, key)
+	t.mu.Unlock()
+	return t.store.Forget(key)
+}
+
+// PresenceStatus is what match cards show about another user's activity
+type PresenceStatus struct {
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+	Label    string    `json:"label"`
+}
+
+// presenceLabel renders "Online now", "Last seen 2h ago", and so on
+func presenceLabel(lastSeen time.Time) string {
+	if lastSeen.IsZero() {
+		return ""
+	}
+	ago := time.Since(lastSeen)
+	switch {
+	case ago < onlineWindow:
+		return "Online now"
+	case ago < time.Hour:
+		return fmt.Sprintf("Last seen %dm ago", int(ago.Minutes()))
+	case ago < 48*time.Hour:
+		return fmt.Sprintf("Last seen %dh ago", int(ago.Hours()))
+	default:
+		return fmt.Sprintf("Last seen %dd ago", int(ago.Hours()/24))
+	}
+}
+
+// Status returns presence for each user key
+func (t *presenceTracker) Status(keys []string) (map[string]PresenceStatus, error) {
+	seen, err := t.store.LastSeen(keys)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]PresenceStatus, len(keys))
+	for _, key := range keys {
+		last := seen[key]
+		statuses[key] = PresenceStatus{
+			Online:   !last.IsZero() && time.Since(last) < onlineWindow,
+			LastSeen: last,
+			Label:    presenceLabel(last),
+		}
+	}
+	return statuses, nil
+}
+
+// presenceBadge is the presence line on a match card. The page script
+// refreshes it while the card is on screen.
+func presenceBadge(email string) string {
+	key := userKey(email)
+	label := ""
+	if statuses, err := chatRoom.presence.Status([]string{key}); err != nil {
+		log.Printf("Error loading presence: %v", err)
+	} else {
+		label = statuses[key].Label
+	}
+	return fmt.Sprintf("<span class='presence' data-user='%s'>%s</span><br>", key, label)
+}
+
+// handlePresenceAPI returns presence for the user keys given as id
+// parameters on GET, and records a heartbeat for email on POST
+func handlePresenceAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		keys := r.URL.Query()["id"]
+		if len(keys) > 100 {
+			keys = keys[:100]
+		}
+		statuses, err := chatRoom.presence.Status(keys)
+		if err != nil {
+			log.Printf("Error loading presence: %v", err)
+			http.Error(w, "Failed to load presence", http.StatusInternalServerError)
+			return
+		}
+		writeJSONCached(w, r, statuses, time.Time{})
+
+	case "POST":
+		email := r.FormValue("email")
+		if email == "" {
+			http.Error(w, "Email is required", http.StatusBadRequest)
+			return
+		}
+		// An admin looking at the user's page isn't the user being online
+		if impersonationFrom(r) == nil {
+			chatRoom.presence.Seen(email)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
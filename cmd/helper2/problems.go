@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/rfielding/helper2/internal/server"
+)
+
+// Problem is an error response in the RFC 7807 problem details format,
+// extended with a stable code and the request's ID
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+	// Errors lists the fields at fault when input failed validation
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// problemCodes name each status for clients to switch on; Title is the
+// standard status text
+var problemCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusBadGateway:            "upstream_failed",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+func problemCode(status int) string {
+	if code, ok := problemCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return "internal"
+	}
+	return "error"
+}
+
+// wantsProblemJSON reports whether an error for r should be JSON rather
+// than a page: API and webhook calls, and requests that ask for JSON
+func wantsProblemJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || server.IsWebhook(r.URL.Path) || server.WantsJSON(r)
+}
+
+// writeProblem sends an error with the given status and code; an empty
+// code is filled in from the status
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	if code == "" {
+		code = problemCode(status)
+	}
+	sendProblem(w, r, Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: server.RequestID(r),
+	})
+}
+
+// writeError sends err as a problem: a ValidationError as a 422 listing
+// the fields at fault, anything else as a 500
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var invalid ValidationError
+	if !errors.As(err, &invalid) {
+		writeProblem(w, r, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	sendProblem(w, r, Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(http.StatusUnprocessableEntity),
+		Status:    http.StatusUnprocessableEntity,
+		Detail:    "Some fields are invalid",
+		Instance:  r.URL.Path,
+		Code:      problemCode(http.StatusUnprocessableEntity),
+		RequestID: server.RequestID(r),
+		Errors:    invalid,
+	})
+}
+
+// sendProblem writes p as problem+json or as an error page, whichever
+// suits the request. Server errors keep their detail out of the response,
+// since it's often an internal error message; it's logged against the
+// request ID instead.
+func sendProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	status := p.Status
+	if status >= 500 {
+		log.Printf("Error serving %s %s [%s]: %d %s", r.Method, r.URL.Path, p.RequestID, status, p.Detail)
+		p.Detail = "Something went wrong on our side. Please try again; if it keeps happening, mention this request ID."
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if wantsProblemJSON(r) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(p)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	renderTemplate(w, "error", errorPageTemplate, p)
+}
+
+// problemWriter holds back plain-text error responses, the kind
+// http.Error writes, so withProblems can send them as problems instead.
+// Anything else passes straight through.
+type problemWriter struct {
+	http.ResponseWriter
+	status    int
+	capturing bool
+	body      bytes.Buffer
+}
+
+func (p *problemWriter) WriteHeader(status int) {
+	if p.status != 0 {
+		return
+	}
+	p.status = status
+	if status >= 400 && strings.HasPrefix(p.Header().Get("Content-Type"), "text/plain") {
+		p.capturing = true
+		return
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *problemWriter) Write(b []byte) (int, error) {
+	if p.status == 0 {
+		p.WriteHeader(http.StatusOK)
+	}
+	if p.capturing {
+		return p.body.Write(b)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+func (p *problemWriter) Flush() {
+	if f, ok := p.ResponseWriter.(http.Flusher); ok && !p.capturing {
+		f.Flush()
+	}
+}
+
+func (p *problemWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// withProblems turns the plain-text errors handlers write with http.Error
+// into problem+json or an error page
+func withProblems(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &problemWriter{ResponseWriter: w}
+		next.ServeHTTP(pw, r)
+		if pw.capturing {
+			writeProblem(w, r, pw.status, "", strings.TrimSpace(pw.body.String()))
+		}
+	})
+}
+
+const errorPageTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - {{.Title}}</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>{{.Title}}</h1>
+        </div>
+        <div class="message system">
+            {{if .Detail}}<p>{{.Detail}}</p>{{end}}
+            {{if .Errors}}<ul>{{range .Errors}}<li>{{.Field}}: {{.Message}}</li>{{end}}</ul>{{end}}
+            {{if .RequestID}}<p>Request ID: <code>{{.RequestID}}</code></p>{{end}}
+            <p><a href="javascript:history.back()">Go back</a> or <a href="/">return to the chat</a>.</p>
+        </div>
+    </div>
+</body>
+</html>
+`
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+var myProfileFunction = map[string]interface{}{
+	"name":        "get_my_profile",
+	"description": "Show the current user everything stored in their caregiver or patient profile, as a card, so they can check it",
+	"parameters": map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{},
+	},
+}
+
+// formatProfileCard renders what's stored about a user as a card for them
+// to check
+func (app *App) formatProfileCard(email string) (string, error) {
+	profile, err := app.GetUserProfile(email)
+	if err != nil {
+		return "", err
+	}
+	if profile.Caregiver == nil && profile.Patient == nil {
+		return "<p>You haven't set up a profile yet.</p>", nil
+	}
+
+	var sb strings.Builder
+	field := func(icon, label, value string) {
+		if value != "" {
+			sb.WriteString(fmt.Sprintf("<span>%s %s: %s</span><br>", icon, label, template.HTMLEscapeString(value)))
+		}
+	}
+	card := func(role, name string, fields func()) {
+		sb.WriteString("<div class='match-item'>")
+		sb.WriteString(avatarImg(email, name))
+		sb.WriteString("<div class='match-details'>")
+		sb.WriteString(fmt.Sprintf("<strong>%s</strong> (%s)<br>", template.HTMLEscapeString(name), role))
+		field("✉️", "Email", email)
+		fields()
+		for _, f := range app.customFieldsFor(role) {
+			field("•", f.Label, profile.CustomFields[f.Name])
+		}
+		sb.WriteString("</div></div>")
+	}
+
+	if c := profile.Caregiver; c != nil {
+		card("caregiver", c.Name, func() {
+			field("📍", "Location", c.Location)
+			field("💰", "Rate", fmt.Sprintf("$%.2f/hour", c.RateExpectations))
+			field("🕒", "Availability", c.Availability)
+			if a := profile.Availability; a != nil {
+				field("⏸️", "Matching", a.Describe())
+			}
+			field("📚", "Experience", c.Experience)
+			field("🩺", "Specializations", c.Specializations)
+			field("🎓", "Certifications", c.Certifications)
+			field("🎯", "Skills", strings.Join(profile.Skills, ", "))
+			field("💳", "Accepts", formatPaymentTypes(profile.PaymentTypes))
+		})
+	}
+	if p := profile.Patient; p != nil {
+		card("patient", p.Name, func() {
+			field("📍", "Location", p.Location)
+			field("💰", "Budget", fmt.Sprintf("$%.2f/hour", p.Budget))
+			field("🩺", "Care needs", p.CareNeeds)
+			field("🕒", "Schedule", p.ScheduleRequirements)
+			field("📝", "Special requirements", p.SpecialRequirements)
+			field("⏱️", "Urgency", profile.Urgency)
+			field("💳", "Pays with", formatPaymentTypes(profile.PaymentTypes))
+		})
+	}
+	if phone := app.phoneStatusFor(email); phone != nil {
+		verified := "not verified"
+		if phone.Verified {
+			verified = "verified"
+		}
+		sb.WriteString(fmt.Sprintf("<p>📞 %s (%s)</p>", template.HTMLEscapeString(phone.Number), verified))
+	}
+	if prefs := profile.Preferences; prefs != nil && len(prefs.Languages) > 0 {
+		sb.WriteString(fmt.Sprintf("<p>🗣️ Languages: %s</p>", template.HTMLEscapeString(strings.Join(prefs.Languages, ", "))))
+	}
+	sb.WriteString("<p><small>Something wrong? Tell me what to change, or say undo to reverse the last change.</small></p>")
+	return sb.String(), nil
+}
+
+// handleProfileAPI returns a user's profile on GET. PUT stores the
+// caregiver and/or patient record in a body shaped like the GET response;
+// invalid fields come back as a 422 problem listing each one.
+func handleProfileAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		profile, err := chatRoom.GetUserProfile(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, profile)
+
+	case "PUT":
+		var body struct {
+			Caregiver *Caregiver `json:"caregiver"`
+			Patient   *Patient   `json:"patient"`
+			Urgency   string     `json:"urgency"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if body.Caregiver == nil && body.Patient == nil {
+			http.Error(w, "A caregiver or patient record is required", http.StatusBadRequest)
+			return
+		}
+		if body.Caregiver != nil {
+			body.Caregiver.Email = email
+			if err := chatRoom.StoreCaregiver(body.Caregiver); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		if body.Patient != nil {
+			body.Patient.Email = email
+			if err := chatRoom.StorePatient(body.Patient); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			if err := chatRoom.SetUrgency(email, body.Urgency); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+const systemPromptName = "system"
+
+// defaultPrompts are served for names that have no stored version yet
+var defaultPrompts = map[string]string{
+	systemPromptName: systemPrompt,
+}
+
+// promptReloadInterval bounds how long another instance's prompt edits take
+// to show up here; edits made through this instance apply immediately
+const promptReloadInterval = 30 * time.Second
+
+const promptsSchema = `
+	CREATE TABLE IF NOT EXISTS prompts (
+		name TEXT,
+		version INTEGER,
+		body TEXT,
+		created_by TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (name, version)
+	)
+`
+
+// PromptTemplate is one saved version of a named prompt. Bodies are Go
+// text/templates rendered with PromptVars.
+type PromptTemplate struct {
+	Name      string    `json:"name"`
+	Version   int       `json:"version"`
+	Body      string    `json:"body"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PromptVars are the values available to prompt templates, e.g. {{.Role}}
+type PromptVars struct {
+	Email        string
+	Role         string
+	Profile      string
+	Organization string
+}
+
+// promptStore caches the latest version of each prompt
+type promptStore struct {
+	db       *instrumentedDB
+	mu       sync.RWMutex
+	active   map[string]PromptTemplate
+	loadedAt time.Time
+}
+
+func newPromptStore(db *instrumentedDB) *promptStore {
+	return &promptStore{db: db, active: make(map[string]PromptTemplate)}
+}
+
+func (ps *promptStore) reload() error {
+	result, err := ps.db.Query("SELECT name, version, body, created_by, created_at FROM prompts")
+	if err != nil {
+		return fmt.Errorf("failed to query prompts: %v", err)
+	}
+	defer result.Close()
+
+	active := make(map[string]PromptTemplate)
+	err = result.Iterate(func(r *chai.Row) error {
+		var p PromptTemplate
+		if err := r.Scan(&p.Name, &p.Version, &p.Body, &p.CreatedBy, &p.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan prompt: %v", err)
+		}
+		if p.Version > active[p.Name].Version {
+			active[p.Name] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	ps.active = active
+	ps.loadedAt = time.Now()
+	ps.mu.Unlock()
+	return nil
+}
+
+// Active returns the latest stored version of a prompt, reloading from the
+// database when the cache is stale
+func (ps *promptStore) Active(name string) (PromptTemplate, bool) {
+	ps.mu.RLock()
+	stale := time.Since(ps.loadedAt) > promptReloadInterval
+	ps.mu.RUnlock()
+	if stale {
+		if err := ps.reload(); err != nil {
+			log.Printf("Error reloading prompts: %v", err)
+		}
+	}
+
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	p, ok := ps.active[name]
+	return p, ok
+}
+
+// Save stores body as the next version of a prompt and makes it active
+func (ps *promptStore) Save(name, body, author string) (PromptTemplate, error) {
+	if name == "" {
+		return PromptTemplate{}, fmt.Errorf("prompt name is required")
+	}
+	if _, err := template.New(name).Parse(body); err != nil {
+		return PromptTemplate{}, fmt.Errorf("invalid prompt template: %v", err)
+	}
+	if err := ps.reload(); err != nil {
+		return PromptTemplate{}, err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p := PromptTemplate{
+		Name:      name,
+		Version:   ps.active[name].Version + 1,
+		Body:      body,
+		CreatedBy: author,
+		CreatedAt: time.Now(),
+	}
+	err := ps.db.Exec(`
+		INSERT INTO prompts (name, version, body, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, p.Name, p.Version, p.Body, p.CreatedBy, p.CreatedAt)
+	if err != nil {
+		return PromptTemplate{}, fmt.Errorf("failed to store prompt: %v", err)
+	}
+	ps.active[name] = p
+	return p, nil
+}
+
+// History returns every stored version of a prompt, newest first
+func (ps *promptStore) History(name string) ([]PromptTemplate, error) {
+	result, err := ps.db.Query(`
+		SELECT name, version, body, created_by, created_at
+		FROM prompts WHERE name = ?
+		ORDER BY version DESC
+	`, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prompt history: %v", err)
+	}
+	defer result.Close()
+
+	var versions []PromptTemplate
+	err = result.Iterate(func(r *chai.Row) error {
+		var p PromptTemplate
+		if err := r.Scan(&p.Name, &p.Version, &p.Body, &p.CreatedBy, &p.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan prompt: %v", err)
+		}
+		versions = append(versions, p)
+		return nil
+	})
+	return versions, err
+}
+
+// Names lists every prompt that has a default or a stored version
+func (ps *promptStore) Names() []string {
+	if err := ps.reload(); err != nil {
+		log.Printf("Error reloading prompts: %v", err)
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var names []string
+	for name := range defaultPrompts {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for name := range ps.active {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PromptBody returns the active body for a prompt, falling back to its default
+func (app *App) PromptBody(name string) string {
+	if p, ok := app.prompts.Active(name); ok {
+		return p.Body
+	}
+	return defaultPrompts[name]
+}
+
+// userRole returns "caregiver", "patient", or "unknown" for users who have
+// not registered yet
+func (app *App) userRole(email string) string {
+	if app.IsCaregiver(email) {
+		return "caregiver"
+	}
+	if p, err := app.GetPatient(email); err == nil && p != nil {
+		return "patient"
+	}
+	return "unknown"
+}
+
+// profileSummary is a one-paragraph description of what is stored for a user
+func (app *App) profileSummary(email string) string {
+	profile, err := app.GetUserProfile(email)
+	if err != nil {
+		log.Printf("Error loading profile summary for %s: %v", email, err)
+		return ""
+	}
+
+	var parts []string
+	if c := profile.Caregiver; c != nil {
+		parts = append(parts, fmt.Sprintf("Caregiver %s in %s, $%.2f/hour, specializations: %s, availability: %s",
+			c.Name, c.Location, c.RateExpectations, c.Specializations, c.Availability))
+	}
+	if p := profile.Patient; p != nil {
+		parts = append(parts, fmt.Sprintf("Patient %s in %s, budget $%.2f/hour, care needs: %s, schedule: %s",
+			p.Name, p.Location, p.Budget, p.CareNeeds, p.ScheduleRequirements))
+	}
+	if len(profile.Skills) > 0 {
+		parts = append(parts, "Skills: "+strings.Join(profile.Skills, ", "))
+	}
+	if len(parts) == 0 {
+		return "No profile stored yet."
+	}
+	return strings.Join(parts, ". ")
+}
+
+// RenderPrompt renders the active version of a prompt for a user. If the
+// stored template fails to render, the default is used instead so a bad edit
+// cannot take the assistant down.
+func (app *App) RenderPrompt(name, email string) string {
+	vars := PromptVars{
+		Email:        email,
+		Role:         app.userRole(email),
+		Profile:      app.profileSummary(email),
+		Organization: config.Branding.Name,
+	}
+
+	render := func(body string) (string, error) {
+		tmpl, err := template.New(name).Parse(body)
+		if err != nil {
+			return "", err
+		}
+		var sb strings.Builder
+		if preamble := config.Branding.PromptPreamble; preamble != "" {
+			sb.WriteString(preamble)
+			sb.WriteString("\n\n")
+		}
+		if err := tmpl.Execute(&sb, vars); err != nil {
+			return "", err
+		}
+		return sb.String(), nil
+	}
+
+	rendered, err := render(app.PromptBody(name))
+	if err == nil {
+		return rendered
+	}
+	log.Printf("Error rendering prompt %s: %v", name, err)
+	if rendered, err = render(defaultPrompts[name]); err == nil {
+		return rendered
+	}
+	return defaultPrompts[name]
+}
+
+type promptAdminEntry struct {
+	Name     string
+	Body     string
+	Versions []PromptTemplate
+}
+
+const adminPromptsTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Prompts</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Prompt Templates</h1>
+            <div class="app-description">Variables: {{"{{.Email}}"}}, {{"{{.Role}}"}}, {{"{{.Profile}}"}}, {{"{{.Organization}}"}}</div>
+        </div>
+        {{range .Prompts}}
+        <div class="calendar">
+            <h3>{{.Name}}</h3>
+            <form method="POST" action="prompts">
+                <input type="hidden" name="email" value="{{$.UserEmail}}">
+                <input type="hidden" name="name" value="{{.Name}}">
+                <textarea name="body" rows="16" class="message-input" style="width: 100%">{{.Body}}</textarea>
+                <button type="submit" class="send-button">Save new version</button>
+            </form>
+            {{range .Versions}}
+            <div class="calendar-event">v{{.Version}} by {{.CreatedBy}} on {{.CreatedAt.Format "Jan 2 2006 3:04 PM"}}</div>
+            {{end}}
+        </div>
+        {{end}}
+        <div class="calendar">
+            <h3>New prompt</h3>
+            <form method="POST" action="prompts">
+                <input type="hidden" name="email" value="{{.UserEmail}}">
+                <input type="text" name="name" placeholder="Prompt name" class="message-input" required>
+                <textarea name="body" rows="8" class="message-input" style="width: 100%"></textarea>
+                <button type="submit" class="send-button">Create</button>
+            </form>
+        </div>
+    </div>
+</body>
+</html>
+`
+
+// handleAdminPrompts lists prompts for editing and saves new versions
+func handleAdminPrompts(w http.ResponseWriter, r *http.Request) {
+	email := requireAdmin(w, r)
+	if email == "" {
+		return
+	}
+
+	if r.Method == "POST" {
+		if _, err := chatRoom.prompts.Save(r.FormValue("name"), r.FormValue("body"), email); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "prompts?email="+url.QueryEscape(email), http.StatusSeeOther)
+		return
+	}
+
+	var entries []promptAdminEntry
+	for _, name := range chatRoom.prompts.Names() {
+		versions, err := chatRoom.prompts.History(name)
+		if err != nil {
+			log.Printf("Error loading prompt history for %s: %v", name, err)
+		}
+		entries = append(entries, promptAdminEntry{
+			Name:     name,
+			Body:     chatRoom.PromptBody(name),
+			Versions: versions,
+		})
+	}
+
+	renderTemplate(w, "prompts", adminPromptsTemplate, struct {
+		UserEmail string
+		Prompts   []promptAdminEntry
+	}{email, entries})
+}
+
+// handlePromptsAPI returns prompt history as JSON on GET, and saves a new
+// version from a JSON body {"name": ..., "body": ...} on POST
+func handlePromptsAPI(w http.ResponseWriter, r *http.Request) {
+	email := requireAdmin(w, r)
+	if email == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		history := make(map[string][]PromptTemplate)
+		for _, name := range chatRoom.prompts.Names() {
+			versions, err := chatRoom.prompts.History(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			history[name] = versions
+		}
+		writeJSON(w, history)
+
+	case "POST":
+		var req struct {
+			Name string `json:"name"`
+			Body string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		p, err := chatRoom.prompts.Save(req.Name, req.Body, email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, p)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Profile details the model extracts from a conversation aren't saved
+// straight away. The store tools propose them instead, shown to the user as
+// a card, and only the user confirming the card (its button, or replying
+// "confirm") writes them.
+
+const profileProposalsSchema = `
+	CREATE TABLE IF NOT EXISTS profile_proposals (
+		email TEXT PRIMARY KEY,
+		role TEXT,
+		args TEXT,
+		created_at TIMESTAMP
+	)
+`
+
+// profileProposalTTL is how long a proposal waits to be confirmed
+const profileProposalTTL = 24 * time.Hour
+
+// Chat replies that answer a proposal
+const (
+	confirmReply = "confirm"
+	discardReply = "discard"
+)
+
+const noProposalMessage = "There are no profile changes waiting to be confirmed."
+
+// ProfileProposal is a profile the model extracted, awaiting the user
+type ProfileProposal struct {
+	Email     string
+	Role      string // "caregiver" or "patient"
+	Args      map[string]interface{}
+	CreatedAt time.Time
+}
+
+// caregiverFromArgs builds the caregiver a store_caregiver call describes
+func caregiverFromArgs(email string, args map[string]interface{}) *Caregiver {
+	return &Caregiver{
+		Email:            email, // Use current user's email
+		Name:             getStringArg(args, "name", ""),
+		Experience:       getStringArg(args, "experience", ""),
+		Location:         getStringArg(args, "location", ""),
+		Availability:     getStringArg(args, "availability", ""),
+		Specializations:  getStringArg(args, "specializations", ""),
+		RateExpectations: getFloatArg(args, "rate_expectations", 0),
+		Certifications:   getStringArg(args, "certifications", ""),
+	}
+}
+
+// patientFromArgs builds the patient a store_patient call describes
+func patientFromArgs(email string, args map[string]interface{}) *Patient {
+	return &Patient{
+		Email:                email, // Use current user's email
+		Name:                 getStringArg(args, "name", ""),
+		CareNeeds:            getStringArg(args, "care_needs", ""),
+		Location:             getStringArg(args, "location", ""),
+		ScheduleRequirements: getStringArg(args, "schedule_requirements", ""),
+		Budget:               getFloatArg(args, "budget", 0),
+		SpecialRequirements:  getStringArg(args, "special_requirements", ""),
+		PhoneNumber:          getStringArg(args, "phone_number", ""),
+		CreatedAt:            time.Now(),
+	}
+}
+
+// ProposeProfile holds a store tool call for the user to confirm, replacing
+// any earlier proposal, and returns the confirmation card. Details that
+// would fail validation are reported now rather than on confirming.
+func (app *App) ProposeProfile(email, role string, args map[string]interface{}) string {
+	var err error
+	if role == "caregiver" {
+		if err = caregiverFromArgs(email, args).validate(); err == nil {
+			_, err = paymentTypesArg(args, "payment_types")
+		}
+	} else if err = patientFromArgs(email, args).validate(); err == nil {
+		if _, err = normalizeUrgency(getStringArg(args, "urgency", "")); err == nil {
+			_, err = paymentTypesArg(args, "payment_type")
+		}
+	}
+	if err != nil {
+		return fmt.Sprintf("Error storing %s: %v", role, err)
+	}
+
+	data, err := json.Marshal(args)
+	if err != nil {
+		return fmt.Sprintf("Error storing %s: %v", role, err)
+	}
+	err = app.db.Exec(`
+		INSERT INTO profile_proposals (email, role, args, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, role, string(data), time.Now())
+	if err != nil {
+		log.Printf("Error storing profile proposal for %s: %v", email, err)
+		return fmt.Sprintf("Error storing %s: failed to save the proposal", role)
+	}
+	return app.formatProposal(&ProfileProposal{Email: email, Role: role, Args: args})
+}
+
+// GetProfileProposal returns a user's unexpired proposal, or nil
+func (app *App) GetProfileProposal(email string) (*ProfileProposal, error) {
+	result, err := app.db.Query("SELECT role, args, created_at FROM profile_proposals WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profile proposal: %v", err)
+	}
+	defer result.Close()
+
+	var found *ProfileProposal
+	err = result.Iterate(func(r *chai.Row) error {
+		p := ProfileProposal{Email: email}
+		var args string
+		if err := r.Scan(&p.Role, &args, &p.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan profile proposal: %v", err)
+		}
+		if err := json.Unmarshal([]byte(args), &p.Args); err != nil {
+			return fmt.Errorf("failed to decode profile proposal: %v", err)
+		}
+		found = &p
+		return nil
+	})
+	if err != nil || found == nil || time.Since(found.CreatedAt) > profileProposalTTL {
+		return nil, err
+	}
+	return found, nil
+}
+
+// AnswerProposal confirms (confirmReply) or discards (discardReply) a
+// user's proposal and returns what to tell them
+func (app *App) AnswerProposal(email, answer string) (string, error) {
+	p, err := app.GetProfileProposal(email)
+	if err != nil {
+		return "", err
+	}
+	if p == nil {
+		return noProposalMessage, nil
+	}
+	if err := app.DiscardProfile(email); err != nil {
+		return "", err
+	}
+	if answer == confirmReply {
+		return app.storeProfileArgs(email, p.Role, p.Args), nil
+	}
+	return "Okay, those details weren't saved.", nil
+}
+
+// DiscardProfile drops a user's proposal
+func (app *App) DiscardProfile(email string) error {
+	if err := app.db.Exec("DELETE FROM profile_proposals WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to discard profile proposal: %v", err)
+	}
+	return nil
+}
+
+// storeProfileArgs writes what a store tool call describes and returns
+// what to tell the user
+func (app *App) storeProfileArgs(email, role string, args map[string]interface{}) string {
+	if role == "caregiver" {
+		if err := app.StoreCaregiver(caregiverFromArgs(email, args)); err != nil {
+			return fmt.Sprintf("Error storing caregiver: %v", err)
+		} else if err := app.storeCustomFieldArgs(email, "caregiver", args); err != nil {
+			return fmt.Sprintf("Registered as a caregiver, but some details were not saved: %v", err)
+		} else if phone := getStringArg(args, "phone_number", ""); phone != "" && app.SetPhoneNumber(email, phone) != nil {
+			return "Registered as a caregiver, but the phone number could not be saved."
+		} else if err := app.storePaymentTypeArgs(email, "caregiver", args); err != nil {
+			return fmt.Sprintf("Registered as a caregiver, but the payment types could not be saved: %v", err)
+		}
+		return "Successfully registered as a caregiver."
+	}
+
+	if err := app.StorePatient(patientFromArgs(email, args)); err != nil {
+		return fmt.Sprintf("Error storing patient: %v", err)
+	} else if err := app.storeCustomFieldArgs(email, "patient", args); err != nil {
+		return fmt.Sprintf("Registered as a patient, but some details were not saved: %v", err)
+	} else if err := app.SetUrgency(email, getStringArg(args, "urgency", "")); err != nil {
+		return fmt.Sprintf("Registered as a patient, but the urgency could not be saved: %v", err)
+	} else if err := app.storePaymentTypeArgs(email, "patient", args); err != nil {
+		return fmt.Sprintf("Registered as a patient, but the payment type could not be saved: %v", err)
+	}
+	return "Successfully registered as a patient."
+}
+
+// answerProposalReply handles a chat reply of "confirm" or "discard" while
+// a proposal is waiting, reporting whether message was one
+func (app *App) answerProposalReply(email, message string) (bool, error) {
+	answer := strings.ToLower(strings.Trim(strings.TrimSpace(message), ".!"))
+	if answer != confirmReply && answer != discardReply {
+		return false, nil
+	}
+	if p, err := app.GetProfileProposal(email); err != nil || p == nil {
+		return false, err
+	}
+	response, err := app.AnswerProposal(email, answer)
+	if err != nil {
+		return true, err
+	}
+	return true, app.AddMessageWithRecipient(email, "assistant", response, "admin")
+}
+
+// formatProposal renders the confirmation card for a proposal
+func (app *App) formatProposal(p *ProfileProposal) string {
+	type row struct{ label, value string }
+	var rows []row
+	add := func(label, value string) {
+		if value != "" {
+			rows = append(rows, row{label, value})
+		}
+	}
+	if p.Role == "caregiver" {
+		c := caregiverFromArgs(p.Email, p.Args)
+		add("Name", c.Name)
+		add("Location", c.Location)
+		add("Rate", fmt.Sprintf("$%.2f/hour", c.RateExpectations))
+		add("Availability", c.Availability)
+		add("Experience", c.Experience)
+		add("Specializations", c.Specializations)
+		add("Certifications", c.Certifications)
+		types, _ := paymentTypesArg(p.Args, "payment_types")
+		add("Accepts", formatPaymentTypes(types))
+	} else {
+		pt := patientFromArgs(p.Email, p.Args)
+		add("Name", pt.Name)
+		add("Location", pt.Location)
+		add("Budget", fmt.Sprintf("$%.2f/hour", pt.Budget))
+		add("Care needs", pt.CareNeeds)
+		add("Schedule", pt.ScheduleRequirements)
+		add("Special requirements", pt.SpecialRequirements)
+		add("Urgency", getStringArg(p.Args, "urgency", ""))
+		types, _ := paymentTypesArg(p.Args, "payment_type")
+		add("Pays with", formatPaymentTypes(types))
+	}
+	add("Phone", getStringArg(p.Args, "phone_number", ""))
+	for _, f := range app.customFieldsFor(p.Role) {
+		if v, ok := p.Args[f.Name]; ok && v != nil {
+			add(f.Label, fmt.Sprint(v))
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<div class='proposal-card'>")
+	sb.WriteString(fmt.Sprintf("<strong>Save these details as your %s profile?</strong>", p.Role))
+	sb.WriteString("<table>")
+	for _, r := range rows {
+		sb.WriteString(fmt.Sprintf("<tr><th>%s</th><td>%s</td></tr>",
+			template.HTMLEscapeString(r.label), template.HTMLEscapeString(r.value)))
+	}
+	sb.WriteString("</table>")
+	sb.WriteString("<form method='POST' action='profile/confirm'>")
+	sb.WriteString("<button type='submit' name='action' value='confirm'>Confirm</button> ")
+	sb.WriteString("<button type='submit' name='action' value='discard'>Discard</button>")
+	sb.WriteString("</form>")
+	sb.WriteString(fmt.Sprintf("<small>Or reply \"%s\" or \"%s\". Nothing is saved until you confirm.</small>", confirmReply, discardReply))
+	sb.WriteString("</div>")
+	return sb.String()
+}
+
+// handleProfileConfirm confirms (action=confirm) or discards
+// (action=discard) the signed-in user's proposal from its card
+func handleProfileConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := requireUser(w, r)
+	if email == "" {
+		return
+	}
+
+	action := r.FormValue("action")
+	if action != confirmReply && action != discardReply {
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	response, err := chatRoom.AnswerProposal(email, action)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := chatRoom.AddMessageWithRecipient(email, "assistant", response, "admin"); err != nil {
+		log.Printf("Error adding confirmation reply for %s: %v", email, err)
+	}
+	http.Redirect(w, r, "../?email="+url.QueryEscape(email), http.StatusSeeOther)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProfileConfirmActsForSession(t *testing.T) {
+	app := newTestApp(t)
+	card := app.ProposeProfile("a@example.com", "patient", map[string]interface{}{
+		"name": "Ann", "location": "Austin", "phone_number": "+15125550100", "budget": 25.0,
+	})
+	if !strings.Contains(card, "proposal-card") {
+		t.Fatalf("no proposal card: %s", card)
+	}
+	if strings.Contains(card, "name='email'") {
+		t.Error("the proposal card still names the user in a form field")
+	}
+
+	handler := withLoginSession(http.HandlerFunc(handleProfileConfirm))
+	confirm := func(body, session string) int {
+		req := httptest.NewRequest("POST", "/profile/confirm", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: loginCookie, Value: session})
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := confirm("action=discard", ""); code != http.StatusUnauthorized {
+		t.Errorf("confirming without a session: got %d, want 401", code)
+	}
+	if code := confirm("email=a@example.com&action=discard", signIn(t, app, "b@example.com")); code != http.StatusForbidden {
+		t.Errorf("confirming someone else's proposal: got %d, want 403", code)
+	}
+	if p, _ := app.GetProfileProposal("a@example.com"); p == nil {
+		t.Fatal("a refused request discarded the proposal")
+	}
+	if code := confirm("action=discard", signIn(t, app, "a@example.com")); code != http.StatusSeeOther {
+		t.Errorf("discarding own proposal: got %d, want 303", code)
+	}
+	if p, _ := app.GetProfileProposal("a@example.com"); p != nil {
+		t.Error("the proposal wasn't discarded")
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Caregivers can opt in to a public page at /c/{slug} to share outside the
+// app. It shows only what a family needs to decide whether to get in
+// touch: first name and initial, experience, skills and a rate band, never
+// their email, phone or exact rate. Visitors ask about the caregiver with
+// the page's form, which starts a conversation with the assistant and, for
+// registered patients, proposes the match.
+
+const publicProfilesSchema = `
+	CREATE TABLE IF NOT EXISTS public_profiles (
+		email TEXT PRIMARY KEY,
+		slug TEXT,
+		enabled BOOLEAN,
+		created_at TIMESTAMP,
+		updated_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_public_profiles_slug ON public_profiles(slug);
+	CREATE TABLE IF NOT EXISTS profile_inquiries (
+		caregiver_email TEXT,
+		email TEXT,
+		message TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (caregiver_email, email, created_at)
+	)
+`
+
+// rateBandWidth is the width of the rate range a public page shows
+const rateBandWidth = 5
+
+// maxInquiry caps the length of an inquiry
+const maxInquiry = 1000
+
+var slugUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// PublicProfile is a caregiver's public page setting
+type PublicProfile struct {
+	Slug    string `json:"slug"`
+	Enabled bool   `json:"enabled"`
+}
+
+// URL is where the page is served
+func (p PublicProfile) URL() string {
+	return config.Email.BaseURL + "/c/" + p.Slug
+}
+
+// PublicCaregiver is what a public page shows
+type PublicCaregiver struct {
+	Slug            string   `json:"slug"`
+	Name            string   `json:"name"`
+	Experience      string   `json:"experience"`
+	Location        string   `json:"location"`
+	Specializations string   `json:"specializations"`
+	Certifications  string   `json:"certifications"`
+	Skills          []string `json:"skills"`
+	RateRange       string   `json:"rate_range"`
+	Available       bool     `json:"available"`
+	DocVerified     bool     `json:"document_verified"` // A current certificate is in their name
+	Checked         bool     `json:"background_checked"`
+	URL             string   `json:"url"`
+}
+
+// Description summarises the caregiver for link previews
+func (c PublicCaregiver) Description() string {
+	parts := []string{"Caregiver"}
+	if c.Location != "" {
+		parts[0] += " in " + c.Location
+	}
+	if c.RateRange != "" {
+		parts = append(parts, c.RateRange)
+	}
+	if c.Experience != "" {
+		parts = append(parts, c.Experience)
+	}
+	return strings.Join(parts, " · ")
+}
+
+// publicName shortens a name to the first name and the last name's
+// initial
+func publicName(name string) string {
+	fields := strings.Fields(name)
+	switch len(fields) {
+	case 0:
+		return "Caregiver"
+	case 1:
+		return fields[0]
+	}
+	last := []rune(fields[len(fields)-1])
+	return fields[0] + " " + strings.ToUpper(string(last[0])) + "."
+}
+
+// rateRange gives a rate as the band it falls in
+func rateRange(rate float64) string {
+	if rate <= 0 {
+		return ""
+	}
+	low := math.Floor(rate/rateBandWidth) * rateBandWidth
+	return fmt.Sprintf("$%.0f–$%.0f/hour", low, low+rateBandWidth)
+}
+
+// slugify turns words into a URL path segment
+func slugify(words ...string) string {
+	slug := slugUnsafe.ReplaceAllString(strings.ToLower(strings.Join(words, " ")), "-")
+	return strings.Trim(slug, "-")
+}
+
+// GetPublicProfile returns a caregiver's public page setting, nil if they
+// never turned it on
+func (app *App) GetPublicProfile(email string) (*PublicProfile, error) {
+	result, err := app.db.Query("SELECT slug, enabled FROM public_profiles WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query public profile: %v", err)
+	}
+	defer result.Close()
+
+	var profile *PublicProfile
+	err = result.Iterate(func(r *chai.Row) error {
+		profile = &PublicProfile{}
+		return r.Scan(&profile.Slug, &profile.Enabled)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan public profile: %v", err)
+	}
+	return profile, nil
+}
+
+// uniqueSlug picks a slug for a caregiver from their public name and
+// location, numbering it if it's taken
+func (app *App) uniqueSlug(c *Caregiver) (string, error) {
+	base := slugify(publicName(c.Name), c.Location)
+	if base == "" {
+		base = "caregiver"
+	}
+	slug := base
+	for n := 2; ; n++ {
+		taken, err := rowExists(app.db, "SELECT email FROM public_profiles WHERE slug = ?", slug)
+		if err != nil || !taken {
+			return slug, err
+		}
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// SetPublicProfile turns a caregiver's public page on or off. The slug is
+// made the first time and kept, so shared links keep working.
+func (app *App) SetPublicProfile(email string, enabled bool) (*PublicProfile, error) {
+	c, err := app.GetCaregiver(email)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, fmt.Errorf("only registered caregivers can have a public page")
+	}
+	profile, err := app.GetPublicProfile(email)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if profile == nil {
+		slug, err := app.uniqueSlug(c)
+		if err != nil {
+			return nil, err
+		}
+		profile = &PublicProfile{Slug: slug, Enabled: enabled}
+		err = app.db.Exec(`
+			INSERT INTO public_profiles (email, slug, enabled, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, email, slug, enabled, now, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store public profile: %v", err)
+		}
+		return profile, nil
+	}
+
+	profile.Enabled = enabled
+	err = app.db.Exec("UPDATE public_profiles SET enabled = ?, updated_at = ? WHERE email = ?", enabled, now, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update public profile: %v", err)
+	}
+	return profile, nil
+}
+
+// caregiverBySlug returns the caregiver whose public page is at slug, or
+// nil if there's no such page, it's turned off or they're suspended
+func (app *App) caregiverBySlug(slug string) (*Caregiver, error) {
+	result, err := app.db.Query("SELECT email FROM public_profiles WHERE slug = ? AND enabled = true", slug)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query public profile: %v", err)
+	}
+	defer result.Close()
+
+	var email string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&email)
+	})
+	if err != nil || email == "" || app.Suspended(email) {
+		return nil, err
+	}
+	return app.GetCaregiver(email)
+}
+
+// PublicCaregiverFor gathers what a caregiver's public page shows
+func (app *App) PublicCaregiverFor(c *Caregiver, slug string) (*PublicCaregiver, error) {
+	skills, err := app.GetSkills(c.Email)
+	if err != nil {
+		return nil, err
+	}
+	availability, err := app.GetAvailability(c.Email)
+	if err != nil {
+		return nil, err
+	}
+	return &PublicCaregiver{
+		Slug:            slug,
+		Name:            publicName(c.Name),
+		Experience:      c.Experience,
+		Location:        c.Location,
+		Specializations: c.Specializations,
+		Certifications:  c.Certifications,
+		Skills:          skills,
+		RateRange:       rateRange(c.RateExpectations),
+		Available:       availability.Available(),
+		DocVerified:     app.DocumentVerified(c.Email),
+		Checked:         app.BackgroundChecked(c.Email),
+		URL:             PublicProfile{Slug: slug}.URL(),
+	}, nil
+}
+
+// RecordInquiry stores a visitor's question about a caregiver and, if the
+// visitor is a registered patient, proposes the match
+func (app *App) RecordInquiry(c *Caregiver, email, message string) error {
+	err := app.db.Exec(`
+		INSERT INTO profile_inquiries (caregiver_email, email, message, created_at)
+		VALUES (?, ?, ?, ?)
+	`, c.Email, email, message, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store inquiry: %v", err)
+	}
+	patient, err := app.GetPatient(email)
+	if err != nil || patient == nil {
+		return err
+	}
+	_, err = app.proposeMatch(c, patient)
+	return err
+}
+
+// inquiryMessage is the chat message an inquiry starts, so the assistant
+// knows who the visitor asked about
+func inquiryMessage(p *PublicCaregiver, message string) string {
+	return fmt.Sprintf("I'm interested in %s, a caregiver in %s (%s). %s", p.Name, p.Location, p.URL, message)
+}
+
+const publicProfileTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.Name}} - Caregiver on {{(brand).Name}}</title>
+    <meta name="description" content="{{.Description}}">
+    <meta property="og:type" content="profile">
+    <meta property="og:title" content="{{.Name}} - Caregiver on {{(brand).Name}}">
+    <meta property="og:description" content="{{.Description}}">
+    <meta property="og:url" content="{{.URL}}">
+    <meta property="og:site_name" content="{{(brand).Name}}">
+    <link rel="canonical" href="{{.URL}}">
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>{{.Name}}</h1>
+            <div class="app-description">Caregiver{{if .Location}} in {{.Location}}{{end}}{{if .RateRange}} · {{.RateRange}}{{end}}{{if .DocVerified}} · <span class="verified">✓ Document verified</span>{{end}}{{if .Checked}} · <span class="verified">✓ Background checked</span>{{end}} · <a href="../directory">Browse caregivers</a></div>
+        </div>
+        {{if not .Available}}<div class="status-banner">{{.Name}} isn't taking new families right now.</div>{{end}}
+        <div class="message system">
+            {{if .Experience}}<p><strong>Experience:</strong> {{.Experience}}</p>{{end}}
+            {{if .Specializations}}<p><strong>Specializations:</strong> {{.Specializations}}</p>{{end}}
+            {{if .Certifications}}<p><strong>Certifications:</strong> {{.Certifications}}</p>{{end}}
+            {{if .Skills}}<p><strong>Skills:</strong> {{range $i, $s := .Skills}}{{if $i}}, {{end}}{{$s}}{{end}}</p>{{end}}
+        </div>
+        <form method="POST" action="{{.Slug}}" class="message-form">
+            <input type="hidden" name="form_time" value="{{.FormTime}}">
+            <input type="text" name="` + honeypotField + `" class="hp" tabindex="-1" autocomplete="off" aria-hidden="true">
+            <input type="email" name="email" placeholder="Your email" required>
+            <input type="text" name="message" placeholder="Ask {{.Name}} about care..." class="message-input" maxlength="1000" required>
+            {{with .Challenge}}<div class="cf-turnstile" data-sitekey="{{.}}"></div>{{end}}
+            <button type="submit" class="send-button">Ask</button>
+        </form>
+        {{with .Challenge}}<script src="https://challenges.cloudflare.com/turnstile/v0/api.js" async defer></script>{{end}}
+    </div>
+</body>
+</html>
+`
+
+// handlePublicProfile serves a caregiver's public page at /c/{slug}. A
+// POST is an inquiry from the page's form: it goes to the assistant as the
+// visitor's message, and the visitor lands in their chat to carry on.
+func handlePublicProfile(w http.ResponseWriter, r *http.Request) {
+	slug := strings.TrimPrefix(r.URL.Path, "/c/")
+	c, err := chatRoom.caregiverBySlug(slug)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if c == nil {
+		http.Error(w, "No such profile", http.StatusNotFound)
+		return
+	}
+	page, err := chatRoom.PublicCaregiverFor(c, slug)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != "POST" {
+		data := struct {
+			*PublicCaregiver
+			FormTime  int64
+			Challenge string // Turnstile site key
+		}{page, time.Now().Unix(), ""}
+		if config.Bots.ScreenSignups {
+			data.Challenge = config.Bots.TurnstileSiteKey
+		}
+		renderTemplate(w, "publicProfile", publicProfileTemplate, data)
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	message := strings.TrimSpace(r.FormValue("message"))
+	if email == "" || message == "" {
+		http.Error(w, "Email and message are required", http.StatusBadRequest)
+		return
+	}
+	if len(message) > maxInquiry {
+		http.Error(w, fmt.Sprintf("A message can be at most %d characters", maxInquiry), http.StatusBadRequest)
+		return
+	}
+	if email == c.Email {
+		http.Error(w, "That's your own profile", http.StatusBadRequest)
+		return
+	}
+	if chatRoom.isFirstContact(email) {
+		if err := chatRoom.screenFirstContact(r, email); err != nil {
+			var rejected *errRejected
+			if !errors.As(err, &rejected) {
+				log.Printf("Error screening inquiry from %s: %v", email, err)
+			} else {
+				log.Printf("Turned away inquiry from %s: %v", email, err)
+				http.Error(w, "Your message could not be sent", rejected.status)
+				return
+			}
+		}
+	}
+
+	if err := chatRoom.RecordInquiry(c, email, message); err != nil {
+		log.Printf("Error recording inquiry from %s about %s: %v", email, c.Email, err)
+	}
+	if err := chatRoom.RunChatTurn(email, inquiryMessage(page, message)); err != nil {
+		log.Printf("Error processing inquiry from %s: %v", email, err)
+		http.Error(w, "Failed to send your message", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/?email="+url.QueryEscape(email), http.StatusSeeOther)
+}
+
+// handlePublicProfileSetting turns the caregiver's public page on
+// (action=enable) or off (action=disable) from the chat page
+func handlePublicProfileSetting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	var enabled bool
+	switch r.FormValue("action") {
+	case "enable":
+		enabled = true
+	case "disable":
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if _, err := chatRoom.SetPublicProfile(email, enabled); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "../?email="+url.QueryEscape(email), http.StatusSeeOther)
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// A caregiver's rate and a patient's budget are where a match starts, not
+// what it pays. Either side offers an hourly rate for the match, the other
+// accepts it, declines it or counters with their own, and the accepted
+// rate is stored on the match as its agreed_rate. Timesheets and invoices
+// use it from then on, and the caregiver's asking rate until then.
+
+const rateOffersSchema = `
+	CREATE TABLE IF NOT EXISTS rate_offers (
+		id TEXT PRIMARY KEY,
+		caregiver_email TEXT,
+		patient_email TEXT,
+		offered_by TEXT,
+		rate REAL,
+		note TEXT,
+		status TEXT,
+		created_at TIMESTAMP,
+		responded_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_rate_offers_caregiver ON rate_offers(caregiver_email);
+	CREATE INDEX IF NOT EXISTS idx_rate_offers_patient ON rate_offers(patient_email)
+`
+
+// migrateMatchRates adds the agreed rate to matches, and the rate it was
+// worked out at to timesheets, for tables created before them
+func migrateMatchRates(db *instrumentedDB) error {
+	if err := addColumn(db, "matches", "agreed_rate", "REAL DEFAULT 0"); err != nil {
+		return err
+	}
+	return addColumn(db, "timesheets", "rate", "REAL DEFAULT 0")
+}
+
+// Rate offer statuses. An offer stays pending until the other side answers
+// it, or either side makes a new one.
+const (
+	RateOfferPending   = "pending"
+	RateOfferAccepted  = "accepted"
+	RateOfferDeclined  = "declined"
+	RateOfferCountered = "countered" // The other side offered instead
+	RateOfferWithdrawn = "withdrawn" // Its maker offered again
+)
+
+// maxHourlyRate guards against typos like 2000 for 20.00
+const maxHourlyRate = 500
+
+// RateOffer is an hourly rate one side of a match offered the other
+type RateOffer struct {
+	ID             string    `json:"id"`
+	CaregiverEmail string    `json:"caregiver_email"`
+	PatientEmail   string    `json:"patient_email"`
+	OfferedBy      string    `json:"offered_by"`
+	Rate           float64   `json:"rate"`
+	Note           string    `json:"note,omitempty"`
+	Status         string    `json:"status"`
+	CreatedAt      time.Time `json:"created_at"`
+	RespondedAt    time.Time `json:"responded_at,omitempty"`
+}
+
+// otherParty returns the side of a match that isn't email
+func otherParty(caregiverEmail, patientEmail, email string) string {
+	if email == caregiverEmail {
+		return patientEmail
+	}
+	return caregiverEmail
+}
+
+const rateOfferColumns = "id, caregiver_email, patient_email, offered_by, rate, note, status, created_at, responded_at"
+
+// RateOffers lists a match's rate offers, the latest first
+func (app *App) RateOffers(caregiverEmail, patientEmail string) ([]RateOffer, error) {
+	result, err := app.db.Query(`
+		SELECT `+rateOfferColumns+`
+		FROM rate_offers WHERE caregiver_email = ? AND patient_email = ?
+		ORDER BY created_at DESC
+	`, caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rate offers: %v", err)
+	}
+	defer result.Close()
+
+	offers := []RateOffer{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var o RateOffer
+		if err := r.Scan(&o.ID, &o.CaregiverEmail, &o.PatientEmail, &o.OfferedBy, &o.Rate, &o.Note, &o.Status,
+			&o.CreatedAt, &o.RespondedAt); err != nil {
+			return fmt.Errorf("failed to scan rate offer: %v", err)
+		}
+		offers = append(offers, o)
+		return nil
+	})
+	return offers, err
+}
+
+// PendingRateOffer returns the offer waiting on an answer in a match, or
+// nil
+func (app *App) PendingRateOffer(caregiverEmail, patientEmail string) (*RateOffer, error) {
+	offers, err := app.RateOffers(caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range offers {
+		if o.Status == RateOfferPending {
+			return &o, nil
+		}
+	}
+	return nil, nil
+}
+
+// negotiableMatch returns the match between a caregiver and a patient if
+// email is one of them and it hasn't ended
+func (app *App) negotiableMatch(caregiverEmail, patientEmail, email string) (*Match, error) {
+	if email != caregiverEmail && email != patientEmail {
+		return nil, fmt.Errorf("not a party to this match")
+	}
+	match, err := app.GetMatch(caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, err
+	}
+	if match == nil || match.Status == MatchEnded {
+		return nil, fmt.Errorf("there's no open match between %s and %s", caregiverEmail, patientEmail)
+	}
+	return match, nil
+}
+
+// OfferRate offers an hourly rate for a match on behalf of one side.
+// Answering the other side's pending offer this way counters it; offering
+// again replaces the maker's own.
+func (app *App) OfferRate(caregiverEmail, patientEmail, by string, rate float64, note string) (*RateOffer, error) {
+	if _, err := app.negotiableMatch(caregiverEmail, patientEmail, by); err != nil {
+		return nil, err
+	}
+	if rate <= 0 || rate > maxHourlyRate {
+		return nil, fmt.Errorf("a rate must be more than $0 and at most $%d an hour", maxHourlyRate)
+	}
+	rate = roundCents(rate)
+
+	offer := &RateOffer{
+		ID:             newAttachmentID(),
+		CaregiverEmail: caregiverEmail,
+		PatientEmail:   patientEmail,
+		OfferedBy:      by,
+		Rate:           rate,
+		Note:           strings.TrimSpace(note),
+		Status:         RateOfferPending,
+		CreatedAt:      time.Now(),
+	}
+	pending, err := app.PendingRateOffer(caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, err
+	}
+	var countered bool
+	err = app.withTx(func(tx *chai.Tx) error {
+		if pending != nil {
+			status := RateOfferWithdrawn
+			if pending.OfferedBy != by {
+				status, countered = RateOfferCountered, true
+			}
+			if err := tx.Exec("UPDATE rate_offers SET status = ?, responded_at = ? WHERE id = ?",
+				status, offer.CreatedAt, pending.ID); err != nil {
+				return fmt.Errorf("failed to update rate offer: %v", err)
+			}
+		}
+		return tx.Exec(`
+			INSERT INTO rate_offers (`+rateOfferColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, offer.ID, offer.CaregiverEmail, offer.PatientEmail, offer.OfferedBy, offer.Rate, offer.Note,
+			offer.Status, offer.CreatedAt, time.Time{})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store rate offer: %v", err)
+	}
+
+	verb := "offered"
+	if countered {
+		verb = "countered with"
+	}
+	message := fmt.Sprintf("%s %s $%.2f/hour for your match.", app.displayName(by), verb, rate)
+	if offer.Note != "" {
+		message += " They said: " + offer.Note
+	}
+	app.tellMatchParty(caregiverEmail, patientEmail, otherParty(caregiverEmail, patientEmail, by),
+		message+" Accept it, decline it or offer another rate on your match page")
+	return offer, nil
+}
+
+// RespondToRateOffer accepts or declines the other side's pending offer.
+// Accepting makes it the match's agreed rate.
+func (app *App) RespondToRateOffer(caregiverEmail, patientEmail, by string, accept bool) (*RateOffer, error) {
+	if _, err := app.negotiableMatch(caregiverEmail, patientEmail, by); err != nil {
+		return nil, err
+	}
+	offer, err := app.PendingRateOffer(caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, err
+	}
+	if offer == nil || offer.OfferedBy == by {
+		return nil, fmt.Errorf("there's no rate offer waiting on you")
+	}
+
+	offer.Status, offer.RespondedAt = RateOfferDeclined, time.Now()
+	if accept {
+		offer.Status = RateOfferAccepted
+	}
+	err = app.withTx(func(tx *chai.Tx) error {
+		if err := tx.Exec("UPDATE rate_offers SET status = ?, responded_at = ? WHERE id = ?",
+			offer.Status, offer.RespondedAt, offer.ID); err != nil {
+			return err
+		}
+		if !accept {
+			return nil
+		}
+		return tx.Exec("UPDATE matches SET agreed_rate = ? WHERE caregiver_email = ? AND patient_email = ?",
+			offer.Rate, caregiverEmail, patientEmail)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to answer rate offer: %v", err)
+	}
+
+	if accept {
+		app.tellMatchParty(caregiverEmail, patientEmail, offer.OfferedBy, fmt.Sprintf(
+			"%s accepted your offer of $%.2f/hour, and shifts are billed at that rate from now on. See your match page", app.displayName(by), offer.Rate))
+	} else {
+		app.tellMatchParty(caregiverEmail, patientEmail, offer.OfferedBy, fmt.Sprintf(
+			"%s declined your offer of $%.2f/hour. You can offer another rate on your match page", app.displayName(by), offer.Rate))
+	}
+	return offer, nil
+}
+
+// displayName returns a user's name, or their email if they have none
+func (app *App) displayName(email string) string {
+	if c, err := app.GetCaregiver(email); err == nil && c != nil && c.Name != "" {
+		return c.Name
+	}
+	if p, err := app.GetPatient(email); err == nil && p != nil && p.Name != "" {
+		return p.Name
+	}
+	return email
+}
+
+// tellMatchParty sends one side of a match a message from the assistant,
+// followed by a link to the match page
+func (app *App) tellMatchParty(caregiverEmail, patientEmail, to, message string) {
+	message = fmt.Sprintf("%s: match?email=%s&caregiver_email=%s&patient_email=%s", message,
+		url.QueryEscape(to), url.QueryEscape(caregiverEmail), url.QueryEscape(patientEmail))
+	if err := app.AddMessageWithRecipient(to, "assistant", message, adminThread); err != nil {
+		log.Printf("Error messaging %s about their match: %v", to, err)
+	}
+}
+
+var negotiateRateFunction = map[string]interface{}{
+	"name":        "negotiate_rate",
+	"description": "Agree an hourly rate with a matched caregiver or patient: offer or counter with a rate, accept or decline the other side's offer, or see where the negotiation stands",
+	"parameters": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"with_email": map[string]interface{}{
+				"type":        "string",
+				"description": "Email of the caregiver or patient the user is matched with",
+			},
+			"action": map[string]interface{}{
+				"type":        "string",
+				"enum":        []string{"status", "offer", "accept", "decline"},
+				"description": "offer also counters the other side's offer",
+			},
+			"rate": map[string]interface{}{
+				"type":        "number",
+				"description": "Hourly rate in dollars, for offer",
+			},
+			"note": map[string]interface{}{
+				"type":        "string",
+				"description": "Anything the user wants to say with their offer",
+			},
+		},
+		"required": []string{"with_email", "action"},
+	},
+}
+
+// negotiateRate carries out a negotiate_rate call for email
+func (app *App) negotiateRate(email string, args map[string]interface{}) string {
+	caregiverEmail, patientEmail := email, getStringArg(args, "with_email", "")
+	if app.userRole(email) == "patient" {
+		caregiverEmail, patientEmail = patientEmail, email
+	}
+
+	switch getStringArg(args, "action", "status") {
+	case "offer":
+		offer, err := app.OfferRate(caregiverEmail, patientEmail, email, getFloatArg(args, "rate", 0), getStringArg(args, "note", ""))
+		if err != nil {
+			return fmt.Sprintf("Error making offer: %v", err)
+		}
+		return fmt.Sprintf("Offered $%.2f/hour to %s. They'll be asked to accept it.",
+			offer.Rate, app.displayName(otherParty(caregiverEmail, patientEmail, email)))
+	case "accept", "decline":
+		offer, err := app.RespondToRateOffer(caregiverEmail, patientEmail, email, getStringArg(args, "action", "") == "accept")
+		if err != nil {
+			return fmt.Sprintf("Error answering offer: %v", err)
+		}
+		if offer.Status == RateOfferAccepted {
+			return fmt.Sprintf("The agreed rate is now $%.2f/hour.", offer.Rate)
+		}
+		return fmt.Sprintf("Declined the offer of $%.2f/hour.", offer.Rate)
+	}
+
+	match, err := app.negotiableMatch(caregiverEmail, patientEmail, email)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	status := "No rate has been agreed yet."
+	if match.AgreedRate > 0 {
+		status = fmt.Sprintf("The agreed rate is $%.2f/hour.", match.AgreedRate)
+	}
+	pending, err := app.PendingRateOffer(caregiverEmail, patientEmail)
+	if err != nil {
+		return fmt.Sprintf("Error checking offers: %v", err)
+	}
+	if pending != nil {
+		who := "You"
+		if pending.OfferedBy != email {
+			who = app.displayName(pending.OfferedBy)
+		}
+		status += fmt.Sprintf(" %s offered $%.2f/hour on %s, waiting on an answer.",
+			who, pending.Rate, pending.CreatedAt.Format("Jan 2"))
+	}
+	return status
+}
+
+// applyRateAction carries out a rate action for a party to a match: offer
+// (with rate and note), accept or decline
+func applyRateAction(r *http.Request, email, caregiverEmail, patientEmail string) error {
+	switch action := r.FormValue("action"); action {
+	case "offer":
+		rate, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(r.FormValue("rate")), "$"), 64)
+		if err != nil {
+			return fmt.Errorf("rate must be a number of dollars")
+		}
+		_, err = chatRoom.OfferRate(caregiverEmail, patientEmail, email, rate, r.FormValue("note"))
+		return err
+	case "accept", "decline":
+		_, err := chatRoom.RespondToRateOffer(caregiverEmail, patientEmail, email, action == "accept")
+		return err
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+// handleMatchRate takes a rate action posted from the match detail view
+func handleMatchRate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email, caregiverEmail, patientEmail, err := shiftParties(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := applyRateAction(r, email, caregiverEmail, patientEmail); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("../match?email=%s&caregiver_email=%s&patient_email=%s",
+		url.QueryEscape(email), url.QueryEscape(caregiverEmail), url.QueryEscape(patientEmail)),
+		http.StatusSeeOther)
+}
+
+// handleRateOffersAPI returns a match's agreed rate and offers (GET) or
+// takes a rate action (POST, as on the match page)
+func handleRateOffersAPI(w http.ResponseWriter, r *http.Request) {
+	email, caregiverEmail, patientEmail, err := shiftParties(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		match, err := chatRoom.GetMatch(caregiverEmail, patientEmail)
+		if err != nil || match == nil {
+			http.Error(w, "match not found", http.StatusNotFound)
+			return
+		}
+		offers, err := chatRoom.RateOffers(caregiverEmail, patientEmail)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"agreed_rate": match.AgreedRate,
+			"offers":      offers,
+		})
+
+	case "POST":
+		if err := applyRateAction(r, email, caregiverEmail, patientEmail); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// adminThread names a user's conversation with the assistant. Every other
+// thread is named by the email of the peer on the other side.
+const adminThread = "admin"
+
+const readMarkersSchema = `
+	CREATE TABLE IF NOT EXISTS read_markers (
+		email TEXT,
+		thread TEXT,
+		read_at TIMESTAMP,
+		PRIMARY KEY (email, thread)
+	);
+	CREATE INDEX IF NOT EXISTS idx_chat_history_recipient ON chat_history(recipient)
+`
+
+// ThreadUnread is the number of unread messages in one of a user's threads
+type ThreadUnread struct {
+	Thread string `json:"thread"`
+	Count  int    `json:"count"`
+}
+
+// MarkThreadRead records that email has read everything in thread up to now
+func (app *App) MarkThreadRead(email, thread string) error {
+	err := app.db.Exec(`
+		INSERT INTO read_markers (email, thread, read_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, thread, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to mark thread read: %v", err)
+	}
+	return nil
+}
+
+// GetReadMarkers returns when email last read each of their threads
+func (app *App) GetReadMarkers(email string) (map[string]time.Time, error) {
+	result, err := app.db.Query("SELECT thread, read_at FROM read_markers WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query read markers: %v", err)
+	}
+	defer result.Close()
+
+	markers := make(map[string]time.Time)
+	err = result.Iterate(func(r *chai.Row) error {
+		var thread string
+		var readAt time.Time
+		if err := r.Scan(&thread, &readAt); err != nil {
+			return fmt.Errorf("failed to scan read marker: %v", err)
+		}
+		markers[thread] = readAt
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return markers, nil
+}
+
+// GetUnreadCounts returns unread counts for each of a user's threads that
+// has anything unread: assistant replies in the admin thread, and direct
+// messages from peers.
+func (app *App) GetUnreadCounts(email string) ([]ThreadUnread, error) {
+	markers, err := app.GetReadMarkers(email)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	count := func(thread string, createdAt time.Time) {
+		if createdAt.After(markers[thread]) {
+			counts[thread]++
+		}
+	}
+
+	result, err := app.db.Query(`
+		SELECT created_at FROM chat_history
+		WHERE email = ? AND role = 'assistant' AND created_at > ?
+	`, email, markers[adminThread])
+	if err != nil {
+		return nil, fmt.Errorf("failed to query assistant messages: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		var createdAt time.Time
+		if err := r.Scan(&createdAt); err != nil {
+			return err
+		}
+		count(adminThread, createdAt)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate assistant messages: %v", err)
+	}
+
+	result, err = app.db.Query(`
+		SELECT email, created_at FROM chat_history
+		WHERE recipient = ? AND email != ?
+	`, email, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query direct messages: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		var sender string
+		var createdAt time.Time
+		if err := r.Scan(&sender, &createdAt); err != nil {
+			return err
+		}
+		count(sender, createdAt)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate direct messages: %v", err)
+	}
+
+	unread := make([]ThreadUnread, 0, len(counts))
+	for thread, n := range counts {
+		unread = append(unread, ThreadUnread{Thread: thread, Count: n})
+	}
+	sort.Slice(unread, func(i, j int) bool { return unread[i].Thread < unread[j].Thread })
+	return unread, nil
+}
+
+// handleUnread returns a user's unread counts per thread
+func handleUnread(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	unread, err := chatRoom.GetUnreadCounts(email)
+	if err != nil {
+		log.Printf("Error getting unread counts: %v", err)
+		http.Error(w, "Failed to get unread counts", http.StatusInternalServerError)
+		return
+	}
+
+	total := 0
+	for _, t := range unread {
+		total += t.Count
+	}
+	writeJSONCached(w, r, map[string]interface{}{
+		"threads": unread,
+		"total":   total,
+	}, time.Time{})
+}
+
+// handleRead marks a thread read on POST. On GET it returns the read receipt
+// for a direct-message thread: when the peer last read their side of it.
+func handleRead(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		thread := r.FormValue("thread")
+		if thread == "" {
+			thread = adminThread
+		}
+		if err := chatRoom.MarkThreadRead(email, thread); err != nil {
+			log.Printf("Error marking thread read: %v", err)
+			http.Error(w, "Failed to mark thread read", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "GET":
+		peer := r.FormValue("peer")
+		if peer == "" {
+			http.Error(w, "Peer is required", http.StatusBadRequest)
+			return
+		}
+		markers, err := chatRoom.GetReadMarkers(peer)
+		if err != nil {
+			log.Printf("Error getting read markers: %v", err)
+			http.Error(w, "Failed to get read receipt", http.StatusInternalServerError)
+			return
+		}
+		receipt := map[string]interface{}{"peer": peer}
+		if readAt, ok := markers[email]; ok {
+			receipt["read_at"] = readAt
+		}
+		writeJSON(w, receipt)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
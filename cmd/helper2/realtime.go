@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// typingTTL is how long clients show a typing indicator without a refresh
+const typingTTL = 5 * time.Second
+
+// streamKeepAlive keeps idle event streams from being cut by proxies
+const streamKeepAlive = 25 * time.Second
+
+const deliveriesSchema = `
+	CREATE TABLE IF NOT EXISTS message_deliveries (
+		sender TEXT,
+		created_at TIMESTAMP,
+		recipient TEXT,
+		delivered_at TIMESTAMP,
+		PRIMARY KEY (sender, created_at, recipient)
+	)
+`
+
+// realtimeEvent is pushed to a user's open chat pages
+type realtimeEvent struct {
+	Name string      // "message", "typing", "delivered" or "notification"
+	Data interface{} // JSON encoded as the event data
+}
+
+// realtimeHub tracks open event streams per user. Each open page is one
+// subscriber; a full subscriber buffer drops events rather than blocking.
+type realtimeHub struct {
+	mu      sync.Mutex
+	streams map[string]map[chan realtimeEvent]bool
+}
+
+func newRealtimeHub() *realtimeHub {
+	return &realtimeHub{streams: make(map[string]map[chan realtimeEvent]bool)}
+}
+
+func (h *realtimeHub) subscribe(email string) chan realtimeEvent {
+	ch := make(chan realtimeEvent, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.streams[email] == nil {
+		h.streams[email] = make(map[chan realtimeEvent]bool)
+	}
+	h.streams[email][ch] = true
+	return ch
+}
+
+func (h *realtimeHub) unsubscribe(email string, ch chan realtimeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.streams[email], ch)
+	if len(h.streams[email]) == 0 {
+		delete(h.streams, email)
+	}
+}
+
+// Send pushes an event to every open page of a user
+func (h *realtimeHub) Send(email, name string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.streams[email] {
+		select {
+		case ch <- realtimeEvent{Name: name, Data: data}:
+		default:
+		}
+	}
+}
+
+// Connected reports whether a user has any page open
+func (h *realtimeHub) Connected(email string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.streams[email]) > 0
+}
+
+// isUserRecipient tells direct messages apart from messages in the
+// assistant thread
+func isUserRecipient(recipient string) bool {
+	return recipient != "" && recipient != adminThread && recipient != "system"
+}
+
+// pushMessage delivers a newly stored message to its sender's pages and,
+// for direct messages, to the recipient's
+func (app *App) pushMessage(entry ChatHistoryEntry) {
+	app.realtime.Send(entry.Email, "message", entry)
+	if isUserRecipient(entry.Recipient) {
+		app.realtime.Send(entry.Recipient, "message", entry)
+	}
+}
+
+// MarkDelivered records that recipient's client received a direct message
+// and tells the sender
+func (app *App) MarkDelivered(sender string, createdAt time.Time, recipient string) error {
+	deliveredAt := time.Now()
+	err := app.db.Exec(`
+		INSERT INTO message_deliveries (sender, created_at, recipient, delivered_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`, sender, createdAt, recipient, deliveredAt)
+	if err != nil {
+		return fmt.Errorf("failed to record delivery: %v", err)
+	}
+	app.realtime.Send(sender, "delivered", map[string]interface{}{
+		"recipient":    recipient,
+		"created_at":   createdAt,
+		"delivered_at": deliveredAt,
+	})
+	return nil
+}
+
+// DeliveredAt returns when a direct message reached its recipient, or the
+// zero time if it hasn't yet
+func (app *App) DeliveredAt(sender string, createdAt time.Time, recipient string) (time.Time, error) {
+	result, err := app.db.Query(`
+		SELECT delivered_at FROM message_deliveries
+		WHERE sender = ? AND created_at = ? AND recipient = ?
+	`, sender, createdAt, recipient)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query delivery: %v", err)
+	}
+	defer result.Close()
+
+	var deliveredAt time.Time
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&deliveredAt)
+	})
+	return deliveredAt, err
+}
+
+// handleStream is a server-sent event stream of a user's message, typing
+// and delivery events
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	ch := chatRoom.realtime.subscribe(email)
+	defer chatRoom.realtime.unsubscribe(email, ch)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			chatRoom.presence.Seen(email)
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case ev := <-ch:
+			data, err := json.Marshal(ev.Data)
+			if err != nil {
+				log.Printf("Error encoding %s event: %v", ev.Name, err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// handleTyping relays a typing indicator to the other side of a thread.
+// In the assistant thread there is nobody to tell.
+func handleTyping(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	thread := r.FormValue("thread")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	if isUserRecipient(thread) {
+		chatRoom.realtime.Send(thread, "typing", map[string]interface{}{
+			"from":       email,
+			"thread":     email,
+			"expires_in": typingTTL.Milliseconds(),
+		})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDelivered acknowledges receipt of a direct message. The created_at
+// parameter is the message's timestamp exactly as the stream sent it.
+func handleDelivered(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	sender := r.FormValue("sender")
+	createdAt, err := time.Parse(time.RFC3339Nano, r.FormValue("created_at"))
+	if email == "" || sender == "" || err != nil {
+		http.Error(w, "email, sender and created_at are required", http.StatusBadRequest)
+		return
+	}
+	if err := chatRoom.MarkDelivered(sender, createdAt, email); err != nil {
+		log.Printf("Error marking delivery: %v", err)
+		http.Error(w, "Failed to record delivery", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+const (
+	// promptWindow is how many recent messages are always sent to the model
+	promptWindow = 20
+	// recallTopK is how many older messages are recalled into the prompt
+	recallTopK = 5
+	// recallMinScore keeps loosely related messages out of the prompt
+	recallMinScore = 0.3
+	// maxEmbeddedChars bounds the text embedded per message; match lists
+	// rendered by tools can be long and are mostly markup
+	maxEmbeddedChars = 2000
+)
+
+const messageEmbeddingsSchema = `
+	CREATE TABLE IF NOT EXISTS message_embeddings (
+		email TEXT,
+		created_at TIMESTAMP,
+		role TEXT,
+		content TEXT,
+		vector TEXT,
+		PRIMARY KEY (email, created_at)
+	);
+	CREATE INDEX IF NOT EXISTS idx_message_embeddings_email ON message_embeddings(email)
+`
+
+// onMessageStored runs after a message has been written to chat_history
+func (app *App) onMessageStored(email, role, content string, createdAt time.Time) {
+	if role != "user" && role != "assistant" {
+		return
+	}
+	go func() {
+		if err := app.IndexMessage(email, role, content, createdAt); err != nil {
+			log.Printf("Error indexing message for %s: %v", email, err)
+		}
+	}()
+}
+
+// IndexMessage embeds one chat message so it can be recalled later
+func (app *App) IndexMessage(email, role, content string, createdAt time.Time) error {
+	if os.Getenv("OPENAI_API_KEY") == "" || strings.TrimSpace(content) == "" {
+		return nil
+	}
+	if len(content) > maxEmbeddedChars {
+		content = content[:maxEmbeddedChars]
+	}
+
+	vectors, err := callOpenAIEmbeddings([]string{content})
+	if err != nil {
+		return err
+	}
+	vector, err := json.Marshal(vectors[0])
+	if err != nil {
+		return fmt.Errorf("failed to marshal embedding: %v", err)
+	}
+
+	err = app.db.Exec(`
+		INSERT INTO message_embeddings (email, created_at, role, content, vector)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, createdAt, role, content, string(vector))
+	if err != nil {
+		return fmt.Errorf("failed to store message embedding: %v", err)
+	}
+	return nil
+}
+
+type recalledMessage struct {
+	Role      string
+	Content   string
+	CreatedAt time.Time
+	Score     float64
+}
+
+// RecallRelevantMessages finds the user's earlier messages most relevant to
+// query, skipping anything already in the recent window, and formats them as
+// a system note. It returns "" when there is nothing worth adding.
+func (app *App) RecallRelevantMessages(email, query string, window []Message) string {
+	if os.Getenv("OPENAI_API_KEY") == "" {
+		return ""
+	}
+
+	vectors, err := callOpenAIEmbeddings([]string{query})
+	if err != nil {
+		log.Printf("Error embedding query for recall: %v", err)
+		return ""
+	}
+	target := vectors[0]
+
+	inWindow := make(map[string]bool)
+	for _, m := range window {
+		inWindow[m.Content] = true
+	}
+
+	result, err := app.db.Query(`
+		SELECT role, content, created_at, vector
+		FROM message_embeddings
+		WHERE email = ?
+	`, email)
+	if err != nil {
+		log.Printf("Error querying message embeddings: %v", err)
+		return ""
+	}
+	defer result.Close()
+
+	var candidates []recalledMessage
+	err = result.Iterate(func(r *chai.Row) error {
+		var m recalledMessage
+		var encoded string
+		if err := r.Scan(&m.Role, &m.Content, &m.CreatedAt, &encoded); err != nil {
+			return err
+		}
+		if inWindow[m.Content] {
+			return nil
+		}
+		var vector []float64
+		if err := json.Unmarshal([]byte(encoded), &vector); err != nil {
+			return err
+		}
+		if m.Score = cosineSimilarity(target, vector); m.Score >= recallMinScore {
+			candidates = append(candidates, m)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error iterating message embeddings: %v", err)
+		return ""
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+	if len(candidates) > recallTopK {
+		candidates = candidates[:recallTopK]
+	}
+	// Present them in the order they were said
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].CreatedAt.Before(candidates[j].CreatedAt) })
+
+	var sb strings.Builder
+	sb.WriteString("Relevant messages from earlier in this conversation:\n")
+	for _, m := range candidates {
+		sb.WriteString(fmt.Sprintf("- [%s, %s] %s\n", m.CreatedAt.Format("Jan 2"), m.Role, m.Content))
+	}
+	return sb.String()
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+const referralsSchema = `
+	CREATE TABLE IF NOT EXISTS invite_codes (
+		code TEXT PRIMARY KEY,
+		owner TEXT,
+		organization TEXT,
+		max_uses INTEGER,
+		uses INTEGER,
+		created_by TEXT,
+		created_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_invite_codes_owner ON invite_codes(owner);
+	CREATE INDEX IF NOT EXISTS idx_invite_codes_organization ON invite_codes(organization);
+	CREATE TABLE IF NOT EXISTS referrals (
+		invitee TEXT PRIMARY KEY,
+		code TEXT,
+		inviter TEXT,
+		organization TEXT,
+		created_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_referrals_inviter ON referrals(inviter);
+	CREATE TABLE IF NOT EXISTS organization_members (
+		email TEXT PRIMARY KEY,
+		organization TEXT,
+		created_at TIMESTAMP
+	)
+`
+
+// InviteCode is a shareable code. A user's personal code has an owner and
+// no limit; codes generated for an agency carry its organization and
+// usually a single use.
+type InviteCode struct {
+	Code         string    `json:"code"`
+	Owner        string    `json:"owner,omitempty"`
+	Organization string    `json:"organization,omitempty"`
+	MaxUses      int       `json:"max_uses"` // Zero means unlimited
+	Uses         int       `json:"uses"`
+	CreatedBy    string    `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+	Link         string    `json:"link"` // Relative to the app root
+}
+
+// ReferralStats summarises who a user has brought in
+type ReferralStats struct {
+	Code         string `json:"code"`
+	Link         string `json:"link"`
+	Invited      int    `json:"invited"`    // Users who signed up with the code
+	Registered   int    `json:"registered"` // ... and went on to register a profile
+	Organization string `json:"organization,omitempty"`
+}
+
+func inviteLink(code string) string {
+	return "invite?code=" + code
+}
+
+// newInviteCode returns 8 characters that are easy to read out or type
+func newInviteCode() string {
+	b := make([]byte, 5)
+	rand.Read(b)
+	return base32.StdEncoding.EncodeToString(b)
+}
+
+func (app *App) createInviteCode(c *InviteCode) error {
+	c.Code = newInviteCode()
+	c.CreatedAt = time.Now()
+	c.Link = inviteLink(c.Code)
+	err := app.db.Exec(`
+		INSERT INTO invite_codes (code, owner, organization, max_uses, uses, created_by, created_at)
+		VALUES (?, ?, ?, ?, 0, ?, ?)
+	`, c.Code, c.Owner, c.Organization, c.MaxUses, c.CreatedBy, c.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create invite code: %v", err)
+	}
+	return nil
+}
+
+func (app *App) queryInviteCodes(query string, args ...interface{}) ([]InviteCode, error) {
+	result, err := app.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invite codes: %v", err)
+	}
+	defer result.Close()
+
+	var codes []InviteCode
+	err = result.Iterate(func(r *chai.Row) error {
+		var c InviteCode
+		if err := r.Scan(&c.Code, &c.Owner, &c.Organization, &c.MaxUses, &c.Uses,
+			&c.CreatedBy, &c.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan invite code: %v", err)
+		}
+		c.Link = inviteLink(c.Code)
+		codes = append(codes, c)
+		return nil
+	})
+	return codes, err
+}
+
+// InviteCodeFor returns a user's personal invite code, creating it on first use
+func (app *App) InviteCodeFor(email string) (*InviteCode, error) {
+	codes, err := app.queryInviteCodes(`
+		SELECT code, owner, organization, max_uses, uses, created_by, created_at
+		FROM invite_codes
+		WHERE owner = ?
+	`, email)
+	if err != nil {
+		return nil, err
+	}
+	if len(codes) > 0 {
+		return &codes[0], nil
+	}
+	c := &InviteCode{Owner: email, CreatedBy: email}
+	if err := app.createInviteCode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CreateBulkInvites generates count codes that each sign someone up to
+// organization, usable maxUses times apiece
+func (app *App) CreateBulkInvites(organization string, count, maxUses int, admin string) ([]InviteCode, error) {
+	if organization == "" {
+		return nil, fmt.Errorf("organization is required")
+	}
+	if count < 1 || count > 1000 {
+		return nil, fmt.Errorf("count must be between 1 and 1000")
+	}
+	codes := make([]InviteCode, count)
+	for i := range codes {
+		codes[i] = InviteCode{Organization: organization, MaxUses: maxUses, CreatedBy: admin}
+		if err := app.createInviteCode(&codes[i]); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// OrganizationInvites lists the codes generated for an organization
+func (app *App) OrganizationInvites(organization string) ([]InviteCode, error) {
+	return app.queryInviteCodes(`
+		SELECT code, owner, organization, max_uses, uses, created_by, created_at
+		FROM invite_codes
+		WHERE organization = ?
+		ORDER BY created_at
+	`, organization)
+}
+
+// RedeemInvite records that email signed up with code. Only new users can
+// be referred, and only once; anyone else is ignored without error.
+func (app *App) RedeemInvite(email, code string) error {
+	if app.userRole(email) != "unknown" {
+		return nil
+	}
+	return app.withTx(func(tx *chai.Tx) error {
+		referred, err := rowExists(tx, "SELECT 1 FROM referrals WHERE invitee = ?", email)
+		if err != nil || referred {
+			return err
+		}
+		result, err := tx.Query(`
+			SELECT owner, organization, max_uses, uses FROM invite_codes WHERE code = ?
+		`, code)
+		if err != nil {
+			return fmt.Errorf("failed to query invite code: %v", err)
+		}
+		defer result.Close()
+
+		var owner, organization string
+		var maxUses, uses int
+		found := false
+		err = result.Iterate(func(r *chai.Row) error {
+			found = true
+			return r.Scan(&owner, &organization, &maxUses, &uses)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan invite code: %v", err)
+		}
+		switch {
+		case !found:
+			return fmt.Errorf("invalid invite code")
+		case owner == email:
+			return fmt.Errorf("cannot use your own invite code")
+		case maxUses > 0 && uses >= maxUses:
+			return fmt.Errorf("invite code has been used up")
+		}
+
+		now := time.Now()
+		err = tx.Exec(`
+			INSERT INTO referrals (invitee, code, inviter, organization, created_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, email, code, owner, organization, now)
+		if err != nil {
+			return fmt.Errorf("failed to record referral: %v", err)
+		}
+		if err := tx.Exec("UPDATE invite_codes SET uses = uses + 1 WHERE code = ?", code); err != nil {
+			return fmt.Errorf("failed to count invite use: %v", err)
+		}
+		if organization != "" {
+			err = tx.Exec(`
+				INSERT INTO organization_members (email, organization, created_at)
+				VALUES (?, ?, ?)
+				ON CONFLICT DO NOTHING
+			`, email, organization, now)
+			if err != nil {
+				return fmt.Errorf("failed to join organization: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// OrganizationOf returns the organization a user joined through, if any
+func (app *App) OrganizationOf(email string) (string, error) {
+	result, err := app.db.Query("SELECT organization FROM organization_members WHERE email = ?", email)
+	if err != nil {
+		return "", fmt.Errorf("failed to query organization: %v", err)
+	}
+	defer result.Close()
+
+	var organization string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&organization)
+	})
+	return organization, err
+}
+
+// ReferralStatsFor returns a user's invite code and how many people it brought in
+func (app *App) ReferralStatsFor(email string) (*ReferralStats, error) {
+	code, err := app.InviteCodeFor(email)
+	if err != nil {
+		return nil, err
+	}
+	stats := &ReferralStats{Code: code.Code, Link: code.Link}
+	if stats.Organization, err = app.OrganizationOf(email); err != nil {
+		return nil, err
+	}
+
+	result, err := app.db.Query("SELECT invitee FROM referrals WHERE inviter = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query referrals: %v", err)
+	}
+	defer result.Close()
+
+	var invitees []string
+	err = result.Iterate(func(r *chai.Row) error {
+		var invitee string
+		if err := r.Scan(&invitee); err != nil {
+			return fmt.Errorf("failed to scan referral: %v", err)
+		}
+		invitees = append(invitees, invitee)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats.Invited = len(invitees)
+	for _, invitee := range invitees {
+		if app.userRole(invitee) != "unknown" {
+			stats.Registered++
+		}
+	}
+	return stats, nil
+}
+
+const inviteTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - You're invited</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>You're invited to {{(brand).Name}}</h1>
+            <div class="app-description">{{(brand).Tagline}}</div>
+        </div>
+        <form method="GET" action="./" class="message-form">
+            <input type="hidden" name="invite" value="{{.Code}}">
+            <input type="email" name="email" placeholder="Your email address" class="message-input" required>
+            <button type="submit" class="send-button">Get started</button>
+        </form>
+    </div>
+</body>
+</html>
+`
+
+// handleInvite is where invite links land; it asks for an email and passes
+// the code on to the chat page, which redeems it
+func handleInvite(w http.ResponseWriter, r *http.Request) {
+	renderTemplate(w, "invite", inviteTemplate, struct{ Code string }{r.FormValue("code")})
+}
+
+// redeemInviteParam redeems the invite code a chat page visit carries, if any
+func redeemInviteParam(r *http.Request, email string) {
+	code := r.URL.Query().Get("invite")
+	if code == "" {
+		return
+	}
+	if err := chatRoom.RedeemInvite(email, code); err != nil {
+		log.Printf("Error redeeming invite %s for %s: %v", code, email, err)
+	}
+}
+
+// handleReferralsAPI returns a user's invite code and referral counts
+func handleReferralsAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	stats, err := chatRoom.ReferralStatsFor(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONCached(w, r, stats, time.Time{})
+}
+
+// handleInvitesAPI lists an organization's codes (GET with organization) and
+// generates a batch from a JSON body {"organization", "count", "max_uses"} (POST)
+func handleInvitesAPI(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		codes, err := chatRoom.OrganizationInvites(r.FormValue("organization"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, codes)
+
+	case "POST":
+		var req struct {
+			Organization string `json:"organization"`
+			Count        int    `json:"count"`
+			MaxUses      int    `json:"max_uses"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		codes, err := chatRoom.CreateBulkInvites(req.Organization, req.Count, req.MaxUses, admin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, codes)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
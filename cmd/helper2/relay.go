@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+const relaySchema = `
+	CREATE TABLE IF NOT EXISTS user_phones (
+		email TEXT PRIMARY KEY,
+		phone_number TEXT,
+		updated_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS match_relays (
+		caregiver_email TEXT,
+		patient_email TEXT,
+		session_sid TEXT,
+		caregiver_proxy TEXT,
+		patient_proxy TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (caregiver_email, patient_email)
+	)
+`
+
+// MatchRelay is the proxy session carrying calls and texts for an active
+// match. Each side dials its own proxy number and reaches the other side
+// without either personal number being revealed.
+type MatchRelay struct {
+	CaregiverEmail string    `json:"caregiver_email"`
+	PatientEmail   string    `json:"patient_email"`
+	SessionSID     string    `json:"session_sid"`
+	CaregiverProxy string    `json:"caregiver_proxy"`
+	PatientProxy   string    `json:"patient_proxy"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// relayParticipant is one phone joining a relay session
+type relayParticipant struct {
+	Name  string
+	Phone string
+}
+
+// relayProvider opens and closes masked phone sessions between two people.
+// OpenSession returns the session id and the proxy number handed to each
+// participant, in order.
+type relayProvider interface {
+	OpenSession(name string, a, b relayParticipant) (sid string, proxies [2]string, err error)
+	CloseSession(sid string) error
+}
+
+// twilioProxy is a relayProvider backed by the Twilio Proxy API
+type twilioProxy struct {
+	accountSID string
+	authToken  string
+	serviceSID string
+	client     *http.Client
+}
+
+// newRelayProvider returns the configured relay provider, or nil if phone
+// relays are not set up
+func newRelayProvider() relayProvider {
+	accountSID := os.Getenv("TWILIO_ACCOUNT_SID")
+	authToken := os.Getenv("TWILIO_AUTH_TOKEN")
+	serviceSID := os.Getenv("TWILIO_PROXY_SERVICE_SID")
+	if accountSID == "" || authToken == "" || serviceSID == "" {
+		return nil
+	}
+	return &twilioProxy{
+		accountSID: accountSID,
+		authToken:  authToken,
+		serviceSID: serviceSID,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// call sends a form-encoded request to the Proxy service and decodes the
+// JSON response into out, if given
+func (t *twilioProxy) call(method, path string, form url.Values, out interface{}) error {
+	endpoint := fmt.Sprintf("https://proxy.twilio.com/v1/Services/%s%s", t.serviceSID, path)
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	request, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	request.SetBasicAuth(t.accountSID, t.authToken)
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := t.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to make proxy request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("proxy request failed with status %d: %s", resp.StatusCode, respBody)
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("failed to decode proxy response: %v", err)
+		}
+	}
+	return nil
+}
+
+func (t *twilioProxy) OpenSession(name string, a, b relayParticipant) (string, [2]string, error) {
+	var proxies [2]string
+	var session struct {
+		SID string `json:"sid"`
+	}
+	err := t.call("POST", "/Sessions", url.Values{
+		"UniqueName": {name},
+		"Mode":       {"message-and-voice"},
+	}, &session)
+	if err != nil {
+		return "", proxies, err
+	}
+
+	for i, p := range []relayParticipant{a, b} {
+		var participant struct {
+			ProxyIdentifier string `json:"proxy_identifier"`
+		}
+		err := t.call("POST", "/Sessions/"+session.SID+"/Participants", url.Values{
+			"Identifier":   {p.Phone},
+			"FriendlyName": {p.Name},
+		}, &participant)
+		if err != nil {
+			// Don't leave a half-built session holding numbers from the pool
+			if closeErr := t.CloseSession(session.SID); closeErr != nil {
+				log.Printf("Error closing relay session %s: %v", session.SID, closeErr)
+			}
+			return "", proxies, err
+		}
+		proxies[i] = participant.ProxyIdentifier
+	}
+	return session.SID, proxies, nil
+}
+
+func (t *twilioProxy) CloseSession(sid string) error {
+	return t.call("DELETE", "/Sessions/"+sid, nil, nil)
+}
+
+// SetPhoneNumber stores the number used to reach a user through relays.
+// Patients give one at registration; caregivers give one here.
+func (app *App) SetPhoneNumber(email, phone string) error {
+	phone, err := normalizePhone(phone)
+	if err != nil {
+		return err
+	}
+	err = app.db.Exec(`
+		INSERT INTO user_phones (email, phone_number, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, phone, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store phone number: %v", err)
+	}
+	return nil
+}
+
+// PhoneNumberFor returns a user's phone number, or "" if none is known
+func (app *App) PhoneNumberFor(email string) (string, error) {
+	result, err := app.db.Query("SELECT phone_number FROM user_phones WHERE email = ?", email)
+	if err != nil {
+		return "", fmt.Errorf("failed to query phone number: %v", err)
+	}
+	defer result.Close()
+
+	var phone string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&phone)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to scan phone number: %v", err)
+	}
+	if phone != "" {
+		return phone, nil
+	}
+
+	patient, err := app.GetPatient(email)
+	if err != nil {
+		return "", err
+	}
+	if patient != nil {
+		return patient.PhoneNumber, nil
+	}
+	return "", nil
+}
+
+// GetMatchRelay returns the open relay for a match, or nil if there is none
+func (app *App) GetMatchRelay(caregiverEmail, patientEmail string) (*MatchRelay, error) {
+	result, err := app.db.Query(`
+		SELECT caregiver_email, patient_email, session_sid, caregiver_proxy, patient_proxy, created_at
+		FROM match_relays
+		WHERE caregiver_email = ? AND patient_email = ?
+	`, caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query match relay: %v", err)
+	}
+	defer result.Close()
+
+	var relay *MatchRelay
+	err = result.Iterate(func(r *chai.Row) error {
+		var m MatchRelay
+		if err := r.Scan(&m.CaregiverEmail, &m.PatientEmail, &m.SessionSID,
+			&m.CaregiverProxy, &m.PatientProxy, &m.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan match relay: %v", err)
+		}
+		relay = &m
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return relay, nil
+}
+
+// OpenMatchRelay creates a relay session for a match if it doesn't have one
+func (app *App) OpenMatchRelay(caregiverEmail, patientEmail string) error {
+	if app.relay == nil {
+		return nil
+	}
+	existing, err := app.GetMatchRelay(caregiverEmail, patientEmail)
+	if err != nil || existing != nil {
+		return err
+	}
+
+	caregiverPhone, err := app.PhoneNumberFor(caregiverEmail)
+	if err != nil {
+		return err
+	}
+	patientPhone, err := app.PhoneNumberFor(patientEmail)
+	if err != nil {
+		return err
+	}
+	if caregiverPhone == "" || patientPhone == "" {
+		return fmt.Errorf("both parties need a phone number for a relay")
+	}
+
+	name := fmt.Sprintf("match:%s:%s", caregiverEmail, patientEmail)
+	sid, proxies, err := app.relay.OpenSession(name,
+		relayParticipant{Name: caregiverEmail, Phone: caregiverPhone},
+		relayParticipant{Name: patientEmail, Phone: patientPhone})
+	if err != nil {
+		return fmt.Errorf("failed to open relay session: %v", err)
+	}
+
+	err = app.db.Exec(`
+		INSERT INTO match_relays (
+			caregiver_email, patient_email, session_sid, caregiver_proxy, patient_proxy, created_at
+		) VALUES (?, ?, ?, ?, ?, ?)
+	`, caregiverEmail, patientEmail, sid, proxies[0], proxies[1], time.Now())
+	if err != nil {
+		if closeErr := app.relay.CloseSession(sid); closeErr != nil {
+			log.Printf("Error closing relay session %s: %v", sid, closeErr)
+		}
+		return fmt.Errorf("failed to store match relay: %v", err)
+	}
+	return nil
+}
+
+// CloseMatchRelay tears down a match's relay session, if it has one
+func (app *App) CloseMatchRelay(caregiverEmail, patientEmail string) error {
+	if app.relay == nil {
+		return nil
+	}
+	relay, err := app.GetMatchRelay(caregiverEmail, patientEmail)
+	if err != nil || relay == nil {
+		return err
+	}
+	if err := app.relay.CloseSession(relay.SessionSID); err != nil {
+		return fmt.Errorf("failed to close relay session: %v", err)
+	}
+	err = app.db.Exec("DELETE FROM match_relays WHERE caregiver_email = ? AND patient_email = ?",
+		caregiverEmail, patientEmail)
+	if err != nil {
+		return fmt.Errorf("failed to delete match relay: %v", err)
+	}
+	return nil
+}
+
+// syncMatchRelay opens a relay when a match becomes active and closes it
+// when the match ends. Relay failures are logged rather than blocking the
+// status change; the parties can still use consented contact details.
+func (app *App) syncMatchRelay(caregiverEmail, patientEmail, status string) {
+	var err error
+	switch status {
+	case MatchActive:
+		err = app.OpenMatchRelay(caregiverEmail, patientEmail)
+	case MatchEnded:
+		err = app.CloseMatchRelay(caregiverEmail, patientEmail)
+	}
+	if err != nil {
+		log.Printf("Error syncing relay for %s/%s: %v", caregiverEmail, patientEmail, err)
+	}
+}
+
+// relayNumberFor returns the proxy number viewer should use to reach the
+// other party of a match, or "" if the match has no relay
+func (app *App) relayNumberFor(caregiverEmail, patientEmail, viewer string) string {
+	relay, err := app.GetMatchRelay(caregiverEmail, patientEmail)
+	if err != nil {
+		log.Printf("Error loading match relay: %v", err)
+		return ""
+	}
+	if relay == nil {
+		return ""
+	}
+	if viewer == caregiverEmail {
+		return relay.CaregiverProxy
+	}
+	return relay.PatientProxy
+}
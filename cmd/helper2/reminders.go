@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Both sides of a booking are reminded of it ahead of time, on the
+// channels their notification preferences allow. Each user picks how long
+// before a visit they want reminding (a day and an hour by default). The
+// reminders job runs every minute: it creates the reminders for upcoming
+// bookings and sends those that are due. Every reminder is recorded, and
+// the link in it lets the user snooze it, to be sent again later, or
+// acknowledge it.
+
+const remindersSchema = `
+	CREATE TABLE IF NOT EXISTS reminder_settings (
+		email TEXT PRIMARY KEY,
+		lead_minutes TEXT,
+		updated_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS reminders (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		assignment_id INTEGER,
+		lead_minutes INTEGER,
+		due_at TIMESTAMP,
+		status TEXT,
+		sent_at TIMESTAMP,
+		snoozed_until TIMESTAMP,
+		acknowledged_at TIMESTAMP,
+		created_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_reminders_due ON reminders(due_at);
+	CREATE INDEX IF NOT EXISTS idx_reminders_email ON reminders(email)
+`
+
+// Reminder statuses
+const (
+	ReminderPending      = "pending"      // Waiting to be sent
+	ReminderSent         = "sent"         // Sent and not answered
+	ReminderSnoozed      = "snoozed"      // To be sent again at its due time
+	ReminderAcknowledged = "acknowledged" // The user saw it
+	ReminderSkipped      = "skipped"      // Not sent: too late, or the booking changed
+)
+
+// Limits on lead times, in minutes
+const (
+	minReminderLead = 5
+	maxReminderLead = 7 * 24 * 60
+	maxReminders    = 5
+)
+
+// reminderLeadChoices are the lead times the settings page offers
+var reminderLeadChoices = []int{7 * 24 * 60, 2 * 24 * 60, 24 * 60, 3 * 60, 60, 15}
+
+// Reminder is a reminder to one user of one booking
+type Reminder struct {
+	ID             string    `json:"id"`
+	Email          string    `json:"email"`
+	AssignmentID   int64     `json:"assignment_id"`
+	LeadMinutes    int       `json:"lead_minutes"`
+	DueAt          time.Time `json:"due_at"`
+	Status         string    `json:"status"`
+	SentAt         time.Time `json:"sent_at,omitempty"`
+	SnoozedUntil   time.Time `json:"snoozed_until,omitempty"`
+	AcknowledgedAt time.Time `json:"acknowledged_at,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// describeLead says how long a number of minutes is, for people
+func describeLead(minutes int) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case minutes >= 7*24*60 && minutes%(7*24*60) == 0:
+		return plural(minutes/(7*24*60), "week")
+	case minutes >= 48*60:
+		return plural((minutes+12*60)/(24*60), "day")
+	case minutes >= 120 || minutes%60 == 0 && minutes > 0:
+		return plural((minutes+30)/60, "hour")
+	}
+	return plural(minutes, "minute")
+}
+
+// ReminderLeads returns how many minutes before a booking a user is
+// reminded of it, longest first
+func (app *App) ReminderLeads(email string) ([]int, error) {
+	leads := append([]int(nil), config.Reminders.LeadMinutes...)
+	result, err := app.db.Query("SELECT lead_minutes FROM reminder_settings WHERE email = ?", email)
+	if err != nil {
+		return leads, fmt.Errorf("failed to query reminder settings: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		var stored string
+		if err := r.Scan(&stored); err != nil {
+			return fmt.Errorf("failed to scan reminder settings: %v", err)
+		}
+		leads = nil
+		return json.Unmarshal([]byte(stored), &leads)
+	})
+	sort.Sort(sort.Reverse(sort.IntSlice(leads)))
+	return leads, err
+}
+
+// SaveReminderLeads stores a user's lead times; none turns reminders off.
+// Reminders not sent yet for lead times they've dropped are skipped.
+func (app *App) SaveReminderLeads(email string, leads []int) error {
+	seen := map[int]bool{}
+	var kept []int
+	for _, lead := range leads {
+		if lead < minReminderLead || lead > maxReminderLead {
+			return fmt.Errorf("reminders can be from %d minutes to %s ahead", minReminderLead, describeLead(maxReminderLead))
+		}
+		if !seen[lead] {
+			seen[lead] = true
+			kept = append(kept, lead)
+		}
+	}
+	if len(kept) > maxReminders {
+		return fmt.Errorf("at most %d reminders per booking", maxReminders)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(kept)))
+
+	err := app.db.Exec(`
+		INSERT INTO reminder_settings (email, lead_minutes, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, string(mustMarshal(append([]int{}, kept...))), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store reminder settings: %v", err)
+	}
+
+	pending, err := app.queryReminders("WHERE email = ? AND status = ?", email, ReminderPending)
+	if err != nil {
+		return err
+	}
+	for _, r := range pending {
+		if !seen[r.LeadMinutes] {
+			if err := app.setReminderStatus(r.ID, ReminderSkipped); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const reminderColumns = "id, email, assignment_id, lead_minutes, due_at, status, sent_at, snoozed_until, acknowledged_at, created_at"
+
+// queryReminders returns the reminders matching a condition, by due time
+func (app *App) queryReminders(where string, args ...interface{}) ([]Reminder, error) {
+	result, err := app.db.Query("SELECT "+reminderColumns+" FROM reminders "+where+" ORDER BY due_at", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reminders: %v", err)
+	}
+	defer result.Close()
+
+	reminders := []Reminder{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var m Reminder
+		if err := r.Scan(&m.ID, &m.Email, &m.AssignmentID, &m.LeadMinutes, &m.DueAt, &m.Status, &m.SentAt,
+			&m.SnoozedUntil, &m.AcknowledgedAt, &m.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan reminder: %v", err)
+		}
+		reminders = append(reminders, m)
+		return nil
+	})
+	return reminders, err
+}
+
+// GetReminder returns a reminder, or nil
+func (app *App) GetReminder(id string) (*Reminder, error) {
+	reminders, err := app.queryReminders("WHERE id = ?", id)
+	if err != nil || len(reminders) == 0 {
+		return nil, err
+	}
+	return &reminders[0], nil
+}
+
+func (app *App) setReminderStatus(id, status string) error {
+	if err := app.db.Exec("UPDATE reminders SET status = ? WHERE id = ?", status, id); err != nil {
+		return fmt.Errorf("failed to update reminder: %v", err)
+	}
+	return nil
+}
+
+// getAssignment returns a booking, or nil
+func (app *App) getAssignment(id int64) (*Assignment, error) {
+	result, err := app.db.Query(`
+		SELECT id, caregiver_email, patient_email, start_time, end_time, status, created_at
+		FROM assignments WHERE id = ?
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query booking: %v", err)
+	}
+	defer result.Close()
+
+	var a *Assignment
+	err = result.Iterate(func(r *chai.Row) error {
+		var b Assignment
+		if err := r.Scan(&b.ID, &b.CaregiverEmail, &b.PatientEmail, &b.StartTime, &b.EndTime, &b.Status,
+			&b.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan booking: %v", err)
+		}
+		a = &b
+		return nil
+	})
+	return a, err
+}
+
+// SnoozeReminder sends a reminder again in some minutes (the configured
+// snooze if zero), as long as that's before the visit starts
+func (app *App) SnoozeReminder(id string, minutes int) (*Reminder, error) {
+	r, err := app.GetReminder(id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("no such reminder")
+	}
+	if r.Status != ReminderSent && r.Status != ReminderSnoozed {
+		return nil, fmt.Errorf("only a reminder that's been sent can be snoozed")
+	}
+	if minutes == 0 {
+		minutes = config.Reminders.SnoozeMinutes
+	}
+	if minutes < 1 {
+		return nil, fmt.Errorf("snooze for at least a minute")
+	}
+	booking, err := app.getAssignment(r.AssignmentID)
+	if err != nil {
+		return nil, err
+	}
+	until := time.Now().Add(time.Duration(minutes) * time.Minute)
+	if booking == nil || !until.Before(booking.StartTime) {
+		return nil, fmt.Errorf("the visit starts before then")
+	}
+	err = app.db.Exec("UPDATE reminders SET status = ?, snoozed_until = ?, due_at = ? WHERE id = ?",
+		ReminderSnoozed, until, until, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snooze reminder: %v", err)
+	}
+	r.Status, r.SnoozedUntil, r.DueAt = ReminderSnoozed, until, until
+	return r, nil
+}
+
+// AcknowledgeReminder records that the user saw a reminder; a snoozed
+// reminder isn't sent again
+func (app *App) AcknowledgeReminder(id string) (*Reminder, error) {
+	r, err := app.GetReminder(id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("no such reminder")
+	}
+	if r.Status == ReminderAcknowledged {
+		return r, nil
+	}
+	r.Status, r.AcknowledgedAt = ReminderAcknowledged, time.Now()
+	err = app.db.Exec("UPDATE reminders SET status = ?, acknowledged_at = ? WHERE id = ?", r.Status, r.AcknowledgedAt, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acknowledge reminder: %v", err)
+	}
+	return r, nil
+}
+
+// scheduleReminders creates the reminders for bookings starting within the
+// longest lead time. A reminder whose time had passed when the booking was
+// made is recorded as skipped: the booking confirmation covers it.
+func (app *App) scheduleReminders(now time.Time) error {
+	result, err := app.db.Query(`
+		SELECT id, caregiver_email, patient_email, start_time, end_time, status, created_at
+		FROM assignments WHERE status = 'scheduled' AND start_time > ? AND start_time <= ?
+	`, now, now.Add(maxReminderLead*time.Minute))
+	if err != nil {
+		return fmt.Errorf("failed to query upcoming bookings: %v", err)
+	}
+	var bookings []Assignment
+	err = result.Iterate(func(r *chai.Row) error {
+		var b Assignment
+		if err := r.Scan(&b.ID, &b.CaregiverEmail, &b.PatientEmail, &b.StartTime, &b.EndTime, &b.Status,
+			&b.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan booking: %v", err)
+		}
+		bookings = append(bookings, b)
+		return nil
+	})
+	result.Close()
+	if err != nil {
+		return err
+	}
+
+	leads := map[string][]int{}
+	for _, b := range bookings {
+		for _, email := range []string{b.CaregiverEmail, b.PatientEmail} {
+			if _, ok := leads[email]; !ok {
+				if leads[email], err = app.ReminderLeads(email); err != nil {
+					return err
+				}
+			}
+			for _, lead := range leads[email] {
+				due := b.StartTime.Add(-time.Duration(lead) * time.Minute)
+				if due.After(now) {
+					continue // Created once it's due, so a changed lead time applies
+				}
+				exists, err := rowExists(app.db, "SELECT 1 FROM reminders WHERE email = ? AND assignment_id = ? AND lead_minutes = ?",
+					email, b.ID, lead)
+				if err != nil {
+					return err
+				}
+				if exists {
+					continue
+				}
+				status := ReminderPending
+				if due.Before(b.CreatedAt) {
+					status = ReminderSkipped
+				}
+				err = app.db.Exec(`
+					INSERT INTO reminders (`+reminderColumns+`)
+					VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				`, newAttachmentID(), email, b.ID, lead, due, status, time.Time{}, time.Time{}, time.Time{}, now)
+				if err != nil {
+					return fmt.Errorf("failed to store reminder: %v", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sendReminders sends the pending and snoozed reminders that are due. One
+// held back by quiet hours is tried again on the next run, unless the
+// visit has started by then.
+func (app *App) sendReminders(now time.Time) error {
+	due, err := app.queryReminders("WHERE due_at <= ? AND (status = ? OR status = ?)", now, ReminderPending, ReminderSnoozed)
+	if err != nil {
+		return err
+	}
+	for _, r := range due {
+		booking, err := app.getAssignment(r.AssignmentID)
+		if err != nil {
+			return err
+		}
+		if booking == nil || booking.Status != "scheduled" || !booking.StartTime.After(now) {
+			if err := app.setReminderStatus(r.ID, ReminderSkipped); err != nil {
+				return err
+			}
+			continue
+		}
+
+		with := booking.CaregiverEmail
+		if r.Email == booking.CaregiverEmail {
+			with = booking.PatientEmail
+		}
+		reminderURL := fmt.Sprintf("%s/reminder?id=%s", config.Email.BaseURL, url.QueryEscape(r.ID))
+		err = app.Notify(Notification{
+			Email: r.Email,
+			Kind:  NotifyBookingReminder,
+			Data: map[string]interface{}{
+				"With":        app.displayName(with),
+				"Start":       booking.StartTime,
+				"End":         booking.EndTime,
+				"In":          describeLead(int(booking.StartTime.Sub(now).Round(time.Minute).Minutes())),
+				"ReminderURL": reminderURL,
+				"Snooze":      describeLead(config.Reminders.SnoozeMinutes),
+			},
+		})
+		if err == errQuietHours {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error sending reminder %s: %v", r.ID, err)
+		}
+		if err := app.db.Exec("UPDATE reminders SET status = ?, sent_at = ? WHERE id = ?", ReminderSent, now, r.ID); err != nil {
+			return fmt.Errorf("failed to update reminder: %v", err)
+		}
+	}
+	return nil
+}
+
+// reminderJob creates and sends booking reminders
+func (app *App) reminderJob() error {
+	now := time.Now()
+	if err := app.scheduleReminders(now); err != nil {
+		return err
+	}
+	return app.sendReminders(now)
+}
+
+const reminderTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Reminder</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Reminder</h1>
+        </div>
+        {{if .Error}}<div class="message system">{{.Error}}</div>{{end}}
+        {{with .Booking}}
+        <p>Your care visit with <strong>{{$.With}}</strong> is on {{.StartTime.Format "Monday, January 2"}} from {{.StartTime.Format "3:04 PM"}} to {{.EndTime.Format "3:04 PM"}}.</p>
+        {{end}}
+        {{with .Reminder}}
+        {{if eq .Status "acknowledged"}}
+        <p>Got it: you won't be reminded again by this reminder.</p>
+        {{else if eq .Status "snoozed"}}
+        <p>We'll remind you again at {{.SnoozedUntil.Format "3:04 PM on Jan 2"}}.</p>
+        {{end}}
+        {{if ne .Status "acknowledged"}}
+        <form method="POST" class="message-form">
+            <input type="hidden" name="id" value="{{.ID}}">
+            <button type="submit" name="action" value="acknowledge" class="send-button">Got it</button>
+            <button type="submit" name="action" value="snooze" class="send-button">Remind me in {{$.Snooze}}</button>
+        </form>
+        {{end}}
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// handleReminder serves the link in a reminder. The reminder's id is the
+// secret that authorizes it. GET shows it, and POST acknowledges
+// (action=acknowledge) or snoozes it (action=snooze, optionally minutes),
+// so link scanners that follow the link don't act on it.
+func handleReminder(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	var err error
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "acknowledge":
+			_, err = chatRoom.AcknowledgeReminder(id)
+		case "snooze":
+			minutes, _ := strconv.Atoi(r.FormValue("minutes"))
+			_, err = chatRoom.SnoozeReminder(id, minutes)
+		default:
+			err = fmt.Errorf("unknown action")
+		}
+	}
+
+	page := map[string]interface{}{"Snooze": describeLead(config.Reminders.SnoozeMinutes)}
+	if err != nil {
+		page["Error"] = err.Error()
+	}
+	reminder, lookupErr := chatRoom.GetReminder(id)
+	if lookupErr != nil {
+		http.Error(w, lookupErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reminder == nil {
+		http.Error(w, "No such reminder", http.StatusNotFound)
+		return
+	}
+	page["Reminder"] = reminder
+	if booking, err := chatRoom.getAssignment(reminder.AssignmentID); err == nil && booking != nil {
+		with := booking.CaregiverEmail
+		if reminder.Email == booking.CaregiverEmail {
+			with = booking.PatientEmail
+		}
+		page["Booking"], page["With"] = booking, chatRoom.displayName(with)
+	}
+	renderTemplate(w, "reminder", reminderTemplate, page)
+}
+
+// handleRemindersAPI returns a user's lead times and reminders from the
+// last week on (GET), replaces their lead times from {"lead_minutes":
+// [...]} (PUT), or acknowledges or snoozes one of their reminders (POST
+// with id and action, and optionally minutes)
+func handleRemindersAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		leads, err := chatRoom.ReminderLeads(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reminders, err := chatRoom.queryReminders("WHERE email = ? AND due_at >= ?", email, time.Now().AddDate(0, 0, -7))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"lead_minutes": leads, "reminders": reminders})
+
+	case "PUT":
+		var body struct {
+			LeadMinutes []int `json:"lead_minutes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.SaveReminderLeads(email, body.LeadMinutes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "POST":
+		reminder, err := chatRoom.GetReminder(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if reminder == nil || reminder.Email != email {
+			http.Error(w, "No such reminder", http.StatusNotFound)
+			return
+		}
+		switch r.FormValue("action") {
+		case "acknowledge":
+			reminder, err = chatRoom.AcknowledgeReminder(reminder.ID)
+		case "snooze":
+			minutes, _ := strconv.Atoi(r.FormValue("minutes"))
+			reminder, err = chatRoom.SnoozeReminder(reminder.ID, minutes)
+		default:
+			err = fmt.Errorf("action must be acknowledge or snooze")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, reminder)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
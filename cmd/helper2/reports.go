@@ -0,0 +1,669 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Users can report or block another user from a match card or their
+// message thread. A block works both ways: neither is matched with the
+// other again, and neither can send the other messages or contact
+// requests. A report joins the queue at /admin/reports with the latest
+// messages between the two, where an admin dismisses it, confirms it or
+// suspends the reported user (see accounts.go).
+
+const reportsSchema = `
+	CREATE TABLE IF NOT EXISTS blocks (
+		blocker TEXT,
+		blocked TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (blocker, blocked)
+	);
+	CREATE INDEX IF NOT EXISTS idx_blocks_blocked ON blocks(blocked);
+	CREATE TABLE IF NOT EXISTS reports (
+		id TEXT PRIMARY KEY,
+		reporter TEXT,
+		reported TEXT,
+		reason TEXT,
+		details TEXT,
+		context TEXT,
+		status TEXT,
+		created_at TIMESTAMP,
+		reviewed_by TEXT,
+		reviewed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_reports_reported ON reports(reported);
+	CREATE INDEX IF NOT EXISTS idx_reports_status ON reports(status)
+`
+
+// Report statuses
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportConfirmed = "confirmed" // The reported user broke the rules
+)
+
+// reportReason is one of the reasons a user can give for a report
+type reportReason struct {
+	Code  string
+	Label string
+}
+
+var reportReasons = []reportReason{
+	{"harassment", "Harassment or threats"},
+	{"inappropriate", "Inappropriate messages"},
+	{"scam", "Scam or asking for money"},
+	{"spam", "Spam"},
+	{"safety", "Worried about someone's safety"},
+	{"other", "Something else"},
+}
+
+// reportContextSize is how many of the latest messages between the two
+// users are kept with a report
+const reportContextSize = 20
+
+// maxReportDetails caps what a reporter can write about a report
+const maxReportDetails = 1000
+
+var errBlocked = errors.New("you can't message or contact this user")
+
+// Report is one user reporting another
+type Report struct {
+	ID         string           `json:"id"`
+	Reporter   string           `json:"reporter"`
+	Reported   string           `json:"reported"`
+	Reason     string           `json:"reason"`
+	Details    string           `json:"details,omitempty"`
+	Context    []HistoryMessage `json:"context,omitempty"` // The latest messages between the two when reported
+	Status     string           `json:"status"`
+	CreatedAt  time.Time        `json:"created_at"`
+	ReviewedBy string           `json:"reviewed_by,omitempty"`
+	ReviewedAt time.Time        `json:"reviewed_at,omitempty"`
+	Confirmed  int              `json:"confirmed_reports"` // Confirmed reports against the reported user, for spotting repeat offenders
+	Suspended  bool             `json:"suspended"`         // Whether the reported user is suspended
+}
+
+func validReportReason(code string) bool {
+	for _, r := range reportReasons {
+		if r.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Block stops blocked and blocker from being matched or messaging each
+// other, and turns down contact requests waiting between them
+func (app *App) Block(blocker, blocked string) error {
+	if !isUserRecipient(blocked) || blocked == blocker {
+		return fmt.Errorf("no such user")
+	}
+	now := time.Now()
+	err := app.withTx(func(tx *chai.Tx) error {
+		err := tx.Exec("INSERT INTO blocks (blocker, blocked, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+			blocker, blocked, now)
+		if err != nil {
+			return fmt.Errorf("failed to store block: %v", err)
+		}
+		for _, pair := range [][2]string{{blocker, blocked}, {blocked, blocker}} {
+			err := tx.Exec(`
+				UPDATE contact_requests SET status = ?, responded_at = ?
+				WHERE requester = ? AND recipient = ? AND status = ?
+			`, ContactDenied, now, pair[0], pair[1], ContactPending)
+			if err != nil {
+				return fmt.Errorf("failed to update contact request: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Match cards rendered before now still show the other user
+	app.invalidateToolCaches()
+	return nil
+}
+
+// Unblock lifts blocker's block on blocked
+func (app *App) Unblock(blocker, blocked string) error {
+	if err := app.db.Exec("DELETE FROM blocks WHERE blocker = ? AND blocked = ?", blocker, blocked); err != nil {
+		return fmt.Errorf("failed to remove block: %v", err)
+	}
+	app.invalidateToolCaches()
+	return nil
+}
+
+// HasBlocked reports whether blocker has blocked blocked
+func (app *App) HasBlocked(blocker, blocked string) bool {
+	exists, err := rowExists(app.db, "SELECT blocker FROM blocks WHERE blocker = ? AND blocked = ?", blocker, blocked)
+	if err != nil {
+		log.Printf("Error checking block: %v", err)
+	}
+	return exists
+}
+
+// Blocked reports whether either of a and b has blocked the other
+func (app *App) Blocked(a, b string) bool {
+	return app.HasBlocked(a, b) || app.HasBlocked(b, a)
+}
+
+// Blocks lists the users email has blocked
+func (app *App) Blocks(email string) ([]string, error) {
+	// chai can only sort rows whose whole primary key is selected
+	result, err := app.db.Query("SELECT blocker, blocked FROM blocks WHERE blocker = ? ORDER BY created_at", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocks: %v", err)
+	}
+	defer result.Close()
+
+	blocked := []string{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var b string
+		if err := r.ScanColumn("blocked", &b); err != nil {
+			return fmt.Errorf("failed to scan block: %v", err)
+		}
+		blocked = append(blocked, b)
+		return nil
+	})
+	return blocked, err
+}
+
+// unmatchable returns the users email mustn't be matched with: those
+// blocked either way, and everyone suspended or banned
+func (app *App) unmatchable(email string) (map[string]bool, error) {
+	excluded, err := app.restrictedAccounts()
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range []string{
+		"SELECT blocked FROM blocks WHERE blocker = ?",
+		"SELECT blocker FROM blocks WHERE blocked = ?",
+	} {
+		result, err := app.db.Query(q, email)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query blocks: %v", err)
+		}
+		err = result.Iterate(func(r *chai.Row) error {
+			var other string
+			if err := r.Scan(&other); err != nil {
+				return fmt.Errorf("failed to scan block: %v", err)
+			}
+			excluded[other] = true
+			return nil
+		})
+		result.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return excluded, nil
+}
+
+// withoutBlockedCaregivers drops caregivers a patient mustn't be matched with
+func (app *App) withoutBlockedCaregivers(patientEmail string, caregivers []Caregiver) ([]Caregiver, error) {
+	excluded, err := app.unmatchable(patientEmail)
+	if err != nil || len(excluded) == 0 {
+		return caregivers, err
+	}
+	kept := caregivers[:0]
+	for _, c := range caregivers {
+		if !excluded[c.Email] {
+			kept = append(kept, c)
+		}
+	}
+	return kept, nil
+}
+
+// withoutBlockedPatients drops patients a caregiver mustn't be matched with
+func (app *App) withoutBlockedPatients(caregiverEmail string, patients []Patient) ([]Patient, error) {
+	excluded, err := app.unmatchable(caregiverEmail)
+	if err != nil || len(excluded) == 0 {
+		return patients, err
+	}
+	kept := patients[:0]
+	for _, p := range patients {
+		if !excluded[p.Email] {
+			kept = append(kept, p)
+		}
+	}
+	return kept, nil
+}
+
+// ReportUser files reporter's report about reported, keeping the latest
+// messages between them for the admin who reviews it. Reporting someone
+// again while a report is open adds nothing new.
+func (app *App) ReportUser(reporter, reported, reason, details string) (*Report, error) {
+	if !isUserRecipient(reported) || reported == reporter {
+		return nil, fmt.Errorf("no such user")
+	}
+	if !validReportReason(reason) {
+		return nil, fmt.Errorf("unknown report reason %q", reason)
+	}
+	details = strings.TrimSpace(details)
+	if len(details) > maxReportDetails {
+		return nil, fmt.Errorf("details can be at most %d characters", maxReportDetails)
+	}
+
+	open, err := app.queryReports("WHERE reporter = ? AND reported = ? AND status = ?", reporter, reported, ReportOpen)
+	if err != nil {
+		return nil, err
+	}
+	if len(open) > 0 {
+		return &open[0], nil
+	}
+
+	page, err := app.MessagePage(reporter, reported, time.Time{}, reportContextSize)
+	if err != nil {
+		return nil, err
+	}
+	context, err := json.Marshal(page.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode report context: %v", err)
+	}
+
+	report := &Report{
+		ID:        newAttachmentID(),
+		Reporter:  reporter,
+		Reported:  reported,
+		Reason:    reason,
+		Details:   details,
+		Context:   page.Messages,
+		Status:    ReportOpen,
+		CreatedAt: time.Now(),
+	}
+	err = app.db.Exec(`
+		INSERT INTO reports (id, reporter, reported, reason, details, context, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, report.ID, reporter, reported, reason, details, string(context), ReportOpen, report.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store report: %v", err)
+	}
+
+	app.events.Publish(EventUserReported, map[string]interface{}{
+		"id":       report.ID,
+		"reporter": reporter,
+		"reported": reported,
+		"reason":   reason,
+	})
+	if err := app.AddMessageWithRecipient(reporter, "assistant",
+		fmt.Sprintf("Thanks for reporting %s. Our team will look into it.", reported), adminThread); err != nil {
+		log.Printf("Error confirming report to %s: %v", reporter, err)
+	}
+	return report, nil
+}
+
+const reportColumns = "id, reporter, reported, reason, details, context, status, created_at, reviewed_by, reviewed_at"
+
+// queryReports returns the reports matching a condition, oldest first
+func (app *App) queryReports(where string, args ...interface{}) ([]Report, error) {
+	result, err := app.db.Query("SELECT "+reportColumns+" FROM reports "+where+" ORDER BY created_at", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reports: %v", err)
+	}
+	defer result.Close()
+
+	var reports []Report
+	err = result.Iterate(func(r *chai.Row) error {
+		var report Report
+		var context string
+		if err := r.Scan(&report.ID, &report.Reporter, &report.Reported, &report.Reason, &report.Details, &context,
+			&report.Status, &report.CreatedAt, &report.ReviewedBy, &report.ReviewedAt); err != nil {
+			return fmt.Errorf("failed to scan report: %v", err)
+		}
+		if context != "" {
+			if err := json.Unmarshal([]byte(context), &report.Context); err != nil {
+				log.Printf("Error decoding context of report %s: %v", report.ID, err)
+			}
+		}
+		reports = append(reports, report)
+		return nil
+	})
+	return reports, err
+}
+
+// Reports lists reports with a status, oldest first, each with how often
+// the reported user has been reported before and confirmed
+func (app *App) Reports(status string) ([]Report, error) {
+	reports, err := app.queryReports("WHERE status = ?", status)
+	if err != nil {
+		return nil, err
+	}
+	confirmed := make(map[string]int)
+	for i := range reports {
+		email := reports[i].Reported
+		if _, ok := confirmed[email]; !ok {
+			if confirmed[email], err = app.ConfirmedReports(email); err != nil {
+				return nil, err
+			}
+		}
+		reports[i].Confirmed = confirmed[email]
+		reports[i].Suspended = app.Suspended(email)
+	}
+	return reports, nil
+}
+
+// ConfirmedReports counts the reports against email an admin confirmed
+func (app *App) ConfirmedReports(email string) (int, error) {
+	reports, err := app.queryReports("WHERE reported = ? AND status = ?", email, ReportConfirmed)
+	return len(reports), err
+}
+
+// ReviewReport closes an open report. "dismiss" finds nothing wrong,
+// "confirm" counts it against the reported user and "suspend" confirms it
+// and suspends them.
+func (app *App) ReviewReport(id, reviewer, action string) error {
+	status := ReportConfirmed
+	switch action {
+	case "dismiss":
+		status = ReportDismissed
+	case "confirm", "suspend":
+	default:
+		return fmt.Errorf("action must be dismiss, confirm or suspend")
+	}
+
+	reports, err := app.queryReports("WHERE id = ? AND status = ?", id, ReportOpen)
+	if err != nil {
+		return err
+	}
+	if len(reports) == 0 {
+		return fmt.Errorf("no open report %s", id)
+	}
+	report := reports[0]
+
+	err = app.db.Exec("UPDATE reports SET status = ?, reviewed_by = ?, reviewed_at = ? WHERE id = ?",
+		status, reviewer, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to review report: %v", err)
+	}
+	switch action {
+	case "suspend":
+		return app.Suspend(report.Reported, report.Reason, id, reviewer)
+	case "confirm":
+		return app.suspendRepeatOffender(report.Reported, id)
+	}
+	return nil
+}
+
+// formatReportBlock renders the report and block forms on a match card.
+// from is "thread" when shown on a message thread, to return there.
+func formatReportBlock(viewer, target, from string) string {
+	var options strings.Builder
+	for _, r := range reportReasons {
+		options.WriteString(fmt.Sprintf(`<option value="%s">%s</option>`, r.Code, template.HTMLEscapeString(r.Label)))
+	}
+	hidden := fmt.Sprintf(`<input type="hidden" name="email" value="%s">
+				<input type="hidden" name="target" value="%s">
+				<input type="hidden" name="from" value="%s">`,
+		template.HTMLEscapeString(viewer), template.HTMLEscapeString(target), template.HTMLEscapeString(from))
+	return fmt.Sprintf(`<details class="report-block"><summary>Report or block</summary>
+			<form class="schedule-form" action="report" method="POST">
+				%[1]s
+				<select name="reason" required>%[2]s</select>
+				<input type="text" name="details" placeholder="What happened? (optional)" maxlength="%[3]d">
+				<label><input type="checkbox" name="block" value="yes" checked> Also block</label>
+				<button type="submit">Report</button>
+			</form>
+			<form class="schedule-form" action="block" method="POST">
+				%[1]s
+				<button type="submit">Block</button>
+			</form>
+		</details>`, hidden, options.String(), maxReportDetails)
+}
+
+// reportBlockReturn is where the report and block forms go back to
+func reportBlockReturn(r *http.Request, email string) string {
+	if r.FormValue("from") == "thread" {
+		return "thread?email=" + url.QueryEscape(email) + "&peer=" + url.QueryEscape(r.FormValue("target"))
+	}
+	return "./?email=" + url.QueryEscape(email)
+}
+
+// handleBlock blocks target for email on POST, or lifts the block with
+// action=unblock
+func handleBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if impersonationFrom(r) != nil {
+		http.Error(w, "Only the user can block someone", http.StatusForbidden)
+		return
+	}
+	email, target := r.FormValue("email"), r.FormValue("target")
+	var err error
+	if r.FormValue("action") == "unblock" {
+		err = chatRoom.Unblock(email, target)
+	} else {
+		err = chatRoom.Block(email, target)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, reportBlockReturn(r, email), http.StatusSeeOther)
+}
+
+// handleReport files a report (email, target, reason, details) on POST,
+// and blocks target too when block is set
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if impersonationFrom(r) != nil {
+		http.Error(w, "Only the user can report someone", http.StatusForbidden)
+		return
+	}
+	email, target := r.FormValue("email"), r.FormValue("target")
+	if _, err := chatRoom.ReportUser(email, target, r.FormValue("reason"), r.FormValue("details")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("block") != "" {
+		if err := chatRoom.Block(email, target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	http.Redirect(w, r, reportBlockReturn(r, email), http.StatusSeeOther)
+}
+
+// handleBlocksAPI lists the users email has blocked (GET), blocks target
+// (POST) and lifts a block (DELETE with target)
+func handleBlocksAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	if r.Method != "GET" && impersonationFrom(r) != nil {
+		http.Error(w, "Only the user can block someone", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		blocked, err := chatRoom.Blocks(email)
+		if err != nil {
+			log.Printf("Error listing blocks for %s: %v", email, err)
+			http.Error(w, "Failed to list blocks", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, blocked)
+
+	case "POST", "DELETE":
+		var err error
+		if r.Method == "POST" {
+			err = chatRoom.Block(email, r.FormValue("target"))
+		} else {
+			err = chatRoom.Unblock(email, r.FormValue("target"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleReportsAPI files a report (POST with email, target, reason,
+// details and optionally block=yes) and returns its ID and status
+func handleReportsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if impersonationFrom(r) != nil {
+		http.Error(w, "Only the user can report someone", http.StatusForbidden)
+		return
+	}
+	email, target := r.FormValue("email"), r.FormValue("target")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	report, err := chatRoom.ReportUser(email, target, r.FormValue("reason"), r.FormValue("details"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("block") != "" {
+		if err := chatRoom.Block(email, target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, map[string]string{"id": report.ID, "status": report.Status})
+}
+
+const adminReportsTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Reports</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Reports</h1>
+            <div class="app-description">Users reported by other users</div>
+        </div>
+        {{range .Reports}}
+        <div class="calendar-event">
+            <strong>{{.Reporter}}</strong> reported <strong>{{.Reported}}</strong> for {{.Reason}} · {{.CreatedAt.Format "Jan 2 3:04 PM"}}
+            {{if .Confirmed}}<span class="unread-badge">{{.Confirmed}} confirmed before</span>{{end}}
+            {{if .Suspended}}<span class="unread-badge">suspended</span>{{end}}
+            {{with .Details}}<p>{{.}}</p>{{end}}
+            {{range .Context}}
+            <div class="message {{if eq .From $.Reporter}}user{{else}}assistant{{end}}">
+                <strong>{{.From}}:</strong> {{.Content}} <small>{{.CreatedAt.Format "Jan 2, 3:04 PM"}}</small>
+            </div>
+            {{else}}
+            <p>They haven't messaged each other.</p>
+            {{end}}
+            <form class="schedule-form" method="POST" action="reports">
+                <input type="hidden" name="email" value="{{$.UserEmail}}">
+                <input type="hidden" name="id" value="{{.ID}}">
+                <button type="submit" name="action" value="dismiss">Dismiss</button>
+                <button type="submit" name="action" value="confirm">Confirm</button>
+                <button type="submit" name="action" value="suspend">Confirm and suspend {{.Reported}}</button>
+            </form>
+        </div>
+        {{else}}
+        <p>No reports are open.</p>
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// applyReportAction reviews a report for an admin and audits it
+func applyReportAction(r *http.Request, actor, id, action string) error {
+	if err := chatRoom.ReviewReport(id, actor, action); err != nil {
+		return err
+	}
+	chatRoom.Audit(r, actor, "report."+action, id, "")
+	return nil
+}
+
+// handleAdminReports shows open reports and takes review actions
+func handleAdminReports(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	if r.Method == "POST" {
+		if err := applyReportAction(r, admin, r.FormValue("id"), r.FormValue("action")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "reports?email="+url.QueryEscape(admin), http.StatusSeeOther)
+		return
+	}
+
+	reports, err := chatRoom.Reports(ReportOpen)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, "reports", adminReportsTemplate, struct {
+		UserEmail string
+		Reports   []Report
+	}{admin, reports})
+}
+
+// handleAdminReportsAPI lists reports (GET, open ones unless status is
+// given) and reviews one from a JSON body {"id", "action":
+// "dismiss"|"confirm"|"suspend"} (POST)
+func handleAdminReportsAPI(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		status := r.FormValue("status")
+		if status == "" {
+			status = ReportOpen
+		}
+		reports, err := chatRoom.Reports(status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, reports)
+
+	case "POST":
+		var req struct {
+			ID     string `json:"id"`
+			Action string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := applyReportAction(r, actor, req.ID, req.Action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
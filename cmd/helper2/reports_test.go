@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBlocks(t *testing.T) {
+	app := newTestApp(t)
+	const email = "user@example.com"
+	for _, blocked := range []string{"first@example.com", "second@example.com", "third@example.com"} {
+		if err := app.Block(email, blocked); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Block("other@example.com", email); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Unblock(email, "second@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := app.Blocks(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"first@example.com", "third@example.com"}; !reflect.DeepEqual(blocks, want) {
+		t.Errorf("got %v, want %v", blocks, want)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+const legalHoldsSchema = `
+	CREATE TABLE IF NOT EXISTS legal_holds (
+		email TEXT PRIMARY KEY,
+		reason TEXT,
+		created_by TEXT,
+		created_at TIMESTAMP
+	)
+`
+
+// retentionTable names the columns a purge needs: whose row it is and how
+// old it is
+type retentionTable struct {
+	EmailColumn string
+	TimeColumn  string
+}
+
+// retentionTables lists the tables that retention policies may purge.
+// Profiles, matches and prompts are never aged out.
+var retentionTables = map[string]retentionTable{
+	"chat_history":        {"email", "created_at"},
+	"message_embeddings":  {"email", "created_at"},
+	"chat_turns":          {"email", "created_at"},
+	"experiment_turns":    {"email", "created_at"},
+	"llm_usage":           {"email", "created_at"},
+	"email_sends":         {"email", "created_at"},
+	"email_reply_threads": {"email", "created_at"},
+	"audit_log":           {"subject", "created_at"},
+	"profile_changes":     {"email", "created_at"},
+}
+
+// LegalHold exempts one user's rows from every retention policy
+type LegalHold struct {
+	Email     string    `json:"email"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PurgeReport describes one table's purge, or what it would do in a dry run
+type PurgeReport struct {
+	Table    string    `json:"table"`
+	Days     int       `json:"days"`
+	Cutoff   time.Time `json:"cutoff"`
+	Eligible int       `json:"eligible"` // rows older than the cutoff
+	Held     int       `json:"held"`     // of those, rows kept for legal holds
+	Deleted  int       `json:"deleted"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// PlaceLegalHold stops retention from purging email's data until released
+func (app *App) PlaceLegalHold(email, reason, actor string) error {
+	if email == "" {
+		return fmt.Errorf("email is required")
+	}
+	err := app.db.Exec(`
+		INSERT INTO legal_holds (email, reason, created_by, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, reason, actor, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to place legal hold: %v", err)
+	}
+	return nil
+}
+
+// ReleaseLegalHold lets retention purge email's data again
+func (app *App) ReleaseLegalHold(email string) error {
+	if err := app.db.Exec("DELETE FROM legal_holds WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to release legal hold: %v", err)
+	}
+	return nil
+}
+
+// ListLegalHolds returns every active legal hold
+func (app *App) ListLegalHolds() ([]LegalHold, error) {
+	result, err := app.db.Query("SELECT email, reason, created_by, created_at FROM legal_holds ORDER BY email")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query legal holds: %v", err)
+	}
+	defer result.Close()
+
+	var holds []LegalHold
+	err = result.Iterate(func(r *chai.Row) error {
+		var h LegalHold
+		if err := r.Scan(&h.Email, &h.Reason, &h.CreatedBy, &h.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan legal hold: %v", err)
+		}
+		holds = append(holds, h)
+		return nil
+	})
+	return holds, err
+}
+
+// purgeTable deletes rows in table older than days, skipping held users.
+// With dryRun set it only counts.
+func (app *App) purgeTable(table string, days int, held map[string]bool, dryRun bool) PurgeReport {
+	cols := retentionTables[table]
+	cutoff := time.Now().AddDate(0, 0, -days)
+	report := PurgeReport{Table: table, Days: days, Cutoff: cutoff}
+
+	result, err := app.db.Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s < ?",
+		cols.EmailColumn, table, cols.TimeColumn), cutoff)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to query %s: %v", table, err)
+		return report
+	}
+	perUser := make(map[string]int)
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		if err := r.Scan(&email); err != nil {
+			return err
+		}
+		perUser[email]++
+		return nil
+	})
+	result.Close()
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to iterate %s: %v", table, err)
+		return report
+	}
+
+	for email, n := range perUser {
+		report.Eligible += n
+		if held[email] {
+			report.Held += n
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		err := app.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ? AND %s < ?",
+			table, cols.EmailColumn, cols.TimeColumn), email, cutoff)
+		if err != nil {
+			report.Error = fmt.Sprintf("failed to purge %s for %s: %v", table, email, err)
+			return report
+		}
+		report.Deleted += n
+		if table == "chat_history" {
+			app.InvalidateSession(email)
+		}
+	}
+	return report
+}
+
+// PurgeExpired applies every configured retention policy. A policy of zero
+// days, or one naming a table retention doesn't know, is skipped.
+func (app *App) PurgeExpired(dryRun bool) ([]PurgeReport, error) {
+	holds, err := app.ListLegalHolds()
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[string]bool, len(holds))
+	for _, h := range holds {
+		held[h.Email] = true
+	}
+
+	tables := make([]string, 0, len(config.Retention.Days))
+	for table := range config.Retention.Days {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	var reports []PurgeReport
+	for _, table := range tables {
+		days := config.Retention.Days[table]
+		if days <= 0 {
+			continue
+		}
+		if _, ok := retentionTables[table]; !ok {
+			log.Printf("Retention policy for unknown table %s ignored", table)
+			continue
+		}
+		reports = append(reports, app.purgeTable(table, days, held, dryRun))
+		if table == "chat_history" {
+			reports = append(reports, app.purgeArchives(days, held, dryRun))
+		}
+	}
+	return reports, nil
+}
+
+// purgeJob is the scheduled retention purge
+func (app *App) purgeJob() error {
+	reports, err := app.PurgeExpired(false)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, r := range reports {
+		if r.Error != "" {
+			failed = append(failed, r.Table)
+			log.Printf("Retention %s: %s", r.Table, r.Error)
+		} else if r.Deleted > 0 || r.Held > 0 {
+			log.Printf("Retention %s: deleted %d rows older than %d days, %d held", r.Table, r.Deleted, r.Days, r.Held)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("purge failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// handleRetentionAPI reports what a purge would delete on GET, and runs one
+// on POST. POST with dry_run=true only reports.
+func handleRetentionAPI(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET", "POST":
+		dryRun := r.Method == "GET" || r.FormValue("dry_run") == "true"
+		reports, err := chatRoom.PurgeExpired(dryRun)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"dry_run": dryRun,
+			"tables":  reports,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleLegalHoldsAPI lists holds on GET, places one from a JSON body
+// {"email": ..., "reason": ...} on POST, and releases the hold named by the
+// target parameter on DELETE
+func handleLegalHoldsAPI(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		holds, err := chatRoom.ListLegalHolds()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, holds)
+
+	case "POST":
+		var req struct {
+			Email  string `json:"email"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.PlaceLegalHold(req.Email, req.Reason, admin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		if err := chatRoom.ReleaseLegalHold(r.FormValue("target")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
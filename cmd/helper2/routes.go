@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rfielding/helper2/internal/server"
+)
+
+// currentAPIVersion is the version served under /api/<version>/
+const currentAPIVersion = "v1"
+
+// newRouter builds the app's handler: every route on its own mux, wrapped
+// in the middleware chain. The app doesn't use the default mux, so debug
+// handlers that register themselves there are only served on the debug
+// address.
+func newRouter() http.Handler {
+	rt := server.NewRouter(currentAPIVersion)
+	// Chat turns call OpenAI and uploads fill storage, so one client can
+	// only send so many
+	limited := server.NewRateLimiter().Limit(httpRateLimit)
+
+	// Serve static files before other routes
+	rt.Mux.Handle("/static/", http.StripPrefix("/static/", staticHandler()))
+
+	// Pages. Those with a JSON form serve it instead when the request asks
+	// for JSON (see server.Negotiate).
+	rt.Handle("/", handleRoot)
+	rt.Handle("/chat", handleChat, pausedForMaintenance, limited)
+	rt.Handle("/chat/voice", handleVoiceMessage, pausedForMaintenance, limited)
+	rt.Handle("/chat/speech", handleSpeech, limited)
+	rt.Handle("/schedule", handleSchedule)
+	rt.Handle("/match", server.Negotiate(handleMatchDetail, handleMatchTimeline))
+	rt.Handle("/match/status", handleMatchStatus)
+	rt.Handle("/match/shifts", handleMatchShifts, limited)
+	rt.Handle("/match/rate", handleMatchRate, limited)
+	rt.Handle("/care-plan", handleCarePlan, limited)
+	rt.Handle("/journal", handleJournal, limited)
+	rt.Handle("/journal/export", handleJournalExport)
+	rt.Handle("/invoice", handleInvoice)
+	rt.Handle("/invoice/pdf", handleInvoicePDF)
+	rt.Handle("/contact/request", handleContactRequest, limited)
+	rt.Handle("/contact/respond", handleContactRespond)
+	rt.Handle("/block", handleBlock)
+	rt.Handle("/report", handleReport, limited)
+	rt.Handle("/export", handleExport)
+	rt.Handle("/export/saved", handleSavedExport)
+	rt.Handle("/avatar", handleAvatar)
+	rt.Handle("/attachments", handleAttachments, limited)
+	rt.Handle("/attachments/download", handleAttachmentDownload)
+	rt.Handle("/certifications", handleCertifications, limited)
+	rt.Handle("/background-check", handleBackgroundCheck, limited)
+	rt.Handle("/profile/fields", handleProfileFields)
+	rt.Handle("/profile/confirm", handleProfileConfirm)
+	rt.Handle("/profile/availability", handleAvailability)
+	rt.Handle("/profile/public", handlePublicProfileSetting)
+	rt.Handle("/c/", handlePublicProfile, pausedForMaintenance, limited)
+	rt.Handle("/directory", server.Negotiate(handleDirectory, handleDirectoryAPI))
+	rt.Handle("/sitemap.xml", handleSitemap)
+	rt.Handle("/robots.txt", handleRobots)
+	rt.Handle("/threads", handleThreads)
+	rt.Handle("/thread", handleThread, pausedForMaintenance, limited)
+	rt.Handle("/legal", handleLegal)
+	rt.Handle("/consent", handleConsent)
+	rt.Handle("/phone/verify", handlePhoneVerify, limited)
+	rt.Handle("/telegram/link", handleTelegramLink)
+	rt.Handle("/onboarding", handleOnboarding)
+	rt.Handle("/invite", handleInvite)
+	rt.Handle("/settings/notifications", server.Negotiate(handleNotificationSettings, handleNotificationPrefsAPI))
+	rt.Handle("/settings/calendar", server.Negotiate(handleCalendarSettings, handleCalendarFeedAPI))
+	rt.Handle("/favorites", server.Negotiate(handleFavorites, handleFavoritesAPI))
+	rt.Handle("/settings/google-calendar", handleGoogleCalendar)
+	rt.Handle("/oauth/google/callback", handleGoogleCallback)
+	rt.Handle("/unsubscribe", handleUnsubscribe)
+	rt.Handle("/login", handleLogin, limited)
+	rt.Handle("/login/verify", handleLoginVerify, limited)
+	rt.Handle("/logout", handleLogout)
+	rt.Handle("/reminder", handleReminder)      // The reminder's id authorizes it
+	rt.Handle("/calendar/", handleCalendarFeed) // The secret in the URL authorizes it
+
+	// APIs, under /api/v1
+	rt.API("/matches", handleMatches)
+	rt.API("/matches/timeline", handleMatchTimeline)
+	rt.API("/unread", handleUnread)
+	rt.API("/read", handleRead)
+	rt.API("/presence", handlePresenceAPI)
+	rt.API("/rate-benchmarks", handleRateBenchmarks)
+	rt.API("/referrals", handleReferralsAPI)
+	rt.API("/stream", handleStream)
+	rt.API("/typing", handleTyping)
+	rt.API("/delivered", handleDelivered)
+	rt.API("/notification-prefs", handleNotificationPrefsAPI)
+	rt.API("/calendar-feed", handleCalendarFeedAPI)
+	rt.API("/google-calendar", handleGoogleCalendarAPI, limited)
+	rt.API("/reminders", handleRemindersAPI)
+	rt.API("/waitlist", handleWaitlistAPI)
+	rt.API("/favorites", handleFavoritesAPI)
+	rt.API("/profile", handleProfileAPI)
+	rt.API("/profile/undo", handleProfileUndo)
+	rt.API("/threads", handleThreadsAPI)
+	rt.API("/direct-messages", handleDirectMessagesAPI, pausedForMaintenance, limited)
+	rt.API("/consents", handleConsentsAPI)
+	rt.API("/directory", handleDirectoryAPI)
+	rt.API("/blocks", handleBlocksAPI)
+	rt.API("/reports", handleReportsAPI, limited)
+	rt.API("/shifts", handleShiftsAPI, limited)
+	rt.API("/timesheets", handleTimesheetsAPI)
+	rt.API("/invoices", handleInvoicesAPI)
+	rt.API("/rate-offers", handleRateOffersAPI, limited)
+	rt.API("/care-plan", handleCarePlanAPI, limited)
+	rt.API("/care-plan/versions", handleCarePlanVersionsAPI)
+	rt.API("/visit-notes", handleVisitNotesAPI, limited)
+	rt.Handle("/api/v1/messages", handleMessagesAPI, server.APIVersion(currentAPIVersion))
+
+	// Provider callbacks, authorized by their own tokens
+	rt.Handle("/webhooks/email/sendgrid", handleSendGridWebhook)
+	rt.Handle("/webhooks/email/ses", handleSESWebhook)
+	rt.Handle("/webhooks/email/sendgrid/inbound", handleSendGridInbound)
+	rt.Handle("/webhooks/telegram", handleTelegramWebhook)
+	rt.Handle("/webhooks/whatsapp", handleWhatsAppWebhook)
+	rt.Handle("/webhooks/checkr", handleBackgroundCheckWebhook)
+
+	// Admin pages and APIs; requireAdminSession rejects everyone not signed
+	// in as an admin before the handler runs
+	admin := []server.Middleware{requireAdminSession}
+	rt.Handle("/admin/prompts", server.Negotiate(handleAdminPrompts, handlePromptsAPI), admin...)
+	rt.Handle("/admin/usage", server.Negotiate(handleAdminUsage, handleUsageAPI), admin...)
+	rt.Handle("/admin/users", handleAdminUsers, admin...)
+	rt.Handle("/admin/impersonate", handleImpersonate, admin...)
+	rt.Handle("/admin/live", server.Negotiate(handleAdminLive, handleHandoffsAPI), admin...)
+	rt.Handle("/admin/moderation", server.Negotiate(handleAdminModeration, handleModerationAPI), admin...)
+	rt.Handle("/admin/reports", server.Negotiate(handleAdminReports, handleAdminReportsAPI), admin...)
+	rt.Handle("/admin/analytics", server.Negotiate(handleAdminAnalytics, handleAnalyticsAPI), admin...)
+	rt.Handle("/admin/duplicates", server.Negotiate(handleAdminDuplicates, handleAdminDuplicatesAPI), admin...)
+	rt.API("/admin/prompts", handlePromptsAPI, admin...)
+	rt.API("/admin/experiments", handleExperimentsAPI, admin...)
+	rt.API("/admin/usage", handleUsageAPI, admin...)
+	rt.API("/admin/custom-fields", handleCustomFieldsAPI, admin...)
+	rt.API("/admin/invites", handleInvitesAPI, admin...)
+	rt.API("/admin/tags", handleTagsAPI, admin...)
+	rt.API("/admin/notes", handleNotesAPI, admin...)
+	rt.API("/admin/email-sends", handleEmailSendsAPI, admin...)
+	rt.API("/admin/export", handleTableExport, admin...)
+	rt.API("/admin/retention", handleRetentionAPI, admin...)
+	rt.API("/admin/legal-holds", handleLegalHoldsAPI, admin...)
+	rt.API("/admin/analytics", handleAnalyticsAPI, admin...)
+	rt.API("/admin/jobs", handleJobsAPI, admin...)
+	rt.API("/admin/signup-flags", handleSignupFlagsAPI, admin...)
+	rt.API("/admin/audit", handleAuditAPI, admin...)
+	rt.API("/admin/tools", handleToolsAPI, admin...)
+	rt.API("/admin/legal", handleLegalAPI, admin...)
+	rt.API("/admin/broadcasts", handleBroadcastsAPI, admin...)
+	rt.API("/admin/maintenance", handleMaintenanceAPI, admin...)
+	rt.API("/admin/certifications", handleCertificationsAPI, admin...)
+	rt.API("/admin/background-checks", handleBackgroundChecksAPI, admin...)
+	rt.API("/admin/escalations", handleEscalationsAPI, admin...)
+	rt.API("/admin/handoffs", handleHandoffsAPI, admin...)
+	rt.API("/admin/moderation", handleModerationAPI, admin...)
+	rt.API("/admin/strikes", handleStrikesAPI, admin...)
+	rt.API("/admin/reports", handleAdminReportsAPI, admin...)
+	rt.API("/admin/suspensions", handleSuspensionsAPI, admin...)
+	rt.API("/admin/shifts", handleAdminShiftsAPI, admin...)
+	rt.API("/admin/invoices", handleAdminInvoicesAPI, admin...)
+	rt.API("/admin/duplicates", handleAdminDuplicatesAPI, admin...)
+
+	// Health checks for load balancers
+	rt.Handle("/healthz", handleHealthz)
+	rt.Handle("/readyz", handleReadyz)
+
+	return server.Chain(rt.Mux, server.WithRequestID, server.WithLogging, withProblems, server.WithRecovery, server.CheckOrigin,
+		withLoginSession, withImpersonation, refuseBanned, server.WithJSONSuffix)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Request types used to route chat turns to a model
+const (
+	RequestSmallTalk  = "small_talk"
+	RequestToolCall   = "tool_call"
+	RequestExtraction = "extraction"
+	RequestDefault    = "default"
+)
+
+const chatTurnsSchema = `
+	CREATE TABLE IF NOT EXISTS chat_turns (
+		email TEXT,
+		created_at TIMESTAMP,
+		request_type TEXT,
+		model TEXT,
+		PRIMARY KEY (email, created_at)
+	)
+`
+
+// profileDataPattern spots messages that carry registration details: money,
+// phone numbers, hourly rates, or self-descriptions
+var profileDataPattern = regexp.MustCompile(`(?i)(\$\s?\d|\d{3}[-.\s]?\d{3}[-.\s]?\d{4}|per hour|/hour|\bi'?m\b|\bi am\b|\bmy name\b|located|years of experience|certified)`)
+
+// classifyRequest decides what kind of turn a message is. Extraction wins
+// over tool calls because storing profile data is the costliest mistake.
+func classifyRequest(message, role string) string {
+	lower := strings.ToLower(message)
+
+	if profileDataPattern.MatchString(message) || (role == "unknown" && len(message) > config.Models.SmallTalkMaxLength) {
+		return RequestExtraction
+	}
+	for _, keyword := range config.Models.ToolKeywords {
+		if strings.Contains(lower, strings.ToLower(keyword)) {
+			return RequestToolCall
+		}
+	}
+	if len(message) <= config.Models.SmallTalkMaxLength {
+		return RequestSmallTalk
+	}
+	return RequestDefault
+}
+
+// routeModel picks the configured model for a request type
+func routeModel(requestType string) string {
+	var model string
+	switch requestType {
+	case RequestSmallTalk:
+		model = config.Models.SmallTalk
+	case RequestToolCall:
+		model = config.Models.ToolCall
+	case RequestExtraction:
+		model = config.Models.Extraction
+	}
+	if model == "" {
+		model = config.Models.Default
+	}
+	if model == "" {
+		model = defaultChatModel
+	}
+	return model
+}
+
+// RecordChatTurn notes which model served a turn and why
+func (app *App) RecordChatTurn(email, requestType, model string) {
+	err := app.db.Exec(`
+		INSERT INTO chat_turns (email, created_at, request_type, model)
+		VALUES (?, ?, ?, ?)
+	`, email, time.Now(), requestType, model)
+	if err != nil {
+		log.Printf("Error recording chat turn for %s: %v", email, err)
+	}
+}
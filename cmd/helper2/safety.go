@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Messages users send, to the assistant or to each other, are screened for
+// signs that someone is at risk: self-harm, abuse or neglect, or a medical
+// emergency. Phrases that can only mean one thing are caught by rules.
+// Messages with just a hint of risk, like "fell" or "scared of", are put to
+// the extraction model to decide, when OpenAI is configured. A flagged
+// message gets a reply with where to find help straight away, and an
+// escalation is recorded and posted to the ops channel for someone to
+// follow up. One open escalation per user and risk is enough; later
+// messages still get the resources but don't raise it again.
+
+const safetyEscalationsSchema = `
+	CREATE TABLE IF NOT EXISTS safety_escalations (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		thread TEXT,
+		category TEXT,
+		source TEXT,
+		excerpt TEXT,
+		status TEXT,
+		created_at TIMESTAMP,
+		resolved_by TEXT,
+		resolved_at TIMESTAMP,
+		note TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_safety_escalations_status ON safety_escalations(status)
+`
+
+// Risk categories
+const (
+	RiskSelfHarm = "self_harm"
+	RiskAbuse    = "abuse"
+	RiskMedical  = "medical_emergency"
+	riskNone     = "none"
+)
+
+// maxRiskExcerpt caps how much of a flagged message an escalation keeps
+const maxRiskExcerpt = 500
+
+// Escalation statuses
+const (
+	EscalationOpen     = "open"
+	EscalationResolved = "resolved"
+)
+
+// riskRule lists the phrases that point to one kind of risk. Definite
+// phrases escalate on their own; possible ones need the classifier to
+// agree.
+type riskRule struct {
+	Category string
+	Definite []string
+	Possible []string
+}
+
+var riskRules = []riskRule{
+	{
+		Category: RiskSelfHarm,
+		Definite: []string{"kill myself", "end my life", "want to die", "hurt myself", "better off dead",
+			"take my own life", "don't want to live", "no reason to live"},
+		Possible: []string{"suicid", "self harm", "self-harm", "overdose", "can't go on", "give up on life",
+			"hopeless", "worthless"},
+	},
+	{
+		Category: RiskAbuse,
+		Definite: []string{"hits me", "beats me", "abusing me", "abuses me", "is hurting me", "stealing my money",
+			"locked me in", "threatened to hurt", "threatens to hurt"},
+		Possible: []string{"abuse", "hit me", "hurt me", "scared of", "afraid of", "neglect", "took my money",
+			"yells at me", "bruise", "threaten"},
+	},
+	{
+		Category: RiskMedical,
+		Definite: []string{"not breathing", "can't breathe", "cannot breathe", "heart attack", "having a stroke",
+			"unconscious", "unresponsive", "bleeding heavily", "won't wake up", "having a seizure"},
+		Possible: []string{"chest pain", "fell", "fallen", "collapsed", "choking", "bleeding", "seizure",
+			"stroke", "passed out", "emergency", "ambulance", "911"},
+	},
+}
+
+// defaultSafetyResources are the replies to each risk, unless the config
+// words them differently
+var defaultSafetyResources = map[string]string{
+	RiskSelfHarm: "I'm really sorry you're going through this, and you don't have to face it alone. " +
+		"If you might act on thoughts of hurting yourself, please call or text 988 (the Suicide & Crisis Lifeline) now, " +
+		"or call 911 if you're in immediate danger. Someone from our team has been told and will check in with you.",
+	RiskAbuse: "No one should be hurt, threatened or taken advantage of. If you're in danger right now, call 911. " +
+		"Adult Protective Services can be reached through the Eldercare Locator at 1-800-677-1116, " +
+		"and the National Domestic Violence Hotline at 1-800-799-7233. Someone from our team has been told and will follow up with you.",
+	RiskMedical: "If this is a medical emergency, call 911 or your local emergency number now; please don't wait for a reply here. " +
+		"Someone from our team has been told.",
+}
+
+const riskInstructions = `You screen messages sent to a service that matches caregivers with patients, looking for people at risk. Decide whether the writer, or someone they describe, is at risk now of:
+- self_harm: suicide or harming themselves
+- abuse: being abused, neglected, threatened or exploited
+- medical_emergency: a medical emergency needing urgent help
+Care needs described in general terms, past events that are over, and caregivers describing their experience are not risks. Reply with only a JSON object: {"category": "self_harm" | "abuse" | "medical_emergency" | "none"}.`
+
+// SafetyEscalation is a flagged message awaiting follow up
+type SafetyEscalation struct {
+	ID         string    `json:"id"`
+	Email      string    `json:"email"`
+	Thread     string    `json:"thread"` // "admin" for the assistant, or the peer a direct message went to
+	Category   string    `json:"category"`
+	Source     string    `json:"source"` // "rules" or "classifier"
+	Excerpt    string    `json:"excerpt"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	ResolvedBy string    `json:"resolved_by,omitempty"`
+	ResolvedAt time.Time `json:"resolved_at,omitempty"`
+	Note       string    `json:"note,omitempty"`
+}
+
+// riskLabel is how a risk category reads to people
+func riskLabel(category string) string {
+	switch category {
+	case RiskSelfHarm:
+		return "self-harm"
+	case RiskAbuse:
+		return "abuse"
+	case RiskMedical:
+		return "medical emergency"
+	}
+	return category
+}
+
+// safetyResources is the reply to a message flagged with a risk
+func safetyResources(category string) string {
+	if text := config.Safety.Resources[category]; text != "" {
+		return text
+	}
+	return defaultSafetyResources[category]
+}
+
+// ruleRisk matches text against the rules, returning the category of the
+// first definite match, or else of the first possible one
+func ruleRisk(text string) (category string, definite bool) {
+	text = strings.ToLower(strings.ReplaceAll(text, "’", "'"))
+	for _, rule := range riskRules {
+		for _, phrase := range rule.Definite {
+			if strings.Contains(text, phrase) {
+				return rule.Category, true
+			}
+		}
+	}
+	for _, rule := range riskRules {
+		for _, phrase := range rule.Possible {
+			if strings.Contains(text, phrase) {
+				return rule.Category, false
+			}
+		}
+	}
+	return "", false
+}
+
+// classifyRisk asks the extraction model whether text shows a risk,
+// returning "" for none
+func classifyRisk(email, text string) (string, error) {
+	model := config.Models.Extraction
+	resp, err := postChatCompletion(map[string]interface{}{
+		"model":           model,
+		"response_format": map[string]string{"type": "json_object"},
+		"messages": []Message{
+			{Role: "system", Content: riskInstructions},
+			{Role: "user", Content: text},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("no classification returned")
+	}
+	chatRoom.RecordUsage(email, model, resp)
+
+	var result struct {
+		Category string `json:"category"`
+	}
+	content := strings.TrimSpace(resp.Choices[0].Message.Content)
+	content = strings.TrimSuffix(strings.TrimPrefix(content, "```json"), "```")
+	if err := json.Unmarshal([]byte(strings.TrimSpace(content)), &result); err != nil {
+		return "", fmt.Errorf("failed to parse classification: %v", err)
+	}
+	switch result.Category {
+	case RiskSelfHarm, RiskAbuse, RiskMedical:
+		return result.Category, nil
+	case riskNone, "":
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown risk category %q", result.Category)
+}
+
+// assessRisk returns the risk a message shows, if any, and whether the
+// rules or the classifier found it. Without the classifier only definite
+// phrases count.
+func assessRisk(email, text string) (category, source string) {
+	category, definite := ruleRisk(text)
+	if category == "" || definite {
+		return category, "rules"
+	}
+	if os.Getenv("OPENAI_API_KEY") == "" {
+		return "", ""
+	}
+	classified, err := classifyRisk(email, text)
+	if err != nil {
+		log.Printf("Error classifying risk in a message from %s: %v", email, err)
+		return "", ""
+	}
+	return classified, "classifier"
+}
+
+// ScreenMessage checks a message a user sent for risk. A flagged message
+// gets the resources for its risk as a reply from the assistant, and opens
+// an escalation unless one is open already. It reports whether the message
+// was flagged.
+func (app *App) ScreenMessage(email, thread, message string) bool {
+	if !config.Safety.Screen {
+		return false
+	}
+	category, source := assessRisk(email, message)
+	if category == "" {
+		return false
+	}
+	if err := app.AddMessageWithRecipient(email, "assistant", safetyResources(category), adminThread); err != nil {
+		log.Printf("Error sending safety resources to %s: %v", email, err)
+	}
+	if err := app.escalate(email, thread, category, source, message); err != nil {
+		log.Printf("Error escalating %s risk for %s: %v", category, email, err)
+	}
+	if _, _, err := app.RequestHandoff(email, HandoffBySafety, category); err != nil {
+		log.Printf("Error requesting handoff for %s: %v", email, err)
+	}
+	return true
+}
+
+// escalate records an escalation and alerts ops, unless the user already
+// has one open for the same risk
+func (app *App) escalate(email, thread, category, source, message string) error {
+	open, err := rowExists(app.db, "SELECT id FROM safety_escalations WHERE email = ? AND category = ? AND status = ?",
+		email, category, EscalationOpen)
+	if err != nil {
+		return err
+	}
+	if open {
+		return nil
+	}
+	excerpt := message
+	if len(excerpt) > maxRiskExcerpt {
+		excerpt = excerpt[:maxRiskExcerpt]
+	}
+	id := newAttachmentID()
+	err = app.db.Exec(`
+		INSERT INTO safety_escalations (id, email, thread, category, source, excerpt, status,
+			created_at, resolved_by, resolved_at, note)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, '', ?, '')
+	`, id, email, thread, category, source, excerpt, EscalationOpen, time.Now(), time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to store escalation: %v", err)
+	}
+	log.Printf("Safety escalation %s: %s risk for %s", id, category, email)
+	// The message itself stays out of the event, which leaves the app
+	app.events.Publish(EventSafetyEscalated, map[string]interface{}{
+		"id":       id,
+		"email":    email,
+		"category": category,
+	})
+	return nil
+}
+
+// Escalations lists escalations with a status, newest first
+func (app *App) Escalations(status string) ([]SafetyEscalation, error) {
+	result, err := app.db.Query(`
+		SELECT id, email, thread, category, source, excerpt, status, created_at, resolved_by, resolved_at, note
+		FROM safety_escalations WHERE status = ? ORDER BY created_at DESC
+	`, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query escalations: %v", err)
+	}
+	defer result.Close()
+
+	var escalations []SafetyEscalation
+	err = result.Iterate(func(r *chai.Row) error {
+		var e SafetyEscalation
+		if err := r.Scan(&e.ID, &e.Email, &e.Thread, &e.Category, &e.Source, &e.Excerpt, &e.Status,
+			&e.CreatedAt, &e.ResolvedBy, &e.ResolvedAt, &e.Note); err != nil {
+			return fmt.Errorf("failed to scan escalation: %v", err)
+		}
+		escalations = append(escalations, e)
+		return nil
+	})
+	return escalations, err
+}
+
+// ResolveEscalation closes an open escalation once someone has followed up
+func (app *App) ResolveEscalation(id, actor, note string) error {
+	open, err := rowExists(app.db, "SELECT id FROM safety_escalations WHERE id = ? AND status = ?", id, EscalationOpen)
+	if err != nil {
+		return err
+	}
+	if !open {
+		return fmt.Errorf("no open escalation %s", id)
+	}
+	err = app.db.Exec("UPDATE safety_escalations SET status = ?, resolved_by = ?, resolved_at = ?, note = ? WHERE id = ?",
+		EscalationResolved, actor, time.Now(), note, id)
+	if err != nil {
+		return fmt.Errorf("failed to resolve escalation: %v", err)
+	}
+	return nil
+}
+
+// handleEscalationsAPI lists escalations (GET, open ones unless status is
+// given) and resolves one from a JSON body {"id", "note"} (POST)
+func handleEscalationsAPI(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		status := r.FormValue("status")
+		if status == "" {
+			status = EscalationOpen
+		}
+		escalations, err := chatRoom.Escalations(status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, escalations)
+
+	case "POST":
+		var req struct {
+			ID   string `json:"id"`
+			Note string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.ResolveEscalation(req.ID, actor, req.Note); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chatRoom.Audit(r, actor, "escalation.resolve", req.ID, req.Note)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
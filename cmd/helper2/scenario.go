@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chaisql/chai"
+)
+
+// Scenario is a scripted conversation between one or more users and the
+// assistant, with the tool calls and database state it should produce.
+// Scenarios are JSON files; each runs against a fresh in-memory database.
+type Scenario struct {
+	Name  string         `json:"name"`
+	Steps []ScenarioStep `json:"steps"`
+	// ExpectDB is checked after the last step
+	ExpectDB []DBAssertion `json:"expect_db"`
+}
+
+// ScenarioStep is one user message and what should follow from it
+type ScenarioStep struct {
+	Email   string `json:"email"`
+	Message string `json:"message"`
+	// ExpectCalls are the tools the model should call for this message, in
+	// order. Other calls in between are allowed.
+	ExpectCalls []string `json:"expect_calls"`
+	// ExpectReply is text the assistant's last reply should contain
+	ExpectReply string        `json:"expect_reply"`
+	ExpectDB    []DBAssertion `json:"expect_db"`
+}
+
+// DBAssertion runs a query and checks its result. Rows, if set, is the
+// number of rows expected; Equals, if set, is compared with the first
+// column of the first row.
+type DBAssertion struct {
+	Query  string        `json:"query"`
+	Args   []interface{} `json:"args"`
+	Rows   *int          `json:"rows"`
+	Equals interface{}   `json:"equals"`
+}
+
+// ScenarioResult reports one scenario. Failures is empty when it passed.
+type ScenarioResult struct {
+	Name     string   `json:"name"`
+	Steps    int      `json:"steps"`
+	Failures []string `json:"failures"`
+}
+
+// Passed reports whether every expectation held
+func (r ScenarioResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// LoadScenario reads a scenario file. Scenarios are JSON only; a YAML
+// file is refused by name rather than failing to parse.
+func LoadScenario(path string) (*Scenario, error) {
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		return nil, fmt.Errorf("scenario %s is YAML; scenarios must be JSON", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %v", err)
+	}
+	var s Scenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario %s: %v", path, err)
+	}
+	if s.Name == "" {
+		s.Name = path
+	}
+	return &s, nil
+}
+
+// RunScenario plays a scenario against a fresh in-memory app. The app
+// becomes chatRoom while it runs, since tool handlers reach it there. The
+// LLM is whatever openAIClient is set up to reach, so deterministic runs
+// need -offline or -replay-openai.
+func RunScenario(s *Scenario) ScenarioResult {
+	result := ScenarioResult{Name: s.Name}
+	app, err := openApp(":memory:", os.Getenv("OPENAI_API_KEY"))
+	if err != nil {
+		result.Failures = append(result.Failures, err.Error())
+		return result
+	}
+	defer app.Close()
+	previous := chatRoom
+	chatRoom = app
+	defer func() { chatRoom = previous }()
+
+	var calls []string
+	app.onToolCall = func(email, name string, args map[string]interface{}) {
+		calls = append(calls, name)
+	}
+
+	for i, step := range s.Steps {
+		result.Steps++
+		fail := func(format string, args ...interface{}) {
+			result.Failures = append(result.Failures, fmt.Sprintf("step %d (%s): %s", i+1, step.Email, fmt.Sprintf(format, args...)))
+		}
+
+		calls = nil
+		if err := app.RunChatTurn(step.Email, step.Message); err != nil {
+			fail("chat turn failed: %v", err)
+			continue
+		}
+		if missing := missingCalls(step.ExpectCalls, calls); len(missing) > 0 {
+			fail("expected calls %v, got %v", step.ExpectCalls, calls)
+		}
+		if step.ExpectReply != "" {
+			if reply := lastAssistantReply(app.GetUserMessages(step.Email, adminThread)); !strings.Contains(reply, step.ExpectReply) {
+				fail("expected reply containing %q, got %q", step.ExpectReply, reply)
+			}
+		}
+		for _, a := range step.ExpectDB {
+			if err := app.checkDBAssertion(a); err != nil {
+				fail("%v", err)
+			}
+		}
+	}
+	for _, a := range s.ExpectDB {
+		if err := app.checkDBAssertion(a); err != nil {
+			result.Failures = append(result.Failures, err.Error())
+		}
+	}
+	return result
+}
+
+// missingCalls returns the expected calls that weren't made in order
+func missingCalls(expected, got []string) []string {
+	j := 0
+	for i, name := range expected {
+		for j < len(got) && got[j] != name {
+			j++
+		}
+		if j == len(got) {
+			return expected[i:]
+		}
+		j++
+	}
+	return nil
+}
+
+func lastAssistantReply(history []Message) string {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == "assistant" {
+			return history[i].Content
+		}
+	}
+	return ""
+}
+
+func (app *App) checkDBAssertion(a DBAssertion) error {
+	result, err := app.db.Query(a.Query, a.Args...)
+	if err != nil {
+		return fmt.Errorf("%s: query failed: %v", a.Query, err)
+	}
+	defer result.Close()
+
+	rows := 0
+	var first interface{}
+	err = result.Iterate(func(r *chai.Row) error {
+		if rows == 0 {
+			if err := r.Scan(&first); err != nil {
+				return fmt.Errorf("failed to scan result: %v", err)
+			}
+		}
+		rows++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", a.Query, err)
+	}
+	if a.Rows != nil && rows != *a.Rows {
+		return fmt.Errorf("%s: expected %d rows, got %d", a.Query, *a.Rows, rows)
+	}
+	if a.Equals != nil && fmt.Sprint(first) != fmt.Sprint(a.Equals) {
+		return fmt.Errorf("%s: expected %v, got %v", a.Query, a.Equals, first)
+	}
+	return nil
+}
+
+// runScenarios is the "scenario" subcommand: it runs each file, prints a
+// line per scenario and reports whether they all passed
+func runScenarios(paths []string) bool {
+	if len(paths) == 0 {
+		fmt.Println("usage: helper2 [flags] scenario FILE.json...")
+		fmt.Println("Scenarios are JSON files (see scenarios/); YAML isn't supported.")
+		return false
+	}
+	passed := 0
+	for _, path := range paths {
+		s, err := LoadScenario(path)
+		if err != nil {
+			fmt.Printf("FAIL %s\n    %v\n", path, err)
+			continue
+		}
+		result := RunScenario(s)
+		if result.Passed() {
+			passed++
+			fmt.Printf("PASS %s (%d steps)\n", result.Name, result.Steps)
+			continue
+		}
+		fmt.Printf("FAIL %s\n", result.Name)
+		for _, f := range result.Failures {
+			fmt.Printf("    %s\n", f)
+		}
+	}
+	fmt.Printf("%d of %d scenarios passed\n", passed, len(paths))
+	return passed == len(paths)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestScenarios plays every scenario in the repository's scenarios
+// directory against the offline model
+func TestScenarios(t *testing.T) {
+	paths, err := filepath.Glob("../../scenarios/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no scenarios found")
+	}
+	t.Setenv("OPENAI_API_KEY", "")
+	previous := openAICircuit.next
+	openAICircuit.next = fakeOpenAI{}
+	defer func() { openAICircuit.next = previous }()
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			s, err := LoadScenario(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := RunScenario(s)
+			for _, f := range result.Failures {
+				t.Error(f)
+			}
+		})
+	}
+}
+
+func TestLoadScenarioRefusesYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.yaml")
+	if err := os.WriteFile(path, []byte("name: chat\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadScenario(path); err == nil || !strings.Contains(err.Error(), "must be JSON") {
+		t.Errorf("loading a YAML scenario: got %v, want a must-be-JSON error", err)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// jobLockTTL bounds how long a crashed instance can keep a job locked
+const jobLockTTL = 30 * time.Minute
+
+// jobHistoryLimit is how many past runs the jobs API returns per job
+const jobHistoryLimit = 10
+
+const schedulerSchema = `
+	CREATE TABLE IF NOT EXISTS job_locks (
+		name TEXT PRIMARY KEY,
+		holder TEXT,
+		slot TIMESTAMP,
+		expires_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS job_runs (
+		job TEXT,
+		started_at TIMESTAMP,
+		finished_at TIMESTAMP,
+		holder TEXT,
+		status TEXT,
+		error TEXT,
+		PRIMARY KEY (job, started_at)
+	)
+`
+
+// JobRun is one recorded execution of a scheduled job
+type JobRun struct {
+	Job        string    `json:"job"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Holder     string    `json:"holder"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// scheduledJob is a named task run on a cron schedule
+type scheduledJob struct {
+	Name     string
+	Spec     string
+	schedule *cronSchedule // nil when disabled
+	run      func() error
+}
+
+// Scheduler runs registered jobs on their cron schedules. A lock row per job
+// makes sure only one instance runs each scheduled slot.
+type Scheduler struct {
+	db     *instrumentedDB
+	holder string // identifies this instance in locks and run history
+	mu     sync.Mutex
+	jobs   map[string]*scheduledJob
+	// running counts jobs executing in this instance right now
+	running int
+	// onFailure, if set before Start, hears about every failed run
+	onFailure func(job string, err error)
+}
+
+func newScheduler(db *instrumentedDB) *Scheduler {
+	host, _ := os.Hostname()
+	return &Scheduler{
+		db:     db,
+		holder: fmt.Sprintf("%s-%d-%d", host, os.Getpid(), rand.Int63()),
+		jobs:   make(map[string]*scheduledJob),
+	}
+}
+
+// Register adds a job with a default cron expression. An entry in the
+// config's schedules overrides it; "off" disables the job.
+func (s *Scheduler) Register(name, spec string, run func() error) error {
+	if override, ok := config.Schedules[name]; ok {
+		spec = override
+	}
+	job := &scheduledJob{Name: name, Spec: spec, run: run}
+	if spec != "off" {
+		schedule, err := parseCron(spec)
+		if err != nil {
+			return fmt.Errorf("failed to schedule %s: %v", name, err)
+		}
+		job.schedule = schedule
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[name] = job
+	return nil
+}
+
+// Start checks the schedules at the top of every minute, forever
+func (s *Scheduler) Start() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+
+		s.mu.Lock()
+		var due []*scheduledJob
+		for _, job := range s.jobs {
+			if job.schedule != nil && job.schedule.Matches(next) {
+				due = append(due, job)
+			}
+		}
+		s.mu.Unlock()
+
+		if len(due) > 0 && InMaintenance() {
+			log.Printf("Skipping %d scheduled jobs during maintenance", len(due))
+			continue
+		}
+		for _, job := range due {
+			go s.runSlot(job, next)
+		}
+	}
+}
+
+// runSlot runs job for the scheduled minute slot unless another instance
+// already has
+func (s *Scheduler) runSlot(job *scheduledJob, slot time.Time) {
+	acquired, err := s.acquire(job.Name, slot)
+	if err != nil {
+		log.Printf("Error locking job %s: %v", job.Name, err)
+		return
+	}
+	if !acquired {
+		return
+	}
+	defer s.release(job.Name)
+	s.execute(job)
+}
+
+// RunNow runs a job immediately, still honouring its lock
+func (s *Scheduler) RunNow(name string) error {
+	s.mu.Lock()
+	job := s.jobs[name]
+	s.mu.Unlock()
+	if job == nil {
+		return fmt.Errorf("unknown job %s", name)
+	}
+	if InMaintenance() {
+		return fmt.Errorf("jobs are paused during maintenance")
+	}
+
+	acquired, err := s.acquire(name, time.Now())
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("job %s is already running", name)
+	}
+	defer s.release(name)
+	return s.execute(job)
+}
+
+func (s *Scheduler) execute(job *scheduledJob) error {
+	run := JobRun{Job: job.Name, StartedAt: time.Now(), Holder: s.holder, Status: "ok"}
+	s.mu.Lock()
+	s.running++
+	s.mu.Unlock()
+	err := job.run()
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+		log.Printf("Job %s failed: %v", job.Name, err)
+		if s.onFailure != nil {
+			s.onFailure(job.Name, err)
+		}
+	}
+
+	if dbErr := s.db.Exec(`
+		INSERT INTO job_runs (job, started_at, finished_at, holder, status, error)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, run.Job, run.StartedAt, run.FinishedAt, run.Holder, run.Status, run.Error); dbErr != nil {
+		log.Printf("Error recording run of job %s: %v", job.Name, dbErr)
+	}
+	return err
+}
+
+// Load reports how many jobs are registered and how many are running in
+// this instance
+func (s *Scheduler) Load() (registered, running int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs), s.running
+}
+
+// acquire takes the job's lock for slot. It fails if another instance holds
+// an unexpired lock or has already claimed the same slot.
+func (s *Scheduler) acquire(name string, slot time.Time) (bool, error) {
+	acquired := false
+	err := s.db.Update(func(tx *chai.Tx) error {
+		result, err := tx.Query("SELECT holder, slot, expires_at FROM job_locks WHERE name = ?", name)
+		if err != nil {
+			return fmt.Errorf("failed to query job lock: %v", err)
+		}
+		var holder string
+		var lastSlot, expiresAt time.Time
+		found := false
+		err = result.Iterate(func(r *chai.Row) error {
+			found = true
+			return r.Scan(&holder, &lastSlot, &expiresAt)
+		})
+		result.Close()
+		if err != nil {
+			return fmt.Errorf("failed to scan job lock: %v", err)
+		}
+
+		now := time.Now()
+		if found && (lastSlot.Equal(slot) || (expiresAt.After(now) && holder != s.holder)) {
+			return nil
+		}
+		err = tx.Exec(`
+			INSERT INTO job_locks (name, holder, slot, expires_at)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT DO REPLACE
+		`, name, s.holder, slot, now.Add(jobLockTTL))
+		if err != nil {
+			return fmt.Errorf("failed to store job lock: %v", err)
+		}
+		acquired = true
+		return nil
+	})
+	return acquired, err
+}
+
+// release expires our lock but keeps the slot, so other instances still
+// see that it has run
+func (s *Scheduler) release(name string) {
+	err := s.db.Exec("UPDATE job_locks SET expires_at = ? WHERE name = ? AND holder = ?",
+		time.Now(), name, s.holder)
+	if err != nil {
+		log.Printf("Error releasing lock for job %s: %v", name, err)
+	}
+}
+
+// JobRuns returns the most recent runs of a job, newest first
+func (s *Scheduler) JobRuns(name string, limit int) ([]JobRun, error) {
+	result, err := s.db.Query(`
+		SELECT job, started_at, finished_at, holder, status, error
+		FROM job_runs WHERE job = ?
+		ORDER BY started_at DESC
+		LIMIT ?
+	`, name, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query job runs: %v", err)
+	}
+	defer result.Close()
+
+	var runs []JobRun
+	err = result.Iterate(func(r *chai.Row) error {
+		var run JobRun
+		if err := r.Scan(&run.Job, &run.StartedAt, &run.FinishedAt, &run.Holder, &run.Status, &run.Error); err != nil {
+			return fmt.Errorf("failed to scan job run: %v", err)
+		}
+		runs = append(runs, run)
+		return nil
+	})
+	return runs, err
+}
+
+// JobStatus describes a registered job for the admin API
+type JobStatus struct {
+	Name    string    `json:"name"`
+	Spec    string    `json:"spec"`
+	NextRun time.Time `json:"next_run,omitempty"`
+	Runs    []JobRun  `json:"runs"`
+}
+
+// Status lists every registered job with its next run and recent history
+func (s *Scheduler) Status() ([]JobStatus, error) {
+	s.mu.Lock()
+	jobs := make([]*scheduledJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		runs, err := s.JobRuns(job.Name, jobHistoryLimit)
+		if err != nil {
+			return nil, err
+		}
+		status := JobStatus{Name: job.Name, Spec: job.Spec, Runs: runs}
+		if job.schedule != nil {
+			status.NextRun = job.schedule.Next(time.Now())
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// registerJobs schedules the app's periodic work
+func (app *App) registerJobs() error {
+	jobs := []struct {
+		name string
+		spec string
+		run  func() error
+	}{
+		{"retention_purge", "0 3 * * *", app.purgeJob},
+		{"chat_compaction", "30 2 * * *", app.compactionJob},
+		{"funnel_analytics", "@hourly", func() error {
+			_, err := app.RefreshFunnelReport()
+			return err
+		}},
+		{"match_recompute", "0 4 * * *", app.recomputeJob},
+		{"match_digest", "0 8 * * *", app.digestJob},
+		{"login_purge", "45 * * * *", app.loginPurgeJob},
+		{"pending_replies", "* * * * *", app.pendingRepliesJob},
+		{"cert_expiry", "0 9 * * *", app.certExpiryJob},
+		{"timesheets", "0 6 * * 1", app.timesheetJob},
+		{"invoices", "0 7 1 * *", app.invoiceJob},
+		{"google_calendar", "*/15 * * * *", app.googleCalendarJob},
+		{"reminders", "* * * * *", app.reminderJob},
+		{"duplicates", "30 5 * * *", app.duplicatesJob},
+		{"sitemap", "15 * * * *", func() error {
+			_, err := app.RefreshSitemap()
+			return err
+		}},
+		// Off unless a schedule is configured; see runDBCommand
+		{"db_maintenance", "off", app.maintenanceJob},
+	}
+	for _, job := range jobs {
+		if err := app.scheduler.Register(job.name, job.spec, job.run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleJobsAPI lists jobs with their recent runs on GET, and runs the job
+// named by the job parameter immediately on POST
+func handleJobsAPI(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		statuses, err := chatRoom.scheduler.Status()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, statuses)
+
+	case "POST":
+		if err := chatRoom.scheduler.RunNow(r.FormValue("job")); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Search engines find the public pages through /sitemap.xml, which lists
+// the directory, the directory for each location with caregivers listed,
+// and every public caregiver page. Building it reads every caregiver, so
+// the sitemap job builds it on a schedule and stores it, and requests serve
+// the stored copy. /robots.txt keeps crawlers to the public pages.
+
+const sitemapSchema = `
+	CREATE TABLE IF NOT EXISTS sitemaps (
+		name TEXT PRIMARY KEY,
+		body TEXT,
+		generated_at TIMESTAMP
+	)
+`
+
+// sitemapName is the sitemaps row the sitemap job writes
+const sitemapName = "sitemap.xml"
+
+// sitemapURL is one <url> entry
+type sitemapURL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod,omitempty"`
+	ChangeFreq string `xml:"changefreq,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// Title names a directory page after its location filter
+func (d *DirectoryPage) Title() string {
+	if d.Filter.Location != "" {
+		return "Caregivers in " + d.Filter.Location
+	}
+	return "Find a caregiver"
+}
+
+// Description summarises a directory page for search results and link
+// previews
+func (d *DirectoryPage) Description() string {
+	s := fmt.Sprintf("%d caregiver", d.Total)
+	if d.Total != 1 {
+		s += "s"
+	}
+	s += " taking new families"
+	if d.Filter.Location != "" {
+		s += " in " + d.Filter.Location
+	}
+	if len(d.Filter.Skills) > 0 {
+		s += ", skilled in " + strings.Join(d.Filter.Skills, ", ")
+	}
+	return s + " on " + config.Branding.Name + ". Compare experience, skills and rates."
+}
+
+// URL is the page's canonical address
+func (d *DirectoryPage) URL() string {
+	u := config.Email.BaseURL + "/directory"
+	if q := d.Filter.Query(d.Page); q != "" {
+		u += "?" + q
+	}
+	return u
+}
+
+// BuildSitemap renders the sitemap from the public pages in the database
+func (app *App) BuildSitemap() ([]byte, error) {
+	set := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	set.URLs = append(set.URLs, sitemapURL{Loc: config.Email.BaseURL + "/directory", ChangeFreq: "daily"})
+
+	listed, err := app.listDirectory(DirectoryFilter{})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, c := range listed {
+		location := strings.TrimSpace(c.Location)
+		if location == "" || seen[strings.ToLower(location)] {
+			continue
+		}
+		seen[strings.ToLower(location)] = true
+		page := DirectoryPage{Filter: DirectoryFilter{Location: location}, Page: 1}
+		set.URLs = append(set.URLs, sitemapURL{Loc: page.URL(), ChangeFreq: "daily"})
+	}
+
+	result, err := app.db.Query("SELECT slug, updated_at FROM public_profiles WHERE enabled = true")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query public profiles: %v", err)
+	}
+	defer result.Close()
+	err = result.Iterate(func(r *chai.Row) error {
+		var slug string
+		var updatedAt time.Time
+		if err := r.Scan(&slug, &updatedAt); err != nil {
+			return fmt.Errorf("failed to scan public profile: %v", err)
+		}
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:        PublicProfile{Slug: slug}.URL(),
+			LastMod:    updatedAt.UTC().Format("2006-01-02"),
+			ChangeFreq: "weekly",
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode sitemap: %v", err)
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+// RefreshSitemap builds the sitemap and stores it for requests to serve
+func (app *App) RefreshSitemap() ([]byte, error) {
+	body, err := app.BuildSitemap()
+	if err != nil {
+		return nil, err
+	}
+	err = app.db.Exec(`
+		INSERT INTO sitemaps (name, body, generated_at) VALUES (?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, sitemapName, string(body), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to store sitemap: %v", err)
+	}
+	return body, nil
+}
+
+// Sitemap returns the stored sitemap, building one if the job hasn't run
+// yet
+func (app *App) Sitemap() ([]byte, error) {
+	result, err := app.db.Query("SELECT body FROM sitemaps WHERE name = ?", sitemapName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sitemap: %v", err)
+	}
+	defer result.Close()
+
+	var body string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&body)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan sitemap: %v", err)
+	}
+	if body == "" {
+		return app.RefreshSitemap()
+	}
+	return []byte(body), nil
+}
+
+// handleSitemap serves /sitemap.xml
+func handleSitemap(w http.ResponseWriter, r *http.Request) {
+	body, err := chatRoom.Sitemap()
+	if err != nil {
+		log.Printf("Error serving sitemap: %v", err)
+		http.Error(w, "Failed to build sitemap", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write(body)
+}
+
+// handleRobots serves /robots.txt, which lets crawlers see the public
+// pages and nothing else
+func handleRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "User-agent: *\nAllow: /c/\nAllow: /directory\nDisallow: /\n\nSitemap: %s/sitemap.xml\n", config.Email.BaseURL)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// session caches a user's most recent messages. The database stays the
+// source of truth: writes go to chat_history first and are appended here
+// only once they have been stored.
+type session struct {
+	mu       sync.Mutex // Serializes loads and writes for one user
+	loaded   bool
+	thread   string // The active conversation, which messages come from
+	messages []Message
+	lastUsed time.Time
+}
+
+// getSession returns the session for email, creating an empty one if needed
+// and evicting the least recently used session when the cache is full.
+func (app *App) getSession(email string) *session {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	s, ok := app.sessions[email]
+	if !ok {
+		if len(app.sessions) >= app.maxSessions {
+			app.evictOldestSessionLocked()
+		}
+		s = &session{}
+		app.sessions[email] = s
+	}
+	s.lastUsed = time.Now()
+	return s
+}
+
+// evictOldestSessionLocked drops the least recently used session; app.mu must be held
+func (app *App) evictOldestSessionLocked() {
+	var oldestEmail string
+	var oldest time.Time
+	for email, s := range app.sessions {
+		if oldestEmail == "" || s.lastUsed.Before(oldest) {
+			oldestEmail, oldest = email, s.lastUsed
+		}
+	}
+	delete(app.sessions, oldestEmail)
+}
+
+// lockSession returns the session for email with its lock held. A session
+// that was invalidated or evicted while we waited for its lock may hold
+// what InvalidateSession meant to forget, so we drop it and lock the one
+// that replaced it instead.
+func (app *App) lockSession(email string) *session {
+	for {
+		s := app.getSession(email)
+		s.mu.Lock()
+		app.mu.Lock()
+		current := app.sessions[email] == s
+		app.mu.Unlock()
+		if current {
+			return s
+		}
+		s.mu.Unlock()
+	}
+}
+
+// InvalidateSession forgets the cached messages for email, so the next read
+// goes back to the database
+func (app *App) InvalidateSession(email string) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	delete(app.sessions, email)
+}
+
+// ensureLoaded fills the session from chat_history; s.mu must be held
+func (app *App) ensureLoaded(email string, s *session) error {
+	if s.loaded {
+		return nil
+	}
+	thread, err := app.ActiveThread(email)
+	if err != nil {
+		return err
+	}
+	messages, err := app.LoadChatHistory(email, thread)
+	if err != nil {
+		return err
+	}
+	s.thread = thread
+	s.messages = messages
+	s.loaded = true
+	return nil
+}
+
+// GetUserMessages returns a user's most recent messages in thread, at most
+// maxHistory of them, oldest first. The admin thread is the active
+// conversation with the assistant; any other thread is the direct messages
+// with that peer, where the peer's messages have the role "peer".
+func (app *App) GetUserMessages(email, thread string) []Message {
+	if thread != adminThread {
+		messages, err := app.PeerMessages(email, thread)
+		if err != nil {
+			log.Printf("Error loading messages between %s and %s: %v", email, thread, err)
+		}
+		return messages
+	}
+
+	s := app.lockSession(email)
+	defer s.mu.Unlock()
+
+	if err := app.ensureLoaded(email, s); err != nil {
+		log.Printf("Error loading chat history for %s: %v", email, err)
+		return nil
+	}
+	return append([]Message(nil), s.messages...)
+}
+
+// AddMessageWithRecipient adds a message to the chat history
+func (app *App) AddMessageWithRecipient(email, role, content, recipient string) error {
+	s := app.lockSession(email)
+	defer s.mu.Unlock()
+
+	// Direct messages aren't part of any conversation with the assistant
+	direct := isUserRecipient(recipient)
+	thread := s.thread
+	if direct {
+		thread = mainThread
+	} else if !s.loaded {
+		var err error
+		if thread, err = app.ActiveThread(email); err != nil {
+			return err
+		}
+	}
+
+	// Store in database
+	createdAt := time.Now()
+	err := app.db.Exec(`
+		INSERT INTO chat_history (
+			email, role, content, recipient, thread_id, created_at
+		) VALUES (?, ?, ?, ?, ?, ?)
+	`, email, role, content, recipient, thread, createdAt)
+	if err != nil {
+		return fmt.Errorf("failed to store message: %v", err)
+	}
+	if !direct {
+		app.onMessageStored(email, role, content, createdAt)
+	}
+	app.pushMessage(ChatHistoryEntry{
+		Email:     email,
+		Role:      role,
+		Content:   content,
+		Recipient: recipient,
+		Thread:    thread,
+		CreatedAt: createdAt,
+	})
+	app.events.Publish(EventMessageSent, map[string]interface{}{
+		"email":      email,
+		"role":       role,
+		"recipient":  recipient,
+		"created_at": createdAt,
+		"length":     len(content),
+	})
+
+	// Only a loaded session is a faithful tail of the history; an unloaded
+	// one will pick this message up from the database on first read.
+	if s.loaded && !direct {
+		s.messages = append(s.messages, Message{Role: role, Content: content})
+		if over := len(s.messages) - app.maxHistory; over > 0 {
+			s.messages = append([]Message(nil), s.messages[over:]...)
+		}
+	}
+	return nil
+}
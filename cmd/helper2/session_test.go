@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockSessionAfterInvalidate(t *testing.T) {
+	app := &App{sessions: make(map[string]*session), maxSessions: 10}
+	stale := app.getSession("a@example.com")
+	stale.mu.Lock()
+
+	locked := make(chan *session)
+	go func() {
+		s := app.lockSession("a@example.com")
+		s.loaded = true
+		s.mu.Unlock()
+		locked <- s
+	}()
+
+	// Invalidate while the goroutine waits on the stale session's lock
+	time.Sleep(10 * time.Millisecond)
+	app.InvalidateSession("a@example.com")
+	stale.mu.Unlock()
+
+	s := <-locked
+	if s == stale {
+		t.Fatal("lockSession returned a session that had been invalidated")
+	}
+	if stale.loaded {
+		t.Error("stale session was loaded after being invalidated")
+	}
+	if app.getSession("a@example.com") != s {
+		t.Error("lockSession's session isn't the cached one")
+	}
+}
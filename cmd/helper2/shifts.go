@@ -0,0 +1,704 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Once a match is active the caregiver keeps a shift log for it, clocking
+// in and out or logging hours afterwards, and the patient confirms or
+// disputes each shift. Shifts nobody disputes are confirmed after
+// shifts.auto_confirm_days. Every Monday the last week's shifts are totted
+// up into a timesheet per match, which invoicing works from; the shifts
+// behind it, with when and how each was logged, are the record for a
+// dispute.
+
+const shiftsSchema = `
+	CREATE TABLE IF NOT EXISTS shifts (
+		id TEXT PRIMARY KEY,
+		caregiver_email TEXT,
+		patient_email TEXT,
+		started_at TIMESTAMP,
+		ended_at TIMESTAMP,
+		minutes INTEGER,
+		note TEXT,
+		source TEXT,
+		status TEXT,
+		dispute_reason TEXT,
+		reviewed_at TIMESTAMP,
+		created_at TIMESTAMP,
+		invoice_id TEXT DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_shifts_caregiver ON shifts(caregiver_email);
+	CREATE INDEX IF NOT EXISTS idx_shifts_patient ON shifts(patient_email);
+	CREATE TABLE IF NOT EXISTS timesheets (
+		caregiver_email TEXT,
+		patient_email TEXT,
+		week_start TIMESTAMP,
+		shifts INTEGER,
+		confirmed_minutes INTEGER,
+		pending_minutes INTEGER,
+		disputed_minutes INTEGER,
+		generated_at TIMESTAMP,
+		rate REAL DEFAULT 0,
+		PRIMARY KEY (caregiver_email, patient_email, week_start)
+	);
+	CREATE INDEX IF NOT EXISTS idx_timesheets_patient ON timesheets(patient_email)
+`
+
+// Shift statuses
+const (
+	ShiftOpen      = "open"      // Clocked in
+	ShiftPending   = "pending"   // Waiting on the patient
+	ShiftConfirmed = "confirmed" // Agreed, and billable
+	ShiftDisputed  = "disputed"
+)
+
+// How a shift's times were recorded
+const (
+	ShiftClocked = "clock" // Clocked in and out as it happened
+	ShiftLogged  = "log"   // Entered afterwards
+)
+
+var errNoEngagement = errors.New("shifts can only be logged for an active match")
+
+// Shift is a stretch of care a caregiver gave a patient
+type Shift struct {
+	ID             string    `json:"id"`
+	CaregiverEmail string    `json:"caregiver_email"`
+	PatientEmail   string    `json:"patient_email"`
+	StartedAt      time.Time `json:"started_at"`
+	EndedAt        time.Time `json:"ended_at,omitempty"`
+	Minutes        int       `json:"minutes"`
+	Note           string    `json:"note,omitempty"`
+	Source         string    `json:"source"`
+	Status         string    `json:"status"`
+	DisputeReason  string    `json:"dispute_reason,omitempty"`
+	ReviewedAt     time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	InvoiceID      string    `json:"invoice_id,omitempty"` // The invoice that billed it
+}
+
+// Duration formats the shift's length for people
+func (s Shift) Duration() string {
+	return formatMinutes(s.Minutes)
+}
+
+// Timesheet totals a week of a match's shifts, from Monday (see weekStart)
+type Timesheet struct {
+	CaregiverEmail   string    `json:"caregiver_email"`
+	PatientEmail     string    `json:"patient_email"`
+	WeekStart        time.Time `json:"week_start"`
+	Shifts           int       `json:"shifts"`
+	ConfirmedMinutes int       `json:"confirmed_minutes"`
+	PendingMinutes   int       `json:"pending_minutes"`
+	DisputedMinutes  int       `json:"disputed_minutes"`
+	GeneratedAt      time.Time `json:"generated_at,omitempty"`
+	Rate             float64   `json:"rate"` // The match's hourly rate when totalled
+}
+
+// ConfirmedAmount is what the week's confirmed shifts come to at Rate
+func (t Timesheet) ConfirmedAmount() float64 {
+	return roundCents(float64(t.ConfirmedMinutes) / 60 * t.Rate)
+}
+
+// formatMinutes formats a number of minutes as hours and minutes
+func formatMinutes(m int) string {
+	if m < 60 {
+		return fmt.Sprintf("%dm", m)
+	}
+	if m%60 == 0 {
+		return fmt.Sprintf("%dh", m/60)
+	}
+	return fmt.Sprintf("%dh %dm", m/60, m%60)
+}
+
+// requireEngagement returns errNoEngagement unless the caregiver and
+// patient have an active match
+func (app *App) requireEngagement(caregiverEmail, patientEmail string) error {
+	match, err := app.GetMatch(caregiverEmail, patientEmail)
+	if err != nil {
+		return err
+	}
+	if match == nil || match.Status != MatchActive {
+		return errNoEngagement
+	}
+	return nil
+}
+
+const shiftColumns = "id, caregiver_email, patient_email, started_at, ended_at, minutes, note, source, status, dispute_reason, reviewed_at, created_at, invoice_id"
+
+// queryShifts returns the shifts matching a condition, by start time
+func (app *App) queryShifts(where string, args ...interface{}) ([]Shift, error) {
+	return selectShifts(app.db, where, args...)
+}
+
+// selectShifts is queryShifts on q, which may be a transaction
+func selectShifts(q execer, where string, args ...interface{}) ([]Shift, error) {
+	result, err := q.Query("SELECT "+shiftColumns+" FROM shifts "+where+" ORDER BY started_at", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shifts: %v", err)
+	}
+	defer result.Close()
+
+	shifts := []Shift{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var s Shift
+		if err := r.Scan(&s.ID, &s.CaregiverEmail, &s.PatientEmail, &s.StartedAt, &s.EndedAt, &s.Minutes,
+			&s.Note, &s.Source, &s.Status, &s.DisputeReason, &s.ReviewedAt, &s.CreatedAt, &s.InvoiceID); err != nil {
+			return fmt.Errorf("failed to scan shift: %v", err)
+		}
+		shifts = append(shifts, s)
+		return nil
+	})
+	return shifts, err
+}
+
+// OpenShift returns the shift a caregiver is clocked in to, or nil
+func (app *App) OpenShift(caregiverEmail string) (*Shift, error) {
+	shifts, err := app.queryShifts("WHERE caregiver_email = ? AND status = ?", caregiverEmail, ShiftOpen)
+	if err != nil || len(shifts) == 0 {
+		return nil, err
+	}
+	return &shifts[0], nil
+}
+
+// Shifts lists a match's shifts that started in [from, to), by start time
+func (app *App) Shifts(caregiverEmail, patientEmail string, from, to time.Time) ([]Shift, error) {
+	return app.queryShifts("WHERE caregiver_email = ? AND patient_email = ? AND started_at >= ? AND started_at < ?",
+		caregiverEmail, patientEmail, from, to)
+}
+
+// ClockIn starts a shift for a caregiver with one of their patients.
+// Caregivers can only be clocked in to one shift at a time.
+func (app *App) ClockIn(caregiverEmail, patientEmail, note string) (*Shift, error) {
+	if err := app.requireEngagement(caregiverEmail, patientEmail); err != nil {
+		return nil, err
+	}
+	open, err := app.OpenShift(caregiverEmail)
+	if err != nil {
+		return nil, err
+	}
+	if open != nil {
+		return nil, fmt.Errorf("already clocked in with %s since %s", open.PatientEmail, open.StartedAt.Format("3:04 PM"))
+	}
+
+	now := time.Now()
+	s := &Shift{
+		ID:             newAttachmentID(),
+		CaregiverEmail: caregiverEmail,
+		PatientEmail:   patientEmail,
+		StartedAt:      now,
+		Note:           strings.TrimSpace(note),
+		Source:         ShiftClocked,
+		Status:         ShiftOpen,
+		CreatedAt:      now,
+	}
+	if err := app.insertShift(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ClockOut ends a caregiver's open shift and asks the patient to confirm it
+func (app *App) ClockOut(caregiverEmail string) (*Shift, error) {
+	s, err := app.OpenShift(caregiverEmail)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("not clocked in")
+	}
+	s.EndedAt = time.Now()
+	s.Minutes = int(s.EndedAt.Sub(s.StartedAt).Round(time.Minute) / time.Minute)
+	if max := config.Shifts.MaxShiftHours; max > 0 && s.Minutes > max*60 {
+		// Most likely a forgotten clock out; the patient sees the note
+		s.Minutes = max * 60
+		s.EndedAt = s.StartedAt.Add(time.Duration(max) * time.Hour)
+		s.Note = strings.TrimSpace(s.Note + fmt.Sprintf(" (capped at %d hours; clocked out %s)", max, time.Now().Format("Jan 2 3:04 PM")))
+	}
+	s.Status = ShiftPending
+	err = app.db.Exec("UPDATE shifts SET ended_at = ?, minutes = ?, note = ?, status = ? WHERE id = ?",
+		s.EndedAt, s.Minutes, s.Note, s.Status, s.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clock out: %v", err)
+	}
+	app.askToConfirmShift(s)
+	return s, nil
+}
+
+// LogShift records a shift after the fact and asks the patient to confirm
+// it. It must have ended, be no longer than shifts.max_shift_hours and not
+// overlap the caregiver's other shifts.
+func (app *App) LogShift(caregiverEmail, patientEmail string, start, end time.Time, note string) (*Shift, error) {
+	if err := app.requireEngagement(caregiverEmail, patientEmail); err != nil {
+		return nil, err
+	}
+	if !end.After(start) {
+		return nil, fmt.Errorf("a shift must end after it starts")
+	}
+	if end.After(time.Now()) {
+		return nil, fmt.Errorf("only shifts that have ended can be logged; clock in for one that's under way")
+	}
+	if max := config.Shifts.MaxShiftHours; max > 0 && end.Sub(start) > time.Duration(max)*time.Hour {
+		return nil, fmt.Errorf("a shift can be at most %d hours", max)
+	}
+	// Anything that started up to a day before could run into this one
+	nearby, err := app.queryShifts("WHERE caregiver_email = ? AND started_at >= ? AND started_at < ?",
+		caregiverEmail, start.Add(-24*time.Hour), end)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range nearby {
+		otherEnd := other.EndedAt
+		if other.Status == ShiftOpen {
+			otherEnd = time.Now()
+		}
+		if other.StartedAt.Before(end) && otherEnd.After(start) {
+			return nil, fmt.Errorf("overlaps the shift from %s", other.StartedAt.Format("Jan 2 3:04 PM"))
+		}
+	}
+
+	s := &Shift{
+		ID:             newAttachmentID(),
+		CaregiverEmail: caregiverEmail,
+		PatientEmail:   patientEmail,
+		StartedAt:      start,
+		EndedAt:        end,
+		Minutes:        int(end.Sub(start).Round(time.Minute) / time.Minute),
+		Note:           strings.TrimSpace(note),
+		Source:         ShiftLogged,
+		Status:         ShiftPending,
+		CreatedAt:      time.Now(),
+	}
+	if err := app.insertShift(s); err != nil {
+		return nil, err
+	}
+	app.askToConfirmShift(s)
+	return s, nil
+}
+
+func (app *App) insertShift(s *Shift) error {
+	err := app.db.Exec(`
+		INSERT INTO shifts (`+shiftColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, '', ?, ?, '')
+	`, s.ID, s.CaregiverEmail, s.PatientEmail, s.StartedAt, s.EndedAt, s.Minutes, s.Note, s.Source, s.Status,
+		time.Time{}, s.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store shift: %v", err)
+	}
+	return nil
+}
+
+// askToConfirmShift tells the patient about a shift waiting on them
+func (app *App) askToConfirmShift(s *Shift) {
+	app.tellMatchParty(s.CaregiverEmail, s.PatientEmail, s.PatientEmail, fmt.Sprintf(
+		"%s logged a %s shift on %s. Please confirm it or tell us what's wrong on your match page",
+		app.displayName(s.CaregiverEmail), s.Duration(), s.StartedAt.Format("Mon Jan 2")))
+}
+
+// ReviewShift lets the patient confirm a pending shift or dispute it with
+// a reason, which the caregiver is told
+func (app *App) ReviewShift(id, patientEmail string, confirm bool, reason string) error {
+	shifts, err := app.queryShifts("WHERE id = ? AND patient_email = ?", id, patientEmail)
+	if err != nil {
+		return err
+	}
+	if len(shifts) == 0 {
+		return fmt.Errorf("no such shift")
+	}
+	s := shifts[0]
+	if s.Status != ShiftPending {
+		return fmt.Errorf("this shift is %s", s.Status)
+	}
+
+	status := ShiftConfirmed
+	reason = strings.TrimSpace(reason)
+	if !confirm {
+		if reason == "" {
+			return fmt.Errorf("say what's wrong with the shift")
+		}
+		status = ShiftDisputed
+	}
+	err = app.db.Exec("UPDATE shifts SET status = ?, dispute_reason = ?, reviewed_at = ? WHERE id = ?",
+		status, reason, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to review shift: %v", err)
+	}
+	app.refreshTimesheet(s.CaregiverEmail, s.PatientEmail, s.StartedAt)
+
+	if !confirm {
+		message := fmt.Sprintf("%s disputed your %s shift on %s: %s. Our team can help sort it out if you can't agree.",
+			patientEmail, s.Duration(), s.StartedAt.Format("Mon Jan 2"), reason)
+		if err := app.AddMessageWithRecipient(s.CaregiverEmail, "assistant", message, adminThread); err != nil {
+			log.Printf("Error telling %s about disputed shift %s: %v", s.CaregiverEmail, id, err)
+		}
+	}
+	return nil
+}
+
+// BuildTimesheet totals a match's shifts in the week from weekStart
+func (app *App) BuildTimesheet(caregiverEmail, patientEmail string, week time.Time) (*Timesheet, error) {
+	week = weekStart(week)
+	shifts, err := app.Shifts(caregiverEmail, patientEmail, week, week.AddDate(0, 0, 7))
+	if err != nil {
+		return nil, err
+	}
+	rate, err := matchRate(app.db, caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, err
+	}
+	t := &Timesheet{CaregiverEmail: caregiverEmail, PatientEmail: patientEmail, WeekStart: week, Rate: rate}
+	for _, s := range shifts {
+		switch s.Status {
+		case ShiftConfirmed:
+			t.ConfirmedMinutes += s.Minutes
+		case ShiftPending:
+			t.PendingMinutes += s.Minutes
+		case ShiftDisputed:
+			t.DisputedMinutes += s.Minutes
+		default:
+			continue
+		}
+		t.Shifts++
+	}
+	return t, nil
+}
+
+// saveTimesheet stores a timesheet, replacing the match's earlier one for
+// the same week
+func (app *App) saveTimesheet(t *Timesheet) error {
+	t.GeneratedAt = time.Now()
+	err := app.db.Exec(`
+		INSERT INTO timesheets (caregiver_email, patient_email, week_start, shifts,
+			confirmed_minutes, pending_minutes, disputed_minutes, generated_at, rate)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, t.CaregiverEmail, t.PatientEmail, t.WeekStart, t.Shifts, t.ConfirmedMinutes, t.PendingMinutes,
+		t.DisputedMinutes, t.GeneratedAt, t.Rate)
+	if err != nil {
+		return fmt.Errorf("failed to store timesheet: %v", err)
+	}
+	return nil
+}
+
+// refreshTimesheet brings a generated timesheet up to date after one of
+// its shifts changed. Weeks not yet generated are left to the job.
+func (app *App) refreshTimesheet(caregiverEmail, patientEmail string, at time.Time) {
+	week := weekStart(at)
+	exists, err := rowExists(app.db,
+		"SELECT week_start FROM timesheets WHERE caregiver_email = ? AND patient_email = ? AND week_start = ?",
+		caregiverEmail, patientEmail, week)
+	if err != nil || !exists {
+		if err != nil {
+			log.Printf("Error checking timesheet: %v", err)
+		}
+		return
+	}
+	t, err := app.BuildTimesheet(caregiverEmail, patientEmail, week)
+	if err == nil {
+		err = app.saveTimesheet(t)
+	}
+	if err != nil {
+		log.Printf("Error refreshing timesheet for %s/%s: %v", caregiverEmail, patientEmail, err)
+	}
+}
+
+// Timesheets lists a match's generated timesheets, the latest week first
+func (app *App) Timesheets(caregiverEmail, patientEmail string) ([]Timesheet, error) {
+	result, err := app.db.Query(`
+		SELECT caregiver_email, patient_email, week_start, shifts, confirmed_minutes, pending_minutes,
+			disputed_minutes, generated_at, rate
+		FROM timesheets WHERE caregiver_email = ? AND patient_email = ?
+		ORDER BY week_start DESC
+	`, caregiverEmail, patientEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query timesheets: %v", err)
+	}
+	defer result.Close()
+
+	timesheets := []Timesheet{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var t Timesheet
+		if err := r.Scan(&t.CaregiverEmail, &t.PatientEmail, &t.WeekStart, &t.Shifts, &t.ConfirmedMinutes,
+			&t.PendingMinutes, &t.DisputedMinutes, &t.GeneratedAt, &t.Rate); err != nil {
+			return fmt.Errorf("failed to scan timesheet: %v", err)
+		}
+		timesheets = append(timesheets, t)
+		return nil
+	})
+	return timesheets, err
+}
+
+// GenerateTimesheets stores the timesheet of every match with shifts in
+// the week from weekStart, returning them
+func (app *App) GenerateTimesheets(week time.Time) ([]Timesheet, error) {
+	week = weekStart(week)
+	shifts, err := app.queryShifts("WHERE started_at >= ? AND started_at < ?", week, week.AddDate(0, 0, 7))
+	if err != nil {
+		return nil, err
+	}
+	pairs := make(map[[2]string]bool)
+	for _, s := range shifts {
+		if s.Status != ShiftOpen {
+			pairs[[2]string{s.CaregiverEmail, s.PatientEmail}] = true
+		}
+	}
+
+	var timesheets []Timesheet
+	for pair := range pairs {
+		t, err := app.BuildTimesheet(pair[0], pair[1], week)
+		if err != nil {
+			return nil, err
+		}
+		if err := app.saveTimesheet(t); err != nil {
+			return nil, err
+		}
+		timesheets = append(timesheets, *t)
+	}
+	sort.Slice(timesheets, func(i, j int) bool {
+		if timesheets[i].CaregiverEmail != timesheets[j].CaregiverEmail {
+			return timesheets[i].CaregiverEmail < timesheets[j].CaregiverEmail
+		}
+		return timesheets[i].PatientEmail < timesheets[j].PatientEmail
+	})
+	return timesheets, nil
+}
+
+// confirmStaleShifts confirms shifts left pending for
+// shifts.auto_confirm_days
+func (app *App) confirmStaleShifts() error {
+	days := config.Shifts.AutoConfirmDays
+	if days <= 0 {
+		return nil
+	}
+	stale, err := app.queryShifts("WHERE status = ? AND ended_at < ?", ShiftPending, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return err
+	}
+	for _, s := range stale {
+		err := app.db.Exec("UPDATE shifts SET status = ?, reviewed_at = ? WHERE id = ?", ShiftConfirmed, time.Now(), s.ID)
+		if err != nil {
+			return fmt.Errorf("failed to confirm shift: %v", err)
+		}
+		app.refreshTimesheet(s.CaregiverEmail, s.PatientEmail, s.StartedAt)
+	}
+	return nil
+}
+
+// timesheetJob confirms stale shifts, then generates last week's
+// timesheets and sends each to both sides of the match
+func (app *App) timesheetJob() error {
+	if err := app.confirmStaleShifts(); err != nil {
+		return err
+	}
+	timesheets, err := app.GenerateTimesheets(time.Now().AddDate(0, 0, -7))
+	if err != nil {
+		return err
+	}
+	for _, t := range timesheets {
+		for _, email := range []string{t.CaregiverEmail, t.PatientEmail} {
+			with := t.PatientEmail
+			if email == t.PatientEmail {
+				with = t.CaregiverEmail
+			}
+			app.notifyLogged(Notification{
+				Email: email,
+				Kind:  NotifyTimesheet,
+				Data: map[string]interface{}{
+					"With":      with,
+					"WeekStart": t.WeekStart,
+					"Shifts":    t.Shifts,
+					"Confirmed": formatMinutes(t.ConfirmedMinutes),
+					"Amount":    fmt.Sprintf("$%.2f", t.ConfirmedAmount()),
+					"Rate":      fmt.Sprintf("$%.2f", t.Rate),
+					"Pending":   formatMinutes(t.PendingMinutes),
+					"Disputed":  formatMinutes(t.DisputedMinutes),
+				},
+			})
+		}
+	}
+	return nil
+}
+
+// shiftParties checks email is the caregiver or patient of a match, from
+// the request's caregiver_email and patient_email
+func shiftParties(r *http.Request) (email, caregiverEmail, patientEmail string, err error) {
+	email = r.FormValue("email")
+	caregiverEmail, patientEmail = r.FormValue("caregiver_email"), r.FormValue("patient_email")
+	if caregiverEmail == "" || patientEmail == "" {
+		return "", "", "", fmt.Errorf("caregiver_email and patient_email are required")
+	}
+	if email != caregiverEmail && email != patientEmail {
+		return "", "", "", fmt.Errorf("not a party to this match")
+	}
+	return email, caregiverEmail, patientEmail, nil
+}
+
+// applyShiftAction carries out a shift action for a party to a match:
+// clock_in, clock_out or log for the caregiver, confirm or dispute for the
+// patient
+func applyShiftAction(r *http.Request, email, caregiverEmail, patientEmail string) error {
+	action := r.FormValue("action")
+	switch action {
+	case "clock_in", "clock_out", "log":
+		if email != caregiverEmail {
+			return fmt.Errorf("only the caregiver can log shifts")
+		}
+	case "confirm", "dispute":
+		if email != patientEmail {
+			return fmt.Errorf("only the patient can confirm shifts")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+
+	var err error
+	switch action {
+	case "clock_in":
+		_, err = chatRoom.ClockIn(caregiverEmail, patientEmail, r.FormValue("note"))
+	case "clock_out":
+		_, err = chatRoom.ClockOut(caregiverEmail)
+	case "log":
+		var start, end time.Time
+		start, err = time.ParseInLocation("2006-01-02T15:04", r.FormValue("start"), time.Local)
+		if err == nil {
+			end, err = time.ParseInLocation("2006-01-02T15:04", r.FormValue("end"), time.Local)
+		}
+		if err != nil {
+			return fmt.Errorf("start and end must be times like 2006-01-02T15:04")
+		}
+		_, err = chatRoom.LogShift(caregiverEmail, patientEmail, start, end, r.FormValue("note"))
+	case "confirm", "dispute":
+		err = chatRoom.ReviewShift(r.FormValue("id"), patientEmail, action == "confirm", r.FormValue("reason"))
+	}
+	return err
+}
+
+// handleMatchShifts takes a shift action posted from the match detail
+// view
+func handleMatchShifts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email, caregiverEmail, patientEmail, err := shiftParties(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := applyShiftAction(r, email, caregiverEmail, patientEmail); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("../match?email=%s&caregiver_email=%s&patient_email=%s",
+		url.QueryEscape(email), url.QueryEscape(caregiverEmail), url.QueryEscape(patientEmail)),
+		http.StatusSeeOther)
+}
+
+// handleShiftsAPI lists a match's shifts (GET, optionally starting from
+// and before to, as dates) and takes a shift action (POST, as on the match
+// page)
+func handleShiftsAPI(w http.ResponseWriter, r *http.Request) {
+	email, caregiverEmail, patientEmail, err := shiftParties(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		from, to := time.Time{}, time.Now().AddDate(1, 0, 0)
+		if s := r.FormValue("from"); s != "" {
+			if from, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+				http.Error(w, "from must be a date like 2006-01-02", http.StatusBadRequest)
+				return
+			}
+		}
+		if s := r.FormValue("to"); s != "" {
+			if to, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+				http.Error(w, "to must be a date like 2006-01-02", http.StatusBadRequest)
+				return
+			}
+		}
+		shifts, err := chatRoom.Shifts(caregiverEmail, patientEmail, from, to)
+		if err != nil {
+			log.Printf("Error listing shifts: %v", err)
+			http.Error(w, "Failed to list shifts", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, shifts)
+
+	case "POST":
+		if err := applyShiftAction(r, email, caregiverEmail, patientEmail); err != nil {
+			status := http.StatusBadRequest
+			if err == errNoEngagement {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTimesheetsAPI lists a match's generated timesheets, or with week
+// (a date in it) totals that week as it stands
+func handleTimesheetsAPI(w http.ResponseWriter, r *http.Request) {
+	_, caregiverEmail, patientEmail, err := shiftParties(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if s := r.FormValue("week"); s != "" {
+		week, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			http.Error(w, "week must be a date like 2006-01-02", http.StatusBadRequest)
+			return
+		}
+		t, err := chatRoom.BuildTimesheet(caregiverEmail, patientEmail, week)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, t)
+		return
+	}
+	timesheets, err := chatRoom.Timesheets(caregiverEmail, patientEmail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, timesheets)
+}
+
+// handleAdminShiftsAPI lists the shifts of a match (caregiver_email and
+// patient_email) for settling disputes, or every disputed shift
+func handleAdminShiftsAPI(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+	var shifts []Shift
+	var err error
+	if c, p := r.FormValue("caregiver_email"), r.FormValue("patient_email"); c != "" && p != "" {
+		shifts, err = chatRoom.queryShifts("WHERE caregiver_email = ? AND patient_email = ?", c, p)
+	} else {
+		shifts, err = chatRoom.queryShifts("WHERE status = ?", ShiftDisputed)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, shifts)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Assistant replies can be read aloud on the chat page. A reply is
+// synthesized the first time someone asks to hear it, by OpenAI's speech
+// API or a local server that speaks the same API, and the audio is kept in
+// the object store so replaying it costs nothing.
+
+const speechClipsSchema = `
+	CREATE TABLE IF NOT EXISTS speech_clips (
+		email TEXT,
+		message_at TIMESTAMP,
+		voice TEXT,
+		object_key TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (email, message_at, voice)
+	)
+`
+
+// maxSpeechInput is the most text OpenAI will synthesize in one request
+const maxSpeechInput = 4096
+
+var speechMarkup = regexp.MustCompile(`<[^>]*>`)
+
+// speechEnabled reports whether a speech provider is configured
+func speechEnabled() bool {
+	switch config.Speech.Provider {
+	case "openai":
+		return true
+	case "local":
+		return config.Speech.URL != ""
+	}
+	return false
+}
+
+// spokenText is what of an assistant message should be read out: its
+// text without markup, forms or link targets
+func spokenText(content string) string {
+	text := speechMarkup.ReplaceAllString(telegramHTML(content), "")
+	text = strings.TrimSpace(html.UnescapeString(text))
+	if len(text) > maxSpeechInput {
+		text = text[:maxSpeechInput]
+	}
+	return text
+}
+
+// synthesizeSpeech returns text read aloud as MP3
+func synthesizeSpeech(text string) ([]byte, error) {
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"model":           config.Speech.Model,
+		"voice":           config.Speech.Voice,
+		"input":           text,
+		"response_format": "mp3",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	endpoint, client := "https://api.openai.com/v1/audio/speech", openAIClient
+	if config.Speech.Provider == "local" {
+		endpoint, client = config.Speech.URL, localAudioClient
+	}
+	request, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if config.Speech.Provider == "openai" {
+		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("OPENAI_API_KEY")))
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make speech request: %v", err)
+	}
+	defer resp.Body.Close()
+	audio, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read speech: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("speech request returned %s: %s", resp.Status, audio)
+	}
+	return audio, nil
+}
+
+// SpeechClip returns the object key of an assistant message read aloud,
+// synthesizing and storing it the first time. It returns "" when there's
+// no such message.
+func (app *App) SpeechClip(email string, messageAt time.Time) (string, error) {
+	voice := config.Speech.Voice
+	result, err := app.db.Query("SELECT object_key FROM speech_clips WHERE email = ? AND message_at = ? AND voice = ?",
+		email, messageAt, voice)
+	if err != nil {
+		return "", fmt.Errorf("failed to query speech clips: %v", err)
+	}
+	var key string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&key)
+	})
+	result.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to scan speech clip: %v", err)
+	}
+	if key != "" {
+		return key, nil
+	}
+
+	result, err = app.db.Query("SELECT content FROM chat_history WHERE email = ? AND created_at = ? AND role = 'assistant'",
+		email, messageAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to query chat history: %v", err)
+	}
+	var content string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&content)
+	})
+	result.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to scan message: %v", err)
+	}
+	text := spokenText(content)
+	if text == "" {
+		return "", nil
+	}
+
+	audio, err := synthesizeSpeech(text)
+	if err != nil {
+		return "", err
+	}
+	key = fmt.Sprintf("speech/%s/%d-%s.mp3", userKey(email), messageAt.UnixNano(), voice)
+	if err := app.objects.Put(key, bytes.NewReader(audio), "audio/mpeg"); err != nil {
+		return "", fmt.Errorf("failed to store speech: %v", err)
+	}
+	err = app.db.Exec(`
+		INSERT INTO speech_clips (email, message_at, voice, object_key, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, messageAt, voice, key, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("failed to store speech clip: %v", err)
+	}
+	return key, nil
+}
+
+// SpeechClipKeys lists the stored audio of a user's messages
+func (app *App) SpeechClipKeys(email string) ([]string, error) {
+	result, err := app.db.Query("SELECT object_key FROM speech_clips WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query speech clips: %v", err)
+	}
+	defer result.Close()
+
+	var keys []string
+	err = result.Iterate(func(r *chai.Row) error {
+		var key string
+		if err := r.Scan(&key); err != nil {
+			return fmt.Errorf("failed to scan speech clip: %v", err)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+// handleSpeech serves /chat/speech?email=...&at=<created_at>, an assistant
+// message read aloud. at is the message's created_at as the messages API
+// gives it.
+func handleSpeech(w http.ResponseWriter, r *http.Request) {
+	if !speechEnabled() {
+		http.Error(w, "Read aloud is not enabled", http.StatusNotFound)
+		return
+	}
+	email := r.URL.Query().Get("email")
+	at, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("at"))
+	if email == "" || err != nil {
+		http.Error(w, "email and at are required", http.StatusBadRequest)
+		return
+	}
+
+	key, err := chatRoom.SpeechClip(email, at)
+	if err != nil {
+		log.Printf("Error reading message aloud for %s: %v", email, err)
+		http.Error(w, "Failed to read message aloud", http.StatusBadGateway)
+		return
+	}
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int((24*time.Hour).Seconds())))
+	serveObject(w, key, "audio/mpeg")
+}
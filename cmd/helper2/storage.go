@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errObjectNotFound is returned by ObjectStore.Get for a missing key
+var errObjectNotFound = errors.New("object not found")
+
+// ObjectStore holds uploaded files, exports and archives by key. Keys are
+// slash separated paths such as "avatars/ab12cd34".
+type ObjectStore interface {
+	Put(key string, body io.Reader, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// newObjectStore builds the store named by the storage config
+func newObjectStore(cfg StorageConfig) (ObjectStore, error) {
+	switch cfg.Backend {
+	case "", "local":
+		return &localStore{dir: cfg.Dir}, nil
+	case "s3":
+		if cfg.S3.Endpoint == "" || cfg.S3.Bucket == "" {
+			return nil, fmt.Errorf("s3 storage needs an endpoint and bucket")
+		}
+		region := cfg.S3.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &s3Store{
+			endpoint:  strings.TrimRight(cfg.S3.Endpoint, "/"),
+			bucket:    cfg.S3.Bucket,
+			region:    region,
+			accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			client:    &http.Client{Timeout: 60 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+// validObjectKey rejects keys that could escape the store's root
+func validObjectKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// localStore keeps objects as files under dir
+type localStore struct {
+	dir string
+}
+
+func (s *localStore) path(key string) (string, error) {
+	if !validObjectKey(key) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *localStore) Put(key string, body io.Reader, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	// Write to a temp file and rename, so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create object: %v", err)
+	}
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write object: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write object: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to store object: %v", err)
+	}
+	return nil
+}
+
+func (s *localStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object: %v", err)
+	}
+	return f, nil
+}
+
+func (s *localStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	return nil
+}
+
+// s3Store talks to S3 or an S3-compatible service such as MinIO, using
+// path-style addressing and Signature Version 4
+type s3Store struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// s3EscapePath URI-encodes each segment of a key as SigV4 requires
+func s3EscapePath(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		var sb strings.Builder
+		for _, b := range []byte(part) {
+			if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+				b == '-' || b == '_' || b == '.' || b == '~' {
+				sb.WriteByte(b)
+			} else {
+				fmt.Fprintf(&sb, "%%%02X", b)
+			}
+		}
+		parts[i] = sb.String()
+	}
+	return strings.Join(parts, "/")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signAWSV4 signs a request with AWS Signature Version 4. uri is the
+// request's escaped path; requests here never carry a query string.
+func signAWSV4(request *http.Request, uri string, body []byte, accessKey, secretKey, region, service string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := amzDate[:8]
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		uri,
+		"",
+		"host:" + request.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), day)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// do sends a signed request for key. The body is buffered so its hash can
+// be signed; objects here are uploads and archives, not bulk data.
+func (s *s3Store) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	if !validObjectKey(key) {
+		return nil, fmt.Errorf("invalid object key %q", key)
+	}
+	uri := "/" + s3EscapePath(s.bucket) + "/" + s3EscapePath(key)
+	request, err := http.NewRequest(method, s.endpoint+uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	signAWSV4(request, uri, body, s.accessKey, s.secretKey, s.region, "s3")
+
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make storage request: %v", err)
+	}
+	return resp, nil
+}
+
+// s3Error turns a failed response into an error, consuming the body
+func s3Error(resp *http.Response) error {
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("storage request failed with status %d: %s", resp.StatusCode, msg)
+}
+
+func (s *s3Store) Put(key string, body io.Reader, contentType string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read object body: %v", err)
+	}
+	resp, err := s.do("PUT", key, data, contentType)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return s3Error(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errObjectNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return nil, s3Error(resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"github.com/chaisql/chai"
+)
+
+// execer is satisfied by both *chai.DB and *chai.Tx, so store helpers can
+// run on their own or as part of a larger transaction
+type execer interface {
+	Exec(q string, args ...interface{}) error
+	Query(q string, args ...interface{}) (*chai.Result, error)
+}
+
+// withTx runs fn in a write transaction, committing if it returns nil and
+// rolling back otherwise. Writers are serialised, so a read inside fn is
+// still true when fn's writes commit. Side effects such as cache
+// invalidation belong after withTx returns, not inside fn.
+func (app *App) withTx(fn func(tx *chai.Tx) error) error {
+	return app.db.Update(fn)
+}
+
+// rowExists reports whether query returns at least one row
+func rowExists(q execer, query string, args ...interface{}) (bool, error) {
+	result, err := q.Query(query, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to check existence: %v", err)
+	}
+	defer result.Close()
+
+	exists := false
+	err = result.Iterate(func(r *chai.Row) error {
+		exists = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to iterate results: %v", err)
+	}
+	return exists, nil
+}
+
+// addColumn adds a column to a table created before the column existed.
+// chai has no ADD COLUMN IF NOT EXISTS, so the table's definition in the
+// catalog is checked first. definition must give a type or default.
+func addColumn(db *instrumentedDB, table, column, definition string) error {
+	tables, err := db.catalog("table")
+	if err != nil {
+		return err
+	}
+	present := regexp.MustCompile(`[(,]\s*` + regexp.QuoteMeta(column) + `\s`)
+	for _, t := range tables {
+		if t.Name == table && present.MatchString(t.SQL) {
+			return nil
+		}
+	}
+	if err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s: %v", table, column, err)
+	}
+	return nil
+}
+
+// userKey is a stable, opaque id for a user. It names their objects in
+// storage and identifies them in markup that mustn't reveal their email.
+func userKey(email string) string {
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:8])
+}
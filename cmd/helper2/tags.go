@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+const tagsSchema = `
+	CREATE TABLE IF NOT EXISTS user_tags (
+		email TEXT,
+		tag TEXT,
+		created_by TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (email, tag)
+	);
+	CREATE INDEX IF NOT EXISTS idx_user_tags_tag ON user_tags(tag);
+	CREATE TABLE IF NOT EXISTS admin_notes (
+		email TEXT,
+		body TEXT,
+		created_by TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (email, created_at)
+	)
+`
+
+var validTag = regexp.MustCompile(`^[a-z0-9][a-z0-9_:-]{0,63}$`)
+
+// UserTag labels a caregiver or patient, e.g. "background-check-passed"
+type UserTag struct {
+	Email     string    `json:"email"`
+	Tag       string    `json:"tag"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AdminNote is a private note on a user, visible only to admins
+type AdminNote struct {
+	Email     string    `json:"email"`
+	Body      string    `json:"body"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// normalizeTag lowercases a tag and joins its words with dashes
+func normalizeTag(tag string) (string, error) {
+	tag = strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+	if !validTag.MatchString(tag) {
+		return "", fmt.Errorf("invalid tag: %q", tag)
+	}
+	return tag, nil
+}
+
+// AddTag labels a user; adding a tag they already have is a no-op
+func (app *App) AddTag(email, tag, admin string) error {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return fmt.Errorf("email is required")
+	}
+	err = app.db.Exec(`
+		INSERT INTO user_tags (email, tag, created_by, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`, email, tag, admin, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to add tag: %v", err)
+	}
+	app.invalidateToolCaches()
+	return nil
+}
+
+// RemoveTag takes a label off a user
+func (app *App) RemoveTag(email, tag string) error {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	if err := app.db.Exec("DELETE FROM user_tags WHERE email = ? AND tag = ?", email, tag); err != nil {
+		return fmt.Errorf("failed to remove tag: %v", err)
+	}
+	app.invalidateToolCaches()
+	return nil
+}
+
+// TagsFor returns a user's tags in alphabetical order
+func (app *App) TagsFor(email string) ([]UserTag, error) {
+	return app.queryTags("SELECT email, tag, created_by, created_at FROM user_tags WHERE email = ? ORDER BY tag", email)
+}
+
+// EmailsWithTag returns every user carrying tag
+func (app *App) EmailsWithTag(tag string) ([]string, error) {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := app.queryTags("SELECT email, tag, created_by, created_at FROM user_tags WHERE tag = ?", tag)
+	if err != nil {
+		return nil, err
+	}
+	emails := make([]string, len(tags))
+	for i, t := range tags {
+		emails[i] = t.Email
+	}
+	return emails, nil
+}
+
+func (app *App) queryTags(query string, args ...interface{}) ([]UserTag, error) {
+	result, err := app.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tags: %v", err)
+	}
+	defer result.Close()
+
+	var tags []UserTag
+	err = result.Iterate(func(r *chai.Row) error {
+		var t UserTag
+		if err := r.Scan(&t.Email, &t.Tag, &t.CreatedBy, &t.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan tag: %v", err)
+		}
+		tags = append(tags, t)
+		return nil
+	})
+	return tags, err
+}
+
+// AddAdminNote appends a private note to a user's record
+func (app *App) AddAdminNote(email, body, admin string) error {
+	body = strings.TrimSpace(body)
+	if email == "" || body == "" {
+		return fmt.Errorf("email and note are required")
+	}
+	err := app.db.Exec(`
+		INSERT INTO admin_notes (email, body, created_by, created_at)
+		VALUES (?, ?, ?, ?)
+	`, email, body, admin, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to add note: %v", err)
+	}
+	return nil
+}
+
+// AdminNotes returns the notes on a user, newest first
+func (app *App) AdminNotes(email string) ([]AdminNote, error) {
+	result, err := app.db.Query(`
+		SELECT email, body, created_by, created_at
+		FROM admin_notes
+		WHERE email = ?
+		ORDER BY created_at DESC
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes: %v", err)
+	}
+	defer result.Close()
+
+	var notes []AdminNote
+	err = result.Iterate(func(r *chai.Row) error {
+		var n AdminNote
+		if err := r.Scan(&n.Email, &n.Body, &n.CreatedBy, &n.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan note: %v", err)
+		}
+		notes = append(notes, n)
+		return nil
+	})
+	return notes, err
+}
+
+// SearchUsers returns the emails whose address, tags or admin notes contain
+// query, case-insensitively
+func (app *App) SearchUsers(query string) ([]string, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil, nil
+	}
+	found := make(map[string]bool)
+	collect := func(sql string) error {
+		result, err := app.db.Query(sql)
+		if err != nil {
+			return fmt.Errorf("failed to search users: %v", err)
+		}
+		defer result.Close()
+		return result.Iterate(func(r *chai.Row) error {
+			var email, text string
+			if err := r.Scan(&email, &text); err != nil {
+				return fmt.Errorf("failed to scan search result: %v", err)
+			}
+			if strings.Contains(strings.ToLower(email), query) || strings.Contains(strings.ToLower(text), query) {
+				found[email] = true
+			}
+			return nil
+		})
+	}
+	for _, sql := range []string{
+		"SELECT email, tag FROM user_tags",
+		"SELECT email, body FROM admin_notes",
+		"SELECT email, name FROM caregivers",
+		"SELECT email, name FROM patients",
+	} {
+		if err := collect(sql); err != nil {
+			return nil, err
+		}
+	}
+
+	emails := make([]string, 0, len(found))
+	for email := range found {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	return emails, nil
+}
+
+// rewriteTagFilters replaces DynamicQuery comparisons on the "tag"
+// pseudo-field with email filters, so matches can be limited to e.g.
+// caregivers tagged background-check-passed
+func (app *App) rewriteTagFilters(filters []QueryFilter) ([]QueryFilter, error) {
+	var rewritten []QueryFilter
+	for _, f := range filters {
+		if len(f.Any) > 0 || len(f.All) > 0 {
+			anyOf, err := app.rewriteTagFilters(f.Any)
+			if err != nil {
+				return nil, err
+			}
+			allOf, err := app.rewriteTagFilters(f.All)
+			if err != nil {
+				return nil, err
+			}
+			rewritten = append(rewritten, QueryFilter{Any: anyOf, All: allOf})
+			continue
+		}
+		if f.Field != "tag" || (f.Operator != "=" && f.Operator != "IN") {
+			rewritten = append(rewritten, f)
+			continue
+		}
+
+		wanted, ok := f.Value.([]interface{})
+		if !ok {
+			wanted = []interface{}{f.Value}
+		}
+		emails := []interface{}{}
+		for _, tag := range wanted {
+			tagged, err := app.EmailsWithTag(fmt.Sprint(tag))
+			if err != nil {
+				return nil, err
+			}
+			for _, email := range tagged {
+				emails = append(emails, email)
+			}
+		}
+		rewritten = append(rewritten, QueryFilter{Field: "email", Operator: "IN", Value: emails})
+	}
+	return rewritten, nil
+}
+
+// filterByTags keeps the emails carrying every one of tags
+func (app *App) filterByTags(emails []string, tags []string) ([]string, error) {
+	keep := make(map[string]int)
+	for _, tag := range tags {
+		tagged, err := app.EmailsWithTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		for _, email := range tagged {
+			keep[email]++
+		}
+	}
+	var filtered []string
+	for _, email := range emails {
+		if keep[email] == len(tags) {
+			filtered = append(filtered, email)
+		}
+	}
+	return filtered, nil
+}
+
+// adminUserEntry is one user on the admin users page
+type adminUserEntry struct {
+	Email      string
+	Role       string
+	Tags       []UserTag
+	Notes      []AdminNote
+	Suspension *Suspension // Set unless the account is active
+}
+
+const adminUsersTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - Users</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>Users</h1>
+            <div class="app-description">Search by email, name, tag or note</div>
+        </div>
+        <form class="schedule-form" method="GET" action="users">
+            <input type="hidden" name="email" value="{{.UserEmail}}">
+            <input type="text" name="q" value="{{.Query}}" placeholder="e.g. background-check-passed">
+            <button type="submit">Search</button>
+        </form>
+        <ul class="matches-list">
+            {{range .Users}}
+            <li class="match-item">
+                <div class="match-details">
+                    <strong>{{.Email}}</strong> <span>({{.Role}})</span><br>
+                    {{with .Suspension}}<span>⛔ {{.Status}} for {{.Reason}}{{with .Note}}: {{.}}{{end}} by {{.SuspendedBy}} on {{.CreatedAt.Format "Jan 2 2006"}}{{if not .EndsAt.IsZero}}, until {{.EndsAt.Format "Jan 2 2006"}}{{end}}</span>{{end}}
+                    <form class="schedule-form" method="POST" action="users">
+                        <input type="hidden" name="email" value="{{$.UserEmail}}">
+                        <input type="hidden" name="q" value="{{$.Query}}">
+                        <input type="hidden" name="target" value="{{.Email}}">
+                        <input type="hidden" name="action" value="set_status">
+                        <select name="status">
+                            <option value="suspended">Suspend</option>
+                            <option value="banned">Ban</option>
+                            <option value="active">Reinstate</option>
+                        </select>
+                        <select name="reason">
+                            {{range $.Reasons}}<option value="{{.Code}}">{{.Label}}</option>{{end}}
+                        </select>
+                        <input type="number" name="days" min="0" placeholder="days (suspensions)">
+                        <input type="text" name="status_note" placeholder="Note">
+                        <button type="submit">Change status</button>
+                    </form>
+                    <span>🏷️ {{range .Tags}}<span class="unread-badge">{{.Tag}}</span> {{else}}No tags{{end}}</span>
+                    <form class="schedule-form" method="POST" action="users">
+                        <input type="hidden" name="email" value="{{$.UserEmail}}">
+                        <input type="hidden" name="q" value="{{$.Query}}">
+                        <input type="hidden" name="target" value="{{.Email}}">
+                        <input type="text" name="tag" placeholder="tag">
+                        <button type="submit" name="action" value="add_tag">Add tag</button>
+                        <button type="submit" name="action" value="remove_tag">Remove tag</button>
+                    </form>
+                    {{range .Notes}}
+                    <div class="calendar-event">
+                        <span>{{.CreatedAt.Format "Jan 2 2006 3:04 PM"}} · {{.CreatedBy}}</span><br>
+                        <span>{{.Body}}</span>
+                    </div>
+                    {{end}}
+                    <form class="schedule-form" method="POST" action="users">
+                        <input type="hidden" name="email" value="{{$.UserEmail}}">
+                        <input type="hidden" name="q" value="{{$.Query}}">
+                        <input type="hidden" name="target" value="{{.Email}}">
+                        <input type="text" name="note" placeholder="Private note">
+                        <button type="submit" name="action" value="add_note">Add note</button>
+                    </form>
+                    <form class="schedule-form" method="POST" action="impersonate">
+                        <input type="hidden" name="email" value="{{$.UserEmail}}">
+                        <input type="hidden" name="target" value="{{.Email}}">
+                        <select name="mode">
+                            <option value="read">Read-only</option>
+                            <option value="full">Full access</option>
+                        </select>
+                        <button type="submit" name="action" value="start">View as this user</button>
+                    </form>
+                </div>
+            </li>
+            {{else}}
+            {{if .Query}}<p>No users found.</p>{{end}}
+            {{end}}
+        </ul>
+    </div>
+</body>
+</html>
+`
+
+// handleAdminUsers searches users and edits their tags and notes
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+	query := r.FormValue("q")
+
+	if r.Method == "POST" {
+		target := r.FormValue("target")
+		var err error
+		switch r.FormValue("action") {
+		case "add_tag":
+			err = chatRoom.AddTag(target, r.FormValue("tag"), admin)
+		case "remove_tag":
+			err = chatRoom.RemoveTag(target, r.FormValue("tag"))
+		case "add_note":
+			err = chatRoom.AddAdminNote(target, r.FormValue("note"), admin)
+		case "set_status":
+			days, _ := strconv.Atoi(r.FormValue("days"))
+			err = applyAccountStatus(r, admin, target, r.FormValue("status"), r.FormValue("reason"), r.FormValue("status_note"), days)
+		default:
+			err = fmt.Errorf("unknown action")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("users?email=%s&q=%s", url.QueryEscape(admin), url.QueryEscape(query)),
+			http.StatusSeeOther)
+		return
+	}
+
+	emails, err := chatRoom.SearchUsers(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var users []adminUserEntry
+	for _, email := range emails {
+		entry := adminUserEntry{Email: email, Role: chatRoom.userRole(email)}
+		if entry.Tags, err = chatRoom.TagsFor(email); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if entry.Notes, err = chatRoom.AdminNotes(email); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if entry.Suspension, err = chatRoom.GetSuspension(email); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		users = append(users, entry)
+	}
+
+	renderTemplate(w, "users", adminUsersTemplate, struct {
+		UserEmail string
+		Query     string
+		Users     []adminUserEntry
+		Reasons   []reportReason
+	}{admin, query, users, accountReasons})
+}
+
+// handleTagsAPI lists a user's tags (GET with target) or everyone carrying
+// a tag (GET with tag), adds a tag from a JSON body {"email", "tag"} (POST)
+// and removes one (DELETE with target and tag)
+func handleTagsAPI(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if tag := r.FormValue("tag"); tag != "" {
+			emails, err := chatRoom.EmailsWithTag(tag)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, emails)
+			return
+		}
+		tags, err := chatRoom.TagsFor(r.FormValue("target"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, tags)
+
+	case "POST":
+		var req struct {
+			Email string `json:"email"`
+			Tag   string `json:"tag"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.AddTag(req.Email, req.Tag, admin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		if err := chatRoom.RemoveTag(r.FormValue("target"), r.FormValue("tag")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleNotesAPI lists a user's notes (GET with target) and adds one from a
+// JSON body {"email", "body"} (POST)
+func handleNotesAPI(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		notes, err := chatRoom.AdminNotes(r.FormValue("target"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, notes)
+
+	case "POST":
+		var req struct {
+			Email string `json:"email"`
+			Body  string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.AddAdminNote(req.Email, req.Body, admin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// careType is a node in the care taxonomy. Patients' care needs and
+// caregivers' specializations are both mapped onto these, so matching can
+// compare like with like instead of free text.
+type careType struct {
+	Key      string
+	Label    string
+	Keywords []string // Fallback classification when the LLM isn't available
+}
+
+var careTaxonomy = []careType{
+	{"elderly", "elderly care", []string{"elderly", "senior", "aging", "geriatric", "older adult", "companionship"}},
+	{"dementia", "dementia care", []string{"dementia", "alzheimer", "memory"}},
+	{"pediatric", "pediatric care", []string{"pediatric", "child", "children", "kid", "infant", "baby", "newborn"}},
+	{"post_op", "post-operative recovery", []string{"post-op", "post op", "surgery", "surgical", "recovery", "rehab"}},
+	{"disability", "disability support", []string{"disability", "disabled", "wheelchair", "mobility", "special needs", "autism"}},
+	{"palliative", "palliative and hospice care", []string{"palliative", "hospice", "end of life", "end-of-life", "terminal"}},
+	{"chronic", "chronic condition management", []string{"chronic", "diabetes", "copd", "heart", "stroke", "parkinson"}},
+	{"mental_health", "mental health support", []string{"mental health", "depression", "anxiety", "psychiatric"}},
+	{"personal_care", "personal care", []string{"bathing", "dressing", "toileting", "personal care", "hygiene", "grooming"}},
+	{"medical", "medication and nursing", []string{"medication", "meds", "injection", "nursing", "wound", "catheter"}},
+}
+
+const careTypesSchema = `
+	CREATE TABLE IF NOT EXISTS profile_care_types (
+		email TEXT,
+		care_type TEXT,
+		source TEXT,
+		updated_at TIMESTAMP,
+		PRIMARY KEY (email, care_type)
+	)
+`
+
+const careTypeInstructions = `Classify the care described below into these care types:
+%s
+Reply with only a JSON array of the matching keys, e.g. ["elderly","dementia"]. Reply [] if none apply.`
+
+func careTypeLabel(key string) string {
+	for _, t := range careTaxonomy {
+		if t.Key == key {
+			return t.Label
+		}
+	}
+	return key
+}
+
+// keywordCareTypes classifies text by keyword alone
+func keywordCareTypes(text string) []string {
+	text = strings.ToLower(text)
+	var keys []string
+	for _, t := range careTaxonomy {
+		for _, kw := range t.Keywords {
+			if strings.Contains(text, kw) {
+				keys = append(keys, t.Key)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// llmCareTypes asks the extraction model to classify text
+func llmCareTypes(email, text string) ([]string, error) {
+	var nodes strings.Builder
+	for _, t := range careTaxonomy {
+		fmt.Fprintf(&nodes, "- %s: %s\n", t.Key, t.Label)
+	}
+	model := config.Models.Extraction
+	resp, err := postChatCompletion(map[string]interface{}{
+		"model": model,
+		"messages": []Message{
+			{Role: "system", Content: fmt.Sprintf(careTypeInstructions, nodes.String())},
+			{Role: "user", Content: text},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no classification returned")
+	}
+	chatRoom.RecordUsage(email, model, resp)
+
+	var keys []string
+	content := strings.TrimSpace(resp.Choices[0].Message.Content)
+	content = strings.TrimSuffix(strings.TrimPrefix(content, "```json"), "```")
+	if err := json.Unmarshal([]byte(strings.TrimSpace(content)), &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse classification: %v", err)
+	}
+	var valid []string
+	for _, k := range keys {
+		if careTypeLabel(k) != k {
+			valid = append(valid, k)
+		}
+	}
+	return valid, nil
+}
+
+// ClassifyProfile maps a user's care needs or specializations onto the
+// taxonomy and stores the result. The LLM does the classification when it
+// is configured; keywords are the fallback.
+func (app *App) ClassifyProfile(email string) error {
+	text, err := app.profileText(email)
+	if err != nil {
+		return err
+	}
+
+	keys, source := keywordCareTypes(text), "keyword"
+	if text != "" && os.Getenv("OPENAI_API_KEY") != "" {
+		if classified, err := llmCareTypes(email, text); err != nil {
+			log.Printf("Error classifying care types for %s, using keywords: %v", email, err)
+		} else {
+			keys, source = classified, "llm"
+		}
+	}
+
+	now := time.Now()
+	return app.withTx(func(tx *chai.Tx) error {
+		if err := tx.Exec("DELETE FROM profile_care_types WHERE email = ?", email); err != nil {
+			return fmt.Errorf("failed to clear care types: %v", err)
+		}
+		for _, key := range keys {
+			err := tx.Exec(`
+				INSERT INTO profile_care_types (email, care_type, source, updated_at)
+				VALUES (?, ?, ?, ?)
+				ON CONFLICT DO NOTHING
+			`, email, key, source, now)
+			if err != nil {
+				return fmt.Errorf("failed to store care type: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// CareTypes returns a user's taxonomy nodes. Profiles that haven't been
+// classified yet are classified by keyword on the fly.
+func (app *App) CareTypes(email string) ([]string, error) {
+	result, err := app.db.Query("SELECT care_type FROM profile_care_types WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query care types: %v", err)
+	}
+	defer result.Close()
+
+	var keys []string
+	classified := false
+	err = result.Iterate(func(r *chai.Row) error {
+		classified = true
+		var key string
+		if err := r.Scan(&key); err != nil {
+			return fmt.Errorf("failed to scan care type: %v", err)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !classified {
+		text, err := app.profileText(email)
+		if err != nil {
+			return nil, err
+		}
+		keys = keywordCareTypes(text)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// careTypeOverlap returns the taxonomy nodes two profiles share
+func careTypeOverlap(a, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, k := range b {
+		inB[k] = true
+	}
+	var shared []string
+	for _, k := range a {
+		if inB[k] {
+			shared = append(shared, k)
+		}
+	}
+	return shared
+}
+
+// careTypeReason explains a taxonomy overlap on a match card
+func careTypeReason(shared []string) string {
+	labels := make([]string, len(shared))
+	for i, k := range shared {
+		labels[i] = careTypeLabel(k)
+	}
+	return "Covers " + strings.Join(labels, ", ")
+}
+
+// applyCareTypes scores each candidate by how many of want's care types it
+// covers, drops candidates with none when config requires an overlap, and
+// stably moves better-covered candidates first. It returns the indexes of
+// the candidates to keep, in their new order, with the shared types of each.
+func (app *App) applyCareTypes(want []string, candidates []string) ([]int, map[int][]string) {
+	shared := make(map[int][]string)
+	var keep []int
+	for i, email := range candidates {
+		types, err := app.CareTypes(email)
+		if err != nil {
+			log.Printf("Error loading care types for %s: %v", email, err)
+		}
+		shared[i] = careTypeOverlap(want, types)
+		if len(want) > 0 && len(shared[i]) == 0 && config.Matching.RequireCareTypeOverlap {
+			continue
+		}
+		keep = append(keep, i)
+	}
+	sort.SliceStable(keep, func(a, b int) bool {
+		return len(shared[keep[a]]) > len(shared[keep[b]])
+	})
+	return keep, shared
+}
+
+// rankCaregiversByCareType boosts caregivers whose specializations cover the
+// patient's care needs, and drops the rest if config requires an overlap
+func (app *App) rankCaregiversByCareType(patientEmail string, caregivers []Caregiver) []Caregiver {
+	want, err := app.CareTypes(patientEmail)
+	if err != nil {
+		log.Printf("Error loading care types for %s: %v", patientEmail, err)
+		return caregivers
+	}
+	emails := make([]string, len(caregivers))
+	for i, c := range caregivers {
+		emails[i] = c.Email
+	}
+	keep, shared := app.applyCareTypes(want, emails)
+	ranked := make([]Caregiver, 0, len(keep))
+	for _, i := range keep {
+		c := caregivers[i]
+		if len(shared[i]) > 0 {
+			c.MatchReasons = append(c.MatchReasons, careTypeReason(shared[i]))
+		}
+		ranked = append(ranked, c)
+	}
+	return ranked
+}
+
+// rankPatientsByCareType is rankCaregiversByCareType for the caregiver side
+func (app *App) rankPatientsByCareType(caregiverEmail string, patients []Patient) []Patient {
+	want, err := app.CareTypes(caregiverEmail)
+	if err != nil {
+		log.Printf("Error loading care types for %s: %v", caregiverEmail, err)
+		return patients
+	}
+	emails := make([]string, len(patients))
+	for i, p := range patients {
+		emails[i] = p.Email
+	}
+	keep, shared := app.applyCareTypes(want, emails)
+	ranked := make([]Patient, 0, len(keep))
+	for _, i := range keep {
+		p := patients[i]
+		if len(shared[i]) > 0 {
+			p.MatchReasons = append(p.MatchReasons, careTypeReason(shared[i]))
+		}
+		ranked = append(ranked, p)
+	}
+	return ranked
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Users can chat with the assistant from Telegram instead of the chat
+// page. The chat page's "Connect Telegram" button opens the bot with a
+// one-time code, which links the Telegram chat to the user's email. After
+// that, messages to the bot run through the same chat turns as the page,
+// and the assistant's replies, match cards included, come back as
+// Telegram-formatted text. Both places show the same conversation.
+//
+// The bot is configured from the environment: TELEGRAM_BOT_TOKEN,
+// TELEGRAM_BOT_USERNAME, and TELEGRAM_WEBHOOK_SECRET, which Telegram sends
+// with every update once it's given as the webhook's secret_token.
+
+const telegramSchema = `
+	CREATE TABLE IF NOT EXISTS telegram_links (
+		chat_id TEXT PRIMARY KEY,
+		email TEXT,
+		linked_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_telegram_links_email ON telegram_links(email);
+	CREATE TABLE IF NOT EXISTS telegram_link_codes (
+		code TEXT PRIMARY KEY,
+		email TEXT,
+		expires_at TIMESTAMP
+	)
+`
+
+// telegramLinkTTL is how long a link code from the chat page works
+const telegramLinkTTL = 15 * time.Minute
+
+// telegramMaxText is the longest message the Bot API accepts
+const telegramMaxText = 4096
+
+// telegramBot sends messages through the Telegram Bot API
+type telegramBot struct {
+	token    string
+	username string
+	secret   string
+	client   *http.Client
+}
+
+// newTelegramBot returns nil if the bot isn't set up
+func newTelegramBot() *telegramBot {
+	token := os.Getenv("TELEGRAM_BOT_TOKEN")
+	username := os.Getenv("TELEGRAM_BOT_USERNAME")
+	secret := os.Getenv("TELEGRAM_WEBHOOK_SECRET")
+	if token == "" || username == "" || secret == "" {
+		return nil
+	}
+	return &telegramBot{
+		token:    token,
+		username: strings.TrimPrefix(username, "@"),
+		secret:   secret,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Send posts HTML-formatted text to a chat, split to fit the API's limit
+func (b *telegramBot) Send(chatID, text string) error {
+	for _, part := range splitTelegramText(text) {
+		body, err := json.Marshal(map[string]interface{}{
+			"chat_id":                  chatID,
+			"text":                     part,
+			"parse_mode":               "HTML",
+			"disable_web_page_preview": true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode Telegram message: %v", err)
+		}
+		resp, err := b.client.Post("https://api.telegram.org/bot"+b.token+"/sendMessage", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to send Telegram message: %v", err)
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("Telegram message failed with status %d: %s", resp.StatusCode, respBody)
+		}
+	}
+	return nil
+}
+
+// splitTelegramText breaks text into parts the API accepts, at line ends
+// where it can
+func splitTelegramText(text string) []string {
+	var parts []string
+	for len(text) > telegramMaxText {
+		cut := strings.LastIndex(text[:telegramMaxText], "\n")
+		if cut <= 0 {
+			cut = telegramMaxText
+		}
+		parts = append(parts, text[:cut])
+		text = strings.TrimLeft(text[cut:], "\n")
+	}
+	return append(parts, text)
+}
+
+var (
+	telegramForms     = regexp.MustCompile(`(?is)<(form|script|style)\b.*?</(form|script|style)>`)
+	telegramTag       = regexp.MustCompile(`(?s)<(/?)([a-zA-Z0-9]+)([^>]*)>`)
+	telegramHref      = regexp.MustCompile(`href\s*=\s*['"]([^'"]*)['"]`)
+	telegramBlankRuns = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+)
+
+// telegramHTML turns an assistant message, which may hold HTML such as
+// match cards, into the small set of HTML Telegram formats. Forms are
+// dropped, since their buttons only work on the chat page.
+func telegramHTML(content string) string {
+	content = telegramForms.ReplaceAllString(content, "")
+	content = telegramTag.ReplaceAllStringFunc(content, func(tag string) string {
+		m := telegramTag.FindStringSubmatch(tag)
+		closing, name := m[1] == "/", strings.ToLower(m[2])
+		switch name {
+		case "b", "strong", "h1", "h2", "h3", "h4":
+			if closing {
+				if name[0] == 'h' {
+					return "</b>\n"
+				}
+				return "</b>"
+			}
+			return "<b>"
+		case "i", "em":
+			if closing {
+				return "</i>"
+			}
+			return "<i>"
+		case "code", "pre":
+			if closing {
+				return "</" + name + ">"
+			}
+			return "<" + name + ">"
+		case "a":
+			if closing {
+				return "</a>"
+			}
+			if href := telegramHref.FindStringSubmatch(m[3]); href != nil {
+				link := href[1]
+				if !strings.Contains(link, "://") {
+					link = config.Email.BaseURL + "/" + strings.TrimPrefix(link, "/")
+				}
+				return `<a href="` + link + `">`
+			}
+			return "<a>"
+		case "br":
+			return "\n"
+		case "li":
+			if closing {
+				return "\n"
+			}
+			return "• "
+		case "p", "div", "tr", "ul", "ol", "table":
+			if closing {
+				return "\n"
+			}
+		case "td", "th":
+			if closing {
+				return " "
+			}
+		}
+		return ""
+	})
+	content = telegramBlankRuns.ReplaceAllString(content, "\n\n")
+	return strings.TrimSpace(content)
+}
+
+// TelegramStatus is what the chat page shows about the Telegram bot
+type TelegramStatus struct {
+	Linked bool
+}
+
+// telegramStatusFor returns nil when the bot isn't set up
+func (app *App) telegramStatusFor(email string) *TelegramStatus {
+	if app.telegram == nil {
+		return nil
+	}
+	linked, err := rowExists(app.db, "SELECT chat_id FROM telegram_links WHERE email = ?", email)
+	if err != nil {
+		log.Printf("Error checking Telegram link for %s: %v", email, err)
+	}
+	return &TelegramStatus{Linked: linked}
+}
+
+// NewTelegramLinkCode returns a one-time code that links a Telegram chat
+// to email when sent to the bot with /start
+func (app *App) NewTelegramLinkCode(email string) (string, error) {
+	b := make([]byte, 10)
+	rand.Read(b)
+	code := base32.StdEncoding.EncodeToString(b)
+	err := app.db.Exec("INSERT INTO telegram_link_codes (code, email, expires_at) VALUES (?, ?, ?)",
+		code, email, time.Now().Add(telegramLinkTTL))
+	if err != nil {
+		return "", fmt.Errorf("failed to store Telegram link code: %v", err)
+	}
+	return code, nil
+}
+
+// LinkTelegram redeems a link code for a chat and returns the email it
+// linked, or "" if the code is unknown or expired
+func (app *App) LinkTelegram(chatID, code string) (string, error) {
+	var email string
+	err := app.withTx(func(tx *chai.Tx) error {
+		result, err := tx.Query("SELECT email FROM telegram_link_codes WHERE code = ? AND expires_at > ?", code, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to query Telegram link code: %v", err)
+		}
+		err = result.Iterate(func(r *chai.Row) error {
+			return r.Scan(&email)
+		})
+		result.Close()
+		if err != nil {
+			return fmt.Errorf("failed to scan Telegram link code: %v", err)
+		}
+		if email == "" {
+			return nil
+		}
+		if err := tx.Exec("DELETE FROM telegram_link_codes WHERE code = ?", code); err != nil {
+			return fmt.Errorf("failed to use Telegram link code: %v", err)
+		}
+		// One chat per user, so replies have one place to go
+		if err := tx.Exec("DELETE FROM telegram_links WHERE email = ?", email); err != nil {
+			return fmt.Errorf("failed to replace Telegram link: %v", err)
+		}
+		err = tx.Exec(`
+			INSERT INTO telegram_links (chat_id, email, linked_at) VALUES (?, ?, ?)
+			ON CONFLICT DO REPLACE
+		`, chatID, email, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to store Telegram link: %v", err)
+		}
+		return nil
+	})
+	return email, err
+}
+
+// UnlinkTelegram forgets a user's Telegram chat
+func (app *App) UnlinkTelegram(email string) error {
+	if err := app.db.Exec("DELETE FROM telegram_links WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to remove Telegram link: %v", err)
+	}
+	return nil
+}
+
+// telegramEmail returns the email linked to a chat, or ""
+func (app *App) telegramEmail(chatID string) (string, error) {
+	result, err := app.db.Query("SELECT email FROM telegram_links WHERE chat_id = ?", chatID)
+	if err != nil {
+		return "", fmt.Errorf("failed to query Telegram link: %v", err)
+	}
+	defer result.Close()
+
+	var email string
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&email)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to scan Telegram link: %v", err)
+	}
+	return email, nil
+}
+
+// telegramTurn runs a chat turn for a message from Telegram and sends the
+// assistant's replies back
+func (app *App) telegramTurn(chatID, email, text string) error {
+	if status := maintenance.Status(); status.Enabled {
+		return app.telegram.Send(chatID, status.Message)
+	}
+	replies, err := app.ChatTurnReplies(email, text)
+	if err != nil {
+		app.telegram.Send(chatID, "Sorry, something went wrong. Please try again.")
+		return err
+	}
+	if len(replies) == 0 {
+		return nil
+	}
+	for i, reply := range replies {
+		replies[i] = telegramHTML(reply)
+	}
+	return app.telegram.Send(chatID, strings.Join(replies, "\n\n"))
+}
+
+// telegramUpdate is the part of a Bot API update the bot reads
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// handleTelegramWebhook takes updates from Telegram. /start with a code
+// links the chat, /stop unlinks it, and anything else from a linked chat is
+// a chat message. Updates are answered straight away and handled in the
+// background, since Telegram resends updates that take too long.
+func handleTelegramWebhook(w http.ResponseWriter, r *http.Request) {
+	bot := chatRoom.telegram
+	if bot == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")), []byte(bot.secret)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var update telegramUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if update.Message == nil || strings.TrimSpace(update.Message.Text) == "" {
+		return
+	}
+	chatID := strconv.FormatInt(update.Message.Chat.ID, 10)
+	text := strings.TrimSpace(update.Message.Text)
+
+	go func() {
+		if err := chatRoom.handleTelegramMessage(chatID, text); err != nil {
+			log.Printf("Error handling Telegram update %d: %v", update.UpdateID, err)
+		}
+	}()
+}
+
+// handleTelegramMessage acts on one message to the bot
+func (app *App) handleTelegramMessage(chatID, text string) error {
+	if code, ok := strings.CutPrefix(text, "/start"); ok {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			return app.telegram.Send(chatID, "Open "+config.Email.BaseURL+" and choose Connect Telegram to chat here.")
+		}
+		email, err := app.LinkTelegram(chatID, code)
+		if err != nil {
+			return err
+		}
+		if email == "" {
+			return app.telegram.Send(chatID, "That link has expired. Choose Connect Telegram on the chat page to get a new one.")
+		}
+		return app.telegram.Send(chatID, "You're connected to "+config.Branding.Name+". Send a message to chat with the assistant, or /stop to disconnect.")
+	}
+
+	email, err := app.telegramEmail(chatID)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return app.telegram.Send(chatID, "Open "+config.Email.BaseURL+" and choose Connect Telegram to chat here.")
+	}
+	if text == "/stop" {
+		if err := app.UnlinkTelegram(email); err != nil {
+			return err
+		}
+		return app.telegram.Send(chatID, "Disconnected. Your conversation is still on the chat page.")
+	}
+	return app.telegramTurn(chatID, email, text)
+}
+
+// handleTelegramLink sends the user to the bot with a fresh link code
+// (action=link) or forgets their Telegram chat (action=unlink)
+func handleTelegramLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	if chatRoom.telegram == nil {
+		http.Error(w, "Telegram isn't set up", http.StatusNotFound)
+		return
+	}
+	if impersonationFrom(r) != nil {
+		http.Error(w, "Only the user can connect Telegram", http.StatusForbidden)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "link":
+		code, err := chatRoom.NewTelegramLinkCode(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "https://t.me/"+chatRoom.telegram.username+"?start="+url.QueryEscape(code), http.StatusSeeOther)
+	case "unlink":
+		if err := chatRoom.UnlinkTelegram(email); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "../?email="+url.QueryEscape(email), http.StatusSeeOther)
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
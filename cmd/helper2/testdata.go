@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Test data is a file of "email: message" lines, played as chat turns.
+// Several users' conversations run at once, but each user's messages are
+// sent in file order by one worker, one after the other. Chat turns across
+// all users are paced to stay inside the OpenAI quota.
+
+// testDataProgressInterval is how often progress is logged while test
+// data plays
+const testDataProgressInterval = 10 * time.Second
+
+// testConversation is one user's messages, in file order
+type testConversation struct {
+	email    string
+	messages []string
+}
+
+// readTestData groups the lines of a test data file by user, keeping each
+// user's messages and the users in the order they first appear
+func readTestData(filename string) ([]*testConversation, int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open test data file: %v", err)
+	}
+	defer file.Close()
+
+	var conversations []*testConversation
+	byEmail := make(map[string]*testConversation)
+	skipped := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 {
+			log.Printf("Skipping invalid line format: %s", line)
+			skipped++
+			continue
+		}
+		email, message := parts[0], parts[1]
+		c, ok := byEmail[email]
+		if !ok {
+			c = &testConversation{email: email}
+			byEmail[email] = c
+			conversations = append(conversations, c)
+		}
+		c.messages = append(c.messages, message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error reading test data: %v", err)
+	}
+	return conversations, skipped, nil
+}
+
+// processTestData plays a test data file against chatRoom using
+// config.TestData's concurrency and rate
+func processTestData(filename string) error {
+	conversations, skipped, err := readTestData(filename)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, c := range conversations {
+		total += len(c.messages)
+	}
+
+	workers := config.TestData.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(conversations) {
+		workers = len(conversations)
+	}
+	log.Printf("Playing %d messages from %d users with %d workers", total, len(conversations), workers)
+
+	// One tick per chat turn; a worker waits for a tick before each
+	var ticks <-chan time.Time
+	if rpm := config.TestData.RequestsPerMinute; rpm > 0 {
+		ticker := time.NewTicker(time.Minute / time.Duration(rpm))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	var done, failed, queued int64
+	start := time.Now()
+	stopProgress := make(chan struct{})
+	go func() {
+		t := time.NewTicker(testDataProgressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				log.Printf("Test data: %d/%d messages, %d failed", atomic.LoadInt64(&done), total, atomic.LoadInt64(&failed))
+			case <-stopProgress:
+				return
+			}
+		}
+	}()
+
+	queue := make(chan *testConversation)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range queue {
+				for _, message := range c.messages {
+					if ticks != nil {
+						<-ticks
+					}
+					log.Printf("Processing message from %s: %s", c.email, message)
+					if err := chatRoom.RunChatTurn(c.email, message); err != nil {
+						log.Printf("Error processing message for %s: %v", c.email, err)
+						atomic.AddInt64(&failed, 1)
+					} else if chatRoom.HasPendingReply(c.email) {
+						atomic.AddInt64(&queued, 1)
+					}
+					atomic.AddInt64(&done, 1)
+				}
+			}
+		}()
+	}
+	for _, c := range conversations {
+		queue <- c
+	}
+	close(queue)
+	wg.Wait()
+	close(stopProgress)
+
+	log.Printf("Played %d messages from %d users in %s: %d failed, %d queued for the assistant, %d lines skipped",
+		total, len(conversations), time.Since(start).Round(time.Second), failed, queued, skipped)
+	return nil
+}
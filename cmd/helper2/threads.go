@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// A user can keep several conversations with the assistant and start a
+// fresh one at any time. Each message in chat_history carries the
+// conversation it belongs to, and only the active conversation is shown
+// and sent to the model. The profile is shared by all of them.
+
+const chatThreadsSchema = `
+	CREATE TABLE IF NOT EXISTS chat_threads (
+		email TEXT,
+		id TEXT,
+		name TEXT,
+		created_at TIMESTAMP,
+		PRIMARY KEY (email, id)
+	);
+	CREATE TABLE IF NOT EXISTS active_threads (
+		email TEXT PRIMARY KEY,
+		thread_id TEXT,
+		updated_at TIMESTAMP
+	)
+`
+
+// mainThread is the conversation every user starts in, and the one
+// messages from before conversations existed belong to
+const mainThread = ""
+
+const mainThreadName = "Main conversation"
+
+// maxThreads caps how many conversations one user can start
+const maxThreads = 20
+
+// maxThreadName caps a conversation's name
+const maxThreadName = 60
+
+// ChatThread is one of a user's conversations with the assistant
+type ChatThread struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	Active    bool      `json:"active"`
+}
+
+// migrateChatThreads adds the conversation column to chat_history tables
+// created before it existed
+func migrateChatThreads(db *instrumentedDB) error {
+	return addColumn(db, "chat_history", "thread_id", "TEXT DEFAULT ''")
+}
+
+// ActiveThread returns the conversation a user is in
+func (app *App) ActiveThread(email string) (string, error) {
+	result, err := app.db.Query("SELECT thread_id FROM active_threads WHERE email = ?", email)
+	if err != nil {
+		return "", fmt.Errorf("failed to query active thread: %v", err)
+	}
+	defer result.Close()
+
+	thread := mainThread
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&thread)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to scan active thread: %v", err)
+	}
+	return thread, nil
+}
+
+// ChatThreads lists a user's conversations, the main one first and the
+// rest oldest first
+func (app *App) ChatThreads(email string) ([]ChatThread, error) {
+	active, err := app.ActiveThread(email)
+	if err != nil {
+		return nil, err
+	}
+	threads := []ChatThread{{ID: mainThread, Name: mainThreadName, Active: active == mainThread}}
+
+	result, err := app.db.Query(`
+		SELECT email, id, name, created_at FROM chat_threads
+		WHERE email = ?
+		ORDER BY created_at ASC
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query threads: %v", err)
+	}
+	defer result.Close()
+
+	err = result.Iterate(func(r *chai.Row) error {
+		// chai can only sort rows whose whole primary key is selected, and
+		// may return the columns in table order, so they're scanned by name
+		var t ChatThread
+		for column, dest := range map[string]interface{}{
+			"id":         &t.ID,
+			"name":       &t.Name,
+			"created_at": &t.CreatedAt,
+		} {
+			if err := r.ScanColumn(column, dest); err != nil {
+				return fmt.Errorf("failed to scan thread: %v", err)
+			}
+		}
+		t.Active = t.ID == active
+		threads = append(threads, t)
+		return nil
+	})
+	return threads, err
+}
+
+// NewThread starts a fresh conversation for a user and switches to it.
+// Without a name it's named after when it started.
+func (app *App) NewThread(email, name string) (*ChatThread, error) {
+	threads, err := app.ChatThreads(email)
+	if err != nil {
+		return nil, err
+	}
+	if len(threads) >= maxThreads {
+		return nil, fmt.Errorf("you can keep at most %d conversations", maxThreads)
+	}
+
+	now := time.Now()
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Conversation of " + now.Format("Jan 2, 3:04 PM")
+	}
+	if len(name) > maxThreadName {
+		return nil, fmt.Errorf("a conversation name can be at most %d characters", maxThreadName)
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	t := &ChatThread{ID: hex.EncodeToString(b), Name: name, CreatedAt: now, Active: true}
+
+	err = app.withTx(func(tx *chai.Tx) error {
+		err := tx.Exec(`
+			INSERT INTO chat_threads (email, id, name, created_at)
+			VALUES (?, ?, ?, ?)
+		`, email, t.ID, t.Name, t.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to create thread: %v", err)
+		}
+		return setActiveThread(tx, email, t.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	app.InvalidateSession(email)
+	return t, nil
+}
+
+// SwitchThread makes one of a user's conversations the active one
+func (app *App) SwitchThread(email, thread string) error {
+	err := app.withTx(func(tx *chai.Tx) error {
+		if thread != mainThread {
+			exists, err := rowExists(tx, "SELECT id FROM chat_threads WHERE email = ? AND id = ?", email, thread)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("no such conversation")
+			}
+		}
+		return setActiveThread(tx, email, thread)
+	})
+	if err != nil {
+		return err
+	}
+	app.InvalidateSession(email)
+	return nil
+}
+
+func setActiveThread(tx *chai.Tx, email, thread string) error {
+	err := tx.Exec(`
+		INSERT INTO active_threads (email, thread_id, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, thread, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to switch thread: %v", err)
+	}
+	return nil
+}
+
+// handleThreads starts a conversation (action=new, with an optional name)
+// or switches to one (action=switch with thread) from the chat page
+func handleThreads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "new":
+		if _, err := chatRoom.NewThread(email, r.FormValue("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "switch":
+		if err := chatRoom.SwitchThread(email, r.FormValue("thread")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "./?email="+url.QueryEscape(email), http.StatusSeeOther)
+}
+
+// handleThreadsAPI lists a user's conversations
+func handleThreadsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	threads, err := chatRoom.ChatThreads(email)
+	if err != nil {
+		log.Printf("Error listing threads for %s: %v", email, err)
+		http.Error(w, "Failed to list conversations", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, threads)
+}
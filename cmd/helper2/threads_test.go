@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestChatThreads(t *testing.T) {
+	app := newTestApp(t)
+	const email = "user@example.com"
+	first, err := app.NewThread(email, "First")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := app.NewThread(email, "Second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.NewThread("other@example.com", "Someone else's"); err != nil {
+		t.Fatal(err)
+	}
+
+	threads, err := app.ChatThreads(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ChatThread{
+		{ID: mainThread, Name: mainThreadName},
+		{ID: first.ID, Name: "First"},
+		{ID: second.ID, Name: "Second", Active: true},
+	}
+	if len(threads) != len(want) {
+		t.Fatalf("got %d threads, want %d: %+v", len(threads), len(want), threads)
+	}
+	for i, w := range want {
+		got := threads[i]
+		if got.ID != w.ID || got.Name != w.Name || got.Active != w.Active {
+			t.Errorf("thread %d: got %+v, want %+v", i, got, w)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Tools can be turned off while the app runs. The config's tools.disabled
+// list is the starting point; an admin can override it per tool, and the
+// override is stored so every instance picks it up. A disabled tool isn't
+// offered to the model, and a call to it anyway is refused.
+
+const toolPolicySchema = `
+	CREATE TABLE IF NOT EXISTS tool_policy (
+		name TEXT PRIMARY KEY,
+		enabled BOOLEAN,
+		updated_by TEXT,
+		updated_at TIMESTAMP
+	)
+`
+
+// toolPolicyReloadInterval bounds how long another instance's changes take
+// to show up here, as with prompts
+const toolPolicyReloadInterval = 30 * time.Second
+
+// ToolStatus is whether a tool is offered to the model, and why
+type ToolStatus struct {
+	Name      string    `json:"name"`
+	Enabled   bool      `json:"enabled"`
+	Source    string    `json:"source"` // "default", "config" or "admin"
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// toolPolicy caches the admin overrides
+type toolPolicy struct {
+	db        *instrumentedDB
+	mu        sync.RWMutex
+	overrides map[string]ToolStatus
+	loadedAt  time.Time
+}
+
+func newToolPolicy(db *instrumentedDB) *toolPolicy {
+	return &toolPolicy{db: db, overrides: make(map[string]ToolStatus)}
+}
+
+func (tp *toolPolicy) reload() error {
+	result, err := tp.db.Query("SELECT name, enabled, updated_by, updated_at FROM tool_policy")
+	if err != nil {
+		return fmt.Errorf("failed to query tool policy: %v", err)
+	}
+	defer result.Close()
+
+	overrides := make(map[string]ToolStatus)
+	err = result.Iterate(func(r *chai.Row) error {
+		s := ToolStatus{Source: "admin"}
+		if err := r.Scan(&s.Name, &s.Enabled, &s.UpdatedBy, &s.UpdatedAt); err != nil {
+			return fmt.Errorf("failed to scan tool policy: %v", err)
+		}
+		overrides[s.Name] = s
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tp.mu.Lock()
+	tp.overrides = overrides
+	tp.loadedAt = time.Now()
+	tp.mu.Unlock()
+	return nil
+}
+
+// Status says whether a tool is enabled, reloading overrides when stale
+func (tp *toolPolicy) Status(name string) ToolStatus {
+	tp.mu.RLock()
+	stale := time.Since(tp.loadedAt) > toolPolicyReloadInterval
+	tp.mu.RUnlock()
+	if stale {
+		if err := tp.reload(); err != nil {
+			log.Printf("Error reloading tool policy: %v", err)
+		}
+	}
+
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	if s, ok := tp.overrides[name]; ok {
+		return s
+	}
+	for _, disabled := range config.Tools.Disabled {
+		if disabled == name {
+			return ToolStatus{Name: name, Enabled: false, Source: "config"}
+		}
+	}
+	return ToolStatus{Name: name, Enabled: true, Source: "default"}
+}
+
+func (tp *toolPolicy) Enabled(name string) bool {
+	return tp.Status(name).Enabled
+}
+
+// Set overrides the config for one tool
+func (tp *toolPolicy) Set(name string, enabled bool, actor string) error {
+	err := tp.db.Exec(`
+		INSERT INTO tool_policy (name, enabled, updated_by, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, name, enabled, actor, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store tool policy: %v", err)
+	}
+	return tp.reload()
+}
+
+// Reset drops a tool's override, so the config decides again
+func (tp *toolPolicy) Reset(name string) error {
+	if err := tp.db.Exec("DELETE FROM tool_policy WHERE name = ?", name); err != nil {
+		return fmt.Errorf("failed to reset tool policy: %v", err)
+	}
+	return tp.reload()
+}
+
+// filter drops the definitions of disabled tools
+func (tp *toolPolicy) filter(defs []map[string]interface{}) []map[string]interface{} {
+	enabled := defs[:0:0]
+	for _, def := range defs {
+		if tp.Enabled(def["name"].(string)) {
+			enabled = append(enabled, def)
+		}
+	}
+	return enabled
+}
+
+// toolNames lists every tool the model can be offered
+func toolNames() []string {
+	var names []string
+	for _, def := range toolDefinitions() {
+		names = append(names, def["name"].(string))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isToolName(name string) bool {
+	for _, n := range toolNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handleToolsAPI lists every tool with its status (GET), enables or
+// disables one from a JSON body {"name", "enabled"} (POST), or drops an
+// admin override so the config applies again (DELETE with name)
+func handleToolsAPI(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var statuses []ToolStatus
+		for _, name := range toolNames() {
+			statuses = append(statuses, chatRoom.tools.Status(name))
+		}
+		writeJSON(w, statuses)
+
+	case "POST":
+		var req struct {
+			Name    string `json:"name"`
+			Enabled bool   `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if !isToolName(req.Name) {
+			http.Error(w, fmt.Sprintf("Unknown tool %q", req.Name), http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.tools.Set(req.Name, req.Enabled, admin); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		chatRoom.Audit(r, admin, "tool.set", "", fmt.Sprintf("%s enabled=%t", req.Name, req.Enabled))
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		name := r.FormValue("name")
+		if !isToolName(name) {
+			http.Error(w, fmt.Sprintf("Unknown tool %q", name), http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.tools.Reset(name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		chatRoom.Audit(r, admin, "tool.reset", "", name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// maxAvatarSize and maxAttachmentSize bound upload sizes in bytes
+const (
+	maxAvatarSize     = 2 << 20
+	maxAttachmentSize = 10 << 20
+)
+
+// avatarTypes are the image types accepted as avatars
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+const attachmentsSchema = `
+	CREATE TABLE IF NOT EXISTS attachments (
+		id TEXT PRIMARY KEY,
+		email TEXT,
+		name TEXT,
+		content_type TEXT,
+		size INTEGER,
+		object_key TEXT,
+		created_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_attachments_email ON attachments(email)
+`
+
+// Attachment is a document a user has uploaded, e.g. a certification
+type Attachment struct {
+	ID          string    `json:"id"`
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	ObjectKey   string    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func avatarKey(email string) string {
+	return "avatars/" + userKey(email)
+}
+
+func newAttachmentID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// readUpload reads a multipart file field, rejecting anything over limit
+func readUpload(r *http.Request, field string, limit int64) ([]byte, string, error) {
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		return nil, "", fmt.Errorf("missing %s upload", field)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read upload: %v", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, "", fmt.Errorf("upload is larger than %d MB", limit>>20)
+	}
+	return data, header.Filename, nil
+}
+
+// SaveAvatar stores an image as the user's avatar, replacing any earlier one
+func (app *App) SaveAvatar(email string, data []byte) error {
+	contentType := http.DetectContentType(data)
+	if !avatarTypes[contentType] {
+		return fmt.Errorf("avatar must be a PNG, JPEG, GIF or WebP image")
+	}
+	return app.objects.Put(avatarKey(email), bytes.NewReader(data), contentType)
+}
+
+// SaveAttachment stores a document for a user
+func (app *App) SaveAttachment(email, name string, data []byte) (*Attachment, error) {
+	a := &Attachment{
+		ID:          newAttachmentID(),
+		Email:       email,
+		Name:        filepath.Base(name),
+		ContentType: http.DetectContentType(data),
+		Size:        int64(len(data)),
+		CreatedAt:   time.Now(),
+	}
+	a.ObjectKey = fmt.Sprintf("attachments/%s/%s", userKey(email), a.ID)
+	if err := app.objects.Put(a.ObjectKey, bytes.NewReader(data), a.ContentType); err != nil {
+		return nil, err
+	}
+
+	err := app.db.Exec(`
+		INSERT INTO attachments (id, email, name, content_type, size, object_key, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, a.ID, a.Email, a.Name, a.ContentType, a.Size, a.ObjectKey, a.CreatedAt)
+	if err != nil {
+		if delErr := app.objects.Delete(a.ObjectKey); delErr != nil {
+			log.Printf("Error removing orphaned attachment %s: %v", a.ObjectKey, delErr)
+		}
+		return nil, fmt.Errorf("failed to store attachment: %v", err)
+	}
+	return a, nil
+}
+
+// ListAttachments returns a user's documents, newest first
+func (app *App) ListAttachments(email string) ([]Attachment, error) {
+	result, err := app.db.Query(`
+		SELECT id, email, name, content_type, size, object_key, created_at
+		FROM attachments WHERE email = ?
+		ORDER BY created_at DESC
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments: %v", err)
+	}
+	defer result.Close()
+
+	var attachments []Attachment
+	err = result.Iterate(func(r *chai.Row) error {
+		var a Attachment
+		if err := r.Scan(&a.ID, &a.Email, &a.Name, &a.ContentType, &a.Size, &a.ObjectKey, &a.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan attachment: %v", err)
+		}
+		attachments = append(attachments, a)
+		return nil
+	})
+	return attachments, err
+}
+
+// GetAttachment returns one of a user's documents, or nil if they have no
+// document with that id
+func (app *App) GetAttachment(email, id string) (*Attachment, error) {
+	attachments, err := app.ListAttachments(email)
+	if err != nil {
+		return nil, err
+	}
+	for i := range attachments {
+		if attachments[i].ID == id {
+			return &attachments[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// serveObject copies an object to the response
+func serveObject(w http.ResponseWriter, key, contentType string) {
+	body, err := chatRoom.objects.Get(key)
+	if err == errObjectNotFound {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading object %s: %v", key, err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("Error serving object %s: %v", key, err)
+	}
+}
+
+// handleAvatar serves an avatar on GET and replaces the user's avatar with
+// an uploaded image on POST. GET takes either email (your own avatar) or id
+// (someone else's, from a match card). Users who haven't uploaded one get a
+// generated initials avatar.
+func handleAvatar(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+
+	switch r.Method {
+	case "GET":
+		id, name := r.FormValue("id"), r.FormValue("name")
+		if id == "" {
+			if email == "" {
+				http.Error(w, "Email or id is required", http.StatusBadRequest)
+				return
+			}
+			id = userKey(email)
+			name = email
+			if profile, err := chatRoom.GetUserProfile(email); err == nil {
+				if profile.Caregiver != nil && profile.Caregiver.Name != "" {
+					name = profile.Caregiver.Name
+				} else if profile.Patient != nil && profile.Patient.Name != "" {
+					name = profile.Patient.Name
+				}
+			}
+		}
+		if _, err := hex.DecodeString(id); err != nil {
+			http.Error(w, "Invalid avatar id", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		body, err := chatRoom.objects.Get("avatars/" + id)
+		if err != nil {
+			if err != errObjectNotFound {
+				log.Printf("Error reading avatar %s: %v", id, err)
+			}
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write(generateAvatarSVG(name, id))
+			return
+		}
+		defer body.Close()
+		data, err := io.ReadAll(body)
+		if err != nil {
+			http.Error(w, "Failed to read avatar", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(data))
+		w.Write(data)
+
+	case "POST":
+		if email == "" {
+			http.Error(w, "Email is required", http.StatusBadRequest)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+1<<20)
+		data, _, err := readUpload(r, "avatar", maxAvatarSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := chatRoom.SaveAvatar(email, data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "./?email="+url.QueryEscape(email), http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAttachments lists a user's documents as JSON on GET and stores an
+// uploaded document on POST
+func handleAttachments(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		attachments, err := chatRoom.ListAttachments(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var modified time.Time
+		for _, a := range attachments {
+			modified = latest(modified, a.CreatedAt)
+		}
+		writeJSONCached(w, r, attachments, modified)
+
+	case "POST":
+		r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+		data, name, err := readUpload(r, "file", maxAttachmentSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := chatRoom.SaveAttachment(email, name, data); err != nil {
+			log.Printf("Error saving attachment: %v", err)
+			http.Error(w, "Failed to save attachment", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "./?email="+url.QueryEscape(email), http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAttachmentDownload sends one of the user's documents. It is always
+// served as a download so uploaded HTML can't run in the app's origin.
+func handleAttachmentDownload(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	a, err := chatRoom.GetAttachment(email, r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.ReplaceAll(a.Name, `"`, "")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	serveObject(w, a.ObjectKey, a.ContentType)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Patients say how soon they need care. Caregivers see urgent patients
+// first, and when a patient becomes urgent the available caregivers in
+// their area are told straight away rather than in the next digest.
+
+const patientUrgencySchema = `
+	CREATE TABLE IF NOT EXISTS patient_urgency (
+		email TEXT PRIMARY KEY,
+		urgency TEXT,
+		updated_at TIMESTAMP
+	)
+`
+
+// Urgency levels, least urgent first
+const (
+	UrgencyRoutine = "routine"
+	UrgencySoon    = "soon"
+	UrgencyUrgent  = "urgent"
+)
+
+var urgencyLevels = []string{UrgencyRoutine, UrgencySoon, UrgencyUrgent}
+
+// maxUrgentFanout caps how many caregivers one urgent patient notifies
+const maxUrgentFanout = 20
+
+// urgencyRank orders urgency levels; patients who haven't said are routine
+func urgencyRank(urgency string) int {
+	for i, u := range urgencyLevels {
+		if u == urgency {
+			return i
+		}
+	}
+	return 0
+}
+
+// normalizeUrgency checks an urgency level, allowing "" for not given
+func normalizeUrgency(urgency string) (string, error) {
+	urgency = strings.ToLower(strings.TrimSpace(urgency))
+	if urgency == "" {
+		return "", nil
+	}
+	for _, u := range urgencyLevels {
+		if u == urgency {
+			return u, nil
+		}
+	}
+	return "", fmt.Errorf("urgency must be one of %s", strings.Join(urgencyLevels, ", "))
+}
+
+// GetUrgency returns a patient's urgency, routine if they haven't said
+func (app *App) GetUrgency(email string) (string, error) {
+	result, err := app.db.Query("SELECT urgency FROM patient_urgency WHERE email = ?", email)
+	if err != nil {
+		return UrgencyRoutine, fmt.Errorf("failed to query urgency: %v", err)
+	}
+	defer result.Close()
+
+	urgency := UrgencyRoutine
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&urgency)
+	})
+	if err != nil {
+		return UrgencyRoutine, fmt.Errorf("failed to scan urgency: %v", err)
+	}
+	return urgency, nil
+}
+
+// SetUrgency stores a patient's urgency. A patient becoming urgent,
+// including registering as urgent, notifies nearby available caregivers.
+func (app *App) SetUrgency(email, urgency string) error {
+	urgency, err := normalizeUrgency(urgency)
+	if err != nil || urgency == "" {
+		return err
+	}
+	previous, err := app.GetUrgency(email)
+	if err != nil {
+		return err
+	}
+	err = app.db.Exec(`
+		INSERT INTO patient_urgency (email, urgency, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT DO REPLACE
+	`, email, urgency, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store urgency: %v", err)
+	}
+	app.invalidateToolCaches()
+
+	if urgency == UrgencyUrgent && previous != UrgencyUrgent {
+		app.events.Publish(EventPatientUrgent, map[string]interface{}{"email": email})
+		go func() {
+			if err := app.notifyUrgentPatient(email); err != nil {
+				log.Printf("Error notifying caregivers about urgent patient %s: %v", email, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// patientUrgencies returns every patient's urgency that isn't routine
+func (app *App) patientUrgencies() (map[string]string, error) {
+	result, err := app.db.Query("SELECT email, urgency FROM patient_urgency WHERE urgency != ?", UrgencyRoutine)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query urgencies: %v", err)
+	}
+	defer result.Close()
+
+	urgencies := map[string]string{}
+	err = result.Iterate(func(r *chai.Row) error {
+		var email, urgency string
+		if err := r.Scan(&email, &urgency); err != nil {
+			return fmt.Errorf("failed to scan urgency: %v", err)
+		}
+		urgencies[email] = urgency
+		return nil
+	})
+	return urgencies, err
+}
+
+// rankPatientsByUrgency moves the most urgent patients to the front,
+// keeping the existing order among patients equally urgent
+func (app *App) rankPatientsByUrgency(patients []Patient) []Patient {
+	urgencies, err := app.patientUrgencies()
+	if err != nil {
+		log.Printf("Error ranking patients by urgency: %v", err)
+		return patients
+	}
+	for i := range patients {
+		switch urgencies[patients[i].Email] {
+		case UrgencyUrgent:
+			patients[i].MatchReasons = append(patients[i].MatchReasons, "Needs care urgently")
+		case UrgencySoon:
+			patients[i].MatchReasons = append(patients[i].MatchReasons, "Needs care soon")
+		}
+	}
+	sort.SliceStable(patients, func(i, j int) bool {
+		return urgencyRank(urgencies[patients[i].Email]) > urgencyRank(urgencies[patients[j].Email])
+	})
+	return patients
+}
+
+// nearbyAvailableCaregivers returns the caregivers in a patient's location
+// whose rate fits their budget and who are taking new families
+func (app *App) nearbyAvailableCaregivers(p *Patient) ([]string, error) {
+	result, err := app.db.Query(`
+		SELECT email FROM profile_locations
+		WHERE role = 'caregiver' AND location_key = ? AND amount <= ?
+	`, locationKey(p.Location), p.Budget)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query nearby caregivers: %v", err)
+	}
+	defer result.Close()
+
+	var emails []string
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		if err := r.Scan(&email); err != nil {
+			return fmt.Errorf("failed to scan nearby caregiver: %v", err)
+		}
+		emails = append(emails, email)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	paused, err := app.pausedCaregivers()
+	if err != nil {
+		return nil, err
+	}
+	var available []string
+	for _, email := range emails {
+		if !paused[email] && email != p.Email {
+			available = append(available, email)
+		}
+	}
+	return available, nil
+}
+
+// notifyUrgentPatient tells nearby available caregivers that a patient
+// needs care urgently
+func (app *App) notifyUrgentPatient(email string) error {
+	p, err := app.GetPatient(email)
+	if err != nil || p == nil {
+		return err
+	}
+	caregivers, err := app.nearbyAvailableCaregivers(p)
+	if err != nil {
+		return err
+	}
+	if len(caregivers) > maxUrgentFanout {
+		caregivers = caregivers[:maxUrgentFanout]
+	}
+	for _, caregiver := range caregivers {
+		app.notifyLogged(Notification{
+			Email: caregiver,
+			Kind:  NotifyUrgentRequest,
+			Data:  map[string]interface{}{"Name": p.Name, "Location": p.Location, "CareNeeds": p.CareNeeds},
+		})
+	}
+	log.Printf("Told %d caregivers about urgent patient %s", len(caregivers), email)
+	return nil
+}
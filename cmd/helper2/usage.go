@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+const llmUsageSchema = `
+	CREATE TABLE IF NOT EXISTS llm_usage (
+		email TEXT,
+		created_at TIMESTAMP,
+		model TEXT,
+		prompt_tokens INTEGER,
+		completion_tokens INTEGER,
+		cost REAL,
+		PRIMARY KEY (email, created_at)
+	);
+	CREATE INDEX IF NOT EXISTS idx_llm_usage_created_at ON llm_usage(created_at)
+`
+
+const usageCapMessage = "You've reached this month's usage limit for the assistant. Please try again later, or contact support if you need help sooner."
+
+// modelPrice is the USD price per million tokens
+type modelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+// modelPrices are list prices; models not listed are billed as the default model
+var modelPrices = map[string]modelPrice{
+	"gpt-3.5-turbo": {Prompt: 0.50, Completion: 1.50},
+	"gpt-4o-mini":   {Prompt: 0.15, Completion: 0.60},
+	"gpt-4o":        {Prompt: 2.50, Completion: 10.00},
+	"gpt-4-turbo":   {Prompt: 10.00, Completion: 30.00},
+}
+
+// estimateCost returns the USD cost of a completion
+func estimateCost(model string, usage Usage) float64 {
+	price, ok := modelPrices[model]
+	if !ok {
+		price = modelPrices[defaultChatModel]
+	}
+	return (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1e6
+}
+
+// monthlyCap is the per-user monthly spend limit in USD from
+// LLM_MONTHLY_CAP_USD; zero means unlimited
+func monthlyCap() float64 {
+	limit, err := strconv.ParseFloat(os.Getenv("LLM_MONTHLY_CAP_USD"), 64)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// RecordUsage stores the token counts and estimated cost of a completion
+func (app *App) RecordUsage(email, model string, resp *ChatResponse) {
+	if resp == nil || resp.Usage == nil {
+		return
+	}
+	if resp.Model != "" {
+		model = resp.Model
+	}
+	err := app.db.Exec(`
+		INSERT INTO llm_usage (email, created_at, model, prompt_tokens, completion_tokens, cost)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, email, time.Now(), model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens,
+		estimateCost(model, *resp.Usage))
+	if err != nil {
+		log.Printf("Error recording LLM usage for %s: %v", email, err)
+	}
+}
+
+// UsageTotal is a user's token usage and cost over a period
+type UsageTotal struct {
+	Email            string  `json:"email"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// UsageBetween totals usage per user within [start, end), costliest first.
+// An empty email totals every user.
+func (app *App) UsageBetween(start, end time.Time, email string) ([]UsageTotal, error) {
+	query := "SELECT email, prompt_tokens, completion_tokens, cost FROM llm_usage WHERE created_at >= ? AND created_at < ?"
+	params := []interface{}{start, end}
+	if email != "" {
+		query += " AND email = ?"
+		params = append(params, email)
+	}
+	result, err := app.db.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %v", err)
+	}
+	defer result.Close()
+
+	totals := make(map[string]*UsageTotal)
+	err = result.Iterate(func(r *chai.Row) error {
+		var e string
+		var promptTokens, completionTokens int
+		var cost float64
+		if err := r.Scan(&e, &promptTokens, &completionTokens, &cost); err != nil {
+			return fmt.Errorf("failed to scan usage: %v", err)
+		}
+		t := totals[e]
+		if t == nil {
+			t = &UsageTotal{Email: e}
+			totals[e] = t
+		}
+		t.Requests++
+		t.PromptTokens += promptTokens
+		t.CompletionTokens += completionTokens
+		t.Cost += cost
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]UsageTotal, 0, len(totals))
+	for _, t := range totals {
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Cost > out[j].Cost })
+	return out, nil
+}
+
+// OverMonthlyCap reports whether email has spent their allowance this month
+func (app *App) OverMonthlyCap(email string) bool {
+	limit := monthlyCap()
+	if limit == 0 {
+		return false
+	}
+	start := monthStart(time.Now())
+	totals, err := app.UsageBetween(start, start.AddDate(0, 1, 0), email)
+	if err != nil {
+		// Don't lock users out because accounting failed
+		log.Printf("Error checking usage cap for %s: %v", email, err)
+		return false
+	}
+	return len(totals) > 0 && totals[0].Cost >= limit
+}
+
+// usageReportMonth parses the month=YYYY-MM parameter, defaulting to this month
+func usageReportMonth(r *http.Request) (time.Time, time.Time, error) {
+	start := monthStart(time.Now())
+	if m := r.FormValue("month"); m != "" {
+		parsed, err := time.ParseInLocation("2006-01", m, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("month must be YYYY-MM")
+		}
+		start = parsed
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// handleUsageAPI returns per-user usage for a month as JSON
+func handleUsageAPI(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+	start, end, err := usageReportMonth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	totals, err := chatRoom.UsageBetween(start, end, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"month":       start.Format("2006-01"),
+		"monthly_cap": monthlyCap(),
+		"users":       totals,
+	})
+}
+
+const adminUsageTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{(brand).Name}} - LLM Usage</title>
+` + pageStyles + `</head>
+<body>
+    <div class="chat-container">
+        <div class="header">
+            {{template "logo"}}
+            <h1>LLM Usage for {{.Month}}</h1>
+            <div class="app-description">{{if .Cap}}Monthly cap: ${{printf "%.2f" .Cap}} per user{{else}}No monthly cap{{end}}</div>
+        </div>
+        <table class="query-results">
+            <tr><th>User</th><th>Requests</th><th>Prompt tokens</th><th>Completion tokens</th><th>Cost</th></tr>
+            {{range .Users}}
+            <tr><td>{{.Email}}</td><td>{{.Requests}}</td><td>{{.PromptTokens}}</td><td>{{.CompletionTokens}}</td><td>${{printf "%.4f" .Cost}}</td></tr>
+            {{end}}
+            <tr><th>Total</th><th></th><th></th><th></th><th>${{printf "%.4f" .Total}}</th></tr>
+        </table>
+    </div>
+</body>
+</html>
+`
+
+// handleAdminUsage renders the monthly usage report
+func handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == "" {
+		return
+	}
+	start, end, err := usageReportMonth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	totals, err := chatRoom.UsageBetween(start, end, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	total := 0.0
+	for _, t := range totals {
+		total += t.Cost
+	}
+	renderTemplate(w, "usage", adminUsageTemplate, struct {
+		Month string
+		Cap   float64
+		Users []UsageTotal
+		Total float64
+	}{start.Format("January 2006"), monthlyCap(), totals, total})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// Profile input is checked, and tidied, here before it's stored. Every
+// path that writes a caregiver or patient (chat tools, the onboarding
+// wizard, the profile API) goes through StoreCaregiver or StorePatient,
+// which validate first.
+
+// Bounds on hourly rates and budgets, in dollars
+const (
+	minHourlyAmount = 5
+	maxHourlyAmount = 500
+)
+
+// Longest values accepted, in characters
+const (
+	maxShortField = 100  // names and locations
+	maxLongField  = 2000 // free text such as care needs
+	maxEmailField = 254
+)
+
+// FieldError is a problem with one input field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found with some input, so a form or
+// the model can fix them all at once
+type ValidationError []FieldError
+
+func (v ValidationError) Error() string {
+	messages := make([]string, len(v))
+	for i, f := range v {
+		messages[i] = f.Field + ": " + f.Message
+	}
+	return "invalid input: " + strings.Join(messages, "; ")
+}
+
+// validator collects field errors
+type validator struct {
+	errs ValidationError
+}
+
+func (v *validator) add(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns the collected errors, or nil if there were none
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// text trims a field and checks its length, and that it's present if required
+func (v *validator) text(field string, value *string, required bool, max int) {
+	*value = strings.TrimSpace(*value)
+	switch {
+	case *value == "" && required:
+		v.add(field, "is required")
+	case utf8.RuneCountInString(*value) > max:
+		v.add(field, "must be at most %d characters", max)
+	}
+}
+
+func (v *validator) email(field, value string) {
+	if value == "" {
+		v.add(field, "is required")
+	} else if err := validateEmail(value); err != nil {
+		v.add(field, "%v", err)
+	}
+}
+
+// phone normalizes a phone number to E.164 in place
+func (v *validator) phone(field string, value *string, required bool) {
+	if strings.TrimSpace(*value) == "" {
+		*value = ""
+		if required {
+			v.add(field, "is required")
+		}
+		return
+	}
+	normalized, err := normalizePhone(*value)
+	if err != nil {
+		v.add(field, "%v", err)
+		return
+	}
+	*value = normalized
+}
+
+func (v *validator) hourly(field string, value float64) {
+	if value < minHourlyAmount || value > maxHourlyAmount {
+		v.add(field, "must be between $%d and $%d an hour", minHourlyAmount, maxHourlyAmount)
+	}
+}
+
+// validateEmail checks that s is a bare address (no display name) with a
+// domain that could receive mail
+func validateEmail(s string) error {
+	if s == "" {
+		return fmt.Errorf("email is required")
+	}
+	if len(s) > maxEmailField {
+		return fmt.Errorf("email must be at most %d characters", maxEmailField)
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s || addr.Name != "" {
+		return fmt.Errorf("%q is not a valid email address", s)
+	}
+	domain := s[strings.LastIndex(s, "@")+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return fmt.Errorf("%q is not a valid email address", s)
+	}
+	return nil
+}
+
+// validate checks a caregiver before it's stored, trimming its text fields
+func (c *Caregiver) validate() error {
+	var v validator
+	v.email("email", c.Email)
+	v.text("name", &c.Name, true, maxShortField)
+	v.text("location", &c.Location, true, maxShortField)
+	v.text("experience", &c.Experience, false, maxLongField)
+	v.text("availability", &c.Availability, false, maxLongField)
+	v.text("specializations", &c.Specializations, false, maxLongField)
+	v.text("certifications", &c.Certifications, false, maxLongField)
+	v.hourly("rate_expectations", c.RateExpectations)
+	return v.err()
+}
+
+// validate checks a patient before it's stored, trimming its text fields
+// and normalizing the phone number
+func (p *Patient) validate() error {
+	var v validator
+	v.email("email", p.Email)
+	v.text("name", &p.Name, true, maxShortField)
+	v.text("location", &p.Location, true, maxShortField)
+	v.text("care_needs", &p.CareNeeds, false, maxLongField)
+	v.text("schedule_requirements", &p.ScheduleRequirements, false, maxLongField)
+	v.text("special_requirements", &p.SpecialRequirements, false, maxLongField)
+	v.phone("phone_number", &p.PhoneNumber, true)
+	v.hourly("budget", p.Budget)
+	return v.err()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Users can send a voice note instead of typing. The recording is
+// transcribed, by OpenAI's Whisper API or a local whisper.cpp server, and
+// the transcript goes through the chat like a typed message. The audio
+// itself is never stored.
+
+// maxVoiceSize caps an uploaded voice note; OpenAI takes up to 25MB
+const maxVoiceSize = 25 << 20
+
+// localAudioClient reaches local whisper.cpp and speech servers, which can
+// take longer than the OpenAI client allows on a slow machine
+var localAudioClient = &http.Client{Timeout: 2 * time.Minute}
+
+// voiceNotesEnabled reports whether a transcription provider is configured
+func voiceNotesEnabled() bool {
+	switch config.Transcription.Provider {
+	case "openai":
+		return true
+	case "whisper_cpp":
+		return config.Transcription.URL != ""
+	}
+	return false
+}
+
+// transcribe turns a voice note into text
+func transcribe(filename string, audio io.Reader) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to create audio part: %v", err)
+	}
+	if _, err := io.Copy(part, audio); err != nil {
+		return "", fmt.Errorf("failed to read audio: %v", err)
+	}
+	form.WriteField("response_format", "json")
+	if config.Transcription.Language != "" {
+		form.WriteField("language", config.Transcription.Language)
+	}
+
+	var request *http.Request
+	client := openAIClient
+	switch config.Transcription.Provider {
+	case "openai":
+		form.WriteField("model", config.Transcription.Model)
+		if err := form.Close(); err != nil {
+			return "", fmt.Errorf("failed to encode audio: %v", err)
+		}
+		request, err = http.NewRequest("POST", "https://api.openai.com/v1/audio/transcriptions", &body)
+		if err != nil {
+			return "", fmt.Errorf("failed to create request: %v", err)
+		}
+		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("OPENAI_API_KEY")))
+	case "whisper_cpp":
+		if err := form.Close(); err != nil {
+			return "", fmt.Errorf("failed to encode audio: %v", err)
+		}
+		request, err = http.NewRequest("POST", config.Transcription.URL, &body)
+		if err != nil {
+			return "", fmt.Errorf("failed to create request: %v", err)
+		}
+		client = localAudioClient
+	default:
+		return "", fmt.Errorf("unknown transcription provider %q", config.Transcription.Provider)
+	}
+	request.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to make transcription request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Text  string `json:"text"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error,omitempty"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode transcription: %v", err)
+	}
+	if result.Error != nil {
+		return "", fmt.Errorf("transcription failed: %s", result.Error.Message)
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("transcription returned %s", resp.Status)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// handleVoiceMessage takes a recorded or uploaded voice note and sends its
+// transcript to the assistant
+func handleVoiceMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !voiceNotesEnabled() {
+		http.Error(w, "Voice notes are not enabled", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxVoiceSize+1<<20)
+	if err := r.ParseMultipartForm(maxVoiceSize); err != nil {
+		http.Error(w, "Voice note is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	userEmail := r.FormValue("email")
+	if userEmail == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	// A new user's first message has to be typed, so it gets the usual
+	// bot screening
+	if chatRoom.isFirstContact(userEmail) {
+		http.Error(w, "Please type your first message", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("audio")
+	if err != nil {
+		http.Error(w, "Audio is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	contentType := header.Header.Get("Content-Type")
+	// Browsers label recordings from MediaRecorder as audio/webm or
+	// video/webm depending on the platform
+	if !strings.HasPrefix(contentType, "audio/") && contentType != "video/webm" && contentType != "video/mp4" {
+		http.Error(w, "Not an audio file", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	message, err := transcribe(header.Filename, file)
+	if err != nil {
+		log.Printf("Error transcribing voice note from %s: %v", userEmail, err)
+		http.Error(w, "Failed to transcribe voice note", http.StatusBadGateway)
+		return
+	}
+	if message == "" {
+		http.Error(w, "No speech was heard in the voice note", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := chatRoom.takeChatMessage(r, userEmail, message); err != nil {
+		log.Printf("Error processing message: %v", err)
+		http.Error(w, "Failed to process message", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("../?email=%s", url.QueryEscape(userEmail)), http.StatusSeeOther)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// A patient whose search finds no caregivers joins the waitlist, with the
+// criteria they searched by. When a caregiver registers, every waiting
+// patient is searched for again, and those the new caregiver fits are told
+// about them. A search that finds caregivers takes the patient off the
+// list. Admin analytics count who's waiting in each region.
+
+const waitlistSchema = `
+	CREATE TABLE IF NOT EXISTS waitlist (
+		email TEXT PRIMARY KEY,
+		status TEXT,
+		location TEXT,
+		region TEXT,
+		care_needs TEXT,
+		schedule_requirements TEXT,
+		special_requirements TEXT,
+		budget REAL,
+		joined_at TIMESTAMP,
+		updated_at TIMESTAMP,
+		matched_at TIMESTAMP,
+		matched_caregiver TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_waitlist_status ON waitlist(status)
+`
+
+// Waitlist statuses
+const (
+	WaitlistWaiting = "waiting"
+	WaitlistMatched = "matched"
+)
+
+// WaitlistEntry is a patient's place on the waitlist and the search that
+// put them there
+type WaitlistEntry struct {
+	Email                string    `json:"email"`
+	Status               string    `json:"status"`
+	Location             string    `json:"location"`
+	Region               string    `json:"region"`
+	CareNeeds            string    `json:"care_needs"`
+	ScheduleRequirements string    `json:"schedule_requirements"`
+	SpecialRequirements  string    `json:"special_requirements"`
+	Budget               float64   `json:"budget"`
+	JoinedAt             time.Time `json:"joined_at"`
+	UpdatedAt            time.Time `json:"updated_at"`
+	MatchedAt            time.Time `json:"matched_at,omitempty"`
+	MatchedCaregiver     string    `json:"matched_caregiver,omitempty"`
+}
+
+// WaitlistRegion counts the patients waiting in one region
+type WaitlistRegion struct {
+	Region  string    `json:"region"`
+	Waiting int       `json:"waiting"`
+	Since   time.Time `json:"since"` // When the longest-waiting joined
+}
+
+const waitlistColumns = `email, status, location, region, care_needs, schedule_requirements, special_requirements,
+	budget, joined_at, updated_at, matched_at, matched_caregiver`
+
+func (app *App) queryWaitlist(where string, args ...interface{}) ([]WaitlistEntry, error) {
+	result, err := app.db.Query("SELECT "+waitlistColumns+" FROM waitlist "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query waitlist: %v", err)
+	}
+	defer result.Close()
+
+	var entries []WaitlistEntry
+	err = result.Iterate(func(r *chai.Row) error {
+		var e WaitlistEntry
+		if err := r.Scan(&e.Email, &e.Status, &e.Location, &e.Region, &e.CareNeeds, &e.ScheduleRequirements,
+			&e.SpecialRequirements, &e.Budget, &e.JoinedAt, &e.UpdatedAt, &e.MatchedAt, &e.MatchedCaregiver); err != nil {
+			return fmt.Errorf("failed to scan waitlist entry: %v", err)
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// WaitlistEntry returns a patient's waitlist entry, or nil if they've
+// never been on it
+func (app *App) WaitlistEntry(email string) (*WaitlistEntry, error) {
+	entries, err := app.queryWaitlist("WHERE email = ?", email)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return &entries[0], nil
+}
+
+// updateWaitlist records the outcome of a patient's search: with no
+// caregivers they join the waitlist, or their criteria are brought up to
+// date; with some they leave it
+func (app *App) updateWaitlist(p *Patient, caregivers []Caregiver) error {
+	entry, err := app.WaitlistEntry(p.Email)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	if len(caregivers) > 0 {
+		if entry == nil || entry.Status != WaitlistWaiting {
+			return nil
+		}
+		err := app.db.Exec("UPDATE waitlist SET status = ?, matched_at = ?, matched_caregiver = ? WHERE email = ?",
+			WaitlistMatched, now, caregivers[0].Email, p.Email)
+		if err != nil {
+			return fmt.Errorf("failed to update waitlist: %v", err)
+		}
+		return nil
+	}
+
+	if entry == nil {
+		err = app.db.Exec(`
+			INSERT INTO waitlist (`+waitlistColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, p.Email, WaitlistWaiting, p.Location, locationKey(p.Location), p.CareNeeds, p.ScheduleRequirements,
+			p.SpecialRequirements, p.Budget, now, now, time.Time{}, "")
+	} else if entry.Status != WaitlistWaiting {
+		err = app.db.Exec(`
+			UPDATE waitlist SET status = ?, location = ?, region = ?, care_needs = ?, schedule_requirements = ?,
+				special_requirements = ?, budget = ?, joined_at = ?, updated_at = ?, matched_at = ?, matched_caregiver = ?
+			WHERE email = ?
+		`, WaitlistWaiting, p.Location, locationKey(p.Location), p.CareNeeds, p.ScheduleRequirements,
+			p.SpecialRequirements, p.Budget, now, now, time.Time{}, "", p.Email)
+	} else if entry.Location != p.Location || entry.CareNeeds != p.CareNeeds || entry.Budget != p.Budget ||
+		entry.ScheduleRequirements != p.ScheduleRequirements || entry.SpecialRequirements != p.SpecialRequirements {
+		err = app.db.Exec(`
+			UPDATE waitlist SET location = ?, region = ?, care_needs = ?, schedule_requirements = ?,
+				special_requirements = ?, budget = ?, updated_at = ?
+			WHERE email = ?
+		`, p.Location, locationKey(p.Location), p.CareNeeds, p.ScheduleRequirements,
+			p.SpecialRequirements, p.Budget, now, p.Email)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store waitlist entry: %v", err)
+	}
+	return nil
+}
+
+// matchWaitlist searches again for every waiting patient once a caregiver
+// registers, and tells those the caregiver fits about them
+func (app *App) matchWaitlist(caregiverEmail string) error {
+	waiting, err := app.queryWaitlist("WHERE status = ?", WaitlistWaiting)
+	if err != nil {
+		return err
+	}
+	for _, entry := range waiting {
+		caregivers, err := app.FindMatchingCaregivers(entry.Email)
+		if err != nil {
+			log.Printf("Error searching again for waitlisted patient %s: %v", entry.Email, err)
+			continue
+		}
+		for _, c := range caregivers {
+			if c.Email != caregiverEmail {
+				continue
+			}
+			err := app.db.Exec("UPDATE waitlist SET matched_caregiver = ? WHERE email = ?", c.Email, entry.Email)
+			if err != nil {
+				return fmt.Errorf("failed to update waitlist: %v", err)
+			}
+			app.notifyLogged(Notification{
+				Email: entry.Email,
+				Kind:  NotifyWaitlistMatch,
+				Data: map[string]interface{}{
+					"Caregiver": c.Name,
+					"Location":  c.Location,
+					"Rate":      fmt.Sprintf("$%.2f", c.RateExpectations),
+					"Waited":    describeLead(int(time.Since(entry.JoinedAt).Minutes())),
+				},
+			})
+			break
+		}
+	}
+	return nil
+}
+
+// subscribeWaitlist searches the waitlist again as caregivers register
+func (app *App) subscribeWaitlist() {
+	app.events.Subscribe(EventCaregiverRegistered, func(e Event) {
+		email, _ := e.Data["email"].(string)
+		if err := app.matchWaitlist(email); err != nil {
+			log.Printf("Error matching the waitlist to %s: %v", email, err)
+		}
+	})
+}
+
+// WaitlistByRegion counts waiting patients by region, most first. Regions
+// are normalized locations; each is shown as its first patient wrote it.
+func (app *App) WaitlistByRegion() ([]WaitlistRegion, error) {
+	waiting, err := app.queryWaitlist("WHERE status = ?", WaitlistWaiting)
+	if err != nil {
+		return nil, err
+	}
+	byRegion := map[string]*WaitlistRegion{}
+	var regions []*WaitlistRegion
+	for _, e := range waiting {
+		r := byRegion[e.Region]
+		if r == nil {
+			r = &WaitlistRegion{Region: e.Location, Since: e.JoinedAt}
+			if e.Region == "" {
+				r.Region = "Unknown"
+			}
+			byRegion[e.Region] = r
+			regions = append(regions, r)
+		}
+		r.Waiting++
+		if e.JoinedAt.Before(r.Since) {
+			r.Since = e.JoinedAt
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		if regions[i].Waiting != regions[j].Waiting {
+			return regions[i].Waiting > regions[j].Waiting
+		}
+		return regions[i].Region < regions[j].Region
+	})
+	counts := []WaitlistRegion{}
+	for _, r := range regions {
+		counts = append(counts, *r)
+	}
+	return counts, nil
+}
+
+// handleWaitlistAPI returns a patient's waitlist entry
+func handleWaitlistAPI(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	entry, err := chatRoom.WaitlistEntry(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entry == nil {
+		http.Error(w, "Not on the waitlist", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, entry)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chaisql/chai"
+)
+
+// Users can chat with the assistant on WhatsApp through Twilio. A message
+// from a phone number someone has verified links WhatsApp to their
+// account, and from then on their messages run through the same chat
+// turns as the chat page. Linking also opts them in to notifications on
+// WhatsApp. WhatsApp only allows free-form messages within a day of the
+// user's last message, so notifications outside that window go out as the
+// approved template configured for their kind, and are skipped if there
+// isn't one. Replying STOP unlinks.
+//
+// Twilio is configured from the environment: TWILIO_ACCOUNT_SID,
+// TWILIO_AUTH_TOKEN and TWILIO_WHATSAPP_FROM, the WhatsApp sender number.
+
+const whatsAppSchema = `
+	CREATE TABLE IF NOT EXISTS whatsapp_links (
+		email TEXT PRIMARY KEY,
+		phone_number TEXT,
+		linked_at TIMESTAMP,
+		last_inbound_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_whatsapp_links_phone ON whatsapp_links(phone_number)
+`
+
+// whatsAppSessionWindow is how long after a user's last message WhatsApp
+// allows free-form messages to them
+const whatsAppSessionWindow = 24 * time.Hour
+
+// whatsAppMaxText is the longest message body Twilio sends to WhatsApp
+const whatsAppMaxText = 1600
+
+// whatsAppSender sends WhatsApp messages through the Twilio Messages API
+type whatsAppSender struct {
+	accountSID string
+	authToken  string
+	from       string // E.164
+	client     *http.Client
+}
+
+// newWhatsAppSender returns nil if WhatsApp is not set up
+func newWhatsAppSender() *whatsAppSender {
+	accountSID := os.Getenv("TWILIO_ACCOUNT_SID")
+	authToken := os.Getenv("TWILIO_AUTH_TOKEN")
+	from := strings.TrimPrefix(os.Getenv("TWILIO_WHATSAPP_FROM"), "whatsapp:")
+	if accountSID == "" || authToken == "" || from == "" {
+		return nil
+	}
+	return &whatsAppSender{
+		accountSID: accountSID,
+		authToken:  authToken,
+		from:       from,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *whatsAppSender) send(form url.Values) error {
+	endpoint := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", s.accountSID)
+	form.Set("From", "whatsapp:"+s.from)
+	request, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	request.SetBasicAuth(s.accountSID, s.authToken)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to send WhatsApp message: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("WhatsApp message failed with status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// Send sends free-form text, split to fit Twilio's limit
+func (s *whatsAppSender) Send(to, text string) error {
+	for len(text) > 0 {
+		part := text
+		if len(part) > whatsAppMaxText {
+			cut := strings.LastIndex(part[:whatsAppMaxText], "\n")
+			if cut <= 0 {
+				cut = whatsAppMaxText
+			}
+			part = part[:cut]
+		}
+		text = strings.TrimLeft(text[len(part):], "\n")
+		if err := s.send(url.Values{"To": {"whatsapp:" + to}, "Body": {part}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendTemplate sends an approved template with its {{1}} variable set
+func (s *whatsAppSender) SendTemplate(to, contentSID, text string) error {
+	variables, err := json.Marshal(map[string]string{"1": text})
+	if err != nil {
+		return fmt.Errorf("failed to encode template variables: %v", err)
+	}
+	return s.send(url.Values{
+		"To":               {"whatsapp:" + to},
+		"ContentSid":       {contentSID},
+		"ContentVariables": {string(variables)},
+	})
+}
+
+// validSignature checks Twilio's X-Twilio-Signature on a form post: the
+// HMAC-SHA1, keyed by the auth token, of the URL Twilio called followed by
+// each parameter's name and value in name order
+func (s *whatsAppSender) validSignature(r *http.Request) bool {
+	data := config.Email.BaseURL + r.URL.RequestURI()
+	names := make([]string, 0, len(r.PostForm))
+	for name := range r.PostForm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range r.PostForm[name] {
+			data += name + value
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(s.authToken))
+	mac.Write([]byte(data))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Twilio-Signature")), []byte(expected)) == 1
+}
+
+var (
+	whatsAppLink   = regexp.MustCompile(`<a href="([^"]*)">(.*?)</a>`)
+	whatsAppMarkup = regexp.MustCompile(`</?[a-z]+>`)
+)
+
+// whatsAppText turns an assistant message into WhatsApp's plain text with
+// *bold* and _italic_, starting from the Telegram form, which has already
+// dropped everything but simple formatting and links
+func whatsAppText(content string) string {
+	text := telegramHTML(content)
+	text = whatsAppLink.ReplaceAllStringFunc(text, func(a string) string {
+		m := whatsAppLink.FindStringSubmatch(a)
+		if m[2] == m[1] {
+			return m[1]
+		}
+		return m[2] + " (" + m[1] + ")"
+	})
+	text = strings.NewReplacer("<b>", "*", "</b>", "*", "<i>", "_", "</i>", "_").Replace(text)
+	text = whatsAppMarkup.ReplaceAllString(text, "")
+	return html.UnescapeString(text)
+}
+
+// verifiedEmailForPhone returns the user who most recently verified a
+// phone number that's still theirs, or ""
+func (app *App) verifiedEmailForPhone(phone string) (string, error) {
+	result, err := app.db.Query(`
+		SELECT email FROM phone_verifications WHERE phone_number = ?
+		ORDER BY phone_verified_at DESC
+	`, phone)
+	if err != nil {
+		return "", fmt.Errorf("failed to query phone verifications: %v", err)
+	}
+	var emails []string
+	err = result.Iterate(func(r *chai.Row) error {
+		var email string
+		if err := r.Scan(&email); err != nil {
+			return fmt.Errorf("failed to scan phone verification: %v", err)
+		}
+		emails = append(emails, email)
+		return nil
+	})
+	result.Close()
+	if err != nil {
+		return "", err
+	}
+	for _, email := range emails {
+		verifiedAt, err := app.PhoneVerifiedAt(email)
+		if err != nil {
+			return "", err
+		}
+		if !verifiedAt.IsZero() {
+			return email, nil
+		}
+	}
+	return "", nil
+}
+
+// linkWhatsApp records a message from a user's WhatsApp number, linking it
+// if it isn't already
+func (app *App) linkWhatsApp(email, phone string) error {
+	now := time.Now()
+	linked, err := rowExists(app.db, "SELECT email FROM whatsapp_links WHERE email = ? AND phone_number = ?", email, phone)
+	if err != nil {
+		return err
+	}
+	if linked {
+		err = app.db.Exec("UPDATE whatsapp_links SET last_inbound_at = ? WHERE email = ?", now, email)
+	} else {
+		err = app.db.Exec(`
+			INSERT INTO whatsapp_links (email, phone_number, linked_at, last_inbound_at)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT DO REPLACE
+		`, email, phone, now, now)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store WhatsApp link: %v", err)
+	}
+	return nil
+}
+
+// UnlinkWhatsApp stops WhatsApp chat and notifications for a user
+func (app *App) UnlinkWhatsApp(email string) error {
+	if err := app.db.Exec("DELETE FROM whatsapp_links WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to remove WhatsApp link: %v", err)
+	}
+	return nil
+}
+
+// whatsAppLinkFor returns a user's linked WhatsApp number and when they
+// last wrote from it, or "" if they haven't linked one. A number that's no
+// longer their verified one doesn't count.
+func (app *App) whatsAppLinkFor(email string) (string, time.Time, error) {
+	result, err := app.db.Query("SELECT phone_number, last_inbound_at FROM whatsapp_links WHERE email = ?", email)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to query WhatsApp link: %v", err)
+	}
+	defer result.Close()
+
+	var phone string
+	var lastInbound time.Time
+	err = result.Iterate(func(r *chai.Row) error {
+		return r.Scan(&phone, &lastInbound)
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to scan WhatsApp link: %v", err)
+	}
+	if phone == "" {
+		return "", time.Time{}, nil
+	}
+	if current, err := app.PhoneNumberFor(email); err != nil || current != phone {
+		return "", time.Time{}, err
+	}
+	return phone, lastInbound, nil
+}
+
+// notifyWhatsApp sends a notification's subject to a user's linked
+// WhatsApp, as free-form text inside the session window and as the kind's
+// template outside it. Users without a link, and kinds without a template
+// outside the window, are skipped.
+func (app *App) notifyWhatsApp(n Notification, subject string) error {
+	phone, lastInbound, err := app.whatsAppLinkFor(n.Email)
+	if err != nil || phone == "" {
+		return err
+	}
+	if time.Since(lastInbound) < whatsAppSessionWindow {
+		return app.whatsapp.Send(phone, subject)
+	}
+	if contentSID := config.WhatsApp.Templates[n.Kind]; contentSID != "" {
+		return app.whatsapp.SendTemplate(phone, contentSID, subject)
+	}
+	return nil
+}
+
+// chatURL opens a WhatsApp chat with the app's number
+func (s *whatsAppSender) chatURL() string {
+	return "https://wa.me/" + strings.TrimPrefix(s.from, "+")
+}
+
+// handleWhatsAppWebhook takes incoming WhatsApp messages from Twilio. The
+// reply goes out through the API once the chat turn finishes, so Twilio
+// gets an empty response straight away.
+func handleWhatsAppWebhook(w http.ResponseWriter, r *http.Request) {
+	sender := chatRoom.whatsapp
+	if sender == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	if !sender.validSignature(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	io.WriteString(w, "<Response></Response>")
+
+	phone, err := normalizePhone(strings.TrimPrefix(r.PostForm.Get("From"), "whatsapp:"))
+	text := strings.TrimSpace(r.PostForm.Get("Body"))
+	if err != nil || text == "" {
+		return
+	}
+	go func() {
+		if err := chatRoom.handleWhatsAppMessage(phone, text); err != nil {
+			log.Printf("Error handling WhatsApp message from %s: %v", phone, err)
+		}
+	}()
+}
+
+// handleWhatsAppMessage acts on one message from a WhatsApp number
+func (app *App) handleWhatsAppMessage(phone, text string) error {
+	email, err := app.verifiedEmailForPhone(phone)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return app.whatsapp.Send(phone, "To chat here, add this number on "+config.Email.BaseURL+" and verify it, then message us again.")
+	}
+	if strings.EqualFold(text, "STOP") {
+		if err := app.UnlinkWhatsApp(email); err != nil {
+			return err
+		}
+		return app.whatsapp.Send(phone, "You won't get messages from "+config.Branding.Name+" here any more. Send anything to start again.")
+	}
+	if err := app.linkWhatsApp(email, phone); err != nil {
+		return err
+	}
+	if status := maintenance.Status(); status.Enabled {
+		return app.whatsapp.Send(phone, status.Message)
+	}
+
+	replies, err := app.ChatTurnReplies(email, text)
+	if err != nil {
+		app.whatsapp.Send(phone, "Sorry, something went wrong. Please try again.")
+		return err
+	}
+	if len(replies) == 0 {
+		return nil
+	}
+	for i, reply := range replies {
+		replies[i] = whatsAppText(reply)
+	}
+	return app.whatsapp.Send(phone, strings.Join(replies, "\n\n"))
+}
@@ -2,7 +2,10 @@ module github.com/rfielding/helper2
 
 go 1.22.5
 
-require github.com/chaisql/chai v0.16.0
+require (
+	github.com/chaisql/chai v0.16.0
+	github.com/prometheus/client_golang v1.17.0
+)
 
 require (
 	github.com/DataDog/zstd v1.5.5 // indirect
@@ -22,7 +25,6 @@ require (
 	github.com/kr/text v0.2.0 // indirect
 	github.com/matttproud/golang_protobuf_extensions/v2 v2.0.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/prometheus/client_golang v1.17.0 // indirect
 	github.com/prometheus/client_model v0.5.0 // indirect
 	github.com/prometheus/common v0.45.0 // indirect
 	github.com/prometheus/procfs v0.12.0 // indirect
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// API versions: /api/v1 changes only additively. A breaking change ships
+// as /api/v2, and v1 then answers with Deprecation and Link headers naming
+// its successor until it's removed; the README has the full policy. The
+// unversioned /api paths from before versioning are deprecated already.
+
+// APIVersion marks responses with the API version that served them
+func APIVersion(version string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("API-Version", version)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DeprecatedAlias serves an old path unchanged, with headers pointing
+// clients at successor
+func DeprecatedAlias(successor string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithJSONSuffix treats a path ending in .json as the same path asking for
+// JSON, so /match.json?... is /match?... with Accept: application/json
+func WithJSONSuffix(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path := strings.TrimSuffix(r.URL.Path, ".json"); path != r.URL.Path && path != "" {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = path
+			r2.URL.RawPath = ""
+			r2.Header.Set("Accept", "application/json")
+			r = r2
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WantsJSON reports whether the request's Accept header prefers JSON to
+// HTML. Browsers list text/html first, so they keep getting pages.
+func WantsJSON(r *http.Request) bool {
+	jsonQ, htmlQ := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				q = f
+			}
+		}
+		switch mediaType {
+		case "application/json":
+			jsonQ = q
+		case "text/html":
+			htmlQ = q
+		}
+	}
+	return jsonQ > 0 && jsonQ > htmlQ
+}
+
+// Negotiate serves page to browsers and api to clients asking for JSON
+func Negotiate(page, api http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if WantsJSON(r) {
+			api(w, r)
+			return
+		}
+		page(w, r)
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type requestIDKey struct{}
+
+// requestIDPattern limits IDs accepted from a proxy to something safe to
+// log and echo
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// WithRequestID gives each request an ID, reusing a proxy's X-Request-ID
+// when it looks sane, and returns it in the response's X-Request-ID
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID returns the ID WithRequestID gave r, or "" outside the router
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// statusRecorder remembers the status a handler wrote. It passes Flush
+// through, since event streams need it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// code is the status written, or 200 if the handler wrote nothing
+func (s *statusRecorder) code() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// WithRecovery turns a panicking handler into a 500 and logs the stack,
+// rather than dropping the connection, for the middleware outside it to
+// render
+func WithRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Printf("Panic serving %s %s [%s]: %v\n%s", r.Method, r.URL.Path, RequestID(r), err, debug.Stack())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WithLogging logs each request with its status and duration
+func WithLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		log.Printf("%s %s %d %s [%s]", r.Method, r.URL.Path, rec.code(), time.Since(started).Round(time.Microsecond), RequestID(r))
+	})
+}
+
+var httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "helper2_http_request_duration_seconds",
+	Help:    "Time to serve HTTP requests, by route pattern.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"route", "method", "code"})
+
+func init() {
+	prometheus.MustRegister(httpRequestDuration)
+}
+
+// WithMetrics times requests into httpRequestDuration under route, the
+// pattern the handler was registered with, so labels stay bounded
+func WithMetrics(route string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			method := r.Method
+			switch method {
+			case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE":
+			default:
+				method = "other"
+			}
+			httpRequestDuration.WithLabelValues(route, method, strconv.Itoa(rec.code())).Observe(time.Since(started).Seconds())
+		})
+	}
+}
+
+// IsSafeMethod reports whether a method only reads
+func IsSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// IsWebhook reports whether a path receives provider callbacks, which
+// aren't browser requests and come in bursts
+func IsWebhook(path string) bool {
+	return strings.HasPrefix(path, "/webhooks/")
+}
+
+// CheckOrigin refuses state-changing requests that a browser says came
+// from another site, which is how cross-site request forgery arrives.
+// Browsers send Origin with every such request, so one with neither
+// Origin nor Referer is refused too; scripts must send an Origin naming
+// this host.
+func CheckOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsSafeMethod(r.Method) || IsWebhook(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		source := r.Header.Get("Origin")
+		if source == "" {
+			source = r.Header.Get("Referer")
+		}
+		if source == "" {
+			http.Error(w, "Origin or Referer header required", http.StatusForbidden)
+			return
+		}
+		crossSite := r.Header.Get("Sec-Fetch-Site") == "cross-site"
+		if u, err := url.Parse(source); err != nil || u.Host != r.Host {
+			crossSite = true
+		}
+		if crossSite {
+			http.Error(w, "Cross-site request refused", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimiter keeps a token bucket per client address for the
+// state-changing requests of the routes it wraps
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiterIdle is how long an address's bucket is kept after its last
+// request; a full bucket is the same as none
+const rateLimiterIdle = 10 * time.Minute
+
+// NewRateLimiter returns a rate limiter with no buckets yet
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow takes a token from key's bucket, refilled at perMinute up to burst
+func (l *RateLimiter) Allow(key string, perMinute float64, burst int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.calls++
+	if l.calls%1000 == 0 {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > rateLimiterIdle {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * perMinute
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ClientAddr is the address a request came from
+func ClientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Limit refuses a client's state-changing requests beyond rate's allowance
+// per minute, with bursts up to its burst; a rate of zero or less turns
+// the limit off. rate is asked on every request, so a changed setting
+// applies at once.
+func (l *RateLimiter) Limit(rate func() (perMinute, burst int)) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			perMinute, burst := rate()
+			if perMinute <= 0 || IsSafeMethod(r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !l.Allow(ClientAddr(r), float64(perMinute), burst, time.Now()) {
+				w.Header().Set("Retry-After", strconv.Itoa(60/perMinute+1))
+				http.Error(w, "Too many requests; slow down and try again shortly", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
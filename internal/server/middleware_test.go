@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	handler := CheckOrigin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		method, path, origin, referer string
+		want                          int
+	}{
+		{"GET", "/", "", "", http.StatusOK},
+		{"POST", "/logout", "http://example.com", "", http.StatusOK},
+		{"POST", "/logout", "", "http://example.com/chat", http.StatusOK},
+		{"POST", "/logout", "https://evil.example", "", http.StatusForbidden},
+		{"POST", "/logout", "", "https://evil.example/", http.StatusForbidden},
+		{"POST", "/logout", "", "", http.StatusForbidden},
+		{"POST", "/webhooks/sms", "", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		if c.referer != "" {
+			req.Header.Set("Referer", c.referer)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s %s with Origin %q, Referer %q: got %d, want %d",
+				c.method, c.path, c.origin, c.referer, rec.Code, c.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Package server is the HTTP plumbing under helper2: a router that
+// registers each route with its own middleware and versions its APIs, and
+// the middleware that doesn't need the app, such as request IDs, logging,
+// metrics, panic recovery, origin checks and rate limits. The handlers,
+// and the middleware that reads the app's database or config, stay in
+// cmd/helper2.
+package server
+
+import "net/http"
+
+// Middleware wraps a handler with behaviour shared across routes
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h in mws, the first outermost
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Router registers handlers on a mux, each wrapped in its own middleware
+// and timed under its route pattern
+type Router struct {
+	Mux     *http.ServeMux
+	version string
+}
+
+// NewRouter returns a router on a new mux serving APIs at /api/<version>
+func NewRouter(version string) *Router {
+	return &Router{Mux: http.NewServeMux(), version: version}
+}
+
+// Handle serves h at pattern, inside mws
+func (rt *Router) Handle(pattern string, h http.HandlerFunc, mws ...Middleware) {
+	rt.Mux.Handle(pattern, Chain(h, append([]Middleware{WithMetrics(pattern)}, mws...)...))
+}
+
+// API registers an API at /api/<version> + path. The unversioned /api +
+// path it replaced stays as a deprecated alias until the next version
+// ships.
+func (rt *Router) API(path string, h http.HandlerFunc, mws ...Middleware) {
+	current := "/api/" + rt.version + path
+	rt.Handle(current, h, append([]Middleware{APIVersion(rt.version)}, mws...)...)
+	rt.Handle("/api"+path, h, append([]Middleware{DeprecatedAlias(current)}, mws...)...)
+}